@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP access log. ACCESS_LOG_SAMPLE=0.1 logs one request in ten, chosen at
+// random, as a logfmt line:
+//
+//	access method=PUT route=/display/value status=200 bytes=11 duration_ms=184.2 remote=10.0.0.7:51234
+//
+// route is the pattern that served the request, so /registers/40001 and
+// /registers/40002 count together. With SLOW_REQUEST_MS set, a request
+// that takes longer is always logged, at warn level and with the full
+// path, query, user agent and body size, and counted in /metrics overall
+// (slow_requests) and per route (slow_requests_by_route), which shows
+// which endpoints stall while the serial bus is congested. Streams
+// (/status/stream, /logs/stream) last as long as their clients and are
+// never slow.
+
+type accessLog struct {
+	sample float64       // ACCESS_LOG_SAMPLE: fraction of requests logged
+	slow   time.Duration // SLOW_REQUEST_MS; 0 disables
+
+	slowCount atomic.Uint64
+	mu        sync.Mutex
+	slowRoute map[string]uint64
+}
+
+func newAccessLog(cfg Config) *accessLog {
+	if cfg.AccessLogSample <= 0 && cfg.SlowRequest <= 0 {
+		return nil
+	}
+	return &accessLog{sample: cfg.AccessLogSample, slow: cfg.SlowRequest, slowRoute: map[string]uint64{}}
+}
+
+func (a *accessLog) slowRequests() uint64 {
+	if a == nil {
+		return 0
+	}
+	return a.slowCount.Load()
+}
+
+func (a *accessLog) noteSlow(route string) {
+	a.slowCount.Add(1)
+	a.mu.Lock()
+	a.slowRoute[route]++
+	a.mu.Unlock()
+}
+
+// slowByRoute returns the per-route counts, by route.
+func (a *accessLog) slowByRoute() ([]string, map[string]uint64) {
+	if a == nil {
+		return nil, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	counts := make(map[string]uint64, len(a.slowRoute))
+	routes := make([]string, 0, len(a.slowRoute))
+	for r, n := range a.slowRoute {
+		counts[r] = n
+		routes = append(routes, r)
+	}
+	sort.Strings(routes)
+	return routes, counts
+}
+
+// accessWriter records what a handler answered.
+type accessWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	streamed bool // the handler flushed: a stream, not a request
+}
+
+func (aw *accessWriter) WriteHeader(code int) {
+	if aw.status == 0 {
+		aw.status = code
+	}
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *accessWriter) Write(p []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(p)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+func (aw *accessWriter) Flush() {
+	aw.streamed = true
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// withAccessLog logs the requests next serves; mux names their routes.
+func (d *ModbusDriver) withAccessLog(mux *http.ServeMux, next http.Handler) http.Handler {
+	a := d.access
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		aw := &accessWriter{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(aw, r)
+		elapsed := time.Since(start)
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+		slow := a.slow > 0 && elapsed >= a.slow && !aw.streamed
+		if slow {
+			a.noteSlow(route)
+		} else if a.sample <= 0 || rand.Float64() >= a.sample {
+			return
+		}
+		fields := [][2]string{
+			{"method", r.Method}, {"route", route}, {"status", strconv.Itoa(aw.status)},
+			{"bytes", strconv.FormatInt(aw.bytes, 10)},
+			{"duration_ms", strconv.FormatFloat(float64(elapsed.Microseconds())/1000, 'f', 1, 64)},
+			{"remote", r.RemoteAddr},
+		}
+		msg := "access"
+		if slow {
+			msg = fmt.Sprintf("slow request (over %v): access", a.slow)
+			fields = append(fields, [][2]string{
+				{"path", r.URL.Path}, {"query", r.URL.RawQuery},
+				{"request_bytes", strconv.FormatInt(r.ContentLength, 10)}, {"user_agent", r.UserAgent()},
+			}...)
+		}
+		d.logger.Print(msg + " " + logfmt(fields))
+	})
+}
+
+// logfmt renders key=value pairs, quoting values that need it.
+func logfmt(fields [][2]string) string {
+	var b strings.Builder
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f[0])
+		b.WriteByte('=')
+		if f[1] == "" || strings.ContainsAny(f[1], " =") || strconv.Quote(f[1]) != `"`+f[1]+`"` {
+			b.WriteString(strconv.Quote(f[1]))
+		} else {
+			b.WriteString(f[1])
+		}
+	}
+	return b.String()
+}
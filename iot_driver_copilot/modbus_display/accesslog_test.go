@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogfmt(t *testing.T) {
+	got := logfmt([][2]string{{"route", "/registers/"}, {"query", ""}, {"user_agent", "curl/8.0 (x)"}, {"path", `/a"b`}})
+	if want := `route=/registers/ query="" user_agent="curl/8.0 (x)" path="/a\"b"`; got != want {
+		t.Errorf("logfmt = %s, want %s", got, want)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	d := &ModbusDriver{logger: log.New(&out, "", 0), access: newAccessLog(Config{SlowRequest: 30 * time.Millisecond})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) })
+	mux.HandleFunc("/registers/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(40 * time.Millisecond)
+		http.Error(w, "device read error", http.StatusBadGateway)
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		time.Sleep(40 * time.Millisecond)
+	})
+	h := d.withAccessLog(mux, mux)
+	for _, path := range []string{"/fast", "/registers/40001?count=2", "/registers/40002", "/stream"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("User-Agent", "probe")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || d.access.slowRequests() != 2 {
+		t.Fatalf("%d slow requests, logged:\n%s", d.access.slowRequests(), out.String())
+	}
+	for _, want := range []string{"slow request (over 30ms): access method=GET route=/registers/ status=502 bytes=", `path=/registers/40001 query="count=2"`, "user_agent=probe"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("slow line %q lacks %q", lines[0], want)
+		}
+	}
+	if logLevel(lines[0]) != "warn" {
+		t.Errorf("slow line at level %s", logLevel(lines[0]))
+	}
+	if routes, counts := d.access.slowByRoute(); len(routes) != 1 || counts["/registers/"] != 2 {
+		t.Errorf("by route %v %v", routes, counts)
+	}
+
+	// With every request sampled, fast ones are logged too, briefly.
+	out.Reset()
+	d.access = newAccessLog(Config{AccessLogSample: 1})
+	h = d.withAccessLog(mux, mux)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fast", nil))
+	if line := out.String(); !strings.HasPrefix(line, "access method=GET route=/fast status=200 bytes=2 duration_ms=") || strings.Contains(line, "user_agent") {
+		t.Errorf("sampled line %q", line)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alarm rules are read from ALARM_RULES_FILE, or given inline in ALARM_RULES,
+// one rule per line (or separated by ';'):
+//
+//	when <field> <op> <value> [for <dur>] [clear <dur>] [hysteresis <n>] -> webhook <url>
+//	when <field> <op> <value> ... -> mqtt [topic] <topic>
+//	when <field> <op> <value> ... -> email <addr>[,<addr>...]
+//	when <field> <op> <value> ... -> telegram <chat_id>
+//
+// <field> is any /status JSON field, "online" (false while the device is unreachable),
+// or "value_stale" (see freshness.go).
+// "for" debounces raising, "clear" debounces clearing, and "hysteresis" widens the
+// numeric threshold an active alarm must fall back across before it clears.
+
+type AlarmRule struct {
+	Text       string
+	Field      string
+	Op         string
+	Value      interface{} // float64, bool or string
+	Literal    string      // value as written, for text comparison
+	For        time.Duration
+	Clear      time.Duration
+	Hysteresis float64
+	Action     string // "webhook", "mqtt", "email" or "telegram"
+	Target     string
+}
+
+type AlarmState struct {
+	ID          int         `json:"id"`
+	Rule        string      `json:"rule"`
+	Field       string      `json:"field"`
+	State       string      `json:"state"` // ok, pending, active, clearing
+	Value       interface{} `json:"value,omitempty"`
+	Since       *time.Time  `json:"since,omitempty"`
+	LastRaised  *time.Time  `json:"last_raised,omitempty"`
+	LastCleared *time.Time  `json:"last_cleared,omitempty"`
+	RaiseCount  int         `json:"raise_count"`
+}
+
+type AlarmEvent struct {
+	Rule      string      `json:"rule"`
+	Field     string      `json:"field"`
+	Event     string      `json:"event"` // raised, cleared
+	Value     interface{} `json:"value"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+type alarmTracker struct {
+	rule          AlarmRule
+	state         AlarmState
+	pendingSince  time.Time
+	clearingSince time.Time
+}
+
+type AlarmEngine struct {
+	mu       sync.Mutex
+	trackers []*alarmTracker
+	notifier *Notifier
+	logger   *log.Logger
+	mapping  *statusMapping // renames Field in events
+}
+
+func LoadAlarmEngine(path string, notifier *Notifier, logger *log.Logger) (*AlarmEngine, error) {
+	e := &AlarmEngine{notifier: notifier, logger: logger}
+	if path == "" {
+		return e, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := e.SetRules(string(raw))
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("loaded %d alarm rules from %s", n, path)
+	return e, nil
+}
+
+// SetRules replaces the rules with those in src and returns how many there
+// are. A rule whose text is unchanged keeps its state, so an alarm that is
+// active stays active (and is not raised again) across the swap.
+func (e *AlarmEngine) SetRules(src string) (int, error) {
+	rules, err := ParseAlarmRules(src)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range rules {
+		if err := e.checkChannel(r); err != nil {
+			return 0, fmt.Errorf("rule %q %w", r.Text, err)
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old := map[string]*alarmTracker{}
+	for _, t := range e.trackers {
+		old[t.rule.Text] = t
+	}
+	trackers := make([]*alarmTracker, 0, len(rules))
+	for i, r := range rules {
+		t, ok := old[r.Text]
+		if ok {
+			delete(old, r.Text) // a duplicated rule gets a fresh tracker
+		} else {
+			t = &alarmTracker{rule: r, state: AlarmState{Rule: r.Text, Field: r.Field, State: "ok"}}
+		}
+		t.state.ID = i + 1
+		trackers = append(trackers, t)
+	}
+	e.trackers = trackers
+	return len(rules), nil
+}
+
+// checkChannel reports a rule whose notification channel isn't configured.
+func (e *AlarmEngine) checkChannel(r AlarmRule) error {
+	switch {
+	case r.Action == "mqtt" && !e.notifier.MQTTEnabled():
+		return errors.New("publishes to MQTT but MQTT_BROKER is not set")
+	case r.Action == "email" && !e.notifier.EmailEnabled():
+		return errors.New("sends email but SMTP_HOST or SMTP_FROM is not set")
+	case r.Action == "telegram" && !e.notifier.TelegramEnabled():
+		return errors.New("sends to Telegram but TELEGRAM_BOT_TOKEN is not set")
+	}
+	return nil
+}
+
+func ParseAlarmRules(src string) ([]AlarmRule, error) {
+	var rules []AlarmRule
+	for _, line := range strings.FieldsFunc(src, func(r rune) bool { return r == '\n' || r == ';' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseAlarmRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", line, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseAlarmRule(line string) (AlarmRule, error) {
+	r := AlarmRule{Text: line}
+	cond, action, ok := strings.Cut(line, "->")
+	if !ok {
+		return r, fmt.Errorf("missing '->'")
+	}
+	tok := strings.Fields(cond)
+	if len(tok) < 4 || tok[0] != "when" {
+		return r, fmt.Errorf("expected 'when <field> <op> <value>'")
+	}
+	r.Field = tok[1]
+	r.Op = tok[2]
+	switch r.Op {
+	case "==", "!=", ">", ">=", "<", "<=":
+	default:
+		return r, fmt.Errorf("unknown operator %q", r.Op)
+	}
+	r.Value = parseAlarmValue(tok[3])
+	r.Literal = strings.Trim(tok[3], `"'`)
+	if _, isNum := r.Value.(float64); !isNum && r.Op != "==" && r.Op != "!=" {
+		return r, fmt.Errorf("operator %s needs a numeric value", r.Op)
+	}
+	for i := 4; i < len(tok); i += 2 {
+		if i+1 >= len(tok) {
+			return r, fmt.Errorf("missing value for %q", tok[i])
+		}
+		var err error
+		switch tok[i] {
+		case "for":
+			r.For, err = time.ParseDuration(tok[i+1])
+		case "clear":
+			r.Clear, err = time.ParseDuration(tok[i+1])
+		case "hysteresis":
+			r.Hysteresis, err = strconv.ParseFloat(tok[i+1], 64)
+		default:
+			err = fmt.Errorf("unknown modifier %q", tok[i])
+		}
+		if err != nil {
+			return r, err
+		}
+	}
+
+	act := strings.Fields(action)
+	if len(act) == 3 && act[0] == "mqtt" && act[1] == "topic" {
+		act = []string{"mqtt", act[2]}
+	}
+	if len(act) != 2 {
+		return r, fmt.Errorf("action must be 'webhook <url>', 'mqtt <topic>', 'email <addr>' or 'telegram <chat_id>'")
+	}
+	switch act[0] {
+	case "webhook", "mqtt", "telegram":
+	case "email":
+		for _, a := range strings.Split(act[1], ",") {
+			if _, err := mail.ParseAddress(a); err != nil {
+				return r, fmt.Errorf("email address %q: %w", a, err)
+			}
+		}
+	default:
+		return r, fmt.Errorf("action must be 'webhook <url>', 'mqtt <topic>', 'email <addr>' or 'telegram <chat_id>'")
+	}
+	r.Action, r.Target = act[0], act[1]
+	return r, nil
+}
+
+func parseAlarmValue(s string) interface{} {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b
+	}
+	return strings.Trim(s, `"'`)
+}
+
+// matches reports whether v satisfies the rule; while active the numeric
+// threshold is relaxed by the hysteresis band so the alarm doesn't chatter.
+// A field that isn't numeric is compared with the literal as text, so only
+// == and != can match it.
+func (r AlarmRule) matches(v interface{}, active bool) bool {
+	if want, ok := r.Value.(float64); ok {
+		if got, ok := v.(float64); ok {
+			h := 0.0
+			if active {
+				h = r.Hysteresis
+			}
+			switch r.Op {
+			case "==":
+				return got == want
+			case "!=":
+				return got != want
+			case ">":
+				return got > want-h
+			case ">=":
+				return got >= want-h
+			case "<":
+				return got < want+h
+			case "<=":
+				return got <= want+h
+			}
+			return false
+		}
+	}
+	if r.Op != "==" && r.Op != "!=" {
+		return false
+	}
+	want := r.Literal
+	if b, ok := r.Value.(bool); ok {
+		want = strconv.FormatBool(b)
+	}
+	eq := fmt.Sprint(v) == want
+	if r.Op == "!=" {
+		return !eq
+	}
+	return eq
+}
+
+// Evaluate feeds one poll's worth of field values through every rule.
+// Rules whose field is absent (e.g. during an outage) keep their state.
+func (e *AlarmEngine) Evaluate(fields map[string]interface{}, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, t := range e.trackers {
+		v, ok := fields[t.rule.Field]
+		if !ok {
+			continue
+		}
+		t.state.Value = v
+		active := t.state.State == "active" || t.state.State == "clearing"
+		cond := t.rule.matches(v, active)
+		switch {
+		case !active && cond:
+			if t.pendingSince.IsZero() {
+				t.pendingSince = now
+				t.state.State = "pending"
+			}
+			if now.Sub(t.pendingSince) >= t.rule.For {
+				t.pendingSince = time.Time{}
+				t.state.State = "active"
+				t.state.Since = timePtr(now)
+				t.state.LastRaised = timePtr(now)
+				t.state.RaiseCount++
+				e.fire(t.rule, "raised", v, now)
+			}
+		case !active && !cond:
+			t.pendingSince = time.Time{}
+			t.state.State = "ok"
+		case active && !cond:
+			if t.clearingSince.IsZero() {
+				t.clearingSince = now
+				t.state.State = "clearing"
+			}
+			if now.Sub(t.clearingSince) >= t.rule.Clear {
+				t.clearingSince = time.Time{}
+				t.state.State = "ok"
+				t.state.Since = nil
+				t.state.LastCleared = timePtr(now)
+				e.fire(t.rule, "cleared", v, now)
+			}
+		case active && cond:
+			t.clearingSince = time.Time{}
+			t.state.State = "active"
+		}
+	}
+}
+
+func (e *AlarmEngine) fire(r AlarmRule, event string, v interface{}, now time.Time) {
+	e.logger.Printf("alarm %s: %s", event, r.Text)
+	ev := AlarmEvent{Rule: r.Text, Field: e.mapping.Name(r.Field), Event: event, Value: v, Timestamp: now}
+	e.notifier.Send(r.Action, r.Target, ev)
+}
+
+func (e *AlarmEngine) States() []AlarmState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]AlarmState, 0, len(e.trackers))
+	for _, t := range e.trackers {
+		out = append(out, t.state)
+	}
+	return out
+}
+
+// targets lists the webhook, MQTT, email and Telegram targets of the rules.
+func (e *AlarmEngine) targets() []notifyTarget {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]notifyTarget, 0, len(e.trackers))
+	for _, t := range e.trackers {
+		out = append(out, notifyTarget{Kind: t.rule.Action, Target: t.rule.Target})
+	}
+	return out
+}
+
+func timePtr(t time.Time) *time.Time { return &t }
+
+// statusFields flattens a DeviceStatus into its JSON field names, with
+// numbers as float64, for rule evaluation.
+func statusFields(st DeviceStatus) map[string]interface{} {
+	fields := map[string]interface{}{}
+	b, err := json.Marshal(st)
+	if err == nil {
+		_ = json.Unmarshal(b, &fields)
+	}
+	return fields
+}
+
+func (d *ModbusDriver) handleAlarms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(d.alarms.States())
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAlarmRules(t *testing.T) {
+	tests := []struct {
+		src     string
+		wantErr bool
+		want    AlarmRule
+	}{
+		{src: "when decimals > 2 -> webhook http://x/hook",
+			want: AlarmRule{Field: "decimals", Op: ">", Value: 2.0, Literal: "2", Action: "webhook", Target: "http://x/hook"}},
+		{src: "when online == false for 30s clear 1m -> mqtt topic alarms/display",
+			want: AlarmRule{Field: "online", Op: "==", Value: false, Literal: "false", For: 30 * time.Second, Clear: time.Minute, Action: "mqtt", Target: "alarms/display"}},
+		{src: "when work_mode >= 3 hysteresis 0.5 -> mqtt a/b",
+			want: AlarmRule{Field: "work_mode", Op: ">=", Value: 3.0, Literal: "3", Hysteresis: 0.5, Action: "mqtt", Target: "a/b"}},
+		{src: `when display_value == "ERR" -> webhook http://x`,
+			want: AlarmRule{Field: "display_value", Op: "==", Value: "ERR", Literal: "ERR", Action: "webhook", Target: "http://x"}},
+		{src: "when decimals > 2", wantErr: true},
+		{src: "if decimals > 2 -> webhook http://x", wantErr: true},
+		{src: "when decimals ~ 2 -> webhook http://x", wantErr: true},
+		{src: "when display_value > ERR -> webhook http://x", wantErr: true},
+		{src: "when decimals > 2 for -> webhook http://x", wantErr: true},
+		{src: "when decimals > 2 for soon -> webhook http://x", wantErr: true},
+		{src: "when decimals > 2 until 5s -> webhook http://x", wantErr: true},
+		{src: "when online == false -> email ops@example.com,oncall@example.com",
+			want: AlarmRule{Field: "online", Op: "==", Value: false, Literal: "false", Action: "email", Target: "ops@example.com,oncall@example.com"}},
+		{src: "when online == false -> telegram -1001234567",
+			want: AlarmRule{Field: "online", Op: "==", Value: false, Literal: "false", Action: "telegram", Target: "-1001234567"}},
+		{src: "when decimals > 2 -> email not-an-address", wantErr: true},
+		{src: "when decimals > 2 -> sms +15550100", wantErr: true},
+	}
+	for _, tt := range tests {
+		rules, err := ParseAlarmRules(tt.src)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.src)
+			}
+			continue
+		}
+		if err != nil || len(rules) != 1 {
+			t.Errorf("%q: rules=%v err=%v", tt.src, rules, err)
+			continue
+		}
+		got := rules[0]
+		tt.want.Text = tt.src
+		if got != tt.want {
+			t.Errorf("%q:\n got %+v\nwant %+v", tt.src, got, tt.want)
+		}
+	}
+
+	rules, err := ParseAlarmRules("# comment\nwhen a == 1 -> mqtt x; when b == 2 -> mqtt y\n\n")
+	if err != nil || len(rules) != 2 {
+		t.Fatalf("multi-rule source: rules=%d err=%v", len(rules), err)
+	}
+}
+
+func TestAlarmRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule   string
+		v      interface{}
+		active bool
+		want   bool
+	}{
+		{"when x > 10", 11.0, false, true},
+		{"when x > 10", 10.0, false, false},
+		{"when x > 10 hysteresis 2", 9.0, true, true},  // still inside the band
+		{"when x > 10 hysteresis 2", 8.0, true, false}, // fell back across it
+		{"when x < 5 hysteresis 1", 5.5, true, true},
+		{"when x != 0", "0", false, false}, // numeric literal, string field
+		{"when x != 0", "12.5", false, true},
+		{"when x == 0", "0", false, true},
+		{"when x > 0", "12.5", false, false}, // ordering needs a number
+		{"when online == false", false, false, true},
+		{"when online == True", true, false, true},
+		{"when x == HELLO", "HELLO", false, true},
+	}
+	for _, tt := range tests {
+		rules, err := ParseAlarmRules(tt.rule + " -> mqtt t")
+		if err != nil {
+			t.Fatalf("%q: %v", tt.rule, err)
+		}
+		if got := rules[0].matches(tt.v, tt.active); got != tt.want {
+			t.Errorf("%q matches(%v, active=%v) = %v, want %v", tt.rule, tt.v, tt.active, got, tt.want)
+		}
+	}
+}
+
+func newTestAlarmEngine(t *testing.T, src string) *AlarmEngine {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	// MQTT_BROKER is set so mqtt rules load; with nothing listening the
+	// deliveries just fail in the background, which these tests ignore.
+	n, err := NewNotifier(Config{MQTTBroker: "tcp://127.0.0.1:1", MQTTClientID: "test"}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ParseAlarmRules(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &AlarmEngine{notifier: n, logger: logger}
+	for i, r := range rules {
+		e.trackers = append(e.trackers, &alarmTracker{
+			rule:  r,
+			state: AlarmState{ID: i + 1, Rule: r.Text, Field: r.Field, State: "ok"},
+		})
+	}
+	return e
+}
+
+func TestAlarmEvaluateDebounceAndHysteresis(t *testing.T) {
+	e := newTestAlarmEngine(t, "when temp > 50 for 10s clear 5s hysteresis 3 -> mqtt alarms")
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		at     time.Duration
+		fields map[string]interface{}
+		state  string
+		raises int
+	}{
+		{0, map[string]interface{}{"temp": 40.0}, "ok", 0},
+		{1 * time.Second, map[string]interface{}{"temp": 55.0}, "pending", 0},
+		{5 * time.Second, map[string]interface{}{"temp": 55.0}, "pending", 0},
+		{6 * time.Second, map[string]interface{}{"temp": 45.0}, "ok", 0}, // blip resets debounce
+		{7 * time.Second, map[string]interface{}{"temp": 55.0}, "pending", 0},
+		{17 * time.Second, map[string]interface{}{"temp": 55.0}, "active", 1},
+		{18 * time.Second, map[string]interface{}{"temp": 48.0}, "active", 1}, // within hysteresis band
+		{19 * time.Second, map[string]interface{}{}, "active", 1},             // field missing: keep state
+		{20 * time.Second, map[string]interface{}{"temp": 46.0}, "clearing", 1},
+		{22 * time.Second, map[string]interface{}{"temp": 49.0}, "active", 1}, // back in band cancels clear
+		{23 * time.Second, map[string]interface{}{"temp": 40.0}, "clearing", 1},
+		{28 * time.Second, map[string]interface{}{"temp": 40.0}, "ok", 1},
+		{29 * time.Second, map[string]interface{}{"temp": 60.0}, "pending", 1},
+		{39 * time.Second, map[string]interface{}{"temp": 60.0}, "active", 2},
+	}
+	for _, st := range steps {
+		e.Evaluate(st.fields, t0.Add(st.at))
+		got := e.States()[0]
+		if got.State != st.state || got.RaiseCount != st.raises {
+			t.Fatalf("t=%v: state=%s raises=%d, want %s/%d", st.at, got.State, got.RaiseCount, st.state, st.raises)
+		}
+	}
+	if got := e.States()[0]; got.LastCleared == nil || !got.LastCleared.Equal(t0.Add(28*time.Second)) {
+		t.Fatalf("LastCleared = %v", got.LastCleared)
+	}
+}
+
+func TestAlarmEvaluateImmediate(t *testing.T) {
+	e := newTestAlarmEngine(t, "when online == false -> mqtt a; when display_value != 0 -> mqtt b")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	e.Evaluate(map[string]interface{}{"online": false}, now)
+	e.Evaluate(map[string]interface{}{"online": true, "display_value": "7"}, now.Add(time.Second))
+	states := e.States()
+	if states[0].State != "ok" || states[0].RaiseCount != 1 || states[0].LastCleared == nil {
+		t.Fatalf("online rule = %+v", states[0])
+	}
+	if states[1].State != "active" || states[1].RaiseCount != 1 {
+		t.Fatalf("display_value rule = %+v", states[1])
+	}
+}
+
+func TestAlarmSetRules(t *testing.T) {
+	e := newTestAlarmEngine(t, "when online == false -> mqtt a; when decimals > 2 -> mqtt b")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	e.Evaluate(map[string]interface{}{"online": false, "decimals": 3.0}, now)
+
+	// The online rule survives with its state; decimals is replaced.
+	n, err := e.SetRules("when work_mode == 2 -> mqtt c\nwhen online == false -> mqtt a")
+	if err != nil || n != 2 {
+		t.Fatalf("SetRules: n=%d err=%v", n, err)
+	}
+	states := e.States()
+	if states[0].Rule != "when work_mode == 2 -> mqtt c" || states[0].State != "ok" || states[0].ID != 1 {
+		t.Errorf("new rule = %+v", states[0])
+	}
+	if states[1].State != "active" || states[1].RaiseCount != 1 || states[1].ID != 2 {
+		t.Errorf("kept rule = %+v", states[1])
+	}
+
+	if _, err := e.SetRules("when online == false -> telegram 1"); err == nil {
+		t.Error("telegram rule without a bot token was accepted")
+	}
+	if len(e.States()) != 2 {
+		t.Error("a rejected rule set replaced the rules")
+	}
+}
+
+func TestAlarmConflicts(t *testing.T) {
+	kinds := map[string]string{"decimals": "number", "display_value": "text", "online": "bool"}
+	off := false
+	rules := []alarmRuleDef{
+		{ID: "hot", Rule: "when decimals > 2 -> webhook http://x"},
+		{ID: "hotter", Rule: "when decimals >= 3 for 5s -> webhook http://x"},
+		{ID: "cold", Rule: "when decimals < 2 -> webhook http://x"},
+		{ID: "edge", Rule: "when decimals <= 2 -> webhook http://y"},
+		{ID: "again", Rule: "when decimals > 2 -> webhook http://x"},
+		{ID: "typo", Rule: "when decimal > 2 -> webhook http://x"},
+		{ID: "text", Rule: "when display_value > 5 -> webhook http://x"},
+		{ID: "flag", Rule: "when online == 1 -> webhook http://x"},
+		{ID: "down", Rule: "when online == false -> webhook http://x"},
+		{ID: "up", Rule: "when online == true -> webhook http://x"},
+		{ID: "muted", Rule: "when decimals > 1 -> webhook http://x", Enabled: &off},
+	}
+	var got []string
+	for _, c := range alarmConflicts(rules, kinds) {
+		got = append(got, c.Kind+":"+strings.Join(c.Rules, ","))
+	}
+	want := []string{"unknown_field:typo", "never_matches:text", "never_matches:flag",
+		"overlap:hot,hotter", "duplicate:hot,again", "overlap:hotter,again"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("conflicts = %v\nwant %v", got, want)
+	}
+}
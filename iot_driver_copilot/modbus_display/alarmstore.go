@@ -0,0 +1,560 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alarm rules can be edited through the API as well as given in
+// ALARM_RULES or ALARM_RULES_FILE. Edited rules are kept in
+// ALARM_RULES_STORE (default alarm_rules.json in STATE_DIR) as a single
+// versioned document, which is also what export and import exchange:
+//
+//	{"schema": 1, "revision": 7, "updated_at": "2026-10-16T08:00:00Z", "rules": [
+//	  {"id": "hot", "rule": "when display_value > 80 for 30s -> webhook https://ops/hook", "enabled": true, "description": "tank too warm"}]}
+//
+//	GET    /alarms/rules       the document (export), with an ETag
+//	PUT    /alarms/rules       replaces the document (import)
+//	POST   /alarms/rules       adds a rule; 201, with an id made up if none is given
+//	GET    /alarms/rules/{id}  one rule
+//	PUT    /alarms/rules/{id}  adds or replaces a rule
+//	DELETE /alarms/rules/{id}  removes a rule
+//
+// Writes need the admin token, since a rule sends requests where it says.
+// The rules are validated as a set before anything changes, and the write
+// is refused with 400 naming the rule at fault: ids are 1-64 letters,
+// digits, '.', '_' or '-' and unique, "rule" is a single rule in the
+// ALARM_RULES syntax, and its channel is configured. A write bumps the
+// revision, is saved (the previous document is kept as .bak) and takes
+// effect at once; rules whose text is unchanged keep their state, as with
+// config sync. If-Match with the ETag of a GET makes a write fail with 412
+// when another came first. Disabled rules are kept but not evaluated.
+//
+// With dry_run=true a write is checked but not made, and the reply reports
+// what the rules would be and which of them conflict:
+//
+//	{"dry_run": true, "revision": 8, "rules": 3, "enabled": 2, "conflicts": [
+//	  {"kind": "overlap", "rules": ["hot", "very-hot"], "detail": "..."}]}
+//
+// unknown_field and never_matches are rules that can never fire: the field
+// is not one the rules see, or the comparison can't hold for its type (a
+// number compared with text, say). duplicate and overlap are pairs of
+// rules that fire together and notify the same target twice: the same rule
+// given twice, or conditions on one field that both hold for some values.
+// Conflicts don't stop a write; its reply lists them as well.
+//
+// Once a write has been saved, the store is where the rules come from:
+// at startup it takes the place of ALARM_RULES and ALARM_RULES_FILE, and
+// config sync no longer changes the rules. Until then GET shows the rules
+// those give, with ids rule-1, rule-2 and so on.
+
+const alarmRulesSchema = 1
+
+type alarmRuleDef struct {
+	ID          string `json:"id"`
+	Rule        string `json:"rule"`
+	Enabled     *bool  `json:"enabled,omitempty"` // default true
+	Description string `json:"description,omitempty"`
+}
+
+func (r alarmRuleDef) on() bool { return r.Enabled == nil || *r.Enabled }
+
+type alarmRuleDoc struct {
+	Schema    int            `json:"schema"`
+	Revision  uint64         `json:"revision"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	Rules     []alarmRuleDef `json:"rules"`
+}
+
+// source is the doc's enabled rules in the ALARM_RULES syntax.
+func (doc alarmRuleDoc) source() string {
+	var lines []string
+	for _, r := range doc.Rules {
+		if r.on() {
+			lines = append(lines, r.Rule)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+type alarmConflict struct {
+	Kind   string   `json:"kind"` // unknown_field, never_matches, duplicate or overlap
+	Rules  []string `json:"rules"`
+	Detail string   `json:"detail"`
+}
+
+type alarmRuleStore struct {
+	file *stateFile // nil without ALARM_RULES_STORE
+
+	mu        sync.Mutex // held across a write's check, save and swap
+	doc       alarmRuleDoc
+	persisted bool // doc is the store's, not ALARM_RULES'
+}
+
+// fromStore reports whether the rules come from the store.
+func (s *alarmRuleStore) fromStore() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.persisted
+}
+
+func (s *alarmRuleStore) etag() string { return fmt.Sprintf(`"alarm-rules-%d"`, s.doc.Revision) }
+
+// loadAlarmRuleStore sets up d.alarmRules once d.alarms has the rules of
+// ALARM_RULES or ALARM_RULES_FILE, replacing them with the store's.
+func (d *ModbusDriver) loadAlarmRuleStore() error {
+	s := &alarmRuleStore{doc: alarmRuleDoc{Schema: alarmRulesSchema}}
+	if d.cfg.AlarmRulesStore != "" {
+		s.file = &stateFile{path: d.cfg.AlarmRulesStore, logf: d.logger.Printf}
+		found, err := s.file.Load(&s.doc)
+		if err != nil {
+			return err
+		}
+		if found {
+			if err := d.validateAlarmRules(&s.doc); err != nil {
+				return fmt.Errorf("%s: %w", d.cfg.AlarmRulesStore, err)
+			}
+			n, err := d.alarms.SetRules(s.doc.source())
+			if err != nil {
+				return fmt.Errorf("%s: %w", d.cfg.AlarmRulesStore, err)
+			}
+			s.persisted = true
+			d.logger.Printf("loaded %d alarm rules from %s (revision %d)", n, d.cfg.AlarmRulesStore, s.doc.Revision)
+			if d.cfg.AlarmRules != "" || d.cfg.AlarmRulesFile != "" {
+				d.logger.Printf("warning: ALARM_RULES and ALARM_RULES_FILE are ignored while %s exists", d.cfg.AlarmRulesStore)
+			}
+			d.alarmRules = s
+			return nil
+		}
+	}
+	on := true
+	for i, st := range d.alarms.States() {
+		s.doc.Rules = append(s.doc.Rules, alarmRuleDef{ID: fmt.Sprintf("rule-%d", i+1), Rule: st.Rule, Enabled: &on})
+	}
+	d.alarmRules = s
+	return nil
+}
+
+var alarmRuleIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// validateAlarmRules checks doc's rules the way the engine will take them,
+// normalizing their text and filling in enabled.
+func (d *ModbusDriver) validateAlarmRules(doc *alarmRuleDoc) error {
+	if doc.Schema != 0 && doc.Schema != alarmRulesSchema {
+		return fmt.Errorf("unsupported schema %d (this driver reads schema %d)", doc.Schema, alarmRulesSchema)
+	}
+	doc.Schema = alarmRulesSchema
+	seen := map[string]bool{}
+	for i := range doc.Rules {
+		def := &doc.Rules[i]
+		if !alarmRuleIDPattern.MatchString(def.ID) {
+			return fmt.Errorf("rules[%d]: id %q must be 1-64 letters, digits, '.', '_' or '-'", i, def.ID)
+		}
+		if seen[def.ID] {
+			return fmt.Errorf("rule %q: id used twice", def.ID)
+		}
+		seen[def.ID] = true
+		if strings.ContainsAny(def.Rule, ";\n") {
+			return fmt.Errorf("rule %q: one rule per entry", def.ID)
+		}
+		def.Rule = strings.Join(strings.Fields(def.Rule), " ")
+		r, err := parseAlarmRule(def.Rule)
+		if err != nil {
+			return fmt.Errorf("rule %q: %w", def.ID, err)
+		}
+		if err := d.alarms.checkChannel(r); err != nil {
+			return fmt.Errorf("rule %q %w", def.ID, err)
+		}
+		if def.Enabled == nil {
+			on := true
+			def.Enabled = &on
+		}
+	}
+	return nil
+}
+
+// alarmFieldKinds maps the fields rules see to "number", "text" or "bool".
+func (d *ModbusDriver) alarmFieldKinds() map[string]string {
+	kinds := map[string]string{"online": "bool"}
+	if d.freshness != nil {
+		kinds["value_stale"] = "bool"
+	}
+	t := reflect.TypeOf(DeviceStatus{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.String:
+			kinds[name] = "text"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			kinds[name] = "number"
+		}
+	}
+	return kinds
+}
+
+// alarmConflicts lists the enabled rules that can never fire and the pairs
+// that fire together; rules have been validated.
+func alarmConflicts(rules []alarmRuleDef, kinds map[string]string) []alarmConflict {
+	out := []alarmConflict{}
+	type live struct {
+		id string
+		r  AlarmRule
+	}
+	var lives []live
+	for _, def := range rules {
+		if !def.on() {
+			continue
+		}
+		r, _ := parseAlarmRule(def.Rule)
+		kind, ok := kinds[r.Field]
+		if !ok {
+			out = append(out, alarmConflict{Kind: "unknown_field", Rules: []string{def.ID},
+				Detail: fmt.Sprintf("%s is not a /status field, online or value_stale (with VALUE_STALE_AFTER_MS); the rule never fires", r.Field)})
+			continue
+		}
+		if neverMatches(r, kind) {
+			out = append(out, alarmConflict{Kind: "never_matches", Rules: []string{def.ID},
+				Detail: fmt.Sprintf("%s is a %s, so %s %s %s never holds", r.Field, kind, r.Field, r.Op, r.Literal)})
+			continue
+		}
+		lives = append(lives, live{def.ID, r})
+	}
+	for i, a := range lives {
+		for _, b := range lives[i+1:] {
+			if a.r.Field != b.r.Field || a.r.Action != b.r.Action || a.r.Target != b.r.Target {
+				continue
+			}
+			ids := []string{a.id, b.id}
+			switch {
+			case a.r.Text == b.r.Text:
+				out = append(out, alarmConflict{Kind: "duplicate", Rules: ids,
+					Detail: fmt.Sprintf("the same rule twice; %s %s is notified twice", a.r.Action, a.r.Target)})
+			case conditionsOverlap(a.r, b.r):
+				out = append(out, alarmConflict{Kind: "overlap", Rules: ids,
+					Detail: fmt.Sprintf("%s %s %s and %s %s %s both hold for some values; %s %s is notified twice",
+						a.r.Field, a.r.Op, a.r.Literal, b.r.Field, b.r.Op, b.r.Literal, a.r.Action, a.r.Target)})
+			}
+		}
+	}
+	return out
+}
+
+// neverMatches reports whether r can't hold for a field of kind, following
+// AlarmRule.matches.
+func neverMatches(r AlarmRule, kind string) bool {
+	_, num := r.Value.(float64)
+	_, isBool := r.Value.(bool)
+	switch kind {
+	case "number":
+		return !num && r.Op == "=="
+	case "text":
+		return r.Op != "==" && r.Op != "!="
+	case "bool":
+		return !isBool && r.Op != "!="
+	}
+	return false
+}
+
+// conditionsOverlap reports whether some value satisfies both a and b.
+// Hysteresis is left out: it only keeps an active alarm on longer.
+func conditionsOverlap(a, b AlarmRule) bool {
+	av, aNum := a.Value.(float64)
+	bv, bNum := b.Value.(float64)
+	if aNum && bNum {
+		for _, x := range numericSpans(a.Op, av) {
+			for _, y := range numericSpans(b.Op, bv) {
+				if x.meets(y) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	la, lb := alarmLiteral(a), alarmLiteral(b)
+	switch {
+	case a.Op == "==" && b.Op == "==":
+		return la == lb
+	case a.Op == "==" && b.Op == "!=", a.Op == "!=" && b.Op == "==":
+		return la != lb
+	}
+	return true
+}
+
+// alarmLiteral is the text AlarmRule.matches compares a field with.
+func alarmLiteral(r AlarmRule) string {
+	if b, ok := r.Value.(bool); ok {
+		return fmt.Sprint(b)
+	}
+	return r.Literal
+}
+
+// span is an interval of numbers; open ends exclude their bound.
+type span struct {
+	lo, hi         float64
+	loOpen, hiOpen bool
+}
+
+func numericSpans(op string, v float64) []span {
+	inf := math.Inf(1)
+	switch op {
+	case ">":
+		return []span{{v, inf, true, true}}
+	case ">=":
+		return []span{{v, inf, false, true}}
+	case "<":
+		return []span{{-inf, v, true, true}}
+	case "<=":
+		return []span{{-inf, v, true, false}}
+	case "==":
+		return []span{{v, v, false, false}}
+	case "!=":
+		return []span{{-inf, v, true, true}, {v, inf, true, true}}
+	}
+	return nil
+}
+
+func (a span) meets(b span) bool {
+	lo, loOpen := a.lo, a.loOpen
+	if b.lo > lo || b.lo == lo && b.loOpen {
+		lo, loOpen = b.lo, b.loOpen
+	}
+	hi, hiOpen := a.hi, a.hiOpen
+	if b.hi < hi || b.hi == hi && b.hiOpen {
+		hi, hiOpen = b.hi, b.hiOpen
+	}
+	return lo < hi || lo == hi && !loOpen && !hiOpen
+}
+
+// --- HTTP ---
+
+type alarmRulesResult struct {
+	DryRun    bool            `json:"dry_run,omitempty"`
+	Revision  uint64          `json:"revision"`
+	Rules     int             `json:"rules"`
+	Enabled   int             `json:"enabled"`
+	Conflicts []alarmConflict `json:"conflicts"`
+}
+
+// errAlarmRule is an edit's error with the status it is answered with.
+type errAlarmRule struct {
+	code int
+	msg  string
+}
+
+func (e errAlarmRule) Error() string { return e.msg }
+
+// handleAlarmRules serves /alarms/rules: the whole document, or a new rule.
+func (d *ModbusDriver) handleAlarmRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s := d.alarmRules
+		s.mu.Lock()
+		doc, etag := s.doc, s.etag()
+		s.mu.Unlock()
+		if doc.Rules == nil {
+			doc.Rules = []alarmRuleDef{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		_ = json.NewEncoder(w).Encode(doc)
+	case http.MethodPut:
+		var doc alarmRuleDoc
+		if !d.alarmRulesWriter(w, r) || !d.decodeJSON(w, r, &doc) {
+			return
+		}
+		if doc.Schema != 0 && doc.Schema != alarmRulesSchema {
+			http.Error(w, fmt.Sprintf("unsupported schema %d (this driver reads schema %d)", doc.Schema, alarmRulesSchema), http.StatusBadRequest)
+			return
+		}
+		d.editAlarmRules(w, r, http.StatusOK, func([]alarmRuleDef) ([]alarmRuleDef, error) { return doc.Rules, nil })
+	case http.MethodPost:
+		var def alarmRuleDef
+		if !d.alarmRulesWriter(w, r) || !d.decodeJSON(w, r, &def) {
+			return
+		}
+		d.editAlarmRules(w, r, http.StatusCreated, func(rules []alarmRuleDef) ([]alarmRuleDef, error) {
+			ids := map[string]bool{}
+			for _, x := range rules {
+				ids[x.ID] = true
+			}
+			if def.ID == "" {
+				for n := len(rules) + 1; def.ID == "" || ids[def.ID]; n++ {
+					def.ID = fmt.Sprintf("rule-%d", n)
+				}
+			} else if ids[def.ID] {
+				return nil, errAlarmRule{http.StatusConflict, fmt.Sprintf("rule %q exists; PUT /alarms/rules/%s replaces it", def.ID, def.ID)}
+			}
+			if dry, _ := parseDryRun(r); !dry {
+				w.Header().Set("Location", "/alarms/rules/"+def.ID)
+			}
+			return append(rules, def), nil
+		})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAlarmRule serves /alarms/rules/{id}.
+func (d *ModbusDriver) handleAlarmRule(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/alarms/rules/")
+	if !alarmRuleIDPattern.MatchString(id) {
+		http.Error(w, "alarm rule not found", http.StatusNotFound)
+		return
+	}
+	find := func(rules []alarmRuleDef) int {
+		for i, x := range rules {
+			if x.ID == id {
+				return i
+			}
+		}
+		return -1
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s := d.alarmRules
+		s.mu.Lock()
+		i, etag := find(s.doc.Rules), s.etag()
+		var def alarmRuleDef
+		if i >= 0 {
+			def = s.doc.Rules[i]
+		}
+		s.mu.Unlock()
+		if i < 0 {
+			http.Error(w, "alarm rule not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag)
+		_ = json.NewEncoder(w).Encode(def)
+	case http.MethodPut:
+		var def alarmRuleDef
+		if !d.alarmRulesWriter(w, r) || !d.decodeJSON(w, r, &def) {
+			return
+		}
+		if def.ID != "" && def.ID != id {
+			http.Error(w, fmt.Sprintf("id %q does not match the path", def.ID), http.StatusBadRequest)
+			return
+		}
+		def.ID = id
+		d.editAlarmRules(w, r, http.StatusOK, func(rules []alarmRuleDef) ([]alarmRuleDef, error) {
+			if i := find(rules); i >= 0 {
+				rules[i] = def
+				return rules, nil
+			}
+			return append(rules, def), nil
+		})
+	case http.MethodDelete:
+		if !d.alarmRulesWriter(w, r) {
+			return
+		}
+		d.editAlarmRules(w, r, http.StatusOK, func(rules []alarmRuleDef) ([]alarmRuleDef, error) {
+			i := find(rules)
+			if i < 0 {
+				return nil, errAlarmRule{http.StatusNotFound, "alarm rule not found"}
+			}
+			return append(rules[:i], rules[i+1:]...), nil
+		})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// alarmRulesWriter answers r and returns false unless it may edit the rules.
+func (d *ModbusDriver) alarmRulesWriter(w http.ResponseWriter, r *http.Request) bool {
+	if !d.adminEnabled() {
+		http.Error(w, "alarm rule editing disabled: ADMIN_TOKEN not set", http.StatusForbidden)
+		return false
+	}
+	if !d.adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if _, err := parseDryRun(r); err != nil {
+		http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// editAlarmRules applies edit to a copy of the rules, validates the result
+// and, unless r is a dry run, saves it and hands it to the alarm engine.
+func (d *ModbusDriver) editAlarmRules(w http.ResponseWriter, r *http.Request, code int, edit func([]alarmRuleDef) ([]alarmRuleDef, error)) {
+	dry, _ := parseDryRun(r)
+	s := d.alarmRules
+	if s.file == nil && !dry {
+		http.Error(w, "alarm rule editing disabled: ALARM_RULES_STORE or STATE_DIR not set", http.StatusForbidden)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h := r.Header.Get("If-Match"); h != "" {
+		match := false
+		for _, tag := range strings.Split(h, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" || tag == s.etag() {
+				match = true
+			}
+		}
+		if !match {
+			w.Header().Set("ETag", s.etag())
+			http.Error(w, "alarm rules changed since they were read", http.StatusPreconditionFailed)
+			return
+		}
+	}
+	rules, err := edit(append([]alarmRuleDef(nil), s.doc.Rules...))
+	var editErr errAlarmRule
+	if errors.As(err, &editErr) {
+		http.Error(w, editErr.msg, editErr.code)
+		return
+	}
+	next := alarmRuleDoc{Schema: alarmRulesSchema, Revision: s.doc.Revision + 1, UpdatedAt: time.Now().UTC(), Rules: rules}
+	if next.Rules == nil {
+		next.Rules = []alarmRuleDef{}
+	}
+	if err := d.validateAlarmRules(&next); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res := alarmRulesResult{DryRun: dry, Revision: next.Revision, Rules: len(next.Rules), Conflicts: alarmConflicts(next.Rules, d.alarmFieldKinds())}
+	for _, def := range next.Rules {
+		if def.on() {
+			res.Enabled++
+		}
+	}
+	if !dry {
+		if err := s.file.Save(next); err != nil {
+			d.logger.Printf("save alarm rules to %s failed: %v", s.file.path, err)
+			http.Error(w, "saving the alarm rules failed", http.StatusInternalServerError)
+			return
+		}
+		if _, err := d.alarms.SetRules(next.source()); err != nil {
+			// validateAlarmRules checked what SetRules does
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.doc, s.persisted = next, true
+		d.logger.Printf("alarm rules revision %d: %d rules, %d enabled, %d conflicts", res.Revision, res.Rules, res.Enabled, len(res.Conflicts))
+		w.Header().Set("ETag", s.etag())
+	} else {
+		code = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(res)
+}
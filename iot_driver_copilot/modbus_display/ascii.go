@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// asciiCodec maps display text to the display value registers, two
+// characters per register, high byte first. Unused positions are filled
+// with Pad; Right aligns the text to the end of the field the way numeric
+// displays usually show values.
+type asciiCodec struct {
+	Regs   int
+	Pad    byte
+	Right  bool
+	Strict bool // reject text that does not fit or would not read back unchanged
+}
+
+// parseDisplayPad accepts "space", "null" or a single printable character.
+func parseDisplayPad(s string) (byte, error) {
+	switch s {
+	case "", "space":
+		return ' ', nil
+	case "null":
+		return 0, nil
+	}
+	if len(s) == 1 && s[0] > 0x20 && s[0] < 0x7F {
+		return s[0], nil
+	}
+	return 0, fmt.Errorf("expected space, null or a single printable character, got %q", s)
+}
+
+// Encode returns the register payload for s. Without Strict, text longer
+// than the field is cut to fit; with it, anything that would not decode
+// back to s is an error.
+func (c asciiCodec) Encode(s string) ([]byte, error) {
+	width := c.Regs * 2
+	if c.Strict {
+		if len(s) > width {
+			return nil, fmt.Errorf("value is %d characters, display holds %d", len(s), width)
+		}
+		for i := 0; i < len(s); i++ {
+			if s[i] < 0x20 || s[i] > 0x7E {
+				return nil, fmt.Errorf("value contains non-printable byte 0x%02x at %d", s[i], i)
+			}
+		}
+		if s != "" {
+			edge := s[len(s)-1]
+			if c.Right {
+				edge = s[0]
+			}
+			if edge == ' ' || edge == c.Pad {
+				return nil, fmt.Errorf("value may not start or end with the padding character %q", c.Pad)
+			}
+		}
+	}
+	if len(s) > width {
+		s = s[:width]
+	}
+	buf := bytes.Repeat([]byte{c.Pad}, width)
+	if c.Right {
+		copy(buf[width-len(s):], s)
+	} else {
+		copy(buf, s)
+	}
+	return buf, nil
+}
+
+// Decode returns the text held in b, stripping padding, spaces and NULs
+// from the padded side. Devices often clear the registers with zeros or
+// spaces regardless of the configured pad, so all three are treated alike.
+// Trailing NULs are always stripped.
+func (c asciiCodec) Decode(b []byte) (string, error) {
+	if len(b) != c.Regs*2 {
+		return "", fmt.Errorf("display value is %d bytes, expected %d", len(b), c.Regs*2)
+	}
+	isPad := func(x byte) bool { return x == c.Pad || x == ' ' || x == 0 }
+	end := len(b)
+	for end > 0 && (b[end-1] == 0 || !c.Right && isPad(b[end-1])) {
+		end--
+	}
+	start := 0
+	if c.Right {
+		for start < end && isPad(b[start]) {
+			start++
+		}
+	}
+	return string(b[start:end]), nil
+}
+
+// Blank returns a copy of payload with the character positions selected by
+// mask (bit i = i-th character from the left of the field) set to spaces.
+func (c asciiCodec) Blank(payload []byte, mask uint16) []byte {
+	out := append([]byte(nil), payload...)
+	for i := range out {
+		if i < 16 && mask&(1<<uint(i)) != 0 {
+			out[i] = ' '
+		}
+	}
+	return out
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestASCIICodecEncode(t *testing.T) {
+	tests := []struct {
+		codec   asciiCodec
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{asciiCodec{Regs: 2, Pad: ' '}, "12", "12  ", false},
+		{asciiCodec{Regs: 2, Pad: ' ', Right: true}, "12", "  12", false},
+		{asciiCodec{Regs: 2, Pad: 0}, "AB", "AB\x00\x00", false},
+		{asciiCodec{Regs: 3, Pad: '0', Right: true}, "12.5", "0012.5", false},
+		{asciiCodec{Regs: 2, Pad: ' '}, "", "    ", false},
+		{asciiCodec{Regs: 2, Pad: ' '}, "TOOLONG", "TOOL", false},
+		{asciiCodec{Regs: 2, Pad: ' ', Right: true}, "TOOLONG", "TOOL", false},
+		{asciiCodec{Regs: 2, Pad: ' ', Strict: true}, "TOOLONG", "", true},
+		{asciiCodec{Regs: 2, Pad: ' ', Strict: true}, "A\tB", "", true},
+		{asciiCodec{Regs: 2, Pad: ' ', Strict: true}, "AB ", "", true},
+		{asciiCodec{Regs: 2, Pad: ' ', Strict: true}, " AB", " AB ", false},
+		{asciiCodec{Regs: 2, Pad: ' ', Right: true, Strict: true}, " AB", "", true},
+		{asciiCodec{Regs: 3, Pad: '0', Right: true, Strict: true}, "0.5", "", true},
+		{asciiCodec{Regs: 3, Pad: '0', Right: true, Strict: true}, "10", "000010", false},
+	}
+	for _, tt := range tests {
+		got, err := tt.codec.Encode(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v Encode(%q): err = %v", tt.codec, tt.in, err)
+			continue
+		}
+		if err == nil && string(got) != tt.want {
+			t.Errorf("%+v Encode(%q) = %q, want %q", tt.codec, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestASCIICodecDecode(t *testing.T) {
+	tests := []struct {
+		codec asciiCodec
+		in    string
+		want  string
+	}{
+		{asciiCodec{Regs: 3, Pad: ' '}, "12.5  ", "12.5"},
+		{asciiCodec{Regs: 3, Pad: ' '}, "1 2 3 ", "1 2 3"}, // inner spaces survive
+		{asciiCodec{Regs: 3, Pad: ' '}, "HI\x00 \x00\x00", "HI"},
+		{asciiCodec{Regs: 3, Pad: ' '}, " HI   ", " HI"},
+		{asciiCodec{Regs: 3, Pad: ' ', Right: true}, "  12.5", "12.5"},
+		{asciiCodec{Regs: 3, Pad: ' ', Right: true}, "\x00\x0012\x00\x00", "12"},
+		{asciiCodec{Regs: 3, Pad: '0', Right: true}, "0012.5", "12.5"},
+		{asciiCodec{Regs: 3, Pad: '0'}, "105000", "105"},
+		{asciiCodec{Regs: 2, Pad: ' '}, "    ", ""},
+		{asciiCodec{Regs: 2, Pad: 0}, "\x00\x00\x00\x00", ""},
+	}
+	for _, tt := range tests {
+		got, err := tt.codec.Decode([]byte(tt.in))
+		if err != nil || got != tt.want {
+			t.Errorf("%+v Decode(%q) = %q, %v; want %q", tt.codec, tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := (asciiCodec{Regs: 2}).Decode([]byte("abc")); err == nil {
+		t.Error("Decode accepted a payload of the wrong length")
+	}
+}
+
+func TestParseDisplayPad(t *testing.T) {
+	for in, want := range map[string]byte{"": ' ', "space": ' ', "null": 0, "0": '0', "_": '_'} {
+		if got, err := parseDisplayPad(in); err != nil || got != want {
+			t.Errorf("parseDisplayPad(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	for _, in := range []string{" ", "ab", "\t", "\x7f", "é"} {
+		if _, err := parseDisplayPad(in); err == nil {
+			t.Errorf("parseDisplayPad(%q) accepted", in)
+		}
+	}
+}
+
+// FuzzASCIICodec checks that encoding always fills the field exactly, that
+// anything strict mode accepts reads back unchanged, and that decoding
+// arbitrary register contents never fails or grows.
+func FuzzASCIICodec(f *testing.F) {
+	for _, s := range []string{"", "12.5", "HELLO", " A ", "0007", "\x00x\xff", strings.Repeat("Z", 40)} {
+		f.Add(s, uint8(4), byte(' '), false)
+		f.Add(s, uint8(3), byte('0'), true)
+		f.Add(s, uint8(1), byte(0), true)
+	}
+	f.Fuzz(func(t *testing.T, s string, regs uint8, pad byte, right bool) {
+		if regs == 0 || regs > maxWriteRegisters {
+			return
+		}
+		width := int(regs) * 2
+		for _, strict := range []bool{false, true} {
+			c := asciiCodec{Regs: int(regs), Pad: pad, Right: right, Strict: strict}
+			p, err := c.Encode(s)
+			if err != nil {
+				if !strict {
+					t.Fatalf("%+v Encode(%q) failed: %v", c, s, err)
+				}
+				continue
+			}
+			if len(p) != width {
+				t.Fatalf("%+v Encode(%q) = %d bytes, want %d", c, s, len(p), width)
+			}
+			got, err := c.Decode(p)
+			if err != nil {
+				t.Fatalf("%+v Decode(Encode(%q)): %v", c, s, err)
+			}
+			if strict && got != s {
+				t.Fatalf("%+v round trip %q -> %q -> %q", c, s, p, got)
+			}
+		}
+		raw := []byte(strings.Repeat(s+"\x00", width))[:0]
+		for len(raw) < width {
+			raw = append(raw, s...)
+			raw = append(raw, 0)
+		}
+		got, err := asciiCodec{Regs: int(regs), Pad: pad, Right: right}.Decode(raw[:width])
+		if err != nil || len(got) > width {
+			t.Fatalf("Decode(%q) = %q, %v", raw[:width], got, err)
+		}
+	})
+}
@@ -0,0 +1,882 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A BACnet/IP device for building automation systems, so they can read and
+// write the display natively instead of scripting HTTP. With BACNET_LISTEN
+// (normally ":47808") the driver answers Who-Is, ReadProperty,
+// ReadPropertyMultiple and WriteProperty as device BACNET_DEVICE_ID, with
+// these objects:
+//
+//	device,BACNET_DEVICE_ID      BACNET_DEVICE_NAME; system-status is
+//	                             non-operational while the display is down,
+//	                             operational-read-only in read-only mode
+//	analog-value,1               display-value: present-value is the display
+//	                             value as a REAL (NaN when it is not a number)
+//	characterstring-value,1      display-text: present-value is the display
+//	                             value as text
+//	binary-value,1               link-up: active while the display answers polls
+//	analog-value,2               last-poll-age: seconds since the last good poll
+//
+// Writing present-value of display-value or display-text is a PUT
+// /display/value with persist true, so DISPLAY_* rules, read-only mode and
+// DISPLAY_WRITE_INTERVAL_MS apply; a refused write comes back as a BACnet
+// error (write-access-denied in read-only mode, value-out-of-range for a
+// rejected value). BACnet has no credentials: TENANT_KEYS, JWT_* and
+// ADMIN_TOKEN do not apply, so keep BACNET_LISTEN on the building network.
+// The objects are not commandable; the write priority is ignored.
+//
+// There is no segmentation, COV or BBMD registration, and the device does
+// not route: I-Am is sent straight back to whoever asked, which works on
+// one subnet and through a BBMD or router that forwards the Who-Is.
+
+const (
+	bvlcTypeBIP          = 0x81
+	bvlcForwardedNPDU    = 0x04
+	bvlcOriginalUnicast  = 0x0A
+	bvlcOriginalBcast    = 0x0B
+	bacnetMaxAPDU        = 1476
+	bacnetMaxInstance    = 4194302 // 4194303 is the wildcard
+	bacnetProtocolRev    = 14
+	bacnetServicesBits   = 44
+	bacnetObjectTypeBits = 56
+	bacnetVendorID       = 0 // ASHRAE's; the driver has none of its own
+)
+
+// APDU types, services and the codes the device answers with.
+const (
+	apduConfirmedRequest   = 0x0
+	apduUnconfirmedRequest = 0x1
+	apduSimpleACK          = 0x2
+	apduComplexACK         = 0x3
+	apduError              = 0x5
+	apduReject             = 0x6
+	apduAbort              = 0x7
+
+	serviceIAm                  = 0  // unconfirmed
+	serviceWhoIs                = 8  // unconfirmed
+	serviceReadProperty         = 12 // confirmed
+	serviceReadPropertyMultiple = 14
+	serviceWriteProperty        = 15
+
+	// Bits of protocol-services-supported.
+	serviceBitIAm   = 26
+	serviceBitWhoIs = 34
+
+	rejectInvalidTag          = 4
+	rejectUnrecognizedService = 9
+	abortSegmentation         = 4
+
+	errClassDevice   = 0
+	errClassObject   = 1
+	errClassProperty = 2
+
+	errCodeCharacterSet       = 41
+	errCodeInvalidArrayIndex  = 42
+	errCodeInvalidDataType    = 9
+	errCodeNotAnArray         = 50
+	errCodeOperationalProblem = 25
+	errCodeUnknownObject      = 31
+	errCodeUnknownProperty    = 32
+	errCodeValueOutOfRange    = 37
+	errCodeWriteAccessDenied  = 40
+)
+
+// Object types and property identifiers.
+const (
+	objAnalogValue          = 2
+	objBinaryValue          = 5
+	objDevice               = 8
+	objCharacterStringValue = 40
+
+	propAll                   = 8
+	propAPDUTimeout           = 11
+	propAppSoftwareVersion    = 12
+	propDescription           = 28
+	propDeviceAddressBinding  = 30
+	propEventState            = 36
+	propFirmwareRevision      = 44
+	propMaxAPDULength         = 62
+	propModelName             = 70
+	propNumberOfAPDURetries   = 73
+	propObjectIdentifier      = 75
+	propObjectList            = 76
+	propObjectName            = 77
+	propObjectType            = 79
+	propOptional              = 80
+	propOutOfService          = 81
+	propPresentValue          = 85
+	propProtocolObjectTypes   = 96
+	propProtocolServices      = 97
+	propProtocolVersion       = 98
+	propRequired              = 105
+	propSegmentationSupported = 107
+	propStatusFlags           = 111
+	propSystemStatus          = 112
+	propUnits                 = 117
+	propVendorIdentifier      = 120
+	propVendorName            = 121
+	propProtocolRevision      = 139
+	propDatabaseRevision      = 155
+	unitsSeconds              = 73
+	unitsNoUnits              = 95
+	segmentationNone          = 3
+	systemOperational         = 0
+	systemOperationalReadOnly = 1
+	systemNonOperational      = 4
+	bacnetCharsetUTF8         = 0
+)
+
+// bacnetArrayAll stands for a request without an array index.
+const bacnetArrayAll uint32 = math.MaxUint32
+
+var (
+	errBACnetEncoding = errors.New("bacnet: malformed message")
+	errBACnetTooLarge = errors.New("bacnet: reply needs segmentation")
+)
+
+type bacnetObjectID struct {
+	typ  uint16
+	inst uint32
+}
+
+func (o bacnetObjectID) encode() []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(o.typ)<<22|o.inst&0x3FFFFF)
+	return b[:]
+}
+
+func decodeBACnetObjectID(c []byte) (bacnetObjectID, bool) {
+	if len(c) != 4 {
+		return bacnetObjectID{}, false
+	}
+	v := binary.BigEndian.Uint32(c)
+	return bacnetObjectID{uint16(v >> 22), v & 0x3FFFFF}, true
+}
+
+// --- tags ---
+
+// bacnetTag is one decoded tag: application or context, or an opening or
+// closing tag. data is the content; application booleans keep their value
+// in lvt.
+type bacnetTag struct {
+	num         uint8
+	context     bool
+	open, close bool
+	lvt         uint32
+	data        []byte
+}
+
+func readBACnetTag(b []byte) (bacnetTag, []byte, error) {
+	if len(b) == 0 {
+		return bacnetTag{}, nil, errBACnetEncoding
+	}
+	h := b[0]
+	t := bacnetTag{num: h >> 4, context: h&0x08 != 0, lvt: uint32(h & 0x07)}
+	b = b[1:]
+	if t.num == 15 {
+		if len(b) == 0 {
+			return t, nil, errBACnetEncoding
+		}
+		t.num, b = b[0], b[1:]
+	}
+	if t.context && t.lvt == 6 {
+		t.open = true
+		return t, b, nil
+	}
+	if t.context && t.lvt == 7 {
+		t.close = true
+		return t, b, nil
+	}
+	if t.lvt == 5 {
+		if len(b) == 0 {
+			return t, nil, errBACnetEncoding
+		}
+		switch n := b[0]; n {
+		case 254:
+			if len(b) < 3 {
+				return t, nil, errBACnetEncoding
+			}
+			t.lvt, b = uint32(binary.BigEndian.Uint16(b[1:3])), b[3:]
+		case 255:
+			if len(b) < 5 {
+				return t, nil, errBACnetEncoding
+			}
+			t.lvt, b = binary.BigEndian.Uint32(b[1:5]), b[5:]
+		default:
+			t.lvt, b = uint32(n), b[1:]
+		}
+	}
+	if !t.context && t.num == 1 { // boolean
+		return t, b, nil
+	}
+	if uint32(len(b)) < t.lvt {
+		return t, nil, errBACnetEncoding
+	}
+	t.data, b = b[:t.lvt], b[t.lvt:]
+	return t, b, nil
+}
+
+func (t bacnetTag) unsigned() (uint32, bool) {
+	if len(t.data) == 0 || len(t.data) > 4 {
+		return 0, false
+	}
+	var v uint32
+	for _, c := range t.data {
+		v = v<<8 | uint32(c)
+	}
+	return v, true
+}
+
+func (t bacnetTag) isContext(num uint8) bool {
+	return t.context && !t.open && !t.close && t.num == num
+}
+
+// bacnetBuf builds APDUs.
+type bacnetBuf struct{ bytes.Buffer }
+
+func (b *bacnetBuf) header(num uint8, context bool, n int) {
+	h := num << 4
+	if context {
+		h |= 0x08
+	}
+	switch {
+	case n < 5:
+		b.WriteByte(h | byte(n))
+	case n < 254:
+		b.Write([]byte{h | 5, byte(n)})
+	default:
+		b.Write([]byte{h | 5, 254, byte(n >> 8), byte(n)})
+	}
+}
+
+func (b *bacnetBuf) tagged(num uint8, context bool, content []byte) {
+	b.header(num, context, len(content))
+	b.Write(content)
+}
+
+func bacnetUnsignedBytes(v uint32) []byte {
+	switch {
+	case v < 1<<8:
+		return []byte{byte(v)}
+	case v < 1<<16:
+		return []byte{byte(v >> 8), byte(v)}
+	case v < 1<<24:
+		return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func (b *bacnetBuf) appUnsigned(v uint32)            { b.tagged(2, false, bacnetUnsignedBytes(v)) }
+func (b *bacnetBuf) appEnum(v uint32)                { b.tagged(9, false, bacnetUnsignedBytes(v)) }
+func (b *bacnetBuf) appObjectID(o bacnetObjectID)    { b.tagged(12, false, o.encode()) }
+func (b *bacnetBuf) ctxUnsigned(num uint8, v uint32) { b.tagged(num, true, bacnetUnsignedBytes(v)) }
+func (b *bacnetBuf) ctxObjectID(num uint8, o bacnetObjectID) {
+	b.tagged(num, true, o.encode())
+}
+func (b *bacnetBuf) open(num uint8)  { b.WriteByte(num<<4 | 0x0E) }
+func (b *bacnetBuf) close(num uint8) { b.WriteByte(num<<4 | 0x0F) }
+
+func (b *bacnetBuf) appBool(v bool) {
+	if v {
+		b.WriteByte(0x11)
+	} else {
+		b.WriteByte(0x10)
+	}
+}
+
+func (b *bacnetBuf) appReal(f float32) {
+	var c [4]byte
+	binary.BigEndian.PutUint32(c[:], math.Float32bits(f))
+	b.tagged(4, false, c[:])
+}
+
+func (b *bacnetBuf) appString(s string) {
+	b.tagged(7, false, append([]byte{bacnetCharsetUTF8}, s...))
+}
+
+// appBitString encodes the given bits; the rest of the n are clear.
+func (b *bacnetBuf) appBitString(n int, set ...int) {
+	c := make([]byte, 1+(n+7)/8)
+	c[0] = byte(len(c)*8 - 8 - n) // unused bits in the last byte
+	for _, i := range set {
+		c[1+i/8] |= 0x80 >> (i % 8)
+	}
+	b.tagged(8, false, c)
+}
+
+// --- objects ---
+
+type bacnetError struct{ class, code uint32 }
+
+func (e *bacnetError) Error() string {
+	return "bacnet error class " + strconv.Itoa(int(e.class)) + " code " + strconv.Itoa(int(e.code))
+}
+
+type bacnetProperty struct {
+	read  func(b *bacnetBuf)
+	items func() []func(b *bacnetBuf) // set for arrays instead of read
+	write func(t bacnetTag) *bacnetError
+}
+
+type bacnetObject struct {
+	id    bacnetObjectID
+	props map[uint32]bacnetProperty
+	order []uint32 // for ReadPropertyMultiple ALL
+}
+
+func newBACnetObject(id bacnetObjectID, name string) *bacnetObject {
+	o := &bacnetObject{id: id, props: map[uint32]bacnetProperty{}}
+	o.add(propObjectIdentifier, bacnetProperty{read: func(b *bacnetBuf) { b.appObjectID(id) }})
+	o.add(propObjectName, bacnetProperty{read: func(b *bacnetBuf) { b.appString(name) }})
+	o.add(propObjectType, bacnetProperty{read: func(b *bacnetBuf) { b.appEnum(uint32(id.typ)) }})
+	return o
+}
+
+func (o *bacnetObject) add(prop uint32, p bacnetProperty) {
+	o.props[prop] = p
+	o.order = append(o.order, prop)
+}
+
+func (o *bacnetObject) readOnly(prop uint32, read func(b *bacnetBuf)) {
+	o.add(prop, bacnetProperty{read: read})
+}
+
+// readProperty encodes one value of o, or the error to report.
+func (o *bacnetObject) readProperty(b *bacnetBuf, prop, index uint32) *bacnetError {
+	p, ok := o.props[prop]
+	if !ok {
+		return &bacnetError{errClassProperty, errCodeUnknownProperty}
+	}
+	if p.items == nil {
+		if index != bacnetArrayAll {
+			return &bacnetError{errClassProperty, errCodeNotAnArray}
+		}
+		p.read(b)
+		return nil
+	}
+	items := p.items()
+	switch {
+	case index == bacnetArrayAll:
+		for _, item := range items {
+			item(b)
+		}
+	case index == 0:
+		b.appUnsigned(uint32(len(items)))
+	case int64(index) <= int64(len(items)):
+		items[index-1](b)
+	default:
+		return &bacnetError{errClassProperty, errCodeInvalidArrayIndex}
+	}
+	return nil
+}
+
+type bacnetDevice struct {
+	id      bacnetObjectID
+	objects []*bacnetObject // the device first
+}
+
+func (dev *bacnetDevice) object(id bacnetObjectID) *bacnetObject {
+	// The device also answers to the wildcard instance.
+	if id.typ == objDevice && id.inst == bacnetMaxInstance+1 {
+		id = dev.id
+	}
+	for _, o := range dev.objects {
+		if o.id == id {
+			return o
+		}
+	}
+	return nil
+}
+
+// --- the driver's objects ---
+
+func (d *ModbusDriver) newBACnetDevice() *bacnetDevice {
+	linkUp := func() bool {
+		r := d.reach.Load()
+		return r != nil && r.Up
+	}
+	status := func() DeviceStatus {
+		d.statusMu.RLock()
+		defer d.statusMu.RUnlock()
+		return d.status
+	}
+	statusFlags := func(b *bacnetBuf) {
+		if linkUp() {
+			b.appBitString(4)
+		} else {
+			b.appBitString(4, 1) // fault
+		}
+	}
+	dev := &bacnetDevice{id: bacnetObjectID{objDevice, d.cfg.BACnetDeviceID}}
+
+	device := newBACnetObject(dev.id, d.cfg.BACnetDeviceName)
+	device.readOnly(propSystemStatus, func(b *bacnetBuf) {
+		switch {
+		case !linkUp():
+			b.appEnum(systemNonOperational)
+		case d.readOnly.Load():
+			b.appEnum(systemOperationalReadOnly)
+		default:
+			b.appEnum(systemOperational)
+		}
+	})
+	device.readOnly(propVendorName, func(b *bacnetBuf) { b.appString("modbus-display-driver") })
+	device.readOnly(propVendorIdentifier, func(b *bacnetBuf) { b.appUnsigned(bacnetVendorID) })
+	device.readOnly(propModelName, func(b *bacnetBuf) { b.appString("modbus-display-driver") })
+	device.readOnly(propFirmwareRevision, func(b *bacnetBuf) { b.appString(buildVersion().Version) })
+	device.readOnly(propAppSoftwareVersion, func(b *bacnetBuf) { b.appString(buildVersion().Version) })
+	device.readOnly(propProtocolVersion, func(b *bacnetBuf) { b.appUnsigned(1) })
+	device.readOnly(propProtocolRevision, func(b *bacnetBuf) { b.appUnsigned(bacnetProtocolRev) })
+	device.readOnly(propProtocolServices, func(b *bacnetBuf) {
+		b.appBitString(bacnetServicesBits, serviceReadProperty, serviceReadPropertyMultiple, serviceWriteProperty, serviceBitIAm, serviceBitWhoIs)
+	})
+	device.readOnly(propProtocolObjectTypes, func(b *bacnetBuf) {
+		b.appBitString(bacnetObjectTypeBits, objAnalogValue, objBinaryValue, objDevice, objCharacterStringValue)
+	})
+	device.add(propObjectList, bacnetProperty{items: func() []func(b *bacnetBuf) {
+		items := make([]func(b *bacnetBuf), len(dev.objects))
+		for i, o := range dev.objects {
+			id := o.id
+			items[i] = func(b *bacnetBuf) { b.appObjectID(id) }
+		}
+		return items
+	}})
+	device.readOnly(propMaxAPDULength, func(b *bacnetBuf) { b.appUnsigned(bacnetMaxAPDU) })
+	device.readOnly(propSegmentationSupported, func(b *bacnetBuf) { b.appEnum(segmentationNone) })
+	device.readOnly(propAPDUTimeout, func(b *bacnetBuf) { b.appUnsigned(3000) })
+	device.readOnly(propNumberOfAPDURetries, func(b *bacnetBuf) { b.appUnsigned(3) })
+	device.readOnly(propDeviceAddressBinding, func(b *bacnetBuf) {}) // an empty list
+	device.readOnly(propDatabaseRevision, func(b *bacnetBuf) { b.appUnsigned(0) })
+
+	value := newBACnetObject(bacnetObjectID{objAnalogValue, 1}, "display-value")
+	value.add(propPresentValue, bacnetProperty{
+		read: func(b *bacnetBuf) {
+			f, err := strconv.ParseFloat(status().DisplayValue, 32)
+			if err != nil {
+				f = math.NaN()
+			}
+			b.appReal(float32(f))
+		},
+		write: func(t bacnetTag) *bacnetError {
+			if t.context || t.num != 4 || len(t.data) != 4 {
+				return &bacnetError{errClassProperty, errCodeInvalidDataType}
+			}
+			f := math.Float32frombits(binary.BigEndian.Uint32(t.data))
+			if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+				return &bacnetError{errClassProperty, errCodeValueOutOfRange}
+			}
+			return d.bacnetWriteDisplayValue(strconv.FormatFloat(float64(f), 'f', -1, 32))
+		},
+	})
+	value.readOnly(propStatusFlags, statusFlags)
+	value.readOnly(propEventState, func(b *bacnetBuf) { b.appEnum(0) }) // normal
+	value.readOnly(propOutOfService, func(b *bacnetBuf) { b.appBool(false) })
+	value.readOnly(propUnits, func(b *bacnetBuf) { b.appEnum(unitsNoUnits) })
+	value.readOnly(propDescription, func(b *bacnetBuf) { b.appString("Display value, when it is a number") })
+
+	text := newBACnetObject(bacnetObjectID{objCharacterStringValue, 1}, "display-text")
+	text.add(propPresentValue, bacnetProperty{
+		read: func(b *bacnetBuf) { b.appString(status().DisplayValue) },
+		write: func(t bacnetTag) *bacnetError {
+			if t.context || t.num != 7 || len(t.data) == 0 {
+				return &bacnetError{errClassProperty, errCodeInvalidDataType}
+			}
+			if t.data[0] != bacnetCharsetUTF8 {
+				return &bacnetError{errClassProperty, errCodeCharacterSet}
+			}
+			return d.bacnetWriteDisplayValue(string(t.data[1:]))
+		},
+	})
+	text.readOnly(propStatusFlags, statusFlags)
+	text.readOnly(propDescription, func(b *bacnetBuf) { b.appString("Display value as text") })
+
+	link := newBACnetObject(bacnetObjectID{objBinaryValue, 1}, "link-up")
+	link.readOnly(propPresentValue, func(b *bacnetBuf) {
+		if linkUp() {
+			b.appEnum(1) // active
+		} else {
+			b.appEnum(0)
+		}
+	})
+	link.readOnly(propStatusFlags, func(b *bacnetBuf) { b.appBitString(4) })
+	link.readOnly(propEventState, func(b *bacnetBuf) { b.appEnum(0) })
+	link.readOnly(propOutOfService, func(b *bacnetBuf) { b.appBool(false) })
+	link.readOnly(propDescription, func(b *bacnetBuf) { b.appString("Whether the display answers polls") })
+
+	started := time.Now()
+	age := newBACnetObject(bacnetObjectID{objAnalogValue, 2}, "last-poll-age")
+	age.readOnly(propPresentValue, func(b *bacnetBuf) {
+		since := time.Since(started)
+		if last := status().lastUpdateTime; !last.IsZero() {
+			since = d.clock.Now().Sub(last)
+		}
+		b.appReal(float32(since.Seconds()))
+	})
+	age.readOnly(propStatusFlags, statusFlags)
+	age.readOnly(propEventState, func(b *bacnetBuf) { b.appEnum(0) })
+	age.readOnly(propOutOfService, func(b *bacnetBuf) { b.appBool(false) })
+	age.readOnly(propUnits, func(b *bacnetBuf) { b.appEnum(unitsSeconds) })
+	age.readOnly(propDescription, func(b *bacnetBuf) { b.appString("Seconds since the last good poll") })
+
+	dev.objects = []*bacnetObject{device, value, text, link, age}
+	return dev
+}
+
+// bacnetWriteDisplayValue runs a present-value write as PUT /display/value,
+// so it is checked and applied exactly like one.
+func (d *ModbusDriver) bacnetWriteDisplayValue(val string) *bacnetError {
+	body, _ := json.Marshal(displayValueReq{DisplayValue: val})
+	req, err := http.NewRequest(http.MethodPut, "/display/value", bytes.NewReader(body))
+	if err != nil {
+		return &bacnetError{errClassDevice, errCodeOperationalProblem}
+	}
+	req.RemoteAddr = "bacnet"
+	rec := &commandRecorder{header: http.Header{}}
+	d.writeGuard(d.handleDisplayValue)(rec, req)
+	switch {
+	case rec.status < 300:
+		return nil
+	case rec.status == http.StatusLocked:
+		return &bacnetError{errClassProperty, errCodeWriteAccessDenied}
+	case rec.status < 500:
+		return &bacnetError{errClassProperty, errCodeValueOutOfRange}
+	}
+	return &bacnetError{errClassDevice, errCodeOperationalProblem}
+}
+
+// --- BVLC, NPDU and APDU ---
+
+// serveBACnet answers requests on BACNET_LISTEN until ctx ends.
+func (d *ModbusDriver) serveBACnet(ctx context.Context, conn net.PacketConn, dev *bacnetDevice) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 1600)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				d.logger.Printf("bacnet: %v", err)
+			}
+			return
+		}
+		if resp, to := dev.handle(buf[:n], from); resp != nil {
+			_, _ = conn.WriteTo(resp, to)
+		}
+	}
+}
+
+// handle answers one BVLC message, returning the reply and where to send
+// it, or nil to stay silent.
+func (dev *bacnetDevice) handle(b []byte, from net.Addr) ([]byte, net.Addr) {
+	if len(b) < 4 || b[0] != bvlcTypeBIP || int(binary.BigEndian.Uint16(b[2:4])) != len(b) {
+		return nil, nil
+	}
+	npdu := b[4:]
+	switch b[1] {
+	case bvlcOriginalUnicast, bvlcOriginalBcast:
+	case bvlcForwardedNPDU:
+		// A BBMD passes the originator's address along; reply to it.
+		if len(npdu) < 6 {
+			return nil, nil
+		}
+		from = &net.UDPAddr{IP: net.IP(append([]byte{}, npdu[:4]...)), Port: int(binary.BigEndian.Uint16(npdu[4:6]))}
+		npdu = npdu[6:]
+	default:
+		return nil, nil
+	}
+	if len(npdu) < 2 || npdu[0] != 0x01 {
+		return nil, nil
+	}
+	ctrl, rest := npdu[1], npdu[2:]
+	if ctrl&0x80 != 0 { // network layer message
+		return nil, nil
+	}
+	var snet []byte // SNET, SLEN and SADR, when the request came through a router
+	if ctrl&0x20 != 0 {
+		if len(rest) < 3 || len(rest) < 3+int(rest[2]) {
+			return nil, nil
+		}
+		if dnet := binary.BigEndian.Uint16(rest[:2]); dnet != 0xFFFF {
+			return nil, nil // for a device on another network
+		}
+		rest = rest[3+int(rest[2]):]
+	}
+	if ctrl&0x08 != 0 {
+		if len(rest) < 3 || len(rest) < 3+int(rest[2]) {
+			return nil, nil
+		}
+		snet, rest = rest[:3+int(rest[2])], rest[3+int(rest[2]):]
+	}
+	if ctrl&0x20 != 0 {
+		if len(rest) < 1 {
+			return nil, nil
+		}
+		rest = rest[1:] // hop count
+	}
+	apdu := dev.handleAPDU(rest)
+	if apdu == nil {
+		return nil, nil
+	}
+	reply := []byte{0x01, 0x00}
+	if snet != nil {
+		reply[1] = 0x20
+		reply = append(append(reply, snet...), 0xFF)
+	}
+	reply = append(reply, apdu...)
+	msg := []byte{bvlcTypeBIP, bvlcOriginalUnicast, 0, 0}
+	msg = append(msg, reply...)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)))
+	return msg, from
+}
+
+func (dev *bacnetDevice) handleAPDU(a []byte) []byte {
+	if len(a) < 2 {
+		return nil
+	}
+	switch a[0] >> 4 {
+	case apduUnconfirmedRequest:
+		if a[1] == serviceWhoIs {
+			return dev.whoIs(a[2:])
+		}
+		return nil
+	case apduConfirmedRequest:
+	default:
+		return nil
+	}
+	if len(a) < 4 {
+		return nil
+	}
+	invokeID := a[2]
+	if a[0]&0x08 != 0 { // segmented
+		return []byte{apduAbort<<4 | 0x01, invokeID, abortSegmentation}
+	}
+	service, params := a[3], a[4:]
+	var b bacnetBuf
+	var err error
+	switch service {
+	case serviceReadProperty:
+		err = dev.readProperty(&b, params)
+	case serviceReadPropertyMultiple:
+		err = dev.readPropertyMultiple(&b, params)
+	case serviceWriteProperty:
+		err = dev.writeProperty(params)
+	default:
+		return []byte{apduReject << 4, invokeID, rejectUnrecognizedService}
+	}
+	var berr *bacnetError
+	switch {
+	case errors.Is(err, errBACnetTooLarge):
+		return []byte{apduAbort<<4 | 0x01, invokeID, abortSegmentation}
+	case errors.As(err, &berr):
+		var e bacnetBuf
+		e.Write([]byte{apduError << 4, invokeID, service})
+		e.appEnum(berr.class)
+		e.appEnum(berr.code)
+		return e.Bytes()
+	case err != nil:
+		return []byte{apduReject << 4, invokeID, rejectInvalidTag}
+	case service == serviceWriteProperty:
+		return []byte{apduSimpleACK << 4, invokeID, service}
+	}
+	return append([]byte{apduComplexACK << 4, invokeID, service}, b.Bytes()...)
+}
+
+// whoIs answers with I-Am when the device is in the asked range, if any.
+func (dev *bacnetDevice) whoIs(params []byte) []byte {
+	if len(params) > 0 {
+		lo, rest, err := readBACnetTag(params)
+		if err != nil || !lo.isContext(0) {
+			return nil
+		}
+		hi, _, err := readBACnetTag(rest)
+		if err != nil || !hi.isContext(1) {
+			return nil
+		}
+		low, ok1 := lo.unsigned()
+		high, ok2 := hi.unsigned()
+		if !ok1 || !ok2 || dev.id.inst < low || dev.id.inst > high {
+			return nil
+		}
+	}
+	var b bacnetBuf
+	b.Write([]byte{apduUnconfirmedRequest << 4, serviceIAm})
+	b.appObjectID(dev.id)
+	b.appUnsigned(bacnetMaxAPDU)
+	b.appEnum(segmentationNone)
+	b.appUnsigned(bacnetVendorID)
+	return b.Bytes()
+}
+
+// readReference reads the object identifier, property and optional array
+// index that ReadProperty and WriteProperty start with.
+func readReference(params []byte) (id bacnetObjectID, prop, index uint32, rest []byte, err error) {
+	t, rest, err := readBACnetTag(params)
+	if err != nil || !t.isContext(0) {
+		return id, 0, 0, nil, errBACnetEncoding
+	}
+	id, ok := decodeBACnetObjectID(t.data)
+	if !ok {
+		return id, 0, 0, nil, errBACnetEncoding
+	}
+	if t, rest, err = readBACnetTag(rest); err != nil || !t.isContext(1) {
+		return id, 0, 0, nil, errBACnetEncoding
+	}
+	if prop, ok = t.unsigned(); !ok {
+		return id, 0, 0, nil, errBACnetEncoding
+	}
+	index = bacnetArrayAll
+	if t, after, err := readBACnetTag(rest); err == nil && t.isContext(2) {
+		if index, ok = t.unsigned(); !ok {
+			return id, 0, 0, nil, errBACnetEncoding
+		}
+		rest = after
+	}
+	return id, prop, index, rest, nil
+}
+
+func (dev *bacnetDevice) readProperty(b *bacnetBuf, params []byte) error {
+	id, prop, index, _, err := readReference(params)
+	if err != nil {
+		return err
+	}
+	o := dev.object(id)
+	if o == nil {
+		return &bacnetError{errClassObject, errCodeUnknownObject}
+	}
+	var value bacnetBuf
+	if err := o.readProperty(&value, prop, index); err != nil {
+		return err
+	}
+	b.ctxObjectID(0, o.id)
+	b.ctxUnsigned(1, prop)
+	if index != bacnetArrayAll {
+		b.ctxUnsigned(2, index)
+	}
+	b.open(3)
+	b.Write(value.Bytes())
+	b.close(3)
+	return nil
+}
+
+// readPropertyMultiple answers each requested property in turn, with an
+// error in place of the value for those that cannot be read. ALL,
+// REQUIRED and OPTIONAL all return every property the object has.
+func (dev *bacnetDevice) readPropertyMultiple(b *bacnetBuf, params []byte) error {
+	for len(params) > 0 {
+		t, rest, err := readBACnetTag(params)
+		if err != nil || !t.isContext(0) {
+			return errBACnetEncoding
+		}
+		id, ok := decodeBACnetObjectID(t.data)
+		if !ok {
+			return errBACnetEncoding
+		}
+		if t, rest, err = readBACnetTag(rest); err != nil || !t.open || t.num != 1 {
+			return errBACnetEncoding
+		}
+		o := dev.object(id)
+		if o == nil {
+			return &bacnetError{errClassObject, errCodeUnknownObject}
+		}
+		b.ctxObjectID(0, o.id)
+		b.open(1)
+		for {
+			if t, rest, err = readBACnetTag(rest); err != nil {
+				return errBACnetEncoding
+			}
+			if t.close && t.num == 1 {
+				break
+			}
+			if !t.isContext(0) {
+				return errBACnetEncoding
+			}
+			prop, ok := t.unsigned()
+			if !ok {
+				return errBACnetEncoding
+			}
+			index := bacnetArrayAll
+			if t, after, err := readBACnetTag(rest); err == nil && t.isContext(1) {
+				if index, ok = t.unsigned(); !ok {
+					return errBACnetEncoding
+				}
+				rest = after
+			}
+			props := []uint32{prop}
+			if prop == propAll || prop == propRequired || prop == propOptional {
+				props = o.order
+			}
+			for _, p := range props {
+				b.ctxUnsigned(2, p)
+				if index != bacnetArrayAll {
+					b.ctxUnsigned(3, index)
+				}
+				var value bacnetBuf
+				if err := o.readProperty(&value, p, index); err != nil {
+					b.open(5)
+					b.appEnum(err.class)
+					b.appEnum(err.code)
+					b.close(5)
+					continue
+				}
+				b.open(4)
+				b.Write(value.Bytes())
+				b.close(4)
+			}
+		}
+		b.close(1)
+		params = rest
+	}
+	if b.Len()+3 > bacnetMaxAPDU {
+		return errBACnetTooLarge
+	}
+	return nil
+}
+
+func (dev *bacnetDevice) writeProperty(params []byte) error {
+	id, prop, index, rest, err := readReference(params)
+	if err != nil {
+		return err
+	}
+	t, rest, err := readBACnetTag(rest)
+	if err != nil || !t.open || t.num != 3 {
+		return errBACnetEncoding
+	}
+	value, rest, err := readBACnetTag(rest)
+	if err != nil || value.open || value.close {
+		return errBACnetEncoding
+	}
+	if t, _, err = readBACnetTag(rest); err != nil || !t.close || t.num != 3 {
+		return errBACnetEncoding
+	}
+	o := dev.object(id)
+	if o == nil {
+		return &bacnetError{errClassObject, errCodeUnknownObject}
+	}
+	p, ok := o.props[prop]
+	switch {
+	case !ok:
+		return &bacnetError{errClassProperty, errCodeUnknownProperty}
+	case p.write == nil:
+		return &bacnetError{errClassProperty, errCodeWriteAccessDenied}
+	case index != bacnetArrayAll:
+		return &bacnetError{errClassProperty, errCodeNotAnArray}
+	}
+	if err := p.write(value); err != nil {
+		return err
+	}
+	return nil
+}
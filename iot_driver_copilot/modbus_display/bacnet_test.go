@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func testBACnetDevice() *bacnetDevice {
+	dev := &bacnetDevice{id: bacnetObjectID{objDevice, 123}}
+	device := newBACnetObject(dev.id, "lobby")
+	device.add(propObjectList, bacnetProperty{items: func() []func(b *bacnetBuf) {
+		return []func(b *bacnetBuf){
+			func(b *bacnetBuf) { b.appObjectID(dev.id) },
+			func(b *bacnetBuf) { b.appObjectID(bacnetObjectID{objAnalogValue, 1}) },
+		}
+	}})
+	value := newBACnetObject(bacnetObjectID{objAnalogValue, 1}, "display-value")
+	value.readOnly(propPresentValue, func(b *bacnetBuf) { b.appReal(12.5) })
+	dev.objects = []*bacnetObject{device, value}
+	return dev
+}
+
+func TestBACnetWhoIs(t *testing.T) {
+	dev := testBACnetDevice()
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 47808}
+	for _, tc := range []struct{ name, req, want string }{
+		// A global Who-Is as bacnet-stack's bacwi sends it.
+		{"global", "810b000c0120ffff00ff1008", "810a001401001000c40200007b2205c491032100"},
+		{"in range", "810b000d0100100809641a00c8", "810a001401001000c40200007b2205c491032100"},
+		{"out of range", "810b000d0100100809011a0002", ""},
+		{"not BACnet/IP", "820b000c0120ffff00ff1008", ""},
+	} {
+		req, _ := hex.DecodeString(tc.req)
+		resp, to := dev.handle(req, from)
+		if got := hex.EncodeToString(resp); got != tc.want {
+			t.Errorf("%s: reply %s, want %s", tc.name, got, tc.want)
+		}
+		if resp != nil && to != from {
+			t.Errorf("%s: reply to %v", tc.name, to)
+		}
+	}
+
+	// Through a BBMD the reply goes to the originator.
+	req, _ := hex.DecodeString("8104001301020304bac00100100809641a00c8")
+	resp, to := dev.handle(req, from)
+	if resp == nil || to.String() != "1.2.3.4:47808" {
+		t.Errorf("forwarded Who-Is: reply %x to %v", resp, to)
+	}
+}
+
+func TestBACnetReadProperty(t *testing.T) {
+	dev := testBACnetDevice()
+	confirmed := func(service byte, params string) []byte {
+		t.Helper()
+		p, _ := hex.DecodeString(params)
+		apdu := append([]byte{0x00, 0x05, 0x01, service}, p...)
+		msg := append([]byte{bvlcTypeBIP, bvlcOriginalUnicast, 0, byte(6 + len(apdu)), 0x01, 0x04}, apdu...)
+		resp, _ := dev.handle(msg, &net.UDPAddr{})
+		if len(resp) < 6 {
+			t.Fatalf("no reply to %x", msg)
+		}
+		return resp[6:]
+	}
+	for _, tc := range []struct{ name, req, want string }{
+		// analog-value,1 present-value: 12.5
+		{"present-value", "0c008000011955", "30010c0c0080000119553e44414800003f"},
+		// The device by the wildcard instance: object-name.
+		{"wildcard", "0c023fffff194d", "30010c0c0200007b194d3e7506006c6f6262793f"},
+		// object-list[0] is its length.
+		{"array length", "0c0200007b194c2900", "30010c0c0200007b194c29003e21023f"},
+		{"unknown object", "0c008000091955", "50010c9101911f"},
+		{"unknown property", "0c0080000119ff", "50010c91029120"},
+		{"not an array", "0c0080000119552901", "50010c91029132"},
+	} {
+		if got := hex.EncodeToString(confirmed(serviceReadProperty, tc.req)); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	// ReadPropertyMultiple: all of analog-value,1 and a missing property.
+	resp := confirmed(serviceReadPropertyMultiple, "0c008000011e09081f0c008000011e09ff1f")
+	if !bytes.HasPrefix(resp, []byte{0x30, 0x01, serviceReadPropertyMultiple, 0x0c, 0x00, 0x80, 0x00, 0x01, 0x1e, 0x29, 0x4b}) ||
+		!bytes.Contains(resp, []byte{0x29, 0x55, 0x4e, 0x44, 0x41, 0x48, 0x00, 0x00, 0x4f}) ||
+		!bytes.HasSuffix(resp, []byte{0x1e, 0x29, 0xff, 0x5e, 0x91, 0x02, 0x91, 0x20, 0x5f, 0x1f}) {
+		t.Errorf("ReadPropertyMultiple: %x", resp)
+	}
+
+	// Writing a read-only property, and services the device lacks.
+	if got := hex.EncodeToString(confirmed(serviceWriteProperty, "0c0080000119553e44412000003f")); got != "50010f91029128" {
+		t.Errorf("WriteProperty to a read-only value: %s", got)
+	}
+	if got := hex.EncodeToString(confirmed(5, "")); got != "600109" {
+		t.Errorf("SubscribeCOV: %s", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// busLock shares the serial port with other programs on the box. With
+// SERIAL_LOCK_FILE set, every Modbus transaction is made holding an
+// exclusive flock(2) on that file, so another program that takes the same
+// lock around its own transactions (flock(1) does, for scripts) never talks
+// over the driver or reads its replies. The lock can be a file of its own
+// or the device node itself. A transaction that cannot get the lock within
+// SERIAL_LOCK_TIMEOUT_MS fails like one the device did not answer.
+//
+// The lock is advisory: programs that don't take it are not kept out, and
+// UUCP-style LCK..tty files are not honoured.
+type busLock struct {
+	path    string
+	timeout time.Duration
+	f       *os.File // opened on first use and kept
+
+	timeouts atomic.Uint64
+}
+
+var errBusLockTimeout = errors.New("timed out waiting for SERIAL_LOCK_FILE")
+
+// busLockPoll is how often a held lock is retried; flock(2) has no timeout.
+const busLockPoll = 5 * time.Millisecond
+
+func newBusLock(path string, timeout time.Duration) *busLock {
+	if path == "" {
+		return nil
+	}
+	return &busLock{path: path, timeout: timeout}
+}
+
+func (b *busLock) open() error {
+	if b.f != nil {
+		return nil
+	}
+	flags, perm := os.O_RDWR|os.O_CREATE, os.FileMode(0o666)
+	if fi, err := os.Stat(b.path); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		// The device node: don't become its controlling terminal or wait
+		// for carrier.
+		flags, perm = os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0
+	}
+	f, err := os.OpenFile(b.path, flags, perm)
+	if err != nil {
+		return fmt.Errorf("SERIAL_LOCK_FILE: %w", err)
+	}
+	b.f = f
+	return nil
+}
+
+// acquire takes the lock, waiting up to the timeout. Without a lock it
+// does nothing. Callers hold mbusMu.
+func (b *busLock) acquire() error {
+	if b == nil {
+		return nil
+	}
+	if err := b.open(); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(b.timeout)
+	for {
+		err := syscall.Flock(int(b.f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		switch {
+		case err == nil:
+			return nil
+		case err == syscall.EINTR:
+			continue
+		case err != syscall.EWOULDBLOCK:
+			return fmt.Errorf("SERIAL_LOCK_FILE: %w", err)
+		}
+		if time.Now().After(deadline) {
+			b.timeouts.Add(1)
+			return fmt.Errorf("%w (%s held for over %v)", errBusLockTimeout, b.path, b.timeout)
+		}
+		time.Sleep(busLockPoll)
+	}
+}
+
+func (b *busLock) release() {
+	if b == nil || b.f == nil {
+		return
+	}
+	_ = syscall.Flock(int(b.f.Fd()), syscall.LOCK_UN)
+}
+
+func (b *busLock) timeoutCount() uint64 {
+	if b == nil {
+		return 0
+	}
+	return b.timeouts.Load()
+}
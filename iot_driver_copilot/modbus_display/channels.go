@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Person-facing channels: "email <addr>[,<addr>...]" and "telegram <chat_id>"
+// alarm actions. Unlike webhook and MQTT payloads, which are JSON for
+// machines, these send NOTIFY_SUBJECT_TEMPLATE/NOTIFY_TEXT_TEMPLATE
+// rendered over the event, and are subject to NOTIFY_RATE_LIMIT per target
+// and NOTIFY_QUIET_HOURS. Messages suppressed by either are dropped, logged
+// and counted, not delayed.
+
+const (
+	defaultSubjectTemplate = `[{{.Event}}] {{.Rule}}`
+	defaultTextTemplate    = `Alarm {{.Event}}: {{.Rule}}
+{{.Field}} = {{.Value}} at {{local .Timestamp}}`
+)
+
+func isMessageChannel(kind string) bool { return kind == "email" || kind == "telegram" }
+
+// notifyMessage is what the spool holds for email and Telegram targets:
+// the rendered message, so a template change doesn't alter queued ones.
+type notifyMessage struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+}
+
+// quietHours is a daily window, possibly spanning midnight, in minutes
+// after midnight.
+type quietHours struct {
+	start, end int
+}
+
+// parseQuietHours parses "22:00-07:00"; "" means no quiet hours.
+func parseQuietHours(s string) (*quietHours, error) {
+	if s == "" {
+		return nil, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+	}
+	var q quietHours
+	for i, part := range []string{from, to} {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+		}
+		m := t.Hour()*60 + t.Minute()
+		if i == 0 {
+			q.start = m
+		} else {
+			q.end = m
+		}
+	}
+	if q.start == q.end {
+		return nil, fmt.Errorf("empty window %q", s)
+	}
+	return &q, nil
+}
+
+func (q *quietHours) contains(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// parseRateLimit parses "6/1h" (at most 6 messages per hour); "" is unlimited.
+func parseRateLimit(s string) (int, time.Duration, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	count, window, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("expected <count>/<duration> like 6/1h, got %q", s)
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("expected <count>/<duration> like 6/1h, got %q", s)
+	}
+	return n, d, nil
+}
+
+// messageGate applies quiet hours and the per-target rate limit.
+type messageGate struct {
+	limit  int
+	window time.Duration
+	quiet  *quietHours
+	loc    *time.Location
+
+	mu   sync.Mutex
+	sent map[string][]time.Time // per kind+target, within the window
+}
+
+// admit reports whether a message to target may go out at now, and why not.
+func (g *messageGate) admit(kind, target string, now time.Time) (bool, string) {
+	if g.quiet.contains(now.In(g.loc)) {
+		return false, "quiet hours"
+	}
+	if g.limit == 0 {
+		return true, ""
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := kind + "\x00" + target
+	recent := g.sent[key][:0]
+	for _, t := range g.sent[key] {
+		if now.Sub(t) < g.window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= g.limit {
+		g.sent[key] = recent
+		return false, fmt.Sprintf("rate limit %d per %v", g.limit, g.window)
+	}
+	g.sent[key] = append(recent, now)
+	return true, ""
+}
+
+type messageTemplates struct {
+	subject, text *template.Template
+}
+
+func parseMessageTemplates(subject, text string, loc *time.Location) (messageTemplates, error) {
+	funcs := template.FuncMap{"local": func(t time.Time) string { return t.In(loc).Format("2006-01-02 15:04:05 MST") }}
+	var mt messageTemplates
+	var err error
+	if mt.subject, err = template.New("subject").Funcs(funcs).Parse(subject); err != nil {
+		return mt, fmt.Errorf("NOTIFY_SUBJECT_TEMPLATE: %w", err)
+	}
+	if mt.text, err = template.New("text").Funcs(funcs).Parse(text); err != nil {
+		return mt, fmt.Errorf("NOTIFY_TEXT_TEMPLATE: %w", err)
+	}
+	return mt, nil
+}
+
+func (mt messageTemplates) render(payload interface{}) ([]byte, error) {
+	var subject, text bytes.Buffer
+	if err := mt.subject.Execute(&subject, payload); err != nil {
+		return nil, err
+	}
+	if err := mt.text.Execute(&text, payload); err != nil {
+		return nil, err
+	}
+	// Header injection guard: the subject is a single line.
+	s := strings.Join(strings.Fields(subject.String()), " ")
+	return json.Marshal(notifyMessage{Subject: s, Text: text.String()})
+}
+
+func (n *Notifier) EmailEnabled() bool    { return n.cfg.SMTPHost != "" && n.cfg.SMTPFrom != "" }
+func (n *Notifier) TelegramEnabled() bool { return n.cfg.TelegramBotToken != "" }
+
+func (n *Notifier) sendEmail(to string, body []byte) error {
+	var m notifyMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return err
+	}
+	var rcpt []string
+	for _, a := range strings.Split(to, ",") {
+		rcpt = append(rcpt, strings.TrimSpace(a))
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", n.cfg.SMTPFrom, strings.Join(rcpt, ", "),
+		mime.QEncoding.Encode("utf-8", m.Subject), time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Text, "\r\n", "\n"), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	var auth smtp.Auth
+	if n.cfg.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", n.cfg.SMTPUsername, n.cfg.SMTPPassword, n.cfg.SMTPHost)
+	}
+	addr := net.JoinHostPort(n.cfg.SMTPHost, strconv.Itoa(n.cfg.SMTPPort))
+	return smtp.SendMail(addr, auth, n.cfg.SMTPFrom, rcpt, msg.Bytes())
+}
+
+func (n *Notifier) sendTelegram(chatID string, body []byte) error {
+	var m notifyMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		return err
+	}
+	req, _ := json.Marshal(map[string]string{"chat_id": chatID, "text": m.Subject + "\n\n" + m.Text})
+	endpoint := strings.TrimRight(n.cfg.TelegramAPIURL, "/") + "/bot" + n.cfg.TelegramBotToken + "/sendMessage"
+	resp, err := n.http.Post(endpoint, "application/json", bytes.NewReader(req))
+	if err != nil {
+		// The URL carries the bot token; keep it out of the logs.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("telegram sendMessage: %w", err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != http.StatusOK || !res.OK {
+		return fmt.Errorf("telegram sendMessage to %s: %s %s", chatID, resp.Status, res.Description)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuietHours(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		tm, _ := time.Parse("15:04", hhmm)
+		return tm
+	}
+	overnight, err := parseQuietHours("22:00-07:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daytime, err := parseQuietHours("12:00-13:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		q    *quietHours
+		at   string
+		want bool
+	}{
+		{overnight, "21:59", false}, {overnight, "22:00", true}, {overnight, "03:00", true},
+		{overnight, "06:59", true}, {overnight, "07:00", false},
+		{daytime, "11:59", false}, {daytime, "12:00", true}, {daytime, "13:29", true}, {daytime, "13:30", false},
+		{nil, "03:00", false},
+	} {
+		if got := tc.q.contains(at(tc.at)); got != tc.want {
+			t.Errorf("%+v contains %s = %v, want %v", tc.q, tc.at, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"22:00", "22:00-25:00", "7-8", "08:00-08:00"} {
+		if _, err := parseQuietHours(bad); err == nil {
+			t.Errorf("parseQuietHours(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestMessageGateRateLimit(t *testing.T) {
+	n, window, err := parseRateLimit("2/1m")
+	if err != nil || n != 2 || window != time.Minute {
+		t.Fatalf("parseRateLimit = %d %v %v", n, window, err)
+	}
+	for _, bad := range []string{"2", "0/1m", "x/1m", "2/soon", "2/-1m"} {
+		if _, _, err := parseRateLimit(bad); err == nil {
+			t.Errorf("parseRateLimit(%q): expected an error", bad)
+		}
+	}
+	g := &messageGate{limit: n, window: window, loc: time.UTC, sent: map[string][]time.Time{}}
+	t0 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, tc := range []struct {
+		kind, target string
+		at           time.Duration
+		want         bool
+	}{
+		{"email", "a@x", 0, true},
+		{"email", "a@x", 10 * time.Second, true},
+		{"email", "a@x", 20 * time.Second, false},
+		{"telegram", "a@x", 20 * time.Second, true}, // targets are counted per channel
+		{"email", "b@x", 20 * time.Second, true},
+		{"email", "a@x", 61 * time.Second, true}, // the first one left the window
+		{"email", "a@x", 65 * time.Second, false},
+	} {
+		if ok, _ := g.admit(tc.kind, tc.target, t0.Add(tc.at)); ok != tc.want {
+			t.Errorf("#%d %s %s at +%v: admit = %v, want %v", i, tc.kind, tc.target, tc.at, ok, tc.want)
+		}
+	}
+
+	q, _ := parseQuietHours("22:00-07:00")
+	g = &messageGate{quiet: q, loc: time.FixedZone("UTC+2", 2*3600)}
+	if ok, why := g.admit("email", "a@x", time.Date(2024, 1, 1, 21, 0, 0, 0, time.UTC)); ok || why != "quiet hours" {
+		t.Errorf("23:00 local: admit = %v %q, want quiet hours", ok, why)
+	}
+	if ok, _ := g.admit("email", "a@x", time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)); !ok {
+		t.Error("14:00 local was held back")
+	}
+}
+
+func testEvent() AlarmEvent {
+	return AlarmEvent{Rule: "when online == false -> telegram 42", Field: "online", Event: "raised", Value: false,
+		Timestamp: time.Date(2024, 3, 1, 22, 15, 0, 0, time.UTC)}
+}
+
+func TestRenderMessage(t *testing.T) {
+	mt, err := parseMessageTemplates(defaultSubjectTemplate, defaultTextTemplate, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := mt.render(testEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m notifyMessage
+	_ = json.Unmarshal(b, &m)
+	if m.Subject != "[raised] when online == false -> telegram 42" {
+		t.Errorf("subject = %q", m.Subject)
+	}
+	if want := "Alarm raised: when online == false -> telegram 42\nonline = false at 2024-03-01 22:15:00 UTC"; m.Text != want {
+		t.Errorf("text = %q, want %q", m.Text, want)
+	}
+
+	mt, _ = parseMessageTemplates("{{.Field}}\nBcc: x@evil", "x", time.UTC)
+	b, _ = mt.render(testEvent())
+	_ = json.Unmarshal(b, &m)
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		t.Errorf("subject keeps a line break: %q", m.Subject)
+	}
+	if _, err := parseMessageTemplates("{{.Field", "x", time.UTC); err == nil {
+		t.Error("bad subject template accepted")
+	}
+}
+
+func TestSendTelegram(t *testing.T) {
+	var got map[string]string
+	var path string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		if got["chat_id"] == "404" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"ok":false,"description":"Bad Request: chat not found"}`)
+			return
+		}
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	defer api.Close()
+	n, err := NewNotifier(Config{TelegramBotToken: "123:abc", TelegramAPIURL: api.URL,
+		NotifySubjectTemplate: "{{.Event}}", NotifyTextTemplate: "{{.Field}}"}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := n.templates.render(testEvent())
+	if err := n.deliver("telegram", "42", body); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/bot123:abc/sendMessage" || got["chat_id"] != "42" || got["text"] != "raised\n\nonline" {
+		t.Errorf("request %s %v", path, got)
+	}
+	if err := n.deliver("telegram", "404", body); err == nil || !strings.Contains(err.Error(), "chat not found") {
+		t.Errorf("failed send: %v", err)
+	}
+}
+
+// fakeSMTP accepts one unauthenticated message and returns its envelope and data.
+func fakeSMTP(t *testing.T) (addr string, result chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	result = make(chan []string, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		reply := func(s string) { io.WriteString(c, s+"\r\n") }
+		reply("220 fake ESMTP")
+		var got []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+			case "EHLO", "HELO", "MAIL", "RCPT":
+				got = append(got, line)
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				got = append(got, data.String())
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				result <- got
+				return
+			default:
+				reply("502 unsupported")
+			}
+		}
+	}()
+	return ln.Addr().String(), result
+}
+
+func TestSendEmail(t *testing.T) {
+	addr, result := fakeSMTP(t)
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := net.LookupPort("tcp", port)
+	n, err := NewNotifier(Config{SMTPHost: host, SMTPPort: p, SMTPFrom: "display@example.com",
+		NotifySubjectTemplate: defaultSubjectTemplate, NotifyTextTemplate: defaultTextTemplate}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := n.templates.render(testEvent())
+	if err := n.deliver("email", "ops@example.com, oncall@example.com", body); err != nil {
+		t.Fatal(err)
+	}
+	got := <-result
+	want := []string{"MAIL FROM:<display@example.com>", "RCPT TO:<ops@example.com>", "RCPT TO:<oncall@example.com>"}
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			found = found || strings.HasPrefix(g, w)
+		}
+		if !found {
+			t.Errorf("missing %q in %q", w, got)
+		}
+	}
+	data := got[len(got)-1]
+	for _, w := range []string{"Subject: [raised] when online == false -> telegram 42\r\n", "To: ops@example.com, oncall@example.com\r\n",
+		"\r\n\r\nAlarm raised: when online == false -> telegram 42\r\nonline = false at"} {
+		if !strings.Contains(data, w) {
+			t.Errorf("message lacks %q:\n%s", w, data)
+		}
+	}
+}
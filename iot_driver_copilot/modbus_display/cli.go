@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// Local operations for technicians:
+//
+//	driver [serve]                       run the daemon (default)
+//	driver status [-url URL]             print the device status as JSON
+//	driver write-value [-url URL] TEXT   write the display value
+//	driver scan [-from N] [-to N]        probe the bus for responding slave ids
+//	driver version                       print the build's version information
+//	driver seal < settings.json          encrypt settings for CONFIG_FILE's "sealed"
+//	driver gen-regmap table.csv          register settings from a vendor table (regmap.go)
+//	driver check-config                  validate the configuration without starting
+//	driver sign-config -key K < cfg.json sign a CONFIG_FILE for config sync (configsync.go)
+//
+// With -url (or DRIVER_URL) the command goes through a running daemon's HTTP
+// API; otherwise it opens SERIAL_PORT itself using the daemon's environment,
+// which fails while the daemon holds the port.
+
+const cliUsage = `usage: driver [command]
+
+commands:
+  serve                       run the HTTP driver (default)
+  status [-url URL] [-api-key KEY]
+                              print the device status as JSON
+  write-value [-url URL] [-api-key KEY] TEXT
+                              write TEXT to the display
+  scan [-from N] [-to N] [-timeout D]
+                              list slave ids that answer on SERIAL_PORT
+  version                     print version and build information as JSON
+  seal                        read a JSON object of settings from stdin and print
+                              it sealed for CONFIG_FILE, using CONFIG_KEY_FILE or
+                              CONFIG_KEYRING_KEY
+  gen-regmap [-profile NAME] [-base N] [-o FILE] FILE.csv
+                              convert a vendor register table (CSV) into the
+                              REG_* settings of a CONFIG_FILE
+  check-config                load the configuration as serve would and exit 1
+                              with the first error
+  sign-config -key FILE [-public]
+                              print the signature of the CONFIG_FILE on stdin for
+                              CONFIG_SYNC_URL, or with -public the CONFIG_SYNC_KEY
+                              of FILE, a PEM Ed25519 private key
+`
+
+// runCLI executes a subcommand and returns the process exit code.
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var err error
+	switch args[0] {
+	case "status":
+		err = cliStatus(args[1:], stdout, stderr)
+	case "write-value":
+		err = cliWriteValue(args[1:], stderr)
+	case "scan":
+		err = cliScan(args[1:], stdout, stderr)
+	case "version":
+		err = cliVersion(stdout)
+	case "seal":
+		err = cliSeal(stdin, stdout)
+	case "gen-regmap":
+		err = cliGenRegmap(args[1:], stdin, stdout, stderr)
+	case "check-config":
+		err = cliCheckConfig(stdout)
+	case "sign-config":
+		err = cliSignConfig(args[1:], stdin, stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// cliAPIKey is sent as X-API-Key to a driver with TENANT_KEYS set.
+var cliAPIKey string
+
+func cliFlags(name string, stderr io.Writer) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	url := fs.String("url", os.Getenv("DRIVER_URL"), "base URL of a running driver, e.g. http://localhost:8080 or unix:///run/copilot/display.sock")
+	fs.StringVar(&cliAPIKey, "api-key", os.Getenv("API_KEY"), "tenant API key for a driver with TENANT_KEYS set")
+	return fs, url
+}
+
+// cliDriver opens the serial port directly, without the notifier, alarms or
+// background loops of the daemon; it logs to stderr.
+func cliDriver(cfg Config, stderr io.Writer) (*ModbusDriver, error) {
+	d := &ModbusDriver{cfg: cfg, logger: log.New(stderr, "[modbus-display] ", log.LstdFlags)}
+	d.codec = asciiCodec{Regs: cfg.DisplayValueRegs, Pad: cfg.DisplayPad, Right: cfg.DisplayAlign == "right", Strict: cfg.DisplayStrict}
+	d.changes = newChangeTracker()
+	d.readOnly.Store(cfg.ReadOnly)
+	if err := d.ensureConnected(context.Background()); err != nil {
+		return nil, fmt.Errorf("open %s: %w", cfg.SerialPort, err)
+	}
+	return d, nil
+}
+
+func cliHTTP(method, base, path string, body interface{}) ([]byte, error) {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rd = bytes.NewReader(b)
+	}
+	client, base := cliClient(strings.TrimRight(base, "/"), 30*time.Second)
+	req, err := http.NewRequest(method, base+path, rd)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cliAPIKey != "" {
+		req.Header.Set("X-API-Key", cliAPIKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+func cliStatus(args []string, stdout, stderr io.Writer) error {
+	fs, url := cliFlags("status", stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *url != "" {
+		out, err := cliHTTP(http.MethodGet, *url, "/status", nil)
+		if err != nil {
+			return err
+		}
+		_, err = stdout.Write(out)
+		return err
+	}
+	d, err := cliDriver(LoadConfig(), stderr)
+	if err != nil {
+		return err
+	}
+	defer d.closeConn()
+	if err := d.readAndUpdateStatus(); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d.status)
+}
+
+func cliVersion(stdout io.Writer) error {
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(buildVersion())
+}
+
+func cliSeal(stdin io.Reader, stdout io.Writer) error {
+	key, err := configKey()
+	if err != nil {
+		return err
+	}
+	plain, err := io.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	sealed, err := sealSettings(plain, key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, sealed)
+	return nil
+}
+
+// cliCheckConfig loads the configuration as serve would; LoadConfig exits
+// on the first bad setting.
+func cliCheckConfig(stdout io.Writer) error {
+	cfg := LoadConfig()
+	rules := cfg.AlarmRules
+	if cfg.AlarmRulesFile != "" {
+		b, err := os.ReadFile(cfg.AlarmRulesFile)
+		if err != nil {
+			return err
+		}
+		rules = string(b)
+	}
+	if _, err := ParseAlarmRules(rules); err != nil {
+		return fmt.Errorf("alarm rules: %w", err)
+	}
+	fmt.Fprintln(stdout, "ok")
+	return nil
+}
+
+// cliSignConfig signs stdin with an Ed25519 key such as
+// "openssl genpkey -algorithm ed25519" writes.
+func cliSignConfig(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("sign-config", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	keyFile := fs.String("key", "", "PEM (PKCS #8) Ed25519 private key")
+	public := fs.Bool("public", false, "print the public key for CONFIG_SYNC_KEY instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" {
+		return fmt.Errorf("-key is required")
+	}
+	raw, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return fmt.Errorf("%s: no PEM block", *keyFile)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %w", *keyFile, err)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("%s: not an Ed25519 key", *keyFile)
+	}
+	if *public {
+		fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)))
+		return nil
+	}
+	doc, err := io.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString(ed25519.Sign(key, doc)))
+	return nil
+}
+
+func cliWriteValue(args []string, stderr io.Writer) error {
+	fs, url := cliFlags("write-value", stderr)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected exactly one value argument")
+	}
+	val := strings.TrimSpace(fs.Arg(0))
+	if val == "" {
+		return fmt.Errorf("display value is empty")
+	}
+	if *url != "" {
+		_, err := cliHTTP(http.MethodPut, *url, "/display/value", map[string]string{"display_value": val})
+		return err
+	}
+	d, err := cliDriver(LoadConfig(), stderr)
+	if err != nil {
+		return err
+	}
+	defer d.closeConn()
+	return d.writeDisplayText(val)
+}
+
+func cliScan(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	from := fs.Int("from", 1, "first slave id")
+	to := fs.Int("to", 247, "last slave id")
+	timeout := fs.Duration("timeout", 200*time.Millisecond, "response timeout per slave")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from < 1 || *to > 247 || *from > *to {
+		return fmt.Errorf("slave id range must be within 1..247")
+	}
+	cfg := LoadConfig()
+	cfg.ModbusTimeout = *timeout
+	d, err := cliDriver(cfg, stderr)
+	if err != nil {
+		return err
+	}
+	defer d.closeConn()
+	found := 0
+	for id := *from; id <= *to; id++ {
+		var addr uint16
+		err := d.withSlave(byte(id), func(c modbus.Client) error {
+			b, err := c.ReadHoldingRegisters(d.cfg.RegDeviceAddress, 1)
+			if err == nil && len(b) >= 2 {
+				addr = binary.BigEndian.Uint16(b)
+			}
+			return err
+		})
+		var mbErr *modbus.ModbusError
+		switch {
+		case err == nil:
+			fmt.Fprintf(stdout, "slave %d: responding (device_address register = %d)\n", id, addr)
+		case errors.As(err, &mbErr):
+			// An exception reply still proves a slave owns this id.
+			fmt.Fprintf(stdout, "slave %d: responding (%v)\n", id, err)
+		default:
+			continue
+		}
+		found++
+	}
+	fmt.Fprintf(stdout, "%d slave(s) found between %d and %d\n", found, *from, *to)
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"modbus-display-driver/internal/modbustest"
+)
+
+// cliRun runs a subcommand the way main does and returns its exit code and
+// output.
+func cliRun(t *testing.T, stdin string, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	code = runCLI(args, strings.NewReader(stdin), &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+// cliRequest is what a fake driver saw of one CLI request.
+type cliRequest struct {
+	Method, Path, APIKey, ContentType, Body string
+}
+
+// fakeDriverAPI answers every request with status and body and records
+// what it was sent.
+func fakeDriverAPI(t *testing.T, status int, body string) (*httptest.Server, func() []cliRequest) {
+	var mu sync.Mutex
+	var reqs []cliRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		reqs = append(reqs, cliRequest{r.Method, r.URL.Path, r.Header.Get("X-API-Key"), r.Header.Get("Content-Type"), string(b)})
+		mu.Unlock()
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []cliRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]cliRequest(nil), reqs...)
+	}
+}
+
+func TestCLIStatusOverHTTP(t *testing.T) {
+	t.Setenv("DRIVER_URL", "")
+	t.Setenv("API_KEY", "")
+	const status = `{"online":true,"display_value":"12.5"}`
+	srv, sent := fakeDriverAPI(t, http.StatusOK, status)
+
+	code, out, errOut := cliRun(t, "", "status", "-url", srv.URL+"/", "-api-key", "tenant-a")
+	if code != 0 || out != status || errOut != "" {
+		t.Fatalf("status = %d, stdout %q, stderr %q", code, out, errOut)
+	}
+	if got := sent(); len(got) != 1 || got[0] != (cliRequest{Method: "GET", Path: "/status", APIKey: "tenant-a"}) {
+		t.Errorf("requests %+v", got)
+	}
+
+	// DRIVER_URL and API_KEY stand in for the flags.
+	t.Setenv("DRIVER_URL", srv.URL)
+	t.Setenv("API_KEY", "tenant-b")
+	if code, out, _ := cliRun(t, "", "status"); code != 0 || out != status {
+		t.Errorf("status from DRIVER_URL = %d %q", code, out)
+	}
+	if got := sent(); len(got) != 2 || got[1].APIKey != "tenant-b" {
+		t.Errorf("requests %+v", got)
+	}
+
+	down, _ := fakeDriverAPI(t, http.StatusServiceUnavailable, "device offline\n")
+	code, out, errOut = cliRun(t, "", "status", "-url", down.URL)
+	if code != 1 || out != "" || errOut != "status: 503 Service Unavailable: device offline\n" {
+		t.Errorf("status from a failing driver = %d, stdout %q, stderr %q", code, out, errOut)
+	}
+}
+
+func TestCLIStatusOverUnixSocket(t *testing.T) {
+	t.Setenv("API_KEY", "")
+	sock := filepath.Join(t.TempDir(), "display.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Method+" "+r.URL.Path)
+	}))
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+	if code, out, errOut := cliRun(t, "", "status", "-url", "unix://"+sock); code != 0 || out != "GET /status" {
+		t.Errorf("status over %s = %d, stdout %q, stderr %q", sock, code, out, errOut)
+	}
+}
+
+func TestCLIWriteValueOverHTTP(t *testing.T) {
+	t.Setenv("DRIVER_URL", "")
+	t.Setenv("API_KEY", "")
+	srv, sent := fakeDriverAPI(t, http.StatusOK, `{"ok":true}`)
+
+	code, out, errOut := cliRun(t, "", "write-value", "-url", srv.URL, "  12.5 ")
+	if code != 0 || out != "" || errOut != "" {
+		t.Fatalf("write-value = %d, stdout %q, stderr %q", code, out, errOut)
+	}
+	want := cliRequest{Method: "PUT", Path: "/display/value", ContentType: "application/json", Body: `{"display_value":"12.5"}`}
+	if got := sent(); len(got) != 1 || got[0] != want {
+		t.Errorf("requests %+v, want %+v", got, want)
+	}
+
+	for _, args := range [][]string{
+		{"write-value", "-url", srv.URL},
+		{"write-value", "-url", srv.URL, "1", "2"},
+		{"write-value", "-url", srv.URL, " "},
+	} {
+		if code, _, errOut := cliRun(t, "", args...); code != 1 || !strings.HasPrefix(errOut, "write-value: ") {
+			t.Errorf("%q = %d, stderr %q", args, code, errOut)
+		}
+	}
+	if got := sent(); len(got) != 1 {
+		t.Errorf("invalid arguments were sent to the driver: %+v", got[1:])
+	}
+
+	locked, _ := fakeDriverAPI(t, http.StatusLocked, "driver is read-only\n")
+	if code, _, errOut := cliRun(t, "", "write-value", "-url", locked.URL, "7"); code != 1 || errOut != "write-value: 423 Locked: driver is read-only\n" {
+		t.Errorf("write-value to a read-only driver = %d, stderr %q", code, errOut)
+	}
+}
+
+func TestCLIUsage(t *testing.T) {
+	if code, out, _ := cliRun(t, "", "help"); code != 0 || out != cliUsage {
+		t.Errorf("help = %d %q", code, out)
+	}
+	if code, out, errOut := cliRun(t, "", "frobnicate"); code != 2 || out != "" || !strings.HasPrefix(errOut, `unknown command "frobnicate"`) || !strings.HasSuffix(errOut, cliUsage) {
+		t.Errorf("unknown command = %d, stdout %q, stderr %q", code, out, errOut)
+	}
+	if code, _, errOut := cliRun(t, "", "status", "-bogus"); code != 1 || !strings.Contains(errOut, "flag provided but not defined: -bogus") {
+		t.Errorf("unknown flag = %d, stderr %q", code, errOut)
+	}
+	if code, _, errOut := cliRun(t, "", "scan", "-from", "10", "-to", "5"); code != 1 || errOut != "scan: slave id range must be within 1..247\n" {
+		t.Errorf("scan with an empty range = %d, stderr %q", code, errOut)
+	}
+
+	code, out, _ := cliRun(t, "", "version")
+	var v versionInfo
+	if err := json.Unmarshal([]byte(out), &v); code != 0 || err != nil || v.Version != version || v.GoVersion == "" {
+		t.Errorf("version = %d %q (%v)", code, out, err)
+	}
+}
+
+func TestCLISignConfig(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := filepath.Join(t.TempDir(), "config.key")
+	if err := os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	const doc = `{"defaults":{"BAUD_RATE":9600}}`
+	code, out, _ := cliRun(t, doc, "sign-config", "-key", key)
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(out))
+	if code != 0 || err != nil || !ed25519.Verify(pub, []byte(doc), sig) {
+		t.Errorf("sign-config = %d %q: not a signature of stdin", code, out)
+	}
+	if code, out, _ := cliRun(t, "", "sign-config", "-key", key, "-public"); code != 0 || out != base64.StdEncoding.EncodeToString(pub)+"\n" {
+		t.Errorf("sign-config -public = %d %q", code, out)
+	}
+	if code, _, errOut := cliRun(t, doc, "sign-config"); code != 1 || errOut != "sign-config: -key is required\n" {
+		t.Errorf("sign-config without -key = %d %q", code, errOut)
+	}
+	if code, _, errOut := cliRun(t, doc, "sign-config", "-key", os.DevNull); code != 1 || !strings.Contains(errOut, "no PEM block") {
+		t.Errorf("sign-config with an empty key = %d %q", code, errOut)
+	}
+}
+
+// cliSerialEnv is the environment of a daemon whose display is sim.
+func cliSerialEnv(t *testing.T, sim *modbustest.Server) {
+	t.Helper()
+	path, err := sim.ListenRTU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"SERIAL_PORT": path, "SLAVE_ID": "1", "BAUD_RATE": "9600", "DATA_BITS": "8", "PARITY": "N", "STOP_BITS": "1",
+		"HTTP_HOST": "127.0.0.1", "HTTP_PORT": "0",
+		"MODBUS_TIMEOUT_MS": "100", "POLL_INTERVAL_MS": "50", "BACKOFF_INITIAL_MS": "20", "BACKOFF_MAX_MS": "100",
+		"REG_ADDR_DEVICE_ADDRESS": "0", "REG_ADDR_BAUD_RATE": "1", "REG_ADDR_COMM_FORMAT": "2", "REG_ADDR_WORK_MODE": "3",
+		"REG_ADDR_VALUE_TYPE": "4", "REG_ADDR_DECIMALS": "5", "REG_ADDR_DP_MASK": "6", "REG_ADDR_BLINK_MASK": "7",
+		"REG_ADDR_BLINK_PERIOD_MS": "8", "REG_ADDR_DISPLAY_VALUE_START": strconv.Itoa(testRegDisplay),
+		"REG_DISPLAY_VALUE_REGS": strconv.Itoa(testRegsDisplay),
+		"CONFIG_FILE":            "", "DRIVER_URL": "",
+	} {
+		t.Setenv(k, v)
+	}
+}
+
+func TestCLIScan(t *testing.T) {
+	sim := modbustest.NewServer(2)
+	defer sim.Close()
+	sim.SetRegisters(0, 2)
+	cliSerialEnv(t, sim)
+
+	code, out, _ := cliRun(t, "", "scan", "-from", "1", "-to", "3", "-timeout", "100ms")
+	want := "slave 2: responding (device_address register = 2)\n1 slave(s) found between 1 and 3\n"
+	if code != 0 || out != want {
+		t.Errorf("scan = %d %q, want %q", code, out, want)
+	}
+}
+
+func TestCLIFromSerialPort(t *testing.T) {
+	sim := modbustest.NewServer(1)
+	defer sim.Close()
+	sim.SetRegisters(0, 1, 9600, 0)
+	cliSerialEnv(t, sim)
+
+	code, out, errOut := cliRun(t, "", "status")
+	var st DeviceStatus
+	if err := json.Unmarshal([]byte(out), &st); code != 0 || err != nil {
+		t.Fatalf("status = %d %q %q (%v)", code, out, errOut, err)
+	}
+	if st.DeviceAddress != 1 || st.BaudRate != 9600 {
+		t.Errorf("status %+v", st)
+	}
+
+	if code, _, errOut := cliRun(t, "", "write-value", "42"); code != 0 {
+		t.Fatalf("write-value = %d %q", code, errOut)
+	}
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); got != "42      " {
+		t.Errorf("display registers hold %q after write-value", got)
+	}
+
+	t.Setenv("SERIAL_PORT", filepath.Join(t.TempDir(), "ttyUSB9"))
+	if code, out, errOut := cliRun(t, "", "status"); code != 1 || out != "" || !strings.HasPrefix(errOut, "status: open ") {
+		t.Errorf("status without the serial port = %d, stdout %q, stderr %q", code, out, errOut)
+	}
+}
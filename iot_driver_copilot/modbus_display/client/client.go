@@ -0,0 +1,168 @@
+// Package client is a typed Go client for the Modbus display driver's HTTP
+// API, for services that drive displays without hand-rolling requests:
+//
+//	c, err := client.New("http://display-1:8080", client.WithAPIKey(key), client.WithRetry(5, 100*time.Millisecond, 2*time.Second))
+//	if err != nil { ... }
+//	if err := c.SetDisplayValue(ctx, "12.5"); err != nil { ... }
+//	st, err := c.GetStatus(ctx)
+//
+// The base URL may carry a path prefix (a driver behind a proxy) or be
+// unix:///run/copilot/display.sock for a driver listening on a socket.
+// Requests that fail to reach the driver, or that it answers with 429,
+// 502, 503 or 504, are retried with exponential backoff; every other
+// answer is returned at once, errors as *Error.
+//
+// The package uses only the standard library and does not import the
+// driver, so it can be vendored on its own. Status follows the driver's
+// default JSON; a driver with STATUS_FIELD_MAP renames fields it cannot
+// see.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client talks to one driver. It is safe for concurrent use.
+type Client struct {
+	base   string
+	http   *http.Client
+	apiKey string
+
+	attempts     int
+	backoff      time.Duration
+	backoffLimit time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAPIKey sends key as a bearer token, for a driver with TENANT_KEYS or
+// ADMIN_TOKEN set.
+func WithAPIKey(key string) Option { return func(c *Client) { c.apiKey = key } }
+
+// WithHTTPClient replaces the default HTTP client (30 s timeout). For a
+// unix:// base URL its transport is replaced.
+func WithHTTPClient(hc *http.Client) Option { return func(c *Client) { c.http = hc } }
+
+// WithRetry makes up to attempts tries of a request, waiting initial
+// before the second and doubling up to max. attempts 1 turns retrying off.
+func WithRetry(attempts int, initial, max time.Duration) Option {
+	return func(c *Client) { c.attempts, c.backoff, c.backoffLimit = attempts, initial, max }
+}
+
+// New returns a client for the driver at baseURL, with three attempts per
+// request starting at 200 ms apart unless WithRetry says otherwise.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	c := &Client{
+		base:     strings.TrimRight(baseURL, "/"),
+		http:     &http.Client{Timeout: 30 * time.Second},
+		attempts: 3, backoff: 200 * time.Millisecond, backoffLimit: 5 * time.Second,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.attempts < 1 || c.backoff < 0 || c.backoffLimit < c.backoff {
+		return nil, fmt.Errorf("client: invalid retry settings (%d attempts, %v to %v)", c.attempts, c.backoff, c.backoffLimit)
+	}
+	if path, ok := strings.CutPrefix(c.base, "unix://"); ok {
+		hc := *c.http
+		hc.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}}
+		c.http, c.base = &hc, "http://localhost"
+	} else if !strings.HasPrefix(c.base, "http://") && !strings.HasPrefix(c.base, "https://") {
+		return nil, fmt.Errorf("client: base URL %q is not http://, https:// or unix://", baseURL)
+	}
+	return c, nil
+}
+
+// Error is a reply the driver gave with a status of 300 or more.
+type Error struct {
+	StatusCode int
+	Message    string // the body, trimmed
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("driver replied %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func retryable(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// do sends method path with body (JSON-encoded unless nil), retrying as
+// configured, and decodes a JSON reply into out unless it is nil.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	wait := c.backoff
+	for attempt := 1; ; attempt++ {
+		err := c.once(ctx, method, path, payload, out)
+		var re *Error
+		if err == nil || ctx.Err() != nil || attempt == c.attempts || (errors.As(err, &re) && !retryable(re.StatusCode)) {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		if wait *= 2; wait > c.backoffLimit {
+			wait = c.backoffLimit
+		}
+	}
+}
+
+func (c *Client) once(ctx context.Context, method, path string, payload []byte, out interface{}) error {
+	var rd io.Reader
+	if payload != nil {
+		rd = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, rd)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode %s %s: %w", method, path, err)
+	}
+	return nil
+}
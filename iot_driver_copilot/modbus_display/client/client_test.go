@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer k1" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/status":
+			if calls.Add(1) < 3 {
+				http.Error(w, "cluster standby", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"display_value": "12.5", "decimals": 1}`))
+		case "/display/value":
+			http.Error(w, "display_value required", http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	c, err := New(srv.URL+"/", WithAPIKey("k1"), WithRetry(3, time.Millisecond, 2*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := c.GetStatus(ctx)
+	if err != nil || st.DisplayValue != "12.5" || st.Decimals != 1 || calls.Load() != 3 {
+		t.Fatalf("GetStatus = %+v, %v after %d calls", st, err, calls.Load())
+	}
+	var re *Error
+	if err := c.SetDisplayValue(ctx, ""); !errors.As(err, &re) || re.StatusCode != http.StatusBadRequest || re.Message != "display_value required" {
+		t.Errorf("SetDisplayValue = %v", err)
+	}
+
+	calls.Store(0)
+	c, _ = New(srv.URL, WithAPIKey("k1"), WithRetry(2, time.Millisecond, time.Millisecond))
+	if _, err := c.GetStatus(ctx); !errors.As(err, &re) || re.StatusCode != http.StatusServiceUnavailable || calls.Load() != 2 {
+		t.Errorf("GetStatus with 2 attempts = %v after %d calls", err, calls.Load())
+	}
+
+	for _, base := range []string{"display-1:8080", "ftp://x"} {
+		if _, err := New(base); err == nil {
+			t.Errorf("New(%q) accepted", base)
+		}
+	}
+	if _, err := New(srv.URL, WithRetry(0, 0, 0)); err == nil {
+		t.Error("New accepted 0 attempts")
+	}
+}
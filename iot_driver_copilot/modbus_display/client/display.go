@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Status is GET /status: the device's configuration and display state as
+// of the driver's last poll.
+type Status struct {
+	DeviceAddress   int                       `json:"device_address"`
+	BaudRate        int                       `json:"baud_rate"`
+	CommFormat      string                    `json:"comm_format"`
+	WorkMode        uint16                    `json:"work_mode"`
+	DisplayValue    string                    `json:"display_value"`
+	ValueType       uint16                    `json:"value_type"`
+	Decimals        uint16                    `json:"decimals"`
+	DpMask          uint16                    `json:"dp_mask"`
+	BlinkMask       uint16                    `json:"blink_mask"`
+	BlinkPeriodMs   uint16                    `json:"blink_period_ms"`
+	ExternalChanges map[string]ExternalChange `json:"external_changes,omitempty"`
+	Sensors         map[string]float64        `json:"sensors,omitempty"`
+}
+
+// ExternalChange is a field a poll found changed without the driver
+// having written it.
+type ExternalChange struct {
+	At   time.Time   `json:"at"`
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// Health is GET /healthz. Fields the driver only reports with the matching
+// feature configured (NTP_SERVER, VALUE_STALE_AFTER_MS, CLUSTER_LEASE_FILE)
+// are left in Extra.
+type Health struct {
+	Status     string                 `json:"status"` // "ok" or "degraded"
+	SerialPort *PortCheck             `json:"serial_port,omitempty"`
+	Clock      map[string]interface{} `json:"clock"`
+	Extra      map[string]interface{} `json:"-"`
+}
+
+// PortCheck is the driver's view of its serial port.
+type PortCheck struct {
+	Port    string    `json:"port"`
+	OK      bool      `json:"ok"`
+	Problem string    `json:"problem,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// GetStatus returns the device status.
+func (c *Client) GetStatus(ctx context.Context) (*Status, error) {
+	var st Status
+	if err := c.do(ctx, http.MethodGet, "/status", nil, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Health returns the driver's health document.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	var raw map[string]interface{}
+	if err := c.do(ctx, http.MethodGet, "/healthz", nil, &raw); err != nil {
+		return nil, err
+	}
+	var h Health
+	if err := remarshal(raw, &h); err != nil {
+		return nil, err
+	}
+	delete(raw, "status")
+	delete(raw, "serial_port")
+	delete(raw, "clock")
+	h.Extra = raw
+	return &h, nil
+}
+
+// SetDisplayValue shows value on the display. The driver persists it for
+// power-cycle recovery when DESIRED_VALUE_FILE is set; see
+// SetDisplayValueTransient. With DISPLAY_WRITE_INTERVAL_MS the driver
+// queues the write and SetDisplayValue returns before it reaches the
+// device.
+func (c *Client) SetDisplayValue(ctx context.Context, value string) error {
+	return c.setDisplayValue(ctx, value, true)
+}
+
+// SetDisplayValueTransient shows value without persisting it ("persist":
+// false), and makes the driver forget any persisted value.
+func (c *Client) SetDisplayValueTransient(ctx context.Context, value string) error {
+	return c.setDisplayValue(ctx, value, false)
+}
+
+func (c *Client) setDisplayValue(ctx context.Context, value string, persist bool) error {
+	body := struct {
+		DisplayValue string `json:"display_value"`
+		Persist      bool   `json:"persist"`
+	}{value, persist}
+	return c.do(ctx, http.MethodPut, "/display/value", body, nil)
+}
+
+// remarshal decodes a generic JSON value into a typed one.
+func remarshal(in, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Clock block: consecutive holding registers starting at REG_ADDR_CLOCK_START,
+// one field per register in CLOCK_LAYOUT order. Supported fields:
+// year (4-digit), year2 (2-digit), month, day, hour, minute, second,
+// weekday (0=Sunday). With CLOCK_BCD=true each value is BCD encoded.
+
+var clockFields = map[string]bool{
+	"year": true, "year2": true, "month": true, "day": true,
+	"hour": true, "minute": true, "second": true, "weekday": true,
+}
+
+func parseClockLayout(s string) ([]string, error) {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if !clockFields[f] {
+			return nil, fmt.Errorf("unknown clock field %q", f)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+func toBCD(v int) uint16 {
+	var out uint16
+	for shift := 0; v > 0 && shift < 16; shift += 4 {
+		out |= uint16(v%10) << shift
+		v /= 10
+	}
+	return out
+}
+
+func fromBCD(v uint16) int {
+	out, mul := 0, 1
+	for ; v > 0; v >>= 4 {
+		out += int(v&0xF) * mul
+		mul *= 10
+	}
+	return out
+}
+
+func (d *ModbusDriver) encodeClock(t time.Time) []uint16 {
+	vals := make([]uint16, len(d.cfg.ClockLayout))
+	for i, f := range d.cfg.ClockLayout {
+		var v int
+		switch f {
+		case "year":
+			v = t.Year()
+		case "year2":
+			v = t.Year() % 100
+		case "month":
+			v = int(t.Month())
+		case "day":
+			v = t.Day()
+		case "hour":
+			v = t.Hour()
+		case "minute":
+			v = t.Minute()
+		case "second":
+			v = t.Second()
+		case "weekday":
+			v = int(t.Weekday())
+		}
+		if d.cfg.ClockBCD {
+			vals[i] = toBCD(v)
+		} else {
+			vals[i] = uint16(v)
+		}
+	}
+	return vals
+}
+
+func (d *ModbusDriver) decodeClock(vals []uint16) map[string]int {
+	out := map[string]int{}
+	for i, f := range d.cfg.ClockLayout {
+		if i >= len(vals) {
+			break
+		}
+		v := int(vals[i])
+		if d.cfg.ClockBCD {
+			v = fromBCD(vals[i])
+		}
+		out[f] = v
+	}
+	return out
+}
+
+// syncClock writes the current time (NTP_SERVER's, else the host's),
+// converted to CLOCK_TIMEZONE, to the device.
+func (d *ModbusDriver) syncClock() (time.Time, error) {
+	now := d.clock.Now().In(d.cfg.ClockLocation)
+	// Round to the next whole second so the display doesn't start up to a second behind.
+	if ns := now.Nanosecond(); ns > 0 {
+		time.Sleep(time.Duration(1e9 - ns))
+		now = now.Add(time.Duration(1e9 - ns))
+	}
+	vals := d.encodeClock(now)
+	payload := make([]byte, 2*len(vals))
+	for i, v := range vals {
+		binary.BigEndian.PutUint16(payload[2*i:], v)
+	}
+	if err := d.writeRegs(d.cfg.RegClockStart, uint16(len(vals)), payload); err != nil {
+		return now, err
+	}
+	d.logger.Printf("device clock set to %s", now.Format(time.RFC3339))
+	return now, nil
+}
+
+// nextClockSync returns the first CLOCK_AUTO_SYNC_AT local (CLOCK_TIMEZONE)
+// time after now. On a DST change a repeated time is its first occurrence,
+// and a skipped one (02:30 when clocks go from 02:00 to 03:00) moves on by
+// the gap, to 03:30.
+func (d *ModbusDriver) nextClockSync(now time.Time) time.Time {
+	now = now.In(d.cfg.ClockLocation)
+	next := d.clockSyncOn(now.Year(), now.Month(), now.Day())
+	if !next.After(now) {
+		next = d.clockSyncOn(now.Year(), now.Month(), now.Day()+1)
+	}
+	return next
+}
+
+func (d *ModbusDriver) clockSyncOn(year int, month time.Month, day int) time.Time {
+	h, m := d.cfg.ClockAutoSyncHour, d.cfg.ClockAutoSyncMinute
+	t := time.Date(year, month, day, h, m, 0, 0, d.cfg.ClockLocation)
+	// time.Date puts a skipped time the gap before it, in the old offset.
+	if gap := ((h*60 + m) - (t.Hour()*60 + t.Minute()) + 24*60) % (24 * 60); gap != 0 {
+		t = t.Add(time.Duration(gap) * time.Minute)
+	}
+	return t
+}
+
+// clockAutoSyncLoop re-syncs the clock once a day at CLOCK_AUTO_SYNC_AT.
+func (d *ModbusDriver) clockAutoSyncLoop(ctx context.Context) {
+	for {
+		now := d.clock.Now()
+		next := d.nextClockSync(now)
+		select {
+		case <-time.After(next.Sub(now)):
+		case <-ctx.Done():
+			return
+		}
+		if _, err := d.syncClock(); err != nil {
+			d.logger.Printf("scheduled clock sync failed: %v", err)
+		}
+	}
+}
+
+func (d *ModbusDriver) handleClockSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(d.cfg.ClockLayout) == 0 {
+		http.Error(w, "clock block not configured", http.StatusNotFound)
+		return
+	}
+	if dryRun(r) {
+		// The time is the whole second syncClock would wait for.
+		now := d.clock.Now().In(d.cfg.ClockLocation)
+		if ns := now.Nanosecond(); ns > 0 {
+			now = now.Add(time.Duration(1e9 - ns))
+		}
+		op := planWrite("clock", d.linkSlave(), 16, d.cfg.RegClockStart, d.encodeClock(now)...)
+		op.Detail = map[string]string{"time": now.Format(time.RFC3339), "timezone": d.cfg.ClockLocation.String()}
+		d.replyDryRun(w, []plannedOp{op})
+		return
+	}
+	t, err := d.syncClock()
+	if err != nil {
+		d.logger.Printf("clock sync failed: %v", err)
+		http.Error(w, "device write error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "time": t.Format(time.RFC3339), "timezone": d.cfg.ClockLocation.String()})
+}
+
+func (d *ModbusDriver) handleClock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(d.cfg.ClockLayout) == 0 {
+		http.Error(w, "clock block not configured", http.StatusNotFound)
+		return
+	}
+	b, err := d.readRegs(d.cfg.RegClockStart, uint16(len(d.cfg.ClockLayout)))
+	if err != nil {
+		d.logger.Printf("read clock failed: %v", err)
+		http.Error(w, "device read error", http.StatusInternalServerError)
+		return
+	}
+	vals := make([]uint16, len(b)/2)
+	for i := range vals {
+		vals[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(d.decodeClock(vals))
+}
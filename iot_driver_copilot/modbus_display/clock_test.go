@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBCD(t *testing.T) {
+	for _, c := range []struct {
+		v   int
+		bcd uint16
+	}{
+		{0, 0x0000}, {7, 0x0007}, {10, 0x0010}, {59, 0x0059}, {99, 0x0099}, {2026, 0x2026}, {9999, 0x9999},
+	} {
+		if got := toBCD(c.v); got != c.bcd {
+			t.Errorf("toBCD(%d) = %#04x, want %#04x", c.v, got, c.bcd)
+		}
+		if got := fromBCD(c.bcd); got != c.v {
+			t.Errorf("fromBCD(%#04x) = %d, want %d", c.bcd, got, c.v)
+		}
+	}
+}
+
+func TestEncodeClock(t *testing.T) {
+	// A Saturday.
+	at := time.Date(2026, time.March, 7, 9, 5, 42, 0, time.UTC)
+	fields := map[string]int{"year": 2026, "year2": 26, "month": 3, "day": 7, "hour": 9, "minute": 5, "second": 42, "weekday": 6}
+	for _, c := range []struct {
+		layout string
+		bcd    bool
+		want   []uint16
+	}{
+		{"year,month,day,hour,minute,second", false, []uint16{2026, 3, 7, 9, 5, 42}},
+		{"year,month,day,hour,minute,second", true, []uint16{0x2026, 0x03, 0x07, 0x09, 0x05, 0x42}},
+		{"second, minute, hour, weekday, day, month, year2", true, []uint16{0x42, 0x05, 0x09, 0x06, 0x07, 0x03, 0x26}},
+		{"hour,minute", false, []uint16{9, 5}},
+	} {
+		layout, err := parseClockLayout(c.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := &ModbusDriver{cfg: Config{ClockLayout: layout, ClockBCD: c.bcd}}
+		got := d.encodeClock(at)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s (bcd %v): %#04x, want %#04x", c.layout, c.bcd, got, c.want)
+		}
+		if decoded := d.decodeClock(got); len(decoded) != len(layout) {
+			t.Errorf("%s: decoded %v", c.layout, decoded)
+		} else {
+			for f, v := range decoded {
+				if v != fields[f] {
+					t.Errorf("%s: decoded %s = %d, want %d", c.layout, f, v, fields[f])
+				}
+			}
+		}
+	}
+	if _, err := parseClockLayout("year,month,fortnight"); err == nil {
+		t.Error("unknown clock field accepted")
+	}
+}
+
+func TestNextClockSyncAcrossDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, ny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, c := range []struct {
+		name      string
+		hour, min int
+		now       string
+		want      time.Time
+		wantWait  time.Duration
+	}{
+		{"later today", 3, 0, "2026-06-10 01:00", at("2026-06-10 03:00"), 2 * time.Hour},
+		{"tomorrow", 3, 0, "2026-06-10 03:00", at("2026-06-11 03:00"), 24 * time.Hour},
+		// Clocks go forward at 02:00 on 8 March 2026: that day is 23 hours long.
+		{"spring forward", 3, 0, "2026-03-07 03:00", at("2026-03-08 03:00"), 23 * time.Hour},
+		// 02:30 does not exist on 8 March; time.Date moves it on by the hour skipped.
+		{"skipped time", 2, 30, "2026-03-08 01:00", time.Date(2026, time.March, 8, 3, 30, 0, 0, ny), 90 * time.Minute},
+		// Clocks go back at 02:00 on 1 November 2026: that day is 25 hours long.
+		{"fall back", 3, 0, "2026-10-31 03:00", at("2026-11-01 03:00"), 25 * time.Hour},
+		// 01:30 happens twice on 1 November; the sync runs at the first (EDT).
+		{"repeated time", 1, 30, "2026-11-01 00:00", time.Date(2026, time.November, 1, 5, 30, 0, 0, time.UTC), 90 * time.Minute},
+	} {
+		d := &ModbusDriver{cfg: Config{ClockLocation: ny, ClockAutoSyncHour: c.hour, ClockAutoSyncMinute: c.min}}
+		// The host clock may be in any zone.
+		now := at(c.now).UTC()
+		next := d.nextClockSync(now)
+		if !next.Equal(c.want) || next.Sub(now) != c.wantWait {
+			t.Errorf("%s: next sync %v (in %v), want %v (in %v)", c.name, next, next.Sub(now), c.want.In(ny), c.wantWait)
+		}
+	}
+}
+
+func TestClockSyncTimezone(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	_, sim, srv := startTestDriver(t, func(c *Config) {
+		c.RegClockStart = 40
+		c.ClockLayout = []string{"year", "month", "day", "hour", "minute", "second"}
+		c.ClockLocation = tokyo
+	})
+	resp, err := http.Post(srv.URL+"/clock/sync", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Time     time.Time `json:"time"`
+		Timezone string    `json:"timezone"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /clock/sync: %d %v", resp.StatusCode, err)
+	}
+	if body.Timezone != "Asia/Tokyo" {
+		t.Errorf("timezone %q", body.Timezone)
+	}
+	r := sim.Registers(40, 6)
+	written := time.Date(int(r[0]), time.Month(r[1]), int(r[2]), int(r[3]), int(r[4]), int(r[5]), 0, tokyo)
+	if !written.Equal(body.Time) {
+		t.Errorf("device clock set to %v, reported %v", written, body.Time)
+	}
+	if skew := time.Since(written); skew < -2*time.Second || skew > 2*time.Second {
+		t.Errorf("device clock %v is %v off the host clock", written, skew)
+	}
+	if _, offset := body.Time.Zone(); offset != 9*3600 {
+		t.Errorf("reported time %v is not in Tokyo time", body.Time)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Active/standby operation, for signage that must survive a host failure:
+// two instances on separate hosts share the bus (an RS-485 tap or a USB
+// switch) and a lease file, CLUSTER_LEASE_FILE, on storage both can reach.
+// The instance named in an unexpired lease is the leader and the only one
+// that opens the bus; it renews the lease every third of CLUSTER_LEASE_MS.
+// The standby takes the lease over once it has been expired for half a
+// lease, which covers that much clock difference between the hosts (use
+// NTP_SERVER or host NTP). Every read-and-write of the lease is made
+// holding an exclusive flock(2) on CLUSTER_LEASE_FILE.lock, so of two
+// nodes racing for the lease one claims it and the other then reads that
+// claim; a node that dies holding the lock loses it with its process.
+//
+// A leader that cannot renew stops touching the bus when its lease runs
+// out by its own clock, before the other host may take over. A standby
+// refuses writes with 503 and, given CLUSTER_PEER_URL, copies the leader's
+// status (GET /status.xml) every poll interval so reads stay current.
+// Alarms and polling run only on the leader.
+//
+// Every Modbus transaction checks the lease under the bus mutex, so a
+// standby never writes to the bus, whichever path the write comes from.
+//
+// This is a lease on a shared file, not a consensus protocol: it relies on
+// the storage honouring flock across hosts (local disks, NFSv4, CephFS),
+// renaming atomically, and on clocks staying within half a lease.
+
+var errStandby = errors.New("driver is the cluster standby")
+
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Term    uint64    `json:"term"` // bumped by every takeover
+	Expires time.Time `json:"expires"`
+}
+
+type clusterNode struct {
+	id    string
+	file  string
+	lease time.Duration
+	wait  time.Duration    // for the other node to let go of the lock
+	now   func() time.Time // wall clock for the lease file
+	logf  func(string, ...interface{})
+
+	mu         sync.Mutex
+	leader     string // holder of the lease as last seen; "" if none
+	term       uint64
+	expires    time.Time // the lease's expiry as last seen
+	validUntil time.Time // while leading: when our lease ends by the local clock
+	peerSync   time.Time // last status copied from the peer
+	peerErr    string
+}
+
+func newClusterNode(cfg Config, now func() time.Time, logf func(string, ...interface{})) *clusterNode {
+	return &clusterNode{id: cfg.ClusterNodeID, file: cfg.ClusterLeaseFile, lease: cfg.ClusterLease, wait: cfg.ClusterLease / 3, now: now, logf: logf}
+}
+
+// leading reports whether this instance may use the bus. Without a cluster
+// it always may.
+func (c *clusterNode) leading() bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader == c.id && time.Now().Before(c.validUntil)
+}
+
+// leaderTerm is the lease holder and term as last seen.
+func (c *clusterNode) leaderTerm() (string, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader, c.term
+}
+
+func (c *clusterNode) readLease() (leaseRecord, error) {
+	var rec leaseRecord
+	b, err := os.ReadFile(c.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return rec, nil
+	}
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return rec, fmt.Errorf("%s: %v", c.file, err)
+	}
+	return rec, nil
+}
+
+// writeLease replaces the lease file through a temporary file of this
+// node's own, so the two hosts never share one.
+func (c *clusterNode) writeLease(rec leaseRecord) error {
+	b, _ := json.Marshal(rec)
+	tmp := filepath.Join(filepath.Dir(c.file), "."+filepath.Base(c.file)+"."+c.id+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, c.file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// lockLease takes the lock that makes reading and writing the lease one
+// step, waiting up to c.wait, and returns its release.
+func (c *clusterNode) lockLease(ctx context.Context) (func(), error) {
+	f, err := os.OpenFile(c.file+".lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(c.wait)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		switch {
+		case err == nil:
+			return func() { f.Close() }, nil // closing drops the lock
+		case err == syscall.EINTR:
+			continue
+		case err != syscall.EWOULDBLOCK:
+			f.Close()
+			return nil, err
+		}
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s.lock held for over %v", c.file, c.wait)
+		}
+		time.Sleep(busLockPoll)
+	}
+}
+
+// step renews or tries to take the lease once.
+func (c *clusterNode) step(ctx context.Context) {
+	start := time.Now()
+	unlock, err := c.lockLease(ctx)
+	if err != nil {
+		c.logf("cluster: lock lease: %v", err)
+		return // a leader keeps its lease until validUntil
+	}
+	defer unlock()
+	rec, err := c.readLease()
+	if err != nil {
+		c.logf("cluster: read lease: %v", err)
+		return // a leader keeps its lease until validUntil
+	}
+	now := c.now()
+	if rec.Holder == c.id && c.leading() {
+		rec.Expires = now.Add(c.lease)
+		if err := c.writeLease(rec); err != nil {
+			c.logf("cluster: renew lease: %v", err)
+			return
+		}
+		c.mu.Lock()
+		c.validUntil, c.expires = start.Add(c.lease), rec.Expires
+		c.mu.Unlock()
+		return
+	}
+	// Another node's live lease makes this one the standby. A free or
+	// expired lease, or one of ours left from before a restart, is claimed.
+	if rec.Holder != "" && rec.Holder != c.id && now.Before(rec.Expires.Add(c.lease/2)) {
+		c.mu.Lock()
+		c.leader, c.term, c.expires, c.validUntil = rec.Holder, rec.Term, rec.Expires, time.Time{}
+		c.mu.Unlock()
+		return
+	}
+	claim := leaseRecord{Holder: c.id, Term: rec.Term + 1, Expires: now.Add(c.lease)}
+	if err := c.writeLease(claim); err != nil {
+		c.logf("cluster: claim lease: %v", err)
+		return
+	}
+	c.mu.Lock()
+	c.leader, c.term, c.expires, c.validUntil = claim.Holder, claim.Term, claim.Expires, start.Add(c.lease)
+	c.mu.Unlock()
+}
+
+// run keeps the lease until ctx ends, calling changed whenever this node
+// starts or stops leading. A leader that shuts down gives the lease up.
+func (c *clusterNode) run(ctx context.Context, changed func(leading bool)) {
+	was := false
+	check := func() {
+		if now := c.leading(); now != was {
+			was = now
+			changed(now)
+		}
+	}
+	t := time.NewTicker(c.lease / 3)
+	defer t.Stop()
+	for {
+		c.step(ctx)
+		check()
+		select {
+		case <-t.C:
+		case <-time.After(time.Until(c.validUntilOrZero())):
+			// The lease ran out before a renewal succeeded.
+		case <-ctx.Done():
+			if c.leading() {
+				c.mu.Lock()
+				c.validUntil = time.Time{}
+				c.mu.Unlock()
+				_, term := c.leaderTerm()
+				if unlock, err := c.lockLease(context.Background()); err != nil {
+					c.logf("cluster: release lease: %v", err)
+				} else {
+					if rec, err := c.readLease(); err == nil && rec.Holder == c.id && rec.Term == term {
+						if err := c.writeLease(leaseRecord{Term: term}); err != nil {
+							c.logf("cluster: release lease: %v", err)
+						}
+					}
+					unlock()
+				}
+			}
+			return
+		}
+	}
+}
+
+func (c *clusterNode) validUntilOrZero() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.validUntil.IsZero() {
+		return time.Now().Add(c.lease) // not leading: only the ticker matters
+	}
+	return c.validUntil
+}
+
+// --- the driver's side ---
+
+// onClusterRole logs role changes and lets go of the bus on losing the lease.
+func (d *ModbusDriver) onClusterRole(leading bool) {
+	leader, term := d.cluster.leaderTerm()
+	if leading {
+		d.logger.Printf("cluster: %s is leader (term %d)", d.cfg.ClusterNodeID, term)
+		return
+	}
+	d.releaseBus()
+	d.logger.Printf("cluster: %s is standby; leader is %q", d.cfg.ClusterNodeID, leader)
+}
+
+// releaseBus closes the serial link so the other instance can have the bus.
+func (d *ModbusDriver) releaseBus() {
+	d.mbusMu.Lock()
+	defer d.mbusMu.Unlock()
+	if d.client == nil {
+		return
+	}
+	if d.link != nil {
+		_ = d.link.Close()
+	}
+	d.client = nil
+}
+
+// replicateStatus copies the leader's status into this standby's cache.
+func (d *ModbusDriver) replicateStatus(ctx context.Context) {
+	if d.cfg.ClusterPeerURL == "" {
+		return
+	}
+	st, err := d.fetchPeerStatus(ctx)
+	d.cluster.mu.Lock()
+	if err != nil {
+		d.cluster.peerErr = err.Error()
+	} else {
+		d.cluster.peerErr, d.cluster.peerSync = "", time.Now()
+	}
+	d.cluster.mu.Unlock()
+	if err != nil {
+		return
+	}
+	d.statusMu.Lock()
+	d.status = st
+	d.statusMu.Unlock()
+	d.statusHub.publish(st)
+}
+
+func (d *ModbusDriver) fetchPeerStatus(ctx context.Context) (DeviceStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.cfg.ClusterPeerURL+"/status.xml", nil)
+	if err != nil {
+		return DeviceStatus{}, err
+	}
+	if d.cfg.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+d.cfg.AdminToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return DeviceStatus{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return DeviceStatus{}, fmt.Errorf("peer status: %s", resp.Status)
+	}
+	var doc statusXML
+	if err := xml.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return DeviceStatus{}, fmt.Errorf("peer status: %v", err)
+	}
+	return doc.deviceStatus(), nil
+}
+
+// handleCluster reports this node's role: 200 on the leader and 503 on the
+// standby, so a load balancer can send clients to the leader.
+func (d *ModbusDriver) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if d.cluster == nil {
+		http.Error(w, "clustering is disabled (CLUSTER_LEASE_FILE)", http.StatusNotFound)
+		return
+	}
+	leading := d.cluster.leading()
+	c := d.cluster
+	c.mu.Lock()
+	body := map[string]interface{}{"node_id": c.id, "role": "standby", "leader": c.leader, "term": c.term}
+	if !c.expires.IsZero() {
+		body["lease_expires"] = c.expires.UTC()
+	}
+	if d.cfg.ClusterPeerURL != "" {
+		peer := map[string]interface{}{"url": d.cfg.ClusterPeerURL}
+		if !c.peerSync.IsZero() {
+			peer["last_sync"] = c.peerSync.UTC()
+		}
+		if c.peerErr != "" {
+			peer["error"] = c.peerErr
+		}
+		body["peer"] = peer
+	}
+	c.mu.Unlock()
+	code := http.StatusServiceUnavailable
+	if leading {
+		body["role"], code = "leader", http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClusterLease(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "lease.json")
+	node := func(id string) *clusterNode {
+		return newClusterNode(Config{ClusterNodeID: id, ClusterLeaseFile: file, ClusterLease: 300 * time.Millisecond}, time.Now, t.Logf)
+	}
+	ctx := context.Background()
+	a, b := node("a"), node("b")
+	a.step(ctx)
+	b.step(ctx)
+	if !a.leading() || b.leading() {
+		t.Fatalf("a leading %v, b leading %v", a.leading(), b.leading())
+	}
+	if leader, term := b.leaderTerm(); leader != "a" || term != 1 {
+		t.Errorf("b sees leader %q term %d", leader, term)
+	}
+
+	// a renews; b stays standby.
+	time.Sleep(100 * time.Millisecond)
+	a.step(ctx)
+	b.step(ctx)
+	if !a.leading() || b.leading() {
+		t.Fatal("renewal lost the lease")
+	}
+
+	// a hangs: it stops using the bus when its lease ends, and b takes over
+	// half a lease after that.
+	time.Sleep(310 * time.Millisecond)
+	if a.leading() {
+		t.Error("a still leading after its lease ran out")
+	}
+	b.step(ctx)
+	if b.leading() {
+		t.Error("b took over without the grace period")
+	}
+	time.Sleep(150 * time.Millisecond)
+	b.step(ctx)
+	a.step(ctx)
+	if !b.leading() || a.leading() {
+		t.Fatalf("after takeover: a leading %v, b leading %v", a.leading(), b.leading())
+	}
+	if leader, term := a.leaderTerm(); leader != "b" || term != 2 {
+		t.Errorf("a sees leader %q term %d", leader, term)
+	}
+
+	// A leader that shuts down frees the lease for the standby at once.
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.run(runCtx, func(bool) {})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	a.step(ctx)
+	if !a.leading() {
+		t.Error("a did not take the released lease")
+	}
+}
+
+func TestClusterClaimRace(t *testing.T) {
+	// Nodes racing for a free lease: each reads and writes it under the
+	// lock, so exactly one wins however the steps interleave.
+	for round := 0; round < 20; round++ {
+		file := filepath.Join(t.TempDir(), "lease.json")
+		nodes := make([]*clusterNode, 4)
+		var wg sync.WaitGroup
+		for i := range nodes {
+			nodes[i] = newClusterNode(Config{ClusterNodeID: fmt.Sprintf("n%d", i), ClusterLeaseFile: file, ClusterLease: 3 * time.Second}, time.Now, t.Logf)
+			wg.Add(1)
+			go func(c *clusterNode) {
+				defer wg.Done()
+				c.step(context.Background())
+			}(nodes[i])
+		}
+		wg.Wait()
+		leaders := 0
+		for _, c := range nodes {
+			if c.leading() {
+				leaders++
+			}
+		}
+		if leaders != 1 {
+			t.Fatalf("round %d: %d leaders", round, leaders)
+		}
+	}
+}
+
+func TestStandbyNeverUsesTheBus(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "lease.json")
+	cfg := Config{ClusterLeaseFile: file, ClusterLease: 3 * time.Second}
+	cfg.ClusterNodeID = "leader"
+	newClusterNode(cfg, time.Now, t.Logf).step(context.Background())
+	cfg.ClusterNodeID = "standby"
+	standby := newClusterNode(cfg, time.Now, t.Logf)
+	standby.step(context.Background())
+	d := &ModbusDriver{cluster: standby}
+	if err := d.writeU16(1, 2); !errors.Is(err, errStandby) {
+		t.Errorf("writeU16 on the standby: %v", err)
+	}
+	if err := d.writeRegs(1, 1, []byte{0, 2}); !errors.Is(err, errStandby) {
+		t.Errorf("writeRegs on the standby: %v", err)
+	}
+	if _, err := d.readRegs(1, 1); !errors.Is(err, errStandby) {
+		t.Errorf("readRegs on the standby: %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Asynchronous writes, for callers behind a gateway whose timeout is
+// shorter than a write on a congested bus:
+//
+//	POST /commands {"path": "/display/value", "body": {"display_value": "12.5"}}
+//	-> 202 {"id": "9f1c2e7a40b3d568", "status": "queued", ...}
+//	GET /commands/9f1c2e7a40b3d568
+//	-> {"id": ..., "status": "succeeded", "http_status": 200, "result": {"ok": true}}
+//
+// A command is a deferred request to one of the write routes, run with the
+// caller's headers (tokens, tenant key, If-Match) by a single worker in
+// arrival order, so it is validated and authorized exactly like the
+// synchronous request. Finished commands are kept for COMMAND_RETENTION_MS.
+
+const (
+	commandQueued     = "queued"
+	commandInProgress = "in_progress"
+	commandSucceeded  = "succeeded"
+	commandFailed     = "failed"
+)
+
+// commandPaths are the routes a command may target, with their method.
+var commandPaths = map[string]string{
+	"/display/value": http.MethodPut, "/display/value/raw": http.MethodPut, "/blink/period": http.MethodPut,
+	"/display/config": http.MethodPut, "/comm/config": http.MethodPut, "/devices/value": http.MethodPut,
+	"/clock/sync": http.MethodPost,
+}
+
+func commandMethod(path string) (string, bool) {
+	if strings.HasPrefix(path, "/registers/") {
+		return http.MethodPut, true
+	}
+	m, ok := commandPaths[path]
+	return m, ok
+}
+
+type command struct {
+	ID         string          `json:"id"`
+	Status     string          `json:"status"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Created    time.Time       `json:"created"`
+	Started    *time.Time      `json:"started,omitempty"`
+	Finished   *time.Time      `json:"finished,omitempty"`
+	HTTPStatus int             `json:"http_status,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"` // the route's JSON reply
+	Error      string          `json:"error,omitempty"`  // or its error text
+
+	tenant string
+	header http.Header
+	body   []byte
+}
+
+type commandQueue struct {
+	retention time.Duration
+	pending   chan *command
+
+	mu    sync.Mutex
+	byID  map[string]*command
+	order []*command // by creation, for expiry
+}
+
+func newCommandQueue(size int, retention time.Duration) *commandQueue {
+	return &commandQueue{retention: retention, pending: make(chan *command, size), byID: map[string]*command{}}
+}
+
+// add queues c, or reports false when the queue is full.
+func (q *commandQueue) add(c *command) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire(time.Now())
+	select {
+	case q.pending <- c:
+	default:
+		return false
+	}
+	q.byID[c.ID] = c
+	q.order = append(q.order, c)
+	return true
+}
+
+// expire drops finished commands older than the retention. Called with mu held.
+func (q *commandQueue) expire(now time.Time) {
+	keep := q.order[:0]
+	for _, c := range q.order {
+		if c.Finished != nil && now.Sub(*c.Finished) > q.retention {
+			delete(q.byID, c.ID)
+			continue
+		}
+		keep = append(keep, c)
+	}
+	for i := len(keep); i < len(q.order); i++ {
+		q.order[i] = nil
+	}
+	q.order = keep
+}
+
+// get returns a copy of command id as the given tenant may see it.
+func (q *commandQueue) get(id, tenant string) (command, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expire(time.Now())
+	c, ok := q.byID[id]
+	if !ok || tenant != "" && c.tenant != tenant {
+		return command{}, false
+	}
+	return *c, true
+}
+
+func (q *commandQueue) update(fn func()) {
+	q.mu.Lock()
+	fn()
+	q.mu.Unlock()
+}
+
+// commandRecorder captures a route's reply for the command record.
+type commandRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *commandRecorder) Header() http.Header { return r.header }
+func (r *commandRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+}
+func (r *commandRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+func (d *ModbusDriver) commandLoop(ctx context.Context) {
+	q := d.commands
+	for {
+		select {
+		case c := <-q.pending:
+			d.runCommand(ctx, c)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *ModbusDriver) runCommand(ctx context.Context, c *command) {
+	q := d.commands
+	started := d.clock.Now().UTC()
+	q.update(func() { c.Status, c.Started = commandInProgress, &started })
+
+	rec := &commandRecorder{header: http.Header{}}
+	req, err := http.NewRequestWithContext(ctx, c.Method, c.Path, bytes.NewReader(c.body))
+	if err == nil {
+		req.Header = c.header
+		d.commandTarget.ServeHTTP(rec, req)
+	} else {
+		rec.status = http.StatusInternalServerError
+		rec.body.WriteString(err.Error())
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	finished := d.clock.Now().UTC()
+	q.update(func() {
+		c.Finished, c.HTTPStatus = &finished, rec.status
+		c.Status = commandSucceeded
+		if rec.status >= 300 {
+			c.Status = commandFailed
+		}
+		if strings.HasPrefix(rec.header.Get("Content-Type"), "application/json") && json.Valid(rec.body.Bytes()) {
+			c.Result = json.RawMessage(bytes.TrimSpace(rec.body.Bytes()))
+		} else {
+			c.Error = strings.TrimSpace(rec.body.String())
+		}
+		c.header, c.body = nil, nil
+	})
+	if c.Status == commandFailed {
+		d.logger.Printf("command %s %s %s failed: %d %s", c.ID, c.Method, c.Path, c.HTTPStatus, c.Error)
+	}
+}
+
+type commandReq struct {
+	Path string          `json:"path"`
+	Body json.RawMessage `json:"body"`
+}
+
+func (d *ModbusDriver) handleCommands(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req commandReq
+	if !d.decodeJSON(w, r, &req) {
+		return
+	}
+	method, ok := commandMethod(req.Path)
+	if !ok {
+		http.Error(w, "path is not a write route: "+req.Path, http.StatusBadRequest)
+		return
+	}
+	if dryRun(r) {
+		d.dryRunCommand(w, r, method, req)
+		return
+	}
+	idb := make([]byte, 8)
+	if _, err := rand.Read(idb); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	c := &command{
+		ID: hex.EncodeToString(idb), Status: commandQueued, Method: method, Path: req.Path, Created: d.clock.Now().UTC(),
+		tenant: requestTenant(r), header: commandHeader(r), body: req.Body,
+	}
+	if !d.commands.add(c) {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "command queue full", http.StatusServiceUnavailable)
+		return
+	}
+	view, _ := d.commands.get(c.ID, "")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "commands/"+c.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(view)
+}
+
+// commandHeader is the header a command's request to its route carries.
+func commandHeader(r *http.Request) http.Header {
+	header := r.Header.Clone()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/json")
+	return header
+}
+
+// dryRunCommand answers a dry run of POST /commands with the dry run of its
+// route, straight away rather than through the queue.
+func (d *ModbusDriver) dryRunCommand(w http.ResponseWriter, r *http.Request, method string, req commandReq) {
+	target, err := http.NewRequestWithContext(r.Context(), method, req.Path, bytes.NewReader(req.Body))
+	if err != nil {
+		http.Error(w, "invalid path: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	target.Header = commandHeader(r)
+	target.Header.Set("Dry-Run", "true")
+	target.RemoteAddr = r.RemoteAddr
+	d.commandTarget.ServeHTTP(w, target)
+}
+
+func (d *ModbusDriver) handleCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c, ok := d.commands.get(strings.TrimPrefix(r.URL.Path, "/commands/"), requestTenant(r))
+	if !ok {
+		http.Error(w, "unknown command", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c)
+}
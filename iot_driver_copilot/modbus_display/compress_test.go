@@ -0,0 +1,80 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for accept, want := range map[string]string{
+		"":                      "",
+		"identity":              "",
+		"gzip":                  "gzip",
+		"gzip, deflate, br":     "br",
+		"br;q=0, gzip;q=0.5":    "gzip",
+		"*":                     "br",
+		"*;q=0":                 "",
+		"GZIP;q=0.8, br;q=oops": "gzip",
+	} {
+		if got := negotiateEncoding(accept); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	big := `{"values":"` + strings.Repeat("1234567890", 100) + `"}`
+	h := compressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(w, big)
+		case "/small":
+			http.Error(w, "nope", http.StatusNotFound)
+		case "/sse":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			_, _ = io.WriteString(w, "event: status\ndata: "+big+"\n\n")
+			w.(http.Flusher).Flush()
+		}
+	}))
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for enc, open := range map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	} {
+		rec := get("/big", enc)
+		if rec.Header().Get("Content-Encoding") != enc || rec.Body.Len() >= len(big) {
+			t.Fatalf("%s: Content-Encoding %q, %d bytes", enc, rec.Header().Get("Content-Encoding"), rec.Body.Len())
+		}
+		r, err := open(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(r); err != nil || string(b) != big {
+			t.Fatalf("%s: decoded %d bytes, err %v", enc, len(b), err)
+		}
+	}
+	if rec := get("/big", ""); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != big {
+		t.Fatal("compressed without Accept-Encoding")
+	}
+	if rec := get("/small", "gzip"); rec.Code != http.StatusNotFound || rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "nope\n" {
+		t.Fatalf("small response: %d %q %q", rec.Code, rec.Header().Get("Content-Encoding"), rec.Body.String())
+	}
+	if rec := get("/sse", "gzip"); rec.Header().Get("Content-Encoding") != "" || !rec.Flushed || !strings.Contains(rec.Body.String(), big) {
+		t.Fatal("event stream was compressed or not flushed")
+	}
+}
@@ -1,24 +1,48 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/goburrow/serial"
 )
 
 type Config struct {
-	HTTPHost string
-	HTTPPort int
+	HTTPHost      string
+	HTTPPort      int
+	HTTPBasePath  string // route prefix behind a reverse proxy, no trailing slash; "" serves at the root
+	HTTPListen    string // unix:///path or tcp://host:port; overrides HTTPHost/HTTPPort when set
+	HTTPInterface string // HTTP_INTERFACE: network interface the TCP listener is bound to; "" for any
+	HTTPSocket    socketPerms
+
+	MaxRequestBody int64 // MAX_REQUEST_BODY_BYTES: largest JSON request body
+	LogBufferLines int   // LOG_BUFFER_LINES: recent log lines GET /logs/stream replays
+	DebugEndpoints bool  // DEBUG_ENDPOINTS: serve /debug/pprof, /debug/goroutines and /debug/memstats to admins
+
+	AccessLogSample float64       // ACCESS_LOG_SAMPLE: fraction of HTTP requests logged; 0 disables
+	SlowRequest     time.Duration // SLOW_REQUEST_MS: log and count requests slower than this; 0 disables
 
-	SerialPort string
-	SlaveId    int
-	BaudRate   int
-	DataBits   int
-	Parity     string // "N", "E", "O"
-	StopBits   int
+	SerialPort       string
+	SlaveId          int
+	BaudRate         int
+	DataBits         int
+	Parity           string             // "N", "E", "O"
+	StopBits         int
+	RS485            serial.RS485Config // RS485_*; kernel direction control, ignored unless Enabled
+	RS485SoftwareRTS bool               // RS485_SOFTWARE_RTS: the driver toggles RTS itself, see link.go
+	ModbusMinGap     time.Duration      // MODBUS_MIN_GAP_MS: silence kept between transactions
+
+	SerialLockFile    string        // SERIAL_LOCK_FILE: flock(2) held around each transaction; "" disables, see buslock.go
+	SerialLockTimeout time.Duration // SERIAL_LOCK_TIMEOUT_MS: longest wait for the lock
 
 	ModbusTimeout   time.Duration
 	PollInterval    time.Duration
@@ -36,12 +60,138 @@ type Config struct {
 	RegBlinkPeriodMs      uint16
 	RegDisplayValueStart  uint16
 	DisplayValueRegs      int
+	DisplayAlign          string // "left" or "right"
+	DisplayPad            byte   // fill for unused display positions
+	DisplayStrict         bool   // reject values that don't fit instead of truncating
+	DisplayRules          displayRules // DISPLAY_*: what PUT /display/value accepts, see displayrules.go
+
+	DisplayWriteInterval time.Duration // write-behind: at most one display write per interval; 0 writes through
+
+	ReadOnly           bool
+	AdminToken         string // required to toggle read-only mode over HTTP; empty disables it
+	AllowSlaveOverride bool
+	RegisterCacheTTL   time.Duration // reuse GET /registers results this long; 0 only coalesces
+
+	BlinkMode       string // "hardware" or "software"
+	SoftBlinkMask   uint16
+	SoftBlinkPeriod time.Duration
+
+	RegClockStart       uint16
+	ClockLayout         []string // empty when no clock block is configured
+	ClockBCD            bool
+	ClockLocation       *time.Location
+	ClockAutoSync       bool
+	ClockAutoSyncHour   int
+	ClockAutoSyncMinute int
+
+	NTPServer     string        // NTP_SERVER: time source for timestamps; "" uses the host clock
+	NTPInterval   time.Duration // NTP_INTERVAL_MS
+	ClockSkewWarn time.Duration // CLOCK_SKEW_WARN_MS: host clock skew that makes /healthz degraded
+
+	SNMPListen      string   // SNMP_LISTEN: UDP address of the SNMPv2c agent; "" disables it
+	SNMPCommunity   string   // SNMP_COMMUNITY: read community, also sent with traps
+	SNMPTrapTargets []string // SNMP_TRAP_TARGETS: host[:port] list for device offline/online traps
+	SNMPBaseOID     snmpOID  // SNMP_BASE_OID: where the driver's objects live
+
+	BACnetListen     string // BACNET_LISTEN: UDP address of the BACnet/IP device; "" disables it
+	BACnetDeviceID   uint32 // BACNET_DEVICE_ID: device object instance, unique on the BACnet internetwork
+	BACnetDeviceName string // BACNET_DEVICE_NAME
+
+	ClusterLeaseFile string        // CLUSTER_LEASE_FILE: lease shared with the standby; "" runs alone
+	ClusterNodeID    string        // CLUSTER_NODE_ID: this instance's name in the lease
+	ClusterLease     time.Duration // CLUSTER_LEASE_MS
+	ClusterPeerURL   string        // CLUSTER_PEER_URL: the other instance, for status replication
+
+	IdentityRegs   []identityReg // registers behind GET /info; empty disables it
+	FirmwareFormat string        // raw, bytes or hundredths
+
+	FirmwareFileNumber uint16 // first file of POST /firmware images
+	FirmwareChunkRegs  int    // registers per Write File Record request
+	FirmwareMaxBytes   int
+
+	StatusFieldMap string // JSON file renaming/omitting/adding status output fields
+
+	AlarmRulesFile string
+	AlarmRules     string // ALARM_RULES: the rules inline, instead of a file
+	AlarmRulesStore string // ALARM_RULES_STORE: rules edited through /alarms/rules; defaults to alarm_rules.json in StateDir
+
+	DesiredValueFile string // persist PUT /display/value and restore it after a device restart; empty disables
+	StateDir         string // crash-safe state files; DesiredValueFile defaults to desired_value.json in it
+
+	ValueStaleAfter time.Duration // VALUE_STALE_AFTER_MS: show ValueStaleText after this long without a new value; 0 disables
+	ValueStaleText  string        // VALUE_STALE_TEXT
+
+	ValueSmoothing       int           // VALUE_SMOOTHING_WINDOW: EMA over about this many values; 0 or 1 disables
+	ValueRotate          []valueView   // VALUE_ROTATE: views cycled on the display; empty disables
+	ValueRotateInterval  time.Duration // VALUE_ROTATE_INTERVAL_MS
+	ValueAggregateWindow time.Duration // VALUE_AGGREGATE_WINDOW_MS: what min, max and avg cover
+
+	MetricsFile             string        // METRICS_FILE: counter totals kept across restarts; defaults to metrics.json in StateDir
+	MetricsSnapshotInterval time.Duration // METRICS_SNAPSHOT_INTERVAL_MS
+
+	MQTTBroker   string
+	MQTTClientID string
+	MQTTUsername string
+	MQTTPassword string
+
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	TelegramBotToken string
+	TelegramAPIURL   string
+
+	NotifySubjectTemplate string
+	NotifyTextTemplate    string
+	NotifyRateLimit       int           // email/Telegram messages per NotifyRateWindow and target; 0 is unlimited
+	NotifyRateWindow      time.Duration
+	NotifyQuietHours      *quietHours   // nil when email/Telegram may go out at any time
+	NotifyLocation        *time.Location
+
+	SpoolDir       string
+	SpoolMaxEvents int
+
+	WatchdogDevice   string
+	WatchdogInterval time.Duration
+	WatchdogStall    time.Duration
+
+	UpdateManifestURL   string        // "" disables the update check in GET /version
+	UpdateCheckInterval time.Duration
+
+	ConfigSyncURL      string            // CONFIG_SYNC_URL: "" disables pulling CONFIG_FILE from a controller
+	ConfigSyncKey      ed25519.PublicKey // CONFIG_SYNC_KEY: verifies the controller's signature
+	ConfigSyncInterval time.Duration     // CONFIG_SYNC_INTERVAL_MS
+
+	ResponseShape       responseShape            // RESPONSE_ENVELOPE, RESPONSE_CASE
+	ResponseShapeRoutes map[string]responseShape // RESPONSE_SHAPE_ROUTES overrides, by path
+
+	TenantKeys    map[string]string // TENANT_KEYS: API key -> tenant; empty disables tenant auth
+	DeviceTenants map[int]string    // TENANT_DEVICES: slave id -> tenant
+
+	JWTJWKSURL     string            // JWT_JWKS_URL: "" disables JWT authentication
+	JWTIssuer      string            // JWT_ISSUER
+	JWTAudience    string            // JWT_AUDIENCE
+	JWTRolesClaim  string            // JWT_ROLES_CLAIM: dotted path of the roles/groups claim
+	JWTRoles       map[string]string // JWT_ROLE_MAP: claim value -> "admin" or tenant
+	JWTJWKSRefresh time.Duration     // JWT_JWKS_REFRESH_MS
+
+	ExternalChangeNotify []notifyTarget // EXTERNAL_CHANGE_NOTIFY: where external_change events go
+	StatusDeadband       deadbands      // STATUS_DEADBAND: field -> smallest change published
+
+	SensorChannels  []sensorChannel // SENSOR_REG_START, SENSOR_CHANNELS; empty when the model has no sensor block
+	SensorSigned    bool            // SENSOR_SIGNED: sensor registers are int16
+	SensorMQTTTopic string          // SENSOR_MQTT_TOPIC: where each poll's readings are published; "" disables
+
+	CommandQueueSize int           // POST /commands waiting to run
+	CommandRetention time.Duration // how long finished commands stay readable
 }
 
 func getenv(key string) string {
 	v := os.Getenv(key)
 	if v == "" {
-		log.Fatalf("missing required env: %s", key)
+		configFatalf("missing required env: %s", key)
 	}
 	return v
 }
@@ -50,7 +200,7 @@ func getenvInt(key string) int {
 	v := getenv(key)
 	i, err := strconv.Atoi(v)
 	if err != nil {
-		log.Fatalf("invalid int for %s: %v", key, err)
+		configFatalf("invalid int for %s: %v", key, err)
 	}
 	return i
 }
@@ -59,23 +209,237 @@ func getenvUint16(key string) uint16 {
 	v := getenv(key)
 	i, err := strconv.Atoi(v)
 	if err != nil {
-		log.Fatalf("invalid uint16 for %s: %v", key, err)
+		configFatalf("invalid uint16 for %s: %v", key, err)
 	}
 	if i < 0 || i > 0xFFFF {
-		log.Fatalf("out of range uint16 for %s", key)
+		configFatalf("out of range uint16 for %s", key)
 	}
 	return uint16(i)
 }
 
+func getenvDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func getenvIntDefault(key string, def int) int {
+	if os.Getenv(key) == "" {
+		return def
+	}
+	return getenvInt(key)
+}
+
+func getenvUint16Default(key string, def uint16) uint16 {
+	if os.Getenv(key) == "" {
+		return def
+	}
+	return getenvUint16(key)
+}
+
+func getenvBool(key string) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		configFatalf("invalid bool for %s: %v", key, err)
+	}
+	return b
+}
+
 func getenvDurationMs(key string) time.Duration {
 	ms := getenvInt(key)
 	return time.Duration(ms) * time.Millisecond
 }
 
+// configFile is the optional CONFIG_FILE: a JSON object whose "defaults" and
+// "profiles.<name>" sections map environment variable names to values, e.g.
+//
+//	{"defaults": {"BAUD_RATE": 9600, "POLL_INTERVAL_MS": 1000},
+//	 "profiles": {"lab": {"SERIAL_PORT": "/dev/ttyUSB1"},
+//	              "production-line-3": {"SLAVE_ID": 7, "REG_ADDR_DISPLAY_VALUE_START": 32}}}
+//
+// Real environment variables win over the "sealed" section (secrets.go),
+// which wins over the PROFILE section, which wins over defaults.
+type configFile struct {
+	Defaults map[string]configValue            `json:"defaults"`
+	Profiles map[string]map[string]configValue `json:"profiles"`
+	Sealed   string                            `json:"sealed"`
+}
+
+// configValue is a setting written as a JSON string, number or boolean.
+type configValue string
+
+func (v *configValue) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*v = configValue(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err == nil {
+		*v = configValue(n)
+		return nil
+	}
+	var t bool
+	if err := json.Unmarshal(b, &t); err == nil {
+		*v = configValue(strconv.FormatBool(t))
+		return nil
+	}
+	return fmt.Errorf("setting must be a string, number or boolean, got %s", b)
+}
+
+// configSettings lists the variables a CONFIG_FILE may set. Anything else
+// (a typo, or CONFIG_FILE/PROFILE themselves) is rejected rather than
+// silently ignored.
+var configSettings = map[string]bool{
+	"HTTP_HOST": true, "HTTP_PORT": true, "HTTP_BASE_PATH": true, "ADMIN_TOKEN": true,
+	"HTTP_LISTEN": true, "HTTP_INTERFACE": true, "MAX_REQUEST_BODY_BYTES": true, "LOG_BUFFER_LINES": true, "DEBUG_ENDPOINTS": true, "HTTP_SOCKET_MODE": true, "HTTP_SOCKET_GROUP": true,
+	"ACCESS_LOG_SAMPLE": true, "SLOW_REQUEST_MS": true,
+	"SERIAL_PORT": true, "SLAVE_ID": true, "BAUD_RATE": true, "DATA_BITS": true, "PARITY": true, "STOP_BITS": true,
+	"RS485_ENABLED": true, "RS485_DELAY_RTS_BEFORE_SEND_MS": true, "RS485_DELAY_RTS_AFTER_SEND_MS": true,
+	"RS485_RTS_HIGH_DURING_SEND": true, "RS485_RTS_HIGH_AFTER_SEND": true, "RS485_RX_DURING_TX": true,
+	"RS485_SOFTWARE_RTS": true, "MODBUS_MIN_GAP_MS": true, "SERIAL_LOCK_FILE": true, "SERIAL_LOCK_TIMEOUT_MS": true,
+	"MODBUS_TIMEOUT_MS": true, "POLL_INTERVAL_MS": true, "BACKOFF_INITIAL_MS": true, "BACKOFF_MAX_MS": true,
+	"REG_ADDR_DEVICE_ADDRESS": true, "REG_ADDR_BAUD_RATE": true, "REG_ADDR_COMM_FORMAT": true, "REG_ADDR_WORK_MODE": true,
+	"REG_ADDR_VALUE_TYPE": true, "REG_ADDR_DECIMALS": true, "REG_ADDR_DP_MASK": true, "REG_ADDR_BLINK_MASK": true,
+	"REG_ADDR_BLINK_PERIOD_MS": true, "REG_ADDR_DISPLAY_VALUE_START": true, "REG_DISPLAY_VALUE_REGS": true,
+	"REG_DISPLAY_ALIGN": true, "REG_DISPLAY_PAD": true, "REG_DISPLAY_STRICT": true, "DISPLAY_WRITE_INTERVAL_MS": true,
+	"DISPLAY_MAX_LENGTH": true, "DISPLAY_ALLOWED_CHARS": true, "DISPLAY_ALLOWED_EXTRA": true,
+	"DISPLAY_NUMERIC_MIN": true, "DISPLAY_NUMERIC_MAX": true, "DISPLAY_BANNED_WORDS": true,
+	"READ_ONLY": true, "ALLOW_SLAVE_OVERRIDE": true, "REGISTER_CACHE_TTL_MS": true,
+	"BLINK_MODE": true, "SOFT_BLINK_MASK": true, "SOFT_BLINK_PERIOD_MS": true,
+	"REG_ADDR_CLOCK_START": true, "CLOCK_LAYOUT": true, "CLOCK_BCD": true, "CLOCK_TIMEZONE": true, "CLOCK_AUTO_SYNC_AT": true,
+	"REG_ADDR_VENDOR_ID": true, "REG_ADDR_PRODUCT_CODE": true, "REG_ADDR_FIRMWARE_VERSION": true, "FIRMWARE_VERSION_FORMAT": true,
+	"FIRMWARE_FILE_NUMBER": true, "FIRMWARE_CHUNK_REGS": true, "FIRMWARE_MAX_BYTES": true,
+	"STATUS_FIELD_MAP": true, "ALARM_RULES_FILE": true, "ALARM_RULES_STORE": true, "DESIRED_VALUE_FILE": true, "STATE_DIR": true, "VALUE_STALE_AFTER_MS": true, "VALUE_STALE_TEXT": true,
+	"VALUE_SMOOTHING_WINDOW": true, "VALUE_ROTATE": true, "VALUE_ROTATE_INTERVAL_MS": true, "VALUE_AGGREGATE_WINDOW_MS": true, "METRICS_FILE": true, "METRICS_SNAPSHOT_INTERVAL_MS": true, "MQTT_BROKER": true, "MQTT_CLIENT_ID": true, "MQTT_USERNAME": true, "MQTT_PASSWORD": true,
+	"SMTP_HOST": true, "SMTP_PORT": true, "SMTP_USERNAME": true, "SMTP_PASSWORD": true, "SMTP_FROM": true,
+	"TELEGRAM_BOT_TOKEN": true, "TELEGRAM_API_URL": true,
+	"NOTIFY_SUBJECT_TEMPLATE": true, "NOTIFY_TEXT_TEMPLATE": true, "NOTIFY_RATE_LIMIT": true, "NOTIFY_QUIET_HOURS": true, "NOTIFY_TIMEZONE": true,
+	"SPOOL_DIR": true, "SPOOL_MAX_EVENTS": true,
+	"WATCHDOG_DEVICE": true, "WATCHDOG_INTERVAL_MS": true, "WATCHDOG_STALL_MS": true,
+	"UPDATE_MANIFEST_URL": true, "UPDATE_CHECK_INTERVAL_MS": true,
+	"CONFIG_SYNC_URL": true, "CONFIG_SYNC_KEY": true, "CONFIG_SYNC_INTERVAL_MS": true, "ALARM_RULES": true,
+	"RESPONSE_ENVELOPE": true, "RESPONSE_CASE": true, "RESPONSE_SHAPE_ROUTES": true,
+	"TENANT_KEYS": true, "TENANT_DEVICES": true,
+	"JWT_JWKS_URL": true, "JWT_ISSUER": true, "JWT_AUDIENCE": true, "JWT_ROLES_CLAIM": true, "JWT_ROLE_MAP": true, "JWT_JWKS_REFRESH_MS": true,
+	"NTP_SERVER": true, "NTP_INTERVAL_MS": true, "CLOCK_SKEW_WARN_MS": true,
+	"SNMP_LISTEN": true, "SNMP_COMMUNITY": true, "SNMP_TRAP_TARGETS": true, "SNMP_BASE_OID": true,
+	"BACNET_LISTEN": true, "BACNET_DEVICE_ID": true, "BACNET_DEVICE_NAME": true,
+	"CLUSTER_LEASE_FILE": true, "CLUSTER_NODE_ID": true, "CLUSTER_LEASE_MS": true, "CLUSTER_PEER_URL": true,
+	"COMMAND_QUEUE_SIZE": true, "COMMAND_RETENTION_MS": true, "EXTERNAL_CHANGE_NOTIFY": true,
+	"STATUS_DEADBAND": true,
+	"SENSOR_REG_START": true, "SENSOR_CHANNELS": true, "SENSOR_SIGNED": true, "SENSOR_MQTT_TOPIC": true,
+}
+
+// mergeConfigFile parses a CONFIG_FILE and returns its defaults overlaid
+// with the named profile ("" for none).
+func mergeConfigFile(raw []byte, profile string) (map[string]configValue, error) {
+	var cf configFile
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cf); err != nil {
+		return nil, err
+	}
+	check := func(section string, m map[string]configValue) error {
+		for k := range m {
+			if !configSettings[k] {
+				return fmt.Errorf("%s: unknown setting %q", section, k)
+			}
+		}
+		return nil
+	}
+	if err := check("defaults", cf.Defaults); err != nil {
+		return nil, err
+	}
+	for name, p := range cf.Profiles {
+		if err := check("profile "+name, p); err != nil {
+			return nil, err
+		}
+	}
+	merged := map[string]configValue{}
+	for k, v := range cf.Defaults {
+		merged[k] = v
+	}
+	if profile != "" {
+		p, ok := cf.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("PROFILE %q not found", profile)
+		}
+		for k, v := range p {
+			merged[k] = v
+		}
+	}
+	if cf.Sealed != "" {
+		key, err := configKey()
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := unsealSettings(cf.Sealed, key)
+		if err != nil {
+			return nil, fmt.Errorf("sealed: %w", err)
+		}
+		if err := check("sealed", sealed); err != nil {
+			return nil, err
+		}
+		for k, v := range sealed {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+func applyConfigFile() {
+	path := os.Getenv("CONFIG_FILE")
+	profile := os.Getenv("PROFILE")
+	if path == "" {
+		if profile != "" {
+			configFatalf("PROFILE=%s requires CONFIG_FILE", profile)
+		}
+		return
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		configFatalf("read CONFIG_FILE: %v", err)
+	}
+	merged, err := mergeConfigFile(raw, profile)
+	if err != nil {
+		configFatalf("CONFIG_FILE %s: %v", path, err)
+	}
+	// An empty variable counts as unset, the same as getenvDefault treats it,
+	// so an exported-but-blank FOO= in a unit file doesn't mask the file.
+	for k, v := range merged {
+		if os.Getenv(k) == "" {
+			os.Setenv(k, string(v))
+		}
+	}
+	if profile != "" {
+		log.Printf("config: %s, profile %s", path, profile)
+	}
+}
+
+// processEnv is the environment the process started with, before secret
+// files and CONFIG_FILE were applied; config sync checks new files with it.
+var processEnv []string
+
 func LoadConfig() Config {
+	processEnv = os.Environ()
+	applySecretFiles()
+	applyConfigFile()
 	cfg := Config{
-		HTTPHost: getenv("HTTP_HOST"),
-		HTTPPort: getenvInt("HTTP_PORT"),
+		HTTPBasePath:  strings.TrimRight(os.Getenv("HTTP_BASE_PATH"), "/"),
+		HTTPListen:    os.Getenv("HTTP_LISTEN"),
+		HTTPInterface: os.Getenv("HTTP_INTERFACE"),
+
+		MaxRequestBody: int64(getenvIntDefault("MAX_REQUEST_BODY_BYTES", defaultMaxRequestBody)),
+		LogBufferLines: getenvIntDefault("LOG_BUFFER_LINES", 200),
+		DebugEndpoints: getenvBool("DEBUG_ENDPOINTS"),
+
+		SlowRequest: time.Duration(getenvIntDefault("SLOW_REQUEST_MS", 0)) * time.Millisecond,
 
 		SerialPort: getenv("SERIAL_PORT"),
 		SlaveId:    getenvInt("SLAVE_ID"),
@@ -83,6 +447,19 @@ func LoadConfig() Config {
 		DataBits:   getenvInt("DATA_BITS"),
 		Parity:     strings.ToUpper(getenv("PARITY")),
 		StopBits:   getenvInt("STOP_BITS"),
+		RS485: serial.RS485Config{
+			Enabled:            getenvBool("RS485_ENABLED"),
+			DelayRtsBeforeSend: time.Duration(getenvIntDefault("RS485_DELAY_RTS_BEFORE_SEND_MS", 0)) * time.Millisecond,
+			DelayRtsAfterSend:  time.Duration(getenvIntDefault("RS485_DELAY_RTS_AFTER_SEND_MS", 0)) * time.Millisecond,
+			RtsHighDuringSend:  getenvBool("RS485_RTS_HIGH_DURING_SEND"),
+			RtsHighAfterSend:   getenvBool("RS485_RTS_HIGH_AFTER_SEND"),
+			RxDuringTx:         getenvBool("RS485_RX_DURING_TX"),
+		},
+		RS485SoftwareRTS: getenvBool("RS485_SOFTWARE_RTS"),
+		ModbusMinGap:     time.Duration(getenvIntDefault("MODBUS_MIN_GAP_MS", 0)) * time.Millisecond,
+
+		SerialLockFile:    os.Getenv("SERIAL_LOCK_FILE"),
+		SerialLockTimeout: time.Duration(getenvIntDefault("SERIAL_LOCK_TIMEOUT_MS", 2000)) * time.Millisecond,
 
 		ModbusTimeout:  getenvDurationMs("MODBUS_TIMEOUT_MS"),
 		PollInterval:   getenvDurationMs("POLL_INTERVAL_MS"),
@@ -100,21 +477,392 @@ func LoadConfig() Config {
 		RegBlinkPeriodMs:     getenvUint16("REG_ADDR_BLINK_PERIOD_MS"),
 		RegDisplayValueStart: getenvUint16("REG_ADDR_DISPLAY_VALUE_START"),
 		DisplayValueRegs:     getenvInt("REG_DISPLAY_VALUE_REGS"),
+		DisplayAlign:         strings.ToLower(getenvDefault("REG_DISPLAY_ALIGN", "left")),
+		DisplayStrict:        getenvBool("REG_DISPLAY_STRICT"),
+		DisplayWriteInterval: time.Duration(getenvIntDefault("DISPLAY_WRITE_INTERVAL_MS", 0)) * time.Millisecond,
+
+		ReadOnly:           getenvBool("READ_ONLY"),
+		AdminToken:         os.Getenv("ADMIN_TOKEN"),
+		AllowSlaveOverride: getenvBool("ALLOW_SLAVE_OVERRIDE"),
+		RegisterCacheTTL:   time.Duration(getenvIntDefault("REGISTER_CACHE_TTL_MS", 0)) * time.Millisecond,
+
+		BlinkMode:       strings.ToLower(getenvDefault("BLINK_MODE", "hardware")),
+		SoftBlinkMask:   getenvUint16Default("SOFT_BLINK_MASK", 0xFFFF),
+		SoftBlinkPeriod: time.Duration(getenvIntDefault("SOFT_BLINK_PERIOD_MS", 0)) * time.Millisecond,
+
+		FirmwareFormat: strings.ToLower(getenvDefault("FIRMWARE_VERSION_FORMAT", "raw")),
+
+		FirmwareFileNumber: getenvUint16Default("FIRMWARE_FILE_NUMBER", 1),
+		FirmwareChunkRegs:  getenvIntDefault("FIRMWARE_CHUNK_REGS", 60),
+		FirmwareMaxBytes:   getenvIntDefault("FIRMWARE_MAX_BYTES", 1<<20),
+
+		StatusFieldMap: os.Getenv("STATUS_FIELD_MAP"),
+
+		AlarmRulesFile: os.Getenv("ALARM_RULES_FILE"),
+		AlarmRules:     os.Getenv("ALARM_RULES"),
+		AlarmRulesStore: os.Getenv("ALARM_RULES_STORE"),
+
+		DesiredValueFile: os.Getenv("DESIRED_VALUE_FILE"),
+		StateDir:         os.Getenv("STATE_DIR"),
+
+		ValueStaleAfter: time.Duration(getenvIntDefault("VALUE_STALE_AFTER_MS", 0)) * time.Millisecond,
+		ValueStaleText:  getenvDefault("VALUE_STALE_TEXT", "----"),
+
+		ValueSmoothing:       getenvIntDefault("VALUE_SMOOTHING_WINDOW", 0),
+		ValueRotateInterval:  time.Duration(getenvIntDefault("VALUE_ROTATE_INTERVAL_MS", 5000)) * time.Millisecond,
+		ValueAggregateWindow: time.Duration(getenvIntDefault("VALUE_AGGREGATE_WINDOW_MS", 300000)) * time.Millisecond,
+
+		MetricsFile:             os.Getenv("METRICS_FILE"),
+		MetricsSnapshotInterval: time.Duration(getenvIntDefault("METRICS_SNAPSHOT_INTERVAL_MS", 60000)) * time.Millisecond,
+
+		MQTTBroker:   os.Getenv("MQTT_BROKER"),
+		MQTTClientID: getenvDefault("MQTT_CLIENT_ID", "modbus-display"),
+		MQTTUsername: os.Getenv("MQTT_USERNAME"),
+		MQTTPassword: os.Getenv("MQTT_PASSWORD"),
+
+		SMTPHost:     os.Getenv("SMTP_HOST"),
+		SMTPPort:     getenvIntDefault("SMTP_PORT", 587),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:     os.Getenv("SMTP_FROM"),
+
+		TelegramBotToken: os.Getenv("TELEGRAM_BOT_TOKEN"),
+		TelegramAPIURL:   getenvDefault("TELEGRAM_API_URL", "https://api.telegram.org"),
+
+		NotifySubjectTemplate: getenvDefault("NOTIFY_SUBJECT_TEMPLATE", defaultSubjectTemplate),
+		NotifyTextTemplate:    getenvDefault("NOTIFY_TEXT_TEMPLATE", defaultTextTemplate),
+
+		SpoolDir:       os.Getenv("SPOOL_DIR"),
+		SpoolMaxEvents: getenvIntDefault("SPOOL_MAX_EVENTS", 10000),
+
+		WatchdogDevice:   os.Getenv("WATCHDOG_DEVICE"),
+		WatchdogInterval: time.Duration(getenvIntDefault("WATCHDOG_INTERVAL_MS", 5000)) * time.Millisecond,
+
+		CommandQueueSize: getenvIntDefault("COMMAND_QUEUE_SIZE", 100),
+		CommandRetention: time.Duration(getenvIntDefault("COMMAND_RETENTION_MS", 600000)) * time.Millisecond,
+
+		UpdateManifestURL:   os.Getenv("UPDATE_MANIFEST_URL"),
+		UpdateCheckInterval: time.Duration(getenvIntDefault("UPDATE_CHECK_INTERVAL_MS", 6*60*60*1000)) * time.Millisecond,
+
+		ConfigSyncURL:      os.Getenv("CONFIG_SYNC_URL"),
+		ConfigSyncInterval: time.Duration(getenvIntDefault("CONFIG_SYNC_INTERVAL_MS", 300000)) * time.Millisecond,
 	}
 
+	if cfg.HTTPListen == "" {
+		cfg.HTTPHost = getenv("HTTP_HOST")
+		cfg.HTTPPort = getenvInt("HTTP_PORT")
+	} else if _, _, err := parseListen(cfg.HTTPListen); err != nil {
+		configFatalf("%v", err)
+	}
+	if err := checkInterface(cfg.HTTPInterface); err != nil {
+		configFatalf("%v", err)
+	}
+	if cfg.DesiredValueFile == "" && cfg.StateDir != "" {
+		cfg.DesiredValueFile = filepath.Join(cfg.StateDir, "desired_value.json")
+	}
+	if cfg.MetricsFile == "" && cfg.StateDir != "" {
+		cfg.MetricsFile = filepath.Join(cfg.StateDir, "metrics.json")
+	}
+	if cfg.AlarmRulesStore == "" && cfg.StateDir != "" {
+		cfg.AlarmRulesStore = filepath.Join(cfg.StateDir, "alarm_rules.json")
+	}
+	if cfg.MetricsFile != "" && cfg.MetricsSnapshotInterval < time.Second {
+		configFatalf("METRICS_SNAPSHOT_INTERVAL_MS must be at least 1000")
+	}
+	if cfg.MaxRequestBody <= 0 {
+		configFatalf("MAX_REQUEST_BODY_BYTES must be >0")
+	}
+	if cfg.LogBufferLines < 0 {
+		configFatalf("LOG_BUFFER_LINES must be >=0")
+	}
+	if v := os.Getenv("ACCESS_LOG_SAMPLE"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(f >= 0 && f <= 1) {
+			configFatalf("ACCESS_LOG_SAMPLE must be between 0 and 1")
+		}
+		cfg.AccessLogSample = f
+	}
+	if cfg.SlowRequest < 0 {
+		configFatalf("SLOW_REQUEST_MS must be >=0")
+	}
+	var err error
+	if cfg.HTTPSocket, err = socketPermsFromEnv(); err != nil {
+		configFatalf("%v", err)
+	}
+	if cfg.HTTPBasePath != "" && !strings.HasPrefix(cfg.HTTPBasePath, "/") {
+		configFatalf("HTTP_BASE_PATH must start with /: %s", cfg.HTTPBasePath)
+	}
 	if cfg.Parity != "N" && cfg.Parity != "E" && cfg.Parity != "O" {
-		log.Fatalf("invalid PARITY: %s (expected N/E/O)", cfg.Parity)
+		configFatalf("invalid PARITY: %s (expected N/E/O)", cfg.Parity)
+	}
+	if cfg.RS485.DelayRtsBeforeSend < 0 || cfg.RS485.DelayRtsAfterSend < 0 {
+		configFatalf("RS485_DELAY_RTS_*_MS must be >=0")
+	}
+	if cfg.RS485.Enabled && cfg.RS485SoftwareRTS {
+		configFatalf("RS485_ENABLED and RS485_SOFTWARE_RTS are exclusive")
+	}
+	if cfg.ModbusMinGap < 0 {
+		configFatalf("MODBUS_MIN_GAP_MS must be >=0")
+	}
+	if cfg.SerialLockTimeout <= 0 {
+		configFatalf("SERIAL_LOCK_TIMEOUT_MS must be >0")
 	}
 	if cfg.DataBits < 5 || cfg.DataBits > 8 {
-		log.Fatalf("DATA_BITS must be 5..8")
+		configFatalf("DATA_BITS must be 5..8")
 	}
 	if cfg.StopBits != 1 && cfg.StopBits != 2 {
-		log.Fatalf("STOP_BITS must be 1 or 2")
+		configFatalf("STOP_BITS must be 1 or 2")
+	}
+	if cfg.BlinkMode != "hardware" && cfg.BlinkMode != "software" {
+		configFatalf("invalid BLINK_MODE: %s (expected hardware/software)", cfg.BlinkMode)
+	}
+	if cfg.DisplayValueRegs < 1 || cfg.DisplayValueRegs > maxWriteRegisters {
+		configFatalf("REG_DISPLAY_VALUE_REGS must be 1..%d", maxWriteRegisters)
+	}
+	if cfg.DisplayAlign != "left" && cfg.DisplayAlign != "right" {
+		configFatalf("invalid REG_DISPLAY_ALIGN: %s (expected left/right)", cfg.DisplayAlign)
+	}
+	pad, err := parseDisplayPad(strings.ToLower(os.Getenv("REG_DISPLAY_PAD")))
+	if err != nil {
+		configFatalf("invalid REG_DISPLAY_PAD: %v", err)
+	}
+	cfg.DisplayPad = pad
+	if os.Getenv("REG_ADDR_CLOCK_START") != "" {
+		cfg.RegClockStart = getenvUint16("REG_ADDR_CLOCK_START")
+		layout, err := parseClockLayout(getenvDefault("CLOCK_LAYOUT", "year,month,day,hour,minute,second"))
+		if err != nil {
+			configFatalf("invalid CLOCK_LAYOUT: %v", err)
+		}
+		cfg.ClockLayout = layout
+		cfg.ClockBCD = getenvBool("CLOCK_BCD")
+	}
+	for _, id := range identityEnv {
+		if os.Getenv(id.env) != "" {
+			cfg.IdentityRegs = append(cfg.IdentityRegs, identityReg{Field: id.field, Addr: getenvUint16(id.env)})
+		}
+	}
+	switch cfg.FirmwareFormat {
+	case "raw", "bytes", "hundredths":
+	default:
+		configFatalf("invalid FIRMWARE_VERSION_FORMAT: %s (expected raw/bytes/hundredths)", cfg.FirmwareFormat)
+	}
+	loc, err := time.LoadLocation(getenvDefault("CLOCK_TIMEZONE", "Local"))
+	if err != nil {
+		configFatalf("invalid CLOCK_TIMEZONE: %v", err)
+	}
+	cfg.ClockLocation = loc
+	if cfg.NotifyLocation, err = time.LoadLocation(getenvDefault("NOTIFY_TIMEZONE", "Local")); err != nil {
+		configFatalf("invalid NOTIFY_TIMEZONE: %v", err)
+	}
+	if cfg.NotifyRateLimit, cfg.NotifyRateWindow, err = parseRateLimit(os.Getenv("NOTIFY_RATE_LIMIT")); err != nil {
+		configFatalf("invalid NOTIFY_RATE_LIMIT: %v", err)
+	}
+	if cfg.NotifyQuietHours, err = parseQuietHours(os.Getenv("NOTIFY_QUIET_HOURS")); err != nil {
+		configFatalf("invalid NOTIFY_QUIET_HOURS: %v", err)
+	}
+	if at := os.Getenv("CLOCK_AUTO_SYNC_AT"); at != "" {
+		t, err := time.Parse("15:04", at)
+		if err != nil {
+			configFatalf("invalid CLOCK_AUTO_SYNC_AT (expected HH:MM): %v", err)
+		}
+		cfg.ClockAutoSync = true
+		cfg.ClockAutoSyncHour, cfg.ClockAutoSyncMinute = t.Hour(), t.Minute()
+	}
+	if cfg.NTPServer = os.Getenv("NTP_SERVER"); cfg.NTPServer != "" {
+		cfg.NTPInterval = time.Duration(getenvIntDefault("NTP_INTERVAL_MS", 900000)) * time.Millisecond
+		cfg.ClockSkewWarn = time.Duration(getenvIntDefault("CLOCK_SKEW_WARN_MS", 1000)) * time.Millisecond
+		if cfg.NTPInterval < time.Minute {
+			configFatalf("NTP_INTERVAL_MS must be at least 60000")
+		}
+		if cfg.ClockSkewWarn <= 0 {
+			configFatalf("CLOCK_SKEW_WARN_MS must be >0")
+		}
+	}
+	cfg.SNMPListen = os.Getenv("SNMP_LISTEN")
+	cfg.SNMPCommunity = getenvDefault("SNMP_COMMUNITY", "public")
+	if cfg.SNMPTrapTargets, err = parseTrapTargets(os.Getenv("SNMP_TRAP_TARGETS")); err != nil {
+		configFatalf("invalid SNMP_TRAP_TARGETS: %v", err)
+	}
+	if cfg.SNMPBaseOID, err = parseOID(getenvDefault("SNMP_BASE_OID", snmpDefaultBaseOID)); err != nil {
+		configFatalf("invalid SNMP_BASE_OID: %v", err)
+	}
+	if cfg.BACnetListen = os.Getenv("BACNET_LISTEN"); cfg.BACnetListen != "" {
+		id := getenvInt("BACNET_DEVICE_ID") // required: it must be unique on the internetwork
+		if id < 0 || id > bacnetMaxInstance {
+			configFatalf("BACNET_DEVICE_ID must be 0..%d", bacnetMaxInstance)
+		}
+		cfg.BACnetDeviceID = uint32(id)
+		cfg.BACnetDeviceName = getenvDefault("BACNET_DEVICE_NAME", fmt.Sprintf("modbus-display-%d", cfg.SlaveId))
+	}
+	if cfg.ClusterLeaseFile = os.Getenv("CLUSTER_LEASE_FILE"); cfg.ClusterLeaseFile != "" {
+		host, _ := os.Hostname()
+		cfg.ClusterNodeID = getenvDefault("CLUSTER_NODE_ID", host)
+		if cfg.ClusterNodeID == "" || strings.ContainsAny(cfg.ClusterNodeID, "/\\") {
+			configFatalf("CLUSTER_NODE_ID must be set and must not contain slashes")
+		}
+		cfg.ClusterLease = time.Duration(getenvIntDefault("CLUSTER_LEASE_MS", 10000)) * time.Millisecond
+		if cfg.ClusterLease < time.Second {
+			configFatalf("CLUSTER_LEASE_MS must be at least 1000")
+		}
+		cfg.ClusterPeerURL = strings.TrimRight(os.Getenv("CLUSTER_PEER_URL"), "/")
+	}
+	if spec := os.Getenv("SENSOR_CHANNELS"); spec != "" {
+		if cfg.SensorChannels, err = parseSensorChannels(spec, getenvUint16("SENSOR_REG_START")); err != nil {
+			configFatalf("invalid SENSOR_CHANNELS: %v", err)
+		}
+		cfg.SensorSigned = getenvBool("SENSOR_SIGNED")
+	}
+	cfg.SensorMQTTTopic = os.Getenv("SENSOR_MQTT_TOPIC")
+	if cfg.SensorMQTTTopic != "" && len(cfg.SensorChannels) == 0 {
+		configFatalf("SENSOR_MQTT_TOPIC needs SENSOR_CHANNELS")
+	}
+	// A healthy loop polls at least every poll interval, plus one full status
+	// read (11 requests, 12 with sensors) of timeouts; the backoff leaves
+	// room for a failed poll to recover.
+	reads := time.Duration(11)
+	if len(cfg.SensorChannels) > 0 {
+		reads++
+	}
+	defStall := 2 * (cfg.PollInterval + cfg.BackoffMax + reads*cfg.ModbusTimeout)
+	cfg.WatchdogStall = time.Duration(getenvIntDefault("WATCHDOG_STALL_MS", int(defStall/time.Millisecond))) * time.Millisecond
+	if cfg.WatchdogInterval <= 0 {
+		configFatalf("WATCHDOG_INTERVAL_MS must be >0")
+	}
+	if cfg.SpoolMaxEvents <= 0 {
+		configFatalf("SPOOL_MAX_EVENTS must be >0")
+	}
+	if cfg.FirmwareChunkRegs < 1 || cfg.FirmwareChunkRegs > maxFileRecordRegs {
+		configFatalf("FIRMWARE_CHUNK_REGS must be 1..%d", maxFileRecordRegs)
+	}
+	if cfg.FirmwareMaxBytes <= 0 {
+		configFatalf("FIRMWARE_MAX_BYTES must be >0")
+	}
+	if cfg.DisplayWriteInterval < 0 {
+		configFatalf("DISPLAY_WRITE_INTERVAL_MS must be >=0")
+	}
+	if cfg.RegisterCacheTTL < 0 {
+		configFatalf("REGISTER_CACHE_TTL_MS must be >=0")
 	}
 	if cfg.DisplayValueRegs <= 0 {
-		log.Fatalf("REG_DISPLAY_VALUE_REGS must be >0")
+		configFatalf("REG_DISPLAY_VALUE_REGS must be >0")
+	}
+	cfg.DisplayRules = loadDisplayRules()
+	if cfg.ExternalChangeNotify, err = parseNotifyTargets(os.Getenv("EXTERNAL_CHANGE_NOTIFY")); err != nil {
+		configFatalf("invalid EXTERNAL_CHANGE_NOTIFY: %v", err)
+	}
+	if cfg.StatusDeadband, err = parseDeadbands(os.Getenv("STATUS_DEADBAND")); err != nil {
+		configFatalf("invalid STATUS_DEADBAND: %v", err)
+	}
+	if cfg.CommandQueueSize <= 0 {
+		configFatalf("COMMAND_QUEUE_SIZE must be >0")
+	}
+	if cfg.CommandRetention <= 0 {
+		configFatalf("COMMAND_RETENTION_MS must be >0")
+	}
+	if cfg.UpdateManifestURL != "" {
+		if u, err := url.Parse(cfg.UpdateManifestURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			configFatalf("invalid UPDATE_MANIFEST_URL: %s (expected an http(s) URL)", cfg.UpdateManifestURL)
+		}
+	}
+	if cfg.UpdateCheckInterval <= 0 {
+		configFatalf("UPDATE_CHECK_INTERVAL_MS must be >0")
+	}
+	if cfg.ValueStaleAfter < 0 {
+		configFatalf("VALUE_STALE_AFTER_MS must be >=0")
+	}
+	if cfg.ValueSmoothing < 0 {
+		configFatalf("VALUE_SMOOTHING_WINDOW must be >=0")
+	}
+	if cfg.ValueRotate, err = parseValueRotate(os.Getenv("VALUE_ROTATE")); err != nil {
+		configFatalf("invalid VALUE_ROTATE: %v", err)
+	}
+	if cfg.ValueRotateInterval < 500*time.Millisecond {
+		configFatalf("VALUE_ROTATE_INTERVAL_MS must be at least 500")
+	}
+	if cfg.ValueAggregateWindow <= 0 {
+		configFatalf("VALUE_AGGREGATE_WINDOW_MS must be >0")
+	}
+	if cfg.AlarmRulesFile != "" && cfg.AlarmRules != "" {
+		configFatalf("ALARM_RULES and ALARM_RULES_FILE are exclusive")
+	}
+	if cfg.ConfigSyncURL != "" {
+		if u, err := url.Parse(cfg.ConfigSyncURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			configFatalf("invalid CONFIG_SYNC_URL: %s (expected an https URL)", cfg.ConfigSyncURL)
+		}
+		if os.Getenv("CONFIG_FILE") == "" {
+			configFatalf("CONFIG_SYNC_URL requires CONFIG_FILE, where the pulled configuration is kept")
+		}
+		if cfg.ConfigSyncKey, err = parseSyncKey(getenv("CONFIG_SYNC_KEY")); err != nil {
+			configFatalf("invalid CONFIG_SYNC_KEY: %v", err)
+		}
+		if cfg.ConfigSyncInterval < time.Second {
+			configFatalf("CONFIG_SYNC_INTERVAL_MS must be at least 1000")
+		}
+	}
+	envelope, casing := getenvDefault("RESPONSE_ENVELOPE", "none"), getenvDefault("RESPONSE_CASE", "snake")
+	if envelope != "none" && envelope != "data" {
+		configFatalf("invalid RESPONSE_ENVELOPE: %s (expected none/data)", envelope)
+	}
+	if casing != "snake" && casing != "camel" {
+		configFatalf("invalid RESPONSE_CASE: %s (expected snake/camel)", casing)
+	}
+	cfg.ResponseShape = responseShape{Envelope: envelope == "data", Camel: casing == "camel"}
+	if cfg.ResponseShapeRoutes, err = parseShapeRoutes(os.Getenv("RESPONSE_SHAPE_ROUTES"), cfg.ResponseShape); err != nil {
+		configFatalf("invalid RESPONSE_SHAPE_ROUTES: %v", err)
+	}
+	if cfg.TenantKeys, err = parseTenantKeys(os.Getenv("TENANT_KEYS")); err != nil {
+		configFatalf("invalid TENANT_KEYS: %v", err)
+	}
+	if cfg.DeviceTenants, err = parseTenantDevices(os.Getenv("TENANT_DEVICES")); err != nil {
+		configFatalf("invalid TENANT_DEVICES: %v", err)
+	}
+	for _, tenant := range cfg.TenantKeys {
+		owned := false
+		for _, t := range cfg.DeviceTenants {
+			owned = owned || t == tenant
+		}
+		if !owned {
+			configFatalf("TENANT_KEYS: tenant %s has no TENANT_DEVICES", tenant)
+		}
+	}
+	if cfg.JWTJWKSURL = os.Getenv("JWT_JWKS_URL"); cfg.JWTJWKSURL != "" {
+		if u, err := url.Parse(cfg.JWTJWKSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			configFatalf("invalid JWT_JWKS_URL: %s (expected an http(s) URL)", cfg.JWTJWKSURL)
+		}
+		cfg.JWTIssuer, cfg.JWTAudience = getenv("JWT_ISSUER"), getenv("JWT_AUDIENCE")
+		// Without both, any token the provider signs, for whatever system,
+		// would be accepted.
+		if cfg.JWTIssuer == "" || cfg.JWTAudience == "" {
+			configFatalf("JWT_JWKS_URL needs JWT_ISSUER and JWT_AUDIENCE")
+		}
+		cfg.JWTRolesClaim = getenvDefault("JWT_ROLES_CLAIM", "roles")
+		if cfg.JWTRoles, err = parseJWTRoleMap(getenv("JWT_ROLE_MAP")); err != nil {
+			configFatalf("invalid JWT_ROLE_MAP: %v", err)
+		}
+		if len(cfg.JWTRoles) == 0 {
+			configFatalf("JWT_ROLE_MAP maps no roles")
+		}
+		for value, role := range cfg.JWTRoles {
+			owned := role == jwtAdminRole
+			for _, t := range cfg.DeviceTenants {
+				owned = owned || t == role
+			}
+			if !owned {
+				configFatalf("JWT_ROLE_MAP: %s maps to tenant %s, which has no TENANT_DEVICES", value, role)
+			}
+		}
+		cfg.JWTJWKSRefresh = time.Duration(getenvIntDefault("JWT_JWKS_REFRESH_MS", 900000)) * time.Millisecond
+		if cfg.JWTJWKSRefresh <= 0 {
+			configFatalf("JWT_JWKS_REFRESH_MS must be >0")
+		}
 	}
 	return cfg
 }
 
-func (c Config) HTTPAddr() string { return fmt.Sprintf("%s:%d", c.HTTPHost, c.HTTPPort) }
\ No newline at end of file
+// HTTPAddr is where the API listens: HTTP_LISTEN if set, else HTTP_HOST:HTTP_PORT.
+func (c Config) HTTPAddr() string {
+	if c.HTTPListen != "" {
+		return c.HTTPListen
+	}
+	return joinHostPort(c.HTTPHost, strconv.Itoa(c.HTTPPort))
+}
\ No newline at end of file
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfigFile = `{
+  "defaults": {"BAUD_RATE": 9600, "POLL_INTERVAL_MS": 1000, "PARITY": "N", "READ_ONLY": false},
+  "profiles": {
+    "lab":  {"SERIAL_PORT": "/dev/ttyUSB1", "POLL_INTERVAL_MS": 200},
+    "line": {"SLAVE_ID": 7, "READ_ONLY": true}
+  }
+}`
+
+func TestMergeConfigFile(t *testing.T) {
+	tests := []struct {
+		profile string
+		want    map[string]configValue
+	}{
+		{"", map[string]configValue{"BAUD_RATE": "9600", "POLL_INTERVAL_MS": "1000", "PARITY": "N", "READ_ONLY": "false"}},
+		{"lab", map[string]configValue{"BAUD_RATE": "9600", "POLL_INTERVAL_MS": "200", "PARITY": "N", "READ_ONLY": "false", "SERIAL_PORT": "/dev/ttyUSB1"}},
+		{"line", map[string]configValue{"BAUD_RATE": "9600", "POLL_INTERVAL_MS": "1000", "PARITY": "N", "READ_ONLY": "true", "SLAVE_ID": "7"}},
+	}
+	for _, tt := range tests {
+		got, err := mergeConfigFile([]byte(testConfigFile), tt.profile)
+		if err != nil {
+			t.Fatalf("profile %q: %v", tt.profile, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("profile %q: got %v, want %v", tt.profile, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("profile %q: %s = %q, want %q", tt.profile, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestMergeConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		raw, profile, wantErr string
+	}{
+		{testConfigFile, "missing", `PROFILE "missing" not found`},
+		{`{"defaults": {"BAUD_RATE": 9600, "BUAD_RATE": 19200}}`, "", `defaults: unknown setting "BUAD_RATE"`},
+		{`{"profiles": {"lab": {"PROFILE": "line"}}}`, "", `profile lab: unknown setting "PROFILE"`},
+		{`{"defaults": {"SLAVE_ID": [1]}}`, "", "must be a string, number or boolean"},
+		{`{"default": {"SLAVE_ID": 1}}`, "", `unknown field "default"`},
+	}
+	for _, tt := range tests {
+		_, err := mergeConfigFile([]byte(tt.raw), tt.profile)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want %q", tt.raw, err, tt.wantErr)
+		}
+	}
+}
+
+func TestApplyConfigFilePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(testConfigFile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("PROFILE", "lab")
+	t.Setenv("BAUD_RATE", "115200") // real environment wins
+	t.Setenv("SERIAL_PORT", "")     // blank counts as unset
+	t.Setenv("POLL_INTERVAL_MS", "")
+	t.Setenv("PARITY", "")
+	t.Setenv("READ_ONLY", "")
+	applyConfigFile()
+
+	for k, want := range map[string]string{
+		"BAUD_RATE":        "115200",
+		"SERIAL_PORT":      "/dev/ttyUSB1",
+		"POLL_INTERVAL_MS": "200",
+		"PARITY":           "N",
+		"READ_ONLY":        "false",
+	} {
+		if got := os.Getenv(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+}
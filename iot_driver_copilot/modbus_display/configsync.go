@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config sync, for fleets run from one place: with CONFIG_SYNC_URL set the
+// driver fetches its CONFIG_FILE from a controller every
+// CONFIG_SYNC_INTERVAL_MS, sending the last ETag as If-None-Match so an
+// unchanged configuration costs a 304. The controller signs each document
+// with Ed25519 and sends the signature of the exact body, base64, in
+// X-Config-Signature; CONFIG_SYNC_KEY is the public key ("driver
+// sign-config" makes both). Documents that are unsigned, signed with
+// another key, or that CONFIG_FILE would reject are logged and ignored.
+//
+// A verified document replaces CONFIG_FILE, and what changed for this
+// PROFILE is reloaded in place: ALARM_RULES is swapped, and the serial link
+// settings reopen the port as PUT /serial does, keeping the old link and
+// refusing the document if it won't open. A document that changes anything
+// else is first vetted by "driver check-config"; the rest, the register map
+// included, is read once at startup, so it is saved for the next start and
+// listed as restart_needed in GET /config/sync. Settings the environment
+// sets itself win over CONFIG_FILE as always; changes to them are ignored.
+//
+// The signature proves where a document came from, not that it is the
+// latest: rotate the key to stop a captured document from being replayed.
+
+const configSignatureHeader = "X-Config-Signature"
+
+type configSync struct {
+	url      string
+	key      ed25519.PublicKey
+	path     string // CONFIG_FILE
+	profile  string
+	interval time.Duration
+	client   *http.Client
+	env      map[string]string // the environment the process started with
+
+	check       func(ctx context.Context, candidate string) error // vets a new CONFIG_FILE
+	applyAlarms func(rules string) error
+	applySerial func(req serialReq) error
+	logf        func(string, ...interface{})
+
+	started map[string]configValue // CONFIG_FILE as the driver started with it
+
+	mu      sync.Mutex
+	etag    string
+	checked time.Time
+	applied time.Time
+	changed []string // settings changed by the last document applied
+	pending []string // settings changed since the start that need a restart
+	lastErr string
+}
+
+// serialSettings are the settings a document changes in place, by field of
+// a PUT /serial request.
+var serialSettings = map[string]bool{
+	"SERIAL_PORT": true, "BAUD_RATE": true, "DATA_BITS": true, "PARITY": true, "STOP_BITS": true, "MODBUS_MIN_GAP_MS": true,
+	"RS485_ENABLED": true, "RS485_DELAY_RTS_BEFORE_SEND_MS": true, "RS485_DELAY_RTS_AFTER_SEND_MS": true,
+	"RS485_RTS_HIGH_DURING_SEND": true, "RS485_RTS_HIGH_AFTER_SEND": true, "RS485_RX_DURING_TX": true, "RS485_SOFTWARE_RTS": true,
+}
+
+// serialReqFor returns the PUT /serial request that sets the changed serial
+// settings to their values in cfg, a merged CONFIG_FILE; a setting the file
+// no longer has goes back to its default. ok is false when no serial
+// setting changed.
+func serialReqFor(changed []string, cfg map[string]configValue) (req serialReq, ok bool, err error) {
+	num := func(k string) *int {
+		n := 0
+		if v := string(cfg[k]); v != "" {
+			if n, err = strconv.Atoi(v); err != nil {
+				err = fmt.Errorf("invalid int for %s: %v", k, err)
+			}
+		}
+		return &n
+	}
+	flag := func(k string) *bool {
+		b := false
+		if v := string(cfg[k]); v != "" {
+			if b, err = strconv.ParseBool(v); err != nil {
+				err = fmt.Errorf("invalid bool for %s: %v", k, err)
+			}
+		}
+		return &b
+	}
+	rs := func() *rs485View {
+		if req.RS485 == nil {
+			req.RS485 = &rs485View{}
+		}
+		return req.RS485
+	}
+	for _, k := range changed {
+		if !serialSettings[k] {
+			continue
+		}
+		ok = true
+		switch k {
+		case "SERIAL_PORT":
+			v := string(cfg[k])
+			req.Port = &v
+		case "BAUD_RATE":
+			req.BaudRate = num(k)
+		case "DATA_BITS":
+			req.DataBits = num(k)
+		case "PARITY":
+			v := string(cfg[k])
+			req.Parity = &v
+		case "STOP_BITS":
+			req.StopBits = num(k)
+		case "MODBUS_MIN_GAP_MS":
+			req.MinGapMs = num(k)
+		case "RS485_ENABLED":
+			rs().Enabled = flag(k)
+		case "RS485_DELAY_RTS_BEFORE_SEND_MS":
+			rs().DelayRtsBeforeSendMs = num(k)
+		case "RS485_DELAY_RTS_AFTER_SEND_MS":
+			rs().DelayRtsAfterSendMs = num(k)
+		case "RS485_RTS_HIGH_DURING_SEND":
+			rs().RtsHighDuringSend = flag(k)
+		case "RS485_RTS_HIGH_AFTER_SEND":
+			rs().RtsHighAfterSend = flag(k)
+		case "RS485_RX_DURING_TX":
+			rs().RxDuringTx = flag(k)
+		case "RS485_SOFTWARE_RTS":
+			rs().SoftwareRTS = flag(k)
+		}
+		if err != nil {
+			return req, ok, err
+		}
+	}
+	return req, ok, nil
+}
+
+func newConfigSync(cfg Config, env []string, logf func(string, ...interface{})) *configSync {
+	s := &configSync{url: cfg.ConfigSyncURL, key: cfg.ConfigSyncKey, path: os.Getenv("CONFIG_FILE"), profile: os.Getenv("PROFILE"),
+		interval: cfg.ConfigSyncInterval, client: &http.Client{Timeout: 30 * time.Second}, env: map[string]string{}, logf: logf}
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			s.env[k] = v
+		}
+	}
+	s.check = func(ctx context.Context, candidate string) error { return checkConfigFile(ctx, env, candidate) }
+	return s
+}
+
+// parseSyncKey decodes CONFIG_SYNC_KEY, a base64 Ed25519 public key.
+func parseSyncKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("want a %d-byte Ed25519 public key, got %d bytes", ed25519.PublicKeySize, len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// run pulls once at startup and then every interval until ctx ends.
+func (s *configSync) run(ctx context.Context) {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		err := s.pull(ctx)
+		if err != nil && ctx.Err() == nil {
+			s.logf("config sync: %v", err)
+		}
+		s.mu.Lock()
+		s.checked, s.lastErr = time.Now(), ""
+		if err != nil {
+			s.lastErr = err.Error()
+		}
+		s.mu.Unlock()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pull fetches the configuration and applies it if it changed.
+func (s *configSync) pull(ctx context.Context) error {
+	body, etag, err := s.fetch(ctx)
+	if err != nil || body == nil {
+		return err
+	}
+	if err := s.apply(ctx, body); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.etag = etag
+	s.mu.Unlock()
+	return nil
+}
+
+// fetch returns the verified document and its ETag, or a nil body when the
+// controller answers 304 Not Modified.
+func (s *configSync) fetch(ctx context.Context) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", "modbus-display-driver/"+version)
+	s.mu.Lock()
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	s.mu.Unlock()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("controller: %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, "", err
+	}
+	sig, err := base64.StdEncoding.DecodeString(resp.Header.Get(configSignatureHeader))
+	if err != nil || len(sig) == 0 {
+		return nil, "", fmt.Errorf("document rejected: missing or malformed %s", configSignatureHeader)
+	}
+	if !ed25519.Verify(s.key, body, sig) {
+		return nil, "", errors.New("document rejected: signature does not match CONFIG_SYNC_KEY")
+	}
+	return body, resp.Header.Get("ETag"), nil
+}
+
+// apply installs a verified document as CONFIG_FILE.
+func (s *configSync) apply(ctx context.Context, body []byte) error {
+	next, err := mergeConfigFile(body, s.profile)
+	if err != nil {
+		return fmt.Errorf("document rejected: %v", err)
+	}
+	cur, err := os.ReadFile(s.path)
+	if err == nil && bytes.Equal(cur, body) {
+		return nil
+	}
+	prev, _ := mergeConfigFile(cur, s.profile) // unreadable: everything counts as changed
+	if s.started == nil {
+		s.started = prev
+	}
+	changed := s.changedSettings(prev, next)
+	var pending []string
+	for _, k := range s.changedSettings(s.started, next) {
+		if k != "ALARM_RULES" && !serialSettings[k] {
+			pending = append(pending, k)
+		}
+	}
+	serial, reopen, err := serialReqFor(changed, next)
+	if err != nil {
+		return fmt.Errorf("document rejected: %v", err)
+	}
+	alarms := false
+	for _, k := range changed {
+		alarms = alarms || k == "ALARM_RULES"
+	}
+
+	// A document that changes more than the alarm rules must still let the
+	// driver start.
+	target := s.path
+	if len(changed) > 0 && !(alarms && len(changed) == 1) {
+		target = s.path + ".sync"
+		if err := writeFileDurable(target, body); err != nil {
+			return err
+		}
+		if err := s.check(ctx, target); err != nil {
+			os.Remove(target)
+			return fmt.Errorf("document rejected: %v", err)
+		}
+	}
+	discard := func() {
+		if target != s.path {
+			os.Remove(target)
+		}
+	}
+	if alarms {
+		if err := s.applyAlarms(string(next["ALARM_RULES"])); err != nil {
+			discard()
+			return fmt.Errorf("alarm rules rejected: %v", err)
+		}
+	}
+	if reopen {
+		if err := s.applySerial(serial); err != nil {
+			if alarms {
+				_ = s.applyAlarms(string(prev["ALARM_RULES"]))
+			}
+			discard()
+			return fmt.Errorf("document rejected: %v", err)
+		}
+	}
+	if target == s.path {
+		err = writeFileDurable(s.path, body)
+	} else if err = os.Rename(target, s.path); err != nil {
+		os.Remove(target)
+	}
+	if err != nil {
+		return err
+	}
+	s.record(changed, pending)
+	if len(changed) > 0 {
+		s.logf("config sync: %s changed", strings.Join(changed, ", "))
+	}
+	if len(pending) > 0 {
+		s.logf("config sync: %s take effect at the next restart", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+func (s *configSync) record(changed, pending []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applied, s.changed, s.pending = time.Now(), changed, pending
+}
+
+// changedSettings lists, sorted, the settings whose effective value differs
+// between two merged configurations.
+func (s *configSync) changedSettings(prev, next map[string]configValue) []string {
+	var out []string
+	for k := range configSettings {
+		pv, inPrev := prev[k]
+		nv, inNext := next[k]
+		if pv == nv && inPrev == inNext || s.env[k] != "" || s.env[k+"_FILE"] != "" {
+			continue
+		}
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// checkConfigFile runs "driver check-config" against candidate with the
+// process's original environment, so a document that would stop the driver
+// from starting is refused while the current configuration still runs.
+func checkConfigFile(ctx context.Context, env []string, candidate string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, exe, "check-config")
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "CONFIG_FILE=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, "CONFIG_FILE="+candidate)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+		return fmt.Errorf("%v: %s", err, lines[len(lines)-1])
+	}
+	return nil
+}
+
+// --- the driver's side ---
+
+// applySyncedAlarmRules swaps in rules from a synced ALARM_RULES.
+func (d *ModbusDriver) applySyncedAlarmRules(src string) error {
+	if d.cfg.AlarmRulesFile != "" {
+		return errors.New("ALARM_RULES_FILE is set, and the two are exclusive")
+	}
+	if d.alarmRules.fromStore() {
+		return fmt.Errorf("the rules are edited through /alarms/rules and kept in %s", d.cfg.AlarmRulesStore)
+	}
+	_, err := d.alarms.SetRules(src)
+	return err
+}
+
+// applySyncedSerial reopens the port with a synced serial link.
+func (d *ModbusDriver) applySyncedSerial(req serialReq) error {
+	if _, msg := d.reopenSerial(req); msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
+
+func (d *ModbusDriver) handleConfigSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if d.configSync == nil {
+		http.Error(w, "config sync is disabled (CONFIG_SYNC_URL)", http.StatusNotFound)
+		return
+	}
+	s := d.configSync
+	s.mu.Lock()
+	body := map[string]interface{}{"url": s.url, "interval_ms": s.interval.Milliseconds()}
+	if s.etag != "" {
+		body["etag"] = s.etag
+	}
+	if !s.checked.IsZero() {
+		body["checked"] = s.checked.UTC()
+	}
+	if !s.applied.IsZero() {
+		body["applied"] = s.applied.UTC()
+		body["changed"] = s.changed
+	}
+	if len(s.pending) > 0 {
+		body["restart_needed"] = s.pending
+	}
+	if s.lastErr != "" {
+		body["error"] = s.lastErr
+	}
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConfigSync(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var doc []byte
+	var sig string
+	version := 0
+	serve := func(body string, signer ed25519.PrivateKey) {
+		mu.Lock()
+		defer mu.Unlock()
+		doc, version = []byte(body), version+1
+		sig = base64.StdEncoding.EncodeToString(ed25519.Sign(signer, doc))
+	}
+	notModified := 0
+	ctrl := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		etag := `"` + strconv.Itoa(version) + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set(configSignatureHeader, sig)
+		_, _ = w.Write(doc)
+	}))
+	defer ctrl.Close()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	doc0 := `{"defaults": {"SLAVE_ID": 1, "ALARM_RULES": "when online == false -> mqtt a"}}`
+	if err := os.WriteFile(path, []byte(doc0), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var alarms, checked []string
+	var serials []serialReq
+	var checkErr, serialErr error
+	s := &configSync{url: ctrl.URL, key: pub, path: path, client: ctrl.Client(),
+		env:         map[string]string{"SERIAL_PORT": "/dev/ttyUSB0"},
+		check:       func(_ context.Context, c string) error { checked = append(checked, c); return checkErr },
+		applyAlarms: func(rules string) error { alarms = append(alarms, rules); return nil },
+		applySerial: func(req serialReq) error { serials = append(serials, req); return serialErr },
+		logf:        t.Logf}
+	ctx := context.Background()
+	fileIs := func(want string) {
+		t.Helper()
+		if b, _ := os.ReadFile(path); string(b) != want {
+			t.Fatalf("CONFIG_FILE = %s, want %s", b, want)
+		}
+	}
+
+	// Only the alarm rules change: applied in place.
+	doc1 := `{"defaults": {"SLAVE_ID": 1, "ALARM_RULES": "when online == false -> mqtt b"}}`
+	serve(doc1, priv)
+	if err := s.pull(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fileIs(doc1)
+	if !reflect.DeepEqual(alarms, []string{"when online == false -> mqtt b"}) || len(serials) != 0 || len(checked) != 0 {
+		t.Fatalf("alarms %q, serial reloads %d, checks %d", alarms, len(serials), len(checked))
+	}
+	if err := s.pull(ctx); err != nil || notModified != 1 {
+		t.Fatalf("second pull: err %v, 304s %d", err, notModified)
+	}
+
+	// The serial link and the register map change: vetted, the link is
+	// reopened in place and the register map waits for a restart.
+	// SERIAL_PORT is set by the environment, so its change doesn't count.
+	doc2 := `{"defaults": {"SLAVE_ID": 1, "REG_ADDR_WORK_MODE": 9, "SERIAL_PORT": "/dev/ttyUSB1", "BAUD_RATE": 19200, "RS485_ENABLED": true, "ALARM_RULES": "when online == false -> mqtt b"}}`
+	serve(doc2, priv)
+	if err := s.pull(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fileIs(doc2)
+	if len(checked) != 1 || !reflect.DeepEqual(s.changed, []string{"BAUD_RATE", "REG_ADDR_WORK_MODE", "RS485_ENABLED"}) ||
+		!reflect.DeepEqual(s.pending, []string{"REG_ADDR_WORK_MODE"}) {
+		t.Fatalf("checks %d, changed %v, restart needed %v", len(checked), s.changed, s.pending)
+	}
+	if _, err := os.Stat(checked[0]); !os.IsNotExist(err) {
+		t.Errorf("candidate %s left behind", checked[0])
+	}
+	if len(serials) != 1 {
+		t.Fatalf("serial reloads %d", len(serials))
+	}
+	if req := serials[0]; req.Port != nil || req.Parity != nil || req.BaudRate == nil || *req.BaudRate != 19200 ||
+		req.RS485 == nil || req.RS485.Enabled == nil || !*req.RS485.Enabled || req.RS485.SoftwareRTS != nil {
+		t.Errorf("serial reload %+v", req)
+	}
+
+	// A link that won't open refuses the document and puts the alarm rules
+	// back. The register map still needs the restart.
+	serialErr = errors.New("open /dev/ttyUSB0: no such file or directory")
+	serve(`{"defaults": {"SLAVE_ID": 1, "REG_ADDR_WORK_MODE": 9, "BAUD_RATE": 9600, "ALARM_RULES": "when online == false -> mqtt c"}}`, priv)
+	if err := s.pull(ctx); err == nil || !strings.Contains(err.Error(), "ttyUSB0") {
+		t.Errorf("failed reload: err %v", err)
+	}
+	if want := []string{"when online == false -> mqtt b", "when online == false -> mqtt c", "when online == false -> mqtt b"}; !reflect.DeepEqual(alarms, want) {
+		t.Errorf("alarms %q, want %q", alarms, want)
+	}
+	if len(serials) != 2 || !reflect.DeepEqual(s.pending, []string{"REG_ADDR_WORK_MODE"}) {
+		t.Errorf("serial reloads %d, restart needed %v", len(serials), s.pending)
+	}
+	fileIs(doc2)
+	serialErr = nil
+
+	// Refused documents leave CONFIG_FILE alone.
+	checkErr = errors.New("invalid PARITY: X")
+	serve(`{"defaults": {"PARITY": "X"}}`, priv)
+	if err := s.pull(ctx); err == nil || !strings.Contains(err.Error(), "PARITY") {
+		t.Errorf("failed check: err %v", err)
+	}
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	serve(`{"defaults": {"SLAVE_ID": 2}}`, other)
+	if err := s.pull(ctx); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("foreign signature: err %v", err)
+	}
+	serve(`{"defaults": {"SLAVE_ADDR": 2}}`, priv)
+	if err := s.pull(ctx); err == nil || !strings.Contains(err.Error(), "unknown setting") {
+		t.Errorf("unknown setting: err %v", err)
+	}
+	fileIs(doc2)
+	if len(serials) != 2 {
+		t.Errorf("serial reloads = %d after refused documents", len(serials))
+	}
+}
+
+func TestSerialReqFor(t *testing.T) {
+	cfg := map[string]configValue{"PARITY": "E", "STOP_BITS": "2", "RS485_RX_DURING_TX": "1", "MODBUS_MIN_GAP_MS": "x"}
+	req, ok, err := serialReqFor([]string{"ALARM_RULES", "PARITY", "STOP_BITS", "RS485_RX_DURING_TX", "RS485_DELAY_RTS_BEFORE_SEND_MS"}, cfg)
+	if err != nil || !ok {
+		t.Fatalf("ok %v, err %v", ok, err)
+	}
+	if *req.Parity != "E" || *req.StopBits != 2 || !*req.RS485.RxDuringTx || *req.RS485.DelayRtsBeforeSendMs != 0 || req.BaudRate != nil {
+		t.Errorf("request %+v, RS485 %+v", req, *req.RS485)
+	}
+	if _, ok, _ := serialReqFor([]string{"ALARM_RULES", "REG_ADDR_WORK_MODE"}, cfg); ok {
+		t.Error("no serial setting changed, but a reload was asked for")
+	}
+	if _, _, err := serialReqFor([]string{"MODBUS_MIN_GAP_MS"}, cfg); err == nil || !strings.Contains(err.Error(), "MODBUS_MIN_GAP_MS") {
+		t.Errorf("bad value: err %v", err)
+	}
+}
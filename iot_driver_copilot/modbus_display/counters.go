@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// The driver's counters start from zero with every process, so a link that
+// drops a few times a day looks healthy right after each restart. With
+// METRICS_FILE (metrics.json in STATE_DIR by default) the counters are
+// saved every METRICS_SNAPSHOT_INTERVAL_MS and on shutdown, and the saved
+// totals are added back on start. GET /metrics then has, next to each
+// since-boot NAME_total, NAME_lifetime_total: everything counted since the
+// file was created, at most one interval short after a crash.
+
+// driverCounter is a counter GET /metrics reports and METRICS_FILE keeps.
+type driverCounter struct {
+	name  string // metric name without the modbus_display_ prefix and _total suffix
+	help  string
+	since func(d *ModbusDriver) uint64 // since boot
+}
+
+var driverCounters = []driverCounter{
+	{"poll_errors", "Polls that failed to connect or to read the display.", func(d *ModbusDriver) uint64 { return d.pollErrors.Load() }},
+	{"reconnects", "Times the display answered again after a failed poll.", func(d *ModbusDriver) uint64 { return d.reconnects.Load() }},
+	{"link_resets", "Serial link rebuilds requested through POST /admin/reconnect.", func(d *ModbusDriver) uint64 { return d.linkResets.Load() }},
+	{"events_delivered", "Webhook/MQTT events delivered.", func(d *ModbusDriver) uint64 { return d.notifier.delivered.Load() }},
+	{"events_failed", "Webhook/MQTT delivery attempts that failed.", func(d *ModbusDriver) uint64 { return d.notifier.failed.Load() }},
+	{"notifications_suppressed", "Email/Telegram messages held back by quiet hours or the rate limit.", func(d *ModbusDriver) uint64 { return d.notifier.suppressed.Load() }},
+	{"spool_dropped", "Events dropped because the spool was full.", func(d *ModbusDriver) uint64 {
+		if d.notifier.spool == nil {
+			return 0
+		}
+		return d.notifier.spool.Dropped()
+	}},
+	{"serial_lock_timeouts", "Transactions given up waiting for SERIAL_LOCK_FILE.", func(d *ModbusDriver) uint64 { return d.busLock.timeoutCount() }},
+	{"echo_tests", "Display echo tests run (POST /display/value/echo-test).", func(d *ModbusDriver) uint64 { return d.echo.tests.Load() }},
+	{"echo_test_failures", "Display echo tests where no attempt read the token back.", func(d *ModbusDriver) uint64 { return d.echo.failures.Load() }},
+	{"echo_test_retries", "Extra attempts display echo tests needed.", func(d *ModbusDriver) uint64 { return d.echo.retries.Load() }},
+	{"value_rejected", "Display values refused by the DISPLAY_* rules.", func(d *ModbusDriver) uint64 { return d.valuesRejected.Load() }},
+	{"external_changes", "Polled fields changed without a write from this driver.", func(d *ModbusDriver) uint64 { return d.externalChanges.Load() }},
+	{"slow_requests", "HTTP requests slower than SLOW_REQUEST_MS.", func(d *ModbusDriver) uint64 { return d.access.slowRequests() }},
+	{"value_superseded", "Queued display values replaced by a newer one before being written.", func(d *ModbusDriver) uint64 {
+		if d.batcher == nil {
+			return 0
+		}
+		return d.batcher.superseded.Load()
+	}},
+}
+
+type counterSnapshot struct {
+	Since    time.Time         `json:"since"` // when the file was created
+	Counters map[string]uint64 `json:"counters"`
+}
+
+// lifetimeCounters holds the totals of earlier runs, fixed once loaded.
+type lifetimeCounters struct {
+	file stateFile
+	prev counterSnapshot
+}
+
+func loadLifetimeCounters(f stateFile, now time.Time) (*lifetimeCounters, error) {
+	lc := &lifetimeCounters{file: f}
+	found, err := f.Load(&lc.prev)
+	if err != nil {
+		return nil, err
+	}
+	if !found || lc.prev.Since.IsZero() {
+		lc.prev.Since = now.UTC()
+	}
+	if lc.prev.Counters == nil {
+		lc.prev.Counters = map[string]uint64{}
+	}
+	return lc, nil
+}
+
+// lifetime is the since-boot value of the named counter plus the earlier
+// runs' total; with no METRICS_FILE it is the since-boot value.
+func (lc *lifetimeCounters) lifetime(name string, since uint64) uint64 {
+	if lc == nil {
+		return since
+	}
+	return lc.prev.Counters[name] + since
+}
+
+func (lc *lifetimeCounters) sinceTime() (time.Time, bool) {
+	if lc == nil {
+		return time.Time{}, false
+	}
+	return lc.prev.Since, true
+}
+
+// saveCounters writes the lifetime totals to METRICS_FILE.
+func (d *ModbusDriver) saveCounters() error {
+	lc := d.lifetime
+	snap := counterSnapshot{Since: lc.prev.Since, Counters: map[string]uint64{}}
+	for _, c := range driverCounters {
+		snap.Counters[c.name] = lc.lifetime(c.name, c.since(d))
+	}
+	return lc.file.Save(snap)
+}
+
+// counterSnapshotLoop saves the counters every METRICS_SNAPSHOT_INTERVAL_MS
+// and once more when ctx ends.
+func (d *ModbusDriver) counterSnapshotLoop(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	t := time.NewTicker(d.cfg.MetricsSnapshotInterval)
+	defer t.Stop()
+	save := func() {
+		if err := d.saveCounters(); err != nil {
+			d.logger.Printf("save %s: %v", d.cfg.MetricsFile, err)
+		}
+	}
+	for {
+		select {
+		case <-t.C:
+			save()
+		case <-ctx.Done():
+			save()
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLifetimeCounters(t *testing.T) {
+	cfg := Config{MetricsFile: filepath.Join(t.TempDir(), "metrics.json"), MetricsSnapshotInterval: time.Hour}
+	run := func(pollErrors, reconnects uint64) (*ModbusDriver, string) {
+		t.Helper()
+		d, err := NewModbusDriver(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.pollErrors.Add(pollErrors)
+		d.reconnects.Add(reconnects)
+		rec := httptest.NewRecorder()
+		d.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		done := make(chan struct{})
+		d.counterSnapshotLoop(ctx, done) // saves once on the way out
+		return d, rec.Body.String()
+	}
+
+	first, _ := run(3, 1)
+	second, metrics := run(2, 0)
+	for _, want := range []string{
+		"modbus_display_poll_errors_total 2\n",
+		"modbus_display_poll_errors_lifetime_total 5\n",
+		"modbus_display_reconnects_total 0\n",
+		"modbus_display_reconnects_lifetime_total 1\n",
+		"modbus_display_events_delivered_lifetime_total 0\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics lack %q:\n%s", want, metrics)
+		}
+	}
+	if !second.lifetime.prev.Since.Equal(first.lifetime.prev.Since) {
+		t.Errorf("lifetime start moved from %v to %v", first.lifetime.prev.Since, second.lifetime.prev.Since)
+	}
+	if _, metrics := run(0, 0); !strings.Contains(metrics, "modbus_display_poll_errors_lifetime_total 5\n") {
+		t.Errorf("third run:\n%s", metrics)
+	}
+}
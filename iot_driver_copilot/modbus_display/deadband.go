@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Dead-bands keep a numeric field that wobbles around a value from turning
+// every poll into an update. STATUS_DEADBAND=display_value=0.5,blink_period_ms=20
+// holds display_value at its last published value until the polled value is
+// more than 0.5 away from it; as the reference is the published value and
+// not the previous poll, a slow drift is still reported once it adds up.
+// Dead-bands apply to GET /status/stream and to external change events.
+// GET /status, and the stream with ?raw=true, report the polled values.
+
+type deadbands map[string]float64
+
+// parseDeadbands reads field=band pairs; fields are /status names before
+// STATUS_FIELD_MAP.
+func parseDeadbands(s string) (deadbands, error) {
+	known := statusFields(DeviceStatus{})
+	b := deadbands{}
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		field, band, ok := strings.Cut(entry, "=")
+		field = strings.TrimSpace(field)
+		if !ok {
+			return nil, fmt.Errorf("malformed entry %q (expected field=band)", entry)
+		}
+		if _, ok := known[field]; !ok {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(band), 64)
+		if err != nil || v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%s: invalid band %q", field, band)
+		}
+		b[field] = v
+	}
+	return b, nil
+}
+
+// numeric reads a status value as a number; display_value is text.
+func numeric(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil && !math.IsNaN(f)
+	}
+	return 0, false
+}
+
+// moved reports whether v differs from ref by more than field's dead-band.
+// Values that aren't numbers have moved whenever they differ.
+func (b deadbands) moved(field string, ref, v interface{}) bool {
+	band, ok := b[field]
+	r, rok := numeric(ref)
+	n, nok := numeric(v)
+	if !ok || !rok || !nok {
+		return fmt.Sprint(ref) != fmt.Sprint(v)
+	}
+	return math.Abs(n-r) > band
+}
+
+// hold returns fields with every dead-banded value that hasn't moved away
+// from its published value replaced by that value.
+func (b deadbands) hold(fields, published map[string]interface{}) map[string]interface{} {
+	if len(b) == 0 || published == nil {
+		return fields
+	}
+	for f := range b {
+		if ref, ok := published[f]; ok && !b.moved(f, ref, fields[f]) {
+			fields[f] = ref
+		}
+	}
+	return fields
+}
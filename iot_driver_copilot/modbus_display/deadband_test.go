@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestParseDeadbands(t *testing.T) {
+	b, err := parseDeadbands("display_value=0.5, blink_period_ms=20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 2 || b["display_value"] != 0.5 || b["blink_period_ms"] != 20 {
+		t.Errorf("got %v", b)
+	}
+	for _, bad := range []string{"nope=1", "decimals", "decimals=-1", "decimals=x", "decimals=NaN"} {
+		if _, err := parseDeadbands(bad); err == nil {
+			t.Errorf("parseDeadbands(%q) accepted", bad)
+		}
+	}
+}
+
+func TestDeadbandHold(t *testing.T) {
+	b := deadbands{"display_value": 0.5}
+	published := map[string]interface{}{"display_value": "10.0", "decimals": 1.0}
+	for _, tc := range []struct {
+		polled interface{}
+		want   interface{}
+	}{
+		{"10.3", "10.0"},
+		{"9.6", "10.0"},
+		{"10.6", "10.6"}, // more than 0.5 from the published value
+		{"OPEN", "OPEN"}, // not a number
+	} {
+		got := b.hold(map[string]interface{}{"display_value": tc.polled, "decimals": 2.0}, published)
+		if got["display_value"] != tc.want || got["decimals"] != 2.0 {
+			t.Errorf("polled %v: got %v, want %v", tc.polled, got, tc.want)
+		}
+	}
+	// A drift of small steps is published once it adds up.
+	for _, v := range []string{"10.2", "10.4", "10.6"} {
+		next := b.hold(map[string]interface{}{"display_value": v}, published)
+		if next["display_value"] != published["display_value"] {
+			if v != "10.6" {
+				t.Errorf("%s published early", v)
+			}
+			published = next
+		}
+	}
+	if published["display_value"] != "10.6" {
+		t.Errorf("drift not published: %v", published)
+	}
+}
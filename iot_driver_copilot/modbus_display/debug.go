@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	httppprof "net/http/pprof"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+// Runtime diagnostics, with DEBUG_ENDPOINTS=true and an admin credential:
+//
+//	GET /debug/pprof/                    index of the profiles below
+//	GET /debug/pprof/profile?seconds=30  CPU profile
+//	GET /debug/pprof/trace?seconds=5     execution trace
+//	GET /debug/pprof/NAME[?debug=1]      goroutine, heap, allocs, block, mutex, threadcreate
+//	GET /debug/goroutines                every goroutine's stack, as text
+//	GET /debug/memstats                  memory, GC and scheduler figures as JSON
+//
+// go tool pprof cannot send the credential, so fetch profiles with curl
+// and open the file.
+// While the endpoints are on, blocking and mutex contention are sampled
+// (debugBlockRate, debugMutexFraction), which is what shows goroutines
+// queueing for the serial bus.
+
+const (
+	debugBlockRate     = int(100 * time.Microsecond) // sample about one block event per 100µs spent blocked
+	debugMutexFraction = 10                          // sample 1 in 10 contended mutex events
+)
+
+func enableContentionProfiles() {
+	runtime.SetBlockProfileRate(debugBlockRate)
+	runtime.SetMutexProfileFraction(debugMutexFraction)
+}
+
+type memStatsView struct {
+	Goroutines      int       `json:"goroutines"`
+	GOMAXPROCS      int       `json:"gomaxprocs"`
+	NumCPU          int       `json:"num_cpu"`
+	HeapAllocBytes  uint64    `json:"heap_alloc_bytes"`
+	HeapInuseBytes  uint64    `json:"heap_inuse_bytes"`
+	HeapObjects     uint64    `json:"heap_objects"`
+	StackInuseBytes uint64    `json:"stack_inuse_bytes"`
+	SysBytes        uint64    `json:"sys_bytes"`
+	TotalAllocBytes uint64    `json:"total_alloc_bytes"`
+	Mallocs         uint64    `json:"mallocs"`
+	Frees           uint64    `json:"frees"`
+	NumGC           uint32    `json:"num_gc"`
+	PauseTotalNs    uint64    `json:"gc_pause_total_ns"`
+	LastGC          time.Time `json:"last_gc"`
+	GCCPUFraction   float64   `json:"gc_cpu_fraction"`
+}
+
+func readMemStats() memStatsView {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return memStatsView{
+		Goroutines: runtime.NumGoroutine(), GOMAXPROCS: runtime.GOMAXPROCS(0), NumCPU: runtime.NumCPU(),
+		HeapAllocBytes: m.HeapAlloc, HeapInuseBytes: m.HeapInuse, HeapObjects: m.HeapObjects,
+		StackInuseBytes: m.StackInuse, SysBytes: m.Sys, TotalAllocBytes: m.TotalAlloc,
+		Mallocs: m.Mallocs, Frees: m.Frees, NumGC: m.NumGC, PauseTotalNs: m.PauseTotalNs,
+		LastGC: time.Unix(0, int64(m.LastGC)).UTC(), GCCPUFraction: m.GCCPUFraction,
+	}
+}
+
+func (d *ModbusDriver) handleDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !d.adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch path := r.URL.Path; {
+	case path == "/debug/goroutines":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_ = pprof.Lookup("goroutine").WriteTo(w, 2)
+	case path == "/debug/memstats":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(readMemStats())
+	case path == "/debug/pprof/profile":
+		httppprof.Profile(w, r)
+	case path == "/debug/pprof/trace":
+		httppprof.Trace(w, r)
+	case path == "/debug/pprof/cmdline":
+		httppprof.Cmdline(w, r)
+	case path == "/debug/pprof/symbol":
+		httppprof.Symbol(w, r)
+	case strings.HasPrefix(path, "/debug/pprof/"):
+		httppprof.Index(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
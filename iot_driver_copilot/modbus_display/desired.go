@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// desiredValue remembers the last display value commanded through
+// PUT /display/value in DESIRED_VALUE_FILE, so that it can be put back when
+// the display comes up again showing its power-on default. Writes that opt
+// out with "persist": false, and raw writes to the display registers, forget
+// it: restoring an older value over them would be a surprise.
+type desiredValue struct {
+	file stateFile
+
+	mu      sync.Mutex
+	value   string
+	set     bool
+	matched bool // the last good poll showed value
+}
+
+type desiredFile struct {
+	DisplayValue string `json:"display_value"`
+}
+
+func loadDesiredValue(file stateFile) (*desiredValue, error) {
+	dv := &desiredValue{file: file}
+	var f desiredFile
+	if _, err := file.Load(&f); err != nil {
+		return nil, err
+	}
+	dv.value, dv.set = f.DisplayValue, f.DisplayValue != ""
+	return dv, nil
+}
+
+func (dv *desiredValue) Get() (string, bool) {
+	if dv == nil {
+		return "", false
+	}
+	dv.mu.Lock()
+	defer dv.mu.Unlock()
+	return dv.value, dv.set
+}
+
+// Set records v as just written to the display.
+func (dv *desiredValue) Set(v string) error {
+	if dv == nil {
+		return nil
+	}
+	dv.mu.Lock()
+	defer dv.mu.Unlock()
+	dv.value, dv.set, dv.matched = v, true, true
+	return dv.file.Save(desiredFile{DisplayValue: v})
+}
+
+func (dv *desiredValue) Clear() error {
+	if dv == nil {
+		return nil
+	}
+	dv.mu.Lock()
+	defer dv.mu.Unlock()
+	if !dv.set {
+		return nil
+	}
+	dv.value, dv.set = "", false
+	return dv.file.Remove()
+}
+
+// forgetDesired drops the persisted value after a display write that did
+// not go through it.
+func (d *ModbusDriver) forgetDesired() {
+	if err := d.desired.Clear(); err != nil {
+		d.logger.Printf("clear %s: %v", d.cfg.DesiredValueFile, err)
+	}
+}
+
+// showsValue reports whether raw display registers hold v, allowing for a
+// soft blink frame with the masked characters blanked.
+func (d *ModbusDriver) showsValue(raw []byte, v string) bool {
+	enc, err := d.codec.Encode(v)
+	if err != nil {
+		return false
+	}
+	if bytes.Equal(raw, enc) {
+		return true
+	}
+	if d.blinker != nil {
+		_, mask, _, _ := d.blinker.Snapshot()
+		return bytes.Equal(raw, d.codec.Blank(enc, mask))
+	}
+	return false
+}
+
+// restoreDesired runs after every good poll. A display that no longer shows
+// the persisted value is taken to have power cycled if it was unreachable
+// since the previous good poll (lost) or showed the value then; in both
+// cases the value is written back. A mismatch that has already survived a
+// poll was put there by someone else and is left alone.
+func (d *ModbusDriver) restoreDesired(raw []byte, lost bool) {
+	dv := d.desired
+	v, ok := dv.Get()
+	if !ok || raw == nil || d.freshness.showingFallback() {
+		return
+	}
+	if d.showsValue(raw, v) {
+		dv.mu.Lock()
+		dv.matched = true
+		dv.mu.Unlock()
+		return
+	}
+	dv.mu.Lock()
+	suspect := lost || dv.matched
+	dv.matched = false
+	dv.mu.Unlock()
+	if !suspect || d.readOnly.Load() {
+		return
+	}
+
+	shown, _ := d.codec.Decode(raw)
+	d.logger.Printf("display shows %q instead of %q, device likely restarted; restoring", shown, v)
+	write := func() error { return d.writeDisplayText(v) }
+	var err error
+	if d.blinker != nil {
+		err = d.blinker.Write(v, write)
+	} else {
+		err = write()
+	}
+	if err != nil {
+		d.logger.Printf("restore display_value failed: %v", err)
+	}
+	// On failure, stay suspicious so the next poll tries again.
+	dv.mu.Lock()
+	if dv.set && dv.value == v {
+		dv.matched = true
+	}
+	dv.mu.Unlock()
+	if err == nil {
+		d.statusMu.Lock()
+		d.status.DisplayValue = v
+		d.statusMu.Unlock()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/goburrow/modbus"
+)
+
+// withSlave runs fn with the shared RTU handler temporarily addressed to
+// slave, restoring the configured slave id afterwards. All displays on the
+// bus are assumed to share the configured register map.
+func (d *ModbusDriver) withSlave(slave byte, fn func(modbus.Client) error) error {
+	d.mbusMu.Lock()
+	defer d.mbusMu.Unlock()
+	if d.client == nil || d.handler == nil {
+		return errors.New("modbus client not connected")
+	}
+	prev := d.handler.SlaveId
+	d.handler.SlaveId = slave
+	defer func() { d.handler.SlaveId = prev }()
+	return fn(d.client)
+}
+
+type devicesValueReq struct {
+	// Either a per-slave map...
+	Values map[string]string `json:"values"`
+	// ...or one value applied to every listed slave.
+	DisplayValue string `json:"display_value"`
+	SlaveIds     []int  `json:"slave_ids"`
+}
+
+type deviceWriteResult struct {
+	SlaveId int    `json:"slave_id"`
+	Value   string `json:"display_value"`
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (d *ModbusDriver) handleDevicesValue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req devicesValueReq
+	if !d.decodeJSON(w, r, &req) {
+		return
+	}
+
+	if len(req.Values) > 0 && (len(req.SlaveIds) > 0 || req.DisplayValue != "") {
+		http.Error(w, "use either values or display_value with slave_ids, not both", http.StatusBadRequest)
+		return
+	}
+
+	targets := map[int]string{}
+	for k, v := range req.Values {
+		id, err := strconv.Atoi(k)
+		if err != nil {
+			http.Error(w, "invalid slave id: "+k, http.StatusBadRequest)
+			return
+		}
+		targets[id] = strings.TrimSpace(v)
+	}
+	if len(req.SlaveIds) > 0 {
+		val := strings.TrimSpace(req.DisplayValue)
+		if val == "" {
+			http.Error(w, "display_value required with slave_ids", http.StatusBadRequest)
+			return
+		}
+		for _, id := range req.SlaveIds {
+			targets[id] = val
+		}
+	}
+	if len(targets) == 0 {
+		http.Error(w, "values or slave_ids required", http.StatusBadRequest)
+		return
+	}
+	ids := make([]int, 0, len(targets))
+	tenant := requestTenant(r)
+	for id, val := range targets {
+		if id < 1 || id > 247 {
+			http.Error(w, "slave id out of range: "+strconv.Itoa(id), http.StatusBadRequest)
+			return
+		}
+		if !d.tenantOwns(tenant, id) {
+			http.Error(w, "slave "+strconv.Itoa(id)+" is not assigned to tenant "+tenant, http.StatusForbidden)
+			return
+		}
+		if val == "" {
+			http.Error(w, "empty display_value for slave "+strconv.Itoa(id), http.StatusBadRequest)
+			return
+		}
+		if _, err := d.codec.Encode(val); err != nil {
+			http.Error(w, "slave "+strconv.Itoa(id)+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := d.cfg.DisplayRules.Check(val); err != nil {
+			d.rejectValue(w, r, "slave "+strconv.Itoa(id)+" display_value", err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	if dryRun(r) {
+		var ops []plannedOp
+		for _, id := range ids {
+			payload, _ := d.codec.Encode(targets[id])
+			ops = append(ops, planPayload("display_value", id, d.cfg.RegDisplayValueStart, payload))
+			if id == d.cfg.SlaveId {
+				ops = append(ops, d.planForgetDesired()...)
+			}
+		}
+		d.replyDryRun(w, ops)
+		return
+	}
+
+	results := make([]deviceWriteResult, 0, len(ids))
+	failed := 0
+	for _, id := range ids {
+		val := targets[id]
+		payload, _ := d.codec.Encode(val) // validated above
+		write := func() error {
+			return d.withSlave(byte(id), func(c modbus.Client) error {
+				if d.readOnly.Load() {
+					return errReadOnly
+				}
+				_, err := c.WriteMultipleRegisters(d.cfg.RegDisplayValueStart, uint16(d.cfg.DisplayValueRegs), payload)
+				d.regCache.Invalidate()
+				return err
+			})
+		}
+		var err error
+		if id == d.cfg.SlaveId && d.blinker != nil {
+			err = d.blinker.Write(val, write)
+		} else {
+			err = write()
+		}
+		res := deviceWriteResult{SlaveId: id, Value: val, Ok: err == nil}
+		if err != nil {
+			failed++
+			res.Error = err.Error()
+			d.logger.Printf("write display_value to slave %d failed: %v", id, err)
+		} else if id == d.cfg.SlaveId {
+			d.forgetDesired()
+			d.noteValueWritten()
+			d.statusMu.Lock()
+			d.status.DisplayValue = val
+			d.statusMu.Unlock()
+		}
+		results = append(results, res)
+	}
+	// 207 when only some slaves took the value, 502 when none did.
+	code := http.StatusOK
+	if failed == len(results) {
+		code = http.StatusBadGateway
+	} else if failed > 0 {
+		code = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": failed == 0, "results": results})
+}
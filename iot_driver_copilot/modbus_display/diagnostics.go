@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Serial line diagnostics: GET /diagnostics/serial returns the UART's own
+// error counters (TIOCGICOUNT) for the port. Framing and parity errors,
+// overruns and breaks rising along with Modbus CRC errors point at wiring,
+// termination or line settings; CRC errors on a clean line point at the
+// slave or at bus contention. The counters are the kernel's, cumulative
+// since the port's driver was loaded, and are read through a descriptor of
+// their own, so they can be fetched while a poll is running. USB adapters
+// and pseudo terminals that keep no counters answer 501.
+
+const tiocgicount = 0x545D
+
+// serialICounter is struct serial_icounter_struct.
+type serialICounter struct {
+	CTS, DSR, RNG, DCD     int32
+	RX, TX                 int32
+	Frame, Overrun, Parity int32
+	Brk, BufOverrun        int32
+	_                      [9]int32
+}
+
+type serialCounters struct {
+	Port           string `json:"port"`
+	RxBytes        int32  `json:"rx_bytes"`
+	TxBytes        int32  `json:"tx_bytes"`
+	FramingErrors  int32  `json:"framing_errors"`
+	ParityErrors   int32  `json:"parity_errors"`
+	Overruns       int32  `json:"overruns"`        // UART FIFO overruns
+	BufferOverruns int32  `json:"buffer_overruns"` // tty buffer overruns
+	Breaks         int32  `json:"breaks"`
+	CTSChanges     int32  `json:"cts_changes"`
+	DSRChanges     int32  `json:"dsr_changes"`
+	DCDChanges     int32  `json:"dcd_changes"`
+	RingChanges    int32  `json:"ring_changes"`
+}
+
+var errNoLineCounters = errors.New("the port's driver keeps no line counters")
+
+// readSerialCounters fetches the kernel counters of the tty at path.
+func readSerialCounters(path string) (serialCounters, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return serialCounters{}, err
+	}
+	defer f.Close()
+	var ic serialICounter
+	if err := ioctl(f.Fd(), tiocgicount, uintptr(unsafe.Pointer(&ic))); err != nil {
+		if err == syscall.ENOTTY || err == syscall.EINVAL {
+			return serialCounters{}, errNoLineCounters
+		}
+		return serialCounters{}, err
+	}
+	return serialCounters{
+		Port: path, RxBytes: ic.RX, TxBytes: ic.TX,
+		FramingErrors: ic.Frame, ParityErrors: ic.Parity, Overruns: ic.Overrun, BufferOverruns: ic.BufOverrun, Breaks: ic.Brk,
+		CTSChanges: ic.CTS, DSRChanges: ic.DSR, DCDChanges: ic.DCD, RingChanges: ic.RNG,
+	}, nil
+}
+
+func (d *ModbusDriver) handleSerialDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d.mbusMu.Lock()
+	path := d.cfg.SerialPort
+	if d.handler != nil {
+		path = d.handler.Address
+	}
+	d.mbusMu.Unlock()
+	c, err := readSerialCounters(path)
+	if errors.Is(err, errNoLineCounters) {
+		http.Error(w, path+": "+err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		d.logger.Printf("serial counters of %s: %v", path, err)
+		http.Error(w, "cannot read serial counters: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Raw display access for segment-direct work modes, where each byte of the
+// display value registers drives one digit's segments instead of holding an
+// ASCII character:
+//
+//	GET /display/value/raw
+//	PUT /display/value/raw  {"hex": "3F06 5B4F"} or {"words": [16134, 23375]}
+//
+// A hex string carries one byte (two hex digits) per display digit; spaces
+// are ignored. Either form must cover every digit of the display.
+
+type displayRawReq struct {
+	Hex   *string  `json:"hex"`
+	Words []uint16 `json:"words"`
+}
+
+type displayRawResp struct {
+	Digits int      `json:"digits"`
+	Hex    string   `json:"hex"`
+	Words  []uint16 `json:"words"`
+}
+
+// payload validates the request against the display's digit count and
+// returns the register bytes to write.
+func (req displayRawReq) payload(regs int) ([]byte, error) {
+	digits := regs * 2
+	switch {
+	case req.Hex != nil && req.Words != nil:
+		return nil, fmt.Errorf("use either hex or words, not both")
+	case req.Hex != nil:
+		s := strings.Join(strings.Fields(*req.Hex), "")
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex: %v", err)
+		}
+		if len(b) != digits {
+			return nil, fmt.Errorf("hex holds %d digits, display has %d", len(b), digits)
+		}
+		return b, nil
+	case req.Words != nil:
+		if len(req.Words) != regs {
+			return nil, fmt.Errorf("words holds %d registers, display has %d", len(req.Words), regs)
+		}
+		b := make([]byte, 2*len(req.Words))
+		for i, v := range req.Words {
+			binary.BigEndian.PutUint16(b[2*i:], v)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("hex or words required")
+}
+
+func rawResponse(b []byte) displayRawResp {
+	resp := displayRawResp{Digits: len(b), Hex: strings.ToUpper(hex.EncodeToString(b)), Words: make([]uint16, len(b)/2)}
+	for i := range resp.Words {
+		resp.Words[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return resp
+}
+
+func (d *ModbusDriver) handleDisplayValueRaw(w http.ResponseWriter, r *http.Request) {
+	regs := d.cfg.DisplayValueRegs
+	switch r.Method {
+	case http.MethodGet:
+		b, err := d.readRegs(d.cfg.RegDisplayValueStart, uint16(regs))
+		if err != nil {
+			d.logger.Printf("read raw display value failed: %v", err)
+			http.Error(w, "device read error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(rawResponse(b))
+	case http.MethodPut:
+		// The soft blinker rewrites the display from its ASCII value every
+		// half period and would undo a raw pattern straight away.
+		if d.blinker != nil {
+			http.Error(w, "raw display writes are unavailable with BLINK_MODE=software", http.StatusConflict)
+			return
+		}
+		var req displayRawReq
+		if !d.decodeJSON(w, r, &req) {
+			return
+		}
+		payload, err := req.payload(regs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if dryRun(r) {
+			d.replyDryRun(w, append([]plannedOp{planPayload("display_value", d.linkSlave(), d.cfg.RegDisplayValueStart, payload)}, d.planForgetDesired()...))
+			return
+		}
+		if err := d.writeDisplayPayload(payload); err != nil {
+			d.logger.Printf("write raw display value failed: %v", err)
+			http.Error(w, "device write error", http.StatusInternalServerError)
+			return
+		}
+		d.forgetDesired()
+		d.noteValueWritten()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(rawResponse(payload))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
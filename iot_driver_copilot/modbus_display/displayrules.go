@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Display value rules: limits on what PUT /display/value and
+// PUT /devices/value accept, so an upstream system gone wrong can't put
+// control characters, absurdly long strings or unwanted words on a public
+// sign. They come on top of the display's own width (REG_DISPLAY_STRICT);
+// a rejected value is answered with 422 and counted in /metrics.
+
+type charClass uint8
+
+const (
+	classDigit charClass = 1 << iota
+	classUpper
+	classLower
+	classSpace
+	classPunct // printable ASCII other than letters, digits and space
+
+	classPrintable = classDigit | classUpper | classLower | classSpace | classPunct
+)
+
+var charClassNames = map[string]charClass{
+	"digit": classDigit, "upper": classUpper, "lower": classLower, "letter": classUpper | classLower,
+	"space": classSpace, "punct": classPunct, "printable": classPrintable,
+}
+
+type displayRules struct {
+	MaxLength int       // DISPLAY_MAX_LENGTH in characters; 0 leaves it to the display
+	Classes   charClass // DISPLAY_ALLOWED_CHARS; 0 is printable
+	Extra     string    // DISPLAY_ALLOWED_EXTRA: single characters allowed besides Classes
+	Min, Max  *float64  // DISPLAY_NUMERIC_MIN/MAX, for values that read as a number
+	Banned    []string  // DISPLAY_BANNED_WORDS, lower case
+}
+
+func loadDisplayRules() displayRules {
+	r := displayRules{MaxLength: getenvIntDefault("DISPLAY_MAX_LENGTH", 0), Extra: os.Getenv("DISPLAY_ALLOWED_EXTRA")}
+	if r.MaxLength < 0 {
+		configFatalf("DISPLAY_MAX_LENGTH must be >=0")
+	}
+	var err error
+	if r.Classes, err = parseCharClasses(getenvDefault("DISPLAY_ALLOWED_CHARS", "printable")); err != nil {
+		configFatalf("invalid DISPLAY_ALLOWED_CHARS: %v", err)
+	}
+	for _, b := range []struct {
+		key string
+		dst **float64
+	}{{"DISPLAY_NUMERIC_MIN", &r.Min}, {"DISPLAY_NUMERIC_MAX", &r.Max}} {
+		if v := os.Getenv(b.key); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(f) {
+				configFatalf("invalid number for %s: %s", b.key, v)
+			}
+			*b.dst = &f
+		}
+	}
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		configFatalf("DISPLAY_NUMERIC_MIN exceeds DISPLAY_NUMERIC_MAX")
+	}
+	for _, w := range strings.Split(os.Getenv("DISPLAY_BANNED_WORDS"), ",") {
+		if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+			r.Banned = append(r.Banned, w)
+		}
+	}
+	return r
+}
+
+// parseCharClasses reads a comma-separated list of class names.
+func parseCharClasses(s string) (charClass, error) {
+	var c charClass
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		cls, ok := charClassNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown character class %q (expected digit, upper, lower, letter, space, punct or printable)", name)
+		}
+		c |= cls
+	}
+	if c == 0 {
+		return 0, errors.New("no character class given")
+	}
+	return c, nil
+}
+
+func (r displayRules) allowed(c rune) bool {
+	if strings.ContainsRune(r.Extra, c) {
+		return true
+	}
+	if r.Classes == 0 {
+		r.Classes = classPrintable
+	}
+	switch {
+	case c >= '0' && c <= '9':
+		return r.Classes&classDigit != 0
+	case c >= 'A' && c <= 'Z':
+		return r.Classes&classUpper != 0
+	case c >= 'a' && c <= 'z':
+		return r.Classes&classLower != 0
+	case c == ' ':
+		return r.Classes&classSpace != 0
+	case c > ' ' && c < 0x7F:
+		return r.Classes&classPunct != 0
+	}
+	return false // control characters and anything beyond ASCII
+}
+
+// Check returns why val may not be displayed, or nil.
+func (r displayRules) Check(val string) error {
+	if n := utf8.RuneCountInString(val); r.MaxLength > 0 && n > r.MaxLength {
+		return fmt.Errorf("value is %d characters, at most %d allowed", n, r.MaxLength)
+	}
+	for i, c := range val {
+		if !r.allowed(c) {
+			return fmt.Errorf("character %q at %d not allowed", c, i)
+		}
+	}
+	if f, err := strconv.ParseFloat(val, 64); err == nil && !math.IsNaN(f) {
+		if r.Min != nil && f < *r.Min {
+			return fmt.Errorf("value %s below minimum %g", val, *r.Min)
+		}
+		if r.Max != nil && f > *r.Max {
+			return fmt.Errorf("value %s above maximum %g", val, *r.Max)
+		}
+	}
+	lower := strings.ToLower(val)
+	for _, w := range r.Banned {
+		if strings.Contains(lower, w) {
+			return errors.New("value contains a banned word")
+		}
+	}
+	return nil
+}
+
+// rejectValue answers a PUT whose value broke the rules.
+func (d *ModbusDriver) rejectValue(w http.ResponseWriter, r *http.Request, what string, err error) {
+	d.valuesRejected.Add(1)
+	d.logger.Printf("rejected %s from %s: %v", what, r.RemoteAddr, err)
+	http.Error(w, what+" rejected: "+err.Error(), http.StatusUnprocessableEntity)
+}
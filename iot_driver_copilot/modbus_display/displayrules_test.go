@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDisplayRules(t *testing.T) {
+	min, max := -50.0, 150.0
+	r := displayRules{MaxLength: 6, Classes: classDigit | classUpper | classSpace, Extra: ".-", Min: &min, Max: &max, Banned: []string{"darn"}}
+	for val, wantErr := range map[string]string{
+		"12.5":    "",
+		"-50":     "",
+		"OPEN":    "",
+		"A 1":     "",
+		"1e2":     `'e'`,
+		"150.1":   "above maximum",
+		"-51":     "below minimum",
+		"TOOLONG": "at most 6",
+		"open":    `'o'`,
+		"AB\x07":  `'\a'`,
+		"1\t2":    `'\t'`,
+		"ÄB":      `'Ä'`,
+		"DARN":    "banned",
+		"XDARNX":  "banned", // words match anywhere
+	} {
+		err := r.Check(val)
+		switch {
+		case wantErr == "" && err != nil:
+			t.Errorf("%q rejected: %v", val, err)
+		case wantErr != "" && (err == nil || !strings.Contains(err.Error(), wantErr)):
+			t.Errorf("%q: error %v, want one containing %s", val, err, wantErr)
+		}
+	}
+
+	// The zero value only keeps out what isn't printable ASCII.
+	var zero displayRules
+	if err := zero.Check("Hello, World! 42"); err != nil {
+		t.Errorf("zero rules: %v", err)
+	}
+	if err := zero.Check("A\x1bB"); err == nil {
+		t.Error("zero rules accepted a control character")
+	}
+}
+
+func TestParseCharClasses(t *testing.T) {
+	if c, err := parseCharClasses("digit, LETTER"); err != nil || c != classDigit|classUpper|classLower {
+		t.Errorf("digit,letter = %b, %v", c, err)
+	}
+	for _, bad := range []string{"", "digits", "digit,emoji"} {
+		if _, err := parseCharClasses(bad); err == nil {
+			t.Errorf("parseCharClasses(%q) accepted", bad)
+		}
+	}
+}
@@ -6,12 +6,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -29,6 +32,9 @@ type DeviceStatus struct {
 	DpMask         uint16 `json:"dp_mask"`
 	BlinkMask      uint16 `json:"blink_mask"`
 	BlinkPeriodMs  uint16 `json:"blink_period_ms"`
+	ExternalChanges map[string]externalChange `json:"external_changes,omitempty"` // fields changed behind the driver's back; see externalchange.go
+	Sensors        map[string]float64 `json:"sensors,omitempty"` // scaled sensor channel values; see sensors.go
+	sensors        []sensorReading
 	lastUpdateTime time.Time `json:"-"`
 }
 
@@ -37,16 +43,142 @@ type ModbusDriver struct {
 	logger   *log.Logger
 
 	handler  *modbus.RTUClientHandler
+	link     *serialLink // transport for handler; see link.go
+	busLock  *busLock    // nil unless SERIAL_LOCK_FILE is set
 	client   modbus.Client
 
-	mbusMu   sync.Mutex     // serialize modbus ops
-	statusMu sync.RWMutex   // guard status
-	status   DeviceStatus
+	mbusMu    sync.Mutex   // serialize modbus ops
+	statusMu  sync.RWMutex // guard status
+	status    DeviceStatus
+	statusHub statusHub    // GET /status/stream subscribers
+	logs      *logHub      // recent log lines and GET /logs/stream subscribers
+	access    *accessLog   // nil unless ACCESS_LOG_SAMPLE or SLOW_REQUEST_MS is set
+
+	settingsMu sync.Mutex // makes If-Match check-and-write atomic on the settings PUTs
+
+	notifier *Notifier
+	alarms   *AlarmEngine
+	alarmRules *alarmRuleStore // the rules as /alarms/rules edits them; see alarmstore.go
+	blinker  *softBlinker // non-nil when BLINK_MODE=software
+	codec    asciiCodec   // display value register layout
+	regCache *regCache    // GET /registers coalescing; nil in CLI mode
+	desired  *desiredValue // nil unless DESIRED_VALUE_FILE is set
+	freshness *valueWatchdog // nil unless VALUE_STALE_AFTER_MS is set
+	pipeline *valuePipeline // nil unless VALUE_SMOOTHING_WINDOW or VALUE_ROTATE is set
+	clock    *timeSource   // nil unless NTP_SERVER is set; Now() is then the host clock
+	reach    atomic.Pointer[reachability] // SLAVE_ID's state as of the last poll; nil before the first
+	port     atomic.Pointer[portCheck]    // SERIAL_PORT's last check; nil in CLI mode
+	echo     echoStats                    // POST /display/value/echo-test results
+	peers    peerStatusCache               // GET /status/all reads of the other slaves
+	mapping  *statusMapping // nil unless STATUS_FIELD_MAP is set
+	batcher  *displayBatcher // non-nil when DISPLAY_WRITE_INTERVAL_MS > 0
+	led      *statusLED      // nil unless STATUS_LED is set
+	updates  *updateChecker  // nil unless UPDATE_MANIFEST_URL is set
+	jwt      *jwtVerifier    // nil unless JWT_JWKS_URL is set
+	commands *commandQueue   // POST /commands
+	changes  *changeTracker  // external change detection; nil in CLI mode
+	snmp     *snmpAgent      // nil unless SNMP_LISTEN or SNMP_TRAP_TARGETS is set
+	cluster  *clusterNode    // nil unless CLUSTER_LEASE_FILE is set
+	configSync *configSync   // nil unless CONFIG_SYNC_URL is set
+	relink     chan struct{} // POST /admin/reconnect: poll now, backoff reset
+	// commandTarget is what queued commands are replayed through; set by routes.
+	commandTarget http.Handler
+	readOnly atomic.Bool
+
+	firmwareBusy atomic.Bool  // a POST /firmware is running
+	valuesRejected atomic.Uint64 // display values refused by DISPLAY_* rules
+	externalChanges atomic.Uint64 // polled fields changed by someone else
+	pollErrors   atomic.Uint64 // failed connects and status reads
+	reconnects   atomic.Uint64 // good polls after a failed one
+	linkResets   atomic.Uint64 // POST /admin/reconnect calls
+	lifetime     *lifetimeCounters // nil unless METRICS_FILE is set
+	lastProgress atomic.Int64 // unix nanos of the last successful poll
+	displayRaw   []byte       // display registers from the last good poll, touched only by pollLoop
+
+	ready    sync.Once // READY=1 sent to systemd
+	linkDesc string    // last STATUS= sent, touched only by pollLoop
 }
 
-func NewModbusDriver(cfg Config) *ModbusDriver {
-	logger := log.New(os.Stdout, "[modbus-display] ", log.LstdFlags|log.Lmicroseconds)
-	return &ModbusDriver{cfg: cfg, logger: logger}
+func NewModbusDriver(cfg Config) (*ModbusDriver, error) {
+	logs := newLogHub(cfg.LogBufferLines)
+	logger := log.New(io.MultiWriter(os.Stdout, logs), "[modbus-display] ", log.LstdFlags|log.Lmicroseconds)
+	notifier, err := NewNotifier(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	d := &ModbusDriver{cfg: cfg, logger: logger, logs: logs, notifier: notifier}
+	d.codec = asciiCodec{Regs: cfg.DisplayValueRegs, Pad: cfg.DisplayPad, Right: cfg.DisplayAlign == "right", Strict: cfg.DisplayStrict}
+	d.regCache = newRegCache(cfg.RegisterCacheTTL)
+	d.access = newAccessLog(cfg)
+	if cfg.StatusFieldMap != "" {
+		if d.mapping, err = loadStatusMapping(cfg.StatusFieldMap); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DesiredValueFile != "" {
+		if d.desired, err = loadDesiredValue(stateFile{path: cfg.DesiredValueFile, logf: logger.Printf}); err != nil {
+			return nil, fmt.Errorf("load %s: %w", cfg.DesiredValueFile, err)
+		}
+	}
+	if cfg.MetricsFile != "" {
+		if d.lifetime, err = loadLifetimeCounters(stateFile{path: cfg.MetricsFile, logf: logger.Printf}, time.Now()); err != nil {
+			return nil, fmt.Errorf("load %s: %w", cfg.MetricsFile, err)
+		}
+	}
+	if cfg.BlinkMode == "software" {
+		d.blinker = newSoftBlinker(cfg.SoftBlinkPeriod, cfg.SoftBlinkMask)
+	}
+	if cfg.DisplayWriteInterval > 0 {
+		d.batcher = newDisplayBatcher(cfg.DisplayWriteInterval)
+	}
+	if cfg.ValueStaleAfter > 0 {
+		if _, err := d.codec.Encode(cfg.ValueStaleText); err != nil {
+			return nil, fmt.Errorf("invalid VALUE_STALE_TEXT: %v", err)
+		}
+		d.freshness = newValueWatchdog(cfg.ValueStaleAfter, cfg.ValueStaleText, time.Now())
+	}
+	if cfg.ValueSmoothing > 1 || len(cfg.ValueRotate) > 0 {
+		d.pipeline = newValuePipeline(cfg, func(s string) bool { _, err := d.codec.Encode(s); return err == nil })
+	}
+	d.busLock = newBusLock(cfg.SerialLockFile, cfg.SerialLockTimeout)
+	d.commands = newCommandQueue(cfg.CommandQueueSize, cfg.CommandRetention)
+	d.changes = newChangeTracker()
+	for _, t := range cfg.ExternalChangeNotify {
+		if t.Kind == "mqtt" && !notifier.MQTTEnabled() {
+			return nil, fmt.Errorf("EXTERNAL_CHANGE_NOTIFY publishes to MQTT but MQTT_BROKER is not set")
+		}
+	}
+	if cfg.SensorMQTTTopic != "" && !notifier.MQTTEnabled() {
+		return nil, fmt.Errorf("SENSOR_MQTT_TOPIC is set but MQTT_BROKER is not")
+	}
+	if cfg.JWTJWKSURL != "" {
+		d.jwt = newJWTVerifier(cfg)
+	}
+	if cfg.NTPServer != "" {
+		d.clock = newTimeSource(cfg, logger)
+	}
+	if cfg.SNMPListen != "" || len(cfg.SNMPTrapTargets) > 0 {
+		d.snmp = newSNMPAgent("modbus-display-driver "+buildVersion().Version, cfg.SNMPCommunity, cfg.SNMPTrapTargets, cfg.SNMPBaseOID, logger.Printf, d.snmpObjects())
+	}
+	if cfg.ClusterLeaseFile != "" {
+		d.cluster = newClusterNode(cfg, d.clock.Now, logger.Printf)
+	}
+	if cfg.UpdateManifestURL != "" {
+		d.updates = newUpdateChecker(cfg.UpdateManifestURL, cfg.UpdateCheckInterval)
+	}
+	d.relink = make(chan struct{}, 1)
+	if cfg.ConfigSyncURL != "" {
+		d.configSync = newConfigSync(cfg, processEnv, logger.Printf)
+		d.configSync.applyAlarms, d.configSync.applySerial = d.applySyncedAlarmRules, d.applySyncedSerial
+	}
+	if cfg.DebugEndpoints {
+		if !d.adminEnabled() {
+			return nil, fmt.Errorf("DEBUG_ENDPOINTS needs ADMIN_TOKEN or a JWT_ROLE_MAP admin role")
+		}
+		enableContentionProfiles()
+	}
+	d.readOnly.Store(cfg.ReadOnly)
+	return d, nil
 }
 
 func (d *ModbusDriver) buildHandler() *modbus.RTUClientHandler {
@@ -55,6 +187,7 @@ func (d *ModbusDriver) buildHandler() *modbus.RTUClientHandler {
 	h.DataBits = d.cfg.DataBits
 	h.Parity = d.cfg.Parity
 	h.StopBits = d.cfg.StopBits
+	h.RS485 = d.cfg.RS485
 	h.SlaveId = byte(d.cfg.SlaveId)
 	h.Timeout = d.cfg.ModbusTimeout
 	return h
@@ -63,30 +196,51 @@ func (d *ModbusDriver) buildHandler() *modbus.RTUClientHandler {
 func (d *ModbusDriver) ensureConnected(ctx context.Context) error {
 	d.mbusMu.Lock()
 	defer d.mbusMu.Unlock()
+	if !d.cluster.leading() { return errStandby }
 	if d.handler == nil {
-		d.handler = d.buildHandler()
+		d.buildLink()
 	}
 	// Connect if not connected
-	if err := d.handler.Connect(); err != nil {
+	if err := d.link.Connect(); err != nil {
 		return err
 	}
-	d.client = modbus.NewClient(d.handler)
+	d.client = modbus.NewClient2(d.handler, d.link)
 	return nil
 }
 
+// buildLink makes a fresh handler and the link around it. The caller holds mbusMu.
+func (d *ModbusDriver) buildLink() {
+	d.handler = d.buildHandler()
+	d.link = newSerialLink(d.handler, d.cfg, d.busLock)
+}
+
 func (d *ModbusDriver) closeConn() {
 	d.mbusMu.Lock()
 	defer d.mbusMu.Unlock()
-	if d.handler != nil {
-		_ = d.handler.Close()
+	if d.link != nil {
+		_ = d.link.Close()
+	}
+}
+
+// busReady checks the bus may be used: the link is up and, in a cluster,
+// this instance holds the lease. Checking under mbusMu fences every
+// transaction, not just the handlers that check leadership first. The
+// caller holds mbusMu.
+func (d *ModbusDriver) busReady() error {
+	if !d.cluster.leading() {
+		return errStandby
+	}
+	if d.client == nil {
+		return errors.New("modbus client not connected")
 	}
+	return nil
 }
 
 func (d *ModbusDriver) readU16(addr uint16) (uint16, error) {
 	d.mbusMu.Lock()
 	defer d.mbusMu.Unlock()
-	if d.client == nil {
-		return 0, errors.New("modbus client not connected")
+	if err := d.busReady(); err != nil {
+		return 0, err
 	}
 	b, err := d.client.ReadHoldingRegisters(addr, 1)
 	if err != nil {
@@ -101,8 +255,8 @@ func (d *ModbusDriver) readU16(addr uint16) (uint16, error) {
 func (d *ModbusDriver) readRegs(addr uint16, qty uint16) ([]byte, error) {
 	d.mbusMu.Lock()
 	defer d.mbusMu.Unlock()
-	if d.client == nil {
-		return nil, errors.New("modbus client not connected")
+	if err := d.busReady(); err != nil {
+		return nil, err
 	}
 	b, err := d.client.ReadHoldingRegisters(addr, qty)
 	if err != nil {
@@ -112,12 +266,17 @@ func (d *ModbusDriver) readRegs(addr uint16, qty uint16) ([]byte, error) {
 }
 
 func (d *ModbusDriver) writeU16(addr uint16, val uint16) error {
+	if d.readOnly.Load() {
+		return errReadOnly
+	}
 	d.mbusMu.Lock()
 	defer d.mbusMu.Unlock()
-	if d.client == nil {
-		return errors.New("modbus client not connected")
+	if err := d.busReady(); err != nil {
+		return err
 	}
 	_, err := d.client.WriteSingleRegister(addr, val)
+	d.regCache.Invalidate()
+	d.changes.noteWrite(addr, 1)
 	return err
 }
 
@@ -125,15 +284,34 @@ func (d *ModbusDriver) writeRegs(addr uint16, qty uint16, payload []byte) error
 	if int(qty)*2 != len(payload) {
 		return fmt.Errorf("payload length mismatch: need %d bytes", int(qty)*2)
 	}
+	if d.readOnly.Load() {
+		return errReadOnly
+	}
 	d.mbusMu.Lock()
 	defer d.mbusMu.Unlock()
-	if d.client == nil {
-		return errors.New("modbus client not connected")
+	if err := d.busReady(); err != nil {
+		return err
 	}
 	_, err := d.client.WriteMultipleRegisters(addr, qty, payload)
+	d.regCache.Invalidate()
+	d.changes.noteWrite(addr, qty)
 	return err
 }
 
+// writeDisplayText writes s to the display value registers, padded and
+// aligned as configured.
+func (d *ModbusDriver) writeDisplayText(s string) error {
+	payload, err := d.codec.Encode(s)
+	if err != nil {
+		return err
+	}
+	return d.writeDisplayPayload(payload)
+}
+
+func (d *ModbusDriver) writeDisplayPayload(payload []byte) error {
+	return d.writeRegs(d.cfg.RegDisplayValueStart, uint16(d.cfg.DisplayValueRegs), payload)
+}
+
 func (d *ModbusDriver) decodeCommFormat(code uint16) string {
 	// Map simple codes to common formats
 	switch code {
@@ -174,11 +352,9 @@ func (d *ModbusDriver) encodeCommFormatStr(s string) uint16 {
 	}
 }
 
-func (d *ModbusDriver) applyLocalSerialFromCommFormat(s string) {
-	// Update local handler serial parameters to match comm_format string
+// parseCommFormat splits a comm_format string like "8N1" into its line settings.
+func parseCommFormat(s string) (dataBits int, parity string, stopBits int, ok bool) {
 	cf := strings.ToUpper(strings.TrimSpace(s))
-	var dataBits, stopBits int
-	var parity string
 	// Parse like "8N1"
 	if len(cf) == 3 || len(cf) == 4 {
 		// handle 8N1 or 8N2
@@ -189,7 +365,13 @@ func (d *ModbusDriver) applyLocalSerialFromCommFormat(s string) {
 			stopBits = int(cf[3] - '0')
 		}
 	}
-	if dataBits >= 5 && dataBits <= 8 && (parity == "N" || parity == "E" || parity == "O") && (stopBits == 1 || stopBits == 2) {
+	ok = dataBits >= 5 && dataBits <= 8 && (parity == "N" || parity == "E" || parity == "O") && (stopBits == 1 || stopBits == 2)
+	return dataBits, parity, stopBits, ok
+}
+
+func (d *ModbusDriver) applyLocalSerialFromCommFormat(s string) {
+	// Update local handler serial parameters to match comm_format string
+	if dataBits, parity, stopBits, ok := parseCommFormat(s); ok {
 		// Update config
 		d.cfg.DataBits = dataBits
 		d.cfg.Parity = parity
@@ -202,58 +384,53 @@ func (d *ModbusDriver) applyLocalSerialFromCommFormat(s string) {
 	}
 }
 
-func (d *ModbusDriver) encodeAsciiToRegs(s string, regs int) []byte {
-	bs := []byte(s)
-	maxBytes := regs * 2
-	buf := make([]byte, maxBytes)
-	// fill spaces
-	for i := range buf {
-		buf[i] = 0x20
-	}
-	copy(buf, bs[:min(len(bs), maxBytes)])
-	// Convert big-endian pairs to register payload
-	return buf
-}
-
-func (d *ModbusDriver) decodeAsciiFromRegs(b []byte) string {
-	// b length is 2 * regs
-	// Trim trailing spaces and nulls
-	out := make([]byte, len(b))
-	copy(out, b)
-	// Convert directly to string of bytes (big-endian pairs already represent ASCII chars)
-	// We interpret each byte as a character in sequence
-	// Remove trailing spaces (0x20) and zeros
-	trimIdx := len(out)
-	for i := len(out) - 1; i >= 0; i-- {
-		if out[i] == 0x00 || out[i] == 0x20 {
-			trimIdx = i
-		} else {
-			break
-		}
-	}
-	return string(out[:trimIdx])
-}
-
-func min(a, b int) int { if a < b { return a } ; return b }
-
 func (d *ModbusDriver) pollLoop(ctx context.Context) {
 	backoff := d.cfg.BackoffInitial
+	lost := true // no good poll since start or the last failure
+	up := false  // a poll has succeeded since start
 	for {
 		if ctx.Err() != nil { return }
+		if !d.cluster.leading() {
+			// Standby: leave the bus to the leader and mirror its status.
+			d.markProgress()
+			d.releaseBus()
+			lost = true
+			d.replicateStatus(ctx)
+			select {
+			case <-time.After(d.cfg.PollInterval):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
 		if err := d.ensureConnected(ctx); err != nil {
 			d.logger.Printf("connect failed: %v; retry in %v", err, backoff)
+			d.pollErrors.Add(1)
+			d.notePortError(err)
+			lost = true
+			d.notifyLink(false, "connect failed: "+err.Error())
+			d.evaluateAlarms(false)
 			select {
 			case <-time.After(backoff):
 				backoff *= 2
 				if backoff > d.cfg.BackoffMax { backoff = d.cfg.BackoffMax }
 				continue
+			case <-d.relink: // POST /admin/reconnect
+				backoff = d.cfg.BackoffInitial
+				continue
 			case <-ctx.Done():
 				return
 			}
 		}
+		d.notePortOpen()
+		d.ready.Do(func() { d.notifyReady() })
 		// Connected: read status
 		if err := d.readAndUpdateStatus(); err != nil {
 			d.logger.Printf("poll error: %v", err)
+			d.pollErrors.Add(1)
+			lost = true
+			d.notifyLink(false, "poll error: "+err.Error())
+			d.evaluateAlarms(false)
 			// Close and backoff
 			d.closeConn()
 			select {
@@ -261,24 +438,51 @@ func (d *ModbusDriver) pollLoop(ctx context.Context) {
 				backoff *= 2
 				if backoff > d.cfg.BackoffMax { backoff = d.cfg.BackoffMax }
 				continue
+			case <-d.relink: // POST /admin/reconnect
+				backoff = d.cfg.BackoffInitial
+				continue
 			case <-ctx.Done():
 				return
 			}
 		}
+		d.notifyLink(true, "")
+		d.restoreDesired(d.displayRaw, lost)
+		d.checkFreshness(d.displayRaw, lost)
+		if lost && up { d.reconnects.Add(1) }
+		lost, up = false, true
+		d.markProgress()
+		d.evaluateAlarms(true)
 		backoff = d.cfg.BackoffInitial
 		// sleep until next poll
 		select {
 		case <-time.After(d.cfg.PollInterval):
 			continue
+		case <-d.relink:
+			continue
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+func (d *ModbusDriver) evaluateAlarms(online bool) {
+	fields := map[string]interface{}{"online": online}
+	if online {
+		d.statusMu.RLock()
+		fields = statusFields(d.status)
+		d.statusMu.RUnlock()
+		fields["online"] = true
+	}
+	if d.freshness != nil {
+		fields["value_stale"] = d.freshness.stale(time.Now())
+	}
+	d.alarms.Evaluate(fields, d.clock.Now())
+}
+
 func (d *ModbusDriver) readAndUpdateStatus() error {
 	// Read core config
 	var err error
+	start := time.Now()
 	st := DeviceStatus{}
 	// These reads are independent; errors should abort to trigger reconnect
 	if v, e := d.readU16(d.cfg.RegDeviceAddress); e == nil { st.DeviceAddress = int(v) } else { err = e }
@@ -288,23 +492,46 @@ func (d *ModbusDriver) readAndUpdateStatus() error {
 	if v, e := d.readU16(d.cfg.RegValueType); e == nil { st.ValueType = v } else { err = e }
 	if v, e := d.readU16(d.cfg.RegDecimals); e == nil { st.Decimals = v } else { err = e }
 	if v, e := d.readU16(d.cfg.RegDpMask); e == nil { st.DpMask = v } else { err = e }
-	if v, e := d.readU16(d.cfg.RegBlinkMask); e == nil { st.BlinkMask = v } else { err = e }
-	if v, e := d.readU16(d.cfg.RegBlinkPeriodMs); e == nil { st.BlinkPeriodMs = v } else { err = e }
+	if d.blinker == nil {
+		if v, e := d.readU16(d.cfg.RegBlinkMask); e == nil { st.BlinkMask = v } else { err = e }
+		if v, e := d.readU16(d.cfg.RegBlinkPeriodMs); e == nil { st.BlinkPeriodMs = v } else { err = e }
+	}
 	// display value registers
 	regQty := uint16(d.cfg.DisplayValueRegs)
 	if b, e := d.readRegs(d.cfg.RegDisplayValueStart, regQty); e == nil {
-		st.DisplayValue = d.decodeAsciiFromRegs(b)
+		if v, e := d.codec.Decode(b); e == nil { st.DisplayValue = v } else { err = e }
+		d.displayRaw = b
 	} else { err = e }
+	if n := len(d.cfg.SensorChannels); n > 0 {
+		if b, e := d.readRegs(d.cfg.SensorChannels[0].Addr, uint16(n)); e == nil { st.sensors = d.decodeSensors(b); st.Sensors = sensorValues(st.sensors) } else { err = e }
+	}
+	if d.blinker != nil && err == nil {
+		// The device may be mid-blink; report the emulated blink state and the commanded value.
+		d.blinker.Observe(st.DisplayValue)
+		period, mask, value, _ := d.blinker.Snapshot()
+		st.BlinkMask = mask
+		st.BlinkPeriodMs = uint16(period / time.Millisecond)
+		st.DisplayValue = value
+	}
 
 	if err != nil {
 		return err
 	}
-	st.lastUpdateTime = time.Now()
+	st.lastUpdateTime = d.clock.Now()
+	d.statusMu.RLock()
+	prev := d.status
+	d.statusMu.RUnlock()
+	d.detectExternalChanges(prev, st, start)
 	// Update state
 	d.statusMu.Lock()
+	st.ExternalChanges = d.changes.snapshot()
 	d.status = st
 	d.statusMu.Unlock()
+	d.statusHub.publish(st)
+	d.publishSensors(st)
 	// Reflect into runtime config for slave id/baud/format if changed
+	d.mbusMu.Lock()
+	defer d.mbusMu.Unlock()
 	if d.cfg.SlaveId != st.DeviceAddress || d.cfg.BaudRate != st.BaudRate || d.cfg.CommFormatString() != st.CommFormat {
 		// Update runtime configuration (no write to device here; we are reading device's current settings)
 		d.cfg.SlaveId = st.DeviceAddress
@@ -329,7 +556,10 @@ func (d *ModbusDriver) handleStatus(w http.ResponseWriter, r *http.Request) {
 	d.statusMu.RLock()
 	st := d.status
 	d.statusMu.RUnlock()
+	w.Header().Add("Vary", "Accept")
+	if kind := statusMediaType(r.Header.Get("Accept")); kind != "json" { writeStatusXML(w, newStatusXML(st, d.cfg.SlaveId), kind == "soap"); return }
 	w.Header().Set("Content-Type", "application/json")
+	if d.mapping != nil { _ = json.NewEncoder(w).Encode(d.mapping.Apply(statusFields(st))); return }
 	_ = json.NewEncoder(w).Encode(st)
 }
 
@@ -340,9 +570,15 @@ type commConfigReq struct {
 }
 
 func (d *ModbusDriver) handleCommConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet { d.serveSettings(w, r, d.refreshCommConfig, commConfigView); return }
 	if r.Method != http.MethodPut { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+	d.settingsMu.Lock(); defer d.settingsMu.Unlock()
+	if !d.ifMatch(w, r, commConfigView) { return }
 	var req commConfigReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { http.Error(w, "invalid json", http.StatusBadRequest); return }
+	if !d.decodeJSON(w, r, &req) { return }
+	if req.BaudRate != nil && *req.BaudRate <= 0 { http.Error(w, "invalid baud_rate", http.StatusBadRequest); return }
+	if req.DeviceAddress != nil && (*req.DeviceAddress < 1 || *req.DeviceAddress > 247) { http.Error(w, "invalid device_address", http.StatusBadRequest); return }
+	if dryRun(r) { d.replyDryRun(w, d.planCommConfig(req)); return }
 	// Apply in safe order: comm_format -> baud_rate -> device_address
 	// Write to device registers then update local handler
 	if req.CommFormat != nil {
@@ -355,7 +591,6 @@ func (d *ModbusDriver) handleCommConfig(w http.ResponseWriter, r *http.Request)
 		d.applyLocalSerialFromCommFormat(*req.CommFormat)
 	}
 	if req.BaudRate != nil {
-		if *req.BaudRate <= 0 { http.Error(w, "invalid baud_rate", http.StatusBadRequest); return }
 		if err := d.writeU16(d.cfg.RegBaudRate, uint16(*req.BaudRate)); err != nil {
 			d.logger.Printf("write baud_rate failed: %v", err)
 			http.Error(w, "device write error", http.StatusInternalServerError); return
@@ -363,7 +598,6 @@ func (d *ModbusDriver) handleCommConfig(w http.ResponseWriter, r *http.Request)
 		if d.handler != nil { d.handler.BaudRate = *req.BaudRate }
 	}
 	if req.DeviceAddress != nil {
-		if *req.DeviceAddress < 1 || *req.DeviceAddress > 247 { http.Error(w, "invalid device_address", http.StatusBadRequest); return }
 		if err := d.writeU16(d.cfg.RegDeviceAddress, uint16(*req.DeviceAddress)); err != nil {
 			d.logger.Printf("write device_address failed: %v", err)
 			http.Error(w, "device write error", http.StatusInternalServerError); return
@@ -376,10 +610,32 @@ func (d *ModbusDriver) handleCommConfig(w http.ResponseWriter, r *http.Request)
 	if req.BaudRate != nil { d.status.BaudRate = *req.BaudRate }
 	if req.CommFormat != nil { d.status.CommFormat = *req.CommFormat }
 	d.statusMu.Unlock()
+	w.Header().Set("ETag", d.settingsETag(commConfigView))
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write([]byte(`{"ok":true}`))
 }
 
+// planCommConfig is the dry run of a validated /comm/config change.
+func (d *ModbusDriver) planCommConfig(req commConfigReq) []plannedOp {
+	var ops []plannedOp
+	slave := d.linkSlave()
+	if req.CommFormat != nil {
+		ops = append(ops, planWrite("comm_format", slave, 6, d.cfg.RegCommFormat, d.encodeCommFormatStr(*req.CommFormat)))
+		if dataBits, parity, stopBits, ok := parseCommFormat(*req.CommFormat); ok {
+			ops = append(ops, plannedOp{Op: "update_link", Field: "comm_format", Detail: map[string]interface{}{"data_bits": dataBits, "parity": parity, "stop_bits": stopBits}})
+		}
+	}
+	if req.BaudRate != nil {
+		ops = append(ops, planWrite("baud_rate", slave, 6, d.cfg.RegBaudRate, uint16(*req.BaudRate)),
+			plannedOp{Op: "update_link", Field: "baud_rate", Detail: map[string]int{"baud_rate": *req.BaudRate}})
+	}
+	if req.DeviceAddress != nil {
+		ops = append(ops, planWrite("device_address", slave, 6, d.cfg.RegDeviceAddress, uint16(*req.DeviceAddress)),
+			plannedOp{Op: "update_link", Field: "device_address", Detail: map[string]int{"slave_id": *req.DeviceAddress}})
+	}
+	return ops
+}
+
 type displayConfigReq struct {
 	ValueType *uint16 `json:"value_type"`
 	Decimals  *uint16 `json:"decimals"`
@@ -387,9 +643,25 @@ type displayConfigReq struct {
 }
 
 func (d *ModbusDriver) handleDisplayConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet { d.serveSettings(w, r, d.refreshDisplayConfig, displayConfigView); return }
 	if r.Method != http.MethodPut { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+	d.settingsMu.Lock(); defer d.settingsMu.Unlock()
+	if !d.ifMatch(w, r, displayConfigView) { return }
 	var req displayConfigReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { http.Error(w, "invalid json", http.StatusBadRequest); return }
+	if !d.decodeJSON(w, r, &req) { return }
+	if dryRun(r) {
+		var ops []plannedOp
+		slave := d.linkSlave()
+		for _, f := range []struct {
+			name string
+			addr uint16
+			v    *uint16
+		}{{"value_type", d.cfg.RegValueType, req.ValueType}, {"decimals", d.cfg.RegDecimals, req.Decimals}, {"work_mode", d.cfg.RegWorkMode, req.WorkMode}} {
+			if f.v != nil { ops = append(ops, planWrite(f.name, slave, 6, f.addr, *f.v)) }
+		}
+		d.replyDryRun(w, ops)
+		return
+	}
 	if req.ValueType != nil {
 		if err := d.writeU16(d.cfg.RegValueType, *req.ValueType); err != nil { d.logger.Printf("write value_type failed: %v", err); http.Error(w, "device write error", http.StatusInternalServerError); return }
 	}
@@ -405,63 +677,178 @@ func (d *ModbusDriver) handleDisplayConfig(w http.ResponseWriter, r *http.Reques
 	if req.Decimals != nil { d.status.Decimals = *req.Decimals }
 	if req.WorkMode != nil { d.status.WorkMode = *req.WorkMode }
 	d.statusMu.Unlock()
+	w.Header().Set("ETag", d.settingsETag(displayConfigView))
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write([]byte(`{"ok":true}`))
 }
 
 type displayValueReq struct {
 	DisplayValue string `json:"display_value"`
+	Persist      *bool  `json:"persist"` // default true; only meaningful with DESIRED_VALUE_FILE
 }
 
 func (d *ModbusDriver) handleDisplayValue(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet { d.serveSettings(w, r, d.refreshDisplayValue, displayValueView); return }
 	if r.Method != http.MethodPut { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+	d.settingsMu.Lock(); defer d.settingsMu.Unlock()
+	if !d.ifMatch(w, r, displayValueView) { return }
 	var req displayValueReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { http.Error(w, "invalid json", http.StatusBadRequest); return }
+	if !d.decodeJSON(w, r, &req) { return }
 	val := strings.TrimSpace(req.DisplayValue)
 	if val == "" { http.Error(w, "display_value required", http.StatusBadRequest); return }
-	payload := d.encodeAsciiToRegs(val, d.cfg.DisplayValueRegs)
-	qty := uint16(d.cfg.DisplayValueRegs)
-	if err := d.writeRegs(d.cfg.RegDisplayValueStart, qty, payload); err != nil {
+	if _, err := d.codec.Encode(val); err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+	if err := d.cfg.DisplayRules.Check(val); err != nil { d.rejectValue(w, r, "display_value", err); return }
+	persist := req.Persist == nil || *req.Persist
+	if dryRun(r) { d.replyDryRun(w, d.planDisplayValue(d.pipeline.Preview(val, time.Now()), persist)); return }
+	val = d.pipeline.Add(val, time.Now())
+	if d.batcher != nil {
+		d.batcher.Queue(val, persist)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"ok":true,"queued":true}`))
+		return
+	}
+	if err := d.applyDisplayValue(val, persist); err != nil {
 		d.logger.Printf("write display_value failed: %v", err)
 		http.Error(w, "device write error", http.StatusInternalServerError); return
 	}
-	// Update cache
-	d.statusMu.Lock(); d.status.DisplayValue = val; d.statusMu.Unlock()
+	w.Header().Set("ETag", d.settingsETag(displayValueView))
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write([]byte(`{"ok":true}`))
 }
 
+// applyDisplayValue writes a validated display value, records or forgets it
+// as the persisted value and updates the status cache.
+func (d *ModbusDriver) applyDisplayValue(val string, persist bool) error {
+	write := func() error { return d.writeDisplayText(val) }
+	var err error
+	if d.blinker != nil { err = d.blinker.Write(val, write) } else { err = write() }
+	if err != nil {
+		return err
+	}
+	if persist {
+		if err := d.desired.Set(val); err != nil { d.logger.Printf("persist display_value: %v", err) }
+	} else {
+		d.forgetDesired()
+	}
+	d.noteValueWritten()
+	// Update cache
+	d.statusMu.Lock(); d.status.DisplayValue = val; d.statusMu.Unlock()
+	return nil
+}
+
+// planDisplayValue is the dry run of a validated PUT /display/value.
+func (d *ModbusDriver) planDisplayValue(val string, persist bool) []plannedOp {
+	if d.batcher != nil {
+		return []plannedOp{{Op: "queue_display_value", Field: "display_value", Detail: map[string]interface{}{"display_value": val, "persist": persist}}}
+	}
+	payload, _ := d.codec.Encode(val) // validated by the caller
+	ops := []plannedOp{planPayload("display_value", d.linkSlave(), d.cfg.RegDisplayValueStart, payload)}
+	if persist && d.desired != nil {
+		return append(ops, plannedOp{Op: "save_desired_value", Detail: map[string]string{"file": d.cfg.DesiredValueFile, "display_value": val}})
+	}
+	if !persist {
+		ops = append(ops, d.planForgetDesired()...)
+	}
+	return ops
+}
+
 type blinkPeriodReq struct {
 	BlinkPeriodMs *uint16 `json:"blink_period_ms"`
 }
 
 func (d *ModbusDriver) handleBlinkPeriod(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet { d.serveSettings(w, r, d.refreshBlinkPeriod, blinkPeriodView); return }
 	if r.Method != http.MethodPut { http.Error(w, "method not allowed", http.StatusMethodNotAllowed); return }
+	d.settingsMu.Lock(); defer d.settingsMu.Unlock()
+	if !d.ifMatch(w, r, blinkPeriodView) { return }
 	var req blinkPeriodReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil { http.Error(w, "invalid json", http.StatusBadRequest); return }
+	if !d.decodeJSON(w, r, &req) { return }
 	if req.BlinkPeriodMs == nil { http.Error(w, "blink_period_ms required", http.StatusBadRequest); return }
-	if err := d.writeU16(d.cfg.RegBlinkPeriodMs, *req.BlinkPeriodMs); err != nil {
+	if dryRun(r) {
+		op := planWrite("blink_period_ms", d.linkSlave(), 6, d.cfg.RegBlinkPeriodMs, *req.BlinkPeriodMs)
+		if d.blinker != nil { op = plannedOp{Op: "set_soft_blink_period", Field: "blink_period_ms", Detail: map[string]uint16{"blink_period_ms": *req.BlinkPeriodMs}} }
+		d.replyDryRun(w, []plannedOp{op})
+		return
+	}
+	if d.blinker != nil {
+		d.blinker.SetPeriod(time.Duration(*req.BlinkPeriodMs) * time.Millisecond)
+	} else if err := d.writeU16(d.cfg.RegBlinkPeriodMs, *req.BlinkPeriodMs); err != nil {
 		d.logger.Printf("write blink_period_ms failed: %v", err)
 		http.Error(w, "device write error", http.StatusInternalServerError); return
 	}
 	// Update cache
 	d.statusMu.Lock(); d.status.BlinkPeriodMs = *req.BlinkPeriodMs; d.statusMu.Unlock()
+	w.Header().Set("ETag", d.settingsETag(blinkPeriodView))
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write([]byte(`{"ok":true}`))
 }
 
-func (d *ModbusDriver) runHTTP(ctx context.Context) *http.Server {
+func (d *ModbusDriver) routes() http.Handler {
 	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.handleHealthz)
 	mux.HandleFunc("/status", d.handleStatus)
-	mux.HandleFunc("/blink/period", d.handleBlinkPeriod)
-	mux.HandleFunc("/display/config", d.handleDisplayConfig)
-	mux.HandleFunc("/display/value", d.handleDisplayValue)
-	mux.HandleFunc("/comm/config", d.handleCommConfig)
+	mux.HandleFunc("/status.xml", d.handleStatusXML)
+	mux.HandleFunc("/status/stream", d.handleStatusStream)
+	mux.HandleFunc("/status/all", d.handleStatusAll)
+	mux.HandleFunc("/logs/stream", d.handleLogStream)
+	mux.HandleFunc("/blink/period", d.writeGuard(d.handleBlinkPeriod))
+	mux.HandleFunc("/display/config", d.writeGuard(d.handleDisplayConfig))
+	mux.HandleFunc("/display/value", d.writeGuard(d.handleDisplayValue))
+	mux.HandleFunc("/display/value/raw", d.writeGuard(d.handleDisplayValueRaw))
+	mux.HandleFunc("/display/value/stats", d.handleValueStats)
+	mux.HandleFunc("/display/value/echo-test", d.writeGuard(d.handleEchoTest))
+	mux.HandleFunc("/comm/config", d.writeGuard(d.handleCommConfig))
+	mux.HandleFunc("/alarms", d.handleAlarms)
+	mux.HandleFunc("/alarms/rules", d.handleAlarmRules)
+	mux.HandleFunc("/alarms/rules/", d.handleAlarmRule)
+	mux.HandleFunc("/metrics", d.handleMetrics)
+	mux.HandleFunc("/devices", d.handleDevices)
+	mux.HandleFunc("/devices/value", d.writeGuard(d.handleDevicesValue))
+	mux.HandleFunc("/admin/readonly", d.handleAdminReadOnly)
+	mux.HandleFunc("/admin/reconnect", d.handleAdminReconnect)
+	mux.HandleFunc("/registers/", d.writeGuard(d.handleRegisters))
+	mux.HandleFunc("/clock", d.handleClock)
+	mux.HandleFunc("/info", d.handleInfo)
+	mux.HandleFunc("/sensors", d.handleSensors)
+	mux.HandleFunc("/firmware", d.writeGuard(d.handleFirmware))
+	mux.HandleFunc("/clock/sync", d.writeGuard(d.handleClockSync))
+	mux.HandleFunc("/serial", d.writeGuard(d.handleSerial))
+	mux.HandleFunc("/diagnostics/serial", d.handleSerialDiagnostics)
+	mux.HandleFunc("/version", d.handleVersion)
+	mux.HandleFunc("/cluster", d.handleCluster)
+	mux.HandleFunc("/config/sync", d.handleConfigSync)
+	mux.HandleFunc("/.well-known/wot", d.handleThingDescription)
+	mux.HandleFunc("/status/external_changes", d.writeGuard(d.handleExternalChanges))
+	mux.HandleFunc("/commands", d.writeGuard(d.handleCommands))
+	mux.HandleFunc("/commands/", d.handleCommand)
+	if d.cfg.DebugEndpoints {
+		mux.HandleFunc("/debug/", d.handleDebug)
+	}
+	d.commandTarget = d.tenantGuard(mux)
+	return mountAt(d.cfg.HTTPBasePath, compressHandler(shapeHandler(d.cfg.ResponseShape, d.cfg.ResponseShapeRoutes, d.withAccessLog(mux, d.tenantGuard(mux)))))
+}
+
+// mountAt serves h under base ("" for the root), for deployments behind a
+// path-routing reverse proxy. Handlers see paths with base stripped.
+func mountAt(base string, h http.Handler) http.Handler {
+	if base == "" {
+		return h
+	}
+	mux := http.NewServeMux()
+	mux.Handle(base+"/", http.StripPrefix(base, h))
+	return mux
+}
 
-	srv := &http.Server{ Addr: d.cfg.HTTPAddr(), Handler: mux }
+func (d *ModbusDriver) runHTTP(ctx context.Context) *http.Server {
+	ln, err := listenHTTP(d.cfg.HTTPAddr(), d.cfg.HTTPInterface, d.cfg.HTTPSocket)
+	if err != nil {
+		d.logger.Fatalf("http listen: %v", err)
+	}
+	srv := &http.Server{ Handler: d.routes() }
 	go func() {
-		d.logger.Printf("HTTP server listening on %s", d.cfg.HTTPAddr())
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		d.logger.Printf("HTTP server listening on %s", ln.Addr())
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			d.logger.Printf("http server error: %v", err)
 		}
 	}()
@@ -475,26 +862,115 @@ func (d *ModbusDriver) runHTTP(ctx context.Context) *http.Server {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	led := openStatusLEDFromEnv()
+	if led != nil {
+		configFatalf = ledConfigFatalf(led)
+	}
 	cfg := LoadConfig()
-	drv := NewModbusDriver(cfg)
+	drv, err := NewModbusDriver(cfg)
+	if err != nil {
+		configFatalf("driver init: %v", err)
+	}
+	drv.led = led
+	v := buildVersion()
+	drv.logger.Printf("modbus-display-driver %s (commit %s, built %s, %s)", v.Version, v.GitCommit, v.BuildDate, v.GoVersion)
+	alarms, err := LoadAlarmEngine(cfg.AlarmRulesFile, drv.notifier, drv.logger)
+	if err != nil {
+		configFatalf("alarm rules: %v", err)
+	}
+	if cfg.AlarmRules != "" {
+		n, err := alarms.SetRules(cfg.AlarmRules)
+		if err != nil {
+			configFatalf("alarm rules: %v", err)
+		}
+		drv.logger.Printf("loaded %d alarm rules from ALARM_RULES", n)
+	}
+	alarms.mapping = drv.mapping
+	drv.alarms = alarms
+	if err := drv.loadAlarmRuleStore(); err != nil {
+		configFatalf("alarm rules: %v", err)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Check the port first so /healthz can say what is wrong with it
+	drv.checkPort()
+
 	// Start HTTP
 	_ = drv.runHTTP(ctx)
 
 	// Start poller
+	drv.markProgress()
 	go drv.pollLoop(ctx)
+	go drv.watchdogLoop(ctx)
+	if drv.blinker != nil {
+		go drv.softBlinkLoop(ctx)
+	}
+	if drv.batcher != nil {
+		go drv.displayWriteLoop(ctx)
+	}
+	if len(cfg.ValueRotate) > 0 {
+		go drv.valueRotateLoop(ctx)
+	}
+	go drv.commandLoop(ctx)
+	if drv.clock != nil {
+		go drv.clock.run(ctx)
+	}
+	clusterDone := make(chan struct{})
+	if drv.cluster != nil {
+		go func() {
+			defer close(clusterDone)
+			drv.cluster.run(ctx, drv.onClusterRole)
+		}()
+	} else {
+		close(clusterDone)
+	}
+	if len(cfg.ClockLayout) > 0 && cfg.ClockAutoSync {
+		go drv.clockAutoSyncLoop(ctx)
+	}
+	if drv.configSync != nil {
+		go drv.configSync.run(ctx)
+	}
+	if cfg.SNMPListen != "" {
+		conn, err := net.ListenPacket("udp", cfg.SNMPListen)
+		if err != nil {
+			configFatalf("snmp listen: %v", err)
+		}
+		drv.logger.Printf("SNMP agent listening on %s", conn.LocalAddr())
+		go drv.snmp.serve(ctx, conn)
+	}
+	if cfg.BACnetListen != "" {
+		conn, err := net.ListenPacket("udp", cfg.BACnetListen)
+		if err != nil {
+			configFatalf("bacnet listen: %v", err)
+		}
+		drv.logger.Printf("BACnet/IP device %d listening on %s", cfg.BACnetDeviceID, conn.LocalAddr())
+		go drv.serveBACnet(ctx, conn, drv.newBACnetDevice())
+	}
+	countersSaved := make(chan struct{})
+	if drv.lifetime != nil {
+		go drv.counterSnapshotLoop(ctx, countersSaved)
+	} else {
+		close(countersSaved)
+	}
 
 	// Handle shutdown
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	sig := <-sigCh
 	drv.logger.Printf("signal received: %v; shutting down", sig)
+	_ = sdNotify("STOPPING=1")
 	cancel()
 	// allow background to finish
 	time.Sleep(1 * time.Second)
+	<-countersSaved
+	<-clusterDone
 	drv.closeConn()
+	drv.notifier.Close()
+	drv.led.Close()
 	drv.logger.Printf("shutdown complete")
 }
@@ -0,0 +1,2051 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"modbus-display-driver/client"
+	"modbus-display-driver/internal/modbustest"
+)
+
+const (
+	testRegDisplay  = 16
+	testRegsDisplay = 4
+)
+
+// startTestDriver runs a driver with its poll loop against a simulated slave
+// on a pty and serves routes() through httptest. opts adjust the config
+// before the driver is built.
+func startTestDriver(t *testing.T, opts ...func(*Config)) (*ModbusDriver, *modbustest.Server, *httptest.Server) {
+	t.Helper()
+	sim := modbustest.NewServer(1)
+	t.Cleanup(func() { sim.Close() })
+	// device_address, baud_rate and comm_format must agree with the driver's
+	// settings or readAndUpdateStatus retargets the handler.
+	sim.SetRegisters(0, 1, 9600, 0)
+	path, err := sim.ListenRTU()
+	if err != nil {
+		t.Fatalf("ListenRTU: %v", err)
+	}
+
+	cfg := Config{
+		HTTPHost: "127.0.0.1", HTTPPort: 0,
+		SerialPort: path, SlaveId: 1, BaudRate: 9600, DataBits: 8, Parity: "N", StopBits: 1,
+		ModbusTimeout:  200 * time.Millisecond,
+		PollInterval:   50 * time.Millisecond,
+		BackoffInitial: 20 * time.Millisecond,
+		BackoffMax:     100 * time.Millisecond,
+
+		RegDeviceAddress: 0, RegBaudRate: 1, RegCommFormat: 2, RegWorkMode: 3, RegValueType: 4,
+		RegDecimals: 5, RegDpMask: 6, RegBlinkMask: 7, RegBlinkPeriodMs: 8,
+		RegDisplayValueStart: testRegDisplay, DisplayValueRegs: testRegsDisplay,
+		DisplayAlign: "left", DisplayPad: ' ',
+
+		BlinkMode:        "hardware",
+		ClockLocation:    time.UTC,
+		SpoolMaxEvents:   100,
+		WatchdogInterval: time.Second,
+		WatchdogStall:    time.Minute,
+		CommandQueueSize: 10,
+		CommandRetention: time.Minute,
+	}
+	for _, o := range opts {
+		o(&cfg)
+	}
+	d, err := NewModbusDriver(cfg)
+	if err != nil {
+		t.Fatalf("NewModbusDriver: %v", err)
+	}
+	d.logger = log.New(d.logs, "", 0) // keep test output quiet, but feed /logs/stream
+	if d.alarms, err = LoadAlarmEngine("", d.notifier, d.logger); err != nil {
+		t.Fatalf("LoadAlarmEngine: %v", err)
+	}
+	d.alarms.mapping = d.mapping
+	if err := d.loadAlarmRuleStore(); err != nil {
+		t.Fatalf("loadAlarmRuleStore: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.pollLoop(ctx)
+	}()
+	if d.blinker != nil {
+		go d.softBlinkLoop(ctx)
+	}
+	if d.batcher != nil {
+		go d.displayWriteLoop(ctx)
+	}
+	if len(cfg.ValueRotate) > 0 {
+		go d.valueRotateLoop(ctx)
+	}
+	go d.commandLoop(ctx)
+	srv := httptest.NewServer(d.routes())
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+		<-done
+		d.closeConn()
+		d.notifier.Close()
+	})
+	return d, sim, srv
+}
+
+func getStatus(t *testing.T, srv *httptest.Server) DeviceStatus {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/status")
+	if err != nil {
+		t.Fatalf("GET /status: %v", err)
+	}
+	defer resp.Body.Close()
+	var st DeviceStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatalf("decode /status: %v", err)
+	}
+	return st
+}
+
+func waitDisplay(t *testing.T, srv *httptest.Server, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	var got string
+	for time.Now().Before(deadline) {
+		if got = getStatus(t, srv).DisplayValue; got == want {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("display_value = %q, want %q", got, want)
+}
+
+func putJSON(t *testing.T, url, body string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
+
+func TestStatusPolling(t *testing.T) {
+	_, sim, srv := startTestDriver(t)
+	sim.SetASCII(testRegDisplay, "HELO", testRegsDisplay)
+	waitDisplay(t, srv, "HELO")
+
+	sim.SetRegisters(5, 2) // decimals
+	sim.SetASCII(testRegDisplay, "12.5", testRegsDisplay)
+	waitDisplay(t, srv, "12.5")
+	if st := getStatus(t, srv); st.Decimals != 2 || st.DeviceAddress != 1 || st.CommFormat != "8N1" {
+		t.Fatalf("status = %+v", st)
+	}
+}
+
+func TestPutDisplayValue(t *testing.T) {
+	_, sim, srv := startTestDriver(t)
+	waitDisplay(t, srv, "")
+
+	code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"1234"}`)
+	if code != http.StatusOK {
+		t.Fatalf("PUT /display/value = %d %s", code, body)
+	}
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); got != "1234    " {
+		t.Fatalf("display registers = %q", got)
+	}
+	if code, _ := putJSON(t, srv.URL+"/display/value", `{"display_value":""}`); code != http.StatusBadRequest {
+		t.Fatalf("empty value: status %d, want 400", code)
+	}
+}
+
+func TestReconnectAfterDropAndGarbage(t *testing.T) {
+	_, sim, srv := startTestDriver(t)
+	sim.SetASCII(testRegDisplay, "UP", testRegsDisplay)
+	waitDisplay(t, srv, "UP")
+
+	sim.Script(
+		modbustest.Fault{Drop: true},
+		modbustest.Fault{Garbage: true},
+		modbustest.Fault{Drop: true},
+		modbustest.Fault{Garbage: true},
+	)
+	sim.SetASCII(testRegDisplay, "BACK", testRegsDisplay)
+	waitDisplay(t, srv, "BACK")
+
+	code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"OK"}`)
+	if code != http.StatusOK {
+		t.Fatalf("write after reconnect = %d %s", code, body)
+	}
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); got != "OK      " {
+		t.Fatalf("display registers = %q", got)
+	}
+}
+
+func TestExceptionHandling(t *testing.T) {
+	_, sim, srv := startTestDriver(t)
+	sim.SetASCII(testRegDisplay, "KEEP", testRegsDisplay)
+	waitDisplay(t, srv, "KEEP")
+
+	sim.OnRequest(func(r modbustest.Request) *modbustest.Fault {
+		if r.Function == 0x10 {
+			return &modbustest.Fault{Exception: modbustest.ExceptionSlaveDeviceFailure}
+		}
+		return nil
+	})
+	code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"LOST"}`)
+	if code != http.StatusInternalServerError || body != "device write error" {
+		t.Fatalf("PUT with exception = %d %q", code, body)
+	}
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); got != "KEEP    " {
+		t.Fatalf("display registers changed to %q", got)
+	}
+
+	// Read exceptions make the poller back off; status recovers once they stop.
+	sim.OnRequest(func(r modbustest.Request) *modbustest.Fault {
+		if r.Function == 0x03 {
+			return &modbustest.Fault{Exception: modbustest.ExceptionSlaveDeviceBusy}
+		}
+		return nil
+	})
+	resp, err := http.Get(srv.URL + "/registers/16?count=4")
+	if err != nil {
+		t.Fatalf("GET /registers: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("GET /registers with exception = %d, want 500", resp.StatusCode)
+	}
+	sim.OnRequest(nil)
+	sim.SetASCII(testRegDisplay, "FINE", testRegsDisplay)
+	waitDisplay(t, srv, "FINE")
+}
+
+func TestSoftBlinkNeverRestoresReplacedValue(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) {
+		c.BlinkMode = "software"
+		c.SoftBlinkPeriod = 40 * time.Millisecond
+		c.SoftBlinkMask = 0x1
+	})
+	sim.SetASCII(testRegDisplay, "OLD", testRegsDisplay)
+	waitDisplay(t, srv, "OLD")
+
+	for i := 0; i < 20; i++ {
+		val := []string{"AAAA", "BBBB"}[i%2]
+		if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"`+val+`"}`); code != http.StatusOK {
+			t.Fatalf("PUT = %d %s", code, body)
+		}
+		// Whatever phase the blinker is in, only the new value may show.
+		deadline := time.Now().Add(60 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			if got := sim.ASCII(testRegDisplay, testRegsDisplay); got != val+"    " && got != " "+val[1:]+"    " {
+				t.Fatalf("after PUT %q display shows %q", val, got)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestDevicesValueStatus(t *testing.T) {
+	_, sim, srv := startTestDriver(t) // only slave 1 answers
+	waitDisplay(t, srv, "")
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"values":{"1":"ONE"}}`, http.StatusOK},
+		{`{"values":{"1":"ONE","2":"TWO"}}`, http.StatusMultiStatus},
+		{`{"display_value":"X","slave_ids":[2,3]}`, http.StatusBadGateway},
+		{`{"values":{"1":"ONE"},"slave_ids":[2]}`, http.StatusBadRequest},
+		{`{"values":{"1":"ONE"},"display_value":"X"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code, body := putJSON(t, srv.URL+"/devices/value", tt.body); code != tt.want {
+			t.Errorf("%s: status %d (%s), want %d", tt.body, code, body, tt.want)
+		}
+	}
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); got != "ONE     " {
+		t.Fatalf("display registers = %q", got)
+	}
+}
+
+func TestReadOnlyPausesSoftBlink(t *testing.T) {
+	d, sim, srv := startTestDriver(t, func(c *Config) {
+		c.BlinkMode = "software"
+		c.SoftBlinkPeriod = 40 * time.Millisecond
+		c.SoftBlinkMask = 0xF
+		c.AdminToken = "s3cret"
+	})
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"WXYZ"}`); code != http.StatusOK {
+		t.Fatalf("PUT = %d %s", code, body)
+	}
+
+	post := func(token string) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/admin/readonly", strings.NewReader(`{"read_only":true}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /admin/readonly: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(""); code != http.StatusUnauthorized {
+		t.Fatalf("POST without token = %d, want 401", code)
+	}
+	if code := post("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("POST with wrong token = %d, want 401", code)
+	}
+	time.Sleep(30 * time.Millisecond) // likely mid-blink
+	if code := post("s3cret"); code != http.StatusOK {
+		t.Fatalf("POST with token = %d, want 200", code)
+	}
+	if !d.readOnly.Load() {
+		t.Fatal("read-only mode not enabled")
+	}
+	for i := 0; i < 10; i++ {
+		if got := sim.ASCII(testRegDisplay, testRegsDisplay); got != "WXYZ    " {
+			t.Fatalf("display during read-only = %q, want the full value", got)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestRegisterCountLimits(t *testing.T) {
+	_, _, srv := startTestDriver(t)
+	waitDisplay(t, srv, "")
+
+	for count, want := range map[int]int{125: http.StatusOK, 126: http.StatusBadRequest} {
+		resp, err := http.Get(srv.URL + "/registers/0?count=" + strconv.Itoa(count))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("read %d registers: status %d, want %d", count, resp.StatusCode, want)
+		}
+	}
+	for count, want := range map[int]int{123: http.StatusOK, 124: http.StatusBadRequest} {
+		vals := strings.TrimSuffix(strings.Repeat("0,", count), ",")
+		if code, body := putJSON(t, srv.URL+"/registers/200", `{"values":[`+vals+`]}`); code != want {
+			t.Errorf("write %d registers: status %d (%s), want %d", count, code, body, want)
+		}
+	}
+}
+
+func TestDisplayValueRaw(t *testing.T) {
+	_, sim, srv := startTestDriver(t)
+	waitDisplay(t, srv, "")
+
+	code, body := putJSON(t, srv.URL+"/display/value/raw", `{"hex":"3F06 5B4F 6600 7F6F"}`)
+	if code != http.StatusOK {
+		t.Fatalf("PUT hex = %d %s", code, body)
+	}
+	if got := sim.Registers(testRegDisplay, testRegsDisplay); !reflect.DeepEqual(got, []uint16{0x3F06, 0x5B4F, 0x6600, 0x7F6F}) {
+		t.Fatalf("registers after hex = %04x", got)
+	}
+	if code, body := putJSON(t, srv.URL+"/display/value/raw", `{"words":[1,2,3,4]}`); code != http.StatusOK {
+		t.Fatalf("PUT words = %d %s", code, body)
+	}
+
+	resp, err := http.Get(srv.URL + "/display/value/raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got displayRawResp
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := displayRawResp{Digits: 8, Hex: "0001000200030004", Words: []uint16{1, 2, 3, 4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("GET = %+v, want %+v", got, want)
+	}
+
+	for _, bad := range []string{
+		`{"hex":"3F06"}`,
+		`{"hex":"3F065B4F66007F6F00"}`,
+		`{"hex":"3G065B4F66007F6F"}`,
+		`{"words":[1,2,3]}`,
+		`{"hex":"3F065B4F66007F6F","words":[1,2,3,4]}`,
+		`{}`,
+	} {
+		if code, _ := putJSON(t, srv.URL+"/display/value/raw", bad); code != http.StatusBadRequest {
+			t.Errorf("PUT %s: status %d, want 400", bad, code)
+		}
+	}
+}
+
+func TestDesiredValueRestoredAfterPowerCycle(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "desired.json")
+	withFile := func(c *Config) { c.DesiredValueFile = file }
+	waitRegs := func(sim *modbustest.Server, want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		var got string
+		for time.Now().Before(deadline) {
+			if got = sim.ASCII(testRegDisplay, testRegsDisplay); got == want {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		t.Fatalf("display registers = %q, want %q", got, want)
+	}
+
+	_, sim, srv := startTestDriver(t, withFile)
+	waitDisplay(t, srv, "")
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"1234"}`); code != http.StatusOK {
+		t.Fatalf("PUT = %d %s", code, body)
+	}
+	waitDisplay(t, srv, "1234")
+
+	// The device reboots to its blank default between two polls.
+	sim.SetASCII(testRegDisplay, "", testRegsDisplay)
+	waitRegs(sim, "1234    ")
+
+	// A transient value is not persisted and forgets the old one.
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"TEMP","persist":false}`); code != http.StatusOK {
+		t.Fatalf("PUT persist=false = %d %s", code, body)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("desired value file after persist=false: %v", err)
+	}
+	sim.SetASCII(testRegDisplay, "", testRegsDisplay)
+	time.Sleep(200 * time.Millisecond)
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); strings.TrimSpace(got) != "" {
+		t.Fatalf("display registers = %q, want them left blank", got)
+	}
+
+	// A driver started with a persisted value restores it on its first poll.
+	if err := os.WriteFile(file, []byte(`{"display_value":"ABCD"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, sim2, _ := startTestDriver(t, withFile)
+	waitRegs(sim2, "ABCD    ")
+}
+
+func TestValueStaleFallback(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "desired.json")
+	hooks := make(chan string, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev AlarmEvent
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		hooks <- ev.Event
+	}))
+	defer hook.Close()
+	d, sim, srv := startTestDriver(t, func(c *Config) {
+		c.DesiredValueFile = file
+		c.ValueStaleAfter, c.ValueStaleText = 400*time.Millisecond, "NO DATA"
+	})
+	if _, err := d.alarms.SetRules("when value_stale == true -> webhook " + hook.URL); err != nil {
+		t.Fatal(err)
+	}
+	health := func() map[string]interface{} {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var h map[string]interface{}
+		_ = json.NewDecoder(resp.Body).Decode(&h)
+		return h
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-hooks:
+			if got != want {
+				t.Fatalf("alarm %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s alarm", want)
+		}
+	}
+
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"1234"}`); code != http.StatusOK {
+		t.Fatalf("PUT = %d %s", code, body)
+	}
+	waitDisplay(t, srv, "1234")
+	if h := health(); h["status"] != "ok" || h["serial_port"].(map[string]interface{})["ok"] != true {
+		t.Fatalf("healthz while fresh = %v", h)
+	}
+
+	// The writes stop: the fallback replaces the value, and the persisted
+	// value is not put back over it.
+	waitDisplay(t, srv, "NO DATA")
+	expect("raised")
+	time.Sleep(200 * time.Millisecond)
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); got != "NO DATA " {
+		t.Fatalf("display registers = %q", got)
+	}
+	if h := health(); h["status"] != "degraded" || h["display_value"].(map[string]interface{})["showing_fallback"] != true {
+		t.Fatalf("healthz while stale = %v", h)
+	}
+
+	// Writes resume.
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"5678"}`); code != http.StatusOK {
+		t.Fatalf("PUT = %d %s", code, body)
+	}
+	expect("cleared")
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); got != "5678    " {
+		t.Fatalf("display registers = %q", got)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	_, _, bare := startTestDriver(t)
+	if resp, err := http.Get(bare.URL + "/info"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET /info without identity registers: %v %v", resp, err)
+	}
+
+	_, sim, srv := startTestDriver(t, func(c *Config) {
+		c.IdentityRegs = []identityReg{{"vendor_id", 64}, {"product_code", 65}, {"firmware_version", 66}}
+		c.FirmwareFormat = "hundredths"
+	})
+	sim.SetRegisters(64, 0x1234, 17, 123)
+	resp, err := http.Get(srv.URL + "/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"slave_id": 1.0, "vendor_id": 4660.0, "product_code": 17.0, "firmware_version": "1.23", "firmware_raw": 123.0}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("GET /info = %v, want %v", got, want)
+	}
+}
+
+func TestFirmwareUpload(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) {
+		c.AdminToken = "s3cret"
+		c.FirmwareFileNumber = 2
+		c.FirmwareChunkRegs = 8
+		c.FirmwareMaxBytes = 1024
+	})
+	waitDisplay(t, srv, "")
+	post := func(token, accept string, image []byte) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/firmware", bytes.NewReader(image))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /firmware: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	image := make([]byte, 41)
+	for i := range image {
+		image[i] = byte(i)
+	}
+	if code, _ := post("", "", image); code != http.StatusUnauthorized {
+		t.Fatalf("without token: %d, want 401", code)
+	}
+	if code, _ := post("s3cret", "", make([]byte, 1025)); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized image: %d, want 413", code)
+	}
+
+	code, body := post("s3cret", "text/event-stream", image)
+	if code != http.StatusOK {
+		t.Fatalf("POST /firmware = %d %s", code, body)
+	}
+	// 21 registers in chunks of 8: three writes, three reads.
+	if n := strings.Count(body, "event: progress"); n != 6 || !strings.Contains(body, `"phase":"verify","done":42,"total":42`) {
+		t.Fatalf("progress events:\n%s", body)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(body), `data: {"bytes":41,"chunks":3,"ok":true}`) {
+		t.Fatalf("stream does not end with done:\n%s", body)
+	}
+	recs := sim.FileRecords(2, 0, 21)
+	if recs[0] != 0x0001 || recs[19] != 0x2627 || recs[20] != 0x28FF {
+		t.Fatalf("file records = %04x", recs)
+	}
+	// Polling resumes on the shared client afterwards.
+	sim.SetASCII(testRegDisplay, "DONE", testRegsDisplay)
+	waitDisplay(t, srv, "DONE")
+
+	sim.OnRequest(func(r modbustest.Request) *modbustest.Fault {
+		if r.Function == 0x15 {
+			return &modbustest.Fault{Exception: modbustest.ExceptionSlaveDeviceBusy}
+		}
+		return nil
+	})
+	code, body = post("s3cret", "", image)
+	if code != http.StatusInternalServerError || !strings.Contains(body, "file 2 record 0") {
+		t.Fatalf("upload with a busy device = %d %s", code, body)
+	}
+}
+
+func TestStatusStreamFieldFilter(t *testing.T) {
+	_, sim, srv := startTestDriver(t)
+	waitDisplay(t, srv, "")
+
+	if resp, err := http.Get(srv.URL + "/status/stream?fields=display_value,nope"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown field: %v %v", resp, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/status/stream?fields=display_value", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := make(chan string, 10)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+				events <- data
+			}
+		}
+		close(events)
+	}()
+	next := func() string {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(3 * time.Second):
+			t.Fatal("no status event")
+		}
+		return ""
+	}
+
+	if got := next(); got != `{"display_value":""}` {
+		t.Fatalf("initial event = %s", got)
+	}
+	sim.SetRegisters(5, 3) // decimals: filtered out
+	time.Sleep(200 * time.Millisecond)
+	sim.SetASCII(testRegDisplay, "42", testRegsDisplay)
+	if got := next(); got != `{"display_value":"42"}` {
+		t.Fatalf("event after display change = %s", got)
+	}
+}
+
+func TestDisplayWriteBehind(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) { c.DisplayWriteInterval = 300 * time.Millisecond })
+	waitDisplay(t, srv, "")
+	displayWrites := func() int {
+		n := 0
+		for _, r := range sim.Requests() {
+			if r.Function == 0x10 && r.Address == testRegDisplay {
+				n++
+			}
+		}
+		return n
+	}
+
+	for i := 0; i < 10; i++ {
+		code, body := putJSON(t, srv.URL+"/display/value", fmt.Sprintf(`{"display_value":"%d"}`, i))
+		if code != http.StatusAccepted {
+			t.Fatalf("PUT %d = %d %s", i, code, body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitDisplay(t, srv, "9")
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); got != "9       " {
+		t.Fatalf("display registers = %q", got)
+	}
+	// The first value goes out at once, the rest within one interval: the
+	// latest one plus at most one in between.
+	if n := displayWrites(); n < 2 || n > 3 {
+		t.Fatalf("%d display writes for 10 PUTs within one interval", n)
+	}
+	if code, _ := putJSON(t, srv.URL+"/display/value", `{"display_value":""}`); code != http.StatusBadRequest {
+		t.Fatalf("empty value: status %d, want 400", code)
+	}
+}
+
+func TestValueRotation(t *testing.T) {
+	_, _, srv := startTestDriver(t, func(c *Config) {
+		c.ValueSmoothing = 3
+		c.ValueRotate, _ = parseValueRotate("current,max:P")
+		c.ValueRotateInterval, c.ValueAggregateWindow = 200*time.Millisecond, time.Minute
+	})
+	for _, v := range []string{"10", "20", "8"} {
+		if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"`+v+`"}`); code != http.StatusOK {
+			t.Fatalf("PUT %s = %d %s", v, code, body)
+		}
+	}
+	// 10, then 15, then 11.5 rounded to the decimals sent.
+	waitDisplay(t, srv, "P15")
+	waitDisplay(t, srv, "12")
+
+	resp, err := http.Get(srv.URL + "/display/value/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var stats map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil || stats["samples"] != 3.0 || stats["max"] != 15.0 || stats["min"] != 10.0 {
+		t.Fatalf("GET /display/value/stats = %v %v", stats, err)
+	}
+
+	// Text is shown as sent and stops the rotation.
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"OPEN"}`); code != http.StatusOK {
+		t.Fatalf("PUT OPEN = %d %s", code, body)
+	}
+	waitDisplay(t, srv, "OPEN")
+	time.Sleep(500 * time.Millisecond)
+	if got := getStatus(t, srv).DisplayValue; got != "OPEN" {
+		t.Fatalf("display rotated to %q after a text", got)
+	}
+}
+
+func TestHTTPBasePath(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) { c.HTTPBasePath = "/drivers/display-7" })
+	sim.SetASCII(testRegDisplay, "BASE", testRegsDisplay)
+	for path, want := range map[string]int{
+		"/drivers/display-7/status":         http.StatusOK,
+		"/drivers/display-7/registers/0x10": http.StatusOK,
+		"/status":                           http.StatusNotFound,
+		"/drivers/display-7x/status":        http.StatusNotFound,
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+	if code, body := putJSON(t, srv.URL+"/drivers/display-7/display/value", `{"display_value":"7"}`); code != http.StatusOK {
+		t.Fatalf("PUT under base path = %d %s", code, body)
+	}
+}
+
+func TestSettingsGet(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) { c.PollInterval = time.Hour })
+	// Only the first poll runs within the test.
+	deadline := time.Now().Add(5 * time.Second)
+	for getStatus(t, srv).BaudRate != 9600 {
+		if time.Now().After(deadline) {
+			t.Fatal("no poll completed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s = %d %s", path, resp.StatusCode, b)
+		}
+		return strings.TrimSpace(string(b))
+	}
+	if got, want := get("/comm/config"), `{"device_address":1,"baud_rate":9600,"comm_format":"8N1"}`; got != want {
+		t.Errorf("GET /comm/config = %s, want %s", got, want)
+	}
+
+	// Changed behind the driver's back: cached until refreshed.
+	sim.SetRegisters(3, 2, 1, 2) // work_mode, value_type, decimals
+	sim.SetRegisters(8, 400)
+	sim.SetASCII(testRegDisplay, "12.5", testRegsDisplay)
+	for path, want := range map[string]string{
+		"/display/config": `{"value_type":0,"decimals":0,"work_mode":0}`,
+		"/blink/period":   `{"blink_period_ms":0}`,
+		"/display/value":  `{"display_value":""}`,
+	} {
+		if got := get(path); got != want {
+			t.Errorf("GET %s = %s, want %s", path, got, want)
+		}
+	}
+	for path, want := range map[string]string{
+		"/display/config?refresh=true": `{"value_type":1,"decimals":2,"work_mode":2}`,
+		"/blink/period?refresh=1":      `{"blink_period_ms":400}`,
+		"/display/value?refresh=true":  `{"display_value":"12.5"}`,
+	} {
+		if got := get(path); got != want {
+			t.Errorf("GET %s = %s, want %s", path, got, want)
+		}
+	}
+	if st := getStatus(t, srv); st.Decimals != 2 || st.BlinkPeriodMs != 400 || st.DisplayValue != "12.5" {
+		t.Errorf("refresh did not update the status cache: %+v", st)
+	}
+
+	resp, err := http.Get(srv.URL + "/comm/config?refresh=maybe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("refresh=maybe: %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestSettingsIfMatch(t *testing.T) {
+	_, _, srv := startTestDriver(t, func(c *Config) { c.PollInterval = time.Hour })
+	put := func(ifMatch, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/display/config", strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("ETag")
+	}
+	resp, err := http.Get(srv.URL + "/display/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	read := resp.Header.Get("ETag")
+	if read == "" {
+		t.Fatal("GET /display/config has no ETag")
+	}
+
+	// Operator A writes with the tag both operators read.
+	code, tagA := put(read, `{"decimals":2}`)
+	if code != http.StatusOK || tagA == "" || tagA == read {
+		t.Fatalf("first write: %d, ETag %q (read %q)", code, tagA, read)
+	}
+	// Operator B still holds the old tag.
+	if code, cur := put(read, `{"decimals":1}`); code != http.StatusPreconditionFailed || cur != tagA {
+		t.Errorf("stale write: %d, ETag %q, want 412 with %q", code, cur, tagA)
+	}
+	if code, _ := put(`"other", `+tagA, `{"work_mode":1}`); code != http.StatusOK {
+		t.Errorf("write matching one of several tags: %d", code)
+	}
+	if code, _ := put("*", `{"work_mode":2}`); code != http.StatusOK {
+		t.Errorf("If-Match *: %d", code)
+	}
+	if code, _ := put("", `{"work_mode":3}`); code != http.StatusOK {
+		t.Errorf("unconditional write: %d", code)
+	}
+}
+
+func TestSerialSettings(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) { c.AdminToken = "s3cret" })
+	put := func(token, body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/serial", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PUT /serial: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	get := func() serialReq {
+		resp, err := http.Get(srv.URL + "/serial")
+		if err != nil {
+			t.Fatalf("GET /serial: %v", err)
+		}
+		defer resp.Body.Close()
+		var v serialReq
+		if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	port := *get().Port
+
+	if code, _ := put("", `{"baud_rate":19200}`); code != http.StatusUnauthorized {
+		t.Errorf("PUT without token = %d, want 401", code)
+	}
+	if code, body := put("s3cret", `{"parity":"X"}`); code != http.StatusBadRequest {
+		t.Errorf("PUT parity X = %d %s, want 400", code, body)
+	}
+	if code, body := put("s3cret", `{"port":"/nonexistent/tty"}`); code != http.StatusBadRequest || !strings.Contains(body, "/nonexistent/tty") {
+		t.Errorf("PUT bad port = %d %s, want 400", code, body)
+	}
+	if got := *get().Port; got != port {
+		t.Fatalf("port after failed PUT = %s, want %s", got, port)
+	}
+	if code, body := put("s3cret", `{"rs485":{"delay_rts_before_send_ms":5,"rts_high_during_send":true}}`); code != http.StatusOK {
+		t.Fatalf("PUT rs485 = %d %s", code, body)
+	}
+	v := get()
+	if *v.RS485.DelayRtsBeforeSendMs != 5 || !*v.RS485.RtsHighDuringSend || *v.RS485.Enabled || *v.Port != port {
+		t.Errorf("after PUT: %+v %+v", v, *v.RS485)
+	}
+	// The link still works after the reopen.
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"OK"}`); code != http.StatusOK {
+		t.Fatalf("PUT /display/value after reopen = %d %s", code, body)
+	}
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); !strings.HasPrefix(got, "OK") {
+		t.Errorf("display = %q after reopen", got)
+	}
+}
+
+func TestConfigSyncSerialReload(t *testing.T) {
+	d, sim, srv := startTestDriver(t)
+	cfg := map[string]configValue{"SERIAL_PORT": "/nonexistent/tty", "RS485_DELAY_RTS_AFTER_SEND_MS": "3"}
+	req, _, err := serialReqFor([]string{"SERIAL_PORT"}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.applySyncedSerial(req); err == nil || !strings.Contains(err.Error(), "/nonexistent/tty") {
+		t.Fatalf("bad port: err %v", err)
+	}
+	if req, _, err = serialReqFor([]string{"RS485_DELAY_RTS_AFTER_SEND_MS"}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.applySyncedSerial(req); err != nil {
+		t.Fatal(err)
+	}
+	d.mbusMu.Lock()
+	delay, port := d.cfg.RS485.DelayRtsAfterSend, d.cfg.SerialPort
+	d.mbusMu.Unlock()
+	if delay != 3*time.Millisecond || port == "/nonexistent/tty" {
+		t.Errorf("link after reload: %s, rts delay %v", port, delay)
+	}
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"OK"}`); code != http.StatusOK {
+		t.Fatalf("PUT /display/value after reload = %d %s", code, body)
+	}
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); !strings.HasPrefix(got, "OK") {
+		t.Errorf("display = %q after reload", got)
+	}
+}
+
+func TestAdminReconnect(t *testing.T) {
+	d, sim, srv := startTestDriver(t, func(c *Config) { c.AdminToken = "s3cret" })
+	waitDisplay(t, srv, "")
+	post := func(token, query string) (int, reconnectResult) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/admin/reconnect"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /admin/reconnect: %v", err)
+		}
+		defer resp.Body.Close()
+		var res reconnectResult
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		return resp.StatusCode, res
+	}
+
+	if code, _ := post("", ""); code != http.StatusUnauthorized {
+		t.Errorf("without token = %d, want 401", code)
+	}
+	if code, _ := post("s3cret", "?dry_run=true"); code != http.StatusOK || d.linkResets.Load() != 0 {
+		t.Errorf("dry run = %d, %d resets", code, d.linkResets.Load())
+	}
+
+	// A display that stopped answering: the port reopens, the check fails.
+	sim.OnRequest(func(modbustest.Request) *modbustest.Fault { return &modbustest.Fault{Drop: true} })
+	if code, res := post("s3cret", ""); code != http.StatusBadGateway || !res.PortOpen || res.DeviceAnswered || res.Error == "" {
+		t.Errorf("silent display = %d %+v", code, res)
+	}
+	sim.OnRequest(nil)
+	code, res := post("s3cret", "")
+	if code != http.StatusOK || !res.OK || !res.DeviceAnswered || res.Port == "" {
+		t.Errorf("reconnect = %d %+v", code, res)
+	}
+	if d.linkResets.Load() != 2 {
+		t.Errorf("%d link resets counted, want 2", d.linkResets.Load())
+	}
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"UP"}`); code != http.StatusOK {
+		t.Fatalf("PUT after reconnect = %d %s", code, body)
+	}
+	waitDisplay(t, srv, "UP")
+}
+
+func TestAlarmRulesAPI(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "alarm_rules.json")
+	d, _, srv := startTestDriver(t, func(c *Config) { c.AdminToken = "s3cret"; c.AlarmRulesStore = store })
+	do := func(method, path, body string, hdr ...string) (int, http.Header, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header, strings.TrimSpace(string(b))
+	}
+
+	if code, _, body := do(http.MethodPost, "/alarms/rules", `{"id":"hot","rule":"when decimals > 2 -> sms 555"}`); code != http.StatusBadRequest || !strings.Contains(body, `rule "hot"`) {
+		t.Errorf("invalid rule = %d %s", code, body)
+	}
+	code, hdr, body := do(http.MethodPost, "/alarms/rules", `{"id":"hot","rule":"when decimals  > 2 -> webhook http://x"}`)
+	if code != http.StatusCreated || hdr.Get("Location") != "/alarms/rules/hot" || hdr.Get("ETag") != `"alarm-rules-1"` {
+		t.Fatalf("POST = %d %v %s", code, hdr, body)
+	}
+	if code, _, _ := do(http.MethodPost, "/alarms/rules", `{"id":"hot","rule":"when decimals > 3 -> webhook http://x"}`); code != http.StatusConflict {
+		t.Errorf("POST of an existing id = %d, want 409", code)
+	}
+
+	// A dry run reports the overlap and changes nothing.
+	code, _, body = do(http.MethodPut, "/alarms/rules/hotter?dry_run=true", `{"rule":"when decimals >= 3 -> webhook http://x"}`)
+	var res alarmRulesResult
+	_ = json.Unmarshal([]byte(body), &res)
+	if code != http.StatusOK || !res.DryRun || res.Revision != 2 || len(res.Conflicts) != 1 || res.Conflicts[0].Kind != "overlap" {
+		t.Errorf("dry run = %d %s", code, body)
+	}
+	if n := len(d.alarms.States()); n != 1 {
+		t.Errorf("dry run left %d rules in the engine, want 1", n)
+	}
+
+	if code, _, body := do(http.MethodPut, "/alarms/rules/cold", `{"rule":"when decimals < 1 -> webhook http://x"}`, "If-Match", `"alarm-rules-0"`); code != http.StatusPreconditionFailed {
+		t.Errorf("stale If-Match = %d %s", code, body)
+	}
+	if code, _, body := do(http.MethodPut, "/alarms/rules/cold", `{"rule":"when decimals < 1 -> webhook http://x","enabled":false}`, "If-Match", `"alarm-rules-1"`); code != http.StatusOK {
+		t.Fatalf("PUT = %d %s", code, body)
+	}
+	code, _, body = do(http.MethodGet, "/alarms/rules", "")
+	var doc alarmRuleDoc
+	if err := json.Unmarshal([]byte(body), &doc); err != nil || code != http.StatusOK {
+		t.Fatalf("GET = %d %s", code, body)
+	}
+	if doc.Schema != 1 || doc.Revision != 2 || len(doc.Rules) != 2 || doc.Rules[0].Rule != "when decimals > 2 -> webhook http://x" || doc.Rules[1].on() {
+		t.Errorf("export = %s", body)
+	}
+	if st := d.alarms.States(); len(st) != 1 || st[0].Rule != doc.Rules[0].Rule {
+		t.Errorf("engine has %+v, want only the enabled rule", st)
+	}
+
+	// Import the export with one rule removed; the store survives a restart.
+	doc.Rules = doc.Rules[1:]
+	b, _ := json.Marshal(doc)
+	if code, _, body := do(http.MethodPut, "/alarms/rules", string(b)); code != http.StatusOK {
+		t.Fatalf("import = %d %s", code, body)
+	}
+	if code, _, _ := do(http.MethodDelete, "/alarms/rules/hot", ""); code != http.StatusNotFound {
+		t.Errorf("DELETE of a removed rule = %d, want 404", code)
+	}
+	d2, _, _ := startTestDriver(t, func(c *Config) { c.AlarmRulesStore = store })
+	d2.alarmRules.mu.Lock()
+	got := d2.alarmRules.doc
+	d2.alarmRules.mu.Unlock()
+	if got.Revision != 3 || len(got.Rules) != 1 || got.Rules[0].ID != "cold" || !d2.alarmRules.fromStore() {
+		t.Errorf("after restart: %+v", got)
+	}
+	if err := d2.applySyncedAlarmRules("when decimals > 1 -> webhook http://x"); err == nil {
+		t.Error("config sync changed rules kept in the store")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) {
+		c.AdminToken = "admin"
+		c.AllowSlaveOverride = true
+		c.TenantKeys = map[string]string{"key-a": "line-a", "key-b": "line-b"}
+		c.DeviceTenants = map[int]string{1: "line-a", 2: "line-a", 7: "line-b"}
+	})
+	do := func(method, path, key, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	for _, tt := range []struct {
+		method, path, key, body string
+		want                    int
+	}{
+		{"GET", "/status", "", "", http.StatusUnauthorized},
+		{"GET", "/status", "wrong", "", http.StatusUnauthorized},
+		{"GET", "/status", "key-a", "", http.StatusOK},
+		{"GET", "/status", "key-b", "", http.StatusForbidden}, // SLAVE_ID 1 belongs to line-a
+		{"PUT", "/display/value", "key-b", `{"display_value":"B"}`, http.StatusForbidden},
+		{"GET", "/registers/0?slave_id=7", "key-a", "", http.StatusForbidden},
+		{"GET", "/registers/0?slave_id=1", "key-b", "", http.StatusForbidden},
+		{"GET", "/registers/0?slave_id=1", "key-a", "", http.StatusOK},
+		{"PUT", "/devices/value", "key-b", `{"values":{"7":"B","1":"B"}}`, http.StatusForbidden},
+		{"GET", "/metrics", "key-a", "", http.StatusForbidden},
+		{"GET", "/serial", "key-a", "", http.StatusForbidden},
+		{"GET", "/version", "key-b", "", http.StatusOK},
+		{"PUT", "/display/value", "key-a", `{"display_value":"A"}`, http.StatusOK},
+	} {
+		if code, body := do(tt.method, tt.path, tt.key, tt.body); code != tt.want {
+			t.Errorf("%s %s as %q: %d %s, want %d", tt.method, tt.path, tt.key, code, body, tt.want)
+		}
+	}
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); !strings.HasPrefix(got, "A ") {
+		t.Errorf("display = %q", got)
+	}
+
+	// The admin token sees every slave; a tenant only its own.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/metrics", nil)
+	req.Header.Set("Authorization", "Bearer admin")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics as admin: %v %v", err, resp)
+	} else {
+		resp.Body.Close()
+	}
+	for key, want := range map[string]string{
+		"key-a": `{"devices":[{"slave_id":1,"tenant":"line-a","default":true},{"slave_id":2,"tenant":"line-a"}]}`,
+		"key-b": `{"devices":[{"slave_id":7,"tenant":"line-b"}]}`,
+	} {
+		if code, body := do("GET", "/devices", key, ""); code != http.StatusOK || body != want {
+			t.Errorf("GET /devices as %s: %d %s, want %s", key, code, body, want)
+		}
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.addKey(t, "k1", false)
+	_, _, srv := startTestDriver(t, func(c *Config) {
+		c.DeviceTenants = map[int]string{1: "line-a", 7: "line-b"}
+		c.JWTJWKSURL, c.JWTIssuer, c.JWTAudience, c.JWTRolesClaim = idp.URL, "https://idp.example", "modbus-display", "roles"
+		c.JWTRoles = map[string]string{"display-admins": "admin", "line-a-ops": "line-a", "line-b-ops": "line-b"}
+		c.JWTJWKSRefresh = time.Hour
+	})
+	admin := idp.sign(t, "k1", nil)
+	lineA := idp.sign(t, "k1", map[string]interface{}{"roles": []string{"line-a-ops"}})
+	lineB := idp.sign(t, "k1", map[string]interface{}{"roles": []string{"line-b-ops"}})
+	for _, tt := range []struct {
+		method, path, token, body string
+		want                      int
+	}{
+		{"GET", "/status", "", "", http.StatusUnauthorized},
+		{"GET", "/status", idp.sign(t, "k1", map[string]interface{}{"aud": "other"}), "", http.StatusUnauthorized},
+		{"GET", "/status", idp.sign(t, "k1", map[string]interface{}{"roles": []string{"staff"}}), "", http.StatusForbidden},
+		{"GET", "/status", lineA, "", http.StatusOK},
+		{"GET", "/status", lineB, "", http.StatusForbidden},
+		{"GET", "/metrics", lineA, "", http.StatusForbidden},
+		{"GET", "/metrics", admin, "", http.StatusOK},
+		// ADMIN_TOKEN is unset, but the admin role may still change settings.
+		{"POST", "/admin/readonly", lineA, `{"read_only":false}`, http.StatusForbidden},
+		{"POST", "/admin/readonly", admin, `{"read_only":false}`, http.StatusOK},
+	} {
+		req, _ := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s: %d %s, want %d", tt.method, tt.path, resp.StatusCode, b, tt.want)
+		}
+	}
+}
+
+func TestRequestBodyLimits(t *testing.T) {
+	_, _, srv := startTestDriver(t, func(c *Config) { c.MaxRequestBody = 256 })
+	for _, tt := range []struct {
+		body     string
+		want     int
+		wantText string
+	}{
+		{`{"display_value":"OK"}`, http.StatusOK, ""},
+		{`{"display_valu":"OK"}`, http.StatusBadRequest, `unknown field "display_valu"`},
+		{`{"display_value":"OK"} {"display_value":"NO"}`, http.StatusBadRequest, "after the JSON value"},
+		{``, http.StatusBadRequest, "empty body"},
+		{`{"display_value":"` + strings.Repeat("8", 300) + `"}`, http.StatusRequestEntityTooLarge, "larger than 256 bytes"},
+	} {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/display/value", strings.NewReader(tt.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.want || !strings.Contains(string(b), tt.wantText) {
+			t.Errorf("%.40s: %d %s, want %d %q", tt.body, resp.StatusCode, b, tt.want, tt.wantText)
+		}
+	}
+}
+
+func TestLogStream(t *testing.T) {
+	d, _, srv := startTestDriver(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/logs/stream?level=warn&backlog=0", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	d.logger.Printf("mqtt connected to tcp://broker:1883")
+	d.logger.Printf("connect failed: gone; retry in 1s")
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line, ok := strings.CutPrefix(sc.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e logEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Level != "error" || e.Message != "connect failed: gone; retry in 1s" {
+			t.Errorf("first event %+v, want the connect failure (info filtered out)", e)
+		}
+		return
+	}
+	t.Fatalf("stream ended: %v", sc.Err())
+}
+
+func TestStatusAll(t *testing.T) {
+	_, _, srv := startTestDriver(t, func(c *Config) {
+		c.TenantKeys = map[string]string{"key-a": "line-a", "key-b": "line-b"}
+		c.DeviceTenants = map[int]string{1: "line-a", 2: "line-a", 7: "line-b"}
+	})
+	get := func(key string) (int, map[string]interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/status/all", nil)
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]interface{}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	// Slave 1 is the simulator; nothing answers as slave 2.
+	code, body := get("key-a")
+	for deadline := time.Now().Add(5 * time.Second); body["online"] != 1.0 && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		code, body = get("key-a")
+	}
+	devices, _ := body["devices"].([]interface{})
+	if code != http.StatusOK || len(devices) != 2 || body["online"] != 1.0 || body["total"] != 2.0 || body["status"] != "ok" {
+		t.Fatalf("GET /status/all as key-a = %d %v", code, body)
+	}
+	first, second := devices[0].(map[string]interface{}), devices[1].(map[string]interface{})
+	if st, _ := first["status"].(map[string]interface{}); first["slave_id"] != 1.0 || first["online"] != true || st["baud_rate"] != 9600.0 {
+		t.Errorf("slave 1: %v", first)
+	}
+	if second["slave_id"] != 2.0 || second["online"] != false || second["error"] == nil || second["status"] != nil {
+		t.Errorf("slave 2: %v", second)
+	}
+
+	code, body = get("key-b")
+	devices, _ = body["devices"].([]interface{})
+	if code != http.StatusOK || len(devices) != 1 || devices[0].(map[string]interface{})["slave_id"] != 7.0 {
+		t.Errorf("GET /status/all as key-b = %d %v", code, body)
+	}
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	_, _, srv := startTestDriver(t, func(c *Config) {
+		c.AdminToken = "s3cret"
+		c.DebugEndpoints = true
+	})
+	get := func(path, token string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	for _, path := range []string{"/debug/memstats", "/debug/goroutines", "/debug/pprof/", "/debug/pprof/mutex"} {
+		if code, _ := get(path, ""); code != http.StatusUnauthorized {
+			t.Errorf("GET %s without token = %d, want 401", path, code)
+		}
+		if code, _ := get(path, "wrong"); code != http.StatusUnauthorized {
+			t.Errorf("GET %s with a wrong token = %d, want 401", path, code)
+		}
+	}
+	code, body := get("/debug/memstats", "s3cret")
+	var m memStatsView
+	if err := json.Unmarshal([]byte(body), &m); code != http.StatusOK || err != nil || m.Goroutines == 0 || m.HeapAllocBytes == 0 {
+		t.Errorf("GET /debug/memstats = %d %s", code, body)
+	}
+	if code, body := get("/debug/goroutines", "s3cret"); code != http.StatusOK || !strings.Contains(body, "goroutine ") {
+		t.Errorf("GET /debug/goroutines = %d %.200s", code, body)
+	}
+	if code, body := get("/debug/pprof/", "s3cret"); code != http.StatusOK || !strings.Contains(body, "mutex") {
+		t.Errorf("GET /debug/pprof/ = %d %.200s", code, body)
+	}
+	if code, body := get("/debug/pprof/heap?debug=1", "s3cret"); code != http.StatusOK || !strings.Contains(body, "heap profile") {
+		t.Errorf("GET /debug/pprof/heap = %d %.200s", code, body)
+	}
+
+	// Off by default.
+	_, _, plain := startTestDriver(t, func(c *Config) { c.AdminToken = "s3cret" })
+	req, _ := http.NewRequest(http.MethodGet, plain.URL+"/debug/memstats", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /debug/memstats without DEBUG_ENDPOINTS: %v %v", err, resp)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestDisplayValueRules(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) {
+		c.DisplayRules = displayRules{MaxLength: 4, Classes: classDigit, Extra: "."}
+	})
+	waitDisplay(t, srv, "")
+	for body, want := range map[string]int{
+		`{"display_value":"12.5"}`:     http.StatusOK,
+		`{"display_value":"OPEN"}`:     http.StatusUnprocessableEntity,
+		`{"display_value":"1\u00002"}`: http.StatusUnprocessableEntity,
+		`{"display_value":"12345"}`:    http.StatusUnprocessableEntity,
+		`{"values":{"1":"9","2":"X"}}`: http.StatusUnprocessableEntity,
+	} {
+		path := "/display/value"
+		if strings.Contains(body, "values") {
+			path = "/devices/value"
+		}
+		if code, resp := putJSON(t, srv.URL+path, body); code != want {
+			t.Errorf("PUT %s %s = %d %s, want %d", path, body, code, resp, want)
+		}
+	}
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); !strings.HasPrefix(got, "12.5") {
+		t.Errorf("display = %q", got)
+	}
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(b), "modbus_display_value_rejected_total 4\n") {
+		t.Errorf("metrics:\n%s", b)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) {
+		c.TenantKeys = map[string]string{"key-a": "line-a", "key-b": "line-b"}
+		c.DeviceTenants = map[int]string{1: "line-a", 7: "line-b"}
+	})
+	do := func(method, path, key, body string) (int, command) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var c command
+		_ = json.NewDecoder(resp.Body).Decode(&c)
+		return resp.StatusCode, c
+	}
+	wait := func(id, key string) command {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			code, c := do("GET", "/commands/"+id, key, "")
+			if code != http.StatusOK {
+				t.Fatalf("GET /commands/%s: %d", id, code)
+			}
+			if c.Status == commandSucceeded || c.Status == commandFailed {
+				return c
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("command %s still %s", id, c.Status)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	code, c := do("POST", "/commands", "key-a", `{"path":"/display/value","body":{"display_value":"AS"}}`)
+	if code != http.StatusAccepted || c.ID == "" || c.Status != commandQueued {
+		t.Fatalf("POST /commands: %d %+v", code, c)
+	}
+	if done := wait(c.ID, "key-a"); done.Status != commandSucceeded || done.HTTPStatus != http.StatusOK || string(done.Result) != `{"ok":true}` {
+		t.Errorf("command: %+v", done)
+	}
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); !strings.HasPrefix(got, "AS") {
+		t.Errorf("display = %q", got)
+	}
+	if code, _ := do("GET", "/commands/"+c.ID, "key-b", ""); code != http.StatusNotFound {
+		t.Errorf("other tenant read command: %d", code)
+	}
+
+	// Authorization happens when the command runs: line-b doesn't own SLAVE_ID.
+	_, c = do("POST", "/commands", "key-b", `{"path":"/display/value","body":{"display_value":"B"}}`)
+	if done := wait(c.ID, "key-b"); done.Status != commandFailed || done.HTTPStatus != http.StatusForbidden || done.Error == "" {
+		t.Errorf("forbidden command: %+v", done)
+	}
+	if code, _ := do("POST", "/commands", "key-a", `{"path":"/status"}`); code != http.StatusBadRequest {
+		t.Errorf("command on a read route: %d", code)
+	}
+}
+
+func TestExternalChanges(t *testing.T) {
+	events := make(chan ExternalChangeEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev ExternalChangeEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err == nil {
+			events <- ev
+		}
+	}))
+	defer hook.Close()
+	_, sim, srv := startTestDriver(t, func(c *Config) {
+		c.ExternalChangeNotify = []notifyTarget{{Kind: "webhook", Target: hook.URL}}
+	})
+	waitDisplay(t, srv, "")
+
+	// The driver's own writes are not external changes.
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"12.5"}`); code != http.StatusOK {
+		t.Fatalf("PUT /display/value: %d %s", code, body)
+	}
+	waitDisplay(t, srv, "12.5")
+	time.Sleep(150 * time.Millisecond)
+	if st := getStatus(t, srv); st.ExternalChanges != nil {
+		t.Fatalf("own write marked as external: %+v", st.ExternalChanges)
+	}
+
+	sim.SetRegisters(5, 2) // decimals, as from a handheld programmer
+	select {
+	case ev := <-events:
+		if ev.Event != "external_change" || ev.Field != "decimals" || ev.From != 0.0 || ev.To != 2.0 || ev.SlaveId != 1 {
+			t.Errorf("event = %+v", ev)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no external_change event")
+	}
+	st := getStatus(t, srv)
+	if c, ok := st.ExternalChanges["decimals"]; !ok || c.From != 0.0 || c.To != 2.0 || len(st.ExternalChanges) != 1 {
+		t.Errorf("external_changes = %+v", st.ExternalChanges)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/status/external_changes", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE /status/external_changes: %v %v", err, resp)
+	}
+	resp.Body.Close()
+	if st := getStatus(t, srv); st.ExternalChanges != nil {
+		t.Errorf("external_changes after clear = %+v", st.ExternalChanges)
+	}
+}
+
+func TestStatusStreamDeadband(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) { c.StatusDeadband = deadbands{"display_value": 0.5} })
+	sim.SetASCII(testRegDisplay, "10.0", testRegsDisplay)
+	waitDisplay(t, srv, "10.0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := func(query string) <-chan string {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/status/stream?fields=display_value"+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		events := make(chan string, 10)
+		go func() {
+			sc := bufio.NewScanner(resp.Body)
+			for sc.Scan() {
+				if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+					events <- data
+				}
+			}
+			close(events)
+		}()
+		return events
+	}
+	next := func(events <-chan string) string {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(3 * time.Second):
+			t.Fatal("no status event")
+		}
+		return ""
+	}
+	filtered, raw := stream(""), stream("&raw=true")
+	for _, ch := range []<-chan string{filtered, raw} {
+		if got := next(ch); got != `{"display_value":"10.0"}` {
+			t.Fatalf("initial event = %s", got)
+		}
+	}
+
+	sim.SetASCII(testRegDisplay, "10.3", testRegsDisplay)
+	if got := next(raw); got != `{"display_value":"10.3"}` {
+		t.Fatalf("raw event = %s", got)
+	}
+	sim.SetASCII(testRegDisplay, "10.6", testRegsDisplay)
+	if got := next(filtered); got != `{"display_value":"10.6"}` {
+		t.Fatalf("event after leaving the dead-band = %s", got)
+	}
+	if got := getStatus(t, srv).DisplayValue; got != "10.6" {
+		t.Errorf("/status display_value = %q", got)
+	}
+}
+
+func TestSensors(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) {
+		c.SensorChannels, _ = parseSensorChannels("temp:0.1:0:°C;humidity:0.1::%;ai3;ai4", 40)
+		c.SensorSigned = true
+	})
+	sim.SetRegisters(40, 0xFFF6, 455, 7, 0) // -1.0 °C, 45.5 %
+	deadline := time.Now().Add(3 * time.Second)
+	var st DeviceStatus
+	for time.Now().Before(deadline) {
+		if st = getStatus(t, srv); st.Sensors["humidity"] == 45.5 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if st.Sensors["temp"] != -1 || st.Sensors["humidity"] != 45.5 || st.Sensors["ai3"] != 7 || len(st.Sensors) != 4 {
+		t.Fatalf("/status sensors = %v", st.Sensors)
+	}
+
+	resp, err := http.Get(srv.URL + "/sensors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var ev SensorEvent
+	if err := json.NewDecoder(resp.Body).Decode(&ev); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /sensors: %d %v", resp.StatusCode, err)
+	}
+	if len(ev.Channels) != 4 || ev.Channels[0] != (sensorReading{Name: "temp", Register: 40, Raw: -10, Value: -1, Unit: "°C"}) || ev.Channels[3].Register != 43 {
+		t.Errorf("channels = %+v", ev.Channels)
+	}
+}
+
+func TestSerialDiagnostics(t *testing.T) {
+	_, _, srv := startTestDriver(t)
+	// The simulated slave sits on a pseudo terminal, which keeps no line counters.
+	resp, err := http.Get(srv.URL + "/diagnostics/serial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("GET /diagnostics/serial on a pty = %d, want 501", resp.StatusCode)
+	}
+	if _, err := readSerialCounters("/nonexistent/tty"); err == nil || errors.Is(err, errNoLineCounters) {
+		t.Errorf("missing port: %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	d, sim, srv := startTestDriver(t)
+	waitDisplay(t, srv, "")
+	dry := func(method, path, body string) (int, []plannedOp) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Dry-Run", "true")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var reply struct {
+			DryRun     bool        `json:"dry_run"`
+			Operations []plannedOp `json:"operations"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err == nil && !reply.DryRun {
+			t.Errorf("%s %s: dry_run missing from reply", method, path)
+		}
+		return resp.StatusCode, reply.Operations
+	}
+
+	code, ops := dry("PUT", "/display/value", `{"display_value":"12.5"}`)
+	if code != http.StatusOK || len(ops) != 1 || ops[0].Function != 16 || *ops[0].Address != testRegDisplay ||
+		fmt.Sprint(ops[0].Values) != "[12594 11829 8224 8224]" {
+		t.Errorf("display value: %d %+v", code, ops)
+	}
+	code, ops = dry("PUT", "/comm/config", `{"baud_rate":19200,"device_address":3}`)
+	if code != http.StatusOK || len(ops) != 4 || ops[0].Function != 6 || *ops[0].Address != 1 || ops[0].Values[0] != 19200 ||
+		*ops[2].Address != 0 || ops[2].Values[0] != 3 || ops[3].Op != "update_link" {
+		t.Errorf("comm config: %d %+v", code, ops)
+	}
+	if code, _ := dry("PUT", "/comm/config", `{"baud_rate":19200,"device_address":300}`); code != http.StatusBadRequest {
+		t.Errorf("invalid comm config: %d", code)
+	}
+	code, ops = dry("PUT", "/registers/0x20", `{"values":[1,2]}`)
+	if code != http.StatusOK || len(ops) != 1 || ops[0].Op != "write_registers" || *ops[0].Address != 0x20 {
+		t.Errorf("registers: %d %+v", code, ops)
+	}
+	code, ops = dry("POST", "/commands", `{"path":"/blink/period","body":{"blink_period_ms":250}}`)
+	if code != http.StatusOK || len(ops) != 1 || *ops[0].Address != 8 || ops[0].Values[0] != 250 {
+		t.Errorf("command: %d %+v", code, ops)
+	}
+
+	// Read-only mode lets dry runs through.
+	d.SetReadOnly(true)
+	if code, ops := dry("PUT", "/display/config", `{"decimals":2}`); code != http.StatusOK || len(ops) != 1 || *ops[0].Address != 5 {
+		t.Errorf("display config while read-only: %d %+v", code, ops)
+	}
+	d.SetReadOnly(false)
+	if code, _ := putJSON(t, srv.URL+"/display/value?dry_run=maybe", `{"display_value":"1"}`); code != http.StatusBadRequest {
+		t.Errorf("dry_run=maybe: %d", code)
+	}
+	if code, body := putJSON(t, srv.URL+"/display/value?dry_run=1", `{"display_value":"1"}`); code != http.StatusOK || !strings.Contains(body, `"dry_run":true`) {
+		t.Errorf("dry_run=1: %d %s", code, body)
+	}
+
+	for _, req := range sim.Requests() {
+		if req.Function == 6 || req.Function == 16 || req.Function == 21 {
+			t.Fatalf("dry run wrote to the device: %+v", req)
+		}
+	}
+	if got := sim.Registers(0, 2); got[0] != 1 || got[1] != 9600 {
+		t.Errorf("device registers = %v", got)
+	}
+}
+
+func TestStatusXML(t *testing.T) {
+	_, sim, srv := startTestDriver(t, func(c *Config) {
+		c.SensorChannels, _ = parseSensorChannels("temp:0.1;humidity:0.1", 40)
+	})
+	sim.SetRegisters(40, 215, 455)
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value": "12.5"}`); code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", code, body)
+	}
+	waitDisplay(t, srv, "12.5")
+	for deadline := time.Now().Add(3 * time.Second); len(getStatus(t, srv).Sensors) == 0 && time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	get := func(path, accept string) (string, []byte) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.Header.Get("Content-Type"), b
+	}
+	for _, tc := range []struct{ path, accept, ctype string }{
+		{"/status", "", "application/json"},
+		{"/status", "*/*", "application/json"},
+		{"/status", "application/json, application/xml", "application/json"},
+		{"/status", "application/json;q=0.5, text/xml", "application/xml; charset=utf-8"},
+		{"/status", "application/xml", "application/xml; charset=utf-8"},
+		{"/status.xml", "", "application/xml; charset=utf-8"},
+		{"/status.xml", "application/soap+xml", "application/soap+xml; charset=utf-8"},
+	} {
+		ctype, body := get(tc.path, tc.accept)
+		if ctype != tc.ctype {
+			t.Errorf("GET %s (Accept %q): Content-Type %q, want %q", tc.path, tc.accept, ctype, tc.ctype)
+			continue
+		}
+		if ctype == "application/json" {
+			continue
+		}
+		var doc statusXML
+		if strings.Contains(ctype, "soap") {
+			var env struct {
+				XMLName xml.Name `xml:"http://www.w3.org/2003/05/soap-envelope Envelope"`
+				Body    struct {
+					Status statusXML `xml:"device_status"`
+				} `xml:"Body"`
+			}
+			if err := xml.Unmarshal(body, &env); err != nil {
+				t.Fatalf("SOAP: %v\n%s", err, body)
+			}
+			doc = env.Body.Status
+		} else if err := xml.Unmarshal(body, &doc); err != nil {
+			t.Fatalf("XML: %v\n%s", err, body)
+		}
+		if doc.SlaveId != 1 || doc.DisplayValue != "12.5" || doc.BaudRate != 9600 || doc.Updated == "" ||
+			doc.Sensors == nil || len(doc.Sensors.Sensor) != 2 || doc.Sensors.Sensor[0] != (sensorXML{Name: "humidity", Value: 45.5}) ||
+			doc.Sensors.Sensor[1].Value != 21.5 || doc.ExternalChanges != nil {
+			t.Errorf("GET %s (Accept %q) = %+v\n%s", tc.path, tc.accept, doc, body)
+		}
+	}
+	if _, body := get("/status.xml", ""); !bytes.HasPrefix(body, []byte(`<?xml version="1.0" encoding="UTF-8"?>`+"\n"+`<device_status xmlns="urn:modbus-display:status:1" slave_id="1"`)) {
+		t.Errorf("document start:\n%s", body)
+	}
+}
+
+func TestSNMPTraps(t *testing.T) {
+	nms, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nms.Close()
+	base := snmpOID{1, 3, 6, 1, 4, 1, 32473, 1}
+	_, sim, srv := startTestDriver(t, func(c *Config) {
+		c.SNMPCommunity, c.SNMPTrapTargets, c.SNMPBaseOID = "public", []string{nms.LocalAddr().String()}, base
+	})
+	waitDisplay(t, srv, "")
+	trap := func() (snmpOID, []snmpVarBind) {
+		t.Helper()
+		nms.SetReadDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, 1500)
+		n, _, err := nms.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no trap: %v", err)
+		}
+		tag, _, vbs := decodeSNMPMessage(t, buf[:n])
+		if tag != pduSNMPv2Trap || len(vbs) != 5 || vbs[0].oid.compare(oidSysUpTime) != 0 || vbs[1].oid.compare(oidSnmpTrapOID) != 0 {
+			t.Fatalf("trap %x %+v", tag, vbs)
+		}
+		return vbs[1].value.v.(snmpOID), vbs[2:]
+	}
+
+	var offline atomic.Bool
+	offline.Store(true)
+	sim.OnRequest(func(modbustest.Request) *modbustest.Fault {
+		if offline.Load() {
+			return &modbustest.Fault{Drop: true}
+		}
+		return nil
+	})
+	oid, vbs := trap()
+	if oid.compare(base.child(0, 1)) != 0 || vbs[0].value != snmpTruth(false) || vbs[1].value.v == "" || vbs[2].value != snmpInt(1) {
+		t.Errorf("offline trap %v %+v", oid, vbs)
+	}
+	offline.Store(false)
+	if oid, vbs = trap(); oid.compare(base.child(0, 2)) != 0 || vbs[0].value != snmpTruth(true) {
+		t.Errorf("online trap %v %+v", oid, vbs)
+	}
+}
+
+func TestBACnetWrite(t *testing.T) {
+	d, _, srv := startTestDriver(t, func(c *Config) {
+		c.BACnetDeviceID, c.BACnetDeviceName = 77, "lobby"
+		c.DisplayRules = displayRules{MaxLength: 4, Classes: classDigit, Extra: "."}
+	})
+	waitDisplay(t, srv, "")
+	dev := d.newBACnetDevice()
+	// request sends one confirmed service and returns the reply APDU.
+	request := func(service byte, params string) string {
+		t.Helper()
+		p, _ := hex.DecodeString(params)
+		apdu := append([]byte{0x00, 0x05, 0x01, service}, p...)
+		msg := append([]byte{bvlcTypeBIP, bvlcOriginalUnicast, 0, byte(6 + len(apdu)), 0x01, 0x04}, apdu...)
+		resp, _ := dev.handle(msg, &net.UDPAddr{})
+		if len(resp) < 6 {
+			t.Fatalf("no reply to %x", msg)
+		}
+		return hex.EncodeToString(resp[6:])
+	}
+
+	// analog-value,1 present-value := 12.5
+	if got := request(serviceWriteProperty, "0c0080000119553e44414800003f"); got != "20010f" {
+		t.Fatalf("WriteProperty 12.5: %s", got)
+	}
+	waitDisplay(t, srv, "12.5")
+	if got := request(serviceReadProperty, "0c008000011955"); got != "30010c0c0080000119553e44414800003f" {
+		t.Errorf("ReadProperty display-value: %s", got)
+	}
+	// characterstring-value,1 present-value := "7", then "OPEN", which DISPLAY_CHARSET refuses.
+	if got := request(serviceWriteProperty, "0c0a00000119553e7200373f"); got != "20010f" {
+		t.Fatalf("WriteProperty \"7\": %s", got)
+	}
+	waitDisplay(t, srv, "7")
+	if got := request(serviceWriteProperty, "0c0a00000119553e7505004f50454e3f"); got != "50010f91029125" {
+		t.Errorf("WriteProperty \"OPEN\": %s", got)
+	}
+	// binary-value,1 (link-up) is read-only, and so is everything in read-only mode.
+	for deadline := time.Now().Add(5 * time.Second); d.reach.Load() == nil && time.Now().Before(deadline); {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := request(serviceReadProperty, "0c014000011955"); got != "30010c0c0140000119553e91013f" {
+		t.Errorf("ReadProperty link-up: %s", got)
+	}
+	if got := request(serviceWriteProperty, "0c0140000119553e91003f"); got != "50010f91029128" {
+		t.Errorf("WriteProperty link-up: %s", got)
+	}
+	d.readOnly.Store(true)
+	if got := request(serviceWriteProperty, "0c0080000119553e44410000003f"); got != "50010f91029128" {
+		t.Errorf("WriteProperty in read-only mode: %s", got)
+	}
+	if got := request(serviceReadProperty, "0c0200004d1970"); got != "30010c0c0200004d19703e91013f" {
+		t.Errorf("system-status in read-only mode: %s", got)
+	}
+	if getStatus(t, srv).DisplayValue != "7" {
+		t.Error("refused writes reached the display")
+	}
+}
+
+func TestClusterStandby(t *testing.T) {
+	dir := t.TempDir()
+	lease := filepath.Join(dir, "lease.json")
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status.xml" {
+			http.NotFound(w, r)
+			return
+		}
+		writeStatusXML(w, newStatusXML(DeviceStatus{DeviceAddress: 1, DisplayValue: "PEER", Sensors: map[string]float64{"t": 2}}, 1), false)
+	}))
+	defer peer.Close()
+	// The other node holds the lease.
+	other := &clusterNode{id: "other", file: lease}
+	if err := other.writeLease(leaseRecord{Holder: "other", Term: 3, Expires: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	var busRequests atomic.Int32
+	d, sim, srv := startTestDriver(t, func(c *Config) {
+		c.ClusterLeaseFile, c.ClusterNodeID, c.ClusterLease, c.ClusterPeerURL = lease, "this", time.Second, peer.URL
+	})
+	sim.OnRequest(func(modbustest.Request) *modbustest.Fault {
+		busRequests.Add(1)
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.cluster.run(ctx, d.onClusterRole)
+	}()
+	defer func() { cancel(); <-done }()
+
+	// The standby mirrors the leader, refuses writes and stays off the bus.
+	waitDisplay(t, srv, "PEER")
+	if st := getStatus(t, srv); st.Sensors["t"] != 2 {
+		t.Errorf("replicated status = %+v", st)
+	}
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"1"}`); code != http.StatusServiceUnavailable || !strings.Contains(body, `"other"`) {
+		t.Errorf("write on standby = %d %s", code, body)
+	}
+	resp, err := http.Get(srv.URL + "/cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		Role, Leader string
+		Term         int
+	}
+	json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || info.Role != "standby" || info.Leader != "other" || info.Term != 3 {
+		t.Errorf("GET /cluster = %d %+v", resp.StatusCode, info)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := busRequests.Load(); n != 0 {
+		t.Errorf("standby sent %d bus requests", n)
+	}
+
+	// The other node lets its lease go: this one takes over and polls.
+	if err := other.writeLease(leaseRecord{Term: 3}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for busRequests.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"12"}`); code != http.StatusOK {
+		t.Fatalf("write on leader = %d %s", code, body)
+	}
+	if leader, term := d.cluster.leaderTerm(); leader != "this" || term != 4 {
+		t.Errorf("lease = %q term %d", leader, term)
+	}
+}
+
+func TestThingDescription(t *testing.T) {
+	_, _, srv := startTestDriver(t, func(c *Config) {
+		c.ExternalChangeNotify = []notifyTarget{{Kind: "webhook", Target: "http://127.0.0.1:1/hook"}}
+	})
+	resp, err := http.Get(srv.URL + "/.well-known/wot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/td+json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	type form struct {
+		Href   string      `json:"href"`
+		Op     interface{} `json:"op"`
+		Method string      `json:"htv:methodName"`
+		Sub    string      `json:"subprotocol"`
+	}
+	type affordance struct {
+		Forms      []form                     `json:"forms"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	var td struct {
+		Context    []interface{}         `json:"@context"`
+		Base       string                `json:"base"`
+		Security   string                `json:"security"`
+		Properties map[string]affordance `json:"properties"`
+		Actions    map[string]affordance `json:"actions"`
+		Events     map[string]affordance `json:"events"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&td); err != nil {
+		t.Fatal(err)
+	}
+	if len(td.Context) == 0 || td.Context[0] != "https://www.w3.org/2022/wot/td/v1.1" || td.Security != "nosec_sc" || td.Base != srv.URL+"/" {
+		t.Fatalf("context %v, security %q, base %q", td.Context, td.Security, td.Base)
+	}
+	if _, ok := td.Properties["status"].Properties["display_value"]; !ok {
+		t.Errorf("status schema lacks display_value: %v", td.Properties["status"].Properties)
+	}
+	if _, ok := td.Properties["clock"]; ok {
+		t.Error("clock property without CLOCK_LAYOUT")
+	}
+	if f := td.Actions["write_registers"].Forms; len(f) != 1 || f[0].Href != "registers/{addr}" || f[0].Method != "PUT" {
+		t.Errorf("write_registers forms = %+v", f)
+	}
+	if f := td.Events["status"].Forms; len(f) != 1 || f[0].Sub != "sse" {
+		t.Errorf("status event forms = %+v", f)
+	}
+	if f := td.Events["external_change"].Forms; len(f) != 1 || f[0].Href != "http://127.0.0.1:1/hook" {
+		t.Errorf("external_change forms = %+v", f)
+	}
+	if _, ok := td.Events["alarm"]; ok {
+		t.Error("alarm event without alarm rules")
+	}
+
+	// A consumer writes the display_value property through its form.
+	f := td.Properties["display_value"].Forms[0]
+	if code, body := putJSON(t, td.Base+f.Href, `{"display_value": "WOT"}`); code != http.StatusOK {
+		t.Fatalf("writeproperty: %d %s", code, body)
+	}
+	waitDisplay(t, srv, "WOT")
+}
+
+func TestGoClient(t *testing.T) {
+	_, sim, srv := startTestDriver(t)
+	c, err := client.New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := c.SetDisplayValue(ctx, "GO"); err != nil {
+		t.Fatal(err)
+	}
+	if got := sim.ASCII(testRegDisplay, testRegsDisplay); strings.TrimSpace(got) != "GO" {
+		t.Fatalf("display = %q", got)
+	}
+	waitDisplay(t, srv, "GO")
+	st, err := c.GetStatus(ctx)
+	if err != nil || st.DisplayValue != "GO" {
+		t.Fatalf("GetStatus = %+v, %v", st, err)
+	}
+	h, err := c.Health(ctx)
+	if err != nil || h.Status != "ok" || h.SerialPort == nil || !h.SerialPort.OK {
+		t.Fatalf("Health = %+v, %v", h, err)
+	}
+	var re *client.Error
+	if err := c.SetDisplayValue(ctx, " "); !errors.As(err, &re) || re.StatusCode != http.StatusBadRequest {
+		t.Errorf("SetDisplayValue(blank) = %v", err)
+	}
+}
+
+func TestDisplayEchoTest(t *testing.T) {
+	d, sim, srv := startTestDriver(t)
+	if code, body := putJSON(t, srv.URL+"/display/value", `{"display_value":"1234"}`); code != http.StatusOK {
+		t.Fatalf("PUT = %d %s", code, body)
+	}
+	echo := func(body string) (int, echoTestResp) {
+		t.Helper()
+		resp, err := http.Post(srv.URL+"/display/value/echo-test", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r echoTestResp
+		_ = json.NewDecoder(resp.Body).Decode(&r)
+		return resp.StatusCode, r
+	}
+
+	var tokenWrites []string
+	var failWrites atomic.Int32
+	failWrites.Store(1)
+	sim.OnRequest(func(r modbustest.Request) *modbustest.Fault {
+		if r.Function != 16 || r.Address != testRegDisplay || r.Values[0] == 0x3132 { // "12", the restore
+			return nil
+		}
+		tokenWrites = append(tokenWrites, fmt.Sprint(r.Values))
+		if failWrites.Add(-1) >= 0 {
+			return &modbustest.Fault{Exception: modbustest.ExceptionSlaveDeviceBusy}
+		}
+		return nil
+	})
+	code, r := echo("")
+	if code != http.StatusOK || !r.OK || r.Retries != 1 || len(r.Errors) != 1 || !r.Restored || r.TotalMs <= 0 || r.Token == "1234" || len(r.Token) != 4 {
+		t.Fatalf("echo test = %d %+v", code, r)
+	}
+	if got := strings.TrimSpace(sim.ASCII(testRegDisplay, testRegsDisplay)); got != "1234" {
+		t.Errorf("display after the test = %q, want 1234 back", got)
+	}
+	if len(tokenWrites) != 2 {
+		t.Errorf("token written %d times, want 2", len(tokenWrites))
+	}
+
+	failWrites.Store(100)
+	if code, r := echo(`{"token": "ECHO", "attempts": 2}`); code != http.StatusBadGateway || r.OK || r.Retries != 1 || len(r.Errors) != 2 || !r.Restored || r.Token != "ECHO" {
+		t.Errorf("failing echo test = %d %+v", code, r)
+	}
+	sim.OnRequest(nil)
+	if code, _ := echo(`{"attempts": 11}`); code != http.StatusBadRequest {
+		t.Errorf("attempts 11 = %d", code)
+	}
+	if d.echo.tests.Load() != 2 || d.echo.failures.Load() != 1 || d.echo.retries.Load() != 2 {
+		t.Errorf("echo stats: %d tests, %d failures, %d retries", d.echo.tests.Load(), d.echo.failures.Load(), d.echo.retries.Load())
+	}
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); !strings.Contains(string(b), "modbus_display_echo_test_latency_seconds ") {
+		t.Error("no echo latency gauge in /metrics")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Dry runs:
+//
+//	PUT /display/value?dry_run=true  {"display_value": "12.5"}
+//	-> {"dry_run": true, "read_only": false, "operations": [
+//	     {"op": "write_registers", "field": "display_value", "slave_id": 1, "function": 16, "address": 16, "values": [12594, 11829, 8224, 8224]}]}
+//
+// Every write route, and POST /admin/readonly, takes dry_run=true or a
+// "Dry-Run: true" header. The request is authorized and validated as it
+// would be, and the reply lists, in order, the Modbus writes it would send
+// and the changes to the driver's own state it would make; none of them
+// happen. Reads a write involves (firmware verification) are not listed.
+// Read-only mode does not refuse a dry run, so a change can be checked
+// before the lock is lifted; read_only in the reply says whether it is on.
+// A dry run of POST /commands is answered at once with the dry run of the
+// command it would queue.
+
+type plannedOp struct {
+	Op       string      `json:"op"`
+	Field    string      `json:"field,omitempty"`
+	SlaveId  int         `json:"slave_id,omitempty"`
+	Function byte        `json:"function,omitempty"` // Modbus function code
+	Address  *uint16     `json:"address,omitempty"`
+	Values   []uint16    `json:"values,omitempty"`
+	Detail   interface{} `json:"detail,omitempty"`
+}
+
+type dryRunCtxKey struct{}
+
+// parseDryRun reads the dry_run parameter or the Dry-Run header.
+func parseDryRun(r *http.Request) (bool, error) {
+	s := r.URL.Query().Get("dry_run")
+	if s == "" {
+		s = r.Header.Get("Dry-Run")
+	}
+	if s == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+// dryRun reports whether writeGuard found r to be a dry run.
+func dryRun(r *http.Request) bool {
+	dry, _ := r.Context().Value(dryRunCtxKey{}).(bool)
+	return dry
+}
+
+// planWrite is the write of vals at addr: FC06 for writeU16, FC16 for
+// writeRegs and multi-register writes.
+func planWrite(field string, slave int, fc byte, addr uint16, vals ...uint16) plannedOp {
+	op := "write_register"
+	if fc == 16 {
+		op = "write_registers"
+	}
+	return plannedOp{Op: op, Field: field, SlaveId: slave, Function: fc, Address: &addr, Values: vals}
+}
+
+// planPayload is planWrite for a register payload, with FC16.
+func planPayload(field string, slave int, addr uint16, payload []byte) plannedOp {
+	return planWrite(field, slave, 16, addr, registerValues(payload)...)
+}
+
+func registerValues(payload []byte) []uint16 {
+	vals := make([]uint16, len(payload)/2)
+	for i := range vals {
+		vals[i] = binary.BigEndian.Uint16(payload[2*i:])
+	}
+	return vals
+}
+
+// planForgetDesired is forgetDesired, when there is a value to forget.
+func (d *ModbusDriver) planForgetDesired() []plannedOp {
+	if _, set := d.desired.Get(); !set {
+		return nil
+	}
+	return []plannedOp{{Op: "clear_desired_value", Detail: map[string]string{"file": d.cfg.DesiredValueFile}}}
+}
+
+func (d *ModbusDriver) replyDryRun(w http.ResponseWriter, ops []plannedOp) {
+	if ops == nil {
+		ops = []plannedOp{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"dry_run": true, "read_only": d.readOnly.Load(), "operations": ops})
+}
+
+// linkSlave is the slave the shared handler currently addresses, which
+// writeU16 and writeRegs go to; /comm/config can move it off SLAVE_ID.
+func (d *ModbusDriver) linkSlave() int {
+	d.mbusMu.Lock()
+	defer d.mbusMu.Unlock()
+	if d.handler == nil {
+		return d.cfg.SlaveId
+	}
+	return int(d.handler.SlaveId)
+}
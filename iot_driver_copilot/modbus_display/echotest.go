@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Display path echo test:
+//
+//	POST /display/value/echo-test  {"attempts": 3}
+//	-> {"ok": true, "token": "4821", "write_ms": 12.4, "read_ms": 9.1, "total_ms": 21.5, "retries": 0, "restored": true}
+//
+// The test writes a token to the display value registers, reads them back
+// and compares, timing the write and the read separately. A failed write,
+// read or comparison is tried again up to "attempts" times (default 3,
+// at most 10); "retries" counts the extra tries and "errors" says what went
+// wrong on each. The text shown before the test is put back afterwards.
+// Run periodically, the latencies and retries show a bus getting worse
+// (a loose terminator, a failing adapter) while polls still succeed. The
+// reply is 502 when no attempt succeeded. "token" picks the token; by
+// default it is up to four random digits, unlike the text on the display.
+//
+// With BLINK_MODE=software the driver rewrites the display continuously,
+// so the test is refused (409).
+
+const maxEchoAttempts = 10
+
+type echoTestReq struct {
+	Token    string `json:"token"`
+	Attempts int    `json:"attempts"`
+}
+
+type echoAttemptError struct {
+	Attempt int    `json:"attempt"`
+	Error   string `json:"error"`
+}
+
+type echoTestResp struct {
+	OK       bool               `json:"ok"`
+	Token    string             `json:"token"`
+	WriteMs  float64            `json:"write_ms,omitempty"`
+	ReadMs   float64            `json:"read_ms,omitempty"`
+	TotalMs  float64            `json:"total_ms,omitempty"`
+	Retries  int                `json:"retries"`
+	Errors   []echoAttemptError `json:"errors,omitempty"`
+	Restored bool               `json:"restored"`
+}
+
+// echoToken returns up to four random digits that encode to something
+// other than current.
+func echoToken(width int, current []byte, codec asciiCodec) string {
+	if width > 4 {
+		width = 4
+	}
+	for {
+		tok := fmt.Sprintf("%0*d", width, rand.Intn(pow10(width)))
+		if enc, err := codec.Encode(tok); err == nil && !bytes.Equal(enc, current) {
+			return tok
+		}
+	}
+}
+
+func pow10(n int) int {
+	p := 1
+	for ; n > 0; n-- {
+		p *= 10
+	}
+	return p
+}
+
+func (d *ModbusDriver) handleEchoTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if d.blinker != nil {
+		http.Error(w, "echo test is not available with BLINK_MODE=software", http.StatusConflict)
+		return
+	}
+	req := echoTestReq{Attempts: 3}
+	if r.ContentLength != 0 {
+		if !d.decodeJSON(w, r, &req) {
+			return
+		}
+	}
+	if req.Attempts < 1 || req.Attempts > maxEchoAttempts {
+		http.Error(w, fmt.Sprintf("attempts must be 1..%d", maxEchoAttempts), http.StatusBadRequest)
+		return
+	}
+	var tokenPayload []byte
+	if req.Token != "" {
+		if strings.TrimSpace(req.Token) != req.Token {
+			http.Error(w, "token may not start or end with spaces", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if tokenPayload, err = d.codec.Encode(req.Token); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	addr, regs := d.cfg.RegDisplayValueStart, uint16(d.cfg.DisplayValueRegs)
+	if dryRun(r) {
+		tok := req.Token
+		if tok == "" {
+			tok = echoToken(int(regs)*2, nil, d.codec)
+			tokenPayload, _ = d.codec.Encode(tok)
+		}
+		d.replyDryRun(w, []plannedOp{
+			planPayload("display_value", d.linkSlave(), addr, tokenPayload),
+			{Op: "restore_display_value", Field: "display_value", Detail: map[string]string{"token": tok}},
+		})
+		return
+	}
+
+	// Other display writes wait until the old text is back.
+	d.settingsMu.Lock()
+	defer d.settingsMu.Unlock()
+	before, err := d.readRegs(addr, regs)
+	if err != nil {
+		d.logger.Printf("echo test: read display value failed: %v", err)
+		http.Error(w, "device read error", http.StatusInternalServerError)
+		return
+	}
+	resp := echoTestResp{Token: req.Token}
+	if resp.Token == "" {
+		resp.Token = echoToken(int(regs)*2, before, d.codec)
+		tokenPayload, _ = d.codec.Encode(resp.Token)
+	}
+	ms := func(from, to time.Time) float64 { return float64(to.Sub(from).Microseconds()) / 1000 }
+	for attempt := 1; attempt <= req.Attempts && !resp.OK; attempt++ {
+		start := time.Now()
+		err := d.writeDisplayPayload(tokenPayload)
+		written := time.Now()
+		var back []byte
+		if err == nil {
+			back, err = d.readRegs(addr, regs)
+		}
+		if err == nil && !bytes.Equal(back, tokenPayload) {
+			err = fmt.Errorf("read back %q", back)
+		}
+		if err != nil {
+			resp.Errors = append(resp.Errors, echoAttemptError{Attempt: attempt, Error: err.Error()})
+			continue
+		}
+		done := time.Now()
+		resp.OK = true
+		resp.WriteMs, resp.ReadMs, resp.TotalMs = ms(start, written), ms(written, done), ms(start, done)
+		resp.Retries = attempt - 1
+	}
+	if !resp.OK {
+		resp.Retries = req.Attempts - 1
+	}
+	if err := d.writeDisplayPayload(before); err != nil {
+		d.logger.Printf("echo test: restoring the display failed: %v", err)
+	} else {
+		resp.Restored = true
+	}
+	d.echo.record(resp)
+	code := http.StatusOK
+	if !resp.OK {
+		d.logger.Printf("echo test failed after %d attempts: %s", req.Attempts, resp.Errors[len(resp.Errors)-1].Error)
+		code = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// echoStats feeds the echo test's results to GET /metrics.
+type echoStats struct {
+	tests, failures, retries atomic.Uint64
+	lastMicros               atomic.Int64 // total latency of the last successful test; 0 before one
+}
+
+func (s *echoStats) record(resp echoTestResp) {
+	s.tests.Add(1)
+	s.retries.Add(uint64(resp.Retries))
+	if !resp.OK {
+		s.failures.Add(1)
+		return
+	}
+	s.lastMicros.Store(int64(resp.TotalMs * 1000))
+}
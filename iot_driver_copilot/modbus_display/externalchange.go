@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// External change detection: a polled field whose value moved although the
+// driver wrote none of its registers since the previous poll was changed by
+// someone else, e.g. with a handheld programmer on the bus. Such changes are
+// marked in /status as "external_changes" until cleared with
+// DELETE /status/external_changes, and sent as "external_change" events to
+// the EXTERNAL_CHANGE_NOTIFY targets.
+//
+// A write counts for the poll that started before it finished and for the
+// one after, since either may be the first to read the new value.
+
+type externalChange struct {
+	At   time.Time   `json:"at"`
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+type ExternalChangeEvent struct {
+	Event     string      `json:"event"` // always "external_change"
+	SlaveId   int         `json:"slave_id"`
+	Field     string      `json:"field"`
+	From      interface{} `json:"from"`
+	To        interface{} `json:"to"`
+	Timestamp time.Time   `json:"timestamp"`
+}
+
+// notifyTarget is a "webhook <url>" or "mqtt <topic>" destination.
+type notifyTarget struct {
+	Kind, Target string
+}
+
+// parseNotifyTargets reads a ';'-separated list of targets in the syntax of
+// alarm rule actions.
+func parseNotifyTargets(s string) ([]notifyTarget, error) {
+	var out []notifyTarget
+	for _, entry := range strings.Split(s, ";") {
+		f := strings.Fields(entry)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) == 3 && f[0] == "mqtt" && f[1] == "topic" {
+			f = []string{"mqtt", f[2]}
+		}
+		if len(f) != 2 || (f[0] != "webhook" && f[0] != "mqtt") {
+			return nil, fmt.Errorf("target %q must be 'webhook <url>' or 'mqtt <topic>'", strings.TrimSpace(entry))
+		}
+		out = append(out, notifyTarget{Kind: f[0], Target: f[1]})
+	}
+	return out, nil
+}
+
+// changeTracker remembers which registers the driver itself wrote, and the
+// external changes seen so far.
+type changeTracker struct {
+	mu        sync.Mutex
+	writes    map[uint16]time.Time // register -> end of the last driver write
+	prevStart time.Time            // start of the previous poll
+	marks     map[string]externalChange
+}
+
+func newChangeTracker() *changeTracker {
+	return &changeTracker{writes: map[uint16]time.Time{}}
+}
+
+func (t *changeTracker) noteWrite(addr, qty uint16) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := uint16(0); i < qty; i++ {
+		t.writes[addr+i] = now
+	}
+}
+
+// trackedField is a status field and the registers it is read from.
+type trackedField struct {
+	name      string
+	addr, qty uint16
+}
+
+func (d *ModbusDriver) trackedFields() []trackedField {
+	c := d.cfg
+	fields := []trackedField{
+		{"device_address", c.RegDeviceAddress, 1}, {"baud_rate", c.RegBaudRate, 1}, {"comm_format", c.RegCommFormat, 1},
+		{"work_mode", c.RegWorkMode, 1}, {"value_type", c.RegValueType, 1}, {"decimals", c.RegDecimals, 1}, {"dp_mask", c.RegDpMask, 1},
+	}
+	if d.blinker == nil {
+		// With software blink the driver rewrites these registers itself
+		// all the time, so changes to them can't be told apart.
+		fields = append(fields,
+			trackedField{"blink_mask", c.RegBlinkMask, 1}, trackedField{"blink_period_ms", c.RegBlinkPeriodMs, 1},
+			trackedField{"display_value", c.RegDisplayValueStart, uint16(c.DisplayValueRegs)})
+	}
+	return fields
+}
+
+// diff returns the fields of st that changed since prev, beyond their
+// dead-band, without a driver write, for a poll that started at start, and makes start the reference
+// for the next poll.
+func (t *changeTracker) diff(fields []trackedField, bands deadbands, prev, st map[string]interface{}, start time.Time) []trackedField {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	since := t.prevStart
+	t.prevStart = start
+	var changed []trackedField
+	for _, f := range fields {
+		if reflect.DeepEqual(prev[f.name], st[f.name]) || !bands.moved(f.name, prev[f.name], st[f.name]) {
+			continue
+		}
+		own := false
+		for i := uint16(0); i < f.qty; i++ {
+			if w, ok := t.writes[f.addr+i]; ok && w.After(since) {
+				own = true
+			}
+		}
+		if !own {
+			changed = append(changed, f)
+		}
+	}
+	for reg, w := range t.writes {
+		if !w.After(start) {
+			delete(t.writes, reg)
+		}
+	}
+	return changed
+}
+
+// mark records a change; marks are copied on write, as status snapshots share them.
+func (t *changeTracker) mark(field string, c externalChange) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	marks := make(map[string]externalChange, len(t.marks)+1)
+	for k, v := range t.marks {
+		marks[k] = v
+	}
+	if old, ok := marks[field]; ok {
+		c.From = old.From // keep the value from before the first change
+	}
+	marks[field] = c
+	t.marks = marks
+}
+
+func (t *changeTracker) snapshot() map[string]externalChange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.marks
+}
+
+func (t *changeTracker) clear() {
+	t.mu.Lock()
+	t.marks = nil
+	t.mu.Unlock()
+}
+
+// detectExternalChanges compares a fresh poll with the previous one.
+// Called from readAndUpdateStatus before st is published.
+func (d *ModbusDriver) detectExternalChanges(prev, st DeviceStatus, start time.Time) {
+	t := d.changes
+	if prev.lastUpdateTime.IsZero() {
+		t.diff(nil, nil, nil, nil, start) // first poll: nothing to compare with
+		return
+	}
+	before, after := statusFields(prev), statusFields(st)
+	for _, f := range t.diff(d.trackedFields(), d.cfg.StatusDeadband, before, after, start) {
+		name := d.mapping.Name(f.name)
+		t.mark(name, externalChange{At: st.lastUpdateTime.UTC(), From: before[f.name], To: after[f.name]})
+		d.externalChanges.Add(1)
+		d.logger.Printf("external change on slave %d: %s %v -> %v", d.cfg.SlaveId, name, before[f.name], after[f.name])
+		ev := ExternalChangeEvent{Event: "external_change", SlaveId: d.cfg.SlaveId, Field: name, From: before[f.name], To: after[f.name], Timestamp: st.lastUpdateTime}
+		for _, target := range d.cfg.ExternalChangeNotify {
+			d.notifier.Send(target.Kind, target.Target, ev)
+		}
+	}
+}
+
+// handleExternalChanges serves DELETE /status/external_changes, which
+// acknowledges the marks in /status.
+func (d *ModbusDriver) handleExternalChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if dryRun(r) {
+		d.replyDryRun(w, []plannedOp{{Op: "clear_external_changes", Detail: d.changes.snapshot()}})
+		return
+	}
+	d.statusMu.Lock()
+	d.changes.clear()
+	d.status.ExternalChanges = nil
+	d.statusMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
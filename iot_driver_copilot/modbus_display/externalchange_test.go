@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseNotifyTargets(t *testing.T) {
+	got, err := parseNotifyTargets("webhook http://h/x; mqtt topic displays/tamper;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != (notifyTarget{"webhook", "http://h/x"}) || got[1] != (notifyTarget{"mqtt", "displays/tamper"}) {
+		t.Errorf("got %+v", got)
+	}
+	for _, bad := range []string{"webhook", "email a@b.c", "mqtt a b"} {
+		if _, err := parseNotifyTargets(bad); err == nil {
+			t.Errorf("parseNotifyTargets(%q) accepted", bad)
+		}
+	}
+}
+
+func TestChangeTrackerDiff(t *testing.T) {
+	fields := []trackedField{{"decimals", 5, 1}, {"display_value", 10, 4}}
+	tr := newChangeTracker()
+	t0 := time.Now()
+	tr.diff(nil, nil, nil, nil, t0)
+
+	a := map[string]interface{}{"decimals": 1.0, "display_value": "1"}
+	b := map[string]interface{}{"decimals": 2.0, "display_value": "2"}
+	// A write inside the display value that finished while the poll
+	// starting at t1 was running.
+	t1 := t0.Add(2 * time.Millisecond)
+	tr.writes[12] = t1.Add(time.Millisecond / 2)
+	if got := tr.diff(fields, nil, a, b, t1); len(got) != 1 || got[0].name != "decimals" {
+		t.Errorf("first poll: %+v", got)
+	}
+	// The write still covers the next poll, which may be the first to see it...
+	if got := tr.diff(fields, nil, a, b, t1.Add(time.Millisecond)); len(got) != 1 || got[0].name != "decimals" {
+		t.Errorf("second poll: %+v", got)
+	}
+	// ...but not the one after.
+	if got := tr.diff(fields, nil, a, b, t1.Add(2*time.Millisecond)); len(got) != 2 {
+		t.Errorf("third poll: %+v", got)
+	}
+	if got := tr.diff(fields, nil, a, a, t1.Add(3*time.Millisecond)); len(got) != 0 {
+		t.Errorf("unchanged: %+v", got)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+)
+
+// Firmware upload over Modbus file records:
+//
+//	POST /firmware[?slave_id=S]  (Authorization: Bearer <ADMIN_TOKEN>, body: raw image)
+//
+// The image is written with Write File Record (FC21) to consecutive records
+// of FIRMWARE_FILE_NUMBER, FIRMWARE_CHUNK_REGS registers per request, and
+// continues in the next file after record 9999. It is then read back with
+// Read File Record (FC20) and compared. An odd-length image is padded with
+// 0xFF. With "Accept: text/event-stream" progress is streamed as SSE.
+//
+// The client library has no file record support, and its RTU transport
+// cannot frame replies it doesn't know the length of. The upload therefore
+// takes the bus exclusively and talks to the port itself; polling and every
+// other request wait until it finishes.
+
+const (
+	fcReadFileRecord  = 0x14
+	fcWriteFileRecord = 0x15
+
+	fileRecordsPerFile = 10000 // record numbers 0..9999
+	maxFileRecordRegs  = 122   // FC21 request PDU limit for one sub-request
+	fileRefType        = 6
+)
+
+// fileChunk is one request's worth of image, in registers.
+type fileChunk struct {
+	File   uint16
+	Record uint16
+	Data   []byte
+}
+
+// splitFirmware lays image out over file records starting at record 0 of
+// file, at most regs registers per chunk and never across a file boundary.
+func splitFirmware(image []byte, file uint16, regs int) []fileChunk {
+	if len(image)%2 != 0 {
+		image = append(append([]byte(nil), image...), 0xFF)
+	}
+	var out []fileChunk
+	record := 0
+	for off := 0; off < len(image); {
+		n := regs
+		if left := fileRecordsPerFile - record; n > left {
+			n = left
+		}
+		if rest := (len(image) - off) / 2; n > rest {
+			n = rest
+		}
+		out = append(out, fileChunk{File: file, Record: uint16(record), Data: image[off : off+2*n]})
+		off += 2 * n
+		if record += n; record == fileRecordsPerFile {
+			file, record = file+1, 0
+		}
+	}
+	return out
+}
+
+// rtuLink is a bare RTU master for the function codes the client library
+// lacks.
+type rtuLink struct {
+	port  io.ReadWriteCloser
+	slave byte
+}
+
+func (l *rtuLink) transact(pdu []byte) ([]byte, error) {
+	adu := append([]byte{l.slave}, pdu...)
+	crc := rtuCRC(adu)
+	adu = append(adu, byte(crc), byte(crc>>8))
+	if _, err := l.port.Write(adu); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 3)
+	if _, err := io.ReadFull(l.port, resp); err != nil {
+		return nil, err
+	}
+	var rest int
+	switch {
+	case resp[1] == pdu[0]|0x80:
+		rest = 2 // exception code already read, CRC left
+	case resp[1] == fcWriteFileRecord:
+		rest = len(adu) - 3 // echo of the request
+	case resp[1] == fcReadFileRecord:
+		rest = int(resp[2]) + 2
+	default:
+		return nil, fmt.Errorf("unexpected function 0x%02x in reply", resp[1])
+	}
+	resp = append(resp, make([]byte, rest)...)
+	if _, err := io.ReadFull(l.port, resp[3:]); err != nil {
+		return nil, err
+	}
+	n := len(resp)
+	if resp[0] != l.slave || rtuCRC(resp[:n-2]) != uint16(resp[n-2])|uint16(resp[n-1])<<8 {
+		return nil, errors.New("corrupt reply")
+	}
+	if resp[1]&0x80 != 0 {
+		return nil, &modbus.ModbusError{FunctionCode: resp[1], ExceptionCode: resp[2]}
+	}
+	return resp[1 : n-2], nil
+}
+
+func (l *rtuLink) writeFileRecord(c fileChunk) error {
+	regs := len(c.Data) / 2
+	pdu := []byte{fcWriteFileRecord, byte(7 + len(c.Data)), fileRefType}
+	pdu = binary.BigEndian.AppendUint16(pdu, c.File)
+	pdu = binary.BigEndian.AppendUint16(pdu, c.Record)
+	pdu = binary.BigEndian.AppendUint16(pdu, uint16(regs))
+	pdu = append(pdu, c.Data...)
+	resp, err := l.transact(pdu)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(resp, pdu) {
+		return errors.New("write file record: reply does not echo the request")
+	}
+	return nil
+}
+
+func (l *rtuLink) readFileRecord(file, record uint16, regs int) ([]byte, error) {
+	pdu := []byte{fcReadFileRecord, 7, fileRefType}
+	pdu = binary.BigEndian.AppendUint16(pdu, file)
+	pdu = binary.BigEndian.AppendUint16(pdu, record)
+	pdu = binary.BigEndian.AppendUint16(pdu, uint16(regs))
+	resp, err := l.transact(pdu)
+	if err != nil {
+		return nil, err
+	}
+	// function, response length, sub-response length, reference type, data
+	if len(resp) != 4+2*regs || int(resp[2]) != 1+2*regs || resp[3] != fileRefType {
+		return nil, errors.New("read file record: malformed reply")
+	}
+	return resp[4:], nil
+}
+
+func rtuCRC(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+type firmwareProgress struct {
+	Phase string `json:"phase"` // write or verify
+	Done  int    `json:"done"`  // bytes
+	Total int    `json:"total"`
+}
+
+// uploadFirmware writes and verifies chunks on slave, reporting progress
+// after every chunk. The shared client is closed for the duration and
+// reconnects on its next request.
+func (d *ModbusDriver) uploadFirmware(slave byte, chunks []fileChunk, progress func(firmwareProgress)) error {
+	d.mbusMu.Lock()
+	defer d.mbusMu.Unlock()
+	if d.readOnly.Load() {
+		return errReadOnly
+	}
+	if d.link != nil {
+		_ = d.link.Close()
+	}
+	// The upload's transactions bypass the link, so the bus lock is held
+	// for all of them.
+	if err := d.busLock.acquire(); err != nil {
+		return err
+	}
+	defer d.busLock.release()
+	var port io.ReadWriteCloser
+	var err error
+	if d.cfg.RS485SoftwareRTS {
+		if d.link == nil {
+			d.buildLink()
+		}
+		if err = d.link.Connect(); err == nil {
+			port = directedPort{d.link}
+		}
+	} else {
+		port, err = serial.Open(&serial.Config{
+			Address: d.cfg.SerialPort, BaudRate: d.cfg.BaudRate, DataBits: d.cfg.DataBits,
+			StopBits: d.cfg.StopBits, Parity: d.cfg.Parity, Timeout: d.cfg.ModbusTimeout, RS485: d.cfg.RS485,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	defer port.Close()
+	link := &rtuLink{port: port, slave: slave}
+
+	total := 0
+	for _, c := range chunks {
+		total += len(c.Data)
+	}
+	done := 0
+	for _, c := range chunks {
+		if err := link.writeFileRecord(c); err != nil {
+			return fmt.Errorf("write file %d record %d: %w", c.File, c.Record, err)
+		}
+		done += len(c.Data)
+		d.markProgress() // the poll loop is blocked behind us
+		progress(firmwareProgress{"write", done, total})
+	}
+	done = 0
+	for _, c := range chunks {
+		got, err := link.readFileRecord(c.File, c.Record, len(c.Data)/2)
+		if err != nil {
+			return fmt.Errorf("read back file %d record %d: %w", c.File, c.Record, err)
+		}
+		if !bytes.Equal(got, c.Data) {
+			return fmt.Errorf("verify failed at file %d record %d", c.File, c.Record)
+		}
+		done += len(c.Data)
+		d.markProgress()
+		progress(firmwareProgress{"verify", done, total})
+	}
+	return nil
+}
+
+func (d *ModbusDriver) handleFirmware(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !d.adminEnabled() {
+		http.Error(w, "firmware upload disabled: ADMIN_TOKEN not set", http.StatusForbidden)
+		return
+	}
+	if !d.adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	slave, code, msg := d.requestSlave(r)
+	if code != 0 {
+		http.Error(w, msg, code)
+		return
+	}
+	if !d.firmwareBusy.CompareAndSwap(false, true) {
+		http.Error(w, "firmware upload already in progress", http.StatusConflict)
+		return
+	}
+	defer d.firmwareBusy.Store(false)
+
+	image, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(d.cfg.FirmwareMaxBytes)))
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		http.Error(w, fmt.Sprintf("image exceeds FIRMWARE_MAX_BYTES (%d)", d.cfg.FirmwareMaxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(image) == 0 {
+		http.Error(w, "empty image", http.StatusBadRequest)
+		return
+	}
+	chunks := splitFirmware(image, d.cfg.FirmwareFileNumber, d.cfg.FirmwareChunkRegs)
+	if dryRun(r) {
+		ops := make([]plannedOp, len(chunks))
+		for i, c := range chunks {
+			ops[i] = plannedOp{Op: "write_file_record", Field: "firmware", SlaveId: slave, Function: 21, Values: registerValues(c.Data),
+				Detail: map[string]uint16{"file": c.File, "record": c.Record}}
+		}
+		d.replyDryRun(w, ops)
+		return
+	}
+
+	flusher, sse := w.(http.Flusher)
+	sse = sse && r.Header.Get("Accept") == "text/event-stream"
+	event := func(name string, v interface{}) {
+		b, _ := json.Marshal(v)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b)
+		flusher.Flush()
+	}
+	progress := func(firmwareProgress) {}
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		progress = func(p firmwareProgress) { event("progress", p) }
+	}
+
+	d.logger.Printf("firmware upload to slave %d: %d bytes in %d chunks", slave, len(image), len(chunks))
+	err = d.uploadFirmware(byte(slave), chunks, progress)
+	if err != nil {
+		d.logger.Printf("firmware upload failed: %v", err)
+		if sse {
+			event("error", map[string]string{"error": err.Error()})
+			return
+		}
+		http.Error(w, "firmware upload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.logger.Printf("firmware upload to slave %d verified", slave)
+	result := map[string]interface{}{"ok": true, "bytes": len(image), "chunks": len(chunks)}
+	if sse {
+		event("done", result)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
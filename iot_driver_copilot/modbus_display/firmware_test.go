@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestSplitFirmware(t *testing.T) {
+	image := make([]byte, 2*(fileRecordsPerFile+50)+1) // spills into a second file, odd length
+	chunks := splitFirmware(image, 3, 120)
+
+	records, last := 0, chunks[len(chunks)-1]
+	for i, c := range chunks {
+		if len(c.Data) == 0 || len(c.Data) > 240 || len(c.Data)%2 != 0 {
+			t.Fatalf("chunk %d holds %d bytes", i, len(c.Data))
+		}
+		if int(c.Record)+len(c.Data)/2 > fileRecordsPerFile {
+			t.Fatalf("chunk %d crosses the end of file %d", i, c.File)
+		}
+		if want := uint16(3 + records/fileRecordsPerFile); c.File != want || int(c.Record) != records%fileRecordsPerFile {
+			t.Fatalf("chunk %d at file %d record %d, want file %d record %d", i, c.File, c.Record, want, records%fileRecordsPerFile)
+		}
+		records += len(c.Data) / 2
+	}
+	if records != fileRecordsPerFile+51 {
+		t.Fatalf("%d records written, want %d", records, fileRecordsPerFile+51)
+	}
+	if last.File != 4 || last.Data[len(last.Data)-1] != 0xFF {
+		t.Fatalf("last chunk = file %d, tail % x; want file 4 padded with ff", last.File, last.Data[len(last.Data)-2:])
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The value freshness watchdog catches a dead upstream: with
+// VALUE_STALE_AFTER_MS set, a display that has not been given a new value
+// for that long (PUT /display/value, its raw form, or /devices/value
+// naming SLAVE_ID) shows VALUE_STALE_TEXT instead of a number that is no
+// longer true. The next write puts a real value back. The state is the
+// "value_stale" alarm field, so rules such as
+//
+//	when value_stale == true for 10s -> mqtt display/alarms
+//
+// raise and clear an alarm with it, and /healthz reports "degraded" while
+// it lasts. The clock starts when the driver does, so a pipeline that never
+// comes up is caught too. The fallback is not persisted: DESIRED_VALUE_FILE
+// keeps the last real value, which is not restored over the fallback.
+
+type valueWatchdog struct {
+	after time.Duration
+	text  string
+
+	mu       sync.Mutex
+	last     time.Time // the last value write, or the start
+	fallback bool      // VALUE_STALE_TEXT is on the display
+}
+
+func newValueWatchdog(after time.Duration, text string, now time.Time) *valueWatchdog {
+	return &valueWatchdog{after: after, text: text, last: now}
+}
+
+// written records a new value on the display.
+func (w *valueWatchdog) written(now time.Time) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.last, w.fallback = now, false
+	w.mu.Unlock()
+}
+
+func (w *valueWatchdog) stale(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return now.Sub(w.last) >= w.after
+}
+
+// showingFallback reports whether VALUE_STALE_TEXT was written and no
+// value has come since.
+func (w *valueWatchdog) showingFallback() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.fallback
+}
+
+// due reports whether the fallback should be written now.
+func (w *valueWatchdog) due(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return !w.fallback && now.Sub(w.last) >= w.after
+}
+
+func (w *valueWatchdog) health(now time.Time) map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return map[string]interface{}{
+		"stale":            now.Sub(w.last) >= w.after,
+		"stale_after_ms":   w.after.Milliseconds(),
+		"last_value_at":    w.last.UTC(),
+		"showing_fallback": w.fallback,
+	}
+}
+
+// --- the driver's side ---
+
+// noteValueWritten tells the watchdog SLAVE_ID's display got a new value.
+func (d *ModbusDriver) noteValueWritten() { d.freshness.written(time.Now()) }
+
+// checkFreshness shows VALUE_STALE_TEXT once the value has gone stale. It
+// runs in the poll loop after a good poll; a failed write is tried again
+// on the next one, and a display that lost the text while it was
+// unreachable (lost) gets it again.
+func (d *ModbusDriver) checkFreshness(raw []byte, lost bool) {
+	w := d.freshness
+	if w == nil || d.readOnly.Load() {
+		return
+	}
+	start := time.Now()
+	if !w.due(start) && !(lost && w.showingFallback() && raw != nil && !d.showsValue(raw, w.text)) {
+		return
+	}
+	write := func() error { return d.writeDisplayText(w.text) }
+	var err error
+	if d.blinker != nil {
+		err = d.blinker.Write(w.text, write)
+	} else {
+		err = write()
+	}
+	if err != nil {
+		d.logger.Printf("show %q for a stale value failed: %v", w.text, err)
+		return
+	}
+	w.mu.Lock()
+	again := w.fallback
+	if w.last.Before(start) { // no value arrived while writing
+		w.fallback = true
+	}
+	shown := w.fallback
+	w.mu.Unlock()
+	if !shown {
+		return
+	}
+	if !again {
+		d.logger.Printf("no display value written for %v; showing %q", w.after, w.text)
+	}
+	d.statusMu.Lock()
+	d.status.DisplayValue = w.text
+	d.statusMu.Unlock()
+}
@@ -2,4 +2,16 @@ module modbus-display-driver
 
 go 1.20
 
-require github.com/goburrow/modbus v0.2.0
+require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/creack/pty v1.1.21
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/goburrow/modbus v0.1.0
+	github.com/goburrow/serial v0.1.0
+)
+
+require (
+	github.com/gorilla/websocket v1.5.0 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+)
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/goburrow/modbus"
+)
+
+// Device identity: GET /info[?slave_id=S] reads the vendor, product and
+// firmware registers named by REG_ADDR_VENDOR_ID, REG_ADDR_PRODUCT_CODE and
+// REG_ADDR_FIRMWARE_VERSION, one register each, so an inventory can tell
+// which model sits on each bus address. Modbus Read Device Identification
+// (FC43/14) is not used: its replies have no fixed length and the RTU
+// transport cannot frame them.
+
+type identityReg struct {
+	Field string // vendor_id, product_code or firmware_version
+	Addr  uint16
+}
+
+var identityEnv = []struct{ field, env string }{
+	{"vendor_id", "REG_ADDR_VENDOR_ID"},
+	{"product_code", "REG_ADDR_PRODUCT_CODE"},
+	{"firmware_version", "REG_ADDR_FIRMWARE_VERSION"},
+}
+
+type infoResp struct {
+	SlaveId         int     `json:"slave_id"`
+	VendorId        *uint16 `json:"vendor_id,omitempty"`
+	ProductCode     *uint16 `json:"product_code,omitempty"`
+	FirmwareVersion string  `json:"firmware_version,omitempty"`
+	FirmwareRaw     *uint16 `json:"firmware_raw,omitempty"`
+}
+
+// formatFirmware renders a firmware register per FIRMWARE_VERSION_FORMAT:
+// raw (decimal), bytes (high.low, 0x0102 -> 1.2) or hundredths (123 -> 1.23).
+func formatFirmware(v uint16, format string) string {
+	switch format {
+	case "bytes":
+		return fmt.Sprintf("%d.%d", v>>8, v&0xFF)
+	case "hundredths":
+		return fmt.Sprintf("%d.%02d", v/100, v%100)
+	}
+	return fmt.Sprint(v)
+}
+
+func (d *ModbusDriver) handleInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(d.cfg.IdentityRegs) == 0 {
+		http.Error(w, "identity registers not configured", http.StatusNotFound)
+		return
+	}
+	slave, code, msg := d.requestSlave(r)
+	if code != 0 {
+		http.Error(w, msg, code)
+		return
+	}
+
+	resp := infoResp{SlaveId: slave}
+	err := d.withSlave(byte(slave), func(c modbus.Client) error {
+		for _, reg := range d.cfg.IdentityRegs {
+			b, err := c.ReadHoldingRegisters(reg.Addr, 1)
+			if err != nil {
+				return fmt.Errorf("%s: %w", reg.Field, err)
+			}
+			v := binary.BigEndian.Uint16(b)
+			switch reg.Field {
+			case "vendor_id":
+				resp.VendorId = &v
+			case "product_code":
+				resp.ProductCode = &v
+			case "firmware_version":
+				resp.FirmwareRaw = &v
+				resp.FirmwareVersion = formatFirmware(v, d.cfg.FirmwareFormat)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		d.logger.Printf("read identity of slave %d failed: %v", slave, err)
+		http.Error(w, "device read error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
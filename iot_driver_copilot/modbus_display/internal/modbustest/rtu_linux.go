@@ -0,0 +1,154 @@
+package modbustest
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/creack/pty"
+)
+
+// ListenRTU exposes the server as an RTU slave on a new pseudo terminal and
+// returns the device path to hand to the driver as SERIAL_PORT.
+func (s *Server) ListenRTU() (string, error) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return "", err
+	}
+	// Keep the slave side open and raw: the master would see EIO whenever
+	// the driver closes its port, and echo would feed replies back to us.
+	if err := makeRaw(tty); err != nil {
+		ptmx.Close()
+		tty.Close()
+		return "", err
+	}
+	master, err := pollable(ptmx)
+	if err != nil {
+		tty.Close()
+		return "", err
+	}
+	s.track(master)
+	s.track(tty)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.serveRTU(master)
+	}()
+	return tty.Name(), nil
+}
+
+func (s *Server) serveRTU(port *os.File) {
+	var buf []byte
+	chunk := make([]byte, 256)
+	for {
+		n, err := port.Read(chunk)
+		if err != nil {
+			return
+		}
+		buf = append(buf, chunk[:n]...)
+		for {
+			size := rtuRequestLen(buf)
+			if size < 0 {
+				buf = buf[:0] // unknown framing: drop it like a line-silence resync
+				break
+			}
+			if size == 0 || len(buf) < size {
+				break
+			}
+			frame := buf[:size]
+			buf = append([]byte(nil), buf[size:]...)
+			if crc16(frame[:size-2]) != uint16(frame[size-2])|uint16(frame[size-1])<<8 {
+				continue // a real slave ignores frames with a bad CRC
+			}
+			r := s.handle(frame[0], frame[1:size-2])
+			s.writeRTU(port, frame[0], r)
+		}
+	}
+}
+
+func (s *Server) writeRTU(port *os.File, unit byte, r reply) {
+	if r.fault.Delay > 0 {
+		time.Sleep(r.fault.Delay)
+	}
+	if r.pdu == nil || r.fault.Drop {
+		return
+	}
+	adu := append([]byte{unit}, r.pdu...)
+	crc := crc16(adu)
+	adu = append(adu, byte(crc), byte(crc>>8))
+	if r.fault.Garbage {
+		adu[len(adu)-1] ^= 0xFF
+		adu[len(adu)-2] ^= 0x5A
+	}
+	_, _ = port.Write(adu)
+}
+
+// rtuRequestLen returns the full length of the request frame at the start
+// of b, 0 when more bytes are needed to tell, or -1 for an unknown function.
+func rtuRequestLen(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	switch b[1] {
+	case 0x01, 0x02, 0x03, 0x04, 0x05, 0x06:
+		return 8
+	case 0x0F, 0x10:
+		if len(b) < 7 {
+			return 0
+		}
+		return 9 + int(b[6])
+	case 0x14, 0x15:
+		if len(b) < 3 {
+			return 0
+		}
+		return 5 + int(b[2])
+	}
+	return -1
+}
+
+// pollable re-wraps f around a non-blocking duplicate of its descriptor so
+// reads go through the runtime poller and Close interrupts a pending Read.
+func pollable(f *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "ptmx"), nil
+}
+
+func makeRaw(f *os.File) error {
+	var t syscall.Termios
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t))); e != 0 {
+		return e
+	}
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&t))); e != 0 {
+		return e
+	}
+	return nil
+}
+
+func crc16(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
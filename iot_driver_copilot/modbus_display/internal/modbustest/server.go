@@ -0,0 +1,298 @@
+// Package modbustest implements a scriptable Modbus slave for tests. One
+// Server holds a holding-register map and file records and can be exposed
+// over RTU (a pseudo terminal the driver opens like a serial adapter)
+// and/or Modbus TCP.
+// Faults queued with Script or returned from an OnRequest hook let tests
+// reproduce slow devices, exception replies, corrupt frames and silence.
+package modbustest
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	fcReadHoldingRegisters   = 0x03
+	fcReadInputRegisters     = 0x04
+	fcWriteSingleRegister    = 0x06
+	fcWriteMultipleRegisters = 0x10
+	fcReadFileRecord         = 0x14
+	fcWriteFileRecord        = 0x15
+)
+
+// Exception codes.
+const (
+	ExceptionIllegalFunction    byte = 0x01
+	ExceptionIllegalAddress     byte = 0x02
+	ExceptionIllegalValue       byte = 0x03
+	ExceptionSlaveDeviceFailure byte = 0x04
+	ExceptionSlaveDeviceBusy    byte = 0x06
+)
+
+// Request is a decoded request addressed to the server.
+type Request struct {
+	SlaveID  byte
+	Function byte
+	Address  uint16
+	Quantity uint16
+	Values   []uint16 // written values for function 6, 16 and 21
+	File     uint16   // file number for function 20 and 21 (Address holds the record)
+}
+
+// Fault describes how to misbehave when answering one request.
+type Fault struct {
+	Delay     time.Duration // wait before answering
+	Exception byte          // answer with this exception code instead of data
+	Garbage   bool          // answer with a corrupt frame
+	Drop      bool          // don't answer at all
+}
+
+// Server is a Modbus slave with a sparse register map and file records;
+// unset registers and records read as 0.
+type Server struct {
+	mu       sync.Mutex
+	slaveID  byte
+	regs     map[uint16]uint16
+	files    map[[2]uint16]uint16 // {file, record}
+	script   []Fault
+	hook     func(Request) *Fault
+	requests []Request
+
+	closeMu sync.Mutex
+	closers []io.Closer
+	wg      sync.WaitGroup
+}
+
+func NewServer(slaveID byte) *Server {
+	return &Server{slaveID: slaveID, regs: map[uint16]uint16{}, files: map[[2]uint16]uint16{}}
+}
+
+// SetSlaveID changes the unit id the server answers to.
+func (s *Server) SetSlaveID(id byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slaveID = id
+}
+
+func (s *Server) SetRegisters(addr uint16, vals ...uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, v := range vals {
+		s.regs[addr+uint16(i)] = v
+	}
+}
+
+func (s *Server) Registers(addr uint16, n int) []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]uint16, n)
+	for i := range out {
+		out[i] = s.regs[addr+uint16(i)]
+	}
+	return out
+}
+
+// FileRecords returns n records of file starting at record.
+func (s *Server) FileRecords(file, record uint16, n int) []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]uint16, n)
+	for i := range out {
+		out[i] = s.files[[2]uint16{file, record + uint16(i)}]
+	}
+	return out
+}
+
+// SetASCII stores text two characters per register, space padded to regs.
+func (s *Server) SetASCII(addr uint16, text string, regs int) {
+	buf := make([]byte, regs*2)
+	for i := range buf {
+		buf[i] = ' '
+	}
+	copy(buf, text)
+	vals := make([]uint16, regs)
+	for i := range vals {
+		vals[i] = binary.BigEndian.Uint16(buf[i*2:])
+	}
+	s.SetRegisters(addr, vals...)
+}
+
+// ASCII reads regs registers back as text, without trimming.
+func (s *Server) ASCII(addr uint16, regs int) string {
+	buf := make([]byte, regs*2)
+	for i, v := range s.Registers(addr, regs) {
+		binary.BigEndian.PutUint16(buf[i*2:], v)
+	}
+	return string(buf)
+}
+
+// Script queues faults applied to the next requests, one per request.
+func (s *Server) Script(faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = append(s.script, faults...)
+}
+
+// OnRequest installs a hook consulted for every request once the script is
+// exhausted; returning nil answers normally. Pass nil to remove it.
+func (s *Server) OnRequest(fn func(Request) *Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hook = fn
+}
+
+// Requests returns the requests received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Close stops every transport and waits for their goroutines.
+func (s *Server) Close() error {
+	s.closeMu.Lock()
+	closers := s.closers
+	s.closers = nil
+	s.closeMu.Unlock()
+	for _, c := range closers {
+		_ = c.Close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) track(c io.Closer) {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	s.closers = append(s.closers, c)
+}
+
+// reply is the outcome of handling one request PDU.
+type reply struct {
+	pdu   []byte // nil means no answer
+	fault Fault
+}
+
+// handle decodes pdu for unit and applies it to the register map.
+func (s *Server) handle(unit byte, pdu []byte) reply {
+	s.mu.Lock()
+	if unit != s.slaveID && unit != 0 {
+		s.mu.Unlock()
+		return reply{} // addressed to another slave on the bus
+	}
+	req, ok := decodeRequest(unit, pdu)
+	s.requests = append(s.requests, req)
+	var f Fault
+	if len(s.script) > 0 {
+		f = s.script[0]
+		s.script = s.script[1:]
+	} else if s.hook != nil {
+		hook := s.hook
+		s.mu.Unlock()
+		fp := hook(req)
+		s.mu.Lock()
+		if fp != nil {
+			f = *fp
+		}
+	}
+	defer s.mu.Unlock()
+
+	exc := f.Exception
+	if exc == 0 && !ok {
+		exc = ExceptionIllegalValue
+	}
+	switch req.Function {
+	case fcReadHoldingRegisters, fcReadInputRegisters, fcWriteSingleRegister, fcWriteMultipleRegisters,
+		fcReadFileRecord, fcWriteFileRecord:
+	default:
+		exc = ExceptionIllegalFunction
+	}
+	if exc != 0 {
+		return reply{pdu: []byte{req.Function | 0x80, exc}, fault: f}
+	}
+
+	var out []byte
+	switch req.Function {
+	case fcReadHoldingRegisters, fcReadInputRegisters:
+		out = make([]byte, 2+2*int(req.Quantity))
+		out[0] = req.Function
+		out[1] = byte(2 * req.Quantity)
+		for i := uint16(0); i < req.Quantity; i++ {
+			binary.BigEndian.PutUint16(out[2+2*i:], s.regs[req.Address+i])
+		}
+	case fcWriteSingleRegister, fcWriteMultipleRegisters:
+		for i, v := range req.Values {
+			s.regs[req.Address+uint16(i)] = v
+		}
+		out = append([]byte(nil), pdu[:5]...) // echo function, address and value/quantity
+	case fcReadFileRecord:
+		out = []byte{req.Function, byte(2 + 2*req.Quantity), byte(1 + 2*req.Quantity), 6}
+		for i := uint16(0); i < req.Quantity; i++ {
+			out = binary.BigEndian.AppendUint16(out, s.files[[2]uint16{req.File, req.Address + i}])
+		}
+	case fcWriteFileRecord:
+		for i, v := range req.Values {
+			s.files[[2]uint16{req.File, req.Address + uint16(i)}] = v
+		}
+		out = append([]byte(nil), pdu...)
+	}
+	if unit == 0 {
+		return reply{} // broadcasts are never answered
+	}
+	return reply{pdu: out, fault: f}
+}
+
+func decodeRequest(unit byte, pdu []byte) (Request, bool) {
+	req := Request{SlaveID: unit}
+	if len(pdu) == 0 {
+		return req, false
+	}
+	req.Function = pdu[0]
+	if len(pdu) < 5 {
+		return req, false
+	}
+	req.Address = binary.BigEndian.Uint16(pdu[1:])
+	switch req.Function {
+	case fcReadHoldingRegisters, fcReadInputRegisters:
+		req.Quantity = binary.BigEndian.Uint16(pdu[3:])
+		return req, req.Quantity >= 1 && req.Quantity <= 125
+	case fcWriteSingleRegister:
+		req.Quantity = 1
+		req.Values = []uint16{binary.BigEndian.Uint16(pdu[3:])}
+		return req, true
+	case fcWriteMultipleRegisters:
+		req.Quantity = binary.BigEndian.Uint16(pdu[3:])
+		if len(pdu) < 6 || int(pdu[5]) != 2*int(req.Quantity) || len(pdu) < 6+int(pdu[5]) ||
+			req.Quantity < 1 || req.Quantity > 123 {
+			return req, false
+		}
+		for i := 0; i < int(req.Quantity); i++ {
+			req.Values = append(req.Values, binary.BigEndian.Uint16(pdu[6+2*i:]))
+		}
+		return req, true
+	case fcReadFileRecord, fcWriteFileRecord:
+		// One sub-request: byte count, reference type 6, file, record, length[, data].
+		if len(pdu) < 9 || int(pdu[1]) != len(pdu)-2 || pdu[2] != 6 {
+			return req, false
+		}
+		req.File = binary.BigEndian.Uint16(pdu[3:])
+		req.Address = binary.BigEndian.Uint16(pdu[5:])
+		req.Quantity = binary.BigEndian.Uint16(pdu[7:])
+		if int(req.Address)+int(req.Quantity) > 10000 || req.Quantity < 1 {
+			return req, false
+		}
+		if req.Function == fcReadFileRecord {
+			return req, len(pdu) == 9 && req.Quantity <= 124
+		}
+		if len(pdu) != 9+2*int(req.Quantity) {
+			return req, false
+		}
+		for i := 0; i < int(req.Quantity); i++ {
+			req.Values = append(req.Values, binary.BigEndian.Uint16(pdu[9+2*i:]))
+		}
+		return req, true
+	}
+	return req, true
+}
@@ -0,0 +1,132 @@
+//go:build linux
+
+package modbustest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// newServer registers Close as a cleanup, so it runs after the client
+// cleanups registered later.
+func newServer(t *testing.T, slaveID byte) *Server {
+	t.Helper()
+	s := NewServer(slaveID)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func rtuClient(t *testing.T, s *Server) (modbus.Client, *modbus.RTUClientHandler) {
+	t.Helper()
+	path, err := s.ListenRTU()
+	if err != nil {
+		t.Fatalf("ListenRTU: %v", err)
+	}
+	h := modbus.NewRTUClientHandler(path)
+	h.BaudRate = 115200
+	h.SlaveId = 1
+	h.Timeout = 300 * time.Millisecond
+	if err := h.Connect(); err != nil {
+		t.Fatalf("connect %s: %v", path, err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return modbus.NewClient(h), h
+}
+
+func TestRTUReadWrite(t *testing.T) {
+	s := newServer(t, 1)
+	s.SetRegisters(10, 0x1234, 0xBEEF)
+	c, _ := rtuClient(t, s)
+
+	b, err := c.ReadHoldingRegisters(10, 2)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if want := []byte{0x12, 0x34, 0xBE, 0xEF}; string(b) != string(want) {
+		t.Fatalf("read = % x, want % x", b, want)
+	}
+	if _, err := c.WriteMultipleRegisters(20, 2, []byte("HI!!")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := s.ASCII(20, 2); got != "HI!!" {
+		t.Fatalf("registers = %q, want %q", got, "HI!!")
+	}
+	if _, err := c.WriteSingleRegister(5, 42); err != nil {
+		t.Fatalf("write single: %v", err)
+	}
+	if got := s.Registers(5, 1)[0]; got != 42 {
+		t.Fatalf("register 5 = %d, want 42", got)
+	}
+}
+
+func TestRTUFaults(t *testing.T) {
+	s := newServer(t, 1)
+	c, _ := rtuClient(t, s)
+
+	s.Script(Fault{Exception: ExceptionSlaveDeviceBusy})
+	_, err := c.ReadHoldingRegisters(0, 1)
+	var mbErr *modbus.ModbusError
+	if !errors.As(err, &mbErr) || mbErr.ExceptionCode != ExceptionSlaveDeviceBusy {
+		t.Fatalf("exception fault: err = %v", err)
+	}
+
+	s.Script(Fault{Garbage: true})
+	if _, err := c.ReadHoldingRegisters(0, 1); err == nil {
+		t.Fatal("garbage fault: expected an error")
+	}
+
+	s.Script(Fault{Drop: true})
+	if _, err := c.ReadHoldingRegisters(0, 1); err == nil {
+		t.Fatal("drop fault: expected a timeout")
+	}
+
+	if _, err := c.ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatalf("read after faults: %v", err)
+	}
+}
+
+func TestOtherSlaveIgnored(t *testing.T) {
+	s := newServer(t, 2)
+	c, _ := rtuClient(t, s) // addresses slave 1
+	if _, err := c.ReadHoldingRegisters(0, 1); err == nil {
+		t.Fatal("expected no answer for a different slave id")
+	}
+	if n := len(s.Requests()); n != 0 {
+		t.Fatalf("recorded %d requests for another slave", n)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	s := newServer(t, 1)
+	addr, err := s.ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	h := modbus.NewTCPClientHandler(addr)
+	h.SlaveId = 1
+	h.Timeout = 300 * time.Millisecond
+	t.Cleanup(func() { h.Close() })
+	c := modbus.NewClient(h)
+
+	if _, err := c.WriteSingleRegister(3, 7); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	b, err := c.ReadHoldingRegisters(3, 1)
+	if err != nil || len(b) != 2 || b[1] != 7 {
+		t.Fatalf("read = % x, %v", b, err)
+	}
+
+	s.OnRequest(func(r Request) *Fault {
+		if r.Address == 99 {
+			return &Fault{Exception: ExceptionIllegalAddress}
+		}
+		return nil
+	})
+	var mbErr *modbus.ModbusError
+	if _, err := c.ReadHoldingRegisters(99, 1); !errors.As(err, &mbErr) || mbErr.ExceptionCode != ExceptionIllegalAddress {
+		t.Fatalf("hook exception: err = %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package modbustest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// ListenTCP exposes the server as a Modbus TCP slave on addr (use
+// "127.0.0.1:0" for an ephemeral port) and returns the bound address.
+func (s *Server) ListenTCP(addr string) (string, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	s.track(ln)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.track(conn)
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer conn.Close()
+				s.serveTCP(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String(), nil
+}
+
+func (s *Server) serveTCP(conn net.Conn) {
+	header := make([]byte, 7)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if length < 2 || length > 254 {
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		r := s.handle(header[6], pdu)
+		if r.fault.Delay > 0 {
+			time.Sleep(r.fault.Delay)
+		}
+		if r.pdu == nil || r.fault.Drop {
+			continue
+		}
+		adu := make([]byte, 7, 7+len(r.pdu))
+		copy(adu, header[:4])
+		binary.BigEndian.PutUint16(adu[4:], uint16(len(r.pdu)+1))
+		adu[6] = header[6]
+		adu = append(adu, r.pdu...)
+		if r.fault.Garbage {
+			// A mismatched transaction id makes the client reject the frame.
+			adu[1] ^= 0xFF
+		}
+		if _, err := conn.Write(adu); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Request bodies are read through decodeJSON: at most MAX_REQUEST_BODY_BYTES
+// (default 64 KiB, 413 beyond that), one JSON value and nothing after it,
+// and no fields the endpoint doesn't know (400 naming the field), so a typo
+// such as "blink_perod_ms" is reported instead of silently ignored.
+// POST /firmware takes raw bytes and has FIRMWARE_MAX_BYTES instead.
+
+const defaultMaxRequestBody = 64 << 10
+
+// decodeJSON decodes r's body into v, replying with the error and returning
+// false when it can't.
+func (d *ModbusDriver) decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	limit := d.cfg.MaxRequestBody
+	if limit <= 0 {
+		limit = defaultMaxRequestBody
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the JSON value")
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("request body larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, io.EOF):
+		http.Error(w, "invalid json: empty body", http.StatusBadRequest)
+	default:
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+	}
+	return false
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Single sign-on: with JWT_JWKS_URL set the driver also accepts JWTs from
+// the identity provider, wherever it takes an API key. A token must be
+// signed by a key of the JWKS (RS*, PS* or ES*), come from JWT_ISSUER, name
+// JWT_AUDIENCE and be unexpired, with a minute's leeway for clock skew.
+// JWT_ROLES_CLAIM (default "roles", a dotted path such as
+// realm_access.roles for nested claims) holds the user's roles or groups,
+// and JWT_ROLE_MAP turns them into the driver's, as ';'-separated
+// value=admin or value=<tenant> entries:
+//
+//	JWT_ROLE_MAP=display-admins=admin;line-a-operators=line-a
+//
+// admin is what the ADMIN_TOKEN may do; a tenant is what that tenant's keys
+// may do. A token mapping to no role, or to several tenants, is refused.
+// Nothing is stored per user: access ends when the provider stops issuing
+// tokens, at the latest when the last one expires. Keys are fetched on first
+// use, refreshed every JWT_JWKS_REFRESH_MS and refetched (at most twice a
+// minute) when a token names a key id the driver hasn't seen, so the
+// provider can rotate keys without a restart.
+
+const (
+	jwtLeeway       = time.Minute
+	jwksMinRefetch  = 30 * time.Second // between fetches for an unknown key id
+	jwtAdminRole    = "admin"
+	jwksMaxBodySize = 256 << 10
+)
+
+var (
+	errJWTInvalid = errors.New("invalid token")
+	errJWTNoRole  = errors.New("token grants no role on this driver")
+)
+
+type jwtIdentity struct {
+	Admin  bool
+	Tenant string
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwksKey struct {
+	alg string // "" when the JWKS doesn't pin one
+	pub crypto.PublicKey
+}
+
+type jwtVerifier struct {
+	issuer, audience string
+	rolesClaim       string
+	roles            map[string]string // claim value -> "admin" or tenant
+	url              string
+	refresh          time.Duration
+	client           *http.Client
+
+	mu      sync.Mutex // held across a fetch so concurrent requests share it
+	keys    map[string]jwksKey
+	fetched time.Time // last successful fetch
+	tried   time.Time // last attempt
+}
+
+func newJWTVerifier(cfg Config) *jwtVerifier {
+	return &jwtVerifier{
+		issuer: cfg.JWTIssuer, audience: cfg.JWTAudience, rolesClaim: cfg.JWTRolesClaim, roles: cfg.JWTRoles,
+		url: cfg.JWTJWKSURL, refresh: cfg.JWTJWKSRefresh, client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// parseJWTRoleMap reads JWT_ROLE_MAP into claim value -> role.
+func parseJWTRoleMap(raw string) (map[string]string, error) {
+	roles := map[string]string{}
+	for _, entry := range strings.Split(raw, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		value, role, ok := strings.Cut(entry, "=")
+		value, role = strings.TrimSpace(value), strings.TrimSpace(role)
+		if !ok || value == "" || role == "" {
+			return nil, fmt.Errorf("malformed entry %q (expected value=admin or value=tenant)", entry)
+		}
+		if _, dup := roles[value]; dup {
+			return nil, fmt.Errorf("%s mapped twice", value)
+		}
+		roles[value] = role
+	}
+	return roles, nil
+}
+
+// grantsAdmin reports whether some claim value maps to admin.
+func (v *jwtVerifier) grantsAdmin() bool {
+	for _, role := range v.roles {
+		if role == jwtAdminRole {
+			return true
+		}
+	}
+	return false
+}
+
+// looksLikeJWT tells a compact JWS apart from a static API key.
+func looksLikeJWT(s string) bool {
+	return strings.Count(s, ".") == 2 && strings.HasPrefix(s, "eyJ")
+}
+
+// identify verifies token and maps its roles claim to the driver's roles.
+func (v *jwtVerifier) identify(ctx context.Context, token string) (jwtIdentity, error) {
+	claims, err := v.verify(ctx, token, time.Now())
+	if err != nil {
+		return jwtIdentity{}, err
+	}
+	var id jwtIdentity
+	tenants := map[string]bool{}
+	for _, value := range claimStrings(claims, v.rolesClaim) {
+		switch role, ok := v.roles[value]; {
+		case !ok:
+		case role == jwtAdminRole:
+			id.Admin = true
+		default:
+			tenants[role] = true
+		}
+	}
+	if id.Admin {
+		return id, nil
+	}
+	if len(tenants) > 1 {
+		return id, fmt.Errorf("%w: roles map to %d tenants", errJWTNoRole, len(tenants))
+	}
+	for t := range tenants {
+		id.Tenant = t
+	}
+	if id.Tenant == "" {
+		return id, errJWTNoRole
+	}
+	return id, nil
+}
+
+// claimStrings returns the strings at a dotted claim path: an array of
+// strings, or a space-separated string as in the OAuth scope claim.
+func claimStrings(claims map[string]interface{}, path string) []string {
+	var cur interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = m[name]
+	}
+	switch c := cur.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		var out []string
+		for _, e := range c {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// verify checks the signature and the registered claims of a compact JWS
+// and returns its claims.
+func (v *jwtVerifier) verify(ctx context.Context, token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a compact JWS", errJWTInvalid)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", errJWTInvalid, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", errJWTInvalid, err)
+	}
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.alg != "" && key.alg != header.Alg {
+		return nil, fmt.Errorf("%w: key %q is for %s, token uses %s", errJWTInvalid, header.Kid, key.alg, header.Alg)
+	}
+	if err := verifyJWS(header.Alg, key.pub, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", errJWTInvalid, err)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", errJWTInvalid, err)
+	}
+	if iss, _ := claims["iss"].(string); v.issuer == "" || iss != v.issuer {
+		return nil, fmt.Errorf("%w: issuer %q", errJWTInvalid, iss)
+	}
+	if v.audience == "" || !containsString(claimAudience(claims["aud"]), v.audience) {
+		return nil, fmt.Errorf("%w: audience %v is not %s", errJWTInvalid, claims["aud"], v.audience)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("%w: no exp claim", errJWTInvalid)
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("%w: expired", errJWTInvalid)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("%w: not valid yet", errJWTInvalid)
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// claimAudience reads aud, which is a string or an array of strings.
+func claimAudience(aud interface{}) []string {
+	switch a := aud.(type) {
+	case string:
+		return []string{a}
+	case []interface{}:
+		var out []string
+		for _, e := range a {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJWS checks sig over signed. "none" and the HMAC algorithms are
+// refused: the driver holds no shared secret with the provider.
+func verifyJWS(alg string, pub crypto.PublicKey, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch alg[:2] {
+	case "RS", "PS":
+		k, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an RSA key", alg)
+		}
+		if alg[0] == 'R' {
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		}
+		return rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		k, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s needs an EC key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("malformed ECDSA signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported alg %q", alg)
+}
+
+// key returns the signing key kid, fetching the JWKS when it is stale or
+// doesn't have kid. A token without kid is accepted when the set holds a
+// single key.
+func (v *jwtVerifier) key(ctx context.Context, kid string) (jwksKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	k, known := v.lookup(kid)
+	stale := now.Sub(v.fetched) >= v.refresh
+	if (stale || !known) && (v.tried.IsZero() || now.Sub(v.tried) >= jwksMinRefetch) {
+		v.tried = now
+		keys, err := v.fetch(ctx)
+		if err != nil {
+			// Keep going on the keys we have; the provider may be restarting.
+			if !known {
+				return jwksKey{}, fmt.Errorf("JWKS: %w", err)
+			}
+			return k, nil
+		}
+		v.keys, v.fetched = keys, now
+		k, known = v.lookup(kid)
+	}
+	if !known {
+		return jwksKey{}, fmt.Errorf("%w: unknown key id %q", errJWTInvalid, kid)
+	}
+	return k, nil
+}
+
+func (v *jwtVerifier) lookup(kid string) (jwksKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+	k, ok := v.keys[kid]
+	return k, ok
+}
+
+func (v *jwtVerifier) fetch(ctx context.Context) (map[string]jwksKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "modbus-display-driver/"+version)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, jwksMaxBodySize)).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]jwksKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of other types (or broken ones) are skipped, not fatal: one
+		// odd key must not lock everybody out.
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = jwksKey{alg: k.Alg, pub: pub}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("key %q: malformed parameter", k.Kid)
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := num(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := num(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("key %q: unsupported exponent", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("key %q: unsupported curve %q", k.Kid, k.Crv)
+		}
+		x, err := num(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := num(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("key %q: point not on curve", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("key %q: unsupported type %q", k.Kid, k.Kty)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIdP serves a JWKS and signs tokens with its keys.
+type testIdP struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]crypto.Signer
+	fetches atomic.Int32
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+	idp := &testIdP{keys: map[string]crypto.Signer{}}
+	idp.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idp.fetches.Add(1)
+		idp.mu.Lock()
+		defer idp.mu.Unlock()
+		b64 := func(n *big.Int, size int) string {
+			return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, size)))
+		}
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, k := range idp.keys {
+			switch pub := k.Public().(type) {
+			case *rsa.PublicKey:
+				set.Keys = append(set.Keys, jwk{Kty: "RSA", Kid: kid, Use: "sig", N: b64(pub.N, pub.Size()), E: b64(big.NewInt(int64(pub.E)), 3)})
+			case *ecdsa.PublicKey:
+				set.Keys = append(set.Keys, jwk{Kty: "EC", Kid: kid, Crv: "P-256", X: b64(pub.X, 32), Y: b64(pub.Y, 32)})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *testIdP) addKey(t *testing.T, kid string, ec bool) {
+	t.Helper()
+	var k crypto.Signer
+	var err error
+	if ec {
+		k, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		k, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.keys[kid] = k
+	idp.mu.Unlock()
+}
+
+// sign issues a token signed with key kid; claims default to a valid
+// admin token.
+func (idp *testIdP) sign(t *testing.T, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	idp.mu.Lock()
+	k := idp.keys[kid]
+	idp.mu.Unlock()
+	alg := "RS256"
+	if _, ok := k.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	enc := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	full := map[string]interface{}{"iss": "https://idp.example", "aud": "modbus-display", "exp": time.Now().Add(time.Hour).Unix(), "roles": []string{"display-admins"}}
+	for name, v := range claims {
+		if v == nil {
+			delete(full, name)
+		} else {
+			full[name] = v
+		}
+	}
+	signed := enc(map[string]string{"alg": alg, "typ": "JWT", "kid": kid}) + "." + enc(full)
+	digest := crypto.SHA256.New()
+	digest.Write([]byte(signed))
+	var sig []byte
+	var err error
+	if ec, ok := k.(*ecdsa.PrivateKey); ok {
+		// JWS wants the fixed-size r||s, not ASN.1.
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, ec, digest.Sum(nil)); err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	} else {
+		sig, err = k.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func testJWTVerifier(idp *testIdP) *jwtVerifier {
+	return newJWTVerifier(Config{
+		JWTJWKSURL: idp.URL, JWTIssuer: "https://idp.example", JWTAudience: "modbus-display", JWTRolesClaim: "roles",
+		JWTRoles:       map[string]string{"display-admins": "admin", "line-a-ops": "line-a", "line-b-ops": "line-b"},
+		JWTJWKSRefresh: time.Hour,
+	})
+}
+
+func TestJWTIdentify(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.addKey(t, "rsa", false)
+	idp.addKey(t, "ec", true)
+	v := testJWTVerifier(idp)
+
+	for _, tt := range []struct {
+		name    string
+		kid     string
+		claims  map[string]interface{}
+		want    jwtIdentity
+		wantErr error
+	}{
+		{"admin", "rsa", nil, jwtIdentity{Admin: true}, nil},
+		{"ec key", "ec", nil, jwtIdentity{Admin: true}, nil},
+		{"tenant", "rsa", map[string]interface{}{"roles": []string{"staff", "line-a-ops"}}, jwtIdentity{Tenant: "line-a"}, nil},
+		{"admin wins", "rsa", map[string]interface{}{"roles": []string{"line-a-ops", "display-admins"}}, jwtIdentity{Admin: true}, nil},
+		{"audience list", "rsa", map[string]interface{}{"aud": []string{"other", "modbus-display"}}, jwtIdentity{Admin: true}, nil},
+		{"within leeway", "rsa", map[string]interface{}{"exp": time.Now().Add(-30 * time.Second).Unix()}, jwtIdentity{Admin: true}, nil},
+		{"no role", "rsa", map[string]interface{}{"roles": []string{"staff"}}, jwtIdentity{}, errJWTNoRole},
+		{"two tenants", "rsa", map[string]interface{}{"roles": []string{"line-a-ops", "line-b-ops"}}, jwtIdentity{}, errJWTNoRole},
+		{"wrong issuer", "rsa", map[string]interface{}{"iss": "https://evil.example"}, jwtIdentity{}, errJWTInvalid},
+		{"no issuer", "rsa", map[string]interface{}{"iss": nil}, jwtIdentity{}, errJWTInvalid},
+		{"no audience", "rsa", map[string]interface{}{"aud": nil}, jwtIdentity{}, errJWTInvalid},
+		{"wrong audience", "rsa", map[string]interface{}{"aud": "other"}, jwtIdentity{}, errJWTInvalid},
+		{"expired", "rsa", map[string]interface{}{"exp": time.Now().Add(-5 * time.Minute).Unix()}, jwtIdentity{}, errJWTInvalid},
+		{"no exp", "rsa", map[string]interface{}{"exp": nil}, jwtIdentity{}, errJWTInvalid},
+		{"not yet valid", "rsa", map[string]interface{}{"nbf": time.Now().Add(10 * time.Minute).Unix()}, jwtIdentity{}, errJWTInvalid},
+	} {
+		got, err := v.identify(context.Background(), idp.sign(t, tt.kid, tt.claims))
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("%s: got %+v, %v; want %+v, %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// A verifier missing its issuer or audience accepts nothing, not
+	// tokens that leave the claim out.
+	open := testJWTVerifier(idp)
+	open.issuer, open.audience = "", ""
+	if _, err := open.identify(context.Background(), idp.sign(t, "rsa", map[string]interface{}{"iss": nil, "aud": nil})); !errors.Is(err, errJWTInvalid) {
+		t.Errorf("verifier without issuer: err = %v, want invalid token", err)
+	}
+
+	tok := idp.sign(t, "rsa", nil)
+	claims := strings.Split(tok, ".")[1]
+	for name, bad := range map[string]string{
+		"tampered":    tok[:len(tok)-4] + "AAAA",
+		"alg none":    base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + claims + ".",
+		"alg HS256":   base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"rsa"}`)) + "." + claims + ".AA",
+		"garbage":     "eyJ.x.y",
+		"unknown kid": base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"nope"}`)) + "." + claims + ".AA",
+	} {
+		if _, err := v.identify(context.Background(), bad); !errors.Is(err, errJWTInvalid) {
+			t.Errorf("%s: err = %v, want invalid token", name, err)
+		}
+	}
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	idp := newTestIdP(t)
+	idp.addKey(t, "k1", false)
+	v := testJWTVerifier(idp)
+	if _, err := v.identify(context.Background(), idp.sign(t, "k1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	// A key published after the last fetch is picked up once the refetch
+	// throttle allows it.
+	idp.addKey(t, "k2", true)
+	v.mu.Lock()
+	v.tried = time.Now().Add(-jwksMinRefetch)
+	v.mu.Unlock()
+	if _, err := v.identify(context.Background(), idp.sign(t, "k2", nil)); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+	// Unknown key ids don't hammer the provider.
+	before := idp.fetches.Load()
+	unknown := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"nope"}`)) + ".e30.AA"
+	for i := 0; i < 5; i++ {
+		if _, err := v.identify(context.Background(), unknown); !errors.Is(err, errJWTInvalid) {
+			t.Fatalf("unknown kid: err = %v", err)
+		}
+	}
+	if n := idp.fetches.Load() - before; n != 0 {
+		t.Errorf("%d JWKS fetches for unknown key ids within the throttle", n)
+	}
+}
+
+func TestParseJWTRoleMap(t *testing.T) {
+	got, err := parseJWTRoleMap(" display-admins=admin; line-a-ops = line-a ;")
+	if err != nil || len(got) != 2 || got["display-admins"] != "admin" || got["line-a-ops"] != "line-a" {
+		t.Errorf("got %v, %v", got, err)
+	}
+	for _, bad := range []string{"admins", "=admin", "a=admin;a=line-a"} {
+		if _, err := parseJWTRoleMap(bad); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestClaimStrings(t *testing.T) {
+	var claims map[string]interface{}
+	_ = json.Unmarshal([]byte(`{"scope":"read write","realm_access":{"roles":["a","b",3]}}`), &claims)
+	if got := claimStrings(claims, "realm_access.roles"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("nested: %v", got)
+	}
+	if got := claimStrings(claims, "scope"); len(got) != 2 || got[1] != "write" {
+		t.Errorf("scope: %v", got)
+	}
+	if got := claimStrings(claims, "scope.x"); got != nil {
+		t.Errorf("path through a string: %v", got)
+	}
+}
+
+func TestJWTConfigNeedsIssuerAndAudience(t *testing.T) {
+	defer func(f func(string, ...interface{})) { configFatalf = f }(configFatalf)
+	var fatal []string
+	configFatalf = func(format string, args ...interface{}) { fatal = append(fatal, fmt.Sprintf(format, args...)) }
+	t.Setenv("JWT_JWKS_URL", "https://idp.example/jwks")
+	t.Setenv("JWT_ROLE_MAP", "display-admins=admin")
+	t.Setenv("JWT_AUDIENCE", "modbus-display")
+	LoadConfig()
+	if !strings.Contains(strings.Join(fatal, "\n"), "JWT_ISSUER and JWT_AUDIENCE") {
+		t.Errorf("JWT_JWKS_URL without JWT_ISSUER: %q", fatal)
+	}
+	fatal = nil
+	t.Setenv("JWT_ISSUER", "https://idp.example")
+	LoadConfig()
+	if strings.Contains(strings.Join(fatal, "\n"), "JWT_ISSUER") {
+		t.Errorf("JWT_ISSUER and JWT_AUDIENCE set: %q", fatal)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+)
+
+// serialLink is the transport under the Modbus client. It adds what some
+// USB RS-485 adapters need on top of the library's RTU transport:
+//
+//   - MODBUS_MIN_GAP_MS: a minimum silence between the end of one
+//     transaction and the start of the next, for slaves that miss a
+//     request sent right after their last reply.
+//   - RS485_SOFTWARE_RTS: direction control by toggling RTS around each
+//     request from the driver, for adapters whose kernel driver lacks
+//     RS-485 mode (RS485_ENABLED). It uses the same RS485_DELAY_* and
+//     RS485_RTS_* settings, waits for the request to leave the UART before
+//     releasing the bus, and opens the port itself instead of letting the
+//     handler do it.
+//   - SERIAL_LOCK_FILE: an flock(2) held for each transaction, for sharing
+//     the port with other programs (buslock.go).
+//
+// The handler still frames requests (slave id, CRC) and holds the line
+// settings the port is opened with.
+type serialLink struct {
+	h       *modbus.RTUClientHandler
+	next    modbus.Transporter // the handler's own transport, unless software RTS
+	gap     time.Duration
+	lastEnd time.Time
+	lock    *busLock // nil unless SERIAL_LOCK_FILE is set
+
+	softRTS bool
+	port    io.ReadWriteCloser // software RTS: the port, opened here
+	ctl     *os.File           // software RTS: a second descriptor for modem-control ioctls
+}
+
+func newSerialLink(h *modbus.RTUClientHandler, cfg Config, lock *busLock) *serialLink {
+	return &serialLink{h: h, next: h, gap: cfg.ModbusMinGap, softRTS: cfg.RS485SoftwareRTS, lock: lock}
+}
+
+func (l *serialLink) Connect() error {
+	if !l.softRTS {
+		return l.h.Connect()
+	}
+	if l.port != nil {
+		return nil
+	}
+	c := l.h.Config
+	c.RS485.Enabled = false // the driver does the switching
+	port, err := serial.Open(&c)
+	if err != nil {
+		return err
+	}
+	ctl, err := os.OpenFile(c.Address, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		port.Close()
+		return err
+	}
+	l.port, l.ctl = port, ctl
+	if err := l.setRTS(false); err != nil {
+		l.Close()
+		return fmt.Errorf("RTS control on %s: %w", c.Address, err)
+	}
+	return nil
+}
+
+func (l *serialLink) Close() error {
+	if !l.softRTS {
+		return l.h.Close()
+	}
+	if l.port == nil {
+		return nil
+	}
+	l.ctl.Close()
+	err := l.port.Close()
+	l.port, l.ctl = nil, nil
+	return err
+}
+
+func (l *serialLink) Send(adu []byte) ([]byte, error) {
+	if err := l.lock.acquire(); err != nil {
+		return nil, err
+	}
+	defer l.lock.release()
+	if wait := l.gap - time.Since(l.lastEnd); wait > 0 {
+		time.Sleep(wait)
+	}
+	defer func() { l.lastEnd = time.Now() }()
+	if !l.softRTS {
+		return l.next.Send(adu)
+	}
+	if err := l.Connect(); err != nil {
+		return nil, err
+	}
+	return l.sendSoftRTS(adu)
+}
+
+// setRTS sets RTS to its level while sending or after it. As with the
+// kernel's RS-485 mode, RTS is raised during send when neither level is set.
+func (l *serialLink) setRTS(sending bool) error {
+	rs := l.h.RS485
+	high := rs.RtsHighAfterSend
+	if sending {
+		high = rs.RtsHighDuringSend || !rs.RtsHighAfterSend
+	}
+	req := uintptr(syscall.TIOCMBIC)
+	if high {
+		req = syscall.TIOCMBIS
+	}
+	bits := int32(syscall.TIOCM_RTS)
+	return ioctl(l.ctl.Fd(), req, uintptr(unsafe.Pointer(&bits)))
+}
+
+const tcsbrk = 0x5409 // TCSBRK with a non-zero argument is tcdrain(3)
+
+// writeDirected writes p with the bus turned around by RTS, holding it
+// until p has left the UART.
+func (l *serialLink) writeDirected(p []byte) (int, error) {
+	if err := l.setRTS(true); err != nil {
+		return 0, err
+	}
+	time.Sleep(l.h.RS485.DelayRtsBeforeSend)
+	n, err := l.port.Write(p)
+	if err == nil {
+		err = ioctl(l.ctl.Fd(), tcsbrk, 1)
+	}
+	time.Sleep(l.h.RS485.DelayRtsAfterSend)
+	if rerr := l.setRTS(false); err == nil {
+		err = rerr
+	}
+	return n, err
+}
+
+// directedPort is the link's port with writes going through writeDirected,
+// for the firmware upload's own RTU framing.
+type directedPort struct{ l *serialLink }
+
+func (p directedPort) Read(b []byte) (int, error)  { return p.l.port.Read(b) }
+func (p directedPort) Write(b []byte) (int, error) { return p.l.writeDirected(b) }
+func (p directedPort) Close() error                { return p.l.Close() }
+
+func (l *serialLink) sendSoftRTS(adu []byte) ([]byte, error) {
+	if _, err := l.writeDirected(adu); err != nil {
+		return nil, err
+	}
+
+	want := rtuResponseLength(adu)
+	buf := make([]byte, 256)
+	n, err := io.ReadAtLeast(l.port, buf, 5)
+	if err != nil {
+		return nil, err
+	}
+	if buf[1] == adu[1]|0x80 {
+		want = 5
+	}
+	if n < want {
+		m, err := io.ReadFull(l.port, buf[n:want])
+		n += m
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf[:n], nil
+}
+
+// rtuResponseLength is the full reply length, CRC included, for the
+// function codes the driver issues; 5 (an exception) when unknown.
+func rtuResponseLength(adu []byte) int {
+	switch adu[1] {
+	case 0x03, 0x04, 0x17: // read holding/input registers, read/write multiple
+		return 5 + 2*int(binary.BigEndian.Uint16(adu[4:]))
+	case 0x01, 0x02: // read coils/discrete inputs
+		return 5 + (int(binary.BigEndian.Uint16(adu[4:]))+7)/8
+	case 0x05, 0x06, 0x0F, 0x10: // writes echo address and value/count
+		return 8
+	case 0x16: // mask write register
+		return 10
+	}
+	return 5
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type timedTransporter struct{ sent []time.Time }
+
+func (t *timedTransporter) Send(adu []byte) ([]byte, error) {
+	t.sent = append(t.sent, time.Now())
+	return adu, nil
+}
+
+func TestSerialLinkMinGap(t *testing.T) {
+	const gap = 30 * time.Millisecond
+	next := &timedTransporter{}
+	l := &serialLink{next: next, gap: gap}
+	for i := 0; i < 3; i++ {
+		if _, err := l.Send([]byte{1, 3, 0, 0, 0, 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i < len(next.sent); i++ {
+		if d := next.sent[i].Sub(next.sent[i-1]); d < gap {
+			t.Errorf("request %d sent %v after the previous one, want >= %v", i, d, gap)
+		}
+	}
+}
+
+func TestSerialLinkNoGap(t *testing.T) {
+	next := &timedTransporter{}
+	l := &serialLink{next: next}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		l.Send([]byte{1, 3, 0, 0, 0, 1})
+	}
+	if d := time.Since(start); d > 20*time.Millisecond {
+		t.Errorf("10 requests took %v without a gap", d)
+	}
+}
+
+func TestSerialLinkBusLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bus.lock")
+	next := &timedTransporter{}
+	l := &serialLink{next: next, lock: newBusLock(path, 100*time.Millisecond)}
+	if _, err := l.Send([]byte{1, 3, 0, 0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another program takes the lock: the driver waits for it, and gives up
+	// after SERIAL_LOCK_TIMEOUT_MS.
+	other, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("driver kept the lock between transactions: %v", err)
+	}
+	if _, err := l.Send([]byte{1, 3, 0, 0, 0, 1}); !errors.Is(err, errBusLockTimeout) {
+		t.Fatalf("Send while locked: %v", err)
+	}
+	released := time.Now().Add(50 * time.Millisecond)
+	fd, unlocked := int(other.Fd()), make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() {
+		syscall.Flock(fd, syscall.LOCK_UN)
+		close(unlocked)
+	})
+	// other must stay open until the unlock has run.
+	defer func() { <-unlocked }()
+	if _, err := l.Send([]byte{1, 3, 0, 0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if sent := next.sent[len(next.sent)-1]; len(next.sent) != 2 || sent.Before(released) {
+		t.Errorf("%d requests sent, the last at %v before the lock was released", len(next.sent), released.Sub(sent))
+	}
+	if n := l.lock.timeoutCount(); n != 1 {
+		t.Errorf("timeouts = %d", n)
+	}
+}
+
+func TestRTUResponseLength(t *testing.T) {
+	for _, tc := range []struct {
+		adu  []byte
+		want int
+	}{
+		{[]byte{1, 0x03, 0, 0x10, 0, 4, 0, 0}, 13},
+		{[]byte{1, 0x04, 0, 0, 0, 1, 0, 0}, 7},
+		{[]byte{1, 0x01, 0, 0, 0, 9, 0, 0}, 7},
+		{[]byte{1, 0x06, 0, 1, 0, 2, 0, 0}, 8},
+		{[]byte{1, 0x10, 0, 1, 0, 2, 4, 0, 0, 0, 0, 0, 0}, 8},
+		{[]byte{1, 0x16, 0, 1, 0xff, 0, 0, 1, 0, 0}, 10},
+		{[]byte{1, 0x2b, 0x0e, 1, 0, 0, 0}, 5},
+	} {
+		if got := rtuResponseLength(tc.adu); got != tc.want {
+			t.Errorf("function %#x: got %d, want %d", tc.adu[1], got, tc.want)
+		}
+	}
+}
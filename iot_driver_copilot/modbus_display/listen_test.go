@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseListen(t *testing.T) {
+	for _, tc := range []struct {
+		spec, network, addr string
+		bad                 bool
+	}{
+		{spec: "unix:///run/copilot/display.sock", network: "unix", addr: "/run/copilot/display.sock"},
+		{spec: "tcp://127.0.0.1:8080", network: "tcp", addr: "127.0.0.1:8080"},
+		{spec: "0.0.0.0:8080", network: "tcp", addr: "0.0.0.0:8080"},
+		{spec: ":8080", network: "tcp", addr: ":8080"},
+		{spec: "tcp://[::]:8080", network: "tcp", addr: "[::]:8080"},
+		{spec: "tcp6://[::]:8080", network: "tcp6", addr: "[::]:8080"},
+		{spec: "tcp4://0.0.0.0:8080", network: "tcp4", addr: "0.0.0.0:8080"},
+		{spec: "tcp://[fe80::1%eth0]:8080", network: "tcp", addr: "[fe80::1%eth0]:8080"},
+		{spec: "tcp://::1:8080", bad: true},
+		{spec: "udp://[::]:8080", bad: true},
+		{spec: "unix://run/display.sock", bad: true},
+		{spec: "http://localhost:8080", bad: true},
+		{spec: "tcp://localhost", bad: true},
+	} {
+		network, addr, err := parseListen(tc.spec)
+		if tc.bad {
+			if err == nil {
+				t.Errorf("parseListen(%q) = %s %s, want error", tc.spec, network, addr)
+			}
+			continue
+		}
+		if err != nil || network != tc.network || addr != tc.addr {
+			t.Errorf("parseListen(%q) = %s %s %v, want %s %s", tc.spec, network, addr, err, tc.network, tc.addr)
+		}
+	}
+}
+
+func TestHTTPAddr(t *testing.T) {
+	for host, want := range map[string]string{
+		"0.0.0.0": "0.0.0.0:8080", "": ":8080", "::": "[::]:8080", "[::]": "[::]:8080", "fe80::1%eth0": "[fe80::1%eth0]:8080",
+	} {
+		if got := (Config{HTTPHost: host, HTTPPort: 8080}).HTTPAddr(); got != want {
+			t.Errorf("HTTP_HOST=%s: HTTPAddr() = %s, want %s", host, got, want)
+		}
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	if _, err := listenTCP("tcp", "[fe80::1]:0", ""); err == nil || !strings.Contains(err.Error(), "needs a zone") {
+		t.Errorf("link-local without zone: err = %v", err)
+	}
+	ln, err := listenTCP("tcp", "127.0.0.1:0", "lo")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("SO_BINDTODEVICE not permitted")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial listener bound to lo: %v", err)
+	}
+	c.Close()
+	if ln6, err := listenTCP("tcp6", "[::1]:0", ""); err == nil {
+		ln6.Close()
+	} else if !strings.Contains(err.Error(), "cannot assign") {
+		t.Errorf("listen on [::1]: %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "display.sock")
+	ln, err := listenUnix(path, socketPerms{Mode: 0o660})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o660 {
+		t.Errorf("socket mode = %o, want 660", fi.Mode().Perm())
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, r.URL.Path) })}
+	go srv.Serve(ln)
+
+	client, base := cliClient("unix://"+path, 5*time.Second)
+	resp, err := client.Get(base + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "/status" {
+		t.Errorf("body = %q", body)
+	}
+
+	if _, err := listenUnix(path, socketPerms{Mode: 0o660}); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("second listener on a live socket: %v", err)
+	}
+	srv.Close()
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "display.sock")
+	// A socket file with nobody accepting on it, as a crash leaves behind.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(path, socketPerms{Mode: 0o600})
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	ln.Close()
+
+	file := filepath.Join(dir, "not-a-socket")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnix(file, socketPerms{Mode: 0o600}); err == nil {
+		t.Error("listenUnix replaced a regular file")
+	}
+}
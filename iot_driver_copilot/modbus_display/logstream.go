@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log stream:
+//
+//	GET /logs/stream[?level=warn][&backlog=50]
+//
+// Server-sent events, one "log" event per line the driver logs, as
+// {"time", "level", "message"}, starting with up to backlog (default all)
+// of the last LOG_BUFFER_LINES lines. The driver's log lines carry no
+// level of their own, so it is read from the wording: failures, lost
+// connections and stalls are "error", retries, dropped or suppressed
+// work and slow requests "warn", the rest "info". level= sends that level and above. Logs
+// cover every slave on the bus, so under tenancy the stream is admin-only.
+
+type logEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+var logLevels = map[string]int{"info": 0, "warn": 1, "error": 2}
+
+var (
+	// logHeader matches what log.Logger puts before the message.
+	logHeader  = regexp.MustCompile(`^(\[[^\]]*\] )?\d{4}/\d\d/\d\d \d\d:\d\d:\d\d(\.\d+)? `)
+	logErrorRe = regexp.MustCompile(`(?i)\b(fail(ed|ure)?|error|lost|stalled|cannot|unreachable|unreadable)\b`)
+	logWarnRe  = regexp.MustCompile(`(?i)\b(retry(ing)?|suppressed|dropped|rejected|discarding|restoring|slow)\b`)
+)
+
+func logLevel(msg string) string {
+	switch {
+	case logErrorRe.MatchString(msg):
+		return "error"
+	case logWarnRe.MatchString(msg):
+		return "warn"
+	}
+	return "info"
+}
+
+// logHub keeps the last lines logged and fans new ones out to streams. It
+// is an io.Writer for the driver's logger; a subscriber that falls behind
+// loses lines rather than slowing logging down.
+type logHub struct {
+	mu   sync.Mutex
+	ring []logEntry
+	next int // where the next entry goes once ring is full
+	size int
+	subs map[chan logEntry]struct{}
+}
+
+func newLogHub(size int) *logHub {
+	return &logHub{size: size, subs: map[chan logEntry]struct{}{}}
+}
+
+func (h *logHub) Write(p []byte) (int, error) {
+	now := time.Now().UTC()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		msg := logHeader.ReplaceAllString(line, "")
+		e := logEntry{Time: now, Level: logLevel(msg), Message: msg}
+		if len(h.ring) < h.size {
+			h.ring = append(h.ring, e)
+		} else if h.size > 0 {
+			h.ring[h.next] = e
+			h.next = (h.next + 1) % h.size
+		}
+		for ch := range h.subs {
+			select {
+			case ch <- e:
+			default:
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// subscribe returns the last n buffered entries, oldest first, and a
+// channel for the ones that follow.
+func (h *logHub) subscribe(n int) ([]logEntry, chan logEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	recent := append(append([]logEntry(nil), h.ring[h.next:]...), h.ring[:h.next]...)
+	if n >= 0 && n < len(recent) {
+		recent = recent[len(recent)-n:]
+	}
+	ch := make(chan logEntry, 64)
+	h.subs[ch] = struct{}{}
+	return recent, ch
+}
+
+func (h *logHub) unsubscribe(ch chan logEntry) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (d *ModbusDriver) handleLogStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	minLevel := 0
+	if l := q.Get("level"); l != "" {
+		var ok bool
+		if minLevel, ok = logLevels[l]; !ok {
+			http.Error(w, "level must be info, warn or error", http.StatusBadRequest)
+			return
+		}
+	}
+	backlog := -1
+	if b := q.Get("backlog"); b != "" {
+		n, err := strconv.Atoi(b)
+		if err != nil || n < 0 {
+			http.Error(w, "backlog must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		backlog = n
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	recent, ch := d.logs.subscribe(backlog)
+	defer d.logs.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	send := func(e logEntry) {
+		if logLevels[e.Level] < minLevel {
+			return
+		}
+		b, _ := json.Marshal(e)
+		fmt.Fprintf(w, "event: log\ndata: %s\n\n", b)
+	}
+	for _, e := range recent {
+		send(e)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e := <-ch:
+			send(e)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
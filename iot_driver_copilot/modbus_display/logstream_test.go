@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	for msg, want := range map[string]string{
+		"connect failed: no such file; retry in 1s":                                "error",
+		"mqtt connection lost: EOF":                                                "error",
+		"watchdog: poll loop stalled, no longer patting":                           "error",
+		"spool: queue for mqtt:a full, dropped oldest event":                       "warn",
+		"display shows \"1\" instead of \"2\", device likely restarted; restoring": "warn",
+		"mqtt connected to tcp://broker:1883":                                      "info",
+		"serial link now /dev/ttyUSB0 9600 8N1 (rs485 false)":                      "info",
+	} {
+		if got := logLevel(msg); got != want {
+			t.Errorf("logLevel(%q) = %s, want %s", msg, got, want)
+		}
+	}
+}
+
+func TestLogHub(t *testing.T) {
+	h := newLogHub(3)
+	l := log.New(h, "[modbus-display] ", log.LstdFlags|log.Lmicroseconds)
+	for _, m := range []string{"one", "two", "three", "four"} {
+		l.Print(m)
+	}
+	recent, ch := h.subscribe(-1)
+	defer h.unsubscribe(ch)
+	if len(recent) != 3 || recent[0].Message != "two" || recent[2].Message != "four" {
+		t.Fatalf("recent = %+v", recent)
+	}
+	if recent, ch2 := h.subscribe(1); len(recent) != 1 || recent[0].Message != "four" {
+		t.Errorf("backlog 1 = %+v", recent)
+	} else {
+		h.unsubscribe(ch2)
+	}
+	l.Print("poll error: timeout")
+	if e := <-ch; e.Message != "poll error: timeout" || e.Level != "error" {
+		t.Errorf("streamed %+v", e)
+	}
+}
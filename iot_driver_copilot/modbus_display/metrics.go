@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// handleMetrics exposes driver counters in the Prometheus text format.
+func (d *ModbusDriver) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	depth := 0
+	if d.notifier.spool != nil {
+		depth = d.notifier.spool.Depth()
+	}
+	writeMetric(w, "modbus_display_spool_depth", "gauge", "Events waiting in the store-and-forward spool.", depth)
+	if us := d.echo.lastMicros.Load(); us > 0 {
+		writeMetric(w, "modbus_display_echo_test_latency_seconds", "gauge", "Write plus read-back time of the last successful display echo test.", float64(us)/1e6)
+	}
+	for _, c := range driverCounters {
+		v := c.since(d)
+		writeMetric(w, "modbus_display_"+c.name+"_total", "counter", c.help, v)
+		writeMetric(w, "modbus_display_"+c.name+"_lifetime_total", "counter", c.help+" Includes earlier runs (METRICS_FILE).", d.lifetime.lifetime(c.name, v))
+	}
+	if routes, counts := d.access.slowByRoute(); len(routes) > 0 {
+		const name = "modbus_display_slow_requests_by_route_total"
+		fmt.Fprintf(w, "# HELP %s HTTP requests slower than SLOW_REQUEST_MS, by route.\n# TYPE %s counter\n", name, name)
+		for _, route := range routes {
+			fmt.Fprintf(w, "%s{route=%q} %d\n", name, route, counts[route])
+		}
+	}
+	if since, ok := d.lifetime.sinceTime(); ok {
+		writeMetric(w, "modbus_display_lifetime_start_seconds", "gauge", "Unix time the lifetime counters were started.", since.Unix())
+	}
+}
+
+func writeMetric(w http.ResponseWriter, name, typ, help string, v interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, v)
+}
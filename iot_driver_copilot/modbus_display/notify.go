@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Notifier delivers event payloads to webhook URLs and MQTT topics.
+type Notifier struct {
+	cfg    Config
+	logger *log.Logger
+	http   *http.Client
+
+	mqttMu sync.Mutex
+	mqtt   mqtt.Client
+
+	spool     *Spool // nil unless SPOOL_DIR is set
+	delivered atomic.Uint64
+	failed    atomic.Uint64
+
+	templates  messageTemplates // email and Telegram message text
+	gate       *messageGate
+	suppressed atomic.Uint64 // email/Telegram messages held back by quiet hours or the rate limit
+}
+
+func NewNotifier(cfg Config, logger *log.Logger) (*Notifier, error) {
+	n := &Notifier{cfg: cfg, logger: logger, http: &http.Client{Timeout: 10 * time.Second}}
+	loc := cfg.NotifyLocation
+	if loc == nil {
+		loc = time.Local
+	}
+	var err error
+	if n.templates, err = parseMessageTemplates(cfg.NotifySubjectTemplate, cfg.NotifyTextTemplate, loc); err != nil {
+		return nil, err
+	}
+	n.gate = &messageGate{limit: cfg.NotifyRateLimit, window: cfg.NotifyRateWindow, quiet: cfg.NotifyQuietHours, loc: loc, sent: map[string][]time.Time{}}
+	if cfg.SpoolDir != "" {
+		sp, err := OpenSpool(cfg.SpoolDir, cfg.SpoolMaxEvents, n.deliver, logger)
+		if err != nil {
+			return nil, err
+		}
+		n.spool = sp
+	}
+	return n, nil
+}
+
+func (n *Notifier) MQTTEnabled() bool { return n.cfg.MQTTBroker != "" }
+
+func (n *Notifier) mqttClient() (mqtt.Client, error) {
+	n.mqttMu.Lock()
+	defer n.mqttMu.Unlock()
+	if !n.MQTTEnabled() {
+		return nil, errors.New("MQTT_BROKER not configured")
+	}
+	if n.mqtt == nil {
+		opts := mqtt.NewClientOptions().
+			AddBroker(n.cfg.MQTTBroker).
+			SetClientID(n.cfg.MQTTClientID).
+			SetAutoReconnect(true).
+			SetConnectRetry(true)
+		if n.cfg.MQTTUsername != "" {
+			opts.SetUsername(n.cfg.MQTTUsername)
+			opts.SetPassword(n.cfg.MQTTPassword)
+		}
+		opts.SetOnConnectHandler(func(mqtt.Client) { n.logger.Printf("mqtt connected to %s", n.cfg.MQTTBroker) })
+		opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) { n.logger.Printf("mqtt connection lost: %v", err) })
+		n.mqtt = mqtt.NewClient(opts)
+		n.mqtt.Connect().WaitTimeout(5 * time.Second)
+	}
+	return n.mqtt, nil
+}
+
+// Send delivers payload to a "webhook" URL or "mqtt" topic as JSON, or as a
+// rendered message to an "email" or "telegram" target (see channels.go).
+// With SPOOL_DIR set the event is queued on disk first and delivered in
+// order by a per-target worker that retries until the target is reachable
+// again.
+func (n *Notifier) Send(kind, target string, payload interface{}) {
+	var body []byte
+	var err error
+	if isMessageChannel(kind) {
+		if ok, why := n.gate.admit(kind, target, time.Now()); !ok {
+			n.suppressed.Add(1)
+			n.logger.Printf("%s to %s suppressed: %s", kind, target, why)
+			return
+		}
+		body, err = n.templates.render(payload)
+	} else {
+		body, err = json.Marshal(payload)
+	}
+	if err != nil {
+		n.logger.Printf("encode %s event for %s: %v", kind, target, err)
+		return
+	}
+	if n.spool != nil {
+		if err := n.spool.Enqueue(kind, target, body); err != nil {
+			n.logger.Printf("spool %s event for %s: %v", kind, target, err)
+		}
+		return
+	}
+	go func() {
+		if err := n.deliver(kind, target, body); err != nil {
+			n.logger.Printf("%s delivery to %s failed: %v", kind, target, err)
+		}
+	}()
+}
+
+func (n *Notifier) deliver(kind, target string, body []byte) error {
+	var err error
+	switch kind {
+	case "webhook":
+		err = n.postWebhook(target, body)
+	case "mqtt":
+		err = n.publishMQTT(target, body)
+	case "email":
+		err = n.sendEmail(target, body)
+	case "telegram":
+		err = n.sendTelegram(target, body)
+	default:
+		err = fmt.Errorf("unknown notification kind %q", kind)
+	}
+	if err != nil {
+		n.failed.Add(1)
+	} else {
+		n.delivered.Add(1)
+	}
+	return err
+}
+
+func (n *Notifier) postWebhook(url string, body []byte) error {
+	resp, err := n.http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+func (n *Notifier) publishMQTT(topic string, body []byte) error {
+	c, err := n.mqttClient()
+	if err != nil {
+		return err
+	}
+	if !c.IsConnected() {
+		return errors.New("mqtt not connected")
+	}
+	tok := c.Publish(topic, 1, false, body)
+	if !tok.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("mqtt publish to %s timed out", topic)
+	}
+	return tok.Error()
+}
+
+func (n *Notifier) Close() {
+	if n.spool != nil {
+		n.spool.Close()
+	}
+	n.mqttMu.Lock()
+	defer n.mqttMu.Unlock()
+	if n.mqtt != nil {
+		n.mqtt.Disconnect(250)
+	}
+}
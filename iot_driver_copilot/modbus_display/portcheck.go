@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// Serial port checks. Before the HTTP server starts the driver stats
+// SERIAL_PORT and opens it once with the configured line settings, so a
+// wrong device name, a missing dialout group or a port held by another
+// program is named in the log and in GET /healthz ("serial_port") instead
+// of surfacing as an endless "connect failed". The driver starts anyway:
+// the adapter may be plugged in later. Each failed connect in the poll
+// loop refreshes the diagnosis, and the next successful one clears it.
+// Under CLUSTER_LEASE_FILE the port is only stat'ed at startup, since the
+// standby must not open the bus.
+
+type portCheck struct {
+	Port    string    `json:"port"`
+	OK      bool      `json:"ok"`
+	Problem string    `json:"problem,omitempty"` // missing, not_a_device, permission_denied, busy, unsupported_settings, not_a_tty, open_failed
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// diagnosePortError turns an error from stat'ing or opening port into a
+// problem code and a message that says what to do about it.
+func diagnosePortError(cfg Config, err error) (string, string) {
+	port := cfg.SerialPort
+	switch {
+	case errors.Is(err, syscall.ENOENT), errors.Is(err, syscall.ENODEV), errors.Is(err, syscall.ENXIO):
+		return "missing", fmt.Sprintf("%s does not exist: check the adapter is plugged in and the name is right (/dev/serial/by-id/ names survive re-enumeration)", port)
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		return "permission_denied", fmt.Sprintf("permission denied opening %s: add the driver's user to the port's group (usually dialout)", port)
+	case errors.Is(err, syscall.EBUSY):
+		return "busy", fmt.Sprintf("%s is busy: another program holds it exclusively (ModemManager, a getty or a second driver instance?)", port)
+	case errors.Is(err, syscall.ENOTTY) && cfg.RS485.Enabled:
+		return "unsupported_settings", fmt.Sprintf("%s has no kernel RS-485 mode: unset RS485_ENABLED or use RS485_SOFTWARE_RTS", port)
+	case errors.Is(err, syscall.ENOTTY):
+		return "not_a_tty", fmt.Sprintf("%s is not a serial port", port)
+	case errors.Is(err, syscall.EINVAL), strings.Contains(err.Error(), "unsupported baud rate"):
+		return "unsupported_settings", fmt.Sprintf("%s rejected the line settings (BAUD_RATE %d, DATA_BITS %d, PARITY %s, STOP_BITS %d): %v",
+			port, cfg.BaudRate, cfg.DataBits, cfg.Parity, cfg.StopBits, err)
+	}
+	return "open_failed", fmt.Sprintf("open %s: %v", port, err)
+}
+
+// probeSerialPort checks that cfg.SerialPort exists, is a character device
+// and, unless statOnly, opens with the configured settings.
+func probeSerialPort(cfg Config, statOnly bool) portCheck {
+	pc := portCheck{Port: cfg.SerialPort, Checked: time.Now().UTC()}
+	fi, err := os.Stat(cfg.SerialPort)
+	if err != nil {
+		pc.Problem, pc.Error = diagnosePortError(cfg, err)
+		return pc
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		pc.Problem, pc.Error = "not_a_device", fmt.Sprintf("%s is not a character device (%s)", cfg.SerialPort, fi.Mode().Type())
+		return pc
+	}
+	if !statOnly {
+		rs485 := cfg.RS485
+		rs485.Enabled = rs485.Enabled && !cfg.RS485SoftwareRTS
+		port, err := serial.Open(&serial.Config{
+			Address: cfg.SerialPort, BaudRate: cfg.BaudRate, DataBits: cfg.DataBits,
+			StopBits: cfg.StopBits, Parity: cfg.Parity, Timeout: cfg.ModbusTimeout, RS485: rs485,
+		})
+		if err != nil {
+			pc.Problem, pc.Error = diagnosePortError(cfg, err)
+			return pc
+		}
+		port.Close()
+	}
+	pc.OK = true
+	return pc
+}
+
+// checkPort runs the startup check and logs what it found.
+func (d *ModbusDriver) checkPort() {
+	pc := probeSerialPort(d.cfg, d.cluster != nil)
+	d.port.Store(&pc)
+	if !pc.OK {
+		d.logger.Printf("serial port check failed: %s", pc.Error)
+		_ = sdNotify("STATUS=" + pc.Error)
+	}
+}
+
+// notePortError records why the poll loop could not open the port.
+func (d *ModbusDriver) notePortError(err error) {
+	if errors.Is(err, errStandby) {
+		return
+	}
+	pc := portCheck{Port: d.cfg.SerialPort, Checked: time.Now().UTC()}
+	pc.Problem, pc.Error = diagnosePortError(d.cfg, err)
+	d.port.Store(&pc)
+}
+
+// notePortOpen clears a recorded problem once the port has opened.
+func (d *ModbusDriver) notePortOpen() {
+	if pc := d.port.Load(); pc != nil && pc.OK {
+		return
+	}
+	d.port.Store(&portCheck{Port: d.cfg.SerialPort, OK: true, Checked: time.Now().UTC()})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"modbus-display-driver/internal/modbustest"
+)
+
+func TestProbeSerialPort(t *testing.T) {
+	sim := modbustest.NewServer(1)
+	defer sim.Close()
+	pty, err := sim.ListenRTU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "ttyUSB0")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{BaudRate: 9600, DataBits: 8, Parity: "N", StopBits: 1}
+	for port, want := range map[string]string{
+		"/dev/ttyUSB-missing": "missing",
+		file:                  "not_a_device",
+		pty:                   "",
+	} {
+		cfg.SerialPort = port
+		pc := probeSerialPort(cfg, false)
+		if pc.Problem != want || pc.OK != (want == "") || pc.Port != port {
+			t.Errorf("%s: %+v, want problem %q", port, pc, want)
+		}
+	}
+	cfg.SerialPort, cfg.BaudRate = pty, 12345
+	if pc := probeSerialPort(cfg, false); pc.Problem != "unsupported_settings" {
+		t.Errorf("baud 12345: %+v", pc)
+	}
+	if pc := probeSerialPort(cfg, true); !pc.OK {
+		t.Errorf("stat only: %+v", pc)
+	}
+}
+
+func TestDiagnosePortError(t *testing.T) {
+	cfg := Config{SerialPort: "/dev/ttyUSB0"}
+	for err, want := range map[error]string{
+		&os.PathError{Op: "open", Path: "/dev/ttyUSB0", Err: syscall.ENOENT}: "missing",
+		syscall.EACCES: "permission_denied",
+		syscall.EBUSY:  "busy",
+		syscall.ENOTTY: "not_a_tty",
+		errors.New("serial: unsupported baud rate"): "unsupported_settings",
+		errors.New("something else"):                "open_failed",
+	} {
+		if got, _ := diagnosePortError(cfg, err); got != want {
+			t.Errorf("%v: %q, want %q", err, got, want)
+		}
+	}
+	cfg.RS485.Enabled = true
+	if got, msg := diagnosePortError(cfg, syscall.ENOTTY); got != "unsupported_settings" {
+		t.Errorf("ENOTTY with RS485_ENABLED: %q (%s)", got, msg)
+	}
+}
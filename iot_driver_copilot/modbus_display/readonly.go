@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errReadOnly is returned by the register write paths while read-only mode is on.
+var errReadOnly = errors.New("driver is in read-only mode")
+
+// SetReadOnly switches read-only mode. With software blinking the display
+// is first restored to the full value, so the lock does not freeze it with
+// characters blanked, and the blinker idles until the mode is lifted.
+func (d *ModbusDriver) SetReadOnly(on bool) {
+	if b := d.blinker; b != nil {
+		b.mu.Lock()
+		if on && b.blanked && d.writeDisplayText(b.value) == nil {
+			b.blanked = false
+		}
+		d.readOnly.Store(on)
+		b.mu.Unlock()
+		b.notify()
+	} else {
+		d.readOnly.Store(on)
+	}
+	d.logger.Printf("read-only mode %s", map[bool]string{true: "enabled", false: "disabled"}[on])
+}
+
+// planSetReadOnly is the dry run of SetReadOnly.
+func (d *ModbusDriver) planSetReadOnly(on bool) []plannedOp {
+	var ops []plannedOp
+	if b := d.blinker; b != nil && on {
+		b.mu.Lock()
+		if b.blanked {
+			if payload, err := d.codec.Encode(b.value); err == nil {
+				ops = append(ops, planPayload("display_value", d.cfg.SlaveId, d.cfg.RegDisplayValueStart, payload))
+			}
+		}
+		b.mu.Unlock()
+	}
+	return append(ops, plannedOp{Op: "set_read_only", Detail: map[string]bool{"read_only": on}})
+}
+
+// writeGuard rejects mutating requests with 423 Locked while read-only mode
+// is on, except for dry runs, which it marks in the request context.
+func (d *ModbusDriver) writeGuard(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		dry, err := parseDryRun(r)
+		if err != nil {
+			http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		}
+		if dry {
+			next(w, r.WithContext(context.WithValue(r.Context(), dryRunCtxKey{}, true)))
+			return
+		}
+		if d.readOnly.Load() {
+			http.Error(w, errReadOnly.Error(), http.StatusLocked)
+			return
+		}
+		if !d.cluster.leading() {
+			leader, _ := d.cluster.leaderTerm()
+			http.Error(w, errStandby.Error()+"; the leader is "+strconv.Quote(leader), http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+	}
+}
+
+type readOnlyReq struct {
+	ReadOnly *bool `json:"read_only"`
+}
+
+// adminAuthorized reports whether r carries "Authorization: Bearer <ADMIN_TOKEN>",
+// or a JWT the tenant guard found to map to admin.
+// Without a configured token no request is authorized.
+func (d *ModbusDriver) adminAuthorized(r *http.Request) bool {
+	if admin, _ := r.Context().Value(adminCtxKey{}).(bool); admin {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && d.cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(d.cfg.AdminToken)) == 1
+}
+
+// adminEnabled reports whether any credential can be admin: the ADMIN_TOKEN,
+// or a JWT role mapped to admin.
+func (d *ModbusDriver) adminEnabled() bool {
+	return d.cfg.AdminToken != "" || d.jwt != nil && d.jwt.grantsAdmin()
+}
+
+func (d *ModbusDriver) handleAdminReadOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !d.adminEnabled() {
+			http.Error(w, "read-only toggle disabled: ADMIN_TOKEN not set", http.StatusForbidden)
+			return
+		}
+		if !d.adminAuthorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req readOnlyReq
+		if !d.decodeJSON(w, r, &req) {
+			return
+		}
+		if req.ReadOnly == nil {
+			http.Error(w, "read_only required", http.StatusBadRequest)
+			return
+		}
+		if dry, err := parseDryRun(r); err != nil {
+			http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+			return
+		} else if dry {
+			d.replyDryRun(w, d.planSetReadOnly(*req.ReadOnly))
+			return
+		}
+		d.SetReadOnly(*req.ReadOnly)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]bool{"read_only": d.readOnly.Load()})
+}
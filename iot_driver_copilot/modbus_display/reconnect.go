@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// POST /admin/reconnect recovers a wedged USB-RS485 adapter without a
+// restart: it closes the port, throws away the handler, opens a new one
+// with the current settings (as PUT /serial last left them) and asks the
+// display for its device address to show the link works end to end. The
+// poll loop's backoff is reset, so polling resumes at once rather than
+// after up to BACKOFF_MAX_MS. Like PUT /serial it needs the admin token.
+
+type reconnectResult struct {
+	OK             bool    `json:"ok"`
+	Port           string  `json:"port"`
+	PortOpen       bool    `json:"port_open"`
+	DeviceAnswered bool    `json:"device_answered"`
+	DurationMs     float64 `json:"duration_ms"`
+	Error          string  `json:"error,omitempty"`
+}
+
+func (d *ModbusDriver) handleAdminReconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !d.adminEnabled() {
+		http.Error(w, "reconnect disabled: ADMIN_TOKEN not set", http.StatusForbidden)
+		return
+	}
+	if !d.adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	dry, err := parseDryRun(r)
+	if err != nil {
+		http.Error(w, "dry_run must be true or false", http.StatusBadRequest)
+		return
+	}
+	if d.firmwareBusy.Load() {
+		http.Error(w, "firmware upload in progress", http.StatusConflict)
+		return
+	}
+	if !d.cluster.leading() {
+		leader, _ := d.cluster.leaderTerm()
+		http.Error(w, errStandby.Error()+"; the leader is "+strconv.Quote(leader), http.StatusServiceUnavailable)
+		return
+	}
+	if dry {
+		d.mbusMu.Lock()
+		view := serialView(d.cfg)
+		d.mbusMu.Unlock()
+		d.replyDryRun(w, []plannedOp{{Op: "reopen_serial", Detail: view}, {Op: "read_register", Field: "device_address", Detail: map[string]uint16{"address": d.cfg.RegDeviceAddress}}})
+		return
+	}
+	res := d.reconnect()
+	code := http.StatusOK
+	switch {
+	case !res.PortOpen:
+		code = http.StatusServiceUnavailable
+	case !res.DeviceAnswered:
+		code = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// reconnect rebuilds the serial link and checks the display answers on it.
+func (d *ModbusDriver) reconnect() reconnectResult {
+	start := time.Now()
+	d.linkResets.Add(1)
+	d.mbusMu.Lock()
+	if d.link != nil {
+		_ = d.link.Close()
+	}
+	d.client = nil
+	d.buildLink()
+	err := d.link.Connect()
+	if err == nil {
+		d.client = modbus.NewClient2(d.handler, d.link)
+	}
+	res := reconnectResult{Port: d.cfg.SerialPort, PortOpen: err == nil}
+	d.mbusMu.Unlock()
+	d.regCache.Invalidate()
+	if err == nil {
+		_, err = d.readU16(d.cfg.RegDeviceAddress)
+		res.DeviceAnswered = err == nil
+	}
+	res.OK = res.DeviceAnswered
+	res.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		res.Error = err.Error()
+		d.logger.Printf("link reset by POST /admin/reconnect: %s failed: %v", res.Port, err)
+	} else {
+		d.logger.Printf("link reset by POST /admin/reconnect: %s open, display answered in %.1f ms", res.Port, res.DurationMs)
+	}
+	// Poll now, with the backoff back at BACKOFF_INITIAL_MS.
+	select {
+	case d.relink <- struct{}{}:
+	default:
+	}
+	return res
+}
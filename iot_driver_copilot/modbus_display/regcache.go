@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// regCache sits in front of GET /registers so that many dashboard widgets
+// polling the same block cost one serial transaction. Concurrent identical
+// reads always share a single request; with a TTL the result is also
+// reused until it expires. Any register write drops everything, since a
+// write to one block can change what another reads back (display value
+// registers overlapping a raw range, for instance).
+type regCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	gen      uint64 // bumped by Invalidate so reads in flight across a write aren't stored
+	entries  map[regKey]regEntry
+	inflight map[regKey]*regCall
+}
+
+type regKey struct {
+	slave byte
+	addr  uint16
+	count uint16
+}
+
+type regEntry struct {
+	raw     []byte
+	expires time.Time
+}
+
+type regCall struct {
+	done chan struct{}
+	raw  []byte
+	err  error
+}
+
+func newRegCache(ttl time.Duration) *regCache {
+	return &regCache{ttl: ttl, entries: map[regKey]regEntry{}, inflight: map[regKey]*regCall{}}
+}
+
+// Get returns the registers for key, from the cache, from a read already in
+// flight, or by calling fetch. The returned slice is the caller's own.
+func (c *regCache) Get(key regKey, fetch func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		if time.Now().Before(e.expires) {
+			c.mu.Unlock()
+			return append([]byte(nil), e.raw...), nil
+		}
+		delete(c.entries, key)
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		return append([]byte(nil), call.raw...), call.err
+	}
+	call := &regCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	gen := c.gen
+	c.mu.Unlock()
+
+	call.raw, call.err = fetch()
+
+	c.mu.Lock()
+	if c.inflight[key] == call {
+		delete(c.inflight, key)
+	}
+	if call.err == nil && c.ttl > 0 && gen == c.gen {
+		c.entries[key] = regEntry{raw: call.raw, expires: time.Now().Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return append([]byte(nil), call.raw...), call.err
+}
+
+// Invalidate forgets every cached result. Reads already in flight finish
+// for their current waiters but are neither stored nor joined afterwards.
+func (c *regCache) Invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.gen++
+	c.entries = map[regKey]regEntry{}
+	c.inflight = map[regKey]*regCall{}
+	c.mu.Unlock()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegCacheCoalescesConcurrentReads(t *testing.T) {
+	c := newRegCache(0)
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	fetch := func() ([]byte, error) {
+		fetches.Add(1)
+		<-release
+		return []byte{0, 42}, nil
+	}
+	key := regKey{1, 0x10, 1}
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 20)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.Get(key, fetch)
+		}(i)
+	}
+	// Let every goroutine queue up behind the first fetch.
+	for deadline := time.Now().Add(time.Second); fetches.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("%d fetches for 20 concurrent reads, want 1", n)
+	}
+	for i, r := range results {
+		if len(r) != 2 || r[1] != 42 {
+			t.Fatalf("reader %d got %v", i, r)
+		}
+	}
+	results[0][1] = 0 // callers own their copy
+	if results[1][1] != 42 {
+		t.Fatal("readers share one result slice")
+	}
+
+	// Without a TTL nothing outlives the read.
+	c.Get(key, func() ([]byte, error) { fetches.Add(1); return []byte{0, 1}, nil })
+	if fetches.Load() != 2 {
+		t.Fatal("result reused with TTL 0")
+	}
+}
+
+func TestRegCacheTTLAndInvalidate(t *testing.T) {
+	c := newRegCache(time.Hour)
+	var fetches int
+	fetch := func() ([]byte, error) {
+		fetches++
+		return []byte{0, byte(fetches)}, nil
+	}
+	a, b := regKey{1, 0x10, 1}, regKey{1, 0x10, 2}
+
+	c.Get(a, fetch)
+	if got, _ := c.Get(a, fetch); fetches != 1 || got[1] != 1 {
+		t.Fatalf("cached read: fetches=%d got=%v", fetches, got)
+	}
+	c.Get(b, fetch) // a different count is a different read
+	if fetches != 2 {
+		t.Fatalf("fetches = %d, want 2", fetches)
+	}
+	c.Invalidate()
+	if got, _ := c.Get(a, fetch); fetches != 3 || got[1] != 3 {
+		t.Fatalf("read after Invalidate: fetches=%d got=%v", fetches, got)
+	}
+
+	// A read that straddles a write must not be cached.
+	c.Invalidate()
+	c.Get(a, func() ([]byte, error) { c.Invalidate(); return []byte{0, 99}, nil })
+	if got, _ := c.Get(a, fetch); got[1] == 99 {
+		t.Fatal("read in flight across Invalidate was cached")
+	}
+
+	var nilCache *regCache
+	nilCache.Invalidate() // CLI drivers have no cache
+}
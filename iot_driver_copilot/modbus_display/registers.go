@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/goburrow/modbus"
+)
+
+// Raw holding register access for commissioning and debugging:
+//
+//	GET /registers/{addr}?count=N[&slave_id=S]
+//	PUT /registers/{addr}[?slave_id=S]  {"values": [1, 2, 3]}
+//
+// {addr} is decimal or 0x-prefixed hex. slave_id is only honoured when
+// ALLOW_SLAVE_OVERRIDE=true; otherwise the configured slave is used.
+// Concurrent identical GETs share one device read, and with
+// REGISTER_CACHE_TTL_MS the result is reused until it expires (see regCache).
+
+const (
+	maxReadRegisters  = 125 // FC03 limit
+	maxWriteRegisters = 123 // FC16 limit
+)
+
+type registersReq struct {
+	Values []uint16 `json:"values"`
+}
+
+type registersResp struct {
+	SlaveId int      `json:"slave_id"`
+	Address uint16   `json:"address"`
+	Values  []uint16 `json:"values"`
+}
+
+func parseRegisterAddr(s string) (uint16, bool) {
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(v), true
+}
+
+// requestSlave resolves the slave a raw register request addresses.
+func (d *ModbusDriver) requestSlave(r *http.Request) (int, int, string) {
+	q := r.URL.Query().Get("slave_id")
+	if q == "" {
+		return d.cfg.SlaveId, 0, ""
+	}
+	if !d.cfg.AllowSlaveOverride {
+		return 0, http.StatusForbidden, "slave_id override disabled (set ALLOW_SLAVE_OVERRIDE=true)"
+	}
+	id, err := strconv.Atoi(q)
+	if err != nil || id < 1 || id > 247 {
+		return 0, http.StatusBadRequest, "invalid slave_id"
+	}
+	return id, 0, ""
+}
+
+func (d *ModbusDriver) handleRegisters(w http.ResponseWriter, r *http.Request) {
+	addr, ok := parseRegisterAddr(strings.TrimPrefix(r.URL.Path, "/registers/"))
+	if !ok {
+		http.Error(w, "invalid register address", http.StatusBadRequest)
+		return
+	}
+	slave, code, msg := d.requestSlave(r)
+	if code != 0 {
+		http.Error(w, msg, code)
+		return
+	}
+	if slave != d.cfg.SlaveId {
+		d.logger.Printf("raw register %s 0x%04X on overridden slave %d", r.Method, addr, slave)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		count := 1
+		if c := r.URL.Query().Get("count"); c != "" {
+			n, err := strconv.Atoi(c)
+			if err != nil || n < 1 || n > maxReadRegisters {
+				http.Error(w, "invalid count", http.StatusBadRequest)
+				return
+			}
+			count = n
+		}
+		raw, err := d.regCache.Get(regKey{byte(slave), addr, uint16(count)}, func() ([]byte, error) {
+			var raw []byte
+			err := d.withSlave(byte(slave), func(c modbus.Client) error {
+				var err error
+				raw, err = c.ReadHoldingRegisters(addr, uint16(count))
+				return err
+			})
+			return raw, err
+		})
+		if err != nil {
+			d.logger.Printf("read registers 0x%04X failed: %v", addr, err)
+			http.Error(w, "device read error", http.StatusInternalServerError)
+			return
+		}
+		vals := make([]uint16, len(raw)/2)
+		for i := range vals {
+			vals[i] = binary.BigEndian.Uint16(raw[2*i:])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(registersResp{SlaveId: slave, Address: addr, Values: vals})
+	case http.MethodPut:
+		var req registersReq
+		if !d.decodeJSON(w, r, &req) {
+			return
+		}
+		if len(req.Values) == 0 || len(req.Values) > maxWriteRegisters {
+			http.Error(w, "values must hold 1..123 registers", http.StatusBadRequest)
+			return
+		}
+		payload := make([]byte, 2*len(req.Values))
+		for i, v := range req.Values {
+			binary.BigEndian.PutUint16(payload[2*i:], v)
+		}
+		start, end := int(d.cfg.RegDisplayValueStart), int(d.cfg.RegDisplayValueStart)+d.cfg.DisplayValueRegs
+		touchesDisplay := slave == d.cfg.SlaveId && int(addr) < end && int(addr)+len(req.Values) > start
+		if dryRun(r) {
+			fc := byte(16)
+			if len(req.Values) == 1 {
+				fc = 6
+			}
+			ops := []plannedOp{planWrite("", slave, fc, addr, req.Values...)}
+			if touchesDisplay {
+				ops = append(ops, d.planForgetDesired()...)
+			}
+			d.replyDryRun(w, ops)
+			return
+		}
+		err := d.withSlave(byte(slave), func(c modbus.Client) error {
+			if d.readOnly.Load() {
+				return errReadOnly
+			}
+			var err error
+			if len(req.Values) == 1 {
+				_, err = c.WriteSingleRegister(addr, req.Values[0])
+			} else {
+				_, err = c.WriteMultipleRegisters(addr, uint16(len(req.Values)), payload)
+			}
+			d.regCache.Invalidate()
+			return err
+		})
+		if err != nil {
+			d.logger.Printf("write registers 0x%04X failed: %v", addr, err)
+			http.Error(w, "device write error", http.StatusInternalServerError)
+			return
+		}
+		if touchesDisplay {
+			d.forgetDesired()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Register map generator:
+//
+//	driver gen-regmap [-profile NAME] [-base N] [-o FILE] registers.csv
+//
+// turns the register table of a display's datasheet, exported to CSV, into
+// the REG_* settings of a CONFIG_FILE ("defaults", or "profiles.NAME" with
+// -profile). The header row names the columns; what comes before it, such
+// as a table title, is skipped. Comma, semicolon and tab separated files
+// are accepted.
+//
+//	address   "Address", "Addr", "Register", "Offset": 16, 0x10, 0010H, or a
+//	          range like 16-19 for a block
+//	name      "Name", "Parameter", "Description", "Function": what the
+//	          register holds; several such columns are read together
+//	count     "Registers", "Length", "Quantity", "Words" (optional): the
+//	          block size when the address is not a range
+//	setting   "Setting" (optional): the driver setting the row is, such as
+//	          REG_ADDR_BAUD_RATE, or "ignore", overriding the name
+//
+// Rows with an empty address continue the previous row's name, as a wrapped
+// cell often comes out of a PDF. A row is matched to a setting by words in
+// its name (see regmapRules); the display value may span several rows, and
+// clock rows (year, month, ... second) become REG_ADDR_CLOCK_START and
+// CLOCK_LAYOUT in address order. Addresses of 40001 and up are taken as
+// Modicon 4xxxx references unless -base says otherwise; -base 1 is for
+// tables numbering registers from 1.
+//
+// Every row and the setting it became is listed on stderr for review. The
+// map is refused when a required register is missing, a setting appears
+// twice, an address does not parse or two settings overlap.
+
+// regmapRules match a row's name, first match first: the more specific
+// names come before the words they contain.
+var regmapRules = []struct {
+	setting  string
+	keywords []string
+}{
+	{"REG_ADDR_DISPLAY_VALUE_START", []string{"display value", "display data", "display content", "display text", "display buffer", "display char", "display character", "display characters", "display digit", "display digits", "ascii"}},
+	{"REG_ADDR_DP_MASK", []string{"decimal point mask", "dp mask", "decimal point", "dot", "dp"}},
+	{"REG_ADDR_DECIMALS", []string{"decimal places", "decimals", "decimal"}},
+	{"REG_ADDR_BLINK_PERIOD_MS", []string{"blink period", "flash period", "blink interval", "flash interval", "blink time", "flash time", "blink speed", "flash speed", "blink frequency", "flash frequency"}},
+	{"REG_ADDR_BLINK_MASK", []string{"blink mask", "flash mask", "blink", "flash", "flashing", "blinking"}},
+	{"REG_ADDR_BAUD_RATE", []string{"baud", "baud rate", "baudrate"}},
+	{"REG_ADDR_COMM_FORMAT", []string{"comm format", "communication format", "data format", "serial format", "parity", "check bit"}},
+	{"REG_ADDR_DEVICE_ADDRESS", []string{"device address", "slave address", "slave id", "station", "station number", "modbus address", "comm address", "communication address", "address"}},
+	{"REG_ADDR_WORK_MODE", []string{"work mode", "working mode", "operating mode", "mode"}},
+	{"REG_ADDR_VALUE_TYPE", []string{"value type", "data type", "display type", "type"}},
+	{"REG_ADDR_VENDOR_ID", []string{"vendor", "vendor id", "manufacturer"}},
+	{"REG_ADDR_PRODUCT_CODE", []string{"product code", "product id", "model"}},
+	{"REG_ADDR_FIRMWARE_VERSION", []string{"firmware", "firmware version", "software version", "fw version", "version"}},
+	{"clock:weekday", []string{"weekday", "week", "day of week"}},
+	{"clock:year", []string{"year"}},
+	{"clock:month", []string{"month"}},
+	{"clock:day", []string{"day", "date"}},
+	{"clock:hour", []string{"hour", "hours"}},
+	{"clock:minute", []string{"minute", "minutes", "min"}},
+	{"clock:second", []string{"second", "seconds", "sec"}},
+}
+
+// regmapRequired are the settings LoadConfig needs.
+var regmapRequired = []string{
+	"REG_ADDR_DEVICE_ADDRESS", "REG_ADDR_BAUD_RATE", "REG_ADDR_COMM_FORMAT", "REG_ADDR_WORK_MODE", "REG_ADDR_VALUE_TYPE",
+	"REG_ADDR_DECIMALS", "REG_ADDR_DP_MASK", "REG_ADDR_BLINK_MASK", "REG_ADDR_BLINK_PERIOD_MS", "REG_ADDR_DISPLAY_VALUE_START",
+}
+
+var regmapColumns = map[string][]string{
+	"address": {"address", "addr", "register address", "reg address", "reg addr", "register", "reg", "register no", "reg no", "offset"},
+	"name":    {"name", "parameter", "parameter name", "description", "function", "item", "content", "meaning", "register name"},
+	"count":   {"count", "length", "len", "registers", "number of registers", "regs", "quantity", "qty", "words", "size"},
+	"setting": {"setting", "driver setting"},
+}
+
+type regmapRow struct {
+	line    int
+	name    string
+	setting string // from the setting column
+	addr    int
+	count   int
+}
+
+// regmapNorm lowercases s and reduces it to space-separated words, with a
+// space at each end so that keywords match whole words.
+func regmapNorm(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	return " " + strings.Join(words, " ") + " "
+}
+
+func regmapNumber(s string, hex bool) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	base := 10
+	if hex {
+		base = 16
+	}
+	switch {
+	case strings.HasPrefix(s, "0x"):
+		s, base = s[2:], 16
+	case strings.HasSuffix(s, "h"):
+		s, base = s[:len(s)-1], 16
+	}
+	n, err := strconv.ParseInt(s, base, 32)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid register number %q", s)
+	}
+	return int(n), nil
+}
+
+// regmapAddress parses an address cell: one register, or a range. Numbers
+// without 0x or H are hex when hex is set.
+func regmapAddress(s string, hex bool) (start, count int, err error) {
+	s = strings.Join(strings.Fields(s), "")
+	for _, sep := range []string{"..", "~", "–", "-"} {
+		if a, b, ok := strings.Cut(s, sep); ok {
+			if start, err = regmapNumber(a, hex); err != nil {
+				return 0, 0, err
+			}
+			end, err := regmapNumber(b, hex)
+			if err != nil {
+				return 0, 0, err
+			}
+			if end < start {
+				return 0, 0, fmt.Errorf("range %q ends before it starts", s)
+			}
+			return start, end - start + 1, nil
+		}
+	}
+	start, err = regmapNumber(s, hex)
+	return start, 1, err
+}
+
+// sniffDelimiter picks the separator used most on the first lines.
+func sniffDelimiter(b []byte) rune {
+	lines := bytes.SplitN(b, []byte("\n"), 11)
+	line := bytes.Join(lines[:len(lines)-1], nil)
+	if len(lines) < 11 {
+		line = b
+	}
+	best, n := ',', bytes.Count(line, []byte(","))
+	for _, c := range []rune{';', '\t'} {
+		if m := bytes.Count(line, []byte(string(c))); m > n {
+			best, n = c, m
+		}
+	}
+	return best
+}
+
+// readRegmapCSV reads the rows of a vendor register table.
+func readRegmapCSV(r io.Reader) ([]regmapRow, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	cr := csv.NewReader(bytes.NewReader(b))
+	cr.Comma = sniffDelimiter(b)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.TrimLeadingSpace = true
+
+	var cols *regmapCols // once the header is found
+	var rows []regmapRow
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		if cols == nil {
+			cols = regmapHeader(rec)
+			continue
+		}
+		cell := func(idx ...int) string {
+			var parts []string
+			for _, i := range idx {
+				if i >= 0 && i < len(rec) && strings.TrimSpace(rec[i]) != "" {
+					parts = append(parts, strings.TrimSpace(rec[i]))
+				}
+			}
+			return strings.Join(parts, " ")
+		}
+		addr, name := cell(cols.address), cell(cols.names...)
+		if addr == "" {
+			if len(rows) > 0 && name != "" {
+				rows[len(rows)-1].name += " " + name
+			}
+			continue
+		}
+		row := regmapRow{line: line, name: name, setting: cell(cols.setting)}
+		if row.addr, row.count, err = regmapAddress(addr, cols.hex); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if c := cell(cols.count); c != "" {
+			n, err := strconv.Atoi(c)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("line %d: invalid register count %q", line, c)
+			}
+			if row.count > 1 && n != row.count {
+				return nil, fmt.Errorf("line %d: address range holds %d registers, count says %d", line, row.count, n)
+			}
+			row.count = n
+		}
+		rows = append(rows, row)
+	}
+	if cols == nil {
+		return nil, errors.New("no header row with an address column")
+	}
+	return rows, nil
+}
+
+// regmapCols are the header's column indexes, -1 for absent ones.
+type regmapCols struct {
+	address, count, setting int
+	names                   []int
+	hex                     bool // the address title says "hex"
+}
+
+var regmapParens = regexp.MustCompile(`\([^)]*\)|\[[^\]]*\]`)
+
+// regmapHeader finds the columns in a header row, or returns nil when rec
+// has no address column and so is not the header. A title is compared
+// without its parenthesised part, as in "Address (Hex)". Every name column
+// is kept; of several address or count columns the one whose title comes
+// first in regmapColumns wins ("Address" over "Register").
+func regmapHeader(rec []string) *regmapCols {
+	titles := make([]string, len(rec))
+	for i, h := range rec {
+		titles[i] = strings.TrimSpace(regmapNorm(regmapParens.ReplaceAllString(h, " ")))
+	}
+	find := func(kind string) []int {
+		var idx []int
+		for _, n := range regmapColumns[kind] {
+			for i, t := range titles {
+				if t == n {
+					idx = append(idx, i)
+				}
+			}
+		}
+		return idx
+	}
+	first := func(idx []int) int {
+		if len(idx) == 0 {
+			return -1
+		}
+		return idx[0]
+	}
+	cols := &regmapCols{address: first(find("address")), count: first(find("count")), setting: first(find("setting"))}
+	if cols.address < 0 {
+		return nil
+	}
+	cols.hex = strings.Contains(strings.ToLower(rec[cols.address]), "hex")
+	for _, i := range find("name") {
+		if i != cols.address { // "Register" can be either; it is the address here
+			cols.names = append(cols.names, i)
+		}
+	}
+	sort.Ints(cols.names)
+	return cols
+}
+
+// regmapTarget is the setting a row maps to: an explicit setting column,
+// else the first rule its name matches. "" means the driver doesn't use it.
+func regmapTarget(row regmapRow) (string, error) {
+	if s := strings.TrimSpace(row.setting); s != "" {
+		if strings.EqualFold(s, "ignore") || s == "-" {
+			return "", nil
+		}
+		if clockFields[strings.ToLower(s)] {
+			return "clock:" + strings.ToLower(s), nil
+		}
+		s = strings.ToUpper(s)
+		for _, r := range regmapRules {
+			if r.setting == s {
+				return s, nil
+			}
+		}
+		return "", fmt.Errorf("line %d: %q is not a register setting", row.line, row.setting)
+	}
+	name := regmapNorm(row.name)
+	for _, r := range regmapRules {
+		for _, kw := range r.keywords {
+			if strings.Contains(name, " "+kw+" ") {
+				return r.setting, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// regmapBlock is a setting's registers, for the overlap check.
+type regmapBlock struct {
+	setting     string
+	start, regs int
+}
+
+// buildRegmap turns table rows into CONFIG_FILE settings. notes describe
+// each row's fate; err lists every problem found.
+func buildRegmap(rows []regmapRow, base int) (settings map[string]interface{}, notes []string, err error) {
+	if base < 0 {
+		base = regmapBase(rows)
+		if base > 0 {
+			notes = append(notes, fmt.Sprintf("addresses read as Modicon references from %d (override with -base)", base))
+		}
+	}
+	var errs []string
+	settings = map[string]interface{}{}
+	seen := map[string]int{} // setting -> line
+	var blocks []regmapBlock
+	var display []regmapRow
+	clock := map[string]regmapRow{}
+	for _, row := range rows {
+		row.addr -= base
+		if row.addr < 0 || row.addr+row.count > 0x10000 {
+			errs = append(errs, fmt.Sprintf("line %d: address %d is outside 0..65535 (base %d)", row.line, row.addr+base, base))
+			continue
+		}
+		target, err := regmapTarget(row)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if target == "" {
+			notes = append(notes, fmt.Sprintf("line %d: %q at %d: not used by the driver", row.line, row.name, row.addr))
+			continue
+		}
+		notes = append(notes, fmt.Sprintf("line %d: %q at %d -> %s", row.line, row.name, row.addr, strings.TrimPrefix(target, "clock:")))
+		switch field, isClock := strings.CutPrefix(target, "clock:"); {
+		case target == "REG_ADDR_DISPLAY_VALUE_START":
+			display = append(display, row)
+		case isClock:
+			if prev, dup := clock[field]; dup {
+				errs = append(errs, fmt.Sprintf("line %d: clock %s already at line %d", row.line, field, prev.line))
+				continue
+			}
+			clock[field] = row
+		default:
+			if prev, dup := seen[target]; dup {
+				errs = append(errs, fmt.Sprintf("line %d: %s already at line %d", row.line, target, prev))
+				continue
+			}
+			seen[target] = row.line
+			settings[target] = row.addr
+			blocks = append(blocks, regmapBlock{target, row.addr, row.count})
+		}
+	}
+
+	if len(display) > 0 {
+		sort.Slice(display, func(i, j int) bool { return display[i].addr < display[j].addr })
+		start, end := display[0].addr, display[0].addr
+		for _, row := range display {
+			if row.addr != end {
+				errs = append(errs, fmt.Sprintf("line %d: display value registers are not contiguous (%d follows %d)", row.line, row.addr, end-1))
+			}
+			end = row.addr + row.count
+		}
+		if end-start > maxWriteRegisters {
+			errs = append(errs, fmt.Sprintf("display value spans %d registers; the driver writes at most %d", end-start, maxWriteRegisters))
+		}
+		settings["REG_ADDR_DISPLAY_VALUE_START"], settings["REG_DISPLAY_VALUE_REGS"] = start, end-start
+		blocks = append(blocks, regmapBlock{"REG_ADDR_DISPLAY_VALUE_START", start, end - start})
+	}
+
+	if len(clock) > 0 {
+		fields := make([]string, 0, len(clock))
+		for f := range clock {
+			fields = append(fields, f)
+		}
+		sort.Slice(fields, func(i, j int) bool { return clock[fields[i]].addr < clock[fields[j]].addr })
+		start := clock[fields[0]].addr
+		for i, f := range fields {
+			if row := clock[f]; row.addr != start+i || row.count != 1 {
+				errs = append(errs, fmt.Sprintf("line %d: clock registers must be consecutive, one per field", row.line))
+				break
+			}
+		}
+		settings["REG_ADDR_CLOCK_START"], settings["CLOCK_LAYOUT"] = start, strings.Join(fields, ",")
+		blocks = append(blocks, regmapBlock{"REG_ADDR_CLOCK_START", start, len(fields)})
+	}
+
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].start < blocks[j].start })
+	for i := 1; i < len(blocks); i++ {
+		if a, b := blocks[i-1], blocks[i]; b.start < a.start+a.regs {
+			errs = append(errs, fmt.Sprintf("%s (%d) overlaps %s (%d..%d)", b.setting, b.start, a.setting, a.start, a.start+a.regs-1))
+		}
+	}
+	for _, s := range regmapRequired {
+		if _, ok := settings[s]; !ok {
+			errs = append(errs, "no row for "+s)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, notes, errors.New(strings.Join(errs, "\n"))
+	}
+	return settings, notes, nil
+}
+
+// regmapBase recognises a table of Modicon references: every address
+// 40001..49999 (4xxxx) or 400001..465536 (4xxxxx).
+func regmapBase(rows []regmapRow) int {
+	for _, base := range []int{40001, 400001} {
+		ok := len(rows) > 0
+		for _, row := range rows {
+			if row.addr < base || row.addr-base+row.count > 0x10000 || base == 40001 && row.addr > 49999 {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return base
+		}
+	}
+	return 0
+}
+
+// cliGenRegmap writes the settings to -o or stdout and its notes on the
+// table to stderr.
+func cliGenRegmap(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("gen-regmap", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	profile := fs.String("profile", "", "write the settings as profiles.NAME instead of defaults")
+	base := fs.Int("base", -1, "number of the first register in the table: 0, 1, 40001 or 400001 (default: 40001/400001 for 4xxxx/4xxxxx addresses, else 0)")
+	out := fs.String("o", "", "output file (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected one CSV file (- for stdin)")
+	}
+	in := stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	rows, err := readRegmapCSV(in)
+	if err != nil {
+		return err
+	}
+	settings, notes, err := buildRegmap(rows, *base)
+	for _, n := range notes {
+		fmt.Fprintln(stderr, n)
+	}
+	if err != nil {
+		return fmt.Errorf("register map not written:\n%v", err)
+	}
+	var doc interface{} = map[string]interface{}{"defaults": settings}
+	if *profile != "" {
+		doc = map[string]interface{}{"profiles": map[string]interface{}{*profile: settings}}
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := mergeConfigFile(b, *profile); err != nil {
+		return fmt.Errorf("generated file does not load: %v", err)
+	}
+	b = append(b, '\n')
+	if *out == "" {
+		_, err = stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(*out, b, 0o644)
+}
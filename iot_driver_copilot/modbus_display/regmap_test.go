@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const vendorTable = `SD-7 Modbus register table,,,
+No.;Address (Hex);Parameter;Words;Notes
+1;0000;Device address;1;1-247
+2;0001;Baud rate;1;0=2400 ... 4=19200
+3;0002;Parity / check bit;1;
+4;0003;Work mode;1;
+5;0004;Value type;1;
+6;0005;Decimal places;1;
+7;0006;Decimal point mask;1;
+8;0007;Blink mask;1;
+9;0008;Blink period;1;ms
+10;0010-0011;Display data;;chars 1-4
+11;0012-0013;Display data;;chars 5-8
+;;(continued);;
+12;0020;Year;1;
+13;0021;Month;1;
+14;0022;Day;1;
+15;0023;Hour;1;
+16;0024;Minute;1;
+17;0025;Reserved;1;
+18;0040;Firmware version;1;
+`
+
+func TestGenRegmap(t *testing.T) {
+	rows, err := readRegmapCSV(strings.NewReader(vendorTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, notes, err := buildRegmap(rows, -1)
+	if err != nil {
+		t.Fatalf("buildRegmap: %v\n%s", err, strings.Join(notes, "\n"))
+	}
+	want := map[string]interface{}{
+		"REG_ADDR_DEVICE_ADDRESS": 0, "REG_ADDR_BAUD_RATE": 1, "REG_ADDR_COMM_FORMAT": 2, "REG_ADDR_WORK_MODE": 3,
+		"REG_ADDR_VALUE_TYPE": 4, "REG_ADDR_DECIMALS": 5, "REG_ADDR_DP_MASK": 6, "REG_ADDR_BLINK_MASK": 7,
+		"REG_ADDR_BLINK_PERIOD_MS": 8, "REG_ADDR_DISPLAY_VALUE_START": 16, "REG_DISPLAY_VALUE_REGS": 4,
+		"REG_ADDR_CLOCK_START": 32, "CLOCK_LAYOUT": "year,month,day,hour,minute", "REG_ADDR_FIRMWARE_VERSION": 64,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v", got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if !strings.Contains(strings.Join(notes, "\n"), `"Reserved" at 37: not used`) {
+		t.Errorf("notes: %s", strings.Join(notes, "\n"))
+	}
+
+	for _, tc := range []struct{ csv, err string }{
+		{"Address,Name\n40001,Device address\n40002,Baud rate\n", "no row for REG_ADDR_COMM_FORMAT"},
+		{"Address,Name\n0,Device address\n1,Slave address\n", "REG_ADDR_DEVICE_ADDRESS already at line 2"},
+		{"Address,Name,Setting\n5,Something,REG_ADDR_BAUD\n", `"REG_ADDR_BAUD" is not a register setting`},
+		{"Address,Name\n16,Display value\n18,Display value\n", "not contiguous"},
+		{"Address,Name\n16-19,Display value\n17,Baud rate\n", "REG_ADDR_BAUD_RATE (17) overlaps REG_ADDR_DISPLAY_VALUE_START (16..19)"},
+	} {
+		rows, err := readRegmapCSV(strings.NewReader(tc.csv))
+		if err == nil {
+			_, _, err = buildRegmap(rows, -1)
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: err = %v, want %q", tc.csv, err, tc.err)
+		}
+	}
+
+	dir := t.TempDir()
+	in, out := filepath.Join(dir, "sd7.csv"), filepath.Join(dir, "config.json")
+	if err := os.WriteFile(in, []byte(vendorTable), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	if err := cliGenRegmap([]string{"-profile", "sd7", "-o", out, in}, nil, io.Discard, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{
+		`line 12: "Display data" at 16 -> REG_ADDR_DISPLAY_VALUE_START`,
+		`line 13: "Display data (continued)" at 18 -> REG_ADDR_DISPLAY_VALUE_START`,
+		`line 15: "Year" at 32 -> year`,
+		`line 20: "Reserved" at 37: not used by the driver`,
+	} {
+		if !strings.Contains(stderr.String(), n+"\n") {
+			t.Errorf("notes lack %q:\n%s", n, &stderr)
+		}
+	}
+	raw, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := mergeConfigFile(raw, "sd7"); err != nil || m["REG_DISPLAY_VALUE_REGS"] != "4" {
+		t.Errorf("generated file: %v, %v", m, err)
+	}
+
+	// From stdin to stdout; a table the driver can't use writes nothing
+	// but its notes.
+	var stdout bytes.Buffer
+	stderr.Reset()
+	if err := cliGenRegmap([]string{"-"}, strings.NewReader(vendorTable), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := mergeConfigFile(stdout.Bytes(), ""); err != nil || m["REG_ADDR_FIRMWARE_VERSION"] != "64" {
+		t.Errorf("generated file on stdout: %v, %v", m, err)
+	}
+	stdout.Reset()
+	stderr.Reset()
+	err = cliGenRegmap([]string{"-"}, strings.NewReader("Address,Name\n40001,Device address\n40002,Baud rate\n"), &stdout, &stderr)
+	if err == nil || stdout.Len() != 0 || stderr.String() != "addresses read as Modicon references from 40001 (override with -base)\nline 2: \"Device address\" at 0 -> REG_ADDR_DEVICE_ADDRESS\nline 3: \"Baud rate\" at 1 -> REG_ADDR_BAUD_RATE\n" {
+		t.Errorf("incomplete table: %v, stdout %q, stderr %q", err, &stdout, &stderr)
+	}
+
+	if _, err := readRegmapCSV(strings.NewReader("Address,Name\nfoo,Baud\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("bad address: %v", err)
+	}
+}
+
+func TestRegmapBase(t *testing.T) {
+	rows, err := readRegmapCSV(strings.NewReader("Register;Name\n40001;Baud rate\n40017-40020;Display value\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base := regmapBase(rows); base != 40001 {
+		t.Errorf("base = %d", base)
+	}
+	rows[0].addr, rows[1].addr = 1, 17
+	if base := regmapBase(rows); base != 0 {
+		t.Errorf("base of plain addresses = %d", base)
+	}
+}
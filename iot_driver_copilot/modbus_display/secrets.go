@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Secrets stay out of the plain environment in two ways.
+//
+// NAME_FILE: each of secretSettings may instead be read from the file named
+// by NAME_FILE (one trailing newline is dropped), as with Docker and
+// systemd credentials. Setting both NAME and NAME_FILE is an error.
+//
+// A sealed CONFIG_FILE section: "sealed" holds settings encrypted with
+// AES-256-GCM, made with `driver seal`. They apply over the profile and
+// under the real environment. The 32-byte key (raw, or as 64 hex digits)
+// comes from CONFIG_KEY_FILE, or from the kernel keyring as the "user" key
+// named by CONFIG_KEYRING_KEY. A TPM-sealed key reaches the driver through
+// systemd: LoadCredentialEncrypted=config-key:... and
+// CONFIG_KEY_FILE=${CREDENTIALS_DIRECTORY}/config-key.
+
+// secretSettings accept NAME_FILE.
+var secretSettings = []string{"ADMIN_TOKEN", "TENANT_KEYS", "MQTT_PASSWORD", "SMTP_PASSWORD", "TELEGRAM_BOT_TOKEN", "SNMP_COMMUNITY"}
+
+const sealedPrefix = "v1:"
+
+// applySecretFiles loads the NAME_FILE secrets into the environment, before
+// CONFIG_FILE, so a secret file wins over the file's sections.
+func applySecretFiles() {
+	for _, name := range secretSettings {
+		path := os.Getenv(name + "_FILE")
+		if path == "" {
+			continue
+		}
+		if os.Getenv(name) != "" {
+			configFatalf("%s and %s_FILE are both set", name, name)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			configFatalf("%s_FILE: %v", name, err)
+		}
+		s := strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
+		if s == "" {
+			configFatalf("%s_FILE: %s is empty", name, path)
+		}
+		os.Setenv(name, s)
+	}
+}
+
+// configKey loads the key of the sealed section.
+func configKey() ([]byte, error) {
+	file, desc := os.Getenv("CONFIG_KEY_FILE"), os.Getenv("CONFIG_KEYRING_KEY")
+	var raw []byte
+	var err error
+	switch {
+	case file != "" && desc != "":
+		return nil, errors.New("set CONFIG_KEY_FILE or CONFIG_KEYRING_KEY, not both")
+	case file != "":
+		raw, err = os.ReadFile(file)
+	case desc != "":
+		raw, err = readKeyring(desc)
+	default:
+		return nil, errors.New("sealed settings need CONFIG_KEY_FILE or CONFIG_KEYRING_KEY")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 32 {
+		return raw, nil
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(raw))); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("config key must be 32 bytes or 64 hex digits")
+}
+
+// sealSettings encrypts a JSON object of settings for the "sealed" section.
+func sealSettings(plain, key []byte) (string, error) {
+	var m map[string]configValue
+	if err := json.Unmarshal(plain, &m); err != nil {
+		return "", err
+	}
+	for k := range m {
+		if !configSettings[k] {
+			return "", fmt.Errorf("unknown setting %q", k)
+		}
+	}
+	gcm, err := configCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return sealedPrefix + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, nil)), nil
+}
+
+// unsealSettings decrypts a "sealed" section.
+func unsealSettings(sealed string, key []byte) (map[string]configValue, error) {
+	enc, ok := strings.CutPrefix(sealed, sealedPrefix)
+	if !ok {
+		return nil, errors.New("not made by this version of `driver seal`")
+	}
+	b, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := configCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("truncated")
+	}
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("cannot decrypt: wrong key or corrupted section")
+	}
+	var m map[string]configValue
+	if err := json.Unmarshal(plain, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func configCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+const (
+	keyctlSearch       = 10
+	keyctlRead         = 11
+	keySpecUserKeyring = -4
+)
+
+// readKeyring returns the payload of the "user" key desc. The keyrings of
+// the process and its session are searched first, then the user keyring,
+// which systemd services only see with KeyringMode=shared.
+func readKeyring(desc string) ([]byte, error) {
+	typ, _ := syscall.BytePtrFromString("user")
+	d, err := syscall.BytePtrFromString(desc)
+	if err != nil {
+		return nil, err
+	}
+	id, _, errno := syscall.Syscall6(syscall.SYS_REQUEST_KEY, uintptr(unsafe.Pointer(typ)), uintptr(unsafe.Pointer(d)), 0, 0, 0, 0)
+	if errno != 0 {
+		ring := keySpecUserKeyring
+		id, _, errno = syscall.Syscall6(syscall.SYS_KEYCTL, keyctlSearch, uintptr(ring), uintptr(unsafe.Pointer(typ)), uintptr(unsafe.Pointer(d)), 0, 0)
+	}
+	if errno != 0 {
+		return nil, fmt.Errorf("keyring key %q: %v", desc, errno)
+	}
+	buf := make([]byte, 4096)
+	n, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlRead, id, uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)), 0, 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("keyring key %q: %v", desc, errno)
+	}
+	if int(n) > len(buf) {
+		return nil, fmt.Errorf("keyring key %q: %d bytes is too long for a key", desc, n)
+	}
+	return buf[:n], nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func writeTestKey(t *testing.T, key []byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config-key")
+	if err := os.WriteFile(path, key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_KEY_FILE", path)
+	t.Setenv("CONFIG_KEYRING_KEY", "")
+}
+
+func TestSealedConfigSection(t *testing.T) {
+	key := []byte(strings.Repeat("k", 32))
+	writeTestKey(t, []byte(hex.EncodeToString(key)+"\n"))
+	sealed, err := sealSettings([]byte(`{"MQTT_PASSWORD": "hunter2", "SLAVE_ID": 9}`), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := `{"defaults": {"SLAVE_ID": 1, "MQTT_PASSWORD": "placeholder"}, "profiles": {"lab": {"SLAVE_ID": 2}}, "sealed": "` + sealed + `"}`
+	got, err := mergeConfigFile([]byte(raw), "lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["MQTT_PASSWORD"] != "hunter2" || got["SLAVE_ID"] != "9" {
+		t.Errorf("merged = %v", got)
+	}
+
+	writeTestKey(t, []byte(strings.Repeat("x", 32)))
+	if _, err := mergeConfigFile([]byte(raw), ""); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Errorf("wrong key: err = %v", err)
+	}
+	t.Setenv("CONFIG_KEY_FILE", "")
+	if _, err := mergeConfigFile([]byte(raw), ""); err == nil || !strings.Contains(err.Error(), "CONFIG_KEY_FILE") {
+		t.Errorf("no key: err = %v", err)
+	}
+	if _, err := sealSettings([]byte(`{"MQTT_PASWORD": "x"}`), key); err == nil {
+		t.Error("sealing an unknown setting succeeded")
+	}
+}
+
+func TestApplySecretFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ADMIN_TOKEN", "")
+	t.Setenv("ADMIN_TOKEN_FILE", path)
+	applySecretFiles()
+	if got := os.Getenv("ADMIN_TOKEN"); got != "s3cret" {
+		t.Errorf("ADMIN_TOKEN = %q", got)
+	}
+}
+
+func TestReadKeyring(t *testing.T) {
+	// Add a key to this process's keyring; containers often filter keyctl.
+	typ, _ := syscall.BytePtrFromString("user")
+	desc, _ := syscall.BytePtrFromString("modbus-display-test")
+	payload := []byte(strings.Repeat("ab", 32))
+	ring := -2 // KEY_SPEC_PROCESS_KEYRING
+	if _, _, errno := syscall.Syscall6(syscall.SYS_ADD_KEY, uintptr(unsafe.Pointer(typ)), uintptr(unsafe.Pointer(desc)),
+		uintptr(unsafe.Pointer(&payload[0])), uintptr(len(payload)), uintptr(ring), 0); errno != 0 {
+		t.Skipf("add_key: %v", errno)
+	}
+	t.Setenv("CONFIG_KEY_FILE", "")
+	t.Setenv("CONFIG_KEYRING_KEY", "modbus-display-test")
+	key, err := configKey()
+	if err != nil || len(key) != 32 || key[0] != 0xab {
+		t.Errorf("configKey() = %x, %v", key, err)
+	}
+}
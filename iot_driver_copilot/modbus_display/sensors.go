@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sensor channels: some display models mirror their analog inputs into
+// holding registers. SENSOR_CHANNELS names one channel per register from
+// SENSOR_REG_START on, as ';'-separated name[:scale[:offset[:unit]]]
+// entries ("temp:0.1:-40:°C;humidity:0.1::%;ai3;ai4"). Every poll reads the
+// block with the status; each value is raw*scale+offset, with raw read as
+// int16 when SENSOR_SIGNED=true. Values appear in /status (and so in the
+// status stream) as "sensors", in full at GET /sensors, and are published
+// to SENSOR_MQTT_TOPIC after every poll when it is set.
+
+type sensorChannel struct {
+	Name   string
+	Addr   uint16
+	Scale  float64
+	Offset float64
+	Unit   string
+}
+
+type sensorReading struct {
+	Name     string  `json:"name"`
+	Register uint16  `json:"register"`
+	Raw      int     `json:"raw"`
+	Value    float64 `json:"value"`
+	Unit     string  `json:"unit,omitempty"`
+}
+
+type SensorEvent struct {
+	Event     string          `json:"event"` // always "sensors"
+	SlaveId   int             `json:"slave_id"`
+	Channels  []sensorReading `json:"channels"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// parseSensorChannels reads SENSOR_CHANNELS for a block starting at start.
+func parseSensorChannels(s string, start uint16) ([]sensorChannel, error) {
+	var out []sensorChannel
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 4)
+		ch := sensorChannel{Name: strings.TrimSpace(parts[0]), Addr: start + uint16(len(out)), Scale: 1}
+		if ch.Name == "" || seen[ch.Name] {
+			return nil, fmt.Errorf("entry %q: channel names must be unique and non-empty", entry)
+		}
+		seen[ch.Name] = true
+		for i, dst := range []*float64{&ch.Scale, &ch.Offset} {
+			if i+1 >= len(parts) || strings.TrimSpace(parts[i+1]) == "" {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(parts[i+1]), 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("%s: invalid number %q", ch.Name, parts[i+1])
+			}
+			*dst = v
+		}
+		if len(parts) == 4 {
+			ch.Unit = strings.TrimSpace(parts[3])
+		}
+		if uint32(start)+uint32(len(out)) > 0xFFFF {
+			return nil, fmt.Errorf("%s: block runs past register 65535", ch.Name)
+		}
+		out = append(out, ch)
+	}
+	if len(out) > 125 {
+		return nil, fmt.Errorf("%d channels; one read covers at most 125", len(out))
+	}
+	return out, nil
+}
+
+// decodeSensors scales the registers of the sensor block.
+func (d *ModbusDriver) decodeSensors(b []byte) []sensorReading {
+	out := make([]sensorReading, 0, len(d.cfg.SensorChannels))
+	for i, ch := range d.cfg.SensorChannels {
+		if 2*i+2 > len(b) {
+			break
+		}
+		v := binary.BigEndian.Uint16(b[2*i:])
+		raw := int(v)
+		if d.cfg.SensorSigned {
+			raw = int(int16(v))
+		}
+		// Round off the float noise of the scaling (235*0.1 = 23.500000000000004).
+		value := math.Round((float64(raw)*ch.Scale+ch.Offset)*1e6) / 1e6
+		out = append(out, sensorReading{Name: ch.Name, Register: ch.Addr, Raw: raw, Value: value, Unit: ch.Unit})
+	}
+	return out
+}
+
+func sensorValues(readings []sensorReading) map[string]float64 {
+	if len(readings) == 0 {
+		return nil
+	}
+	m := make(map[string]float64, len(readings))
+	for _, r := range readings {
+		m[r.Name] = r.Value
+	}
+	return m
+}
+
+// publishSensors sends a poll's readings to SENSOR_MQTT_TOPIC.
+func (d *ModbusDriver) publishSensors(st DeviceStatus) {
+	if d.cfg.SensorMQTTTopic == "" || len(st.sensors) == 0 {
+		return
+	}
+	d.notifier.Send("mqtt", d.cfg.SensorMQTTTopic, SensorEvent{Event: "sensors", SlaveId: d.cfg.SlaveId, Channels: st.sensors, Timestamp: st.lastUpdateTime})
+}
+
+func (d *ModbusDriver) handleSensors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(d.cfg.SensorChannels) == 0 {
+		http.Error(w, "sensor channels not configured", http.StatusNotFound)
+		return
+	}
+	d.statusMu.RLock()
+	st := d.status
+	d.statusMu.RUnlock()
+	if st.sensors == nil {
+		http.Error(w, "no sensor reading yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(SensorEvent{Event: "sensors", SlaveId: d.cfg.SlaveId, Channels: st.sensors, Timestamp: st.lastUpdateTime})
+}
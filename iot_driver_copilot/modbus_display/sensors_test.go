@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestParseSensorChannels(t *testing.T) {
+	chs, err := parseSensorChannels("temp:0.1:-40:°C; humidity:0.1::% ;ai3;;", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sensorChannel{
+		{Name: "temp", Addr: 100, Scale: 0.1, Offset: -40, Unit: "°C"},
+		{Name: "humidity", Addr: 101, Scale: 0.1, Unit: "%"},
+		{Name: "ai3", Addr: 102, Scale: 1},
+	}
+	if len(chs) != len(want) {
+		t.Fatalf("got %+v", chs)
+	}
+	for i := range want {
+		if chs[i] != want[i] {
+			t.Errorf("channel %d = %+v, want %+v", i, chs[i], want[i])
+		}
+	}
+	for _, bad := range []string{"temp;temp", ":0.1", "temp:x", "temp:1:NaN", "a;b"} {
+		start := uint16(0)
+		if bad == "a;b" {
+			start = 0xFFFF
+		}
+		if _, err := parseSensorChannels(bad, start); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestDecodeSensors(t *testing.T) {
+	d := &ModbusDriver{}
+	d.cfg.SensorChannels, _ = parseSensorChannels("t:0.1;p", 0)
+	b := []byte{0xFF, 0x9C, 0x00, 0x2A} // -100 or 65436, 42
+	if got := d.decodeSensors(b); got[0].Value != 6543.6 || got[1].Value != 42 {
+		t.Errorf("unsigned: %+v", got)
+	}
+	d.cfg.SensorSigned = true
+	if got := d.decodeSensors(b); got[0].Raw != -100 || got[0].Value != -10 {
+		t.Errorf("signed: %+v", got)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// GET/PUT /serial expose the driver's own end of the link: the port it
+// opens and the line settings and RS-485 RTS timing it opens it with. This
+// is unlike /comm/config, which writes the device's registers; /serial is
+// for catching up after the device was changed some other way. A PUT
+// (ADMIN_TOKEN required) reopens the port straight away and keeps the old
+// settings if that fails. Changes last until restart.
+
+type rs485View struct {
+	Enabled              *bool `json:"enabled,omitempty"`
+	DelayRtsBeforeSendMs *int  `json:"delay_rts_before_send_ms,omitempty"`
+	DelayRtsAfterSendMs  *int  `json:"delay_rts_after_send_ms,omitempty"`
+	RtsHighDuringSend    *bool `json:"rts_high_during_send,omitempty"`
+	RtsHighAfterSend     *bool `json:"rts_high_after_send,omitempty"`
+	RxDuringTx           *bool `json:"rx_during_tx,omitempty"`
+	SoftwareRTS          *bool `json:"software_rts,omitempty"`
+}
+
+type serialReq struct {
+	Port     *string    `json:"port,omitempty"`
+	BaudRate *int       `json:"baud_rate,omitempty"`
+	DataBits *int       `json:"data_bits,omitempty"`
+	Parity   *string    `json:"parity,omitempty"`
+	StopBits *int       `json:"stop_bits,omitempty"`
+	MinGapMs *int       `json:"min_gap_ms,omitempty"`
+	RS485    *rs485View `json:"rs485,omitempty"`
+}
+
+// serialView returns the settings in c; for the current ones the caller
+// holds mbusMu.
+func serialView(c Config) serialReq {
+	before, after := int(c.RS485.DelayRtsBeforeSend/time.Millisecond), int(c.RS485.DelayRtsAfterSend/time.Millisecond)
+	gap := int(c.ModbusMinGap / time.Millisecond)
+	return serialReq{
+		Port: &c.SerialPort, BaudRate: &c.BaudRate, DataBits: &c.DataBits, Parity: &c.Parity, StopBits: &c.StopBits, MinGapMs: &gap,
+		RS485: &rs485View{
+			Enabled: &c.RS485.Enabled, DelayRtsBeforeSendMs: &before, DelayRtsAfterSendMs: &after,
+			RtsHighDuringSend: &c.RS485.RtsHighDuringSend, RtsHighAfterSend: &c.RS485.RtsHighAfterSend, RxDuringTx: &c.RS485.RxDuringTx,
+			SoftwareRTS: &c.RS485SoftwareRTS,
+		},
+	}
+}
+
+// apply merges req into c, reporting the first invalid field.
+func (req serialReq) apply(c *Config) string {
+	if req.Port != nil {
+		if *req.Port == "" {
+			return "port must not be empty"
+		}
+		c.SerialPort = *req.Port
+	}
+	if req.BaudRate != nil {
+		if *req.BaudRate <= 0 {
+			return "baud_rate must be >0"
+		}
+		c.BaudRate = *req.BaudRate
+	}
+	if req.DataBits != nil {
+		if *req.DataBits < 5 || *req.DataBits > 8 {
+			return "data_bits must be 5..8"
+		}
+		c.DataBits = *req.DataBits
+	}
+	if req.Parity != nil {
+		p := strings.ToUpper(*req.Parity)
+		if p != "N" && p != "E" && p != "O" {
+			return "parity must be N, E or O"
+		}
+		c.Parity = p
+	}
+	if req.StopBits != nil {
+		if *req.StopBits != 1 && *req.StopBits != 2 {
+			return "stop_bits must be 1 or 2"
+		}
+		c.StopBits = *req.StopBits
+	}
+	if req.MinGapMs != nil {
+		if *req.MinGapMs < 0 {
+			return "min_gap_ms must be >=0"
+		}
+		c.ModbusMinGap = time.Duration(*req.MinGapMs) * time.Millisecond
+	}
+	if rs := req.RS485; rs != nil {
+		set := func(dst *bool, v *bool) {
+			if v != nil {
+				*dst = *v
+			}
+		}
+		set(&c.RS485.Enabled, rs.Enabled)
+		set(&c.RS485.RtsHighDuringSend, rs.RtsHighDuringSend)
+		set(&c.RS485.RtsHighAfterSend, rs.RtsHighAfterSend)
+		set(&c.RS485.RxDuringTx, rs.RxDuringTx)
+		set(&c.RS485SoftwareRTS, rs.SoftwareRTS)
+		for _, dl := range []struct {
+			ms  *int
+			dst *time.Duration
+		}{{rs.DelayRtsBeforeSendMs, &c.RS485.DelayRtsBeforeSend}, {rs.DelayRtsAfterSendMs, &c.RS485.DelayRtsAfterSend}} {
+			if dl.ms != nil {
+				if *dl.ms < 0 {
+					return "rs485 delays must be >=0"
+				}
+				*dl.dst = time.Duration(*dl.ms) * time.Millisecond
+			}
+		}
+	}
+	if c.RS485.Enabled && c.RS485SoftwareRTS {
+		return "rs485 enabled and software_rts are exclusive"
+	}
+	return ""
+}
+
+func (d *ModbusDriver) handleSerial(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !d.adminEnabled() {
+			http.Error(w, "serial changes disabled: ADMIN_TOKEN not set", http.StatusForbidden)
+			return
+		}
+		if !d.adminAuthorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req serialReq
+		if !d.decodeJSON(w, r, &req) {
+			return
+		}
+		if dryRun(r) {
+			d.planSerial(w, req)
+			return
+		}
+		if code, msg := d.reopenSerial(req); code != 0 {
+			http.Error(w, msg, code)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d.mbusMu.Lock()
+	view := serialView(d.cfg)
+	d.mbusMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(view)
+}
+
+// planSerial answers a dry run of req: the port closed and opened again
+// with the settings it would leave.
+func (d *ModbusDriver) planSerial(w http.ResponseWriter, req serialReq) {
+	if d.firmwareBusy.Load() {
+		http.Error(w, "firmware upload in progress", http.StatusConflict)
+		return
+	}
+	d.mbusMu.Lock()
+	next := d.cfg
+	msg := req.apply(&next)
+	d.mbusMu.Unlock()
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	d.replyDryRun(w, []plannedOp{{Op: "reopen_serial", Detail: serialView(next)}})
+}
+
+// reopenSerial applies req and reopens the port with it. When the port
+// won't open the previous settings are restored and reopened.
+func (d *ModbusDriver) reopenSerial(req serialReq) (int, string) {
+	if d.firmwareBusy.Load() {
+		return http.StatusConflict, "firmware upload in progress"
+	}
+	d.mbusMu.Lock()
+	defer d.mbusMu.Unlock()
+	next := d.cfg
+	if msg := req.apply(&next); msg != "" {
+		return http.StatusBadRequest, msg
+	}
+	prev := d.cfg
+	if d.link != nil {
+		_ = d.link.Close()
+	}
+	d.setSerial(next)
+	d.buildLink()
+	err := d.link.Connect()
+	if err != nil {
+		d.setSerial(prev)
+		d.buildLink()
+	}
+	// The poll loop reconnects on its own if this fails too.
+	d.client = nil
+	if d.link.Connect() == nil {
+		d.client = modbus.NewClient2(d.handler, d.link)
+	}
+	if err != nil {
+		return http.StatusBadRequest, "open " + next.SerialPort + ": " + err.Error()
+	}
+	d.logger.Printf("serial link now %s %d %d%s%d (rs485 %v)", next.SerialPort, next.BaudRate, next.DataBits, next.Parity, next.StopBits, next.RS485.Enabled)
+	return 0, ""
+}
+
+// setSerial copies just the link settings from c, leaving the rest of
+// d.cfg alone for the goroutines reading it. The caller holds mbusMu.
+func (d *ModbusDriver) setSerial(c Config) {
+	d.cfg.SerialPort, d.cfg.BaudRate, d.cfg.DataBits, d.cfg.Parity, d.cfg.StopBits = c.SerialPort, c.BaudRate, c.DataBits, c.Parity, c.StopBits
+	d.cfg.RS485, d.cfg.RS485SoftwareRTS, d.cfg.ModbusMinGap = c.RS485, c.RS485SoftwareRTS, c.ModbusMinGap
+}
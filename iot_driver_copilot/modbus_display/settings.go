@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GET on the settings endpoints (/blink/period, /display/config,
+// /display/value, /comm/config) returns the fields a PUT there controls, in
+// the shape of the PUT body, so a UI can fill its form from it. Values come
+// from the status cache; ?refresh=true reads just those registers first.
+// STATUS_FIELD_MAP does not apply: the names are the PUT body's.
+//
+// Each GET carries an ETag over those values. A PUT with If-Match is
+// refused with 412 when the values changed since, whether by another
+// client or on the device, so two operators editing the same settings
+// can't silently overwrite each other; without If-Match a PUT always goes
+// ahead. Successful PUTs return the new ETag.
+
+func commConfigView(st DeviceStatus) interface{} {
+	return commConfigReq{DeviceAddress: &st.DeviceAddress, BaudRate: &st.BaudRate, CommFormat: &st.CommFormat}
+}
+
+func displayConfigView(st DeviceStatus) interface{} {
+	return displayConfigReq{ValueType: &st.ValueType, Decimals: &st.Decimals, WorkMode: &st.WorkMode}
+}
+
+func displayValueView(st DeviceStatus) interface{} {
+	return map[string]string{"display_value": st.DisplayValue}
+}
+
+func blinkPeriodView(st DeviceStatus) interface{} {
+	return blinkPeriodReq{BlinkPeriodMs: &st.BlinkPeriodMs}
+}
+
+func etagOf(v interface{}) string {
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// settingsETag is the ETag of the cached values view selects.
+func (d *ModbusDriver) settingsETag(view func(DeviceStatus) interface{}) string {
+	d.statusMu.RLock()
+	st := d.status
+	d.statusMu.RUnlock()
+	return etagOf(view(st))
+}
+
+// ifMatch checks r's If-Match against the current values and answers 412
+// when none of its tags match. The caller holds settingsMu.
+func (d *ModbusDriver) ifMatch(w http.ResponseWriter, r *http.Request, view func(DeviceStatus) interface{}) bool {
+	h := r.Header.Get("If-Match")
+	if h == "" {
+		return true
+	}
+	cur := d.settingsETag(view)
+	for _, tag := range strings.Split(h, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == cur {
+			return true
+		}
+	}
+	w.Header().Set("ETag", cur)
+	http.Error(w, "settings changed since they were read", http.StatusPreconditionFailed)
+	return false
+}
+
+func (d *ModbusDriver) serveSettings(w http.ResponseWriter, r *http.Request, refresh func() error, view func(DeviceStatus) interface{}) {
+	if v := r.URL.Query().Get("refresh"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "invalid refresh", http.StatusBadRequest)
+			return
+		}
+		if b {
+			if err := refresh(); err != nil {
+				d.logger.Printf("refresh %s failed: %v", r.URL.Path, err)
+				http.Error(w, "device read error", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	d.statusMu.RLock()
+	st := d.status
+	d.statusMu.RUnlock()
+	v := view(st)
+	w.Header().Set("ETag", etagOf(v))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (d *ModbusDriver) refreshBlinkPeriod() error {
+	if d.blinker != nil {
+		return nil // emulated; the cache is the only copy
+	}
+	v, err := d.readU16(d.cfg.RegBlinkPeriodMs)
+	if err != nil {
+		return err
+	}
+	d.statusMu.Lock()
+	d.status.BlinkPeriodMs = v
+	d.statusMu.Unlock()
+	return nil
+}
+
+func (d *ModbusDriver) refreshDisplayConfig() error {
+	var v [3]uint16
+	for i, reg := range []uint16{d.cfg.RegValueType, d.cfg.RegDecimals, d.cfg.RegWorkMode} {
+		var err error
+		if v[i], err = d.readU16(reg); err != nil {
+			return err
+		}
+	}
+	d.statusMu.Lock()
+	d.status.ValueType, d.status.Decimals, d.status.WorkMode = v[0], v[1], v[2]
+	d.statusMu.Unlock()
+	return nil
+}
+
+func (d *ModbusDriver) refreshDisplayValue() error {
+	if d.blinker != nil {
+		return nil // the device may be mid-blink; the cache holds the commanded value
+	}
+	b, err := d.readRegs(d.cfg.RegDisplayValueStart, uint16(d.cfg.DisplayValueRegs))
+	if err != nil {
+		return err
+	}
+	val, err := d.codec.Decode(b)
+	if err != nil {
+		return err
+	}
+	d.statusMu.Lock()
+	d.status.DisplayValue = val
+	d.statusMu.Unlock()
+	return nil
+}
+
+func (d *ModbusDriver) refreshCommConfig() error {
+	var v [3]uint16
+	for i, reg := range []uint16{d.cfg.RegDeviceAddress, d.cfg.RegBaudRate, d.cfg.RegCommFormat} {
+		var err error
+		if v[i], err = d.readU16(reg); err != nil {
+			return err
+		}
+	}
+	d.statusMu.Lock()
+	d.status.DeviceAddress, d.status.BaudRate, d.status.CommFormat = int(v[0]), int(v[1]), d.decodeCommFormat(v[2])
+	d.statusMu.Unlock()
+	return nil
+}
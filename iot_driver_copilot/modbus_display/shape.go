@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response shaping for consumers that can't take the API's own JSON:
+// RESPONSE_ENVELOPE=data wraps every JSON body as {"data": <body>, "ts": <unix ms>}
+// and RESPONSE_CASE=camel renames object keys (slave_id -> slaveId), for the
+// whole driver or, with RESPONSE_SHAPE_ROUTES, per route. Only
+// application/json bodies are touched; errors (text/plain), metrics and event
+// streams pass through as they are.
+
+type responseShape struct {
+	Envelope bool // {"data": ..., "ts": ...}
+	Camel    bool // camelCase object keys
+}
+
+// parseResponseShape reads a route's shape, "data+camel" or "none+snake";
+// either half may be left out to keep def's.
+func parseResponseShape(spec string, def responseShape) (responseShape, error) {
+	s := def
+	for _, part := range strings.Split(spec, "+") {
+		switch strings.TrimSpace(part) {
+		case "data":
+			s.Envelope = true
+		case "none":
+			s.Envelope = false
+		case "camel":
+			s.Camel = true
+		case "snake":
+			s.Camel = false
+		default:
+			return s, fmt.Errorf("unknown response shape %q (expected data|none and camel|snake)", part)
+		}
+	}
+	return s, nil
+}
+
+// parseShapeRoutes reads RESPONSE_SHAPE_ROUTES: comma-separated
+// path=shape entries, e.g. "/status=data+camel,/registers/=camel". A path
+// ending in / covers everything under it.
+func parseShapeRoutes(spec string, def responseShape) (map[string]responseShape, error) {
+	routes := map[string]responseShape{}
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		path, shape, ok := strings.Cut(entry, "=")
+		path = strings.TrimSpace(path)
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid route %q (expected /path=shape)", entry)
+		}
+		s, err := parseResponseShape(shape, def)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", path, err)
+		}
+		routes[path] = s
+	}
+	return routes, nil
+}
+
+// shapeFor picks the exact route, else the longest matching subtree.
+func shapeFor(path string, def responseShape, routes map[string]responseShape) responseShape {
+	if s, ok := routes[path]; ok {
+		return s
+	}
+	best, s := "", def
+	for p, rs := range routes {
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) && len(p) > len(best) {
+			best, s = p, rs
+		}
+	}
+	return s
+}
+
+type shapeWriter struct {
+	http.ResponseWriter
+	shape   responseShape
+	status  int
+	buf     bytes.Buffer // the JSON body, reshaped at finish
+	json    bool
+	decided bool
+}
+
+func (sw *shapeWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	if !sw.decided {
+		sw.decide()
+	}
+}
+
+func (sw *shapeWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if !sw.decided {
+		sw.decide()
+	}
+	if sw.json {
+		return sw.buf.Write(p)
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// decide holds back JSON bodies and sends anything else straight through.
+func (sw *shapeWriter) decide() {
+	sw.decided = true
+	sw.json = strings.HasPrefix(sw.Header().Get("Content-Type"), "application/json") && sw.status != http.StatusNoContent
+	if !sw.json {
+		sw.ResponseWriter.WriteHeader(sw.status)
+	}
+}
+
+func (sw *shapeWriter) Flush() {
+	if sw.json {
+		return
+	}
+	if !sw.decided {
+		sw.status = http.StatusOK
+		sw.decide()
+	}
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *shapeWriter) finish() {
+	if !sw.json {
+		return
+	}
+	body, err := reshapeJSON(sw.buf.Bytes(), sw.shape, time.Now())
+	if err != nil {
+		body = sw.buf.Bytes() // not valid JSON after all; send it unchanged
+	}
+	sw.Header().Del("Content-Length")
+	sw.ResponseWriter.WriteHeader(sw.status)
+	_, _ = sw.ResponseWriter.Write(body)
+}
+
+// reshapeJSON applies s to one JSON document, keeping key order and number
+// formatting.
+func reshapeJSON(body []byte, s responseShape, now time.Time) ([]byte, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		body = []byte("null")
+	}
+	if s.Camel {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var out bytes.Buffer
+		if err := camelValue(dec, &out); err != nil {
+			return nil, err
+		}
+		if dec.More() {
+			return nil, fmt.Errorf("trailing data after JSON value")
+		}
+		body = out.Bytes()
+	}
+	if s.Envelope {
+		var out bytes.Buffer
+		out.WriteString(`{"data":`)
+		out.Write(body)
+		out.WriteString(`,"ts":`)
+		out.WriteString(strconv.FormatInt(now.UnixMilli(), 10))
+		out.WriteString("}")
+		body = out.Bytes()
+	}
+	return append(body, '\n'), nil
+}
+
+// camelValue copies the next JSON value from dec to out with its object
+// keys, at any depth, in camelCase.
+func camelValue(dec *json.Decoder, out *bytes.Buffer) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		out.WriteByte('{')
+		for i := 0; dec.More(); i++ {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			k, _ := json.Marshal(camelCase(key.(string)))
+			out.Write(k)
+			out.WriteByte(':')
+			if err := camelValue(dec, out); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		out.WriteByte('}')
+	case json.Delim('['):
+		out.WriteByte('[')
+		for i := 0; dec.More(); i++ {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := camelValue(dec, out); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		out.WriteByte(']')
+	default:
+		b, err := json.Marshal(tok)
+		if err != nil {
+			return err
+		}
+		out.Write(b)
+	}
+	return nil
+}
+
+// camelCase turns snake_case into camelCase: slave_id -> slaveId,
+// delay_rts_before_send_ms -> delayRtsBeforeSendMs. Keys without an
+// underscore or with capitals (names taken from STATUS_FIELD_MAP or alarm
+// rules) are left alone.
+func camelCase(key string) string {
+	if !strings.Contains(key, "_") || strings.ToLower(key) != key {
+		return key
+	}
+	parts := strings.Split(key, "_")
+	var b strings.Builder
+	b.WriteString(parts[0])
+	for _, p := range parts[1:] {
+		if p == "" {
+			continue
+		}
+		if b.Len() == 0 {
+			b.WriteString(p)
+			continue
+		}
+		b.WriteString(strings.ToUpper(p[:1]) + p[1:])
+	}
+	return b.String()
+}
+
+func shapeHandler(def responseShape, routes map[string]responseShape, next http.Handler) http.Handler {
+	if def == (responseShape{}) && len(routes) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := shapeFor(r.URL.Path, def, routes)
+		if s == (responseShape{}) || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sw := &shapeWriter{ResponseWriter: w, shape: s}
+		defer sw.finish()
+		next.ServeHTTP(sw, r)
+	})
+}
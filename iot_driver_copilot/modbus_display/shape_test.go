@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCamelCase(t *testing.T) {
+	for in, want := range map[string]string{
+		"slave_id":                 "slaveId",
+		"delay_rts_before_send_ms": "delayRtsBeforeSendMs",
+		"ok":                       "ok",
+		"1":                        "1",
+		"TEMP_HIGH":                "TEMP_HIGH",
+		"_private":                 "private",
+		"a__b":                     "aB",
+	} {
+		if got := camelCase(in); got != want {
+			t.Errorf("camelCase(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestReshapeJSON(t *testing.T) {
+	now := time.UnixMilli(1760601600123)
+	body := `{"slave_id":1,"values":[{"blink_mask":3,"raw_value":12.50}],"ok":true,"note":"a_b <c>"}` + "\n"
+	for _, tc := range []struct {
+		shape responseShape
+		want  string
+	}{
+		{responseShape{Camel: true}, `{"slaveId":1,"values":[{"blinkMask":3,"rawValue":12.50}],"ok":true,"note":"a_b \u003cc\u003e"}`},
+		{responseShape{Envelope: true}, `{"data":{"slave_id":1,"values":[{"blink_mask":3,"raw_value":12.50}],"ok":true,"note":"a_b <c>"},"ts":1760601600123}`},
+		{responseShape{Envelope: true, Camel: true}, `{"data":{"slaveId":1,"values":[{"blinkMask":3,"rawValue":12.50}],"ok":true,"note":"a_b \u003cc\u003e"},"ts":1760601600123}`},
+	} {
+		got, err := reshapeJSON([]byte(body), tc.shape, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want+"\n" {
+			t.Errorf("%+v:\n got %s\nwant %s", tc.shape, got, tc.want)
+		}
+	}
+	if _, err := reshapeJSON([]byte(`{"a_b":`), responseShape{Camel: true}, now); err == nil {
+		t.Error("truncated JSON reshaped without error")
+	}
+}
+
+func TestParseShapeRoutes(t *testing.T) {
+	def := responseShape{Camel: true}
+	routes, err := parseShapeRoutes("/status=data, /registers/=snake,/info=data+snake", def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]responseShape{
+		"/status":         {Envelope: true, Camel: true},
+		"/registers/16":   {},
+		"/info":           {Envelope: true},
+		"/alarms":         def,
+		"/status/stream":  def,
+		"/registers/0x10": {},
+	} {
+		if got := shapeFor(path, def, routes); got != want {
+			t.Errorf("shapeFor(%s) = %+v, want %+v", path, got, want)
+		}
+	}
+	for _, bad := range []string{"status=data", "/status", "/status=xml"} {
+		if _, err := parseShapeRoutes(bad, def); err == nil {
+			t.Errorf("parseShapeRoutes(%q) accepted", bad)
+		}
+	}
+}
+
+func TestShapeHandler(t *testing.T) {
+	h := shapeHandler(responseShape{Envelope: true, Camel: true}, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"display_value":"12.5"}`)
+		case "/error":
+			http.Error(w, "bad slave_id", http.StatusBadRequest)
+		case "/sse":
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: {\"slave_id\":1}\n\n")
+			w.(http.Flusher).Flush()
+		}
+	}))
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/json")
+	if rec.Code != http.StatusCreated || !strings.HasPrefix(rec.Body.String(), `{"data":{"displayValue":"12.5"},"ts":`) {
+		t.Errorf("/json: %d %s", rec.Code, rec.Body)
+	}
+	rec = get("/error")
+	if rec.Code != http.StatusBadRequest || rec.Body.String() != "bad slave_id\n" {
+		t.Errorf("/error: %d %q", rec.Code, rec.Body)
+	}
+	rec = get("/sse")
+	if !rec.Flushed || rec.Body.String() != "data: {\"slave_id\":1}\n\n" {
+		t.Errorf("/sse: flushed=%v %q", rec.Flushed, rec.Body)
+	}
+}
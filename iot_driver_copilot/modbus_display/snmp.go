@@ -0,0 +1,89 @@
+package main
+
+import "time"
+
+// A minimal SNMPv2c agent, for NOCs that monitor everything over SNMP.
+// With SNMP_LISTEN (e.g. ":161") it answers Get, GetNext and GetBulk for
+// the read community SNMP_COMMUNITY; Set is refused with noAccess, and v1
+// and v3 requests, and requests with another community, are dropped. With
+// SNMP_TRAP_TARGETS it sends SNMPv2-Trap notifications when SLAVE_ID goes
+// offline and comes back. Either may be set without the other.
+//
+// Objects, under SNMP_BASE_OID (default 1.3.6.1.4.1.32473.1; 32473 is the
+// documentation enterprise number of RFC 5612, so sites set their own):
+//
+//	sysDescr.0, sysObjectID.0, sysUpTime.0   the MIB-II system group
+//	BASE.1.1.0  linkUp         INTEGER    1 while the display answers polls, 2 otherwise
+//	BASE.1.2.0  linkDetail     STRING     why the last poll failed; empty while up
+//	BASE.1.3.0  lastPollAge    TimeTicks  since the last good poll (or since start)
+//	BASE.1.4.0  displayValue   STRING     as of the last poll
+//	BASE.1.5.0  readOnly       INTEGER    1 in read-only mode, 2 otherwise
+//	BASE.1.6.0  slaveId        INTEGER    SLAVE_ID
+//	BASE.2.1.0  pollErrors       Counter64  these count since the driver started,
+//	BASE.2.2.0  reconnects       Counter64  like the NAME_total metrics; sysUpTime
+//	BASE.2.3.0  eventsDelivered  Counter64  marks the restarts
+//	BASE.2.4.0  eventsFailed     Counter64
+//	BASE.2.5.0  valueRejected    Counter64
+//	BASE.2.6.0  externalChanges  Counter64
+//
+// Traps carry sysUpTime.0, snmpTrapOID.0 and then linkUp, linkDetail and
+// slaveId: snmpTrapOID.0 is BASE.0.1 (deviceOffline) or BASE.0.2
+// (deviceOnline). A display that is unreachable when the driver starts
+// sends deviceOffline for the first failed poll.
+
+// snmpDefaultBaseOID is SNMP_BASE_OID's default.
+const snmpDefaultBaseOID = "1.3.6.1.4.1.32473.1"
+
+// --- the driver's objects ---
+
+func (d *ModbusDriver) snmpObjects() []snmpObject {
+	base := d.cfg.SNMPBaseOID
+	reach := func() reachability {
+		if r := d.reach.Load(); r != nil {
+			return *r
+		}
+		return reachability{Detail: "no poll yet"}
+	}
+	status := func() DeviceStatus {
+		d.statusMu.RLock()
+		defer d.statusMu.RUnlock()
+		return d.status
+	}
+	started := time.Now()
+	return []snmpObject{
+		{base.child(1, 1, 0), func() snmpValue { return snmpTruth(reach().Up) }},
+		{base.child(1, 2, 0), func() snmpValue { return snmpString(reach().Detail) }},
+		{base.child(1, 3, 0), func() snmpValue {
+			last := status().lastUpdateTime
+			if last.IsZero() {
+				return snmpTicks(time.Since(started))
+			}
+			return snmpTicks(d.clock.Now().Sub(last))
+		}},
+		{base.child(1, 4, 0), func() snmpValue { return snmpString(status().DisplayValue) }},
+		{base.child(1, 5, 0), func() snmpValue { return snmpTruth(d.readOnly.Load()) }},
+		{base.child(1, 6, 0), func() snmpValue { return snmpInt(int64(d.cfg.SlaveId)) }},
+		{base.child(2, 1, 0), func() snmpValue { return snmpCounter(d.pollErrors.Load()) }},
+		{base.child(2, 2, 0), func() snmpValue { return snmpCounter(d.reconnects.Load()) }},
+		{base.child(2, 3, 0), func() snmpValue { return snmpCounter(d.notifier.delivered.Load()) }},
+		{base.child(2, 4, 0), func() snmpValue { return snmpCounter(d.notifier.failed.Load()) }},
+		{base.child(2, 5, 0), func() snmpValue { return snmpCounter(d.valuesRejected.Load()) }},
+		{base.child(2, 6, 0), func() snmpValue { return snmpCounter(d.externalChanges.Load()) }},
+	}
+}
+
+// snmpLinkTrap reports a change of SLAVE_ID's reachability.
+func (d *ModbusDriver) snmpLinkTrap(up bool, detail string) {
+	if d.snmp == nil {
+		return
+	}
+	base := d.cfg.SNMPBaseOID
+	trapOID := base.child(0, 1)
+	if up {
+		trapOID = base.child(0, 2)
+	}
+	d.snmp.trap(trapOID,
+		snmpVarBind{base.child(1, 1, 0), snmpTruth(up)},
+		snmpVarBind{base.child(1, 2, 0), snmpString(detail)},
+		snmpVarBind{base.child(1, 6, 0), snmpInt(int64(d.cfg.SlaveId))})
+}
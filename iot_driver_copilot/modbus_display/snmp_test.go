@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"log"
+	"strings"
+	"testing"
+)
+
+// decodeSNMPMessage is the test side of the agent: the PDU type, error
+// status and varbinds of any v2c message.
+func decodeSNMPMessage(t *testing.T, b []byte) (byte, int64, []snmpVarBind) {
+	t.Helper()
+	outer := berReader(b)
+	msg, err := outer.expect(berSequence)
+	if err != nil {
+		t.Fatalf("message: %v", err)
+	}
+	r := berReader(msg)
+	if v, err := r.integer(); err != nil || v != snmpVersion2c {
+		t.Fatalf("version %d %v", v, err)
+	}
+	if _, err := r.expect(berOctetString); err != nil {
+		t.Fatal(err)
+	}
+	tag, pdu, err := r.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := berReader(pdu)
+	var fields [3]int64
+	for i := range fields {
+		if fields[i], err = p.integer(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, _ := p.expect(berSequence)
+	var vbs []snmpVarBind
+	for l := berReader(list); len(l) > 0; {
+		vb, err := l.expect(berSequence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vr := berReader(vb)
+		c, _ := vr.expect(berOID)
+		oid, err := decodeOID(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vtag, content, err := vr.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := snmpValue{tag: vtag}
+		switch vtag {
+		case berInteger:
+			ir := berReader(berTLV(berInteger, content))
+			v.v, _ = ir.integer()
+		case berOctetString:
+			v.v = string(content)
+		case berOID:
+			v.v, _ = decodeOID(content)
+		case snmpTimeTicks, snmpCounter64:
+			var n uint64
+			for _, c := range content {
+				n = n<<8 | uint64(c)
+			}
+			v.v = n
+		}
+		vbs = append(vbs, snmpVarBind{oid, v})
+	}
+	return tag, fields[1], vbs
+}
+
+func testSNMPAgent(t *testing.T) *snmpAgent {
+	t.Helper()
+	d, err := NewModbusDriver(Config{SlaveId: 7, SNMPListen: "127.0.0.1:0", SNMPCommunity: "public", SNMPBaseOID: snmpOID{1, 3, 6, 1, 4, 1, 32473, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.snmp.logf = log.New(io.Discard, "", 0).Printf
+	d.pollErrors.Add(3)
+	d.status.DisplayValue = "12.5"
+	return d.snmp
+}
+
+func TestSNMPGet(t *testing.T) {
+	a := testSNMPAgent(t)
+
+	get := encodeSNMPMessage("public", pduGetRequest, 0x12345678, 0, 0, []snmpVarBind{
+		{oidSysDescr, snmpValue{berNull, nil}},
+		{snmpOID{1, 3, 6, 1, 4, 1, 32473, 1, 2, 1, 0}, snmpValue{berNull, nil}},
+		{snmpOID{1, 3, 6, 1, 4, 1, 32473, 1, 2, 1, 5}, snmpValue{berNull, nil}},
+		{snmpOID{1, 3, 6, 1, 4, 1, 32473, 9, 0}, snmpValue{berNull, nil}},
+	})
+	tag, status, vbs := decodeSNMPMessage(t, a.handle(get))
+	if tag != pduResponse || status != 0 || len(vbs) != 4 {
+		t.Fatalf("response %x, status %d, %d varbinds", tag, status, len(vbs))
+	}
+	if s, _ := vbs[0].value.v.(string); !strings.HasPrefix(s, "modbus-display-driver ") {
+		t.Errorf("sysDescr = %v", vbs[0].value)
+	}
+	if vbs[1].value != (snmpValue{snmpCounter64, uint64(3)}) {
+		t.Errorf("pollErrors = %+v", vbs[1].value)
+	}
+	if vbs[2].value.tag != snmpNoSuchInstance || vbs[3].value.tag != snmpNoSuchObject {
+		t.Errorf("unknown OIDs: %+v %+v", vbs[2].value, vbs[3].value)
+	}
+
+	if a.handle(encodeSNMPMessage("private", pduGetRequest, 1, 0, 0, []snmpVarBind{{oidSysDescr, snmpValue{berNull, nil}}})) != nil {
+		t.Error("answered a request with the wrong community")
+	}
+	set := encodeSNMPMessage("public", pduSetRequest, 2, 0, 0, []snmpVarBind{{oidSysDescr, snmpString("x")}})
+	if _, status, _ := decodeSNMPMessage(t, a.handle(set)); status != snmpErrNoAccess {
+		t.Errorf("set: error status %d", status)
+	}
+	if a.handle([]byte{0x30, 0x03, 0x02, 0x01}) != nil {
+		t.Error("answered a truncated message")
+	}
+}
+
+func TestSNMPWalk(t *testing.T) {
+	a := testSNMPAgent(t)
+	// snmpwalk's GetNext walk from the root visits every object in order.
+	var walked []string
+	for oid := (snmpOID{1, 3}); ; {
+		_, _, vbs := decodeSNMPMessage(t, a.handle(encodeSNMPMessage("public", pduGetNextRequest, 1, 0, 0, []snmpVarBind{{oid, snmpValue{berNull, nil}}})))
+		if vbs[0].value.tag == snmpEndOfMibView {
+			break
+		}
+		if vbs[0].oid.compare(oid) <= 0 {
+			t.Fatalf("GetNext(%v) = %v", oid, vbs[0].oid)
+		}
+		oid = vbs[0].oid
+		walked = append(walked, oid.String())
+	}
+	if len(walked) != 15 || walked[0] != "1.3.6.1.2.1.1.1.0" || walked[3] != "1.3.6.1.4.1.32473.1.1.1.0" || walked[14] != "1.3.6.1.4.1.32473.1.2.6.0" {
+		t.Errorf("walk = %v", walked)
+	}
+
+	// GetBulk: sysUpTime once, then three objects after the base.
+	bulk := encodeSNMPMessage("public", pduGetBulkRequest, 3, 1, 3, []snmpVarBind{
+		{oidSysObjectID, snmpValue{berNull, nil}},
+		{snmpOID{1, 3, 6, 1, 4, 1, 32473, 1}, snmpValue{berNull, nil}},
+	})
+	_, _, vbs := decodeSNMPMessage(t, a.handle(bulk))
+	if len(vbs) != 4 || vbs[0].oid.compare(oidSysUpTime) != 0 || vbs[1].oid.String() != "1.3.6.1.4.1.32473.1.1.1.0" ||
+		vbs[3].oid.String() != "1.3.6.1.4.1.32473.1.1.3.0" {
+		t.Errorf("bulk = %+v", vbs)
+	}
+}
+
+func TestSNMPEncoding(t *testing.T) {
+	// The request net-snmp sends for "snmpget -v2c -c public HOST sysUpTime.0".
+	raw, _ := hex.DecodeString("302902010104067075626c6963a01c0204499602d2020100020100300e300c06082b060102010103000500")
+	req, err := decodeSNMPRequest(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.community != "public" || req.pduType != pduGetRequest || req.requestID != 1234567890 || len(req.oids) != 1 || req.oids[0].compare(oidSysUpTime) != 0 {
+		t.Errorf("decoded %+v", req)
+	}
+	if enc := encodeSNMPMessage("public", pduGetRequest, 1234567890, 0, 0, []snmpVarBind{{oidSysUpTime, snmpValue{berNull, nil}}}); !bytes.Equal(enc, raw) {
+		t.Errorf("encoded %x", enc)
+	}
+	for n, want := range map[int64]string{0: "00", 127: "7f", 128: "0080", -1: "ff", -129: "ff7f", 1 << 40: "010000000000"} {
+		if got := hex.EncodeToString(berSigned(n)); got != want {
+			t.Errorf("berSigned(%d) = %s, want %s", n, got, want)
+		}
+	}
+	if got := hex.EncodeToString(berUnsigned(1 << 63)); got != "008000000000000000" {
+		t.Errorf("berUnsigned(1<<63) = %s", got)
+	}
+	oid, _ := parseOID(".1.3.6.1.4.1.2680.1.2.7.3.2.0")
+	if c := berOIDContent(oid); hex.EncodeToString(c) != "2b060104019478010207030200" {
+		t.Errorf("OID content %x", c)
+	}
+	if back, err := decodeOID(berOIDContent(oid)); err != nil || back.compare(oid) != 0 {
+		t.Errorf("OID round trip: %v %v", back, err)
+	}
+	for _, bad := range []string{"1", "3.1", "1.40", "1.3.x"} {
+		if _, err := parseOID(bad); err == nil {
+			t.Errorf("parseOID(%q) accepted", bad)
+		}
+	}
+	targets, err := parseTrapTargets("nms.example, 10.0.0.5:1162, fe80::1, [::1]:9162")
+	if err != nil || strings.Join(targets, " ") != "nms.example:162 10.0.0.5:1162 [fe80::1]:162 [::1]:9162" {
+		t.Errorf("targets = %v, %v", targets, err)
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The SNMPv2c agent of both drivers: BER encoding, request decoding, Get,
+// GetNext and GetBulk over a sorted object table, and SNMPv2-Trap
+// delivery. Each driver's snmp.go has its settings, its objects and when
+// it traps.
+//
+// This file is the same, byte for byte, in modbus_display and usb_camera.
+// The drivers are separate modules, each built from its own directory, so
+// neither can import a package from the other. snmpagent_test.go fails
+// when the copies differ; change both together.
+
+// BER and SNMP type tags, and PDU types.
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+
+	snmpGauge32        = 0x42
+	snmpTimeTicks      = 0x43
+	snmpCounter64      = 0x46
+	snmpNoSuchObject   = 0x80
+	snmpNoSuchInstance = 0x81
+	snmpEndOfMibView   = 0x82
+
+	pduGetRequest     = 0xA0
+	pduGetNextRequest = 0xA1
+	pduResponse       = 0xA2
+	pduSetRequest     = 0xA3
+	pduGetBulkRequest = 0xA5
+	pduSNMPv2Trap     = 0xA7
+)
+
+const (
+	snmpVersion2c       = 1 // the version field's value for v2c
+	snmpErrNoAccess     = 6
+	snmpMaxRepetitions  = 50
+	snmpMaxMessage      = 1472 // keeps a response in one Ethernet frame
+	snmpDefaultTrapPort = "162"
+)
+
+var (
+	oidSysDescr     = snmpOID{1, 3, 6, 1, 2, 1, 1, 1, 0}
+	oidSysObjectID  = snmpOID{1, 3, 6, 1, 2, 1, 1, 2, 0}
+	oidSysUpTime    = snmpOID{1, 3, 6, 1, 2, 1, 1, 3, 0}
+	oidSnmpTrapOID  = snmpOID{1, 3, 6, 1, 6, 3, 1, 1, 4, 1, 0}
+	errSNMPEncoding = errors.New("snmp: malformed message")
+)
+
+type snmpOID []uint32
+
+func parseOID(s string) (snmpOID, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), ".")
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("OID %q needs at least two arcs", s)
+	}
+	oid := make(snmpOID, len(parts))
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("OID %q: bad arc %q", s, p)
+		}
+		oid[i] = uint32(n)
+	}
+	if oid[0] > 2 || oid[0] < 2 && oid[1] > 39 {
+		return nil, fmt.Errorf("OID %q: bad first arcs", s)
+	}
+	return oid, nil
+}
+
+func (o snmpOID) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// compare orders OIDs lexicographically, as GetNext walks them.
+func (o snmpOID) compare(p snmpOID) int {
+	for i := 0; i < len(o) && i < len(p); i++ {
+		if o[i] != p[i] {
+			if o[i] < p[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(o) - len(p)
+}
+
+// child is o extended by arcs, in a new slice.
+func (o snmpOID) child(arcs ...uint32) snmpOID {
+	return append(append(snmpOID{}, o...), arcs...)
+}
+
+// snmpValue is a varbind value: tag is the BER type and v an int64
+// (INTEGER), uint64 (Counter64, Gauge32, TimeTicks), string, snmpOID,
+// or nil (NULL and the exceptions).
+type snmpValue struct {
+	tag byte
+	v   interface{}
+}
+
+func snmpInt(n int64) snmpValue      { return snmpValue{berInteger, n} }
+func snmpString(s string) snmpValue  { return snmpValue{berOctetString, s} }
+func snmpCounter(n uint64) snmpValue { return snmpValue{snmpCounter64, n} }
+func snmpGauge(n uint64) snmpValue   { return snmpValue{snmpGauge32, n} }
+
+// snmpTruth is a TruthValue: 1 for true, 2 for false.
+func snmpTruth(b bool) snmpValue {
+	if b {
+		return snmpInt(1)
+	}
+	return snmpInt(2)
+}
+
+// snmpTicks is a TimeTicks value, in hundredths of a second.
+func snmpTicks(d time.Duration) snmpValue {
+	return snmpValue{snmpTimeTicks, uint64(d/(10*time.Millisecond)) & 0xFFFFFFFF}
+}
+
+type snmpVarBind struct {
+	oid   snmpOID
+	value snmpValue
+}
+
+// --- BER ---
+
+func berTLV(tag byte, content []byte) []byte {
+	b := []byte{tag}
+	if n := len(content); n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		var l []byte
+		for ; n > 0; n >>= 8 {
+			l = append([]byte{byte(n)}, l...)
+		}
+		b = append(append(b, 0x80|byte(len(l))), l...)
+	}
+	return append(b, content...)
+}
+
+func berSigned(n int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	i := 0
+	for i < 7 && (b[i] == 0 && b[i+1]&0x80 == 0 || b[i] == 0xFF && b[i+1]&0x80 != 0) {
+		i++
+	}
+	return b[i:]
+}
+
+func berUnsigned(n uint64) []byte {
+	var b [9]byte
+	binary.BigEndian.PutUint64(b[1:], n)
+	i := 0
+	for i < 8 && b[i] == 0 && b[i+1]&0x80 == 0 {
+		i++
+	}
+	return b[i:]
+}
+
+func berOIDContent(o snmpOID) []byte {
+	if len(o) < 2 {
+		return []byte{0}
+	}
+	var b []byte
+	for _, arc := range append(snmpOID{40*o[0] + o[1]}, o[2:]...) {
+		enc := []byte{byte(arc & 0x7F)}
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			enc = append([]byte{byte(arc&0x7F) | 0x80}, enc...)
+		}
+		b = append(b, enc...)
+	}
+	return b
+}
+
+func (v snmpValue) encode() []byte {
+	switch x := v.v.(type) {
+	case int64:
+		return berTLV(v.tag, berSigned(x))
+	case uint64:
+		return berTLV(v.tag, berUnsigned(x))
+	case string:
+		return berTLV(v.tag, []byte(x))
+	case snmpOID:
+		return berTLV(v.tag, berOIDContent(x))
+	}
+	return berTLV(v.tag, nil)
+}
+
+func encodeVarBinds(vbs []snmpVarBind) []byte {
+	var list []byte
+	for _, vb := range vbs {
+		list = append(list, berTLV(berSequence, append(berTLV(berOID, berOIDContent(vb.oid)), vb.value.encode()...))...)
+	}
+	return berTLV(berSequence, list)
+}
+
+func encodeSNMPMessage(community string, pduType byte, requestID int32, errStatus, errIndex int, vbs []snmpVarBind) []byte {
+	pdu := berTLV(berInteger, berSigned(int64(requestID)))
+	pdu = append(pdu, berTLV(berInteger, berSigned(int64(errStatus)))...)
+	pdu = append(pdu, berTLV(berInteger, berSigned(int64(errIndex)))...)
+	pdu = append(pdu, encodeVarBinds(vbs)...)
+	msg := berTLV(berInteger, berSigned(snmpVersion2c))
+	msg = append(msg, berTLV(berOctetString, []byte(community))...)
+	msg = append(msg, berTLV(pduType, pdu)...)
+	return berTLV(berSequence, msg)
+}
+
+// berReader walks the TLVs of one constructed value.
+type berReader []byte
+
+func (r *berReader) next() (tag byte, content []byte, err error) {
+	b := *r
+	if len(b) < 2 {
+		return 0, nil, errSNMPEncoding
+	}
+	tag, n, off := b[0], int(b[1]), 2
+	if n&0x80 != 0 {
+		k := n & 0x7F
+		if k == 0 || k > 3 || len(b) < 2+k {
+			return 0, nil, errSNMPEncoding
+		}
+		n = 0
+		for _, c := range b[2 : 2+k] {
+			n = n<<8 | int(c)
+		}
+		off += k
+	}
+	if len(b)-off < n {
+		return 0, nil, errSNMPEncoding
+	}
+	*r = b[off+n:]
+	return tag, b[off : off+n], nil
+}
+
+func (r *berReader) expect(tag byte) ([]byte, error) {
+	t, c, err := r.next()
+	if err == nil && t != tag {
+		err = errSNMPEncoding
+	}
+	return c, err
+}
+
+func (r *berReader) integer() (int64, error) {
+	c, err := r.expect(berInteger)
+	if err != nil || len(c) == 0 || len(c) > 8 {
+		return 0, errSNMPEncoding
+	}
+	n := int64(int8(c[0]))
+	for _, b := range c[1:] {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
+
+func decodeOID(c []byte) (snmpOID, error) {
+	if len(c) == 0 {
+		return nil, errSNMPEncoding
+	}
+	var arcs []uint32
+	var arc uint64
+	for i, b := range c {
+		arc = arc<<7 | uint64(b&0x7F)
+		if arc > 0xFFFFFFFF {
+			return nil, errSNMPEncoding
+		}
+		if b&0x80 != 0 {
+			if i == len(c)-1 {
+				return nil, errSNMPEncoding
+			}
+			continue
+		}
+		arcs = append(arcs, uint32(arc))
+		arc = 0
+	}
+	first := arcs[0]
+	switch {
+	case first < 40:
+		return append(snmpOID{0, first}, arcs[1:]...), nil
+	case first < 80:
+		return append(snmpOID{1, first - 40}, arcs[1:]...), nil
+	}
+	return append(snmpOID{2, first - 80}, arcs[1:]...), nil
+}
+
+type snmpRequest struct {
+	community                    string
+	pduType                      byte
+	requestID                    int32
+	nonRepeaters, maxRepetitions int // GetBulk only
+	oids                         []snmpOID
+}
+
+// decodeSNMPRequest parses a v2c request; anything else is an error.
+func decodeSNMPRequest(b []byte) (snmpRequest, error) {
+	var req snmpRequest
+	outer := berReader(b)
+	msg, err := outer.expect(berSequence)
+	if err != nil {
+		return req, err
+	}
+	r := berReader(msg)
+	if v, err := r.integer(); err != nil || v != snmpVersion2c {
+		return req, errors.New("snmp: not a v2c message")
+	}
+	community, err := r.expect(berOctetString)
+	if err != nil {
+		return req, err
+	}
+	req.community = string(community)
+	tag, pdu, err := r.next()
+	if err != nil {
+		return req, err
+	}
+	req.pduType = tag
+	p := berReader(pdu)
+	var fields [3]int64
+	for i := range fields {
+		if fields[i], err = p.integer(); err != nil {
+			return req, err
+		}
+	}
+	req.requestID = int32(fields[0])
+	req.nonRepeaters, req.maxRepetitions = int(fields[1]), int(fields[2])
+	list, err := p.expect(berSequence)
+	if err != nil {
+		return req, err
+	}
+	for vbs := berReader(list); len(vbs) > 0; {
+		vb, err := vbs.expect(berSequence)
+		if err != nil {
+			return req, err
+		}
+		vr := berReader(vb)
+		c, err := vr.expect(berOID)
+		if err != nil {
+			return req, err
+		}
+		oid, err := decodeOID(c)
+		if err != nil {
+			return req, err
+		}
+		req.oids = append(req.oids, oid)
+	}
+	return req, nil
+}
+
+// --- agent ---
+
+type snmpObject struct {
+	oid snmpOID
+	get func() snmpValue
+}
+
+type snmpAgent struct {
+	community string
+	targets   []string
+	base      snmpOID
+	objects   []snmpObject // sorted by oid
+	started   time.Time
+	logf      func(format string, args ...interface{})
+	requestID atomic.Int32
+}
+
+// newSNMPAgent answers for community with the system group and objects,
+// and sends traps to targets; sysObjectID is base.
+func newSNMPAgent(sysDescr, community string, targets []string, base snmpOID, logf func(string, ...interface{}), objects []snmpObject) *snmpAgent {
+	a := &snmpAgent{community: community, targets: targets, base: base, started: time.Now(), logf: logf}
+	a.objects = append([]snmpObject{
+		{oidSysDescr, func() snmpValue { return snmpString(sysDescr) }},
+		{oidSysObjectID, func() snmpValue { return snmpValue{berOID, a.base} }},
+		{oidSysUpTime, func() snmpValue { return snmpTicks(time.Since(a.started)) }},
+	}, objects...)
+	sort.Slice(a.objects, func(i, j int) bool { return a.objects[i].oid.compare(a.objects[j].oid) < 0 })
+	return a
+}
+
+// serve answers requests on SNMP_LISTEN until ctx ends.
+func (a *snmpAgent) serve(ctx context.Context, conn net.PacketConn) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				a.logf("snmp: %v", err)
+			}
+			return
+		}
+		if resp := a.handle(buf[:n]); resp != nil {
+			_, _ = conn.WriteTo(resp, from)
+		}
+	}
+}
+
+// handle answers one request, or returns nil to drop it.
+func (a *snmpAgent) handle(b []byte) []byte {
+	req, err := decodeSNMPRequest(b)
+	if err != nil || subtle.ConstantTimeCompare([]byte(req.community), []byte(a.community)) != 1 {
+		return nil
+	}
+	var vbs []snmpVarBind
+	errStatus, errIndex := 0, 0
+	switch req.pduType {
+	case pduGetRequest:
+		for _, oid := range req.oids {
+			vbs = append(vbs, a.get(oid))
+		}
+	case pduGetNextRequest:
+		for _, oid := range req.oids {
+			vbs = append(vbs, a.getNext(oid))
+		}
+	case pduGetBulkRequest:
+		vbs = a.getBulk(req)
+	case pduSetRequest:
+		errStatus, errIndex = snmpErrNoAccess, 1
+		for _, oid := range req.oids {
+			vbs = append(vbs, snmpVarBind{oid, snmpValue{berNull, nil}})
+		}
+	default:
+		return nil
+	}
+	resp := encodeSNMPMessage(req.community, pduResponse, req.requestID, errStatus, errIndex, vbs)
+	// A GetBulk reply that outgrew the datagram loses repetitions from the end.
+	for len(resp) > snmpMaxMessage && req.pduType == pduGetBulkRequest && len(vbs) > len(req.oids) {
+		vbs = vbs[:len(vbs)-1]
+		resp = encodeSNMPMessage(req.community, pduResponse, req.requestID, 0, 0, vbs)
+	}
+	return resp
+}
+
+func (a *snmpAgent) get(oid snmpOID) snmpVarBind {
+	i := sort.Search(len(a.objects), func(i int) bool { return a.objects[i].oid.compare(oid) >= 0 })
+	if i < len(a.objects) && a.objects[i].oid.compare(oid) == 0 {
+		return snmpVarBind{oid, a.objects[i].get()}
+	}
+	// An instance other than .0 of a known object is noSuchInstance.
+	for _, o := range a.objects {
+		if len(oid) > 0 && o.oid[:len(o.oid)-1].compare(oid[:len(oid)-1]) == 0 {
+			return snmpVarBind{oid, snmpValue{snmpNoSuchInstance, nil}}
+		}
+	}
+	return snmpVarBind{oid, snmpValue{snmpNoSuchObject, nil}}
+}
+
+func (a *snmpAgent) getNext(oid snmpOID) snmpVarBind {
+	i := sort.Search(len(a.objects), func(i int) bool { return a.objects[i].oid.compare(oid) > 0 })
+	if i == len(a.objects) {
+		return snmpVarBind{oid, snmpValue{snmpEndOfMibView, nil}}
+	}
+	return snmpVarBind{a.objects[i].oid, a.objects[i].get()}
+}
+
+// getBulk follows RFC 3416 4.2.3: one GetNext for each of the first
+// nonRepeaters OIDs, then maxRepetitions rounds over the rest.
+func (a *snmpAgent) getBulk(req snmpRequest) []snmpVarBind {
+	n := req.nonRepeaters
+	if n < 0 {
+		n = 0
+	}
+	if n > len(req.oids) {
+		n = len(req.oids)
+	}
+	reps := req.maxRepetitions
+	if reps < 0 {
+		reps = 0
+	}
+	if reps > snmpMaxRepetitions {
+		reps = snmpMaxRepetitions
+	}
+	var vbs []snmpVarBind
+	for _, oid := range req.oids[:n] {
+		vbs = append(vbs, a.getNext(oid))
+	}
+	last := append([]snmpOID{}, req.oids[n:]...)
+	for r := 0; r < reps && len(last) > 0; r++ {
+		done := true
+		for i, oid := range last {
+			vb := a.getNext(oid)
+			vbs = append(vbs, vb)
+			last[i] = vb.oid
+			if vb.value.tag != snmpEndOfMibView {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	return vbs
+}
+
+// trap sends an SNMPv2-Trap to every SNMP_TRAP_TARGETS entry, in the
+// background; delivery is not confirmed.
+func (a *snmpAgent) trap(trapOID snmpOID, vbs ...snmpVarBind) {
+	if len(a.targets) == 0 {
+		return
+	}
+	vbs = append([]snmpVarBind{
+		{oidSysUpTime, snmpTicks(time.Since(a.started))},
+		{oidSnmpTrapOID, snmpValue{berOID, trapOID}},
+	}, vbs...)
+	msg := encodeSNMPMessage(a.community, pduSNMPv2Trap, a.requestID.Add(1), 0, 0, vbs)
+	for _, target := range a.targets {
+		go func(target string) {
+			conn, err := net.Dial("udp", target)
+			if err != nil {
+				a.logf("snmp trap to %s: %v", target, err)
+				return
+			}
+			defer conn.Close()
+			if _, err := conn.Write(msg); err != nil {
+				a.logf("snmp trap to %s: %v", target, err)
+			}
+		}(target)
+	}
+}
+
+// parseTrapTargets reads SNMP_TRAP_TARGETS: "host[:port],...".
+func parseTrapTargets(s string) ([]string, error) {
+	var targets []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(t); err != nil {
+			t = net.JoinHostPort(strings.Trim(t, "[]"), snmpDefaultTrapPort)
+		}
+		if _, port, _ := net.SplitHostPort(t); port == "" {
+			return nil, fmt.Errorf("%q: missing port", t)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// softBlinker emulates the blink registers on displays that lack them by
+// alternately writing the commanded value and a copy with the masked
+// character positions blanked. Bit i of the mask selects character i
+// counted from the left of the display value field (see asciiCodec.Blank).
+type softBlinker struct {
+	mu        sync.Mutex
+	period    time.Duration // full on+off cycle; 0 disables blinking
+	mask      uint16
+	value     string
+	haveValue bool
+	blanked   bool
+	gen       uint64 // bumped on every Write
+	wake      chan struct{}
+}
+
+func newSoftBlinker(period time.Duration, mask uint16) *softBlinker {
+	return &softBlinker{period: period, mask: mask, wake: make(chan struct{}, 1)}
+}
+
+func (b *softBlinker) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *softBlinker) SetPeriod(p time.Duration) {
+	b.mu.Lock()
+	b.period = p
+	b.mu.Unlock()
+	b.notify()
+}
+
+// Write puts a new value on the display through write and, on success,
+// records it as shown unblanked. The lock is held across the device write
+// so a blink frame of the old value cannot land after it.
+func (b *softBlinker) Write(v string, write func() error) error {
+	b.mu.Lock()
+	if err := write(); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.value, b.haveValue, b.blanked = v, true, false
+	b.gen++
+	b.mu.Unlock()
+	b.notify()
+	return nil
+}
+
+// Observe adopts a value read from the device if nothing has been commanded yet.
+func (b *softBlinker) Observe(v string) {
+	b.mu.Lock()
+	if !b.haveValue && v != "" {
+		b.value, b.haveValue = v, true
+	}
+	b.mu.Unlock()
+}
+
+func (b *softBlinker) Snapshot() (period time.Duration, mask uint16, value string, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.period, b.mask, b.value, b.haveValue
+}
+
+func (d *ModbusDriver) softBlinkLoop(ctx context.Context) {
+	b := d.blinker
+	for {
+		b.mu.Lock()
+		period, mask, have, blanked, gen := b.period, b.mask, b.haveValue, b.blanked, b.gen
+		b.mu.Unlock()
+		// SetReadOnly already unblanked the display; sit out the lock.
+		paused := d.readOnly.Load()
+
+		if period <= 0 || mask == 0 || !have || paused {
+			if blanked && have && !paused {
+				b.mu.Lock()
+				if b.blanked && d.writeDisplayText(b.value) == nil {
+					b.blanked = false
+				}
+				b.mu.Unlock()
+			}
+			select {
+			case <-b.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// Hold the current phase for half a cycle; a wake-up (new value or
+		// period) restarts the phase timer.
+		select {
+		case <-time.After(period / 2):
+		case <-b.wake:
+			continue
+		case <-ctx.Done():
+			return
+		}
+
+		// Take the value only now and keep the lock through the write: a Write
+		// that landed during the wait must not be overwritten by a frame
+		// built from the value it replaced.
+		b.mu.Lock()
+		if b.gen != gen || b.period <= 0 || b.mask == 0 || d.readOnly.Load() {
+			b.mu.Unlock()
+			continue
+		}
+		payload, err := d.codec.Encode(b.value)
+		if err == nil {
+			if !b.blanked {
+				payload = d.codec.Blank(payload, b.mask)
+			}
+			err = d.writeDisplayPayload(payload)
+		}
+		if err == nil {
+			b.blanked = !b.blanked
+		}
+		b.mu.Unlock()
+		if err != nil {
+			d.logger.Printf("soft blink write failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spool is a bounded on-disk store-and-forward queue for outgoing events.
+// Each target (webhook URL or MQTT topic) gets its own subdirectory and
+// worker so one unreachable target doesn't hold up the others; within a
+// target events are replayed strictly in order. When a target's queue is
+// full the oldest event is dropped.
+type Spool struct {
+	dir     string
+	max     int
+	deliver func(kind, target string, body []byte) error
+	logger  *log.Logger
+
+	mu      sync.Mutex
+	seq     uint64
+	queues  map[string]*spoolQueue
+	dropped uint64
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type spoolQueue struct {
+	dir      string
+	kind     string
+	target   string
+	depth    int
+	inflight string // file the worker is delivering; never trimmed
+	wake     chan struct{}
+}
+
+type spoolEntry struct {
+	Kind    string          `json:"kind"`
+	Target  string          `json:"target"`
+	Body    json.RawMessage `json:"body"`
+	Created time.Time       `json:"created"`
+}
+
+const (
+	spoolRetryMin = time.Second
+	spoolRetryMax = time.Minute
+)
+
+// OpenSpool opens (or creates) dir and resumes delivery of anything left
+// from a previous run.
+func OpenSpool(dir string, max int, deliver func(kind, target string, body []byte) error, logger *log.Logger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, max: max, deliver: deliver, logger: logger, queues: map[string]*spoolQueue{}, done: make(chan struct{})}
+	subdirs, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, sd := range subdirs {
+		if !sd.IsDir() {
+			continue
+		}
+		names, err := s.entries(filepath.Join(dir, sd.Name()))
+		if err != nil || len(names) == 0 {
+			continue
+		}
+		first, err := readSpoolEntry(filepath.Join(dir, sd.Name(), names[0]))
+		if err != nil {
+			continue
+		}
+		s.mu.Lock()
+		q := s.queue(first.Kind, first.Target)
+		q.depth += len(names) // the worker may already have delivered one
+		if n := spoolSeq(names[len(names)-1]); n > s.seq {
+			s.seq = n
+		}
+		s.mu.Unlock()
+		logger.Printf("spool: resuming %d queued %s events for %s", len(names), first.Kind, first.Target)
+	}
+	return s, nil
+}
+
+func spoolSeq(name string) uint64 {
+	var n uint64
+	fmt.Sscanf(strings.TrimSuffix(name, ".json"), "%d", &n)
+	return n
+}
+
+func readSpoolEntry(path string) (spoolEntry, error) {
+	var e spoolEntry
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return e, err
+	}
+	err = json.Unmarshal(b, &e)
+	return e, err
+}
+
+// entries lists a queue directory's event files in delivery order.
+func (s *Spool) entries(dir string) ([]string, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, de := range des {
+		if strings.HasSuffix(de.Name(), ".json") {
+			names = append(names, de.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// queue returns the queue for a target, starting its worker on first use.
+// Callers must hold s.mu.
+func (s *Spool) queue(kind, target string) *spoolQueue {
+	sum := sha1.Sum([]byte(kind + "\x00" + target))
+	key := hex.EncodeToString(sum[:8])
+	if q, ok := s.queues[key]; ok {
+		return q
+	}
+	q := &spoolQueue{dir: filepath.Join(s.dir, key), kind: kind, target: target, wake: make(chan struct{}, 1)}
+	_ = os.MkdirAll(q.dir, 0o755)
+	s.queues[key] = q
+	s.wg.Add(1)
+	go s.worker(q)
+	return q
+}
+
+func (s *Spool) Enqueue(kind, target string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queue(kind, target)
+	s.seq++
+	b, err := json.Marshal(spoolEntry{Kind: kind, Target: target, Body: body, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := writeFileDurable(filepath.Join(q.dir, fmt.Sprintf("%020d.json", s.seq)), b); err != nil {
+		return err
+	}
+	q.depth++
+	for q.depth > s.max {
+		names, err := s.entries(q.dir)
+		if err == nil && len(names) > 0 && names[0] == q.inflight {
+			names = names[1:] // being delivered right now; drop the next oldest
+		}
+		if err != nil || len(names) == 0 {
+			break
+		}
+		if os.Remove(filepath.Join(q.dir, names[0])) == nil {
+			q.depth--
+			s.dropped++
+			s.logger.Printf("spool: queue for %s full, dropped oldest event", target)
+		}
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// writeFileDurable writes b to name via a temporary file, syncing the file
+// before the rename and the directory after it so a power cut leaves either
+// the complete event or nothing.
+func writeFileDurable(name string, b []byte) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// syncDir makes renames and removals in dir durable.
+func syncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (s *Spool) worker(q *spoolQueue) {
+	defer s.wg.Done()
+	retry := spoolRetryMin
+	for {
+		// Pick the head under the lock so Enqueue can't trim it in between.
+		s.mu.Lock()
+		names, _ := s.entries(q.dir)
+		q.inflight = ""
+		if len(names) > 0 {
+			q.inflight = names[0]
+		}
+		s.mu.Unlock()
+		if len(names) == 0 {
+			select {
+			case <-q.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		path := filepath.Join(q.dir, names[0])
+		e, err := readSpoolEntry(path)
+		if err == nil {
+			err = s.deliver(e.Kind, e.Target, e.Body)
+			if err != nil {
+				s.logger.Printf("spool: %s delivery to %s failed (%d queued), retry in %v: %v", q.kind, q.target, s.Depth(), retry, err)
+				select {
+				case <-time.After(retry):
+				case <-s.done:
+					return
+				}
+				retry *= 2
+				if retry > spoolRetryMax {
+					retry = spoolRetryMax
+				}
+				continue
+			}
+		} else {
+			s.logger.Printf("spool: discarding unreadable event %s: %v", path, err)
+		}
+		retry = spoolRetryMin
+		s.mu.Lock()
+		if os.Remove(path) == nil {
+			q.depth--
+		}
+		q.inflight = ""
+		s.mu.Unlock()
+	}
+}
+
+// Depth is the total number of events waiting across all targets.
+func (s *Spool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, q := range s.queues {
+		n += q.depth
+	}
+	return n
+}
+
+func (s *Spool) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+func (s *Spool) Close() {
+	close(s.done)
+	s.wg.Wait()
+}
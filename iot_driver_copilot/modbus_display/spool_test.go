@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpoolTrimSkipsInFlightEvent(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	deliver := func(kind, target string, body []byte) error {
+		select {
+		case started <- struct{}{}:
+			<-release // hold the first event in flight
+		default:
+		}
+		mu.Lock()
+		delivered = append(delivered, string(body))
+		mu.Unlock()
+		return nil
+	}
+	s, err := OpenSpool(t.TempDir(), 2, deliver, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Enqueue("webhook", "http://x", []byte(`1`)); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	for _, b := range []string{`2`, `3`, `4`} {
+		if err := s.Enqueue("webhook", "http://x", []byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := s.Dropped(); d != 2 {
+		t.Fatalf("dropped %d events, want 2", d)
+	}
+	close(release)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Depth() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"1", "4"}; !reflect.DeepEqual(delivered, want) {
+		t.Fatalf("delivered %v, want %v", delivered, want)
+	}
+}
+
+func TestSpoolResumesAndIgnoresPartialWrites(t *testing.T) {
+	dir := t.TempDir()
+	fail := func(string, string, []byte) error { return os.ErrDeadlineExceeded }
+	s, err := OpenSpool(dir, 10, fail, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []string{`"a"`, `"b"`} {
+		if err := s.Enqueue("mqtt", "alarms", []byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// A crash mid-write leaves only a .tmp file behind; it must be ignored.
+	subdirs, _ := os.ReadDir(dir)
+	if len(subdirs) != 1 {
+		t.Fatalf("spool has %d queue dirs, want 1", len(subdirs))
+	}
+	if err := os.WriteFile(filepath.Join(dir, subdirs[0].Name(), "99999999999999999999.json.tmp"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	done := make(chan struct{})
+	s, err = OpenSpool(dir, 10, func(_, _ string, body []byte) error {
+		got = append(got, string(body))
+		if len(got) == 2 {
+			close(done)
+		}
+		return nil
+	}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("replayed %v", got)
+	}
+	if want := []string{`"a"`, `"b"`}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// State that has to survive the power being cut at any moment is kept in
+// stateFiles. A save writes the new contents next to the file, syncs them,
+// moves the current file to NAME.bak and renames the new one into place,
+// then syncs the directory, so after a crash there is always a complete
+// NAME or NAME.bak. Contents are wrapped with a SHA-256 of the payload; a
+// file that fails to parse or to match its checksum (a torn write on a
+// filesystem without ordered data, or a bad sector) is moved aside to
+// NAME.corrupt and the backup is used instead.
+//
+// STATE_DIR gives state files without a path of their own a place to live.
+
+type stateEnvelope struct {
+	Checksum string          `json:"checksum"` // "sha256:" + hex of data
+	Saved    time.Time       `json:"saved"`
+	Data     json.RawMessage `json:"data"`
+}
+
+type stateFile struct {
+	path string
+	logf func(format string, args ...interface{})
+}
+
+func stateChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Save replaces the file with v, keeping the previous contents as the backup.
+func (f stateFile) Save(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b, _ := json.Marshal(stateEnvelope{Checksum: stateChecksum(data), Saved: time.Now().UTC(), Data: data})
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, f.path+".bak"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return writeFileDurable(f.path, append(b, '\n'))
+}
+
+// Load reads the file into v, falling back to the backup when the file is
+// missing or corrupt. found is false when neither holds usable state.
+func (f stateFile) Load(v interface{}) (found bool, err error) {
+	for _, p := range []string{f.path, f.path + ".bak"} {
+		b, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if err := decodeState(b, v); err != nil {
+			f.logf("state file %s is corrupt (%v), moved to %s", p, err, p+".corrupt")
+			if err := os.Rename(p, p+".corrupt"); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if p != f.path {
+			f.logf("state file %s unusable, restoring from %s", f.path, p)
+			if err := writeFileDurable(f.path, b); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Remove deletes the file and its backup.
+func (f stateFile) Remove() error {
+	for _, p := range []string{f.path, f.path + ".bak"} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+// decodeState unwraps and checks an envelope. Files written before state
+// files had one hold the bare JSON value and are accepted as they are.
+func decodeState(b []byte, v interface{}) error {
+	var env stateEnvelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return err
+	}
+	if env.Checksum == "" {
+		return json.Unmarshal(b, v)
+	}
+	if got := stateChecksum(env.Data); got != env.Checksum {
+		return fmt.Errorf("checksum mismatch: %s, recorded %s", got, env.Checksum)
+	}
+	return json.Unmarshal(env.Data, v)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStateFileRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "desired.json")
+	var logged []string
+	f := stateFile{path: path, logf: func(format string, args ...interface{}) { logged = append(logged, format) }}
+	load := func() (desiredFile, bool) {
+		t.Helper()
+		var got desiredFile
+		found, err := f.Load(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got, found
+	}
+
+	if _, found := load(); found {
+		t.Fatal("found state before any save")
+	}
+	for _, v := range []string{"1", "2"} {
+		if err := f.Save(desiredFile{DisplayValue: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := load(); got.DisplayValue != "2" {
+		t.Fatalf("loaded %q, want 2", got.DisplayValue)
+	}
+
+	// A flipped byte fails the checksum; the previous save takes over.
+	b, _ := os.ReadFile(path)
+	if err := os.WriteFile(path, []byte(strings.Replace(string(b), `"2"`, `"7"`, 1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, found := load(); !found || got.DisplayValue != "1" {
+		t.Fatalf("after corruption loaded %q, %v; want the backup", got.DisplayValue, found)
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Errorf("corrupt file not kept: %v", err)
+	}
+	if len(logged) != 2 {
+		t.Errorf("logged %q", logged)
+	}
+
+	// A crash between moving the file to the backup and renaming the new
+	// one into place leaves only the backup.
+	if err := os.Rename(path, path+".bak"); err != nil {
+		t.Fatal(err)
+	}
+	if got, found := load(); !found || got.DisplayValue != "1" {
+		t.Fatalf("with only the backup loaded %q, %v", got.DisplayValue, found)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file not restored from the backup: %v", err)
+	}
+
+	// Truncated file and backup: no state rather than an error.
+	os.WriteFile(path, []byte(`{"checksum": "sha2`), 0o644)
+	os.WriteFile(path+".bak", nil, 0o644)
+	if _, found := load(); found {
+		t.Error("found state in truncated files")
+	}
+
+	if err := f.Remove(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateFileLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "desired.json")
+	os.WriteFile(path, []byte(`{"display_value":"ABCD"}`), 0o644)
+	var got desiredFile
+	if found, err := (stateFile{path: path}).Load(&got); !found || err != nil || got.DisplayValue != "ABCD" {
+		t.Errorf("legacy file: %q, %v, %v", got.DisplayValue, found, err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// Fleet status:
+//
+//	GET /status/all
+//
+// One document with the status and health of every slave the caller may
+// address (as GET /devices lists them) and of the driver itself. SLAVE_ID
+// is reported from the poll loop. The TENANT_DEVICES slaves are not
+// polled, so they are read on request, one after another on the shared
+// bus, and the reading is reused for POLL_INTERVAL_MS. A slave that can't
+// be read is listed with "online": false and the error; the reply is 200
+// whatever the devices' state.
+
+type reachability struct {
+	Up     bool
+	Detail string
+}
+
+type deviceStatusEntry struct {
+	deviceEntry
+	Online  bool        `json:"online"`
+	Updated *time.Time  `json:"updated,omitempty"` // when the status was read
+	Error   string      `json:"error,omitempty"`
+	Status  interface{} `json:"status,omitempty"`
+}
+
+type peerStatusCache struct {
+	mu      sync.Mutex
+	entries map[int]deviceStatusEntry
+}
+
+func (d *ModbusDriver) handleStatusAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	devices := []deviceStatusEntry{}
+	online := 0
+	for _, dev := range d.tenantDevices(requestTenant(r)) {
+		var e deviceStatusEntry
+		if dev.Default {
+			e = d.defaultDeviceStatus(dev)
+		} else {
+			e = d.peerDeviceStatus(dev)
+		}
+		if e.Online {
+			online++
+		}
+		devices = append(devices, e)
+	}
+	body := d.health()
+	body["devices"], body["online"], body["total"] = devices, online, len(devices)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (d *ModbusDriver) statusView(st DeviceStatus) interface{} {
+	if d.mapping != nil {
+		return d.mapping.Apply(statusFields(st))
+	}
+	return st
+}
+
+func (d *ModbusDriver) defaultDeviceStatus(dev deviceEntry) deviceStatusEntry {
+	e := deviceStatusEntry{deviceEntry: dev}
+	if reach := d.reach.Load(); reach != nil {
+		e.Online = reach.Up
+		if !reach.Up {
+			e.Error = reach.Detail
+		}
+	} else {
+		e.Error = "not polled yet"
+	}
+	d.statusMu.RLock()
+	st := d.status
+	d.statusMu.RUnlock()
+	if !st.lastUpdateTime.IsZero() {
+		t := st.lastUpdateTime.UTC()
+		e.Updated, e.Status = &t, d.statusView(st)
+	}
+	return e
+}
+
+func (d *ModbusDriver) peerDeviceStatus(dev deviceEntry) deviceStatusEntry {
+	c := &d.peers
+	c.mu.Lock()
+	defer c.mu.Unlock() // one bus read per slave at a time, and none while a fresh one is cached
+	if e, ok := c.entries[dev.SlaveId]; ok && e.Updated != nil && d.clock.Now().Sub(*e.Updated) < d.cfg.PollInterval {
+		e.deviceEntry = dev
+		return e
+	}
+	now := d.clock.Now().UTC()
+	e := deviceStatusEntry{deviceEntry: dev, Updated: &now}
+	var st DeviceStatus
+	err := d.withSlave(byte(dev.SlaveId), func(mc modbus.Client) error {
+		var err error
+		st, err = d.readPeerStatus(mc)
+		return err
+	})
+	if err != nil {
+		e.Error = err.Error()
+	} else {
+		e.Online, e.Status = true, d.statusView(st)
+	}
+	if c.entries == nil {
+		c.entries = map[int]deviceStatusEntry{}
+	}
+	c.entries[dev.SlaveId] = e
+	return e
+}
+
+// readPeerStatus reads the status registers through mc, which addresses a
+// slave other than SLAVE_ID; it mirrors readAndUpdateStatus without the
+// software blink and change tracking that only apply to SLAVE_ID.
+func (d *ModbusDriver) readPeerStatus(mc modbus.Client) (DeviceStatus, error) {
+	var st DeviceStatus
+	var err error
+	u16 := func(addr uint16) uint16 {
+		if err != nil {
+			return 0 // reported below
+		}
+		var b []byte
+		if b, err = mc.ReadHoldingRegisters(addr, 1); err == nil && len(b) < 2 {
+			err = errors.New("short read")
+		}
+		if err != nil {
+			return 0
+		}
+		return binary.BigEndian.Uint16(b)
+	}
+	st.DeviceAddress, st.BaudRate = int(u16(d.cfg.RegDeviceAddress)), int(u16(d.cfg.RegBaudRate))
+	st.CommFormat = d.decodeCommFormat(u16(d.cfg.RegCommFormat))
+	st.WorkMode, st.ValueType = u16(d.cfg.RegWorkMode), u16(d.cfg.RegValueType)
+	st.Decimals, st.DpMask = u16(d.cfg.RegDecimals), u16(d.cfg.RegDpMask)
+	st.BlinkMask, st.BlinkPeriodMs = u16(d.cfg.RegBlinkMask), u16(d.cfg.RegBlinkPeriodMs)
+	if err != nil {
+		return st, err
+	}
+	b, err := mc.ReadHoldingRegisters(d.cfg.RegDisplayValueStart, uint16(d.cfg.DisplayValueRegs))
+	if err != nil {
+		return st, err
+	}
+	if st.DisplayValue, err = d.codec.Decode(b); err != nil {
+		return st, err
+	}
+	if n := len(d.cfg.SensorChannels); n > 0 {
+		b, err := mc.ReadHoldingRegisters(d.cfg.SensorChannels[0].Addr, uint16(n))
+		if err != nil {
+			return st, err
+		}
+		st.sensors = d.decodeSensors(b)
+		st.Sensors = sensorValues(st.sensors)
+	}
+	st.lastUpdateTime = d.clock.Now()
+	return st, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// An optional status LED for enclosures where nobody can reach the API:
+//
+//	solid       polling the display
+//	blink (1Hz) display offline or not reached yet
+//	fast (5Hz)  configuration error; the driver exits after
+//	            STATUS_LED_ERROR_HOLD_MS so a supervisor can restart it
+//
+// STATUS_LED names the output: "gpiochip0:17" drives line 17 of
+// /dev/gpiochip0 through the GPIO character device, a bare "17" or
+// "sysfs:17" drives /sys/class/gpio/gpio17. STATUS_LED_ACTIVE_LOW=true
+// inverts it. These are read from the environment before anything else, so
+// the LED can report a broken configuration; CONFIG_FILE can't set them.
+
+type ledState int32
+
+const (
+	ledOffline ledState = iota
+	ledOK
+	ledConfigError
+)
+
+type ledLine interface {
+	Set(on bool) error
+	Close() error
+}
+
+type statusLED struct {
+	line  ledLine
+	state atomic.Int32
+	stop  chan struct{}
+	done  sync.WaitGroup
+}
+
+// openStatusLEDFromEnv returns the configured LED, already blinking
+// ledOffline, or nil when STATUS_LED is unset or unusable.
+func openStatusLEDFromEnv() *statusLED {
+	spec := os.Getenv("STATUS_LED")
+	if spec == "" {
+		return nil
+	}
+	activeLow, _ := strconv.ParseBool(os.Getenv("STATUS_LED_ACTIVE_LOW"))
+	line, err := openLEDLine(spec, activeLow)
+	if err != nil {
+		log.Printf("STATUS_LED %s: %v; running without status LED", spec, err)
+		return nil
+	}
+	l := &statusLED{line: line, stop: make(chan struct{})}
+	l.done.Add(1)
+	go l.run()
+	return l
+}
+
+func openLEDLine(spec string, activeLow bool) (ledLine, error) {
+	chip, n, ok := strings.Cut(spec, ":")
+	if !ok {
+		chip, n = "sysfs", spec
+	}
+	offset, err := strconv.Atoi(n)
+	if err != nil || offset < 0 {
+		return nil, fmt.Errorf("want gpiochipN:LINE or a sysfs GPIO number, got %q", spec)
+	}
+	if chip == "sysfs" {
+		return openSysfsLED(offset, activeLow)
+	}
+	if !strings.HasPrefix(chip, "/") {
+		chip = "/dev/" + chip
+	}
+	return openCdevLED(chip, offset, activeLow)
+}
+
+// set is nil-safe so callers needn't check whether an LED is configured.
+func (l *statusLED) set(s ledState) {
+	if l != nil {
+		l.state.Store(int32(s))
+	}
+}
+
+func (l *statusLED) run() {
+	defer l.done.Done()
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for tick := 0; ; tick++ {
+		on := true
+		switch ledState(l.state.Load()) {
+		case ledOffline:
+			on = tick%10 < 5
+		case ledConfigError:
+			on = tick%2 == 0
+		}
+		_ = l.line.Set(on)
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Close turns the LED off, so a stopped driver doesn't look healthy.
+func (l *statusLED) Close() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	l.done.Wait()
+	_ = l.line.Set(false)
+	l.line.Close()
+}
+
+// --- sysfs ---
+
+type sysfsLED struct{ value *os.File }
+
+func openSysfsLED(n int, activeLow bool) (ledLine, error) {
+	dir := fmt.Sprintf("/sys/class/gpio/gpio%d", n)
+	if _, err := os.Stat(dir); err != nil {
+		if err := os.WriteFile("/sys/class/gpio/export", []byte(strconv.Itoa(n)), 0); err != nil {
+			return nil, fmt.Errorf("export: %w", err)
+		}
+	}
+	// The attribute files may appear a moment after the export.
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.WriteFile(dir+"/direction", []byte("out"), 0); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("direction: %w", err)
+	}
+	low := "0"
+	if activeLow {
+		low = "1"
+	}
+	if err := os.WriteFile(dir+"/active_low", []byte(low), 0); err != nil {
+		return nil, fmt.Errorf("active_low: %w", err)
+	}
+	f, err := os.OpenFile(dir+"/value", os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &sysfsLED{value: f}, nil
+}
+
+func (s *sysfsLED) Set(on bool) error {
+	v := []byte("0")
+	if on {
+		v[0] = '1'
+	}
+	_, err := s.value.WriteAt(v, 0)
+	return err
+}
+
+func (s *sysfsLED) Close() error { return s.value.Close() }
+
+// --- GPIO character device (uAPI v2, <linux/gpio.h>) ---
+
+const (
+	gpioV2LineFlagActiveLow = 1 << 1
+	gpioV2LineFlagOutput    = 1 << 3
+)
+
+type gpioV2LineConfig struct {
+	Flags    uint64
+	NumAttrs uint32
+	Padding  [5]uint32
+	Attrs    [10][3]uint64 // struct gpio_v2_line_config_attribute, unused
+}
+
+type gpioV2LineRequest struct {
+	Offsets         [64]uint32
+	Consumer        [32]byte
+	Config          gpioV2LineConfig
+	NumLines        uint32
+	EventBufferSize uint32
+	Padding         [5]uint32
+	FD              int32
+}
+
+type gpioV2LineValues struct {
+	Bits uint64
+	Mask uint64
+}
+
+func gpioIoc(nr, size uintptr) uintptr { return 3<<30 | size<<16 | 0xB4<<8 | nr } // _IOWR(0xB4, nr, size)
+
+var (
+	gpioV2GetLineIoctl       = gpioIoc(0x07, unsafe.Sizeof(gpioV2LineRequest{}))
+	gpioV2LineSetValuesIoctl = gpioIoc(0x0F, unsafe.Sizeof(gpioV2LineValues{}))
+)
+
+type cdevLED struct{ fd int }
+
+func openCdevLED(chip string, offset int, activeLow bool) (ledLine, error) {
+	f, err := os.OpenFile(chip, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	req := gpioV2LineRequest{NumLines: 1}
+	req.Offsets[0] = uint32(offset)
+	copy(req.Consumer[:], "modbus-display status")
+	req.Config.Flags = gpioV2LineFlagOutput
+	if activeLow {
+		req.Config.Flags |= gpioV2LineFlagActiveLow
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), gpioV2GetLineIoctl, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return nil, fmt.Errorf("request line %d: %w", offset, errno)
+	}
+	if req.FD <= 0 {
+		return nil, errors.New("kernel returned no line descriptor")
+	}
+	return &cdevLED{fd: int(req.FD)}, nil
+}
+
+func (c *cdevLED) Set(on bool) error {
+	v := gpioV2LineValues{Mask: 1}
+	if on {
+		v.Bits = 1
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(c.fd), gpioV2LineSetValuesIoctl, uintptr(unsafe.Pointer(&v))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (c *cdevLED) Close() error { return syscall.Close(c.fd) }
+
+// configFatalf reports a configuration error and exits. main replaces it
+// when a status LED is configured so the error shows on the LED first.
+var configFatalf = log.Fatalf
+
+func ledConfigFatalf(led *statusLED) func(string, ...interface{}) {
+	hold := 30 * time.Second
+	if ms, err := strconv.Atoi(os.Getenv("STATUS_LED_ERROR_HOLD_MS")); err == nil && ms >= 0 {
+		hold = time.Duration(ms) * time.Millisecond
+	}
+	return func(format string, args ...interface{}) {
+		log.Printf(format, args...)
+		led.set(ledConfigError)
+		time.Sleep(hold)
+		led.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type fakeLED struct {
+	mu     sync.Mutex
+	values []bool
+	closed bool
+}
+
+func (f *fakeLED) Set(on bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values = append(f.values, on)
+	return nil
+}
+
+func (f *fakeLED) Close() error { f.closed = true; return nil }
+
+// toggles returns how often the LED changed during d.
+func (f *fakeLED) toggles(d time.Duration) (n int, last bool) {
+	f.mu.Lock()
+	start := len(f.values)
+	f.mu.Unlock()
+	time.Sleep(d)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vals := f.values[start:]
+	for i := 1; i < len(vals); i++ {
+		if vals[i] != vals[i-1] {
+			n++
+		}
+	}
+	return n, vals[len(vals)-1]
+}
+
+func TestStatusLEDPatterns(t *testing.T) {
+	if s := unsafe.Sizeof(gpioV2LineRequest{}); s != 592 {
+		t.Fatalf("gpio_v2_line_request is %d bytes, want 592", s)
+	}
+	line := &fakeLED{}
+	l := &statusLED{line: line, stop: make(chan struct{})}
+	l.done.Add(1)
+	go l.run()
+
+	l.set(ledOK)
+	time.Sleep(150 * time.Millisecond)
+	if n, on := line.toggles(time.Second); n != 0 || !on {
+		t.Errorf("ok: %d toggles, on=%v; want solid", n, on)
+	}
+	l.set(ledOffline)
+	if n, _ := line.toggles(2 * time.Second); n < 2 || n > 5 {
+		t.Errorf("offline: %d toggles in 2s, want a 1Hz blink", n)
+	}
+	l.set(ledConfigError)
+	if n, _ := line.toggles(time.Second); n < 7 {
+		t.Errorf("config error: %d toggles in 1s, want a fast blink", n)
+	}
+	l.Close()
+	if !line.closed || line.values[len(line.values)-1] {
+		t.Error("Close left the LED on or the line open")
+	}
+	var none *statusLED
+	none.set(ledOK)
+	none.Close()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// statusMapping reshapes status output for consumers that expect their own
+// field names and units. STATUS_FIELD_MAP names a JSON file like
+//
+//	{"rename":   {"display_value": "DISP", "baud_rate": "baud"},
+//	 "omit":     ["comm_format"],
+//	 "computed": {"baud_rate_kbps": {"from": "baud_rate", "scale": 0.001}}}
+//
+// Computed fields are derived from the original numeric fields as
+// value*scale+offset; omit and rename then apply to the original fields.
+// The mapping shapes GET /status, GET /status/stream and the field name in
+// alarm webhook/MQTT events. Alarm rules keep using the original names.
+type statusMapping struct {
+	Rename   map[string]string        `json:"rename"`
+	Omit     []string                 `json:"omit"`
+	Computed map[string]computedField `json:"computed"`
+}
+
+type computedField struct {
+	From   string   `json:"from"`
+	Scale  *float64 `json:"scale"` // default 1
+	Offset float64  `json:"offset"`
+}
+
+func loadStatusMapping(path string) (*statusMapping, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseStatusMapping(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+func parseStatusMapping(raw []byte) (*statusMapping, error) {
+	var m statusMapping
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	known := statusFields(DeviceStatus{})
+	for _, f := range m.Omit {
+		if _, ok := known[f]; !ok {
+			return nil, fmt.Errorf("omit: unknown field %q", f)
+		}
+	}
+	for from, to := range m.Rename {
+		if _, ok := known[from]; !ok {
+			return nil, fmt.Errorf("rename: unknown field %q", from)
+		}
+		if to == "" {
+			return nil, fmt.Errorf("rename: empty name for %q", from)
+		}
+	}
+	for name, c := range m.Computed {
+		if _, ok := known[c.From].(float64); !ok {
+			return nil, fmt.Errorf("computed %q: %q is not a numeric field", name, c.From)
+		}
+	}
+	// Every output name must be unique.
+	seen := map[string]string{}
+	for _, f := range m.outputNames(known) {
+		if prev, dup := seen[f.out]; dup {
+			return nil, fmt.Errorf("%s and %s are both output as %q", prev, f, f.out)
+		}
+		seen[f.out] = f.String()
+	}
+	return &m, nil
+}
+
+type outputName struct {
+	src, out string
+	computed bool
+}
+
+func (o outputName) String() string {
+	if o.computed {
+		return fmt.Sprintf("computed field %q", o.out)
+	}
+	return fmt.Sprintf("field %q", o.src)
+}
+
+func (m *statusMapping) outputNames(fields map[string]interface{}) []outputName {
+	omit := map[string]bool{}
+	for _, f := range m.Omit {
+		omit[f] = true
+	}
+	var out []outputName
+	for f := range fields {
+		if !omit[f] {
+			out = append(out, outputName{src: f, out: m.Name(f)})
+		}
+	}
+	for name := range m.Computed {
+		out = append(out, outputName{src: m.Computed[name].From, out: name, computed: true})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].String() < out[j].String() })
+	return out
+}
+
+// Name returns the output name of a status field.
+func (m *statusMapping) Name(field string) string {
+	if m != nil {
+		if to, ok := m.Rename[field]; ok {
+			return to
+		}
+	}
+	return field
+}
+
+// Apply maps flattened status fields (see statusFields) to output fields.
+func (m *statusMapping) Apply(fields map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return fields
+	}
+	out := make(map[string]interface{}, len(fields)+len(m.Computed))
+	for _, f := range m.outputNames(fields) {
+		if f.computed {
+			c := m.Computed[f.out]
+			v, _ := fields[c.From].(float64)
+			scale := 1.0
+			if c.Scale != nil {
+				scale = *c.Scale
+			}
+			out[f.out] = v*scale + c.Offset
+			continue
+		}
+		out[f.out] = fields[f.src]
+	}
+	return out
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStatusMappingApply(t *testing.T) {
+	m, err := parseStatusMapping([]byte(`{
+		"rename":   {"display_value": "DISP", "baud_rate": "baud"},
+		"omit":     ["comm_format", "dp_mask", "blink_mask", "blink_period_ms", "value_type", "work_mode", "device_address"],
+		"computed": {"baud_rate_kbps": {"from": "baud_rate", "scale": 0.001}, "decimals_plus_one": {"from": "decimals", "offset": 1}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := m.Apply(statusFields(DeviceStatus{DisplayValue: "12.5", BaudRate: 9600, Decimals: 1, CommFormat: "8N1"}))
+	want := map[string]interface{}{"DISP": "12.5", "baud": 9600.0, "baud_rate_kbps": 9.6, "decimals": 1.0, "decimals_plus_one": 2.0}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Apply = %v, want %v", got, want)
+	}
+	if m.Name("display_value") != "DISP" || m.Name("decimals") != "decimals" {
+		t.Fatal("Name does not follow rename")
+	}
+	var none *statusMapping
+	if none.Name("baud_rate") != "baud_rate" {
+		t.Fatal("nil mapping renamed a field")
+	}
+}
+
+func TestParseStatusMappingErrors(t *testing.T) {
+	for src, wantErr := range map[string]string{
+		`{"omit": ["nope"]}`:                                          `omit: unknown field "nope"`,
+		`{"rename": {"nope": "x"}}`:                                   `rename: unknown field "nope"`,
+		`{"rename": {"decimals": ""}}`:                                `empty name`,
+		`{"computed": {"x": {"from": "display_value"}}}`:              `not a numeric field`,
+		`{"rename": {"decimals": "baud_rate"}}`:                       `both output as "baud_rate"`,
+		`{"computed": {"decimals": {"from": "baud_rate"}}}`:           `both output as "decimals"`,
+		`{"omit": ["decimals"], "rename": {"baud_rate": "decimals"}}`: "",
+	} {
+		_, err := parseStatusMapping([]byte(src))
+		if wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", src, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("%s: err = %v, want %q", src, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status stream:
+//
+//	GET /status/stream[?fields=display_value,blink_mask][&raw=true]
+//
+// Server-sent events, one "status" event with the current status on
+// connect and another whenever a poll finds it changed. With fields only
+// those fields are sent, and only when one of them changed. Field names are
+// the ones GET /status reports, after STATUS_FIELD_MAP. Changes within a
+// field's STATUS_DEADBAND are held back unless raw=true (see deadband.go).
+
+const streamKeepalive = 30 * time.Second
+
+// statusHub fans poll results out to stream subscribers. A slow subscriber
+// only ever has the latest status pending.
+type statusHub struct {
+	mu   sync.Mutex
+	subs map[chan DeviceStatus]struct{}
+}
+
+func (h *statusHub) subscribe() chan DeviceStatus {
+	ch := make(chan DeviceStatus, 1)
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = map[chan DeviceStatus]struct{}{}
+	}
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *statusHub) unsubscribe(ch chan DeviceStatus) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *statusHub) publish(st DeviceStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case <-ch: // drop the stale one
+		default:
+		}
+		ch <- st
+	}
+}
+
+// parseStreamFields validates a ?fields= list against the /status fields,
+// as named by the output mapping; nil means all of them.
+func parseStreamFields(s string, m *statusMapping) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	known := m.Apply(statusFields(DeviceStatus{}))
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if _, ok := known[f]; !ok {
+			names := make([]string, 0, len(known))
+			for k := range known {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown field %q (known: %s)", f, strings.Join(names, ", "))
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+func selectFields(raw map[string]interface{}, fields []string, m *statusMapping) map[string]interface{} {
+	all := m.Apply(raw)
+	if fields == nil {
+		return all
+	}
+	out := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		out[f] = all[f]
+	}
+	return out
+}
+
+func (d *ModbusDriver) handleStatusStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fields, err := parseStreamFields(r.URL.Query().Get("fields"), d.mapping)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bands := d.cfg.StatusDeadband
+	if r.URL.Query().Get("raw") == "true" {
+		bands = nil
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := d.statusHub.subscribe()
+	defer d.statusHub.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var last, published map[string]interface{}
+	send := func(st DeviceStatus) {
+		raw := bands.hold(statusFields(st), published)
+		cur := selectFields(raw, fields, d.mapping)
+		if last != nil && reflect.DeepEqual(cur, last) {
+			return
+		}
+		last, published = cur, raw
+		b, _ := json.Marshal(cur)
+		fmt.Fprintf(w, "event: status\ndata: %s\n\n", b)
+		flusher.Flush()
+	}
+	d.statusMu.RLock()
+	st := d.status
+	d.statusMu.RUnlock()
+	send(st)
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case st := <-ch:
+			send(st)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
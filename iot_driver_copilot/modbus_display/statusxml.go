@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XML status, for building-management systems that ingest nothing else:
+//
+//	GET /status.xml, or GET /status with "Accept: application/xml"
+//	<?xml version="1.0" encoding="UTF-8"?>
+//	<device_status xmlns="urn:modbus-display:status:1" slave_id="1" updated="2026-10-16T08:00:00Z">
+//	  <device_address>1</device_address>
+//	  ...
+//	  <sensors><sensor name="temp">21.5</sensor></sensors>
+//	  <external_changes><change field="work_mode" at="..."><from>0</from><to>1</to></change></external_changes>
+//	</device_status>
+//
+// Elements carry the JSON field names and always appear in the same order;
+// sensors and external changes are sorted by name, and omitted when there
+// are none. STATUS_FIELD_MAP applies to JSON only, so the schema stays
+// fixed whatever the map says. "Accept: application/soap+xml" gets the same
+// document as the Body of a SOAP 1.2 Envelope.
+
+type statusXML struct {
+	XMLName         xml.Name            `xml:"urn:modbus-display:status:1 device_status"`
+	SlaveId         int                 `xml:"slave_id,attr"`
+	Updated         string              `xml:"updated,attr,omitempty"`
+	DeviceAddress   int                 `xml:"device_address"`
+	BaudRate        int                 `xml:"baud_rate"`
+	CommFormat      string              `xml:"comm_format"`
+	WorkMode        uint16              `xml:"work_mode"`
+	DisplayValue    string              `xml:"display_value"`
+	ValueType       uint16              `xml:"value_type"`
+	Decimals        uint16              `xml:"decimals"`
+	DpMask          uint16              `xml:"dp_mask"`
+	BlinkMask       uint16              `xml:"blink_mask"`
+	BlinkPeriodMs   uint16              `xml:"blink_period_ms"`
+	Sensors         *sensorsXML         `xml:"sensors"`
+	ExternalChanges *externalChangesXML `xml:"external_changes"`
+}
+
+type sensorsXML struct {
+	Sensor []sensorXML `xml:"sensor"`
+}
+
+type sensorXML struct {
+	Name  string  `xml:"name,attr"`
+	Value float64 `xml:",chardata"`
+}
+
+type externalChangesXML struct {
+	Change []externalChangeXML `xml:"change"`
+}
+
+type externalChangeXML struct {
+	Field string `xml:"field,attr"`
+	At    string `xml:"at,attr"`
+	From  string `xml:"from"`
+	To    string `xml:"to"`
+}
+
+type soapEnvelope struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2003/05/soap-envelope Envelope"`
+	Body    struct {
+		Content interface{}
+	} `xml:"Body"`
+}
+
+func newStatusXML(st DeviceStatus, slaveId int) statusXML {
+	doc := statusXML{SlaveId: slaveId, DeviceAddress: st.DeviceAddress, BaudRate: st.BaudRate, CommFormat: st.CommFormat,
+		WorkMode: st.WorkMode, DisplayValue: st.DisplayValue, ValueType: st.ValueType, Decimals: st.Decimals,
+		DpMask: st.DpMask, BlinkMask: st.BlinkMask, BlinkPeriodMs: st.BlinkPeriodMs}
+	if !st.lastUpdateTime.IsZero() {
+		doc.Updated = st.lastUpdateTime.UTC().Format(time.RFC3339Nano)
+	}
+	if len(st.Sensors) > 0 {
+		s := &sensorsXML{}
+		for name, v := range st.Sensors {
+			s.Sensor = append(s.Sensor, sensorXML{Name: name, Value: v})
+		}
+		sort.Slice(s.Sensor, func(i, j int) bool { return s.Sensor[i].Name < s.Sensor[j].Name })
+		doc.Sensors = s
+	}
+	if len(st.ExternalChanges) > 0 {
+		c := &externalChangesXML{}
+		for field, ch := range st.ExternalChanges {
+			c.Change = append(c.Change, externalChangeXML{Field: field, At: ch.At.UTC().Format(time.RFC3339Nano), From: xmlText(ch.From), To: xmlText(ch.To)})
+		}
+		sort.Slice(c.Change, func(i, j int) bool { return c.Change[i].Field < c.Change[j].Field })
+		doc.ExternalChanges = c
+	}
+	return doc
+}
+
+// deviceStatus turns a document back into a status, for a cluster standby
+// copying the leader's. External change values come back as text.
+func (doc statusXML) deviceStatus() DeviceStatus {
+	st := DeviceStatus{DeviceAddress: doc.DeviceAddress, BaudRate: doc.BaudRate, CommFormat: doc.CommFormat,
+		WorkMode: doc.WorkMode, DisplayValue: doc.DisplayValue, ValueType: doc.ValueType, Decimals: doc.Decimals,
+		DpMask: doc.DpMask, BlinkMask: doc.BlinkMask, BlinkPeriodMs: doc.BlinkPeriodMs}
+	st.lastUpdateTime, _ = time.Parse(time.RFC3339Nano, doc.Updated)
+	if doc.Sensors != nil {
+		st.Sensors = map[string]float64{}
+		for _, s := range doc.Sensors.Sensor {
+			st.Sensors[s.Name] = s.Value
+		}
+	}
+	if doc.ExternalChanges != nil {
+		st.ExternalChanges = map[string]externalChange{}
+		for _, c := range doc.ExternalChanges.Change {
+			at, _ := time.Parse(time.RFC3339Nano, c.At)
+			st.ExternalChanges[c.Field] = externalChange{At: at, From: c.From, To: c.To}
+		}
+	}
+	return st
+}
+
+func xmlText(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// statusMediaType picks "json", "xml" or "soap" from an Accept header. The
+// highest q wins and JSON wins ties, so browsers and clients that send
+// nothing or */* keep getting JSON.
+func statusMediaType(accept string) string {
+	best, bestQ := "json", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			weight = f
+		}
+		kind := ""
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "application/json", "*/*", "application/*":
+			kind = "json"
+		case "application/xml", "text/xml":
+			kind = "xml"
+		case "application/soap+xml":
+			kind = "soap"
+		}
+		if kind != "" && (weight > bestQ || weight == bestQ && kind == "json") {
+			best, bestQ = kind, weight
+		}
+	}
+	return best
+}
+
+func writeStatusXML(w http.ResponseWriter, doc statusXML, soap bool) {
+	var v interface{} = doc
+	ctype := "application/xml; charset=utf-8"
+	if soap {
+		env := soapEnvelope{}
+		env.Body.Content = doc
+		v, ctype = env, "application/soap+xml; charset=utf-8"
+	}
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, "xml encoding error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(append(b, '\n'))
+}
+
+func (d *ModbusDriver) handleStatusXML(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d.statusMu.RLock()
+	st := d.status
+	d.statusMu.RUnlock()
+	writeStatusXML(w, newStatusXML(st, d.cfg.SlaveId), statusMediaType(r.Header.Get("Accept")) == "soap")
+}
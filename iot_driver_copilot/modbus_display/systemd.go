@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// sdNotify sends a state string to systemd's NOTIFY_SOCKET; it is a no-op
+// when the driver isn't running under a Type=notify unit.
+func sdNotify(state string) error {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return nil
+	}
+	if sock[0] == '@' {
+		sock = "\x00" + sock[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// listenFDsStart is the first file descriptor systemd passes
+// (SD_LISTEN_FDS_START); tests point it at descriptors of their own.
+var listenFDsStart = 3
+
+// systemdListener returns the first socket passed by systemd socket
+// activation (LISTEN_FDS), or nil when the driver was started normally.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	f := os.NewFile(uintptr(listenFDsStart), "LISTEN_FD_"+strconv.Itoa(listenFDsStart))
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %w", err)
+	}
+	return l, nil
+}
+
+// listenHTTP prefers a socket-activated listener and otherwise binds spec,
+// a TCP host:port or an HTTP_LISTEN value (see listen.go), to iface when
+// it is set.
+func listenHTTP(spec, iface string, perms socketPerms) (net.Listener, error) {
+	l, err := systemdListener()
+	if err != nil || l != nil {
+		return l, err
+	}
+	network, addr, err := parseListen(spec)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if iface != "" {
+			return nil, fmt.Errorf("HTTP_INTERFACE applies to TCP listeners, not %s", spec)
+		}
+		return listenUnix(addr, perms)
+	}
+	return listenTCP(network, addr, iface)
+}
+
+// notifyReady tells systemd the serial port is open and the HTTP API is up.
+func (d *ModbusDriver) notifyReady() {
+	d.linkDesc = "serial port " + d.cfg.SerialPort + " open"
+	if err := sdNotify("READY=1\nSTATUS=" + d.linkDesc); err != nil {
+		d.logger.Printf("sd_notify: %v", err)
+	}
+}
+
+// notifyLink publishes device reachability as the unit's STATUS= line
+// whenever it changes.
+func (d *ModbusDriver) notifyLink(up bool, detail string) {
+	if prev := d.reach.Swap(&reachability{Up: up, Detail: detail}); prev == nil && !up || prev != nil && prev.Up != up {
+		d.snmpLinkTrap(up, detail)
+	}
+	desc := "polling slave " + strconv.Itoa(d.cfg.SlaveId) + " on " + d.cfg.SerialPort
+	if !up {
+		desc = "device unreachable: " + detail
+	}
+	if desc == d.linkDesc {
+		return
+	}
+	if up {
+		d.led.set(ledOK)
+	} else {
+		d.led.set(ledOffline)
+	}
+	d.linkDesc = desc
+	_ = sdNotify("STATUS=" + desc)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// activate sets up the environment of a socket-activated start with fd as
+// the passed socket.
+func activate(t *testing.T, pid, fd int) {
+	t.Helper()
+	saved := listenFDsStart
+	t.Cleanup(func() { listenFDsStart = saved })
+	listenFDsStart = fd
+	t.Setenv("LISTEN_PID", strconv.Itoa(pid))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "http")
+}
+
+func TestSystemdListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// systemdListener takes over the descriptor, so give it a bare copy.
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The sockets are for another process, e.g. a parent that forked us.
+	activate(t, os.Getpid()+1, fd)
+	if l, err := systemdListener(); l != nil || err != nil {
+		t.Fatalf("LISTEN_PID of another process: %v, %v", l, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "1" {
+		t.Error("LISTEN_FDS for another process was cleared")
+	}
+
+	activate(t, os.Getpid(), fd)
+	l, err := systemdListener()
+	if err != nil || l == nil {
+		t.Fatalf("socket activation: %v, %v", l, err)
+	}
+	defer l.Close()
+	if l.Addr().String() != ln.Addr().String() {
+		t.Errorf("listener on %v, want the passed socket on %v", l.Addr(), ln.Addr())
+	}
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if os.Getenv(v) != "" {
+			t.Errorf("%s left set for child processes", v)
+		}
+	}
+}
+
+func TestSystemdListenerWithoutSocket(t *testing.T) {
+	// No LISTEN_FDS: a normal start.
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "0")
+	if l, err := systemdListener(); l != nil || err != nil {
+		t.Fatalf("LISTEN_FDS=0: %v, %v", l, err)
+	}
+
+	// LISTEN_FDS=1 but the descriptor is a plain file.
+	f, err := os.Create(filepath.Join(t.TempDir(), "not-a-socket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	activate(t, os.Getpid(), fd)
+	if l, err := systemdListener(); l != nil || err == nil || !strings.Contains(err.Error(), "socket activation") {
+		t.Errorf("plain file as the socket: %v, %v", l, err)
+	}
+
+	// LISTEN_FDS=1 but nothing is open there: systemdListener closed fd.
+	activate(t, os.Getpid(), fd)
+	if l, err := systemdListener(); l != nil || err == nil {
+		t.Errorf("closed descriptor as the socket: %v, %v", l, err)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	for _, abstract := range []bool{false, true} {
+		name := filepath.Join(t.TempDir(), "notify")
+		addr := name
+		if abstract {
+			name = "\x00copilot-test-" + strconv.Itoa(os.Getpid())
+			addr = "@" + name[1:]
+		}
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("NOTIFY_SOCKET", addr)
+		recv := func() string {
+			t.Helper()
+			buf := make([]byte, 512)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("NOTIFY_SOCKET %q: %v", addr, err)
+			}
+			return string(buf[:n])
+		}
+
+		d := &ModbusDriver{cfg: Config{SerialPort: "/dev/ttyUSB0", SlaveId: 3}, logger: log.New(os.Stderr, "", 0)}
+		d.notifyReady()
+		if got := recv(); got != "READY=1\nSTATUS=serial port /dev/ttyUSB0 open" {
+			t.Errorf("ready message %q", got)
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			t.Fatal(err)
+		}
+		if got := recv(); got != "WATCHDOG=1" {
+			t.Errorf("watchdog message %q", got)
+		}
+		conn.Close()
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Errorf("without NOTIFY_SOCKET: %v", err)
+	}
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "gone"))
+	if err := sdNotify("READY=1"); err == nil {
+		t.Error("sdNotify to a missing socket succeeded")
+	}
+}
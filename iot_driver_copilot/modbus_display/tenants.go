@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Tenants: the displays on one bus can belong to different contractors.
+// TENANT_DEVICES assigns slave ids to tenants ("line-a=1,2;line-b=7") and
+// TENANT_KEYS issues API keys per tenant ("line-a:s3cret,line-b:hunter2").
+// Once keys are set every request needs one (Authorization: Bearer or
+// X-API-Key), or the ADMIN_TOKEN, which sees everything. A tenant reaches
+// only its own slaves: routes without ?slave_id act on SLAVE_ID and need the
+// tenant to own it, bus and driver administration is admin-only, and
+// GET /devices and PUT /devices/value are limited to the tenant's slaves.
+// JWTs (jwt.go) stand in for either kind of key.
+
+type (
+	tenantCtxKey struct{}
+	adminCtxKey  struct{} // set for a JWT that maps to admin
+)
+
+var (
+	// tenantAdminRoutes change or expose the bus as a whole.
+	tenantAdminRoutes = map[string]bool{"/metrics": true, "/serial": true, "/diagnostics/serial": true, "/admin/readonly": true, "/comm/config": true, "/logs/stream": true}
+	// tenantSharedRoutes check slaves themselves, or concern none.
+	tenantSharedRoutes = map[string]bool{"/version": true, "/devices": true, "/devices/value": true, "/commands": true, "/status/all": true, "/.well-known/wot": true}
+)
+
+// parseTenantKeys reads TENANT_KEYS, tenant:key pairs, into key -> tenant.
+func parseTenantKeys(raw string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		tenant, key, ok := strings.Cut(pair, ":")
+		if !ok || tenant == "" || key == "" {
+			return nil, fmt.Errorf("malformed entry %q (expected tenant:key)", pair)
+		}
+		if _, dup := keys[key]; dup {
+			return nil, fmt.Errorf("key of tenant %s issued twice", tenant)
+		}
+		keys[key] = tenant
+	}
+	return keys, nil
+}
+
+// parseTenantDevices reads TENANT_DEVICES into slave id -> tenant. A slave
+// belongs to one tenant at most.
+func parseTenantDevices(raw string) (map[int]string, error) {
+	devices := map[int]string{}
+	for _, entry := range strings.Split(raw, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tenant, ids, ok := strings.Cut(entry, "=")
+		tenant = strings.TrimSpace(tenant)
+		if !ok || tenant == "" {
+			return nil, fmt.Errorf("malformed entry %q (expected tenant=id,id)", entry)
+		}
+		for _, s := range strings.Split(ids, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || id < 1 || id > 247 {
+				return nil, fmt.Errorf("tenant %s: invalid slave id %q", tenant, s)
+			}
+			if other, taken := devices[id]; taken && other != tenant {
+				return nil, fmt.Errorf("slave %d assigned to both %s and %s", id, other, tenant)
+			}
+			devices[id] = tenant
+		}
+	}
+	return devices, nil
+}
+
+// requestTenant is the tenant r was authenticated as; "" for the admin
+// token or when tenants are not configured.
+func requestTenant(r *http.Request) string {
+	t, _ := r.Context().Value(tenantCtxKey{}).(string)
+	return t
+}
+
+// requestKey is the credential r carries, from Authorization: Bearer or
+// X-API-Key.
+func requestKey(r *http.Request) string {
+	key := r.Header.Get("X-API-Key")
+	if h, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		key = strings.TrimSpace(h)
+	}
+	return key
+}
+
+func (d *ModbusDriver) lookupTenant(r *http.Request) (string, bool) {
+	key := requestKey(r)
+	if key == "" {
+		return "", false
+	}
+	for k, tenant := range d.cfg.TenantKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return tenant, true
+		}
+	}
+	return "", false
+}
+
+// tenantOwns reports whether tenant may address slave; "" owns every slave.
+func (d *ModbusDriver) tenantOwns(tenant string, slave int) bool {
+	return tenant == "" || d.cfg.DeviceTenants[slave] == tenant
+}
+
+// acceptsSlaveOverride lists the routes that honour ?slave_id=.
+func acceptsSlaveOverride(path string) bool {
+	return strings.HasPrefix(path, "/registers/") || path == "/info" || path == "/firmware"
+}
+
+func (d *ModbusDriver) tenantGuard(next http.Handler) http.Handler {
+	if len(d.cfg.TenantKeys) == 0 && d.jwt == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || d.adminAuthorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tenant, ok := d.lookupTenant(r)
+		if key := requestKey(r); !ok && d.jwt != nil && looksLikeJWT(key) {
+			id, err := d.jwt.identify(r.Context(), key)
+			switch {
+			case errors.Is(err, errJWTInvalid):
+				w.Header().Set("WWW-Authenticate", `Bearer realm="modbus-display", error="invalid_token"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			case errors.Is(err, errJWTNoRole):
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			case err != nil:
+				d.logger.Printf("jwt: %v", err)
+				http.Error(w, "cannot verify token: identity provider keys unavailable", http.StatusServiceUnavailable)
+				return
+			case id.Admin:
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminCtxKey{}, true)))
+				return
+			}
+			tenant, ok = id.Tenant, true
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="modbus-display"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch path := r.URL.Path; {
+		case tenantAdminRoutes[path], strings.HasPrefix(path, "/debug/"):
+			http.Error(w, "admin token required", http.StatusForbidden)
+			return
+		case tenantSharedRoutes[path], strings.HasPrefix(path, "/commands/"):
+		default:
+			slave := d.cfg.SlaveId
+			if q := r.URL.Query().Get("slave_id"); q != "" && acceptsSlaveOverride(path) {
+				// An invalid id is left for the handler to reject.
+				if id, err := strconv.Atoi(q); err == nil {
+					slave = id
+				}
+			}
+			if !d.tenantOwns(tenant, slave) {
+				http.Error(w, fmt.Sprintf("slave %d is not assigned to tenant %s", slave, tenant), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantCtxKey{}, tenant)))
+	})
+}
+
+type deviceEntry struct {
+	SlaveId int    `json:"slave_id"`
+	Tenant  string `json:"tenant,omitempty"`
+	Default bool   `json:"default,omitempty"` // SLAVE_ID, the display /status and friends act on
+}
+
+// handleDevices lists the slaves the caller may address.
+func (d *ModbusDriver) handleDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"devices": d.tenantDevices(requestTenant(r))})
+}
+
+// tenantDevices lists SLAVE_ID and the TENANT_DEVICES slaves tenant owns,
+// by slave id.
+func (d *ModbusDriver) tenantDevices(tenant string) []deviceEntry {
+	ids := map[int]bool{d.cfg.SlaveId: true}
+	for id := range d.cfg.DeviceTenants {
+		ids[id] = true
+	}
+	devices := []deviceEntry{}
+	for id := range ids {
+		if d.tenantOwns(tenant, id) {
+			devices = append(devices, deviceEntry{SlaveId: id, Tenant: d.cfg.DeviceTenants[id], Default: id == d.cfg.SlaveId})
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].SlaveId < devices[j].SlaveId })
+	return devices
+}
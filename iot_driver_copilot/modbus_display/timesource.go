@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// timeSource timestamps events, alarms, commands, polls and device clock
+// syncs. With NTP_SERVER set it asks that server for the time every
+// NTP_INTERVAL_MS (SNTP, RFC 4330) and applies the measured offset to the
+// host clock, which is never changed itself: edge boxes without an RTC
+// battery or a time daemon often boot years off. Until the first answer,
+// and without NTP_SERVER, it is the host clock. GET /healthz reports the
+// skew, and a skew beyond CLOCK_SKEW_WARN_MS or a server that has not
+// answered for three intervals makes the driver "degraded".
+type timeSource struct {
+	server   string
+	interval time.Duration
+	warn     time.Duration
+	logger   *log.Logger
+
+	mu      sync.Mutex
+	offset  time.Duration // true time minus host time
+	rtt     time.Duration
+	synced  time.Time // host time of the last answer
+	lastErr error
+	warned  bool
+}
+
+const (
+	ntpEpochOffset = 2208988800 // seconds from 1900 to 1970
+	ntpTimeout     = 5 * time.Second
+)
+
+func newTimeSource(cfg Config, logger *log.Logger) *timeSource {
+	return &timeSource{server: cfg.NTPServer, interval: cfg.NTPInterval, warn: cfg.ClockSkewWarn, logger: logger}
+}
+
+// Now is the current time, corrected by the last NTP measurement.
+func (ts *timeSource) Now() time.Time {
+	if ts == nil {
+		return time.Now()
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return time.Now().Add(ts.offset)
+}
+
+func (ts *timeSource) run(ctx context.Context) {
+	for {
+		ts.sync(ctx)
+		select {
+		case <-time.After(ts.interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sync takes one measurement. A failed query keeps the previous offset.
+func (ts *timeSource) sync(ctx context.Context) {
+	offset, rtt, err := queryNTP(ctx, ts.server)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if err != nil {
+		if ts.lastErr == nil {
+			ts.logger.Printf("ntp query to %s failed: %v", ts.server, err)
+		}
+		ts.lastErr = err
+		return
+	}
+	if ts.lastErr != nil {
+		ts.logger.Printf("ntp server %s answering again", ts.server)
+	}
+	ts.offset, ts.rtt, ts.synced, ts.lastErr = offset, rtt, time.Now(), nil
+	skewed := offset.Abs() > ts.warn
+	if skewed && !ts.warned {
+		ts.logger.Printf("host clock differs from %s by %v; correcting event times", ts.server, -offset)
+	}
+	ts.warned = skewed
+}
+
+type clockHealth struct {
+	Source   string     `json:"source"` // "ntp" or "system"
+	Server   string     `json:"server,omitempty"`
+	SkewMs   *float64   `json:"skew_ms,omitempty"` // host clock minus NTP time
+	RTTMs    *float64   `json:"rtt_ms,omitempty"`
+	LastSync *time.Time `json:"last_sync,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	OK       bool       `json:"ok"`
+}
+
+func (ts *timeSource) health() clockHealth {
+	if ts == nil {
+		return clockHealth{Source: "system", OK: true}
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	h := clockHealth{Source: "ntp", Server: ts.server}
+	if ts.lastErr != nil {
+		h.Error = ts.lastErr.Error()
+	}
+	if ts.synced.IsZero() {
+		return h
+	}
+	ms := func(d time.Duration) *float64 { v := float64(d) / float64(time.Millisecond); return &v }
+	last := ts.synced.Add(ts.offset).UTC()
+	h.SkewMs, h.RTTMs, h.LastSync = ms(-ts.offset), ms(ts.rtt), &last
+	h.OK = ts.offset.Abs() <= ts.warn && time.Since(ts.synced) < 3*ts.interval
+	return h
+}
+
+// queryNTP asks server ("host" or "host:port") for the time, returning the
+// host clock's offset from it and the round trip.
+func queryNTP(ctx context.Context, server string) (offset, rtt time.Duration, err error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	ctx, cancel := context.WithTimeout(ctx, ntpTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	// The transmit timestamp is random rather than the time: the server
+	// echoes it as the originate timestamp, which ties the answer to this
+	// request, and the host clock may be far enough off to be refused.
+	req := make([]byte, 48)
+	req[0] = 0x23 // LI 0, version 4, mode 3 (client)
+	if _, err := rand.Read(req[40:]); err != nil {
+		return 0, 0, err
+	}
+	t1 := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, 0, err
+	}
+	resp := make([]byte, 48)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n >= 48 && string(resp[24:32]) == string(req[40:48]) {
+			break
+		}
+	}
+	t4 := t1.Add(time.Since(t1))
+	switch {
+	case resp[0]&0x07 != 4:
+		return 0, 0, errors.New("ntp: not a server reply")
+	case resp[0]>>6 == 3:
+		return 0, 0, errors.New("ntp: server clock not synchronized")
+	case resp[1] == 0:
+		return 0, 0, fmt.Errorf("ntp: server refused: %q", resp[12:16])
+	}
+	t2, t3 := ntpTime(resp[32:40]), ntpTime(resp[40:48])
+	rtt = t4.Sub(t1) - t3.Sub(t2)
+	// ((t2-t1)+(t3-t4))/2, with the local times taken from t1 so that the
+	// monotonic clock measures the interval.
+	offset = (t2.Sub(t1.Round(0)) + t3.Sub(t4.Round(0))) / 2
+	return offset, rtt, nil
+}
+
+func ntpTime(b []byte) time.Time {
+	secs := int64(binary.BigEndian.Uint32(b))
+	if secs < 1<<31 {
+		secs += 1 << 32 // era 1, from February 2036
+	}
+	frac := int64(binary.BigEndian.Uint32(b[4:]))
+	return time.Unix(secs-ntpEpochOffset, frac*1e9>>32)
+}
+
+func (d *ModbusDriver) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(d.health())
+}
+
+// health is the GET /healthz document, also the top of GET /status/all.
+func (d *ModbusDriver) health() map[string]interface{} {
+	clock := d.clock.health()
+	status := "ok"
+	if !clock.OK {
+		status = "degraded"
+	}
+	health := map[string]interface{}{"status": status, "clock": clock}
+	if d.freshness != nil {
+		value := d.freshness.health(time.Now())
+		if value["stale"] == true {
+			health["status"] = "degraded"
+		}
+		health["display_value"] = value
+	}
+	if port := d.port.Load(); port != nil {
+		if !port.OK {
+			health["status"] = "degraded"
+		}
+		health["serial_port"] = port
+	}
+	if d.cluster != nil {
+		health["cluster_role"] = "standby"
+		if d.cluster.leading() {
+			health["cluster_role"] = "leader"
+		}
+	}
+	return health
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fakeNTP answers SNTP requests with the host time shifted by ahead.
+func fakeNTP(t *testing.T, ahead time.Duration, stratum byte) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	put := func(b []byte, tm time.Time) {
+		binary.BigEndian.PutUint32(b, uint32(tm.Unix()+ntpEpochOffset))
+		binary.BigEndian.PutUint32(b[4:], uint32((uint64(tm.Nanosecond())<<32)/1e9))
+	}
+	go func() {
+		buf := make([]byte, 48)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 48 {
+				continue
+			}
+			resp := make([]byte, 48)
+			resp[0], resp[1] = 0x24, stratum // version 4, mode 4 (server)
+			copy(resp[24:32], buf[40:48])
+			now := time.Now().Add(ahead)
+			put(resp[32:], now)
+			put(resp[40:], now)
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestTimeSource(t *testing.T) {
+	ts := &timeSource{server: fakeNTP(t, time.Hour, 2), interval: time.Minute, warn: time.Second, logger: log.New(io.Discard, "", 0)}
+	if h := ts.health(); h.OK || h.SkewMs != nil {
+		t.Errorf("health before the first answer: %+v", h)
+	}
+	ts.sync(context.Background())
+	if off := ts.Now().Sub(time.Now()); off < time.Hour-time.Second || off > time.Hour+time.Second {
+		t.Errorf("Now() is %v ahead, want 1h", off)
+	}
+	h := ts.health()
+	if h.OK || h.SkewMs == nil || *h.SkewMs > -3599000 || *h.SkewMs < -3601000 || h.Error != "" {
+		t.Errorf("health after a 1h skew: %+v (skew %v)", h, *h.SkewMs)
+	}
+
+	// A kiss-of-death answer is an error and keeps the last offset.
+	ts.server = fakeNTP(t, 0, 0)
+	ts.sync(context.Background())
+	if h := ts.health(); h.Error == "" || *h.SkewMs > -3599000 {
+		t.Errorf("health after a refusal: %+v", h)
+	}
+
+	synced := &timeSource{server: fakeNTP(t, 0, 1), interval: time.Minute, warn: time.Second, logger: log.New(io.Discard, "", 0)}
+	synced.sync(context.Background())
+	if h := synced.health(); !h.OK {
+		t.Errorf("health in sync: %+v", h)
+	}
+}
+
+func TestNTPTimeEras(t *testing.T) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, 3993955200) // 2026-07-26
+	if got := ntpTime(b).UTC(); got.Year() != 2026 {
+		t.Errorf("era 0: %v", got)
+	}
+	binary.BigEndian.PutUint32(b, 100) // just after the 2036 rollover
+	if got := ntpTime(b).UTC(); got.Year() != 2036 {
+		t.Errorf("era 1: %v", got)
+	}
+}
+
+func TestHealthzWithoutCredentials(t *testing.T) {
+	_, _, srv := startTestDriver(t, func(c *Config) { c.TenantKeys = map[string]string{"key-a": "line-a"} })
+	resp, err := http.Get(srv.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var got struct {
+		Status string      `json:"status"`
+		Clock  clockHealth `json:"clock"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || resp.StatusCode != http.StatusOK || got.Status != "ok" || got.Clock.Source != "system" {
+		t.Errorf("GET /healthz = %d %+v, %v", resp.StatusCode, got, err)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The value pipeline steadies numbers from a noisy upstream before they
+// reach SLAVE_ID's display, so the sender can stay simple. It applies to
+// PUT /display/value values that are plain decimal numbers ("21.53",
+// "-4"); anything else is shown as sent and starts the pipeline afresh.
+//
+// VALUE_SMOOTHING_WINDOW=N shows an exponential moving average over about
+// N values (weight 2/(N+1) for each new one) with the decimals of the
+// value sent. VALUE_ROTATE="current,max:P" cycles the display through
+// views of the smoothed values every VALUE_ROTATE_INTERVAL_MS: current,
+// min, max and avg over the last VALUE_AGGREGATE_WINDOW_MS, each
+// optionally prefixed by a label that is dropped when it doesn't fit.
+// A new value shows the view on display at the time. Rotation pauses while
+// the display is read-only, shows VALUE_STALE_TEXT, or holds text. GET
+// /display/value/stats reports the figures.
+
+// valueView is one VALUE_ROTATE entry.
+type valueView struct {
+	Kind  string // current, min, max or avg
+	Label string
+}
+
+var valueViewKinds = map[string]bool{"current": true, "min": true, "max": true, "avg": true}
+
+// parseValueRotate parses "current,max:P,min:L".
+func parseValueRotate(s string) ([]valueView, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var views []valueView
+	for _, part := range strings.Split(s, ",") {
+		kind, label, _ := strings.Cut(strings.TrimSpace(part), ":")
+		if !valueViewKinds[kind] {
+			return nil, fmt.Errorf("unknown view %q (expected current, min, max or avg)", kind)
+		}
+		views = append(views, valueView{Kind: kind, Label: label})
+	}
+	if len(views) < 2 {
+		return nil, fmt.Errorf("rotating needs at least two views")
+	}
+	return views, nil
+}
+
+var displayNumberPattern = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]+)?$`)
+
+// parseDisplayNumber reads a plain decimal number and its decimals.
+func parseDisplayNumber(s string) (v float64, decimals int, ok bool) {
+	if !displayNumberPattern.MatchString(s) {
+		return 0, 0, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(v, 0) {
+		return 0, 0, false
+	}
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		decimals = len(s) - i - 1
+	}
+	return v, decimals, true
+}
+
+type valueSample struct {
+	at time.Time
+	v  float64
+}
+
+// maxValueSamples bounds the aggregation window's memory.
+const maxValueSamples = 10000
+
+type valuePipeline struct {
+	alpha  float64 // weight of a new value; 1 is no smoothing
+	views  []valueView
+	window time.Duration
+	fits   func(string) bool // whether the display can show a text
+
+	mu       sync.Mutex
+	numeric  bool // the last value was a number
+	ema      float64
+	decimals int
+	samples  []valueSample // smoothed values within window, oldest first
+	phase    int           // index into views
+}
+
+func newValuePipeline(cfg Config, fits func(string) bool) *valuePipeline {
+	p := &valuePipeline{alpha: 1, views: cfg.ValueRotate, window: cfg.ValueAggregateWindow, fits: fits}
+	if cfg.ValueSmoothing > 1 {
+		p.alpha = 2 / float64(cfg.ValueSmoothing+1)
+	}
+	return p
+}
+
+// Add takes a value sent for the display and returns the text to show.
+func (p *valuePipeline) Add(val string, now time.Time) string { return p.add(val, now, true) }
+
+// Preview is Add for a dry run: the pipeline is left as it was.
+func (p *valuePipeline) Preview(val string, now time.Time) string { return p.add(val, now, false) }
+
+func (p *valuePipeline) add(val string, now time.Time, commit bool) string {
+	if p == nil {
+		return val
+	}
+	f, decimals, ok := parseDisplayNumber(val)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !ok {
+		if commit {
+			p.numeric, p.samples = false, nil
+		}
+		return val
+	}
+	ema := f
+	if p.numeric {
+		ema = p.ema + p.alpha*(f-p.ema)
+	}
+	samples := p.pruned(now)
+	if !commit {
+		samples = append([]valueSample(nil), samples...)
+	}
+	samples = append(samples, valueSample{now, ema})
+	if len(samples) > maxValueSamples {
+		samples = samples[len(samples)-maxValueSamples:]
+	}
+	if commit {
+		p.numeric, p.ema, p.decimals, p.samples = true, ema, decimals, samples
+	}
+	return p.text(p.phase, ema, decimals, samples)
+}
+
+// Next moves to the next VALUE_ROTATE view and returns its text; ok is
+// false when there is nothing to rotate.
+func (p *valuePipeline) Next(now time.Time) (text string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.views) < 2 || !p.numeric {
+		return "", false
+	}
+	p.samples = p.pruned(now)
+	p.phase = (p.phase + 1) % len(p.views)
+	return p.text(p.phase, p.ema, p.decimals, p.samples), true
+}
+
+// pruned drops the samples older than the window; p.mu is held.
+func (p *valuePipeline) pruned(now time.Time) []valueSample {
+	i := 0
+	for i < len(p.samples) && now.Sub(p.samples[i].at) > p.window {
+		i++
+	}
+	return p.samples[i:]
+}
+
+// text renders view phase; p.mu is held.
+func (p *valuePipeline) text(phase int, ema float64, decimals int, samples []valueSample) string {
+	view := valueView{Kind: "current"}
+	if len(p.views) > 0 {
+		view = p.views[phase]
+	}
+	s := formatDisplayNumber(aggregate(view.Kind, ema, samples), decimals)
+	if view.Label != "" && p.fits(view.Label+s) {
+		return view.Label + s
+	}
+	return s
+}
+
+func aggregate(kind string, current float64, samples []valueSample) float64 {
+	if kind == "current" || len(samples) == 0 {
+		return current
+	}
+	v, sum := samples[0].v, 0.0
+	for _, s := range samples {
+		switch {
+		case kind == "min" && s.v < v, kind == "max" && s.v > v:
+			v = s.v
+		}
+		sum += s.v
+	}
+	if kind == "avg" {
+		return sum / float64(len(samples))
+	}
+	return v
+}
+
+func formatDisplayNumber(v float64, decimals int) string {
+	s := strconv.FormatFloat(v, 'f', decimals, 64)
+	if strings.Trim(s, "-0.") == "" {
+		s = strings.TrimPrefix(s, "-") // no "-0.0" for a value that rounds to zero
+	}
+	return s
+}
+
+// view names the VALUE_ROTATE view on display.
+func (p *valuePipeline) view() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.views) == 0 {
+		return "current"
+	}
+	return p.views[p.phase].Kind
+}
+
+// --- the driver's side ---
+
+// valueRotateLoop shows the next VALUE_ROTATE view every
+// VALUE_ROTATE_INTERVAL_MS.
+func (d *ModbusDriver) valueRotateLoop(ctx context.Context) {
+	t := time.NewTicker(d.cfg.ValueRotateInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		if d.readOnly.Load() || !d.cluster.leading() || d.freshness.showingFallback() {
+			continue
+		}
+		d.rotateValue(time.Now())
+	}
+}
+
+func (d *ModbusDriver) rotateValue(now time.Time) {
+	d.settingsMu.Lock() // not between a PUT's Add and its write
+	defer d.settingsMu.Unlock()
+	text, ok := d.pipeline.Next(now)
+	if !ok {
+		return
+	}
+	write := func() error { return d.writeDisplayText(text) }
+	var err error
+	if d.blinker != nil {
+		err = d.blinker.Write(text, write)
+	} else {
+		err = write()
+	}
+	if err != nil {
+		d.logger.Printf("show %q for VALUE_ROTATE failed: %v", text, err)
+		return
+	}
+	d.statusMu.Lock()
+	d.status.DisplayValue = text
+	d.statusMu.Unlock()
+}
+
+// handleValueStats serves GET /display/value/stats.
+func (d *ModbusDriver) handleValueStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := d.pipeline
+	if p == nil {
+		http.Error(w, "value pipeline disabled (VALUE_SMOOTHING_WINDOW, VALUE_ROTATE)", http.StatusNotFound)
+		return
+	}
+	view := p.view()
+	p.mu.Lock()
+	samples := p.pruned(time.Now())
+	out := map[string]interface{}{
+		"smoothing_window":    d.cfg.ValueSmoothing,
+		"aggregate_window_ms": p.window.Milliseconds(),
+		"samples":             len(samples),
+		"view":                view,
+		"numeric":             p.numeric,
+	}
+	if p.numeric {
+		for _, kind := range []string{"current", "min", "max", "avg"} {
+			out[kind] = aggregate(kind, p.ema, samples)
+		}
+	}
+	p.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
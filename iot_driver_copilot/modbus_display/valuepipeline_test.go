@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseValueRotate(t *testing.T) {
+	views, err := parseValueRotate("current, max:P ,avg")
+	if err != nil || len(views) != 3 || views[1] != (valueView{Kind: "max", Label: "P"}) {
+		t.Fatalf("%+v %v", views, err)
+	}
+	for _, bad := range []string{"current", "current,peak", "max:H,"} {
+		if _, err := parseValueRotate(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestValuePipeline(t *testing.T) {
+	views, _ := parseValueRotate("current,max:P,min:LOW")
+	p := newValuePipeline(Config{ValueSmoothing: 3, ValueRotate: views, ValueAggregateWindow: time.Minute},
+		func(s string) bool { return len(s) <= 6 })
+	t0 := time.Now()
+
+	// Weight 2/(3+1): 10, then 10+0.5*(20-10), then 15+0.5*(11-15).
+	for i, c := range []struct{ in, want string }{{"10.0", "10.0"}, {"20.0", "15.0"}, {"11.0", "13.0"}} {
+		if got := p.Add(c.in, t0.Add(time.Duration(i)*time.Second)); got != c.want {
+			t.Errorf("Add(%s) = %q, want %q", c.in, got, c.want)
+		}
+	}
+	if got := p.Preview("1.0", t0.Add(3*time.Second)); got != "7.0" {
+		t.Errorf("Preview = %q", got)
+	}
+	if got, ok := p.Next(t0.Add(4 * time.Second)); !ok || got != "P15.0" {
+		t.Errorf("max view %q %v", got, ok)
+	}
+	if got, ok := p.Next(t0.Add(5 * time.Second)); !ok || got != "10.0" {
+		t.Errorf("min view %q %v, want the label left out", got, ok)
+	}
+	// A new value shows in the view on display, where the label fits again;
+	// the preview left no trace.
+	if got := p.Add("5.0", t0.Add(6*time.Second)); got != "LOW9.0" {
+		t.Errorf("Add in the min view = %q", got)
+	}
+	if got, _ := p.Next(t0.Add(7 * time.Second)); got != "9.0" {
+		t.Errorf("current view %q", got)
+	}
+	// Samples older than the window drop out of min and max.
+	p.Next(t0.Add(70 * time.Second))
+	if got, _ := p.Next(t0.Add(70 * time.Second)); got != "LOW9.0" {
+		t.Errorf("min over an emptied window %q", got)
+	}
+
+	if got := p.Add("OPEN", t0); got != "OPEN" {
+		t.Errorf("text changed to %q", got)
+	}
+	if _, ok := p.Next(t0); ok {
+		t.Error("rotating after a text")
+	}
+	if got := p.Add("-0.01", t0); got != "-0.01" {
+		t.Errorf("first value after a text %q", got)
+	}
+	if got := formatDisplayNumber(-0.004, 2); got != "0.00" {
+		t.Errorf("formatDisplayNumber(-0.004) = %q", got)
+	}
+}
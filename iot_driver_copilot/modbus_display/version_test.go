@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		latest, current string
+		want            bool
+	}{
+		{"1.5.0", "1.4.9", true},
+		{"v1.10.0", "1.9.3", true},
+		{"2.0.0", "v1.99.99", true},
+		{"1.4.0", "1.4.0", false},
+		{"1.3.9", "1.4.0", false},
+		{"1.4.0", "1.4.0-rc.2", true},
+		{"1.4.0-rc.2", "1.4.0", false},
+		{"1.4.0-rc.10", "1.4.0-rc.2", true},
+		{"1.4.0-rc.1", "1.4.0-beta", true},
+		{"1.4.0-alpha.1", "1.4.0-alpha", true},
+		{"1.4.0-alpha", "1.4.0-1", true},
+		{"1.4.0+build.7", "1.4.0", false},
+		{"1.5.0", "dev", false},
+		{"latest", "1.4.0", false},
+		{"1.5", "1.4.0", false},
+	} {
+		if got := newerVersion(tc.latest, tc.current); got != tc.want {
+			t.Errorf("newerVersion(%q, %q) = %v, want %v", tc.latest, tc.current, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateChecker(t *testing.T) {
+	var hits atomic.Int32
+	var manifest atomic.Value
+	manifest.Store(`{"version": "1.5.0", "url": "https://example.com/releases/1.5.0", "notes": "faster polling"}`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte(manifest.Load().(string)))
+	}))
+	defer srv.Close()
+
+	u := newUpdateChecker(srv.URL, time.Hour)
+	d := &ModbusDriver{updates: u}
+	get := func(query string) versionInfo {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		d.handleVersion(rec, httptest.NewRequest(http.MethodGet, "/version"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /version%s: %d %s", query, rec.Code, rec.Body)
+		}
+		var v versionInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	v := get("")
+	if v.GoVersion == "" || v.Platform == "" || v.Update == nil {
+		t.Fatalf("incomplete version info: %+v", v)
+	}
+	if v.Update.Latest != "1.5.0" || v.Update.URL != "https://example.com/releases/1.5.0" || v.Update.Error != "" {
+		t.Fatalf("update: %+v", v.Update)
+	}
+	// A dev build never reports an update.
+	if v.Update.Available {
+		t.Fatalf("update available for %q", v.Update.Current)
+	}
+	get("")
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("manifest fetched %d times, want 1 (cached)", n)
+	}
+	get("?check=true")
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("manifest fetched %d times, want 2 after ?check=true", n)
+	}
+
+	if s := u.status(context.Background(), "1.4.2", true); !s.Available || s.Current != "1.4.2" {
+		t.Fatalf("no update reported for 1.4.2: %+v", s)
+	}
+
+	manifest.Store(`{"version": "soon"}`)
+	if s := u.status(context.Background(), "1.4.2", true); s.Error == "" || s.Available {
+		t.Fatalf("invalid manifest accepted: %+v", s)
+	}
+}
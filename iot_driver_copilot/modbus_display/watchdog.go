@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The watchdog is patted only while polls succeed (or, on a standby, while
+// the loop mirrors the leader), so a wedged driver or a serial link that
+// stays down for WATCHDOG_STALL_MS gets the box rebooted by /dev/watchdog
+// or the service restarted by systemd.
+
+// systemdWatchdogInterval returns WATCHDOG_USEC when it is addressed to this process.
+func systemdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+func (d *ModbusDriver) markProgress() { d.lastProgress.Store(time.Now().UnixNano()) }
+
+func (d *ModbusDriver) healthy() bool {
+	last := time.Unix(0, d.lastProgress.Load())
+	return time.Since(last) < d.cfg.WatchdogStall
+}
+
+func (d *ModbusDriver) watchdogLoop(ctx context.Context) {
+	sdInterval := systemdWatchdogInterval()
+	var dev *os.File
+	if d.cfg.WatchdogDevice != "" {
+		f, err := os.OpenFile(d.cfg.WatchdogDevice, os.O_WRONLY, 0)
+		if err != nil {
+			d.logger.Printf("watchdog: open %s: %v", d.cfg.WatchdogDevice, err)
+		} else {
+			dev = f
+		}
+	}
+	if dev == nil && sdInterval == 0 {
+		return
+	}
+	interval := d.cfg.WatchdogInterval
+	if sdInterval > 0 && sdInterval/2 < interval {
+		interval = sdInterval / 2
+	}
+	d.logger.Printf("watchdog: patting every %v while polls succeed (stall limit %v)", interval, d.cfg.WatchdogStall)
+	warned := false
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if dev != nil {
+				// Magic close: disarm the hardware watchdog on a clean shutdown.
+				_, _ = dev.Write([]byte("V"))
+				dev.Close()
+			}
+			return
+		case <-t.C:
+		}
+		if !d.healthy() {
+			if !warned {
+				d.logger.Printf("watchdog: no successful poll for %v, no longer patting", d.cfg.WatchdogStall)
+				warned = true
+			}
+			continue
+		}
+		warned = false
+		if dev != nil {
+			if _, err := dev.Write([]byte{0}); err != nil {
+				d.logger.Printf("watchdog: pat %s: %v", d.cfg.WatchdogDevice, err)
+			}
+		}
+		if sdInterval > 0 {
+			_ = sdNotify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"modbus-display-driver/internal/modbustest"
+)
+
+func TestWatchdogPatsWhilePollsSucceed(t *testing.T) {
+	// A regular file stands in for /dev/watchdog: every pat appends a byte.
+	dev := filepath.Join(t.TempDir(), "watchdog")
+	if err := os.WriteFile(dev, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	d, sim, _ := startTestDriver(t, func(c *Config) {
+		c.WatchdogDevice = dev
+		c.WatchdogInterval = 10 * time.Millisecond
+		c.WatchdogStall = 300 * time.Millisecond
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.watchdogLoop(ctx)
+	}()
+	pats := func() int64 {
+		t.Helper()
+		fi, err := os.Stat(dev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	patting := func(want bool) {
+		t.Helper()
+		before := pats()
+		time.Sleep(100 * time.Millisecond)
+		if got := pats() > before; got != want {
+			t.Fatalf("patting = %v, want %v", got, want)
+		}
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); pats() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("watchdog never patted")
+		}
+	}
+	patting(true)
+
+	sim.OnRequest(func(modbustest.Request) *modbustest.Fault {
+		return &modbustest.Fault{Exception: modbustest.ExceptionSlaveDeviceFailure}
+	})
+	time.Sleep(d.cfg.WatchdogStall)
+	patting(false)
+
+	// Patting resumes with the first good poll after the link recovers.
+	sim.OnRequest(nil)
+	for deadline := time.Now().Add(5 * time.Second); !d.healthy(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no successful poll after the device recovered")
+		}
+	}
+	patting(true)
+
+	cancel()
+	<-done
+	if b, _ := os.ReadFile(dev); b[len(b)-1] != 'V' {
+		t.Error("watchdog not disarmed with the magic close on shutdown")
+	}
+}
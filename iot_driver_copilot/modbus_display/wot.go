@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// GET /.well-known/wot describes the driver as a W3C Web of Things Thing
+// Description (TD 1.1), so a WoT consumer can use it without an adapter:
+// the settings endpoints become properties, the other writes actions, and
+// the status and log streams (SSE) and the configured alarm and external
+// change targets (webhook, MQTT) events. The document follows the running
+// configuration: optional features appear only when they are set up,
+// status field names follow STATUS_FIELD_MAP, and the security scheme says
+// whether a credential is needed. Hrefs are relative to "base", which is
+// taken from the request so the TD also works behind HTTP_BASE_PATH.
+
+type tdMap = map[string]interface{}
+
+func tdObject(props tdMap, required ...string) tdMap {
+	m := tdMap{"type": "object", "properties": props}
+	if len(required) > 0 {
+		m["required"] = required
+	}
+	return m
+}
+
+func tdUint16() tdMap { return tdMap{"type": "integer", "minimum": 0, "maximum": 65535} }
+
+// tdForm is an HTTP form. method is only given where the TD default for
+// op (GET to read, PUT to write, POST to invoke) does not hold.
+func tdForm(href string, op interface{}, method string) tdMap {
+	f := tdMap{"href": href, "op": op, "contentType": "application/json"}
+	if method != "" {
+		f["htv:methodName"] = method
+	}
+	return f
+}
+
+func tdSSEForm(href string, op string) tdMap {
+	return tdMap{"href": href, "op": op, "subprotocol": "sse", "contentType": "text/event-stream"}
+}
+
+// tdSetting is a property backed by a GET|PUT settings endpoint.
+func tdSetting(title, href string, schema tdMap) tdMap {
+	schema["title"] = title
+	schema["forms"] = []tdMap{tdForm(href, []string{"readproperty", "writeproperty"}, "")}
+	return schema
+}
+
+// statusSchema is the GET /status object under STATUS_FIELD_MAP.
+func (d *ModbusDriver) statusSchema() tdMap {
+	fields := tdMap{}
+	t := reflect.TypeOf(DeviceStatus{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.String:
+			fields[name] = tdMap{"type": "string"}
+		case reflect.Int, reflect.Uint16:
+			fields[name] = tdMap{"type": "integer"}
+		case reflect.Map:
+			fields[name] = tdMap{"type": "object"}
+		}
+	}
+	fields["display_value"].(tdMap)["description"] = "the text shown, as last polled"
+	if d.mapping != nil {
+		mapped := tdMap{}
+		for _, o := range d.mapping.outputNames(fields) {
+			if o.computed {
+				mapped[o.out] = tdMap{"type": "number"}
+			} else {
+				mapped[o.out] = fields[o.src]
+			}
+		}
+		fields = mapped
+	}
+	return tdObject(fields)
+}
+
+// notifyForms turns webhook and MQTT targets into event forms; email and
+// Telegram have no WoT binding and are left out.
+func (d *ModbusDriver) notifyForms(targets []notifyTarget) []tdMap {
+	var forms []tdMap
+	seen := map[string]bool{}
+	for _, t := range targets {
+		var f tdMap
+		switch t.Kind {
+		case "webhook":
+			// The driver POSTs each event to the target, which is set in
+			// its configuration rather than by subscribing.
+			f = tdMap{"href": t.Target, "op": "subscribeevent", "subprotocol": "webhook", "htv:methodName": "POST", "contentType": "application/json"}
+		case "mqtt":
+			u, err := url.Parse(d.cfg.MQTTBroker)
+			if err != nil || d.cfg.MQTTBroker == "" {
+				continue
+			}
+			scheme := "mqtt"
+			if u.Scheme == "ssl" || u.Scheme == "tls" || u.Scheme == "mqtts" {
+				scheme = "mqtts"
+			}
+			f = tdMap{"href": scheme + "://" + u.Host + "/" + strings.TrimPrefix(t.Target, "/"), "op": "subscribeevent", "contentType": "application/json"}
+		default:
+			continue
+		}
+		if key := f["href"].(string); !seen[key] {
+			seen[key] = true
+			forms = append(forms, f)
+		}
+	}
+	return forms
+}
+
+func (d *ModbusDriver) thingDescription(r *http.Request) tdMap {
+	host, _ := os.Hostname()
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	td := tdMap{
+		"@context":    []interface{}{"https://www.w3.org/2022/wot/td/v1.1", tdMap{"htv": "http://www.w3.org/2011/http#"}},
+		"@type":       "Thing",
+		"id":          "urn:modbus-display:" + host + ":" + strconv.Itoa(d.cfg.SlaveId),
+		"title":       "modbus-display-" + strconv.Itoa(d.cfg.SlaveId),
+		"description": "Modbus RTU 7-segment display, slave " + strconv.Itoa(d.cfg.SlaveId) + " on " + d.cfg.SerialPort,
+		"version":     tdMap{"instance": version},
+		"base":        scheme + "://" + r.Host + d.cfg.HTTPBasePath + "/",
+	}
+	if len(d.cfg.TenantKeys) > 0 || d.jwt != nil {
+		td["securityDefinitions"] = tdMap{"bearer_sc": tdMap{"scheme": "bearer", "in": "header", "name": "Authorization"}}
+		td["security"] = "bearer_sc"
+	} else {
+		td["securityDefinitions"] = tdMap{"nosec_sc": tdMap{"scheme": "nosec"}}
+		td["security"] = "nosec_sc"
+	}
+
+	status := d.statusSchema()
+	status["title"], status["readOnly"], status["observable"] = "Device status", true, true
+	status["forms"] = []tdMap{tdForm("status", "readproperty", ""), tdSSEForm("status/stream", "observeproperty")}
+	props := tdMap{
+		"status": status,
+		"display_value": tdSetting("Display value", "display/value", tdObject(tdMap{
+			"display_value": tdMap{"type": "string"},
+			"persist":       tdMap{"type": "boolean", "writeOnly": true, "description": "keep the value across device restarts (DESIRED_VALUE_FILE); default true"},
+		}, "display_value")),
+		"display_value_raw": tdSetting("Display value registers", "display/value/raw", tdObject(tdMap{
+			"hex":   tdMap{"type": "string", "description": "one byte per digit"},
+			"words": tdMap{"type": "array", "items": tdUint16()},
+		})),
+		"display_config": tdSetting("Display configuration", "display/config", tdObject(tdMap{
+			"value_type": tdUint16(), "decimals": tdUint16(), "work_mode": tdUint16(),
+		})),
+		"blink_period": tdSetting("Blink period", "blink/period", tdObject(tdMap{
+			"blink_period_ms": tdUint16(),
+		})),
+		"comm_config": tdSetting("Device communication settings", "comm/config", tdObject(tdMap{
+			"device_address": tdMap{"type": "integer", "minimum": 1, "maximum": 247},
+			"baud_rate":      tdMap{"type": "integer"},
+			"comm_format":    tdMap{"type": "string", "description": "data bits, parity and stop bits, e.g. 8N1"},
+		})),
+		"alarms": tdMap{"title": "Alarm rule states", "type": "array", "items": tdMap{"type": "object"}, "readOnly": true,
+			"forms": []tdMap{tdForm("alarms", "readproperty", "")}},
+	}
+	if len(d.cfg.SensorChannels) > 0 {
+		props["sensors"] = tdMap{"title": "Sensor readings", "type": "object", "readOnly": true,
+			"forms": []tdMap{tdForm("sensors", "readproperty", "")}}
+	}
+	if len(d.cfg.ClockLayout) > 0 {
+		props["clock"] = tdMap{"title": "Device clock", "type": "object", "readOnly": true,
+			"forms": []tdMap{tdForm("clock", "readproperty", "")}}
+	}
+	if len(d.cfg.IdentityRegs) > 0 {
+		props["info"] = tdMap{"title": "Device identity", "type": "object", "readOnly": true,
+			"forms": []tdMap{tdForm("info", "readproperty", "")}}
+	}
+	td["properties"] = props
+
+	actions := tdMap{
+		"write_registers": tdMap{
+			"title":        "Write holding registers",
+			"uriVariables": tdMap{"addr": tdUint16()},
+			"input":        tdObject(tdMap{"values": tdMap{"type": "array", "items": tdUint16(), "minItems": 1, "maxItems": maxWriteRegisters}}, "values"),
+			"forms":        []tdMap{tdForm("registers/{addr}", "invokeaction", "PUT")},
+		},
+		"set_device_values": tdMap{
+			"title": "Write display values to several slaves",
+			"input": tdObject(tdMap{
+				"values":        tdMap{"type": "object", "description": "slave id -> display value"},
+				"display_value": tdMap{"type": "string"},
+				"slave_ids":     tdMap{"type": "array", "items": tdMap{"type": "integer"}},
+			}),
+			"forms": []tdMap{tdForm("devices/value", "invokeaction", "PUT")},
+		},
+		"clear_external_changes": tdMap{
+			"title": "Clear the external change marks in the status",
+			"forms": []tdMap{tdForm("status/external_changes", "invokeaction", "DELETE")},
+		},
+		"queue_command": tdMap{
+			"title":  "Queue a write and return at once",
+			"input":  tdObject(tdMap{"path": tdMap{"type": "string"}, "body": tdMap{"type": "object"}}, "path"),
+			"output": tdObject(tdMap{"id": tdMap{"type": "string"}, "status": tdMap{"type": "string"}}),
+			"forms":  []tdMap{tdForm("commands", "invokeaction", "")},
+		},
+	}
+	if d.blinker == nil {
+		actions["echo_test"] = tdMap{
+			"title":  "Write a token to the display, read it back and time it",
+			"input":  tdObject(tdMap{"attempts": tdMap{"type": "integer", "minimum": 1, "maximum": maxEchoAttempts}, "token": tdMap{"type": "string"}}),
+			"output": tdObject(tdMap{"ok": tdMap{"type": "boolean"}, "total_ms": tdMap{"type": "number"}, "retries": tdMap{"type": "integer"}}),
+			"forms":  []tdMap{tdForm("display/value/echo-test", "invokeaction", "")},
+		}
+	}
+	if len(d.cfg.ClockLayout) > 0 {
+		actions["sync_clock"] = tdMap{"title": "Set the device clock to the host time", "forms": []tdMap{tdForm("clock/sync", "invokeaction", "")}}
+	}
+	td["actions"] = actions
+
+	events := tdMap{
+		"status": tdMap{"title": "Status changed", "data": d.statusSchema(),
+			"forms": []tdMap{tdSSEForm("status/stream", "subscribeevent")}},
+		"log": tdMap{"title": "Driver log line",
+			"data":  tdObject(tdMap{"time": tdMap{"type": "string"}, "level": tdMap{"type": "string", "enum": []string{"info", "warn", "error"}}, "message": tdMap{"type": "string"}}),
+			"forms": []tdMap{tdSSEForm("logs/stream", "subscribeevent")}},
+	}
+	if forms := d.notifyForms(d.alarms.targets()); len(forms) > 0 {
+		events["alarm"] = tdMap{"title": "Alarm raised or cleared",
+			"data": tdObject(tdMap{"rule": tdMap{"type": "string"}, "field": tdMap{"type": "string"},
+				"event": tdMap{"type": "string", "enum": []string{"raised", "cleared"}}, "value": tdMap{}, "timestamp": tdMap{"type": "string"}}),
+			"forms": forms}
+	}
+	if forms := d.notifyForms(d.cfg.ExternalChangeNotify); len(forms) > 0 {
+		events["external_change"] = tdMap{"title": "Device changed by someone else",
+			"data": tdObject(tdMap{"event": tdMap{"type": "string", "const": "external_change"}, "slave_id": tdMap{"type": "integer"},
+				"field": tdMap{"type": "string"}, "from": tdMap{}, "to": tdMap{}, "timestamp": tdMap{"type": "string"}}),
+			"forms": forms}
+	}
+	td["events"] = events
+	return td
+}
+
+func (d *ModbusDriver) handleThingDescription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/td+json")
+	_ = json.NewEncoder(w).Encode(d.thingDescription(r))
+}
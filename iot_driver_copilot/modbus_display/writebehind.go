@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// displayBatcher is the write-behind mode of PUT /display/value, enabled by
+// DISPLAY_WRITE_INTERVAL_MS. Requests only replace the pending value; the
+// write loop puts the latest one on the bus at most once per interval, so a
+// source pushing every 100ms costs one multi-register write per interval
+// instead of one per request.
+type displayBatcher struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	value   string
+	persist bool
+	pending bool
+	wake    chan struct{}
+
+	superseded atomic.Uint64 // values replaced before they were written
+}
+
+func newDisplayBatcher(interval time.Duration) *displayBatcher {
+	return &displayBatcher{interval: interval, wake: make(chan struct{}, 1)}
+}
+
+// Queue makes v the next value to write, replacing any still pending.
+func (q *displayBatcher) Queue(v string, persist bool) {
+	q.mu.Lock()
+	if q.pending {
+		q.superseded.Add(1)
+	}
+	q.value, q.persist, q.pending = v, persist, true
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *displayBatcher) take() (string, bool, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	v, persist, ok := q.value, q.persist, q.pending
+	q.pending = false
+	return v, persist, ok
+}
+
+// requeue puts back a value whose write failed, unless a newer one arrived.
+func (q *displayBatcher) requeue(v string, persist bool) {
+	q.mu.Lock()
+	if !q.pending {
+		q.value, q.persist, q.pending = v, persist, true
+	}
+	q.mu.Unlock()
+}
+
+func (d *ModbusDriver) displayWriteLoop(ctx context.Context) {
+	q := d.batcher
+	for {
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+			return
+		}
+		v, persist, ok := q.take()
+		if !ok {
+			continue
+		}
+		if err := d.applyDisplayValue(v, persist); err != nil {
+			d.logger.Printf("write display_value failed: %v", err)
+			if !errors.Is(err, errReadOnly) && !errors.Is(err, errStandby) {
+				q.requeue(v, persist)
+			}
+		}
+		// Hold off for the interval; whatever arrives meanwhile is written
+		// right after it, latest value only.
+		select {
+		case <-time.After(q.interval):
+		case <-ctx.Done():
+			return
+		}
+		q.mu.Lock()
+		again := q.pending
+		q.mu.Unlock()
+		if again {
+			select {
+			case q.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
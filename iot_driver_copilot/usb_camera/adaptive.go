@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// --- ADAPTIVE STREAM QUALITY ---
+// Every stream (/stream, /video/stream, /stream/ws) sends the newest frame
+// once the previous one is written, so a viewer on a slow link silently
+// skips frames. The time each write blocks, against the capture's frame
+// interval, tells how many were skipped: a write that took three frame
+// intervals cost the viewer two frames. With STREAM_ADAPTIVE on (the
+// default) a stream that skipped more than a third of its frames over a
+// STREAM_ADAPTIVE_WINDOW_MS window steps down one quality tier, re-encoding
+// its frames smaller; one that skipped almost none for
+// STREAM_ADAPTIVE_RECOVER_MS steps back up. Tier 0 is the frame as
+// captured. GET /streams lists the open streams with their counts and tier.
+// Multipart parts after a change carry "X-Stream-Event: quality-changed",
+// "X-Stream-Quality: N" and "X-Frame-Size"; WebSocket viewers get a
+// {"type": "quality_changed"} message.
+
+type AdaptiveConfig struct {
+	Enabled bool          // STREAM_ADAPTIVE
+	Window  time.Duration // STREAM_ADAPTIVE_WINDOW_MS: how long skipping is measured before stepping down
+	Recover time.Duration // STREAM_ADAPTIVE_RECOVER_MS: how long a stream must keep up before stepping up
+}
+
+var adaptiveConfig = AdaptiveConfig{Enabled: true, Window: 2 * time.Second, Recover: 10 * time.Second}
+
+// qualityTier is a reduced encoding; tier 0 (not listed) is the frame as
+// captured.
+type qualityTier struct {
+	Quality int // JPEG quality
+	Scale   int // width and height are divided by this
+}
+
+var qualityTiers = []qualityTier{1: {Quality: 70, Scale: 1}, 2: {Quality: 50, Scale: 2}, 3: {Quality: 35, Scale: 4}}
+
+const (
+	stepDownSkipRate = 1.0 / 3
+	stepUpSkipRate   = 0.05
+)
+
+func loadAdaptiveConfig() error {
+	adaptiveConfig = AdaptiveConfig{Enabled: true, Window: 2 * time.Second, Recover: 10 * time.Second}
+	if v := os.Getenv("STREAM_ADAPTIVE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("STREAM_ADAPTIVE must be true or false")
+		}
+		adaptiveConfig.Enabled = b
+	}
+	for _, s := range []struct {
+		name string
+		dst  *time.Duration
+	}{{"STREAM_ADAPTIVE_WINDOW_MS", &adaptiveConfig.Window}, {"STREAM_ADAPTIVE_RECOVER_MS", &adaptiveConfig.Recover}} {
+		if v := os.Getenv(s.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 100 || n > 600000 {
+				return fmt.Errorf("%s must be between 100 and 600000", s.name)
+			}
+			*s.dst = time.Duration(n) * time.Millisecond
+		}
+	}
+	return nil
+}
+
+// streamClient tracks one open stream.
+type streamClient struct {
+	id        uint64
+	client    string
+	transport string // "multipart" or "websocket"
+	remote    string
+	started   time.Time
+	interval  time.Duration // the capture's frame interval
+
+	mu          sync.Mutex
+	tier        int
+	announce    bool // the next frame is the first at a new tier
+	sent        uint64
+	skipped     uint64
+	winStart    time.Time
+	winSent     uint64
+	winSkipped  uint64
+	calmSince   time.Time // since when the stream has kept up; zero while it skips
+	width       int       // of the last frame sent
+	height      int
+	tierChanges uint64
+}
+
+type streamRegistry struct {
+	mu      sync.Mutex
+	next    uint64
+	streams map[uint64]*streamClient
+}
+
+var openStreams = &streamRegistry{streams: map[uint64]*streamClient{}}
+
+// openStreamClient registers a stream for r. The caller must close it.
+func openStreamClient(r *http.Request, transport string) *streamClient {
+	cameraState.mu.Lock()
+	fps := cameraState.fps
+	cameraState.mu.Unlock()
+	if fps == 0 {
+		fps = 30
+	}
+	now := time.Now()
+	s := &streamClient{client: clientIDFromRequest(r), transport: transport, remote: r.RemoteAddr, started: now,
+		interval: time.Second / time.Duration(fps), winStart: now, calmSince: now}
+	openStreams.mu.Lock()
+	openStreams.next++
+	s.id = openStreams.next
+	openStreams.streams[s.id] = s
+	openStreams.mu.Unlock()
+	return s
+}
+
+func (s *streamClient) close() {
+	openStreams.mu.Lock()
+	delete(openStreams.streams, s.id)
+	openStreams.mu.Unlock()
+}
+
+// prepare returns jpg encoded for the stream's tier, with its size, and
+// whether it is the first frame at a tier the viewer has not been told of.
+func (s *streamClient) prepare(jpg []byte, width, height int) ([]byte, int, int, bool, error) {
+	s.mu.Lock()
+	tier, announce := s.tier, s.announce
+	s.mu.Unlock()
+	if tier > 0 {
+		var err error
+		if jpg, width, height, err = transcodeTier(jpg, tier); err != nil {
+			return nil, 0, 0, false, err
+		}
+	}
+	s.mu.Lock()
+	s.width, s.height, s.announce = width, height, false
+	s.mu.Unlock()
+	return jpg, width, height, announce, nil
+}
+
+// wrote records a frame whose write blocked for took, and moves the tier
+// when a window is complete.
+func (s *streamClient) wrote(took time.Duration, now time.Time) {
+	skipped := uint64(0)
+	if n := uint64(took / s.interval); n > 1 {
+		skipped = n - 1 // n frames came in; the next write sends the newest
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	s.skipped += skipped
+	s.winSent++
+	s.winSkipped += skipped
+	if !adaptiveConfig.Enabled || now.Sub(s.winStart) < adaptiveConfig.Window {
+		return
+	}
+	rate := float64(s.winSkipped) / float64(s.winSent+s.winSkipped)
+	s.winStart, s.winSent, s.winSkipped = now, 0, 0
+	switch {
+	case rate > stepDownSkipRate:
+		s.calmSince = time.Time{}
+		if s.tier < len(qualityTiers)-1 {
+			s.tier++
+			s.announce = true
+			s.tierChanges++
+		}
+	case rate > stepUpSkipRate:
+		s.calmSince = time.Time{}
+	case s.calmSince.IsZero():
+		s.calmSince = now
+	case s.tier > 0 && now.Sub(s.calmSince) >= adaptiveConfig.Recover:
+		s.tier--
+		s.announce = true
+		s.tierChanges++
+		s.calmSince = now
+	}
+}
+
+func (s *streamClient) currentTier() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tier
+}
+
+// qualityHeaders are the extra part headers for a frame at a new tier.
+func (s *streamClient) qualityHeaders(width, height int) []string {
+	return []string{"X-Stream-Event: quality-changed", "X-Stream-Quality: " + strconv.Itoa(s.currentTier()), fmt.Sprintf("X-Frame-Size: %dx%d", width, height)}
+}
+
+type streamStats struct {
+	ID          uint64  `json:"id"`
+	Client      string  `json:"client,omitempty"`
+	Transport   string  `json:"transport"`
+	Remote      string  `json:"remote"`
+	Started     string  `json:"started"`
+	FramesSent  uint64  `json:"frames_sent"`
+	FramesSkip  uint64  `json:"frames_skipped"`
+	SkipRate    float64 `json:"skip_rate"`
+	Tier        int     `json:"quality_tier"`
+	Quality     int     `json:"jpeg_quality,omitempty"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	TierChanges uint64  `json:"tier_changes"`
+}
+
+func (s *streamClient) stats() streamStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := streamStats{ID: s.id, Client: s.client, Transport: s.transport, Remote: s.remote,
+		Started: s.started.UTC().Format(time.RFC3339), FramesSent: s.sent, FramesSkip: s.skipped,
+		Tier: s.tier, Width: s.width, Height: s.height, TierChanges: s.tierChanges}
+	if total := s.sent + s.skipped; total > 0 {
+		st.SkipRate = float64(s.skipped) / float64(total)
+	}
+	if s.tier > 0 {
+		st.Quality = qualityTiers[s.tier].Quality
+	}
+	return st
+}
+
+// transcodeTier re-encodes jpg at tier's quality and size. Viewers at the
+// same tier share the result through the frame cache.
+func transcodeTier(jpg []byte, tier int) ([]byte, int, int, error) {
+	t := qualityTiers[tier]
+	mark := "tier" + strconv.Itoa(tier)
+	key := frameCache.key(jpg, "JPEG", 0, 0, mark)
+	if encoderConfig.Dedup {
+		if out := frameCache.get(key); out != nil {
+			cfg, err := jpeg.DecodeConfig(bytes.NewReader(out))
+			return out, cfg.Width, cfg.Height, err
+		}
+	}
+	img, err := jpeg.Decode(bytes.NewReader(withDefaultHuffman(jpg)))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	b := img.Bounds()
+	w, h := b.Dx()/t.Scale, b.Dy()/t.Scale
+	if t.Scale > 1 && w > 0 && h > 0 {
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+		img = dst
+	} else {
+		w, h = b.Dx(), b.Dy()
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: t.Quality}); err != nil {
+		return nil, 0, 0, err
+	}
+	if encoderConfig.Dedup {
+		frameCache.put(key, buf.Bytes())
+	}
+	return buf.Bytes(), w, h, nil
+}
+
+func handleStreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	openStreams.mu.Lock()
+	list := make([]streamStats, 0, len(openStreams.streams))
+	for _, s := range openStreams.streams {
+		list = append(list, s.stats())
+	}
+	openStreams.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"adaptive": adaptiveConfig.Enabled, "streams": list})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStreamClientTiers(t *testing.T) {
+	saved := adaptiveConfig
+	defer func() { adaptiveConfig = saved }()
+	adaptiveConfig = AdaptiveConfig{Enabled: true, Window: time.Second, Recover: 3 * time.Second}
+
+	r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	sc := openStreamClient(r, "multipart")
+	defer sc.close()
+	sc.interval = 100 * time.Millisecond
+	now := sc.started
+
+	// Every write blocks for three frame intervals: two of three frames
+	// are skipped, and each window steps down until the lowest tier.
+	for i := 1; i <= len(qualityTiers); i++ {
+		for n := 0; n < 4; n++ {
+			now = now.Add(300 * time.Millisecond)
+			sc.wrote(300*time.Millisecond, now)
+		}
+		if want := i; want > len(qualityTiers)-1 {
+			if sc.currentTier() != len(qualityTiers)-1 {
+				t.Fatalf("window %d: tier %d, want it to stay at %d", i, sc.currentTier(), len(qualityTiers)-1)
+			}
+		} else if sc.currentTier() != want {
+			t.Fatalf("window %d: tier %d, want %d", i, sc.currentTier(), want)
+		}
+	}
+	if st := sc.stats(); st.FramesSkip != 2*st.FramesSent || st.TierChanges != uint64(len(qualityTiers)-1) {
+		t.Errorf("stats = %+v", st)
+	}
+
+	// Keeping up: the first calm window starts the recovery clock, and the
+	// tier rises once it has run for Recover.
+	sc.prepare(nil, 0, 0) // consume the announcement
+	tier := sc.currentTier()
+	for sc.currentTier() == tier {
+		now = now.Add(50 * time.Millisecond)
+		sc.wrote(10*time.Millisecond, now)
+		if now.Sub(sc.started) > time.Minute {
+			t.Fatal("tier never rose")
+		}
+	}
+	if sc.currentTier() != tier-1 || !sc.announce {
+		t.Errorf("tier %d announce %v after recovering from %d", sc.currentTier(), sc.announce, tier)
+	}
+
+	adaptiveConfig.Enabled = false
+	for n := 0; n < 20; n++ {
+		now = now.Add(500 * time.Millisecond)
+		sc.wrote(500*time.Millisecond, now)
+	}
+	if sc.currentTier() != tier-1 {
+		t.Errorf("tier moved to %d with STREAM_ADAPTIVE=false", sc.currentTier())
+	}
+}
+
+func TestTranscodeTier(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 48)), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	for tier, want := range map[int]int{1: 64, 2: 32, 3: 16} {
+		out, w, h, err := transcodeTier(buf.Bytes(), tier)
+		if err != nil {
+			t.Fatalf("tier %d: %v", tier, err)
+		}
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(out))
+		if err != nil || cfg.Width != want || w != want || h != want*48/64 {
+			t.Errorf("tier %d: %dx%d (reported %dx%d), want width %d: %v", tier, cfg.Width, cfg.Height, w, h, want, err)
+		}
+	}
+}
+
+func TestHandleStreams(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/stream/ws", nil)
+	r.RemoteAddr = "192.0.2.7:5000"
+	sc := openStreamClient(r, "websocket")
+	defer sc.close()
+	sc.wrote(0, time.Now())
+
+	rec := httptest.NewRecorder()
+	handleStreams(rec, httptest.NewRequest(http.MethodGet, "/streams", nil))
+	var reply struct {
+		Adaptive bool          `json:"adaptive"`
+		Streams  []streamStats `json:"streams"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &reply) != nil {
+		t.Fatalf("GET /streams = %d %s", rec.Code, rec.Body)
+	}
+	found := false
+	for _, st := range reply.Streams {
+		if st.ID == sc.id {
+			found = st.Transport == "websocket" && st.Remote == "192.0.2.7:5000" && st.FramesSent == 1 && st.Tier == 0
+		}
+	}
+	if !found {
+		t.Errorf("stream %d missing or wrong in %s", sc.id, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	handleStreams(rec, httptest.NewRequest(http.MethodPost, "/streams", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /streams = %d", rec.Code)
+	}
+}
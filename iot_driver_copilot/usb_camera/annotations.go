@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// --- ANNOTATIONS ---
+// A remote supervisor can point something out to whoever watches the same
+// stream on site:
+//
+//	POST /annotations {"shape": "box", "x": 0.4, "y": 0.3, "width": 0.2, "height": 0.25, "text": "this valve", "seconds": 30}
+//	POST /annotations {"shape": "arrow", "x": 0.1, "y": 0.9, "x2": 0.38, "y2": 0.45, "color": "yellow"}
+//	POST /annotations {"shape": "text", "x": 0.02, "y": 0.02, "text": "stop the line"}
+//	GET /annotations, DELETE /annotations[?id=3]
+//
+// Coordinates are fractions of the frame, from the top-left corner, so
+// markers stay put across a reconfigure. Each one lasts "seconds" (default
+// 10, at most 600) and is drawn into the captured frames themselves, so
+// every stream, snapshot and clip shows it. While none is active frames pass
+// through untouched; while some are, MJPEG frames are decoded and encoded
+// again at JPEG_QUALITY.
+
+const (
+	defaultAnnotationSeconds = 10
+	maxAnnotationSeconds     = 600
+	maxAnnotations           = 32
+	maxAnnotationText        = 100
+)
+
+var annotationColors = map[string]color.RGBA{
+	"red": {255, 0, 0, 255}, "green": {0, 200, 0, 255}, "blue": {40, 80, 255, 255},
+	"yellow": {255, 220, 0, 255}, "orange": {255, 140, 0, 255}, "cyan": {0, 220, 220, 255},
+	"magenta": {255, 0, 255, 255}, "white": {255, 255, 255, 255}, "black": {0, 0, 0, 255},
+}
+
+type annotation struct {
+	ID      uint64    `json:"id"`
+	Shape   string    `json:"shape"`
+	X       float64   `json:"x"`
+	Y       float64   `json:"y"`
+	Width   float64   `json:"width,omitempty"`
+	Height  float64   `json:"height,omitempty"`
+	X2      float64   `json:"x2,omitempty"`
+	Y2      float64   `json:"y2,omitempty"`
+	Text    string    `json:"text,omitempty"`
+	Color   string    `json:"color"`
+	Client  string    `json:"client,omitempty"`
+	Expires time.Time `json:"expires"`
+	rgba    color.RGBA
+}
+
+type annotationRequest struct {
+	Shape   string   `json:"shape"`
+	X       float64  `json:"x"`
+	Y       float64  `json:"y"`
+	Width   float64  `json:"width"`
+	Height  float64  `json:"height"`
+	X2      *float64 `json:"x2"`
+	Y2      *float64 `json:"y2"`
+	Text    string   `json:"text"`
+	Color   string   `json:"color"`
+	Seconds int      `json:"seconds"`
+}
+
+func inFrame(v float64) bool { return v >= 0 && v <= 1 }
+
+func parseAnnotationColor(s string) (color.RGBA, error) {
+	if c, ok := annotationColors[strings.ToLower(s)]; ok {
+		return c, nil
+	}
+	if len(s) == 7 && s[0] == '#' {
+		if v, err := strconv.ParseUint(s[1:], 16, 32); err == nil {
+			return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+		}
+	}
+	return color.RGBA{}, fmt.Errorf("unknown color %q (a name such as red or yellow, or #rrggbb)", s)
+}
+
+func (req annotationRequest) annotation(now time.Time) (annotation, error) {
+	a := annotation{Shape: req.Shape, X: req.X, Y: req.Y, Text: req.Text, Color: req.Color}
+	if !inFrame(req.X) || !inFrame(req.Y) {
+		return a, errors.New("x and y must be between 0 and 1")
+	}
+	switch req.Shape {
+	case "box":
+		if req.Width <= 0 || req.Height <= 0 || !inFrame(req.X+req.Width) || !inFrame(req.Y+req.Height) {
+			return a, errors.New("a box needs a width and height that keep it inside the frame")
+		}
+		a.Width, a.Height = req.Width, req.Height
+	case "arrow":
+		if req.X2 == nil || req.Y2 == nil || !inFrame(*req.X2) || !inFrame(*req.Y2) {
+			return a, errors.New("an arrow needs x2 and y2, its tip, between 0 and 1")
+		}
+		a.X2, a.Y2 = *req.X2, *req.Y2
+	case "text":
+		if req.Text == "" {
+			return a, errors.New("a text annotation needs text")
+		}
+	default:
+		return a, errors.New("shape must be box, arrow or text")
+	}
+	if len(req.Text) > maxAnnotationText {
+		return a, fmt.Errorf("text is limited to %d bytes", maxAnnotationText)
+	}
+	if a.Color == "" {
+		a.Color = "red"
+	}
+	var err error
+	if a.rgba, err = parseAnnotationColor(a.Color); err != nil {
+		return a, err
+	}
+	seconds := req.Seconds
+	if seconds == 0 {
+		seconds = defaultAnnotationSeconds
+	}
+	if seconds < 1 || seconds > maxAnnotationSeconds {
+		return a, fmt.Errorf("seconds must be between 1 and %d", maxAnnotationSeconds)
+	}
+	a.Expires = now.Add(time.Duration(seconds) * time.Second)
+	return a, nil
+}
+
+// annotationSet holds the markers being drawn, oldest first.
+type annotationSet struct {
+	mu     sync.Mutex
+	list   []annotation
+	nextID uint64
+}
+
+var annotations = &annotationSet{}
+
+var errTooManyAnnotations = fmt.Errorf("at most %d annotations can be shown at once", maxAnnotations)
+
+func (s *annotationSet) add(a annotation, now time.Time) (annotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(now)
+	if len(s.list) >= maxAnnotations {
+		return a, errTooManyAnnotations
+	}
+	s.nextID++
+	a.ID = s.nextID
+	s.list = append(s.list, a)
+	return a, nil
+}
+
+// active returns the markers that have not expired at now.
+func (s *annotationSet) active(now time.Time) []annotation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked(now)
+	if len(s.list) == 0 {
+		return nil
+	}
+	return append([]annotation(nil), s.list...)
+}
+
+func (s *annotationSet) pruneLocked(now time.Time) {
+	kept := s.list[:0]
+	for _, a := range s.list {
+		if now.Before(a.Expires) {
+			kept = append(kept, a)
+		}
+	}
+	s.list = kept
+}
+
+// remove deletes one marker, or all of them for id 0, and reports how many went.
+func (s *annotationSet) remove(id uint64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.list[:0]
+	for _, a := range s.list {
+		if id != 0 && a.ID != id {
+			kept = append(kept, a)
+		}
+	}
+	n := len(s.list) - len(kept)
+	s.list = kept
+	return n
+}
+
+// --- drawing ---
+
+// drawAnnotations paints the markers onto img in place.
+func drawAnnotations(img *image.RGBA, list []annotation) {
+	b := img.Bounds()
+	thick := b.Dy() / 160
+	if thick < 2 {
+		thick = 2
+	}
+	at := func(fx, fy float64) image.Point {
+		return image.Pt(b.Min.X+int(fx*float64(b.Dx()-1)+0.5), b.Min.Y+int(fy*float64(b.Dy()-1)+0.5))
+	}
+	for _, a := range list {
+		c := image.NewUniform(a.rgba)
+		p := at(a.X, a.Y)
+		switch a.Shape {
+		case "box":
+			q := at(a.X+a.Width, a.Y+a.Height)
+			for _, r := range []image.Rectangle{
+				image.Rect(p.X, p.Y, q.X+1, p.Y+thick), image.Rect(p.X, q.Y+1-thick, q.X+1, q.Y+1),
+				image.Rect(p.X, p.Y, p.X+thick, q.Y+1), image.Rect(q.X+1-thick, p.Y, q.X+1, q.Y+1),
+			} {
+				draw.Draw(img, r.Intersect(b), c, image.Point{}, draw.Src)
+			}
+			if a.Text != "" {
+				drawAnnotationLabel(img, image.Pt(p.X, p.Y-annotationLabelHeight()), a.Text, a.rgba)
+			}
+		case "arrow":
+			tip := at(a.X2, a.Y2)
+			drawThickLine(img, p, tip, thick, c)
+			// Two barbs at ±25° off the shaft, a quarter of its length (8-40 px).
+			dx, dy := float64(p.X-tip.X), float64(p.Y-tip.Y)
+			length := math.Hypot(dx, dy)
+			barb := math.Max(8, math.Min(40, length/4))
+			if length > 0 {
+				for _, turn := range []float64{-25, 25} {
+					ang := math.Atan2(dy, dx) + turn*math.Pi/180
+					end := image.Pt(tip.X+int(barb*math.Cos(ang)), tip.Y+int(barb*math.Sin(ang)))
+					drawThickLine(img, tip, end, thick, c)
+				}
+			}
+			if a.Text != "" {
+				drawAnnotationLabel(img, p, a.Text, a.rgba)
+			}
+		case "text":
+			drawAnnotationLabel(img, p, a.Text, a.rgba)
+		}
+	}
+}
+
+func drawThickLine(img *image.RGBA, from, to image.Point, thick int, c image.Image) {
+	steps := int(math.Max(math.Abs(float64(to.X-from.X)), math.Abs(float64(to.Y-from.Y))))
+	for i := 0; i <= steps; i++ {
+		t := 0.0
+		if steps > 0 {
+			t = float64(i) / float64(steps)
+		}
+		x := from.X + int(math.Round(t*float64(to.X-from.X)))
+		y := from.Y + int(math.Round(t*float64(to.Y-from.Y)))
+		r := image.Rect(x-thick/2, y-thick/2, x-thick/2+thick, y-thick/2+thick)
+		draw.Draw(img, r.Intersect(img.Bounds()), c, image.Point{}, draw.Src)
+	}
+}
+
+func annotationLabelHeight() int {
+	m := basicfont.Face7x13.Metrics()
+	return (m.Ascent + m.Descent).Ceil() + 4
+}
+
+// drawAnnotationLabel writes text in c on a black box whose top-left corner
+// is at p, moved as needed to keep it inside the frame.
+func drawAnnotationLabel(img *image.RGBA, p image.Point, text string, c color.RGBA) {
+	face := basicfont.Face7x13
+	b := img.Bounds()
+	box := image.Rect(0, 0, font.MeasureString(face, text).Ceil()+4, annotationLabelHeight())
+	if p.X+box.Dx() > b.Max.X {
+		p.X = b.Max.X - box.Dx()
+	}
+	if p.Y+box.Dy() > b.Max.Y {
+		p.Y = b.Max.Y - box.Dy()
+	}
+	if p.X < b.Min.X {
+		p.X = b.Min.X
+	}
+	if p.Y < b.Min.Y {
+		p.Y = b.Min.Y
+	}
+	box = box.Add(p)
+	draw.Draw(img, box.Intersect(b), image.Black, image.Point{}, draw.Src)
+	d := &font.Drawer{Dst: img, Src: image.NewUniform(c), Face: face, Dot: fixed.P(box.Min.X+2, box.Min.Y+2+face.Metrics().Ascent.Ceil())}
+	d.DrawString(text)
+}
+
+// annotateFrame draws list onto a frame in its capture format.
+func annotateFrame(frame []byte, info sourceInfo, list []annotation) ([]byte, error) {
+	if info.Format == "YUYV" {
+		img := yuyvToImage(frame, int(info.Width), int(info.Height)).(*image.RGBA)
+		drawAnnotations(img, list)
+		return imageToYUYV(img), nil
+	}
+	src, err := jpeg.Decode(bytes.NewReader(withDefaultHuffman(frame)))
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+	drawAnnotations(img, list)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: encoderConfig.Quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// annotateSource draws the active annotations into a backend's frames. A
+// frame that can't be annotated is passed on as it is: unlike a lens
+// correction, a missing marker doesn't make the picture wrong.
+type annotateSource struct {
+	FrameSource
+	info sourceInfo
+}
+
+func (s *annotateSource) ReadFrame() ([]byte, error) {
+	frame, err := s.FrameSource.ReadFrame()
+	if len(frame) == 0 {
+		return frame, err
+	}
+	list := annotations.active(time.Now())
+	if len(list) == 0 {
+		return frame, err
+	}
+	if out, aerr := annotateFrame(frame, s.info, list); aerr == nil {
+		carryFrameTime(frame, out)
+		releaseFrame(frame)
+		return out, err
+	}
+	return frame, err
+}
+
+func handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req annotationRequest
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+		a, err := req.annotation(now)
+		if err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		a.Client = clientIDFromRequest(r)
+		if a, err = annotations.add(a, now); err != nil {
+			jsonResponse(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		recordEvent("annotation_added", a.Client, map[string]interface{}{"id": a.ID, "shape": a.Shape, "text": a.Text})
+		jsonResponse(w, http.StatusCreated, a)
+		return
+	case http.MethodDelete:
+		var id uint64
+		if v := r.URL.Query().Get("id"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil || n == 0 {
+				jsonResponse(w, http.StatusBadRequest, map[string]string{"error": "id must be a positive integer"})
+				return
+			}
+			id = n
+		}
+		n := annotations.remove(id)
+		if id != 0 && n == 0 {
+			jsonResponse(w, http.StatusNotFound, map[string]string{"error": "no such annotation"})
+			return
+		}
+		recordEvent("annotations_cleared", clientIDFromRequest(r), map[string]interface{}{"count": n})
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := annotations.active(now)
+	if list == nil {
+		list = []annotation{}
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"annotations": list})
+}
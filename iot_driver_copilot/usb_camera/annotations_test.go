@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnotations(t *testing.T) {
+	savedCam := cameraConfig
+	defer func() { closeCamera(); cameraConfig = savedCam; annotations.remove(0) }()
+	cameraConfig = CameraConfig{DevicePath: "/dev/video-missing", Simulate: true, Format: "YUYV", Width: 320, Height: 240, FPS: 30}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleAnnotations(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+	for _, body := range []string{
+		`{"shape": "circle", "x": 0.5, "y": 0.5}`,
+		`{"shape": "box", "x": 0.8, "y": 0.1, "width": 0.3, "height": 0.1}`,
+		`{"shape": "arrow", "x": 0.1, "y": 0.1}`,
+		`{"shape": "text", "x": 0.1, "y": 0.1}`,
+		`{"shape": "text", "x": 0.1, "y": 0.1, "text": "hi", "color": "chartreuse"}`,
+		`{"shape": "text", "x": 0.1, "y": 0.1, "text": "hi", "seconds": 3600}`,
+	} {
+		if rec := call(http.MethodPost, "/annotations", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("POST %s = %d", body, rec.Code)
+		}
+	}
+
+	rec := call(http.MethodPost, "/annotations", `{"shape": "box", "x": 0.25, "y": 0.25, "width": 0.5, "height": 0.5, "text": "here", "color": "#ff0000", "seconds": 30}`)
+	var box annotation
+	if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &box) != nil || box.ID == 0 {
+		t.Fatalf("POST box = %d %s", rec.Code, rec.Body)
+	}
+	if rec := call(http.MethodPost, "/annotations", `{"shape": "arrow", "x": 0.9, "y": 0.9, "x2": 0.76, "y2": 0.76, "color": "yellow"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("POST arrow = %d %s", rec.Code, rec.Body)
+	}
+	var list struct{ Annotations []annotation }
+	if rec := call(http.MethodGet, "/annotations", ""); json.Unmarshal(rec.Body.Bytes(), &list) != nil || len(list.Annotations) != 2 {
+		t.Fatalf("GET = %s", rec.Body)
+	}
+
+	// The box's left edge, at x=80, is red in the captured frame; the
+	// middle of the box is the test pattern.
+	cameraState.mu.Lock()
+	cam := cameraState.source
+	cameraState.mu.Unlock()
+	if err := cam.WaitForFrame(1); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := cam.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := yuyvToImage(frame, 320, 240).(*image.RGBA)
+	if c := img.RGBAAt(80, 150); c.R < 200 || c.G > 60 || c.B > 60 {
+		t.Errorf("box edge = %v, want red", c)
+	}
+
+	if rec := call(http.MethodDelete, "/annotations?id=99999", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE unknown id = %d", rec.Code)
+	}
+	if rec := call(http.MethodDelete, "/annotations?id="+strconv.FormatUint(box.ID, 10), ""); rec.Code != http.StatusOK || len(annotations.active(time.Now())) != 1 {
+		t.Errorf("DELETE the box = %d %s", rec.Code, rec.Body)
+	}
+	if got := annotations.active(time.Now().Add(time.Minute)); len(got) != 0 {
+		t.Errorf("%d annotations left after they expired", len(got))
+	}
+	if rec := call(http.MethodDelete, "/annotations", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"annotations":[]`) {
+		t.Errorf("DELETE = %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type ctxKey int
+
+const clientIDKey ctxKey = iota
+
+// apiKeys maps an API key to the client identifier it was issued to.
+var apiKeys = map[string]string{}
+
+// Tenancy: when several cameras and displays are run for different
+// contractors, CAMERA_TENANT names the tenant this camera belongs to and
+// API_KEY_TENANTS ("alice=line-a,bob=line-b") the tenant of each client.
+// A client of another tenant is refused everywhere, stream tokens included;
+// clients without a tenant (operators) reach every camera.
+var (
+	cameraTenant  string
+	clientTenants = map[string]string{}
+)
+
+// --- AUTH CONFIG ---
+// API_KEYS is a comma-separated list of client:key pairs, e.g. "alice:s3cret,bob:hunter2".
+// When unset, the driver accepts unauthenticated requests as before.
+// Static keys are the camera's only credential: JWT sign-on (JWT_JWKS_URL)
+// is the display driver's alone, so SSO users reach the camera through a
+// proxy that checks their token and presents a key.
+func loadAuthConfig() error {
+	raw := os.Getenv("API_KEYS")
+	if raw == "" {
+		return nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, key, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || key == "" {
+			log.Printf("ignoring malformed API_KEYS entry %q", pair)
+			continue
+		}
+		apiKeys[key] = id
+	}
+	return loadTenantConfig()
+}
+
+func loadTenantConfig() error {
+	cameraTenant = strings.TrimSpace(os.Getenv("CAMERA_TENANT"))
+	clientTenants = map[string]string{}
+	raw := os.Getenv("API_KEY_TENANTS")
+	if raw == "" && cameraTenant == "" {
+		return nil
+	}
+	if !authEnabled() {
+		return fmt.Errorf("CAMERA_TENANT and API_KEY_TENANTS need API_KEYS")
+	}
+	clients := map[string]bool{}
+	for _, id := range apiKeys {
+		clients[id] = true
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, tenant, ok := strings.Cut(pair, "=")
+		if !ok || tenant == "" {
+			return fmt.Errorf("malformed API_KEY_TENANTS entry %q (expected client=tenant)", pair)
+		}
+		if !clients[id] {
+			return fmt.Errorf("API_KEY_TENANTS: unknown client %q", id)
+		}
+		clientTenants[id] = tenant
+	}
+	return nil
+}
+
+// tenantAllowed reports whether client id may use this camera.
+func tenantAllowed(id string) bool {
+	t, scoped := clientTenants[id]
+	return !scoped || t == cameraTenant
+}
+
+func authEnabled() bool {
+	return len(apiKeys) > 0
+}
+
+// requestAPIKey extracts the presented key from the Authorization header,
+// the X-API-Key header, or the api_key query parameter (for <img> embedding).
+func requestAPIKey(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return k
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+func lookupClient(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	for k, id := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled() {
+			next(w, r)
+			return
+		}
+		key := requestAPIKey(r)
+		id, ok := lookupClient(key)
+		if !ok && key == "" && authExempt(r) {
+			id, ok = exemptClientID, true
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="camera"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !tenantAllowed(id) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), clientIDKey, id)))
+	}
+}
+
+// clientIDFromRequest returns the authenticated client identifier, or "" when
+// authentication is disabled.
+func clientIDFromRequest(r *http.Request) string {
+	id, _ := r.Context().Value(clientIDKey).(string)
+	return id
+}
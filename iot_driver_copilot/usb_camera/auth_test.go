@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCameraTenant(t *testing.T) {
+	savedKeys, savedTenants := apiKeys, clientTenants
+	t.Cleanup(func() {
+		apiKeys, clientTenants = savedKeys, savedTenants
+		cameraTenant = ""
+	})
+	apiKeys = map[string]string{"k-alice": "alice", "k-bob": "bob", "k-ops": "ops"}
+	t.Setenv("CAMERA_TENANT", "line-a")
+	t.Setenv("API_KEY_TENANTS", "alice=line-a, bob=line-b")
+	if err := loadTenantConfig(); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STREAM_TOKEN_SECRET", "0123456789abcdef0123")
+	if err := loadTokenConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(clientIDFromRequest(r))) }
+	for key, want := range map[string]int{"k-alice": 200, "k-ops": 200, "k-bob": 403, "nope": 401} {
+		req := httptest.NewRequest(http.MethodGet, "/snapshot", nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		requireAuth(ok)(rec, req)
+		if rec.Code != want {
+			t.Errorf("key %s: %d, want %d", key, rec.Code, want)
+		}
+	}
+
+	// A token minted while bob still had access stops working once his
+	// tenant no longer matches.
+	exp := time.Now().Add(time.Minute).Unix()
+	for client, want := range map[string]int{"alice": 200, "bob": 403} {
+		tok := mintToken(tokenClaims{Client: client, Path: "/stream", Expires: exp})
+		rec := httptest.NewRecorder()
+		tokenAuth(ok)(rec, httptest.NewRequest(http.MethodGet, "/stream?token="+url.QueryEscape(tok), nil))
+		if rec.Code != want {
+			t.Errorf("token for %s: %d, want %d", client, rec.Code, want)
+		}
+	}
+
+	t.Setenv("API_KEY_TENANTS", "carol=line-a")
+	if err := loadTenantConfig(); err == nil {
+		t.Error("tenant for an unknown client accepted")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --- LOCAL READERS ---
+// An on-box kiosk viewer should not need an API key, while remote clients
+// still do. With API_KEYS set, AUTH_EXEMPT_CIDRS (e.g. "127.0.0.1/32,::1")
+// lets requests from those addresses, and AUTH_EXEMPT_UNIX_SOCKET=true
+// requests over an HTTP_LISTEN=unix:// socket, read without a key: GET and
+// HEAD only, so streams, snapshots and status, never a change. They act as
+// the client "local". A request that presents a key is still identified
+// by it. Do not list the address a reverse proxy on the same machine
+// connects from, or every client it forwards is exempt.
+
+var (
+	authExemptNets []*net.IPNet
+	authExemptUnix bool
+)
+
+// exemptClientID is who an exempt request acts as, in events and
+// watermarks.
+const exemptClientID = "local"
+
+type unixConnKey struct{}
+
+func loadAuthExemptConfig() error {
+	authExemptNets, authExemptUnix = nil, false
+	for _, s := range strings.Split(os.Getenv("AUTH_EXEMPT_CIDRS"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("AUTH_EXEMPT_CIDRS: %q is not an address or CIDR range", s)
+		}
+		authExemptNets = append(authExemptNets, n)
+	}
+	if v := os.Getenv("AUTH_EXEMPT_UNIX_SOCKET"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("AUTH_EXEMPT_UNIX_SOCKET must be true or false")
+		}
+		authExemptUnix = b
+	}
+	return nil
+}
+
+// markUnixConn is the server's ConnContext: it notes connections accepted
+// on a Unix socket, whose requests carry no useful RemoteAddr.
+func markUnixConn(ctx context.Context, c net.Conn) context.Context {
+	if c.LocalAddr().Network() == "unix" {
+		return context.WithValue(ctx, unixConnKey{}, true)
+	}
+	return ctx
+}
+
+// authExempt reports whether r may read without a key.
+func authExempt(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if onUnix, _ := r.Context().Value(unixConnKey{}).(bool); onUnix {
+		return authExemptUnix
+	}
+	if len(authExemptNets) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	host, _, _ = strings.Cut(host, "%") // a link-local zone
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range authExemptNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
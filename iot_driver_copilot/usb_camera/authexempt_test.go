@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthExempt(t *testing.T) {
+	savedKeys := apiKeys
+	t.Cleanup(func() { apiKeys, authExemptNets, authExemptUnix = savedKeys, nil, false })
+	apiKeys = map[string]string{"k-alice": "alice"}
+	t.Setenv("AUTH_EXEMPT_CIDRS", "127.0.0.1, 10.1.0.0/16,::1")
+	t.Setenv("AUTH_EXEMPT_UNIX_SOCKET", "true")
+	if err := loadAuthExemptConfig(); err != nil {
+		t.Fatal(err)
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(clientIDFromRequest(r))) }
+	for _, c := range []struct {
+		method, remote, key string
+		unix                bool
+		code                int
+		client              string
+	}{
+		{http.MethodGet, "127.0.0.1:5000", "", false, 200, "local"},
+		{http.MethodHead, "[::1]:5000", "", false, 200, "local"},
+		{http.MethodGet, "10.1.4.2:5000", "", false, 200, "local"},
+		{http.MethodGet, "10.2.4.2:5000", "", false, 401, ""},
+		{http.MethodPost, "127.0.0.1:5000", "", false, 401, ""},
+		{http.MethodGet, "127.0.0.1:5000", "k-alice", false, 200, "alice"},
+		{http.MethodGet, "127.0.0.1:5000", "wrong", false, 401, ""},
+		{http.MethodGet, "@", "", true, 200, "local"},
+		{http.MethodPut, "@", "", true, 401, ""},
+	} {
+		req := httptest.NewRequest(c.method, "/snapshot", nil)
+		req.RemoteAddr = c.remote
+		if c.key != "" {
+			req.Header.Set("X-API-Key", c.key)
+		}
+		if c.unix {
+			req = req.WithContext(context.WithValue(req.Context(), unixConnKey{}, true))
+		}
+		rec := httptest.NewRecorder()
+		requireAuth(ok)(rec, req)
+		if rec.Code != c.code || (c.code == 200 && c.method == http.MethodGet && rec.Body.String() != c.client) {
+			t.Errorf("%s from %s key %q: %d %q, want %d %q", c.method, c.remote, c.key, rec.Code, rec.Body, c.code, c.client)
+		}
+	}
+
+	t.Setenv("AUTH_EXEMPT_CIDRS", "localhost")
+	if loadAuthExemptConfig() == nil {
+		t.Error("host name accepted as an address")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAverageFrames(t *testing.T) {
+	out, err := averageFrames([][]byte{{10, 20, 0, 255}, {20, 40, 1, 255}, {30, 61, 1, 254}}, "YUYV")
+	if err != nil || !bytes.Equal(out, []byte{20, 40, 1, 255}) {
+		t.Errorf("YUYV average = %v, %v", out, err)
+	}
+	if _, err := averageFrames([][]byte{{1, 2, 3, 4}, {1, 2}}, "YUYV"); err != errFrameSizeChanged {
+		t.Errorf("mixed sizes: %v", err)
+	}
+
+	gray := func(y uint8) []byte {
+		img := image.NewGray(image.Rect(0, 0, 16, 16))
+		for i := range img.Pix {
+			img.Pix[i] = y
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	savedQ := encoderConfig.Quality
+	defer func() { encoderConfig.Quality = savedQ }()
+	encoderConfig.Quality = 100
+	out, err = averageFrames([][]byte{gray(40), gray(120)}, "MJPEG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if y := color.GrayModel.Convert(img.At(8, 8)).(color.Gray).Y; y < 78 || y > 82 {
+		t.Errorf("MJPEG average luma = %d, want about 80", y)
+	}
+}
+
+func TestAveragedSnapshot(t *testing.T) {
+	saved := cameraConfig
+	defer func() { closeCamera(); cameraConfig = saved }()
+	cameraConfig = CameraConfig{DevicePath: "/dev/video-missing", Simulate: true, Format: "YUYV", Width: 64, Height: 48, FPS: 60}
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleSnapshot(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	if rec := get("/snapshot?average=4"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("while stopped: %d", rec.Code)
+	}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"0", "65", "x", ""} {
+		if rec := get("/snapshot?average=" + bad); rec.Code != http.StatusBadRequest {
+			t.Errorf("average=%q: %d", bad, rec.Code)
+		}
+	}
+	if rec := get("/snapshot?average=2&full_res=true"); rec.Code != http.StatusBadRequest {
+		t.Errorf("with full_res: %d", rec.Code)
+	}
+	rec := get("/snapshot?average=4")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Frames-Averaged") != "4" {
+		t.Fatalf("average=4: %d %q %s", rec.Code, rec.Header().Get("X-Frames-Averaged"), rec.Body)
+	}
+	if cfg, err := jpeg.DecodeConfig(rec.Body); err != nil || cfg.Width != 64 || cfg.Height != 48 {
+		t.Errorf("averaged snapshot: %+v %v", cfg, err)
+	}
+}
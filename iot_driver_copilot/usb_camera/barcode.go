@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// --- BARCODE SCANNING ---
+// With BARCODE_SCAN=true the driver doubles as a scan station: every
+// BARCODE_INTERVAL_MS it hands a captured frame to zbarimg (the zbar-tools
+// package; BARCODE_DECODER names another path), which finds QR codes and
+// the common 1D symbologies (EAN/UPC, Code 128, Code 39, ...). Frames are
+// taken from what streams and snapshots read, and read from the camera
+// when nobody else does. Each detection,
+//
+//	{"type": "QR-Code", "data": "PALLET-0042", "box": {"x": 212, "y": 88, "width": 140, "height": 141},
+//	 "polygon": [[212, 88], [212, 229], [352, 229], [352, 88]], "frame_width": 1280, "frame_height": 720, "time": "..."}
+//
+// goes to the event timeline (type "barcode"), to GET /barcodes/events
+// (Server-Sent Events, takes ?token=), to each BARCODE_WEBHOOK_URLS as a
+// POST, and to BARCODE_MQTT_TOPIC on MQTT_BROKER. A code held in front of
+// the camera is reported once, and again only after it has been out of
+// sight for BARCODE_REPEAT_MS. Coordinates are pixels of the frame as
+// captured, after lens correction; binary payloads are base64 with
+// "encoding": "base64".
+
+type BarcodeConfig struct {
+	Enabled  bool          // BARCODE_SCAN
+	Interval time.Duration // BARCODE_INTERVAL_MS: how often a frame is scanned
+	Decoder  string        // BARCODE_DECODER: the zbarimg binary
+	Repeat   time.Duration // BARCODE_REPEAT_MS: how long a code must be gone before it is reported again
+	Webhooks []string      // BARCODE_WEBHOOK_URLS: comma-separated
+	Topic    string        // BARCODE_MQTT_TOPIC, used with MQTT_BROKER
+}
+
+var barcodeConfig BarcodeConfig
+
+// barcodes is the running scanner; nil unless BARCODE_SCAN is on.
+var barcodes *barcodeScanner
+
+var (
+	barcodeFramesScanned atomic.Uint64
+	barcodesDetected     atomic.Uint64
+)
+
+// decodeBarcodes finds the codes in a JPEG. Tests replace it.
+var decodeBarcodes = zbarDecode
+
+func loadBarcodeConfig() error {
+	barcodeConfig = BarcodeConfig{Interval: 500 * time.Millisecond, Repeat: 3 * time.Second}
+	barcodes = nil
+	if v := os.Getenv("BARCODE_SCAN"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("BARCODE_SCAN must be true or false")
+		}
+		barcodeConfig.Enabled = b
+	}
+	for _, s := range []struct {
+		name     string
+		dst      *time.Duration
+		min, max int
+	}{{"BARCODE_INTERVAL_MS", &barcodeConfig.Interval, 50, 60000}, {"BARCODE_REPEAT_MS", &barcodeConfig.Repeat, 0, 3600000}} {
+		if v := os.Getenv(s.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < s.min || n > s.max {
+				return fmt.Errorf("%s must be between %d and %d", s.name, s.min, s.max)
+			}
+			*s.dst = time.Duration(n) * time.Millisecond
+		}
+	}
+	webhooks, err := webhookURLs("BARCODE_WEBHOOK_URLS")
+	if err != nil {
+		return err
+	}
+	barcodeConfig.Webhooks = webhooks
+	barcodeConfig.Topic = getenvDefault("BARCODE_MQTT_TOPIC", "camera/barcodes")
+	if !barcodeConfig.Enabled {
+		return nil
+	}
+	decoder := getenvDefault("BARCODE_DECODER", "zbarimg")
+	path, err := exec.LookPath(decoder)
+	if err != nil {
+		return fmt.Errorf("BARCODE_SCAN needs zbarimg (zbar-tools) on the PATH or in BARCODE_DECODER: %v", err)
+	}
+	barcodeConfig.Decoder = path
+	barcodes = newBarcodeScanner()
+	return nil
+}
+
+type barcodeBox struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type barcodeDetection struct {
+	Type        string      `json:"type"` // zbar's symbology name
+	Data        string      `json:"data"`
+	Encoding    string      `json:"encoding,omitempty"` // "base64" when the payload is not text
+	Box         *barcodeBox `json:"box,omitempty"`
+	Polygon     [][2]int    `json:"polygon,omitempty"`
+	FrameWidth  int         `json:"frame_width"`
+	FrameHeight int         `json:"frame_height"`
+	Time        time.Time   `json:"time"`
+}
+
+type barcodeScanner struct {
+	frames chan clipFrame // one waiting frame at most
+
+	mu         sync.Mutex
+	lastSample time.Time
+	seen       map[string]time.Time // type and data -> when last in view
+	subs       map[chan []byte]struct{}
+
+	out *publisher
+}
+
+func newBarcodeScanner() *barcodeScanner {
+	return &barcodeScanner{frames: make(chan clipFrame, 1), seen: map[string]time.Time{}, subs: map[chan []byte]struct{}{},
+		out: newPublisher("barcode", barcodeConfig.Webhooks, barcodeConfig.Topic, "")}
+}
+
+// offer queues a copy of frame for scanning if a BARCODE_INTERVAL_MS has
+// passed since the last one. It never blocks the reader.
+func (s *barcodeScanner) offer(frame []byte, info sourceInfo, now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.lastSample) < barcodeConfig.Interval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastSample = now
+	s.mu.Unlock()
+	select {
+	case s.frames <- clipFrame{at: now, frame: append([]byte(nil), frame...), format: info.Format, width: info.Width, height: info.Height}:
+	default: // the decoder is still busy with the last one
+	}
+}
+
+func (s *barcodeScanner) sampledSince(t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSample.After(t)
+}
+
+// run decodes the queued frames and, like clipRecorder, reads the camera
+// itself while nobody else does.
+func (s *barcodeScanner) run(ctx context.Context) {
+	defer s.out.connect()()
+	go func() {
+		t := time.NewTicker(barcodeConfig.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+			cameraState.mu.Lock()
+			running, cam := cameraState.running, cameraState.source
+			cameraState.mu.Unlock()
+			if !running || cam == nil || s.sampledSince(time.Now().Add(-2*barcodeConfig.Interval)) {
+				continue
+			}
+			if cam.WaitForFrame(1) != nil {
+				continue
+			}
+			if frame, err := cam.ReadFrame(); len(frame) > 0 {
+				if err == nil {
+					markFrame()
+				}
+				releaseFrame(frame)
+			}
+		}
+	}()
+	for {
+		select {
+		case f := <-s.frames:
+			s.scan(ctx, f)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *barcodeScanner) scan(ctx context.Context, f clipFrame) {
+	jpg, err := snapshotJPEG(f.frame, f.format, f.width, f.height, "")
+	if err != nil {
+		return
+	}
+	dctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	found, err := decodeBarcodes(dctx, jpg)
+	cancel()
+	barcodeFramesScanned.Add(1)
+	if err != nil {
+		log.Printf("barcode decoder: %v", err)
+		return
+	}
+	for _, d := range s.fresh(found, f.at) {
+		d.FrameWidth, d.FrameHeight, d.Time = int(f.width), int(f.height), clockNow().UTC()
+		s.publish(d)
+	}
+}
+
+// fresh returns the detections not in view within the last
+// BARCODE_REPEAT_MS, and notes all of them as seen at now.
+func (s *barcodeScanner) fresh(found []barcodeDetection, now time.Time) []barcodeDetection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []barcodeDetection
+	for _, d := range found {
+		key := d.Type + "\x00" + d.Data
+		if last, ok := s.seen[key]; !ok || now.Sub(last) > barcodeConfig.Repeat {
+			out = append(out, d)
+		}
+		s.seen[key] = now
+	}
+	for key, last := range s.seen {
+		if now.Sub(last) > barcodeConfig.Repeat {
+			delete(s.seen, key)
+		}
+	}
+	return out
+}
+
+func (s *barcodeScanner) publish(d barcodeDetection) {
+	barcodesDetected.Add(1)
+	detail := map[string]interface{}{"symbology": d.Type, "data": d.Data}
+	if d.Box != nil {
+		detail["box"] = d.Box
+	}
+	recordEvent("barcode", "", detail)
+	body, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	for ch := range s.subs {
+		select {
+		case ch <- body:
+		default: // a subscriber that does not keep up misses detections
+		}
+	}
+	s.mu.Unlock()
+	s.out.publish(body)
+}
+
+func (s *barcodeScanner) subscribe() chan []byte {
+	ch := make(chan []byte, 16)
+	s.mu.Lock()
+	s.subs[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch
+}
+
+func (s *barcodeScanner) unsubscribe(ch chan []byte) {
+	s.mu.Lock()
+	delete(s.subs, ch)
+	s.mu.Unlock()
+}
+
+// barcodeTap hands the frames read from a source to the scanner.
+type barcodeTap struct {
+	FrameSource
+	info sourceInfo
+}
+
+func (s *barcodeTap) ReadFrame() ([]byte, error) {
+	frame, err := s.FrameSource.ReadFrame()
+	if sc := barcodes; sc != nil && len(frame) > 0 {
+		sc.offer(frame, s.info, time.Now())
+	}
+	return frame, err
+}
+
+// handleBarcodeEvents streams detections as Server-Sent Events.
+func handleBarcodeEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sc := barcodes
+	if sc == nil {
+		http.Error(w, "Barcode scanning is off (BARCODE_SCAN)", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch := sc.subscribe()
+	defer sc.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, ": barcode detections\n\n")
+	flusher.Flush()
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case body := <-ch:
+			fmt.Fprintf(w, "event: barcode\ndata: %s\n\n", body)
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// zbarimg --xml output, reduced to what is used.
+type zbarOutput struct {
+	Sources []struct {
+		Indexes []struct {
+			Symbols []struct {
+				Type    string `xml:"type,attr"`
+				Polygon struct {
+					Points string `xml:"points,attr"`
+				} `xml:"polygon"`
+				Data struct {
+					Format string `xml:"format,attr"`
+					Text   string `xml:",chardata"`
+				} `xml:"data"`
+			} `xml:"symbol"`
+		} `xml:"index"`
+	} `xml:"source"`
+}
+
+// zbarDecode runs zbarimg on a JPEG.
+func zbarDecode(ctx context.Context, jpg []byte) ([]barcodeDetection, error) {
+	f, err := os.CreateTemp("", "barcode-*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(jpg)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, barcodeConfig.Decoder, "--quiet", "--xml", f.Name())
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 4 {
+		return nil, nil // zbarimg found nothing
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseZbarXML(out)
+}
+
+func parseZbarXML(out []byte) ([]barcodeDetection, error) {
+	var doc zbarOutput
+	if err := xml.Unmarshal(out, &doc); err != nil {
+		return nil, fmt.Errorf("zbarimg output: %v", err)
+	}
+	var found []barcodeDetection
+	for _, src := range doc.Sources {
+		for _, idx := range src.Indexes {
+			for _, sym := range idx.Symbols {
+				d := barcodeDetection{Type: sym.Type, Data: sym.Data.Text}
+				if sym.Data.Format == "base64" {
+					raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sym.Data.Text))
+					if err != nil {
+						return nil, fmt.Errorf("zbarimg output: %v", err)
+					}
+					if utf8.Valid(raw) {
+						d.Data = string(raw)
+					} else {
+						d.Data, d.Encoding = base64.StdEncoding.EncodeToString(raw), "base64"
+					}
+				}
+				d.Polygon = parseZbarPoints(sym.Polygon.Points)
+				d.Box = boundingBox(d.Polygon)
+				found = append(found, d)
+			}
+		}
+	}
+	return found, nil
+}
+
+// parseZbarPoints reads "+12,34 +12,80 ..."; a malformed list gives nil.
+func parseZbarPoints(s string) [][2]int {
+	var pts [][2]int
+	for _, p := range strings.Fields(s) {
+		x, y, ok := strings.Cut(p, ",")
+		xi, errX := strconv.Atoi(x)
+		yi, errY := strconv.Atoi(y)
+		if !ok || errX != nil || errY != nil {
+			return nil
+		}
+		pts = append(pts, [2]int{xi, yi})
+	}
+	return pts
+}
+
+func boundingBox(pts [][2]int) *barcodeBox {
+	if len(pts) == 0 {
+		return nil
+	}
+	minX, minY, maxX, maxY := pts[0][0], pts[0][1], pts[0][0], pts[0][1]
+	for _, p := range pts[1:] {
+		minX, maxX = min(minX, p[0]), max(maxX, p[0])
+		minY, maxY = min(minY, p[1]), max(maxY, p[1])
+	}
+	return &barcodeBox{X: minX, Y: minY, Width: maxX - minX, Height: maxY - minY}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const zbarSample = `<barcodes xmlns='http://zbar.sourceforge.net/2008/barcode'>
+<source href='/tmp/barcode-1.jpg'>
+<index num='0'>
+<symbol type='QR-Code' quality='1' orientation='UP'><polygon points='+212,88 +212,229 +352,229 +352,88'/><data><![CDATA[PALLET-0042]]></data></symbol>
+<symbol type='EAN-13' quality='3'><data format='base64'><![CDATA[NDAwNjM4MTMzMzkzMQ==]]></data></symbol>
+<symbol type='QR-Code' quality='1'><data format='base64'><![CDATA[AP8Q]]></data></symbol>
+</index>
+</source>
+</barcodes>
+`
+
+func TestParseZbarXML(t *testing.T) {
+	found, err := parseZbarXML([]byte(zbarSample))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 3 {
+		t.Fatalf("found %d symbols: %+v", len(found), found)
+	}
+	qr := found[0]
+	if qr.Type != "QR-Code" || qr.Data != "PALLET-0042" || qr.Box == nil || *qr.Box != (barcodeBox{X: 212, Y: 88, Width: 140, Height: 141}) || len(qr.Polygon) != 4 {
+		t.Errorf("QR = %+v box %+v", qr, qr.Box)
+	}
+	if ean := found[1]; ean.Type != "EAN-13" || ean.Data != "4006381333931" || ean.Encoding != "" || ean.Box != nil {
+		t.Errorf("EAN = %+v", ean)
+	}
+	if bin := found[2]; bin.Data != "AP8Q" || bin.Encoding != "base64" {
+		t.Errorf("binary = %+v", bin)
+	}
+	if _, err := parseZbarXML([]byte("scanned 0 barcode symbols")); err == nil {
+		t.Error("non-XML output accepted")
+	}
+}
+
+func TestBarcodeRepeat(t *testing.T) {
+	saved := barcodeConfig
+	defer func() { barcodeConfig = saved }()
+	barcodeConfig.Repeat = time.Second
+	s := newBarcodeScanner()
+	code := []barcodeDetection{{Type: "QR-Code", Data: "A"}}
+	now := time.Now()
+	if len(s.fresh(code, now)) != 1 {
+		t.Fatal("first sighting not reported")
+	}
+	// Still in view: never reported again, however long it stays.
+	for i := 1; i <= 5; i++ {
+		if len(s.fresh(code, now.Add(time.Duration(i)*500*time.Millisecond))) != 0 {
+			t.Fatalf("reported again while in view (%d)", i)
+		}
+	}
+	if len(s.fresh(code, now.Add(4*time.Second))) != 1 {
+		t.Error("not reported after being out of view")
+	}
+}
+
+func TestBarcodeScanning(t *testing.T) {
+	savedCam, savedCfg, savedDecode := cameraConfig, barcodeConfig, decodeBarcodes
+	defer func() {
+		closeCamera()
+		cameraConfig, barcodeConfig, decodeBarcodes, barcodes = savedCam, savedCfg, savedDecode, nil
+	}()
+	hooked := make(chan barcodeDetection, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var d barcodeDetection
+		json.NewDecoder(r.Body).Decode(&d)
+		hooked <- d
+	}))
+	defer hook.Close()
+	barcodeConfig = BarcodeConfig{Enabled: true, Interval: 50 * time.Millisecond, Repeat: time.Minute, Webhooks: []string{hook.URL}}
+	decodeBarcodes = func(ctx context.Context, jpg []byte) ([]barcodeDetection, error) {
+		if len(jpg) < 4 || jpg[0] != 0xFF || jpg[1] != 0xD8 {
+			t.Errorf("decoder was not given a JPEG")
+		}
+		return []barcodeDetection{{Type: "QR-Code", Data: "PALLET-0042", Box: &barcodeBox{X: 1, Y: 2, Width: 3, Height: 4}}}, nil
+	}
+
+	rec := httptest.NewRecorder()
+	handleBarcodeEvents(rec, httptest.NewRequest(http.MethodGet, "/barcodes/events", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("events with scanning off = %d", rec.Code)
+	}
+
+	barcodes = newBarcodeScanner()
+	srv := httptest.NewServer(http.HandlerFunc(handleBarcodeEvents))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+
+	// Nobody streams, so the scanner reads the camera itself.
+	cameraConfig = CameraConfig{DevicePath: "/dev/video-missing", Simulate: true, Format: "YUYV", Width: 64, Height: 48, FPS: 30}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	scanCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	detected, scanned := barcodesDetected.Load(), barcodeFramesScanned.Load()
+	go barcodes.run(scanCtx)
+
+	rd := bufio.NewReader(resp.Body)
+	var data string
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatalf("event stream: %v", err)
+		}
+		if rest, ok := strings.CutPrefix(line, "data: "); ok {
+			data = strings.TrimSpace(rest)
+			break
+		}
+	}
+	var d barcodeDetection
+	if err := json.Unmarshal([]byte(data), &d); err != nil || d.Data != "PALLET-0042" || d.FrameWidth != 64 || d.FrameHeight != 48 || d.Box == nil {
+		t.Errorf("SSE detection %s: %v", data, err)
+	}
+	select {
+	case d := <-hooked:
+		if d.Type != "QR-Code" || d.Data != "PALLET-0042" {
+			t.Errorf("webhook got %+v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := barcodesDetected.Load() - detected; n != 1 {
+		t.Errorf("%d detections reported for one code in view", n)
+	}
+	if n := barcodeFramesScanned.Load() - scanned; n < 2 {
+		t.Errorf("only %d frames scanned", n)
+	}
+	if evs, _ := events.query(eventQuery{types: map[string]bool{"barcode": true}, limit: 1000}); len(evs) == 0 || evs[len(evs)-1].Detail["data"] != "PALLET-0042" {
+		t.Errorf("timeline: %+v", evs)
+	}
+}
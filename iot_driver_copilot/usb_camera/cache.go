@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// --- CACHE HEADERS ---
+// Every reply carries Cache-Control, so proxies between the driver and its
+// operators never hand out a stale snapshot or status. CACHE_CONTROL is the
+// driver-wide value (default no-store); CACHE_CONTROL_ROUTES overrides it
+// per route as ';'-separated path=value entries, where a path ending in /
+// covers a subtree and "off" sends no header at all:
+//
+//	CACHE_CONTROL_ROUTES=/version=private, max-age=300;/events=no-cache
+//
+// /version, which only changes with a new build, defaults to
+// "private, max-age=60". Replies that must not be stored also get
+// "Pragma: no-cache" for HTTP/1.0 caches.
+
+type CacheConfig struct {
+	Default string
+	Routes  map[string]string // by path; a path ending in / is a subtree
+}
+
+var cacheConfig = CacheConfig{Default: "no-store"}
+
+func loadCacheConfig() error {
+	cacheConfig = CacheConfig{Default: "no-store", Routes: map[string]string{"/version": "private, max-age=60"}}
+	if v := strings.TrimSpace(os.Getenv("CACHE_CONTROL")); v != "" {
+		cacheConfig.Default = v
+	}
+	for _, entry := range strings.Split(os.Getenv("CACHE_CONTROL_ROUTES"), ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		path, value, ok := strings.Cut(entry, "=")
+		path, value = strings.TrimSpace(path), strings.TrimSpace(value)
+		if !ok || !strings.HasPrefix(path, "/") || value == "" {
+			return fmt.Errorf("CACHE_CONTROL_ROUTES: invalid route %q (expected /path=value)", entry)
+		}
+		cacheConfig.Routes[path] = value
+	}
+	return nil
+}
+
+func cacheHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := routeFor(r.URL.Path, cacheConfig.Default, cacheConfig.Routes)
+		if v != "off" {
+			w.Header().Set("Cache-Control", v)
+			if strings.Contains(v, "no-store") || strings.Contains(v, "no-cache") {
+				w.Header().Set("Pragma", "no-cache")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
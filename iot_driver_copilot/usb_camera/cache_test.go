@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCacheHeaders(t *testing.T) {
+	saved := cacheConfig
+	defer func() { cacheConfig = saved }()
+	t.Setenv("CACHE_CONTROL_ROUTES", "/events=no-cache; /playback/=off")
+	if err := loadCacheConfig(); err != nil {
+		t.Fatal(err)
+	}
+	h := cacheHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, want := range map[string][2]string{
+		"/snapshot":       {"no-store", "no-cache"},
+		"/version":        {"private, max-age=60", ""},
+		"/events":         {"no-cache", "no-cache"},
+		"/playback/start": {"", ""},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := [2]string{rec.Header().Get("Cache-Control"), rec.Header().Get("Pragma")}; got != want {
+			t.Errorf("%s: Cache-Control/Pragma = %q, want %q", path, got, want)
+		}
+	}
+
+	t.Setenv("CACHE_CONTROL_ROUTES", "version=no-store")
+	if err := loadCacheConfig(); err == nil {
+		t.Error("route without a leading / accepted")
+	}
+}
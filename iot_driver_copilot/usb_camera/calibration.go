@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lens distortion correction for wide-angle cameras:
+//
+//	POST   /calibration   install a profile (JSON body, below)
+//	GET    /calibration   the installed profile, if any
+//	DELETE /calibration   turn correction off
+//
+//	{"width":1920,"height":1080,"k1":-0.31,"k2":0.09,"cx":962.5,"cy":538.1,"fx":1210,"fy":1210}
+//
+// k1 and k2 are the radial coefficients of the Brown model, for the frame
+// size the camera was calibrated at. The centre (cx, cy) and focal lengths
+// (fx, fy) are in pixels of that frame; the centre defaults to the middle of
+// the frame and the focal lengths to half its shorter side. Other frame
+// sizes use the profile scaled to them. Every frame the camera delivers is
+// remapped (nearest pixel; corners with no source pixel come out black), so
+// streams, snapshots, raw frames and statistics all see the corrected
+// image. MJPEG frames are decoded and re-encoded at JPEG_QUALITY for this.
+//
+// With CALIBRATION_FILE (or STATE_DIR) set the profile is kept there and
+// installed again at startup.
+
+type CalibrationConfig struct {
+	File string // CALIBRATION_FILE
+}
+
+var calibrationConfig CalibrationConfig
+
+type calibrationProfile struct {
+	Width  int      `json:"width"`
+	Height int      `json:"height"`
+	K1     float64  `json:"k1"`
+	K2     float64  `json:"k2"`
+	Cx     *float64 `json:"cx"`
+	Cy     *float64 `json:"cy"`
+	Fx     *float64 `json:"fx"`
+	Fy     *float64 `json:"fy"`
+}
+
+// calibration is an installed profile and its remap tables.
+type calibration struct {
+	profile   calibrationProfile
+	installed time.Time
+	mu        sync.Mutex
+	maps      map[[2]int][]int32 // frame size -> source pixel of each output pixel, -1 for none
+}
+
+var activeCalibration atomic.Pointer[calibration]
+
+// --- CALIBRATION CONFIG ---
+func loadCalibrationConfig() error {
+	calibrationConfig.File = stateFilePath("CALIBRATION_FILE", "calibration.json")
+	activeCalibration.Store(nil)
+	if calibrationConfig.File == "" {
+		return nil
+	}
+	var p calibrationProfile
+	err := loadState(calibrationConfig.File, &p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := p.validate(); err != nil {
+		return fmt.Errorf("%s: %v", calibrationConfig.File, err)
+	}
+	installCalibration(p)
+	log.Printf("Lens correction profile loaded from %s", calibrationConfig.File)
+	return nil
+}
+
+// validate checks p and fills in the defaulted centre and focal lengths.
+func (p *calibrationProfile) validate() error {
+	if p.Width <= 0 || p.Width > maxFrameWidth || p.Height <= 0 || p.Height > maxFrameHeight {
+		return fmt.Errorf("width and height must give the calibrated frame size (max %dx%d)", maxFrameWidth, maxFrameHeight)
+	}
+	def := func(v **float64, d float64) {
+		if *v == nil {
+			*v = &d
+		}
+	}
+	half := float64(p.Width) / 2
+	if p.Height < p.Width {
+		half = float64(p.Height) / 2
+	}
+	def(&p.Cx, float64(p.Width)/2)
+	def(&p.Cy, float64(p.Height)/2)
+	def(&p.Fx, half)
+	def(&p.Fy, half)
+	for _, v := range []float64{p.K1, p.K2, *p.Cx, *p.Cy, *p.Fx, *p.Fy} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return errors.New("coefficients must be finite numbers")
+		}
+	}
+	if *p.Fx <= 0 || *p.Fy <= 0 {
+		return errors.New("fx and fy must be positive")
+	}
+	return nil
+}
+
+func installCalibration(p calibrationProfile) {
+	activeCalibration.Store(&calibration{profile: p, installed: clockNow().UTC(), maps: map[[2]int][]int32{}})
+}
+
+// remap returns the table for a w x h frame, computing it on first use.
+func (c *calibration) remap(w, h int) []int32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m, ok := c.maps[[2]int{w, h}]; ok {
+		return m
+	}
+	p := c.profile
+	sx, sy := float64(w)/float64(p.Width), float64(h)/float64(p.Height)
+	cx, cy, fx, fy := *p.Cx*sx, *p.Cy*sy, *p.Fx*sx, *p.Fy*sy
+	m := make([]int32, w*h)
+	for v := 0; v < h; v++ {
+		y := (float64(v) - cy) / fy
+		for u := 0; u < w; u++ {
+			x := (float64(u) - cx) / fx
+			r2 := x*x + y*y
+			f := 1 + p.K1*r2 + p.K2*r2*r2
+			su, sv := int(math.Round(cx+x*f*fx)), int(math.Round(cy+y*f*fy))
+			m[v*w+u] = -1
+			if su >= 0 && su < w && sv >= 0 && sv < h {
+				m[v*w+u] = int32(sv*w + su)
+			}
+		}
+	}
+	c.maps[[2]int{w, h}] = m
+	return m
+}
+
+// undistort returns the corrected copy of a frame in info.Format.
+func (c *calibration) undistort(frame []byte, info sourceInfo) ([]byte, error) {
+	if info.Format == "YUYV" {
+		w, h := int(info.Width), int(info.Height)
+		if len(frame) < w*h*2 {
+			return nil, fmt.Errorf("short YUYV frame (%d bytes for %dx%d)", len(frame), w, h)
+		}
+		return undistortYUYV(frame, w, h, c.remap(w, h)), nil
+	}
+	img, err := jpeg.Decode(bytes.NewReader(withDefaultHuffman(frame)))
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	out, err := undistortImage(img, c.remap(b.Dx(), b.Dy()))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, out, &jpeg.Options{Quality: encoderConfig.Quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// undistortYUYV remaps a YUYV frame. Each output pixel pair takes its
+// chroma from the pair its first mapped pixel falls in.
+func undistortYUYV(frame []byte, w, h int, m []int32) []byte {
+	out := make([]byte, w*h*2)
+	for i := 0; i+1 < w*h; i += 2 {
+		o := i * 2
+		s0, s1 := m[i], m[i+1]
+		out[o], out[o+1], out[o+2], out[o+3] = 16, 128, 16, 128
+		if s0 >= 0 {
+			out[o] = frame[s0*2]
+		}
+		if s1 >= 0 {
+			out[o+2] = frame[s1*2]
+		}
+		if s0 < 0 {
+			s0 = s1
+		}
+		if s0 >= 0 {
+			pair := int(s0) / 2 * 4
+			out[o+1], out[o+3] = frame[pair+1], frame[pair+3]
+		}
+	}
+	return out
+}
+
+// undistortImage remaps a decoded JPEG, keeping its colour model.
+func undistortImage(img image.Image, m []int32) (image.Image, error) {
+	b := img.Bounds()
+	w := b.Dx()
+	switch in := img.(type) {
+	case *image.YCbCr:
+		out := image.NewYCbCr(image.Rect(0, 0, w, b.Dy()), in.SubsampleRatio)
+		for i, s := range m {
+			u, v := i%w, i/w
+			yo, co := out.YOffset(u, v), out.COffset(u, v)
+			if s < 0 {
+				out.Y[yo], out.Cb[co], out.Cr[co] = 0, 128, 128
+				continue
+			}
+			su, sv := b.Min.X+int(s)%w, b.Min.Y+int(s)/w
+			out.Y[yo] = in.Y[in.YOffset(su, sv)]
+			ci := in.COffset(su, sv)
+			out.Cb[co], out.Cr[co] = in.Cb[ci], in.Cr[ci]
+		}
+		return out, nil
+	case *image.Gray:
+		out := image.NewGray(image.Rect(0, 0, w, b.Dy()))
+		for i, s := range m {
+			if s >= 0 {
+				out.Pix[out.PixOffset(i%w, i/w)] = in.Pix[in.PixOffset(b.Min.X+int(s)%w, b.Min.Y+int(s)/w)]
+			}
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("lens correction does not support %T frames", img)
+	}
+}
+
+// undistortSource corrects the frames of a backend with the installed
+// profile. A frame that can't be corrected is dropped, so clients never
+// mistake a raw frame for a corrected one.
+type undistortSource struct {
+	FrameSource
+	info sourceInfo
+}
+
+func (s *undistortSource) ReadFrame() ([]byte, error) {
+	frame, err := s.FrameSource.ReadFrame()
+	c := activeCalibration.Load()
+	if c == nil || len(frame) == 0 {
+		return frame, err
+	}
+	out, cerr := c.undistort(frame, s.info)
+	carryFrameTime(frame, out)
+	releaseFrame(frame)
+	if cerr != nil {
+		log.Printf("lens correction failed, frame dropped: %v", cerr)
+		return nil, err
+	}
+	return out, err
+}
+
+// saveCalibration writes p to CALIBRATION_FILE, or removes the file for nil.
+func saveCalibration(p *calibrationProfile) error {
+	if calibrationConfig.File == "" {
+		return nil
+	}
+	if p == nil {
+		return removeState(calibrationConfig.File)
+	}
+	return saveState(calibrationConfig.File, p)
+}
+
+// writeFileAtomic replaces path with data, so a crash leaves either the old
+// or the new file, and syncs the directory so the rename is not lost.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if serr := tmp.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// calibrationOps is a dry run's change to CALIBRATION_FILE, if set, and to
+// the frames.
+func calibrationOps(fileOp string, op plannedOp) []plannedOp {
+	if calibrationConfig.File == "" {
+		return []plannedOp{op}
+	}
+	return []plannedOp{{Op: fileOp, File: calibrationConfig.File}, op}
+}
+
+func calibrationResponse() map[string]interface{} {
+	c := activeCalibration.Load()
+	if c == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	return map[string]interface{}{"enabled": true, "installed": c.installed, "profile": c.profile}
+}
+
+func handleCalibration(w http.ResponseWriter, r *http.Request) {
+	dry, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var p calibrationProfile
+		if !decodeJSONBody(w, r, &p) {
+			return
+		}
+		if err := p.validate(); err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if dry {
+			replyDryRun(w, calibrationOps("save_state", plannedOp{Op: "install_calibration", Detail: p}))
+			return
+		}
+		if err := saveCalibration(&p); err != nil {
+			jsonResponse(w, http.StatusInternalServerError, map[string]string{"error": "saving profile: " + err.Error()})
+			return
+		}
+		installCalibration(p)
+	case http.MethodDelete:
+		if dry {
+			replyDryRun(w, calibrationOps("remove_state", plannedOp{Op: "remove_calibration"}))
+			return
+		}
+		if err := saveCalibration(nil); err != nil {
+			jsonResponse(w, http.StatusInternalServerError, map[string]string{"error": "removing profile: " + err.Error()})
+			return
+		}
+		activeCalibration.Store(nil)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, http.StatusOK, calibrationResponse())
+}
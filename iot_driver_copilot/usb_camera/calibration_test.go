@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUndistortYUYV(t *testing.T) {
+	const w, h = 8, 4
+	frame := make([]byte, w*h*2)
+	for i := range frame {
+		frame[i] = byte(i)
+	}
+	identity := calibrationProfile{Width: w, Height: h}
+	if err := identity.validate(); err != nil {
+		t.Fatal(err)
+	}
+	c := &calibration{profile: identity, maps: map[[2]int][]int32{}}
+	out, err := c.undistort(frame, sourceInfo{Format: "YUYV", Width: w, Height: h})
+	if err != nil || !bytes.Equal(out, frame) {
+		t.Fatalf("k1=k2=0 changed the frame: %v", err)
+	}
+
+	// Strong barrel correction pulls the corners from outside the frame.
+	barrel := calibrationProfile{Width: w, Height: h, K1: 0.5}
+	barrel.validate()
+	c = &calibration{profile: barrel, maps: map[[2]int][]int32{}}
+	out, _ = c.undistort(frame, sourceInfo{Format: "YUYV", Width: w, Height: h})
+	if out[0] != 16 || out[1] != 128 {
+		t.Errorf("corner = %v, want black", out[:4])
+	}
+	// The profile scales to other frame sizes.
+	if m := c.remap(2*w, 2*h); len(m) != 4*w*h || m[0] != -1 {
+		t.Errorf("scaled map: len %d, corner %d", len(m), m[0])
+	}
+}
+
+func TestCalibrationEndpoint(t *testing.T) {
+	savedCam, savedCal := cameraConfig, calibrationConfig
+	defer func() {
+		closeCamera()
+		cameraConfig, calibrationConfig = savedCam, savedCal
+		activeCalibration.Store(nil)
+	}()
+	file := filepath.Join(t.TempDir(), "calibration.json")
+	t.Setenv("CALIBRATION_FILE", file)
+	if err := loadCalibrationConfig(); err != nil || activeCalibration.Load() != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+
+	call := func(method, body string) (int, map[string]json.RawMessage) {
+		rec := httptest.NewRecorder()
+		handleCalibration(rec, httptest.NewRequest(method, "/calibration", strings.NewReader(body)))
+		var resp map[string]json.RawMessage
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	for _, bad := range []string{`{"k1":-0.3}`, `{"width":64,"height":48,"fx":0}`, `not json`} {
+		if code, _ := call(http.MethodPost, bad); code != http.StatusBadRequest {
+			t.Errorf("%s: %d", bad, code)
+		}
+	}
+	code, resp := call(http.MethodPost, `{"width":64,"height":48,"k1":-0.2,"k2":0.05}`)
+	if code != http.StatusOK || string(resp["enabled"]) != "true" {
+		t.Fatalf("POST: %d %v", code, resp)
+	}
+	var p calibrationProfile
+	_ = json.Unmarshal(resp["profile"], &p)
+	if p.Cx == nil || *p.Cx != 32 || *p.Fx != 24 {
+		t.Errorf("defaults not filled in: %s", resp["profile"])
+	}
+
+	// Frames come out corrected, at the same size.
+	cameraConfig = CameraConfig{Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handleSnapshot(rec, httptest.NewRequest(http.MethodGet, "/snapshot", nil))
+	if cfg, err := jpeg.DecodeConfig(rec.Body); rec.Code != http.StatusOK || err != nil || cfg.Width != 64 || cfg.Height != 48 {
+		t.Errorf("snapshot: %d %v %+v", rec.Code, err, cfg)
+	}
+
+	// The profile survives a restart.
+	activeCalibration.Store(nil)
+	if err := loadCalibrationConfig(); err != nil || activeCalibration.Load() == nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if code, resp := call(http.MethodDelete, ""); code != http.StatusOK || string(resp["enabled"]) != "false" {
+		t.Errorf("DELETE: %d %v", code, resp)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("profile file left behind: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// What the driver does with the camera when it starts, STARTUP_CAPTURE:
+//
+//	idle    wait for POST /capture/start (the default)
+//	resume  capture again if it was capturing when the driver last ran,
+//	        with the same format, size and frame rate
+//	always  start capturing with the configured settings
+//
+// The capture state is kept in CAPTURE_STATE_FILE, by default
+// capture_state.json in STATE_DIR, which resume needs. It is written when
+// a client starts, stops or reconfigures capture, not when the driver shuts
+// down or loses the camera, so a crash, reboot or clean restart all resume
+// alike. Clip playback is not resumed; the camera
+// settings from before it are.
+
+type StartupConfig struct {
+	Mode      string // STARTUP_CAPTURE
+	StateFile string // CAPTURE_STATE_FILE
+}
+
+var startupConfig = StartupConfig{Mode: "idle"}
+
+type captureState struct {
+	Running bool      `json:"running"`
+	Format  string    `json:"format"`
+	Width   uint32    `json:"width"`
+	Height  uint32    `json:"height"`
+	FPS     uint32    `json:"fps"`
+	Saved   time.Time `json:"saved"`
+}
+
+// --- STARTUP CONFIG ---
+func loadStartupConfig() error {
+	startupConfig.Mode = strings.ToLower(os.Getenv("STARTUP_CAPTURE"))
+	if startupConfig.Mode == "" {
+		startupConfig.Mode = "idle"
+	}
+	switch startupConfig.Mode {
+	case "idle", "resume", "always":
+	default:
+		return fmt.Errorf("STARTUP_CAPTURE must be idle, resume or always, got %q", startupConfig.Mode)
+	}
+	startupConfig.StateFile = stateFilePath("CAPTURE_STATE_FILE", "capture_state.json")
+	if startupConfig.Mode == "resume" && startupConfig.StateFile == "" {
+		return errors.New("STARTUP_CAPTURE=resume needs CAPTURE_STATE_FILE or STATE_DIR")
+	}
+	return nil
+}
+
+// saveCaptureState records whether capture should be running, with the
+// current settings. Failures are logged; the request that changed the
+// state has succeeded regardless.
+func saveCaptureState(running bool) {
+	if startupConfig.StateFile == "" {
+		return
+	}
+	st := captureState{Running: running, Format: cameraConfig.Format, Width: cameraConfig.Width,
+		Height: cameraConfig.Height, FPS: cameraConfig.FPS, Saved: clockNow().UTC()}
+	if err := saveState(startupConfig.StateFile, st); err != nil {
+		log.Printf("saving capture state to %s: %v", startupConfig.StateFile, err)
+	}
+}
+
+func readCaptureState(path string) (captureState, error) {
+	var st captureState
+	if err := loadState(path, &st); err != nil {
+		return st, err
+	}
+	cfg := cameraConfig
+	cfg.Width, cfg.Height, cfg.FPS = st.Width, st.Height, st.FPS
+	if err := validateFrameConfig(cfg); err != nil {
+		return st, fmt.Errorf("%s: %v", path, err)
+	}
+	if st.Format != "MJPEG" && st.Format != "YUYV" {
+		return st, fmt.Errorf("%s: unsupported format %q", path, st.Format)
+	}
+	return st, nil
+}
+
+// startupCapture applies STARTUP_CAPTURE. The camera failing to open is
+// logged, not fatal: the API stays up so it can be retried.
+func startupCapture() {
+	switch startupConfig.Mode {
+	case "always":
+	case "resume":
+		st, err := readCaptureState(startupConfig.StateFile)
+		if errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		if err != nil {
+			log.Printf("Not resuming capture: %v", err)
+			return
+		}
+		cameraConfig.Format, cameraConfig.Width, cameraConfig.Height, cameraConfig.FPS = st.Format, st.Width, st.Height, st.FPS
+		if !st.Running {
+			return
+		}
+		log.Printf("Resuming capture stopped at %s", st.Saved.Format(time.RFC3339))
+	default:
+		return
+	}
+	if err := openCamera(); err != nil {
+		log.Printf("Starting capture failed: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeCapture(t *testing.T) {
+	savedCam, savedStartup := cameraConfig, startupConfig
+	defer func() { closeCamera(); cameraConfig, startupConfig = savedCam, savedStartup }()
+	file := filepath.Join(t.TempDir(), "capture.json")
+	t.Setenv("STARTUP_CAPTURE", "resume")
+	t.Setenv("CAPTURE_STATE_FILE", file)
+	if err := loadStartupConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cameraConfig = CameraConfig{Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+
+	// No state yet: stay idle.
+	startupCapture()
+	if cameraState.running {
+		t.Fatal("capturing without saved state")
+	}
+	rec := httptest.NewRecorder()
+	handleStartCapture(rec, httptest.NewRequest(http.MethodPost, "/capture/start?format=yuyv&width=32&height=24&fps=10", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("start: %d %s", rec.Code, rec.Body)
+	}
+
+	// A crash: the camera goes away without a stop request.
+	closeCamera()
+	cameraConfig = CameraConfig{Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	startupCapture()
+	if !cameraState.running || cameraState.formatStr != "YUYV" || cameraState.width != 32 || cameraState.fps != 10 {
+		t.Fatalf("resumed %v %s %dx%d@%d", cameraState.running, cameraState.formatStr, cameraState.width, cameraState.height, cameraState.fps)
+	}
+
+	handleStopCapture(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/capture/stop", nil))
+	startupCapture()
+	if cameraState.running {
+		t.Error("resumed capture that was stopped")
+	}
+
+	t.Setenv("CAPTURE_STATE_FILE", "")
+	if err := loadStartupConfig(); err == nil {
+		t.Error("resume without a state file accepted")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- CLI ---
+// Local operations for technicians:
+//   camera-driver [serve]                               run the HTTP driver (default)
+//   camera-driver snapshot [-url URL] [-api-key K] OUT  save one JPEG frame ("-" for stdout)
+//   camera-driver version                               print version and build info as JSON
+// With -url (or DRIVER_URL) the frame is taken from a running driver's
+// GET /snapshot; otherwise the capture backend is opened directly, which fails while
+// the driver holds the camera.
+
+const cliUsage = `usage: camera-driver [command]
+
+commands:
+  serve                                 run the HTTP driver (default)
+  snapshot [-url URL] [-api-key KEY] OUT
+                                        save one JPEG frame to OUT ("-" for stdout)
+  version                               print version and build information
+`
+
+// runCLI executes a subcommand and returns the process exit code.
+func runCLI(args []string) int {
+	var err error
+	switch args[0] {
+	case "snapshot":
+		err = cliSnapshot(args[1:])
+	case "version":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(buildVersion())
+	case "help", "-h", "-help", "--help":
+		fmt.Print(cliUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", args[0], cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func cliSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	url := fs.String("url", os.Getenv("DRIVER_URL"), "base URL of a running driver, e.g. http://localhost:8080 or unix:///run/copilot/camera.sock")
+	apiKey := fs.String("api-key", os.Getenv("API_KEY"), "API key for a driver with API_KEYS set")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected an output file argument")
+	}
+	var frame []byte
+	var err error
+	if *url != "" {
+		frame, err = snapshotHTTP(strings.TrimRight(*url, "/"), *apiKey)
+	} else {
+		frame, err = snapshotDirect()
+	}
+	if err != nil {
+		return err
+	}
+	if out := fs.Arg(0); out != "-" {
+		return os.WriteFile(out, frame, 0o644)
+	}
+	_, err = os.Stdout.Write(frame)
+	return err
+}
+
+// snapshotHTTP fetches GET /snapshot, which the driver already watermarks
+// and tags with EXIF.
+func snapshotHTTP(base, apiKey string) ([]byte, error) {
+	client, base := cliClient(base, 15*time.Second)
+	req, err := http.NewRequest(http.MethodGet, base+"/snapshot", nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			return nil, fmt.Errorf("%s (POST /capture/start first)", strings.TrimSpace(string(msg)))
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/jpeg" {
+		return nil, fmt.Errorf("unexpected frame type %q", ct)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// snapshotDirect opens the configured capture backend for a single frame.
+func snapshotDirect() ([]byte, error) {
+	if err := loadEnvConfig(); err != nil {
+		return nil, err
+	}
+	if err := loadExifConfig(); err != nil {
+		return nil, err
+	}
+	if err := loadEncoderConfig(); err != nil {
+		return nil, err
+	}
+	src, info, err := openFrameSource(cameraConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		src.StopStreaming()
+		src.Close()
+	}()
+	for attempt := 0; attempt < 3; attempt++ {
+		if err := src.WaitForFrame(5); err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return nil, err
+		}
+		frame, err := src.ReadFrame()
+		if err != nil && !isTimeout(err) {
+			return nil, err
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		taken := time.Now()
+		jpg, err := snapshotJPEG(frame, info.Format, info.Width, info.Height, "")
+		if err != nil {
+			return nil, err
+		}
+		if exifConfig.Enabled {
+			jpg = withExif(jpg, snapshotMeta{Taken: taken, Width: info.Width, Height: info.Height})
+		}
+		return jpg, nil
+	}
+	return nil, errors.New("no frame received from camera")
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Status is GET /status/all: the driver's health and its camera.
+type Status struct {
+	Status string                 `json:"status"` // "ok", or "degraded" when capture or the clock is unhealthy
+	Clock  map[string]interface{} `json:"clock"`
+	Camera CameraStatus           `json:"-"`
+}
+
+// CameraStatus describes the camera. Format, Width, Height and FPS are set
+// while it is capturing.
+type CameraStatus struct {
+	ID             string `json:"id"` // the device path
+	Backend        string `json:"backend"`
+	Present        bool   `json:"present"`
+	Capturing      bool   `json:"capturing"`
+	CaptureHealthy bool   `json:"capture_healthy"`
+	Online         bool   `json:"online"`
+	Streams        int    `json:"streams"`
+	Format         string `json:"format,omitempty"`
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	FPS            int    `json:"fps,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// GetStatus returns the driver's status.
+func (c *Client) GetStatus(ctx context.Context) (*Status, error) {
+	var reply struct {
+		Status
+		Devices []CameraStatus `json:"devices"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/status/all", nil, &reply); err != nil {
+		return nil, err
+	}
+	if len(reply.Devices) == 0 {
+		return nil, errors.New("client: GET /status/all listed no camera")
+	}
+	st := reply.Status
+	st.Camera = reply.Devices[0]
+	return &st, nil
+}
+
+// CaptureOptions are the settings for StartCapture; zero values keep the
+// driver's current ones.
+type CaptureOptions struct {
+	Format string // "MJPEG" or "YUYV"
+	Width  int
+	Height int
+	FPS    int
+}
+
+func (o CaptureOptions) query() string {
+	q := url.Values{}
+	if o.Format != "" {
+		q.Set("format", o.Format)
+	}
+	for name, v := range map[string]int{"width": o.Width, "height": o.Height, "fps": o.FPS} {
+		if v != 0 {
+			q.Set(name, strconv.Itoa(v))
+		}
+	}
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
+
+// StartCapture opens the camera, or reopens it with new settings.
+func (c *Client) StartCapture(ctx context.Context, opts CaptureOptions) error {
+	return c.do(ctx, http.MethodPost, "/capture/start"+opts.query(), nil, nil)
+}
+
+// StopCapture closes the camera.
+func (c *Client) StopCapture(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/capture/stop", nil, nil)
+}
+
+// Snapshot returns one JPEG frame.
+func (c *Client) Snapshot(ctx context.Context) ([]byte, error) {
+	var frame []byte
+	err := c.retry(ctx, func() error {
+		resp, err := c.send(ctx, c.http, http.MethodGet, "/snapshot", nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		frame, err = io.ReadAll(resp.Body)
+		return err
+	})
+	return frame, err
+}
+
+// Frame is one frame of the stream.
+type Frame struct {
+	JPEG          []byte
+	Width, Height int
+	// FormatChanged is set on the first frame after the capture settings
+	// changed (POST /capture/reconfigure).
+	FormatChanged bool
+	// QualityChanged is set on the first frame after the driver moved the
+	// stream to another quality tier because it could not keep up;
+	// QualityTier is then the new tier (0 is full quality).
+	QualityChanged bool
+	QualityTier    int
+	Received       time.Time
+}
+
+// ErrStreamEnded is returned by StreamFrames when the driver closes the
+// stream.
+var ErrStreamEnded = errors.New("client: the driver ended the stream")
+
+// StreamFrames reads GET /stream and calls fn with each frame, in order,
+// until ctx is done, the stream ends or fn returns an error, which is then
+// returned. The frame's bytes are fn's to keep. Frames that arrive while
+// fn runs wait in the connection, so a slow fn slows the stream down
+// rather than skipping frames.
+func (c *Client) StreamFrames(ctx context.Context, fn func(Frame) error) error {
+	hc := *c.http
+	hc.Timeout = 0 // the stream lasts as long as ctx
+	var resp *http.Response
+	err := c.retry(ctx, func() error {
+		var err error
+		resp, err = c.send(ctx, &hc, http.MethodGet, "/stream", nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" || params["boundary"] == "" {
+		return fmt.Errorf("client: GET /stream answered %q, not a multipart stream", resp.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return ErrStreamEnded
+			}
+			return err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		f := Frame{JPEG: data, FormatChanged: part.Header.Get("X-Stream-Event") == "format-changed", Received: time.Now()}
+		if part.Header.Get("X-Stream-Event") == "quality-changed" {
+			f.QualityChanged = true
+			f.QualityTier, _ = strconv.Atoi(part.Header.Get("X-Stream-Quality"))
+		}
+		if cfg, err := jpeg.DecodeConfig(bytes.NewReader(data)); err == nil {
+			f.Width, f.Height = cfg.Width, cfg.Height
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+}
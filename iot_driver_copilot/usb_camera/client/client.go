@@ -0,0 +1,187 @@
+// Package client is a typed Go client for the USB camera driver's HTTP API:
+// capture control, status, snapshots and the MJPEG stream delivered frame
+// by frame to a callback.
+//
+//	c, err := client.New("http://camera-1:8080", client.WithAPIKey(key))
+//	if err != nil { ... }
+//	if err := c.StartCapture(ctx, client.CaptureOptions{Format: "MJPEG", Width: 1280, Height: 720}); err != nil { ... }
+//	err = c.StreamFrames(ctx, func(f client.Frame) error {
+//		return process(f.JPEG)
+//	})
+//
+// unix:// base URLs reach a driver on LISTEN_SOCKET. Calls that cannot
+// reach the driver, or get 429, 502, 503 or 504 back, are retried with
+// exponential backoff (WithRetry); a stream is retried only until it has
+// started. Other failures are returned as *Error.
+//
+// Only the standard library is used, and the driver is not imported.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client talks to one camera driver. It is safe for concurrent use.
+type Client struct {
+	base   string
+	http   *http.Client
+	apiKey string
+
+	attempts     int
+	backoff      time.Duration
+	backoffLimit time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAPIKey authenticates with key, one of the driver's API_KEYS.
+func WithAPIKey(key string) Option { return func(c *Client) { c.apiKey = key } }
+
+// WithHTTPClient replaces the default HTTP client. Its Timeout applies to
+// every call but StreamFrames, which runs until its context ends.
+func WithHTTPClient(hc *http.Client) Option { return func(c *Client) { c.http = hc } }
+
+// WithRetry sets how many attempts a call gets (1 for no retries) and the
+// backoff between them, doubling from initial to max.
+func WithRetry(attempts int, initial, max time.Duration) Option {
+	return func(c *Client) { c.attempts, c.backoff, c.backoffLimit = attempts, initial, max }
+}
+
+// New returns a client for the driver at baseURL. Without WithRetry a call
+// is tried three times, 200 ms and then 400 ms apart.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	c := &Client{
+		base:     strings.TrimRight(baseURL, "/"),
+		http:     &http.Client{Timeout: 30 * time.Second},
+		attempts: 3, backoff: 200 * time.Millisecond, backoffLimit: 5 * time.Second,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.attempts < 1 || c.backoff < 0 || c.backoffLimit < c.backoff {
+		return nil, fmt.Errorf("client: invalid retry settings (%d attempts, %v to %v)", c.attempts, c.backoff, c.backoffLimit)
+	}
+	if path, ok := strings.CutPrefix(c.base, "unix://"); ok {
+		hc := *c.http
+		hc.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}}
+		c.http, c.base = &hc, "http://localhost"
+	} else if !strings.HasPrefix(c.base, "http://") && !strings.HasPrefix(c.base, "https://") {
+		return nil, fmt.Errorf("client: base URL %q is not http://, https:// or unix://", baseURL)
+	}
+	return c, nil
+}
+
+// Error is a reply with a status of 300 or more.
+type Error struct {
+	StatusCode int
+	Message    string // the reply body, or its "error" field for JSON replies
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("camera driver replied %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func retryable(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retry runs try until it succeeds, fails for good or runs out of
+// attempts, sleeping the backoff in between.
+func (c *Client) retry(ctx context.Context, try func() error) error {
+	wait := c.backoff
+	for attempt := 1; ; attempt++ {
+		err := try()
+		var re *Error
+		if err == nil || ctx.Err() != nil || attempt == c.attempts || (errors.As(err, &re) && !retryable(re.StatusCode)) {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		if wait *= 2; wait > c.backoffLimit {
+			wait = c.backoffLimit
+		}
+	}
+}
+
+// send makes one request and returns the response if its status is below
+// 300; otherwise the body is read into an *Error.
+func (c *Client) send(ctx context.Context, hc *http.Client, method, path string, payload []byte) (*http.Response, error) {
+	var rd io.Reader
+	if payload != nil {
+		rd = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, rd)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	msg := strings.TrimSpace(string(body))
+	var reply struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &reply) == nil && reply.Error != "" {
+		msg = reply.Error
+	}
+	return nil, &Error{StatusCode: resp.StatusCode, Message: msg}
+}
+
+// do makes a call with retries and decodes the JSON reply into out unless
+// it is nil.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	return c.retry(ctx, func() error {
+		resp, err := c.send(ctx, c.http, method, path, payload)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if out == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			return nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("decode %s %s: %w", method, path, err)
+		}
+		return nil
+	})
+}
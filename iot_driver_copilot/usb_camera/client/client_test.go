@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAndErrors(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer k1" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/capture/start":
+			if got := r.URL.RawQuery; got != "format=YUYV&width=640" {
+				t.Errorf("query = %q", got)
+			}
+			if calls.Add(1) < 3 {
+				http.Error(w, "Camera is not capturing", http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprint(w, `{"status": "capture started"}`)
+		case "/capture/stop":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `{"error": "close failed"}`)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	c, err := New(srv.URL, WithAPIKey("k1"), WithRetry(3, time.Millisecond, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartCapture(ctx, CaptureOptions{Format: "YUYV", Width: 640}); err != nil || calls.Load() != 3 {
+		t.Fatalf("StartCapture = %v after %d calls", err, calls.Load())
+	}
+	var re *Error
+	if err := c.StopCapture(ctx); !errors.As(err, &re) || re.StatusCode != http.StatusInternalServerError || re.Message != "close failed" {
+		t.Errorf("StopCapture = %v", err)
+	}
+	c, _ = New(srv.URL, WithRetry(3, time.Millisecond, time.Millisecond))
+	if err := c.StopCapture(ctx); !errors.As(err, &re) || re.StatusCode != http.StatusUnauthorized {
+		t.Errorf("StopCapture without a key = %v", err)
+	}
+	if _, err := New("camera-1:8080"); err == nil {
+		t.Error("New accepted a base URL without a scheme")
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// --- CLIPS ---
+// GET /clip.gif?seconds=5 returns the last few seconds as an animated GIF,
+// small enough to embed in a chat alert; GET /clip.mp4 does the same through
+// ffmpeg when it is installed. Both are built from a buffer of recent frames
+// that every capture source feeds: the frames streams and snapshots read are
+// kept at CLIP_FPS, and while nobody reads the camera clipRecorder reads it
+// itself so the buffer stays current. Like snapshots, clips carry the
+// client's watermark and accept a ?token= stream token.
+
+type ClipConfig struct {
+	Seconds int // CLIP_BUFFER_SECONDS: how much recent video is kept; 0 turns clips off
+	FPS     int // CLIP_FPS: frames kept per second
+}
+
+var clipConfig = ClipConfig{Seconds: 10, FPS: 5}
+
+const (
+	defaultClipSeconds = 5
+	defaultClipWidth   = 320
+	maxClipFPS         = 30
+)
+
+// --- CLIP CONFIG ---
+func loadClipConfig() error {
+	clipConfig = ClipConfig{Seconds: 10, FPS: 5}
+	if v := os.Getenv("CLIP_BUFFER_SECONDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 300 {
+			return fmt.Errorf("CLIP_BUFFER_SECONDS must be between 0 and 300")
+		}
+		clipConfig.Seconds = n
+	}
+	if v := os.Getenv("CLIP_FPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxClipFPS {
+			return fmt.Errorf("CLIP_FPS must be between 1 and %d", maxClipFPS)
+		}
+		clipConfig.FPS = n
+	}
+	return nil
+}
+
+func (c ClipConfig) interval() time.Duration { return time.Second / time.Duration(c.FPS) }
+
+type clipFrame struct {
+	at     time.Time
+	frame  []byte
+	format string
+	width  uint32
+	height uint32
+}
+
+// clipBuffer holds the frames of the last CLIP_BUFFER_SECONDS, oldest first.
+type clipBuffer struct {
+	mu     sync.Mutex
+	frames []clipFrame
+}
+
+var clipFrames = &clipBuffer{}
+
+// add keeps a copy of frame unless one was kept less than a CLIP_FPS
+// interval ago. A change of format or size starts the buffer over, so a
+// clip never mixes frame sizes.
+func (b *clipBuffer) add(frame []byte, info sourceInfo, now time.Time) {
+	if clipConfig.Seconds <= 0 || len(frame) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n := len(b.frames); n > 0 {
+		last := b.frames[n-1]
+		if last.format != info.Format || last.width != info.Width || last.height != info.Height {
+			b.frames = b.frames[:0]
+		} else if now.Sub(last.at) < clipConfig.interval() {
+			return
+		}
+	}
+	b.frames = append(b.frames, clipFrame{at: now, frame: append([]byte(nil), frame...), format: info.Format, width: info.Width, height: info.Height})
+	cutoff := now.Add(-time.Duration(clipConfig.Seconds) * time.Second)
+	old := 0
+	for old < len(b.frames) && b.frames[old].at.Before(cutoff) {
+		old++
+	}
+	if old > 0 {
+		b.frames = append(b.frames[:0], b.frames[old:]...)
+	}
+}
+
+// since returns the frames kept after t.
+func (b *clipBuffer) since(t time.Time) []clipFrame {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []clipFrame
+	for _, f := range b.frames {
+		if f.at.After(t) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func (b *clipBuffer) latest() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.frames) == 0 {
+		return time.Time{}
+	}
+	return b.frames[len(b.frames)-1].at
+}
+
+func (b *clipBuffer) reset() {
+	b.mu.Lock()
+	b.frames = nil
+	b.mu.Unlock()
+}
+
+// clipTap feeds the frames read from a source into clipFrames.
+type clipTap struct {
+	FrameSource
+	info sourceInfo
+}
+
+func (s *clipTap) ReadFrame() ([]byte, error) {
+	frame, err := s.FrameSource.ReadFrame()
+	if len(frame) > 0 {
+		clipFrames.add(frame, s.info, time.Now())
+	}
+	return frame, err
+}
+
+// clipRecorder reads a frame whenever the buffer has gone two CLIP_FPS
+// intervals without one, which only happens while nobody else is reading
+// the camera.
+func clipRecorder(ctx context.Context) {
+	interval := clipConfig.interval()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		cameraState.mu.Lock()
+		running, cam := cameraState.running, cameraState.source
+		cameraState.mu.Unlock()
+		if !running || cam == nil || time.Since(clipFrames.latest()) < 2*interval {
+			continue
+		}
+		if cam.WaitForFrame(1) != nil {
+			continue
+		}
+		if frame, err := cam.ReadFrame(); len(frame) > 0 {
+			if err == nil {
+				markFrame()
+			}
+			releaseFrame(frame)
+		}
+	}
+}
+
+// clipRequest checks a clip request and returns its frames and output
+// width, answering the request itself when there is no clip to make.
+func clipRequest(w http.ResponseWriter, r *http.Request) ([]clipFrame, int, bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return nil, 0, false
+	}
+	if clipConfig.Seconds <= 0 {
+		http.Error(w, "Clips are disabled (CLIP_BUFFER_SECONDS=0)", http.StatusNotFound)
+		return nil, 0, false
+	}
+	q := r.URL.Query()
+	seconds := defaultClipSeconds
+	if seconds > clipConfig.Seconds {
+		seconds = clipConfig.Seconds
+	}
+	if v := q.Get("seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > clipConfig.Seconds {
+			http.Error(w, fmt.Sprintf("seconds must be between 1 and %d", clipConfig.Seconds), http.StatusBadRequest)
+			return nil, 0, false
+		}
+		seconds = n
+	}
+	width := defaultClipWidth
+	if v := q.Get("width"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 16 || n > maxFrameWidth {
+			http.Error(w, fmt.Sprintf("width must be between 16 and %d", maxFrameWidth), http.StatusBadRequest)
+			return nil, 0, false
+		}
+		width = n
+	}
+	cameraState.mu.Lock()
+	running := cameraState.running
+	cameraState.mu.Unlock()
+	if !running {
+		http.Error(w, "Camera is not capturing", http.StatusServiceUnavailable)
+		return nil, 0, false
+	}
+	frames := clipFrames.since(time.Now().Add(-time.Duration(seconds) * time.Second))
+	if len(frames) == 0 {
+		http.Error(w, "No recent frames to make a clip from", http.StatusServiceUnavailable)
+		return nil, 0, false
+	}
+	if width > int(frames[0].width) {
+		width = int(frames[0].width) // never upscale
+	}
+	return frames, width, true
+}
+
+func decodeClipFrame(f clipFrame) (image.Image, error) {
+	if f.format == "YUYV" {
+		return yuyvToImage(f.frame, int(f.width), int(f.height)), nil
+	}
+	return jpeg.Decode(bytes.NewReader(withDefaultHuffman(f.frame)))
+}
+
+// scaleToWidth resizes img to width, keeping its aspect ratio.
+func scaleToWidth(img image.Image, width int) *image.RGBA {
+	b := img.Bounds()
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	return dst
+}
+
+// clipDelays returns each frame's display time in hundredths of a second,
+// taken from when the frames were captured so the clip plays in real time.
+func clipDelays(frames []clipFrame) []int {
+	delays := make([]int, len(frames))
+	for i := range frames {
+		d := clipConfig.interval()
+		if i+1 < len(frames) {
+			d = frames[i+1].at.Sub(frames[i].at)
+		}
+		delays[i] = int((d + 5*time.Millisecond) / (10 * time.Millisecond))
+		if delays[i] < 2 {
+			delays[i] = 2 // browsers slow anything shorter down to 10
+		}
+	}
+	return delays
+}
+
+func handleClipGIF(w http.ResponseWriter, r *http.Request) {
+	frames, width, ok := clipRequest(w, r)
+	if !ok {
+		return
+	}
+	mark := watermarkFor(clientIDFromRequest(r))
+	delays := clipDelays(frames)
+	anim := &gif.GIF{}
+	for i, f := range frames {
+		img, err := decodeClipFrame(f)
+		if err != nil {
+			continue
+		}
+		var frame image.Image = scaleToWidth(img, width)
+		if mark != "" {
+			frame = watermarkImage(frame, mark)
+		}
+		p := image.NewPaletted(frame.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(p, p.Bounds(), frame, image.Point{})
+		anim.Image = append(anim.Image, p)
+		anim.Delay = append(anim.Delay, delays[i])
+	}
+	if len(anim.Image) == 0 {
+		http.Error(w, "No decodable frames in the clip buffer", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+	recordEvent("clip", clientIDFromRequest(r), map[string]interface{}{"format": "gif", "frames": len(anim.Image), "width": width})
+}
+
+// handleClipMP4 pipes the clip's frames, as JPEGs, through ffmpeg. The MP4
+// is fragmented so ffmpeg can write it to a pipe.
+func handleClipMP4(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		http.Error(w, "clip.mp4 needs ffmpeg on the PATH; use /clip.gif", http.StatusNotImplemented)
+		return
+	}
+	frames, width, ok := clipRequest(w, r)
+	if !ok {
+		return
+	}
+	mark := watermarkFor(clientIDFromRequest(r))
+	var in bytes.Buffer
+	for _, f := range frames {
+		jpg, err := snapshotJPEG(f.frame, f.format, f.width, f.height, mark)
+		if err != nil {
+			continue
+		}
+		in.Write(jpg)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ffmpeg, "-loglevel", "error", "-f", "mjpeg", "-framerate", strconv.Itoa(clipConfig.FPS), "-i", "-",
+		"-vf", fmt.Sprintf("scale=%d:-2", width&^1), "-an", "-pix_fmt", "yuv420p", "-movflags", "frag_keyframe+empty_moov", "-f", "mp4", "-")
+	var out, stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = &in, &out, &stderr
+	if err := cmd.Run(); err != nil {
+		http.Error(w, "ffmpeg: "+strings.TrimSpace(err.Error()+" "+stderr.String()), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	w.Write(out.Bytes())
+	recordEvent("clip", clientIDFromRequest(r), map[string]interface{}{"format": "mp4", "frames": len(frames), "width": width})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClipGIF(t *testing.T) {
+	savedCam, savedClip := cameraConfig, clipConfig
+	defer func() { closeCamera(); cameraConfig, clipConfig = savedCam, savedClip; clipFrames.reset() }()
+	cameraConfig = CameraConfig{DevicePath: "/dev/video-missing", Simulate: true, Format: "YUYV", Width: 64, Height: 48, FPS: 30}
+	clipConfig = ClipConfig{Seconds: 2, FPS: 10}
+	clipFrames.reset()
+
+	get := func(h http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+	if rec := get(handleClipGIF, "/clip.gif"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("not capturing: %d %s", rec.Code, rec.Body)
+	}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go clipRecorder(ctx)
+	for deadline := time.Now().Add(5 * time.Second); len(clipFrames.since(time.Time{})) < 3; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			cancel()
+			t.Fatalf("%d frames recorded in 5s", len(clipFrames.since(time.Time{})))
+		}
+	}
+	cancel()
+
+	rec := get(handleClipGIF, "/clip.gif?seconds=2&width=32")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/gif" {
+		t.Fatalf("GET /clip.gif = %d %s", rec.Code, rec.Body)
+	}
+	anim, err := gif.DecodeAll(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) < 3 || anim.Config.Width != 32 || anim.Config.Height != 24 {
+		t.Errorf("%d frames of %dx%d", len(anim.Image), anim.Config.Width, anim.Config.Height)
+	}
+	for _, d := range anim.Delay {
+		if d < 5 || d > 30 {
+			t.Errorf("delays %v, want about 10 at CLIP_FPS=10", anim.Delay)
+			break
+		}
+	}
+	if n := len(clipFrames.since(time.Time{})); n > 2*10+1 {
+		t.Errorf("buffer holds %d frames, more than CLIP_BUFFER_SECONDS*CLIP_FPS", n)
+	}
+
+	for target, want := range map[string]int{
+		"/clip.gif?seconds=3":  http.StatusBadRequest,
+		"/clip.gif?width=8":    http.StatusBadRequest,
+		"/clip.gif?width=4096": http.StatusOK, // capped at the frame width
+	} {
+		if rec := get(handleClipGIF, target); rec.Code != want {
+			t.Errorf("GET %s = %d, want %d", target, rec.Code, want)
+		}
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if rec := get(handleClipMP4, "/clip.mp4"); rec.Code != http.StatusNotImplemented {
+		t.Errorf("GET /clip.mp4 without ffmpeg = %d", rec.Code)
+	}
+	clipConfig.Seconds = 0
+	if rec := get(handleClipGIF, "/clip.gif"); rec.Code != http.StatusNotFound {
+		t.Errorf("clips off: %d", rec.Code)
+	}
+}
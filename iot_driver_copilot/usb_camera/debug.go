@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- DEBUG ENDPOINTS ---
+// DEBUG_ENDPOINTS=true serves runtime diagnostics to the API_KEYS clients
+// listed in DEBUG_CLIENTS, and to nobody else:
+//
+//	GET /debug/pprof/                    index of the profiles below
+//	GET /debug/pprof/profile?seconds=30  CPU profile, e.g. of YUYV conversion
+//	GET /debug/pprof/trace?seconds=1     execution trace
+//	GET /debug/pprof/NAME[?debug=1]      goroutine, heap, allocs, block, mutex, threadcreate
+//	GET /debug/goroutines                every goroutine's stack, as text
+//	GET /debug/memstats                  memory, GC and scheduler figures
+//
+// The profiles are written with runtime/pprof here rather than by
+// net/http/pprof, whose import alone would publish them on the default mux
+// this driver serves, past the key check. Block and mutex sampling is on
+// while the endpoints are.
+
+type DebugConfig struct {
+	Enabled bool            // DEBUG_ENDPOINTS
+	Clients map[string]bool // DEBUG_CLIENTS
+}
+
+var debugConfig DebugConfig
+
+const (
+	debugBlockRate     = int(100 * time.Microsecond)
+	debugMutexFraction = 10
+	debugMaxSeconds    = 300 // longest CPU profile or trace
+)
+
+func loadDebugConfig() error {
+	debugConfig = DebugConfig{Clients: map[string]bool{}}
+	switch v := strings.ToLower(os.Getenv("DEBUG_ENDPOINTS")); v {
+	case "", "false", "0":
+		return nil
+	case "true", "1":
+	default:
+		return fmt.Errorf("DEBUG_ENDPOINTS must be true or false, got %q", v)
+	}
+	if !authEnabled() {
+		return errors.New("DEBUG_ENDPOINTS needs API_KEYS and DEBUG_CLIENTS")
+	}
+	known := map[string]bool{}
+	for _, id := range apiKeys {
+		known[id] = true
+	}
+	for _, id := range strings.Split(os.Getenv("DEBUG_CLIENTS"), ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		if !known[id] {
+			return fmt.Errorf("DEBUG_CLIENTS: unknown client %q", id)
+		}
+		debugConfig.Clients[id] = true
+	}
+	if len(debugConfig.Clients) == 0 {
+		return errors.New("DEBUG_ENDPOINTS needs DEBUG_CLIENTS")
+	}
+	debugConfig.Enabled = true
+	runtime.SetBlockProfileRate(debugBlockRate)
+	runtime.SetMutexProfileFraction(debugMutexFraction)
+	return nil
+}
+
+// requireDebugClient wraps requireAuth, further limiting next to the
+// DEBUG_CLIENTS.
+func requireDebugClient(next http.HandlerFunc) http.HandlerFunc {
+	return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if !debugConfig.Clients[clientIDFromRequest(r)] {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func handleDebug(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch path := r.URL.Path; {
+	case path == "/debug/goroutines":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_ = pprof.Lookup("goroutine").WriteTo(w, 2)
+	case path == "/debug/memstats":
+		jsonResponse(w, http.StatusOK, memStats())
+	case path == "/debug/pprof/" || path == "/debug/pprof":
+		debugIndex(w)
+	case path == "/debug/pprof/profile":
+		debugTimed(w, r, 30, func() error { return pprof.StartCPUProfile(w) }, pprof.StopCPUProfile)
+	case path == "/debug/pprof/trace":
+		debugTimed(w, r, 1, func() error { return trace.Start(w) }, trace.Stop)
+	case strings.HasPrefix(path, "/debug/pprof/"):
+		p := pprof.Lookup(strings.TrimPrefix(path, "/debug/pprof/"))
+		if p == nil {
+			jsonResponse(w, http.StatusNotFound, map[string]string{"error": "unknown profile"})
+			return
+		}
+		level, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if level > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pprof"`, p.Name()))
+		}
+		_ = p.WriteTo(w, level)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func debugIndex(w http.ResponseWriter) {
+	var names []string
+	for _, p := range pprof.Profiles() {
+		names = append(names, fmt.Sprintf("%s\t%d", p.Name(), p.Count()))
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "profile\tCPU profile, ?seconds=30\ntrace\texecution trace, ?seconds=1\n%s\n", strings.Join(names, "\n"))
+}
+
+// debugTimed runs a CPU profile or trace into w for ?seconds=, or until the
+// client goes away.
+func debugTimed(w http.ResponseWriter, r *http.Request, def int, start func() error, stop func()) {
+	secs := def
+	if v := r.URL.Query().Get("seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > debugMaxSeconds {
+			jsonResponse(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("seconds must be 1..%d", debugMaxSeconds)})
+			return
+		}
+		secs = n
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := start(); err != nil {
+		w.Header().Del("Content-Type")
+		jsonResponse(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	select {
+	case <-time.After(time.Duration(secs) * time.Second):
+	case <-r.Context().Done():
+	}
+	stop()
+}
+
+func memStats() map[string]interface{} {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return map[string]interface{}{
+		"goroutines":        runtime.NumGoroutine(),
+		"gomaxprocs":        runtime.GOMAXPROCS(0),
+		"num_cpu":           runtime.NumCPU(),
+		"heap_alloc_bytes":  m.HeapAlloc,
+		"heap_inuse_bytes":  m.HeapInuse,
+		"heap_objects":      m.HeapObjects,
+		"stack_inuse_bytes": m.StackInuse,
+		"sys_bytes":         m.Sys,
+		"total_alloc_bytes": m.TotalAlloc,
+		"mallocs":           m.Mallocs,
+		"frees":             m.Frees,
+		"num_gc":            m.NumGC,
+		"gc_pause_total_ns": m.PauseTotalNs,
+		"last_gc":           time.Unix(0, int64(m.LastGC)).UTC(),
+		"gc_cpu_fraction":   m.GCCPUFraction,
+	}
+}
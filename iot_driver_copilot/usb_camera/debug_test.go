@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	savedKeys, savedDebug := apiKeys, debugConfig
+	t.Cleanup(func() {
+		apiKeys, debugConfig = savedKeys, savedDebug
+		runtime.SetBlockProfileRate(0)
+		runtime.SetMutexProfileFraction(0)
+	})
+	apiKeys = map[string]string{"k-ops": "ops", "k-alice": "alice"}
+	t.Setenv("DEBUG_ENDPOINTS", "true")
+	for _, tt := range []struct {
+		clients string
+		ok      bool
+	}{{"", false}, {"mallory", false}, {"ops", true}} {
+		t.Setenv("DEBUG_CLIENTS", tt.clients)
+		if err := loadDebugConfig(); (err == nil) != tt.ok {
+			t.Errorf("DEBUG_CLIENTS=%q: err = %v", tt.clients, err)
+		}
+	}
+
+	get := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		requireDebugClient(handleDebug)(rec, req)
+		return rec
+	}
+	for key, want := range map[string]int{"k-ops": 200, "k-alice": 403, "nope": 401} {
+		if rec := get("/debug/memstats", key); rec.Code != want {
+			t.Errorf("key %s: %d, want %d", key, rec.Code, want)
+		}
+	}
+	var m map[string]interface{}
+	if rec := get("/debug/memstats", "k-ops"); json.Unmarshal(rec.Body.Bytes(), &m) != nil || m["goroutines"].(float64) < 1 {
+		t.Errorf("memstats: %s", rec.Body)
+	}
+	if rec := get("/debug/goroutines", "k-ops"); !strings.Contains(rec.Body.String(), "goroutine ") {
+		t.Errorf("goroutines: %.200s", rec.Body)
+	}
+	if rec := get("/debug/pprof/", "k-ops"); !strings.Contains(rec.Body.String(), "mutex") {
+		t.Errorf("index: %s", rec.Body)
+	}
+	if rec := get("/debug/pprof/heap?debug=1", "k-ops"); rec.Code != 200 || !strings.Contains(rec.Body.String(), "heap profile") {
+		t.Errorf("heap: %d %.200s", rec.Code, rec.Body)
+	}
+	if rec := get("/debug/pprof/heap", "k-ops"); rec.Code != 200 || rec.Body.Len() == 0 || rec.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("heap proto: %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec := get("/debug/pprof/nope", "k-ops"); rec.Code != 404 {
+		t.Errorf("unknown profile: %d", rec.Code)
+	}
+	if rec := get("/debug/pprof/profile?seconds=1", "k-ops"); rec.Code != 200 || rec.Body.Len() == 0 {
+		t.Errorf("cpu profile: %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	if rec := get("/debug/pprof/trace?seconds=0", "k-ops"); rec.Code != 400 {
+		t.Errorf("trace seconds=0: %d", rec.Code)
+	}
+}
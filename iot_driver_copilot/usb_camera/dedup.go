@@ -0,0 +1,56 @@
+package main
+
+import (
+	"hash/maphash"
+	"sync"
+)
+
+// A static scene yields the same raw frame over and over, and encoding
+// each copy again is wasted CPU. snapshotJPEG remembers its last few
+// results keyed by a hash of the raw frame, its size and the watermark, and
+// hands the same JPEG to every client that asks for an identical frame.
+// FRAME_DEDUP=false turns this off. Cached JPEGs are shared and must not be
+// modified.
+
+const jpegCacheSize = 8 // a few entries, so per-client watermarks don't evict each other
+
+type jpegCacheKey struct {
+	sum           uint64
+	format        string
+	width, height uint32
+	mark          string
+}
+
+type jpegCache struct {
+	mu      sync.Mutex
+	seed    maphash.Seed
+	entries [jpegCacheSize]struct {
+		key jpegCacheKey
+		jpg []byte
+	}
+	next int
+}
+
+var frameCache = jpegCache{seed: maphash.MakeSeed()}
+
+func (c *jpegCache) key(frame []byte, format string, width, height uint32, mark string) jpegCacheKey {
+	return jpegCacheKey{maphash.Bytes(c.seed, frame), format, width, height, mark}
+}
+
+func (c *jpegCache) get(k jpegCacheKey) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		if e.jpg != nil && e.key == k {
+			return e.jpg
+		}
+	}
+	return nil
+}
+
+func (c *jpegCache) put(k jpegCacheKey, jpg []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[c.next].key, c.entries[c.next].jpg = k, jpg
+	c.next = (c.next + 1) % jpegCacheSize
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+type countingEncoder struct{ calls int }
+
+func (*countingEncoder) Name() string { return "counting" }
+func (e *countingEncoder) EncodeYUYV(frame []byte, width, height, quality int) ([]byte, error) {
+	e.calls++
+	return softwareEncoder{}.EncodeYUYV(frame, width, height, quality)
+}
+func (*countingEncoder) Close() error { return nil }
+
+func TestSnapshotJPEGDedup(t *testing.T) {
+	saved := encoderConfig
+	defer func() { encoderConfig = saved; activeEncoder.Store(nil); frameCache = jpegCache{seed: frameCache.seed} }()
+	encoderConfig.Dedup = true
+	counter := &countingEncoder{}
+	var enc jpegEncoder = counter
+	activeEncoder.Store(&enc)
+
+	frame := make([]byte, 16*8*2)
+	first, err := snapshotJPEG(frame, "YUYV", 16, 8, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := snapshotJPEG(append([]byte(nil), frame...), "YUYV", 16, 8, "")
+	if counter.calls != 1 || &again[0] != &first[0] {
+		t.Fatalf("identical frame encoded %d times", counter.calls)
+	}
+	frame[0] = 200
+	if _, err := snapshotJPEG(frame, "YUYV", 16, 8, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := snapshotJPEG(frame, "YUYV", 8, 16, ""); err != nil {
+		t.Fatal(err)
+	}
+	if counter.calls != 3 {
+		t.Errorf("changed frames: %d encodes, want 3", counter.calls)
+	}
+
+	encoderConfig.Dedup = false
+	snapshotJPEG(frame, "YUYV", 16, 8, "")
+	if counter.calls != 4 {
+		t.Errorf("FRAME_DEDUP=false still served from the cache")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// --- GAUGE DISPLAY LINK ---
+// With GAUGE_DISPLAY_URL the gauge reading goes straight to a
+// modbus_display driver, so a camera watching a meter drives an LED sign
+// with no glue in between. The text is formatted for the sign:
+//
+//	GAUGE_DISPLAY_DECIMALS  decimals shown (default GAUGE_DECIMALS)
+//	GAUGE_DISPLAY_UNIT      appended to the number, e.g. "C" for 21.5C
+//	GAUGE_DISPLAY_WIDTH     characters the sign has (default 0, no limit).
+//	                        A value that is too wide loses decimals, then
+//	                        the unit; one that still doesn't fit shows
+//	                        GAUGE_DISPLAY_STALE_TEXT.
+//	GAUGE_DISPLAY_ZONE      the slave id of one display on a multi-display
+//	                        bus, written through PUT /devices/value; without
+//	                        it, PUT /display/value writes the driver's own
+//	                        SLAVE_ID.
+//
+// Writes are transient ("persist": false). With GAUGE_DISPLAY_STALE_MS set,
+// a display that has not been given a reading for that long, because the
+// gauge fails to read or capture stopped, shows GAUGE_DISPLAY_STALE_TEXT
+// (default "----") until the next reading, rather than a number that is no
+// longer true. GET /gauge reports what the display was last sent.
+
+// defaultStaleText is what a stale or overflowing display shows.
+const defaultStaleText = "----"
+
+var gaugeDisplayWrites, gaugeDisplayErrors atomic.Uint64
+
+func loadGaugeDisplayConfig() error {
+	gaugeConfig.DisplayDecimals = gaugeConfig.Decimals
+	gaugeConfig.DisplayStaleText = defaultStaleText
+	gaugeConfig.DisplayToken = os.Getenv("GAUGE_DISPLAY_TOKEN")
+	if gaugeConfig.DisplayURL == "" {
+		for _, name := range []string{"GAUGE_DISPLAY_ZONE", "GAUGE_DISPLAY_UNIT", "GAUGE_DISPLAY_STALE_MS"} {
+			if os.Getenv(name) != "" {
+				return fmt.Errorf("%s needs GAUGE_DISPLAY_URL", name)
+			}
+		}
+		return nil
+	}
+	for _, s := range []struct {
+		name     string
+		dst      *int
+		min, max int
+	}{
+		{"GAUGE_DISPLAY_DECIMALS", &gaugeConfig.DisplayDecimals, 0, 6},
+		{"GAUGE_DISPLAY_WIDTH", &gaugeConfig.DisplayWidth, 0, 64},
+		{"GAUGE_DISPLAY_ZONE", &gaugeConfig.DisplayZone, 1, 247},
+	} {
+		if v := os.Getenv(s.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < s.min || n > s.max {
+				return fmt.Errorf("%s must be between %d and %d", s.name, s.min, s.max)
+			}
+			*s.dst = n
+		}
+	}
+	if v := os.Getenv("GAUGE_DISPLAY_STALE_MS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 86400000 {
+			return errors.New("GAUGE_DISPLAY_STALE_MS must be between 0 and 86400000")
+		}
+		gaugeConfig.DisplayStale = time.Duration(n) * time.Millisecond
+		if n > 0 && gaugeConfig.DisplayStale <= gaugeConfig.Interval {
+			return errors.New("GAUGE_DISPLAY_STALE_MS must be longer than GAUGE_INTERVAL_MS")
+		}
+	}
+	gaugeConfig.DisplayUnit = os.Getenv("GAUGE_DISPLAY_UNIT")
+	if v, ok := os.LookupEnv("GAUGE_DISPLAY_STALE_TEXT"); ok {
+		if v == "" {
+			return errors.New("GAUGE_DISPLAY_STALE_TEXT must not be empty")
+		}
+		gaugeConfig.DisplayStaleText = v
+	}
+	if w := gaugeConfig.DisplayWidth; w > 0 && utf8.RuneCountInString(gaugeConfig.DisplayStaleText) > w {
+		return fmt.Errorf("GAUGE_DISPLAY_STALE_TEXT %q is wider than GAUGE_DISPLAY_WIDTH", gaugeConfig.DisplayStaleText)
+	}
+	return nil
+}
+
+// displayText formats value for the sign: GAUGE_DISPLAY_DECIMALS and
+// GAUGE_DISPLAY_UNIT, shortened to GAUGE_DISPLAY_WIDTH. ok is false when
+// even the bare integer is too wide.
+func displayText(value float64) (text string, ok bool) {
+	width := gaugeConfig.DisplayWidth
+	fits := func(s string) bool { return width == 0 || utf8.RuneCountInString(s) <= width }
+	for _, unit := range []string{gaugeConfig.DisplayUnit, ""} {
+		for dec := gaugeConfig.DisplayDecimals; dec >= 0; dec-- {
+			if s := strconv.FormatFloat(value, 'f', dec, 64) + unit; fits(s) {
+				return s, true
+			}
+		}
+	}
+	return gaugeConfig.DisplayStaleText, false
+}
+
+// displayLink writes readings to the modbus_display driver and the
+// fallback when they stop.
+type displayLink struct {
+	http *http.Client
+
+	mu       sync.Mutex
+	last     time.Time // the last reading shown, or the start
+	stale    bool      // GAUGE_DISPLAY_STALE_TEXT is shown for want of readings
+	shown    string
+	shownAt  time.Time
+	writeErr string
+}
+
+func newDisplayLink(now time.Time) *displayLink {
+	return &displayLink{http: &http.Client{Timeout: 10 * time.Second}, last: now}
+}
+
+// show writes a reading.
+func (l *displayLink) show(ctx context.Context, value float64, now time.Time) {
+	text, ok := displayText(value)
+	if !ok {
+		log.Printf("gauge display: %s does not fit in %d characters", strconv.FormatFloat(value, 'f', -1, 64), gaugeConfig.DisplayWidth)
+	}
+	l.mu.Lock()
+	l.last, l.stale = now, false
+	l.mu.Unlock()
+	l.write(ctx, text, now)
+}
+
+// checkStale shows GAUGE_DISPLAY_STALE_TEXT once no reading has come for
+// GAUGE_DISPLAY_STALE_MS.
+func (l *displayLink) checkStale(ctx context.Context, now time.Time) {
+	if gaugeConfig.DisplayStale == 0 {
+		return
+	}
+	l.mu.Lock()
+	due := !l.stale && now.Sub(l.last) >= gaugeConfig.DisplayStale
+	if due {
+		l.stale = true
+	}
+	l.mu.Unlock()
+	if due {
+		log.Printf("gauge display: no reading for %v, showing %q", gaugeConfig.DisplayStale, gaugeConfig.DisplayStaleText)
+		l.write(ctx, gaugeConfig.DisplayStaleText, now)
+	}
+}
+
+// run watches for staleness until ctx ends.
+func (l *displayLink) run(ctx context.Context) {
+	if gaugeConfig.DisplayStale == 0 {
+		return
+	}
+	t := time.NewTicker(gaugeConfig.DisplayStale / 4)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			l.checkStale(ctx, now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// write sends text to GAUGE_DISPLAY_ZONE, or the driver's own display.
+func (l *displayLink) write(ctx context.Context, text string, now time.Time) {
+	path, payload := "/display/value", map[string]interface{}{"display_value": text, "persist": false}
+	if gaugeConfig.DisplayZone != 0 {
+		path, payload = "/devices/value", map[string]interface{}{"values": map[string]string{strconv.Itoa(gaugeConfig.DisplayZone): text}}
+	}
+	err := l.put(ctx, path, payload)
+	l.mu.Lock()
+	if err != nil {
+		l.writeErr = err.Error()
+	} else {
+		l.shown, l.shownAt, l.writeErr = text, now.UTC(), ""
+	}
+	l.mu.Unlock()
+	if err != nil {
+		gaugeDisplayErrors.Add(1)
+		log.Printf("gauge display %s: %v", gaugeConfig.DisplayURL, err)
+		return
+	}
+	gaugeDisplayWrites.Add(1)
+}
+
+func (l *displayLink) put(ctx context.Context, path string, payload interface{}) error {
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, gaugeConfig.DisplayURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if gaugeConfig.DisplayToken != "" {
+		req.Header.Set("Authorization", "Bearer "+gaugeConfig.DisplayToken)
+	}
+	resp, err := l.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var msg bytes.Buffer
+		_, _ = msg.ReadFrom(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("PUT %s returned %s %s", path, resp.Status, strings.TrimSpace(msg.String()))
+	}
+	return nil
+}
+
+// status is the "display" part of GET /gauge.
+func (l *displayLink) status() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := map[string]interface{}{"url": gaugeConfig.DisplayURL, "stale": l.stale}
+	if gaugeConfig.DisplayZone != 0 {
+		st["zone"] = gaugeConfig.DisplayZone
+	}
+	if l.shown != "" {
+		st["text"], st["time"] = l.shown, l.shownAt
+	}
+	if l.writeErr != "" {
+		st["error"] = l.writeErr
+	}
+	return st
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDisplayText(t *testing.T) {
+	saved := gaugeConfig
+	defer func() { gaugeConfig = saved }()
+	gaugeConfig = GaugeConfig{DisplayDecimals: 2, DisplayUnit: "C", DisplayWidth: 5, DisplayStaleText: defaultStaleText}
+	for _, c := range []struct {
+		value float64
+		want  string
+		ok    bool
+	}{
+		{1.5, "1.50C", true},
+		{21.54, "21.5C", true},
+		{-21.54, "-22C", true},
+		{1234.4, "1234C", true},
+		{12345, "12345", true},
+		{123456, "----", false},
+	} {
+		if got, ok := displayText(c.value); got != c.want || ok != c.ok {
+			t.Errorf("displayText(%v) = %q, %v; want %q, %v", c.value, got, ok, c.want, c.ok)
+		}
+	}
+	gaugeConfig.DisplayWidth = 0
+	if got, _ := displayText(123456); got != "123456.00C" {
+		t.Errorf("without a width: %q", got)
+	}
+}
+
+func TestDisplayLinkZoneAndStale(t *testing.T) {
+	saved := gaugeConfig
+	defer func() { gaugeConfig = saved }()
+	type write struct {
+		path   string
+		values map[string]string
+	}
+	writes := make(chan write, 4)
+	display := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ Values map[string]string }
+		json.NewDecoder(r.Body).Decode(&req)
+		writes <- write{r.URL.Path, req.Values}
+	}))
+	defer display.Close()
+	gaugeConfig = GaugeConfig{Interval: time.Second, DisplayURL: display.URL, DisplayZone: 3, DisplayDecimals: 1,
+		DisplayStale: 10 * time.Second, DisplayStaleText: "--"}
+	t0 := time.Now()
+	l := newDisplayLink(t0)
+	next := func() write {
+		select {
+		case w := <-writes:
+			return w
+		default:
+			t.Fatal("nothing written")
+			return write{}
+		}
+	}
+
+	l.show(context.Background(), 7.25, t0)
+	if w := next(); w.path != "/devices/value" || w.values["3"] != "7.2" {
+		t.Errorf("reading written as %+v", w)
+	}
+	l.checkStale(context.Background(), t0.Add(9*time.Second))
+	if len(writes) != 0 {
+		t.Fatal("fallback shown before GAUGE_DISPLAY_STALE_MS")
+	}
+	l.checkStale(context.Background(), t0.Add(10*time.Second))
+	if w := next(); w.values["3"] != "--" {
+		t.Errorf("fallback written as %+v", w)
+	}
+	l.checkStale(context.Background(), t0.Add(20*time.Second))
+	if len(writes) != 0 {
+		t.Error("fallback written twice")
+	}
+	if st := l.status(); st["stale"] != true || st["text"] != "--" || st["zone"] != 3 {
+		t.Errorf("status %v", st)
+	}
+	l.show(context.Background(), 8, t0.Add(21*time.Second))
+	if w := next(); w.values["3"] != "8.0" || l.status()["stale"] != false {
+		t.Errorf("reading after the fallback written as %+v", w)
+	}
+}
+
+func TestLoadGaugeDisplayConfig(t *testing.T) {
+	defer func() { gaugeConfig, gauge = GaugeConfig{}, nil }()
+	base := map[string]string{"GAUGE_ANALYZER": "dial", "GAUGE_ROI": "gauge"}
+	for _, env := range []map[string]string{
+		{"GAUGE_DISPLAY_ZONE": "2"},
+		{"GAUGE_DISPLAY_URL": "http://display:8080", "GAUGE_DISPLAY_ZONE": "300"},
+		{"GAUGE_DISPLAY_URL": "http://display:8080", "GAUGE_DISPLAY_STALE_MS": "1000"},
+		{"GAUGE_DISPLAY_URL": "http://display:8080", "GAUGE_DISPLAY_WIDTH": "3"},
+	} {
+		t.Run("", func(t *testing.T) {
+			for k, v := range base {
+				t.Setenv(k, v)
+			}
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if loadGaugeConfig() == nil {
+				t.Errorf("%v accepted", env)
+			}
+		})
+	}
+	for k, v := range base {
+		t.Setenv(k, v)
+	}
+	t.Setenv("GAUGE_DECIMALS", "2")
+	t.Setenv("GAUGE_DISPLAY_URL", "http://display:8080")
+	t.Setenv("GAUGE_DISPLAY_UNIT", "bar")
+	if err := loadGaugeConfig(); err != nil || gaugeConfig.DisplayDecimals != 2 || gaugeConfig.DisplayUnit != "bar" ||
+		gaugeConfig.DisplayStaleText != "----" || gauge.display == nil {
+		t.Errorf("%+v %v", gaugeConfig, err)
+	}
+}
@@ -1,18 +1,24 @@
-```go
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/jpeg"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/blackjack/webcam"
@@ -24,13 +30,19 @@ type CameraConfig struct {
 	Width       uint32
 	Height      uint32
 	FPS         uint32
+	Simulate    bool   // generate synthetic frames instead of opening DevicePath
+	Backend     string // CAPTURE_BACKEND, see openFrameSource
+	GstPipeline string // gstreamer backend source pipeline
+	CaptureURL  string // file backend: MJPEG file, video file or RTSP URL
+	USBID       string // CAMERA_USB_ID: pick the node by vendor:product instead of DevicePath
+	BusInfo     string // CAMERA_BUS_INFO: pick the node by its V4L2 bus info
 }
 
 type CameraState struct {
 	mu        sync.Mutex
 	running   bool
-	webcam    *webcam.Webcam
-	format    webcam.PixelFormat
+	source    FrameSource
+	gen       atomic.Uint64 // bumped whenever reconfigureCamera replaces source
 	width     uint32
 	height    uint32
 	fps       uint32
@@ -48,6 +60,9 @@ func loadEnvConfig() error {
 	if cameraConfig.DevicePath == "" {
 		cameraConfig.DevicePath = "/dev/video0"
 	}
+	if err := loadNodeMatch(&cameraConfig); err != nil {
+		return err
+	}
 	cameraConfig.Format = strings.ToUpper(os.Getenv("CAMERA_FORMAT"))
 	if cameraConfig.Format == "" {
 		cameraConfig.Format = "MJPEG"
@@ -58,21 +73,26 @@ func loadEnvConfig() error {
 	cameraConfig.Width = 640
 	cameraConfig.Height = 480
 	cameraConfig.FPS = 15
+	var err error
 	if width != "" {
-		if w, err := strconv.Atoi(width); err == nil {
-			cameraConfig.Width = uint32(w)
+		if cameraConfig.Width, err = parseFrameParam("CAMERA_WIDTH", width, maxFrameWidth); err != nil {
+			return err
 		}
 	}
 	if height != "" {
-		if h, err := strconv.Atoi(height); err == nil {
-			cameraConfig.Height = uint32(h)
+		if cameraConfig.Height, err = parseFrameParam("CAMERA_HEIGHT", height, maxFrameHeight); err != nil {
+			return err
 		}
 	}
 	if fps != "" {
-		if f, err := strconv.Atoi(fps); err == nil {
-			cameraConfig.FPS = uint32(f)
+		if cameraConfig.FPS, err = parseFrameParam("CAMERA_FPS", fps, maxFrameRate); err != nil {
+			return err
 		}
 	}
+	cameraConfig.Simulate = strings.EqualFold(os.Getenv("SIMULATE"), "true")
+	cameraConfig.Backend = strings.ToLower(os.Getenv("CAPTURE_BACKEND"))
+	cameraConfig.GstPipeline = os.Getenv("GST_PIPELINE")
+	cameraConfig.CaptureURL = os.Getenv("CAPTURE_URL")
 	return nil
 }
 
@@ -83,59 +103,29 @@ func openCamera() error {
 	if cameraState.running {
 		return nil
 	}
-	cam, err := webcam.Open(cameraConfig.DevicePath)
+	src, info, err := openFrameSource(cameraConfig)
 	if err != nil {
+		_ = sdNotify("STATUS=camera open failed: " + err.Error())
 		return err
 	}
-	formatDesc := cam.GetSupportedFormats()
-	var pixFmt webcam.PixelFormat
-	for k, v := range formatDesc {
-		if (cameraConfig.Format == "MJPEG" && strings.Contains(v, "MJPEG")) ||
-			(cameraConfig.Format == "YUYV" && strings.Contains(v, "YUYV")) {
-			pixFmt = k
-			break
-		}
-	}
-	if pixFmt == 0 {
-		cam.Close()
-		return errors.New("unsupported camera format")
-	}
-	width, height, fps, err := selectFrameSizeAndFPS(cam, pixFmt)
-	if err != nil {
-		cam.Close()
-		return err
-	}
-	_, _, _, err = cam.SetImageFormat(pixFmt, width, height)
-	if err != nil {
-		cam.Close()
-		return err
-	}
-	err = cam.SetFramerate(fps)
-	if err != nil {
-		cam.Close()
-		return err
-	}
-	if _, err := cam.StartStreaming(); err != nil {
-		cam.Close()
-		return err
-	}
-	cameraState.webcam = cam
-	cameraState.format = pixFmt
-	cameraState.width = width
-	cameraState.height = height
-	cameraState.fps = fps
-	cameraState.formatStr = cameraConfig.Format
+	cameraState.source = src
+	cameraState.width = info.Width
+	cameraState.height = info.Height
+	cameraState.fps = info.FPS
+	cameraState.formatStr = info.Format
 	cameraState.running = true
+	_ = sdNotify(fmt.Sprintf("STATUS=capturing %s %dx%d@%d", info.Format, info.Width, info.Height, info.FPS))
+	recordEvent("capture_started", "", map[string]interface{}{"format": info.Format, "width": info.Width, "height": info.Height, "fps": info.FPS})
 	return nil
 }
 
-func selectFrameSizeAndFPS(cam *webcam.Webcam, pixFmt webcam.PixelFormat) (uint32, uint32, uint32, error) {
+func selectFrameSizeAndFPS(cam *webcam.Webcam, pixFmt webcam.PixelFormat, cfg CameraConfig) (uint32, uint32, uint32, error) {
 	framesizes := cam.GetSupportedFrameSizes(pixFmt)
 	var width, height uint32
 	for _, size := range framesizes {
-		if size.MaxWidth >= cameraConfig.Width && size.MaxHeight >= cameraConfig.Height {
-			width = cameraConfig.Width
-			height = cameraConfig.Height
+		if size.MaxWidth >= cfg.Width && size.MaxHeight >= cfg.Height {
+			width = cfg.Width
+			height = cfg.Height
 			break
 		}
 	}
@@ -145,19 +135,22 @@ func selectFrameSizeAndFPS(cam *webcam.Webcam, pixFmt webcam.PixelFormat) (uint3
 		height = framesizes[0].MaxHeight
 	}
 	// FPS selection
-	fps := cameraConfig.FPS
+	fps := cfg.FPS
 	return width, height, fps, nil
 }
 
 func closeCamera() error {
 	cameraState.mu.Lock()
 	defer cameraState.mu.Unlock()
-	if cameraState.running && cameraState.webcam != nil {
-		cameraState.webcam.StopStreaming()
-		cameraState.webcam.Close()
-		cameraState.webcam = nil
+	if cameraState.running && cameraState.source != nil {
+		cameraState.source.StopStreaming()
+		cameraState.source.Close()
+		cameraState.source = nil
 		cameraState.running = false
+		_ = sdNotify("STATUS=idle, camera closed")
+		recordEvent("capture_stopped", "", nil)
 	}
+	endPlayback()
 	return nil
 }
 
@@ -168,38 +161,75 @@ func jsonResponse(w http.ResponseWriter, code int, data interface{}) {
 	_ = json.NewEncoder(w).Encode(data)
 }
 
+// parseFrameParam parses a width, height or fps value in 1..max.
+func parseFrameParam(name, s string, max int) (uint32, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil || v <= 0 || v > max {
+		return 0, fmt.Errorf("%s must be an integer from 1 to %d", name, max)
+	}
+	return uint32(v), nil
+}
+
 func handleStartCapture(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	dry, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
 	// Optional format and resolution via query or body
 	format := r.URL.Query().Get("format")
 	width := r.URL.Query().Get("width")
 	height := r.URL.Query().Get("height")
 	fps := r.URL.Query().Get("fps")
-	if format != "" {
-		cameraConfig.Format = strings.ToUpper(format)
-	}
+	// Validate everything before touching cameraConfig so a bad request
+	// leaves the previous settings intact.
+	wv, hv, fv := cameraConfig.Width, cameraConfig.Height, cameraConfig.FPS
+	var err error
 	if width != "" {
-		if wv, err := strconv.Atoi(width); err == nil {
-			cameraConfig.Width = uint32(wv)
+		if wv, err = parseFrameParam("width", width, maxFrameWidth); err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
 		}
 	}
 	if height != "" {
-		if hv, err := strconv.Atoi(height); err == nil {
-			cameraConfig.Height = uint32(hv)
+		if hv, err = parseFrameParam("height", height, maxFrameHeight); err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
 		}
 	}
 	if fps != "" {
-		if f, err := strconv.Atoi(fps); err == nil {
-			cameraConfig.FPS = uint32(f)
+		if fv, err = parseFrameParam("fps", fps, maxFrameRate); err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
 		}
 	}
+	if dry {
+		cfg := cameraConfig
+		if format != "" {
+			cfg.Format = strings.ToUpper(format)
+		}
+		cfg.Width, cfg.Height, cfg.FPS = wv, hv, fv
+		var ops []plannedOp
+		cameraState.mu.Lock()
+		if !cameraState.running {
+			ops = append(ops, openSourceOp(cfg))
+		}
+		cameraState.mu.Unlock()
+		replyDryRun(w, append(ops, saveCaptureStateOps()...))
+		return
+	}
+	if format != "" {
+		cameraConfig.Format = strings.ToUpper(format)
+	}
+	cameraConfig.Width, cameraConfig.Height, cameraConfig.FPS = wv, hv, fv
 	if err := openCamera(); err != nil {
 		jsonResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
+	saveCaptureState(true)
 	jsonResponse(w, http.StatusOK, map[string]string{"status": "capture started"})
 }
 
@@ -212,10 +242,25 @@ func handleStopCapture(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if dry, ok := dryRunRequested(w, r); !ok {
+		return
+	} else if dry {
+		var ops []plannedOp
+		cameraState.mu.Lock()
+		if playbackState.active {
+			ops = append(ops, plannedOp{Op: "stop_playback", Detail: map[string]string{"clip": playbackState.clip}})
+		} else if cameraState.running && cameraState.source != nil {
+			ops = append(ops, closeSourceOp())
+		}
+		cameraState.mu.Unlock()
+		replyDryRun(w, append(ops, saveCaptureStateOps()...))
+		return
+	}
 	if err := closeCamera(); err != nil {
 		jsonResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
+	saveCaptureState(false)
 	jsonResponse(w, http.StatusOK, map[string]string{"status": "capture stopped"})
 }
 
@@ -232,20 +277,30 @@ func handleStream(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Camera is not capturing", http.StatusServiceUnavailable)
 		return
 	}
-	format := r.URL.Query().Get("format")
+	cameraState.mu.Lock()
+	captured := cameraState.formatStr
+	cameraState.mu.Unlock()
+	format := strings.ToUpper(r.URL.Query().Get("format"))
 	if format == "" {
-		format = cameraState.formatStr
+		format = captured
 	}
-	format = strings.ToUpper(format)
 	if format != "MJPEG" && format != "YUYV" {
 		http.Error(w, "Only MJPEG or YUYV supported", http.StatusBadRequest)
 		return
 	}
+	// The stream only relabels frames, it cannot convert between formats.
+	if format != captured {
+		http.Error(w, "Camera is capturing "+captured+", not "+format, http.StatusBadRequest)
+		return
+	}
+	client, started := clientIDFromRequest(r), time.Now()
+	recordEvent("stream_started", client, map[string]interface{}{"format": format})
 	if format == "MJPEG" {
 		streamMJPEG(w, r)
 	} else {
 		streamYUYV(w, r)
 	}
+	recordEvent("stream_ended", client, map[string]interface{}{"format": format, "seconds": int(time.Since(started).Seconds())})
 }
 
 // /video/stream and /stream are the same
@@ -253,6 +308,130 @@ func handleVideoStream(w http.ResponseWriter, r *http.Request) {
 	handleStream(w, r)
 }
 
+// handleSnapshot serves one JPEG frame, watermarked like the client's
+// streams, with EXIF provenance unless SNAPSHOT_EXIF=false. With
+// ?full_res=true the frame is a still at the sensor's largest size (still.go).
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Has("average") {
+		handleAveragedSnapshot(w, r)
+		return
+	}
+	if r.URL.Query().Get("full_res") == "true" {
+		handleStill(w, r)
+		return
+	}
+	cameraState.mu.Lock()
+	running := cameraState.running
+	cam := cameraState.source
+	format := cameraState.formatStr
+	width, height := cameraState.width, cameraState.height
+	cameraState.mu.Unlock()
+	if !running {
+		http.Error(w, "Camera is not capturing", http.StatusServiceUnavailable)
+		return
+	}
+	frame, ok := grabFrame(w, cam)
+	if !ok {
+		return
+	}
+	defer releaseFrame(frame)
+	writeSnapshot(w, r, "snapshot", frame, format, width, height)
+}
+
+// writeSnapshot answers a snapshot request with frame and records it as an
+// event of type kind.
+func writeSnapshot(w http.ResponseWriter, r *http.Request, kind string, frame []byte, format string, width, height uint32) {
+	at := frameTimeOf(frame)
+	jpg, err := snapshotJPEG(frame, format, width, height, watermarkFor(clientIDFromRequest(r)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if exifConfig.Enabled {
+		jpg = withExif(jpg, snapshotMeta{Taken: at.Captured, Width: width, Height: height})
+	}
+	for _, h := range at.headers() {
+		k, v, _ := strings.Cut(h, ": ")
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(jpg)))
+	w.Write(jpg)
+	recordEvent(kind, clientIDFromRequest(r), map[string]interface{}{"width": width, "height": height})
+}
+
+// grabFrame reads one frame for a single-shot request, answering the
+// request itself when none arrives.
+func grabFrame(w http.ResponseWriter, cam FrameSource) ([]byte, bool) {
+	var frame []byte
+	for attempt := 0; attempt < 3 && len(frame) == 0; attempt++ {
+		if err := cam.WaitForFrame(5); err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			captureErrors.Add(1)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+		var err error
+		if frame, err = cam.ReadFrame(); err != nil && !isTimeout(err) {
+			captureErrors.Add(1)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+	if len(frame) == 0 {
+		http.Error(w, "No frame received from camera", http.StatusGatewayTimeout)
+		return nil, false
+	}
+	markFrame()
+	return frame, true
+}
+
+// snapshotJPEG turns a captured frame into a standalone JPEG: MJPEG frames
+// get the Huffman tables UVC cameras leave out, YUYV and watermarked
+// frames are encoded, or taken from frameCache when an identical frame was.
+func snapshotJPEG(frame []byte, format string, width, height uint32, mark string) ([]byte, error) {
+	if format == "MJPEG" && mark == "" {
+		return withDefaultHuffman(frame), nil
+	}
+	if !encoderConfig.Dedup {
+		return encodeJPEG(frame, format, width, height, mark)
+	}
+	key := frameCache.key(frame, format, width, height, mark)
+	if jpg := frameCache.get(key); jpg != nil {
+		return jpg, nil
+	}
+	jpg, err := encodeJPEG(frame, format, width, height, mark)
+	if err == nil {
+		frameCache.put(key, jpg)
+	}
+	return jpg, err
+}
+
+func encodeJPEG(frame []byte, format string, width, height uint32, mark string) ([]byte, error) {
+	if format == "MJPEG" {
+		return watermarkJPEG(frame, mark)
+	}
+	if mark == "" {
+		return encodeYUYVJPEG(frame, int(width), int(height))
+	}
+	img := watermarkImage(yuyvToImage(frame, int(width), int(height)), mark)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: watermarkConfig.Quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// maxUndecodableFrames ends a watermarked MJPEG stream after this many
+// consecutive frames fail to decode.
+const maxUndecodableFrames = 30
+
 func streamMJPEG(w http.ResponseWriter, r *http.Request) {
 	boundary := "mjpegstream"
 	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
@@ -261,31 +440,83 @@ func streamMJPEG(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
 		return
 	}
-	cameraState.mu.Lock()
-	cam := cameraState.webcam
-	width := cameraState.width
-	height := cameraState.height
-	cameraState.mu.Unlock()
+	feed := newStreamFeed()
+	mark := watermarkFor(clientIDFromRequest(r))
+	badFrames := 0
+	activeStreams.Add(1)
+	defer activeStreams.Add(-1)
+	sc := openStreamClient(r, "multipart")
+	defer sc.close()
 	for {
-		err := cam.WaitForFrame(5)
-		if err != nil && err != webcam.ErrTimeout {
+		if r.Context().Err() != nil {
+			break
+		}
+		if !feed.follow(false) {
+			break
+		}
+		err := feed.src.WaitForFrame(5)
+		if err != nil && !isTimeout(err) {
+			captureErrors.Add(1)
+			if feed.follow(true) {
+				continue
+			}
 			break
 		}
-		frame, err := cam.ReadFrame()
+		frame, err := feed.src.ReadFrame()
 		if len(frame) == 0 {
 			continue
 		}
-		if err != nil && err != webcam.ErrTimeout {
+		if err != nil && !isTimeout(err) {
+			releaseFrame(frame)
+			captureErrors.Add(1)
+			if feed.follow(true) {
+				continue
+			}
 			break
 		}
+		markFrame()
+		at := frameTimeOf(frame)
 		// MJPEG frame is JPEG already
-		fmt.Fprintf(w, "--%s\r\n", boundary)
-		fmt.Fprintf(w, "Content-Type: image/jpeg\r\n")
-		fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(frame))
-		w.Write(frame)
-		fmt.Fprintf(w, "\r\n")
-		flusher.Flush()
+		if mark != "" {
+			stamped, err := snapshotJPEG(frame, "MJPEG", uint32(feed.width), uint32(feed.height), mark)
+			releaseFrame(frame)
+			if err != nil {
+				// A watermarked client must never get an unmarked frame, so
+				// skip bad frames but end the stream if none can be decoded.
+				badFrames++
+				log.Printf("watermark failed (%d in a row): %v", badFrames, err)
+				if badFrames >= maxUndecodableFrames {
+					log.Printf("ending watermarked stream for %q: frames cannot be decoded", mark)
+					break
+				}
+				continue
+			}
+			badFrames = 0
+			frame = stamped
+		}
+		writeStreamPart(w, flusher, feed, sc, boundary, frame, at)
+		releaseFrame(frame)
+	}
+}
+
+// writeStreamPart sends jpg, from a frame captured at at, as the next part of
+// a multipart stream, at the stream's quality tier, and records how long the
+// write blocked.
+func writeStreamPart(w http.ResponseWriter, flusher http.Flusher, feed *streamFeed, sc *streamClient, boundary string, jpg []byte, at frameTime) {
+	jpg, width, height, announce, err := sc.prepare(jpg, feed.width, feed.height)
+	if err != nil {
+		return
 	}
+	extra := at.headers()
+	if announce {
+		extra = append(extra, sc.qualityHeaders(width, height)...)
+	}
+	start := time.Now()
+	feed.writePartHeader(w, boundary, len(jpg), extra...)
+	w.Write(jpg)
+	fmt.Fprintf(w, "\r\n")
+	flusher.Flush()
+	sc.wrote(time.Since(start), time.Now())
 }
 
 func streamYUYV(w http.ResponseWriter, r *http.Request) {
@@ -296,44 +527,53 @@ func streamYUYV(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
 		return
 	}
-	cameraState.mu.Lock()
-	cam := cameraState.webcam
-	width := int(cameraState.width)
-	height := int(cameraState.height)
-	cameraState.mu.Unlock()
+	feed := newStreamFeed()
+	mark := watermarkFor(clientIDFromRequest(r))
+	activeStreams.Add(1)
+	defer activeStreams.Add(-1)
+	sc := openStreamClient(r, "multipart")
+	defer sc.close()
 	for {
-		err := cam.WaitForFrame(5)
-		if err != nil && err != webcam.ErrTimeout {
+		if r.Context().Err() != nil {
+			break
+		}
+		if !feed.follow(false) {
+			break
+		}
+		err := feed.src.WaitForFrame(5)
+		if err != nil && !isTimeout(err) {
+			captureErrors.Add(1)
+			if feed.follow(true) {
+				continue
+			}
 			break
 		}
-		frame, err := cam.ReadFrame()
+		frame, err := feed.src.ReadFrame()
 		if len(frame) == 0 {
 			continue
 		}
-		if err != nil && err != webcam.ErrTimeout {
+		if err != nil && !isTimeout(err) {
+			releaseFrame(frame)
+			captureErrors.Add(1)
+			if feed.follow(true) {
+				continue
+			}
 			break
 		}
-		img := yuyvToImage(frame, width, height)
-		var buf []byte
-		jpegBuf := &buf
-		jpegWriter := &bufferWriter{buf: jpegBuf}
-		_ = jpeg.Encode(jpegWriter, img, nil)
-		fmt.Fprintf(w, "--%s\r\n", boundary)
-		fmt.Fprintf(w, "Content-Type: image/jpeg\r\n")
-		fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(*jpegBuf))
-		w.Write(*jpegBuf)
-		fmt.Fprintf(w, "\r\n")
-		flusher.Flush()
+		markFrame()
+		at := frameTimeOf(frame)
+		jpg, err := snapshotJPEG(frame, "YUYV", uint32(feed.width), uint32(feed.height), mark)
+		releaseFrame(frame)
+		if err != nil {
+			continue
+		}
+		writeStreamPart(w, flusher, feed, sc, boundary, jpg, at)
 	}
 }
 
-type bufferWriter struct {
-	buf *[]byte
-}
-
-func (w *bufferWriter) Write(p []byte) (int, error) {
-	*w.buf = append(*w.buf, p...)
-	return len(p), nil
+func isTimeout(err error) bool {
+	var t *webcam.Timeout
+	return errors.As(err, &t)
 }
 
 // YUYV422 to image.Image (RGB)
@@ -359,14 +599,14 @@ func yuyvToImage(frame []byte, width, height int) image.Image {
 	return img
 }
 
-func yuvToRGB(y, u, v int) image.Color {
+func yuvToRGB(y, u, v int) color.Color {
 	c := y - 16
 	d := u - 128
 	e := v - 128
 	r := clamp((298*c+409*e+128)>>8, 0, 255)
 	g := clamp((298*c-100*d-208*e+128)>>8, 0, 255)
 	b := clamp((298*c+516*d+128)>>8, 0, 255)
-	return image.RGBAColor{R: uint8(r), G: uint8(g), B: uint8(b), A: 255}
+	return color.RGBA{R: uint8(r), G: uint8(g), B: uint8(b), A: 255}
 }
 
 func clamp(val, min, max int) int {
@@ -381,27 +621,241 @@ func clamp(val, min, max int) int {
 
 // --- MAIN ---
 func main() {
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(runCLI(os.Args[1:]))
+	}
 	if err := loadEnvConfig(); err != nil {
 		log.Fatalf("Config error: %v", err)
 	}
+	if err := loadSecretFiles(); err != nil {
+		log.Fatalf("Secret config error: %v", err)
+	}
+	if err := loadAuthConfig(); err != nil {
+		log.Fatalf("Auth config error: %v", err)
+	}
+	if err := loadAuthExemptConfig(); err != nil {
+		log.Fatalf("Auth config error: %v", err)
+	}
+	if err := loadBodyConfig(); err != nil {
+		log.Fatalf("Request body config error: %v", err)
+	}
+	if err := loadDebugConfig(); err != nil {
+		log.Fatalf("Debug config error: %v", err)
+	}
+	if err := loadTimeConfig(); err != nil {
+		log.Fatalf("Time config error: %v", err)
+	}
+	if err := loadWatermarkConfig(); err != nil {
+		log.Fatalf("Watermark config error: %v", err)
+	}
+	if err := loadWatchdogConfig(); err != nil {
+		log.Fatalf("Watchdog config error: %v", err)
+	}
+	if err := loadExifConfig(); err != nil {
+		log.Fatalf("EXIF config error: %v", err)
+	}
+	if err := loadTokenConfig(); err != nil {
+		log.Fatalf("Token config error: %v", err)
+	}
+	if err := loadEncoderConfig(); err != nil {
+		log.Fatalf("Encoder config error: %v", err)
+	}
+	if err := loadUpdateConfig(); err != nil {
+		log.Fatalf("Update config error: %v", err)
+	}
+	if err := loadShapeConfig(); err != nil {
+		log.Fatalf("Response shape config error: %v", err)
+	}
+	if err := loadCacheConfig(); err != nil {
+		log.Fatalf("Cache config error: %v", err)
+	}
+	if err := loadPlaybackConfig(); err != nil {
+		log.Fatalf("Playback config error: %v", err)
+	}
+	if err := loadEventConfig(); err != nil {
+		log.Fatalf("Event config error: %v", err)
+	}
+	if err := loadCalibrationConfig(); err != nil {
+		log.Fatalf("Calibration config error: %v", err)
+	}
+	if err := loadMetricsConfig(); err != nil {
+		log.Fatalf("Metrics config error: %v", err)
+	}
+	if err := loadSNMPConfig(); err != nil {
+		log.Fatalf("SNMP config error: %v", err)
+	}
+	if err := loadClipConfig(); err != nil {
+		log.Fatalf("Clip config error: %v", err)
+	}
+	if err := loadAdaptiveConfig(); err != nil {
+		log.Fatalf("Adaptive stream config error: %v", err)
+	}
+	if err := loadStreamWSConfig(); err != nil {
+		log.Fatalf("WebSocket stream config error: %v", err)
+	}
+	loadMQTTConfig()
+	if err := loadBarcodeConfig(); err != nil {
+		log.Fatalf("Barcode config error: %v", err)
+	}
+	if err := loadROIConfig(); err != nil {
+		log.Fatalf("Region of interest config error: %v", err)
+	}
+	if err := loadGaugeConfig(); err != nil {
+		log.Fatalf("Gauge config error: %v", err)
+	}
+	if err := loadRecoveryConfig(); err != nil {
+		log.Fatalf("Capture recovery config error: %v", err)
+	}
+	if err := loadFrameBufferConfig(); err != nil {
+		log.Fatalf("Frame buffer config error: %v", err)
+	}
+	if err := loadFrameTimeConfig(); err != nil {
+		log.Fatalf("Frame timestamp config error: %v", err)
+	}
+	if err := loadSyncConfig(); err != nil {
+		log.Fatalf("Camera sync config error: %v", err)
+	}
+	if err := loadStartupConfig(); err != nil {
+		log.Fatalf("Startup config error: %v", err)
+	}
+	v := buildVersion()
+	log.Printf("camera-driver %s (commit %s, built %s, %s)", v.Version, v.GitCommit, v.BuildDate, v.GoVersion)
+	log.Printf("JPEG encoder: %s", openJPEGEncoder())
+	ctx, cancel := context.WithCancel(context.Background())
+	watchdogDone := make(chan struct{})
+	go func() {
+		defer close(watchdogDone)
+		watchdogLoop(ctx)
+	}()
+	if timeConfig.Server != "" {
+		go timeSyncLoop(ctx)
+	}
+	metricsDone := make(chan struct{})
+	go func() {
+		defer close(metricsDone)
+		metricsSnapshotLoop(ctx)
+	}()
+	if snmpConfig.Listen != "" {
+		conn, err := net.ListenPacket("udp", snmpConfig.Listen)
+		if err != nil {
+			log.Fatalf("SNMP listen error: %v", err)
+		}
+		log.Printf("SNMP agent listening on %s", conn.LocalAddr())
+		go snmp.serve(ctx, conn)
+	}
+	if snmp != nil {
+		go snmpWatch(ctx, 2*time.Second)
+	}
+	if clipConfig.Seconds > 0 {
+		go clipRecorder(ctx)
+	}
+	if barcodes != nil {
+		log.Printf("Barcode scanning every %v with %s", barcodeConfig.Interval, barcodeConfig.Decoder)
+		go barcodes.run(ctx)
+	}
+	if recoveryConfig.Timeouts > 0 {
+		go recovery.run(ctx)
+	}
+	if gauge != nil {
+		log.Printf("Reading the %s gauge in region %q every %v", gaugeConfig.Analyzer, gaugeConfig.ROI, gaugeConfig.Interval)
+		go gauge.run(ctx)
+	}
 	serverHost := os.Getenv("SERVER_HOST")
 	serverPort := os.Getenv("SERVER_PORT")
 	if serverPort == "" {
 		serverPort = "8080"
 	}
-	addr := serverHost + ":" + serverPort
+	addr := joinHostPort(serverHost, serverPort)
+	if v := os.Getenv("HTTP_LISTEN"); v != "" {
+		addr = v
+	}
+	sockPerms, err := socketPermsFromEnv()
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	iface := os.Getenv("HTTP_INTERFACE")
+	if err := checkInterface(iface); err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	if err := loadBasePath(); err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
 
-	http.HandleFunc("/capture/start", handleStartCapture)
-	http.HandleFunc("/video/start", handleStartVideo)
-	http.HandleFunc("/capture/stop", handleStopCapture)
-	http.HandleFunc("/video/stop", handleStopVideo)
-	http.HandleFunc("/video/stream", handleVideoStream)
-	http.HandleFunc("/stream", handleStream)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/status/all", requireAuth(handleStatusAll))
+	http.HandleFunc("/status.xml", requireAuth(handleStatusXML))
+	http.HandleFunc("/metrics", requireAuth(handleMetrics))
+	http.HandleFunc("/capture/start", requireAuth(handleStartCapture))
+	http.HandleFunc("/video/start", requireAuth(handleStartVideo))
+	http.HandleFunc("/capture/stop", requireAuth(handleStopCapture))
+	http.HandleFunc("/capture/reconfigure", requireAuth(handleReconfigure))
+	http.HandleFunc("/video-nodes", requireAuth(handleVideoNodes))
+	http.HandleFunc("/video/stop", requireAuth(handleStopVideo))
+	http.HandleFunc("/video/stream", tokenAuth(handleVideoStream))
+	http.HandleFunc("/stream", tokenAuth(handleStream))
+	http.HandleFunc("/stream/ws", tokenAuth(handleStreamWS))
+	http.HandleFunc("/streams", requireAuth(handleStreams))
+	http.HandleFunc("/snapshot", tokenAuth(handleSnapshot))
+	http.HandleFunc("/rois", requireAuth(handleROIs))
+	http.HandleFunc("/roi/", tokenAuth(handleROI))
+	http.HandleFunc("/gauge", requireAuth(handleGauge))
+	http.HandleFunc("/clip.gif", tokenAuth(handleClipGIF))
+	http.HandleFunc("/clip.mp4", tokenAuth(handleClipMP4))
+	http.HandleFunc("/tokens", requireAuth(handleMintToken))
+	http.HandleFunc("/frame/raw", requireAuth(handleRawFrame))
+	http.HandleFunc("/stats/image", requireAuth(handleImageStats))
+	http.HandleFunc("/sync/status", requireAuth(handleSyncStatus))
+	http.HandleFunc("/calibration", requireAuth(handleCalibration))
+	http.HandleFunc("/annotations", requireAuth(handleAnnotations))
+	http.HandleFunc("/version", requireAuth(handleVersion))
+	http.HandleFunc("/events", requireAuth(handleEvents))
+	http.HandleFunc("/barcodes/events", tokenAuth(handleBarcodeEvents))
+	http.HandleFunc("/playback", requireAuth(handlePlayback))
+	http.HandleFunc("/playback/start", requireAuth(handlePlaybackStart))
+	http.HandleFunc("/playback/stop", requireAuth(handlePlaybackStop))
+	http.HandleFunc("/.well-known/wot", requireAuth(handleThingDescription))
+	if debugConfig.Enabled {
+		http.HandleFunc("/debug/", requireDebugClient(handleDebug))
+	}
+
+	log.Printf("Device: %s, Format: %s, Resolution: %dx%d, FPS: %d",
+		cameraConfig.deviceID(), cameraConfig.Format, cameraConfig.Width, cameraConfig.Height, cameraConfig.FPS)
+	if cameraConfig.Simulate {
+		log.Printf("SIMULATE=true: serving synthetic frames, %s is not opened", cameraConfig.deviceID())
+	}
 
-	log.Printf("USB Camera HTTP driver starting on %s", addr)
-	log.Printf("Device path: %s, Format: %s, Resolution: %dx%d, FPS: %d",
-		cameraConfig.DevicePath, cameraConfig.Format, cameraConfig.Width, cameraConfig.Height, cameraConfig.FPS)
+	ln, err := listenHTTP(addr, iface, sockPerms)
+	if err != nil {
+		log.Fatalf("Listen error: %v", err)
+	}
+	log.Printf("USB Camera HTTP driver starting on %s", ln.Addr())
+	// The camera is opened by /capture/start unless STARTUP_CAPTURE says
+	// otherwise, so readiness means the API is accepting requests.
+	_ = sdNotify("READY=1\nSTATUS=idle, camera closed")
+	startupCapture()
+	srv := &http.Server{Handler: mountAt(httpBasePath, compressHandler(cacheHeaders(shapeResponses(http.DefaultServeMux)))), ConnContext: markUnixConn}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
 
-	log.Fatal(http.ListenAndServe(addr, nil))
+	// Handle shutdown
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	log.Printf("Signal received: %v; shutting down", sig)
+	_ = sdNotify("STOPPING=1")
+	// Disarm the watchdog first so a slow shutdown can't end in a reboot.
+	cancel()
+	<-watchdogDone
+	<-metricsDone
+	closeCamera()
+	// Streams never finish on their own; give them a moment, then cut them.
+	shutdownCtx, done := context.WithTimeout(context.Background(), 2*time.Second)
+	defer done()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		srv.Close()
+	}
+	log.Printf("Shutdown complete")
 }
-```
\ No newline at end of file
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// --- DRY RUNS ---
+// The capture, reconfigure, calibration and playback endpoints take
+// ?dry_run=true or a "Dry-Run: true" header. The request is authorized and
+// checked as usual, then answered with what it would do, in order, while
+// the camera is neither opened, closed nor reconfigured and no file is
+// written:
+//
+//	POST /capture/reconfigure?width=1280&height=720&dry_run=true
+//	-> {"dry_run": true, "operations": [
+//	     {"op": "close_source", "backend": "webcam", "device": "/dev/video0"},
+//	     {"op": "open_source", "backend": "webcam", "device": "/dev/video0", "format": "MJPEG", "width": 1280, "height": 720, "fps": 15},
+//	     {"op": "save_state", "file": "/var/lib/camera/capture_state.json"}]}
+//
+// The settings listed are the requested ones; the device may still pick a
+// nearby frame size, as it would for the real request. A dry run of an
+// uploaded clip reads only as far as its first frame, so PLAYBACK_MAX_BYTES
+// is not checked.
+
+type plannedOp struct {
+	Op      string      `json:"op"`
+	Backend string      `json:"backend,omitempty"`
+	Device  string      `json:"device,omitempty"`
+	Format  string      `json:"format,omitempty"`
+	Width   uint32      `json:"width,omitempty"`
+	Height  uint32      `json:"height,omitempty"`
+	FPS     uint32      `json:"fps,omitempty"`
+	File    string      `json:"file,omitempty"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// dryRunRequested reads the dry_run parameter or Dry-Run header, answering
+// 400 and reporting !ok for a value that is not a boolean.
+func dryRunRequested(w http.ResponseWriter, r *http.Request) (dry, ok bool) {
+	s := r.URL.Query().Get("dry_run")
+	if s == "" {
+		s = r.Header.Get("Dry-Run")
+	}
+	if s == "" {
+		return false, true
+	}
+	dry, err := strconv.ParseBool(s)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, map[string]string{"error": "dry_run must be true or false"})
+		return false, false
+	}
+	return dry, true
+}
+
+func openSourceOp(cfg CameraConfig) plannedOp {
+	return plannedOp{Op: "open_source", Backend: captureBackend(), Device: cfg.deviceID(), Format: cfg.Format, Width: cfg.Width, Height: cfg.Height, FPS: cfg.FPS}
+}
+
+func closeSourceOp() plannedOp {
+	return plannedOp{Op: "close_source", Backend: captureBackend(), Device: cameraConfig.deviceID()}
+}
+
+// saveCaptureStateOps is saveCaptureState's write, if CAPTURE_STATE_FILE is set.
+func saveCaptureStateOps() []plannedOp {
+	if startupConfig.StateFile == "" {
+		return nil
+	}
+	return []plannedOp{{Op: "save_state", File: startupConfig.StateFile}}
+}
+
+func replyDryRun(w http.ResponseWriter, ops []plannedOp) {
+	if ops == nil {
+		ops = []plannedOp{}
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"dry_run": true, "operations": ops})
+}
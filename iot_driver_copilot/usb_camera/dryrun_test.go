@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	saved, savedCal := cameraConfig, calibrationConfig
+	defer func() { closeCamera(); cameraConfig, calibrationConfig = saved, savedCal }()
+	cameraConfig = CameraConfig{Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	calibrationConfig.File = filepath.Join(t.TempDir(), "calibration.json")
+
+	dry := func(h http.HandlerFunc, method, target, body string) (int, []plannedOp) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		h(rec, req)
+		var reply struct {
+			DryRun     bool        `json:"dry_run"`
+			Operations []plannedOp `json:"operations"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&reply); err == nil && rec.Code == http.StatusOK && !reply.DryRun {
+			t.Errorf("%s %s: dry_run missing from reply", method, target)
+		}
+		return rec.Code, reply.Operations
+	}
+
+	code, ops := dry(handleStartCapture, "POST", "/capture/start?width=32&height=24&dry_run=true", "")
+	if code != http.StatusOK || len(ops) != 1 || ops[0].Op != "open_source" || ops[0].Width != 32 || ops[0].Backend != "simulate" {
+		t.Errorf("start: %d %+v", code, ops)
+	}
+	cameraState.mu.Lock()
+	running := cameraState.running
+	cameraState.mu.Unlock()
+	if running || cameraConfig.Width != 64 {
+		t.Fatalf("dry run started capture (running %v, width %d)", running, cameraConfig.Width)
+	}
+	if code, _ := dry(handleReconfigure, "POST", "/capture/reconfigure?width=32&dry_run=true", ""); code != http.StatusConflict {
+		t.Errorf("reconfigure while stopped: %d", code)
+	}
+	if code, _ := dry(handleStartCapture, "POST", "/capture/start?width=0&dry_run=true", ""); code != http.StatusBadRequest {
+		t.Errorf("invalid width: %d", code)
+	}
+	if code, _ := dry(handleStartCapture, "POST", "/capture/start?dry_run=perhaps", ""); code != http.StatusBadRequest {
+		t.Errorf("dry_run=perhaps: %d", code)
+	}
+
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	code, ops = dry(handleReconfigure, "POST", "/capture/reconfigure?width=32&height=24&dry_run=1", "")
+	if code != http.StatusOK || len(ops) != 2 || ops[0].Op != "close_source" || ops[1].Width != 32 || ops[1].FPS != 30 {
+		t.Errorf("reconfigure: %d %+v", code, ops)
+	}
+	cameraState.mu.Lock()
+	width := cameraState.width
+	cameraState.mu.Unlock()
+	if width != 64 {
+		t.Errorf("dry run reconfigured the camera to width %d", width)
+	}
+
+	code, ops = dry(handleCalibration, "POST", "/calibration?dry_run=true", `{"width": 64, "height": 48, "k1": -0.1}`)
+	if code != http.StatusOK || len(ops) != 2 || ops[0].File != calibrationConfig.File || ops[1].Op != "install_calibration" {
+		t.Errorf("calibration: %d %+v", code, ops)
+	}
+	if activeCalibration.Load() != nil {
+		t.Error("dry run installed the calibration")
+	}
+	if m, _ := filepath.Glob(calibrationConfig.File + "*"); len(m) != 0 {
+		t.Errorf("dry run wrote %v", m)
+	}
+}
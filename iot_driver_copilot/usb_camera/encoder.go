@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// YUYV frames are JPEG-encoded by the backend JPEG_ENCODER selects:
+//
+//	software   image/jpeg
+//	turbojpeg  libjpeg-turbo through cgo; needs a build with -tags turbojpeg
+//	v4l2       a V4L2 memory-to-memory JPEG encoder (JPEG_ENCODER_DEVICE,
+//	           or the first one found under /dev/video*)
+//	auto       v4l2, then turbojpeg, then software (the default)
+//
+// A backend that can't be opened, or that fails on a frame later, is
+// replaced by software encoding. Watermarked frames are always encoded in
+// software, as the watermark is drawn on a decoded image.
+
+type jpegEncoder interface {
+	Name() string
+	EncodeYUYV(frame []byte, width, height, quality int) ([]byte, error)
+	Close() error
+}
+
+type EncoderConfig struct {
+	Backend string // JPEG_ENCODER
+	Device  string // JPEG_ENCODER_DEVICE
+	Quality int    // JPEG_QUALITY, 1-100
+	Dedup   bool   // FRAME_DEDUP; see dedup.go
+}
+
+var (
+	encoderConfig EncoderConfig
+	activeEncoder atomic.Pointer[jpegEncoder]
+)
+
+// --- ENCODER CONFIG ---
+func loadEncoderConfig() error {
+	encoderConfig.Backend = strings.ToLower(os.Getenv("JPEG_ENCODER"))
+	if encoderConfig.Backend == "" {
+		encoderConfig.Backend = "auto"
+	}
+	switch encoderConfig.Backend {
+	case "auto", "software", "turbojpeg", "v4l2":
+	default:
+		return fmt.Errorf("JPEG_ENCODER must be auto, software, turbojpeg or v4l2, got %q", encoderConfig.Backend)
+	}
+	encoderConfig.Device = os.Getenv("JPEG_ENCODER_DEVICE")
+	encoderConfig.Dedup = !strings.EqualFold(os.Getenv("FRAME_DEDUP"), "false")
+	encoderConfig.Quality = jpeg.DefaultQuality
+	if v := os.Getenv("JPEG_QUALITY"); v != "" {
+		q, err := strconv.Atoi(v)
+		if err != nil || q < 1 || q > 100 {
+			return fmt.Errorf("JPEG_QUALITY must be 1-100, got %q", v)
+		}
+		encoderConfig.Quality = q
+	}
+	return nil
+}
+
+// openJPEGEncoder installs the configured backend, falling back to
+// software, and returns its name.
+func openJPEGEncoder() string {
+	var order []string
+	switch encoderConfig.Backend {
+	case "auto":
+		order = []string{"v4l2", "turbojpeg"}
+	case "software":
+	default:
+		order = []string{encoderConfig.Backend}
+	}
+	var enc jpegEncoder = softwareEncoder{}
+	for _, name := range order {
+		var e jpegEncoder
+		var err error
+		switch name {
+		case "v4l2":
+			e, err = openV4L2Encoder(encoderConfig.Device)
+		case "turbojpeg":
+			e, err = openTurboJPEGEncoder()
+		}
+		if err == nil {
+			enc = e
+			break
+		}
+		if encoderConfig.Backend != "auto" {
+			log.Printf("JPEG encoder %s unavailable: %v; using software", name, err)
+		}
+	}
+	activeEncoder.Store(&enc)
+	return enc.Name()
+}
+
+// encodeYUYVJPEG encodes a YUYV frame with the active backend. A failing
+// backend is closed and replaced by software encoding for good.
+func encodeYUYVJPEG(frame []byte, width, height int) ([]byte, error) {
+	p := activeEncoder.Load()
+	if p == nil {
+		return softwareEncoder{}.EncodeYUYV(frame, width, height, encoderConfig.Quality)
+	}
+	enc := *p
+	b, err := enc.EncodeYUYV(frame, width, height, encoderConfig.Quality)
+	if err == nil || enc.Name() == "software" {
+		return b, err
+	}
+	var sw jpegEncoder = softwareEncoder{}
+	if activeEncoder.CompareAndSwap(p, &sw) {
+		log.Printf("JPEG encoder %s failed: %v; falling back to software", enc.Name(), err)
+		enc.Close()
+	}
+	return sw.EncodeYUYV(frame, width, height, encoderConfig.Quality)
+}
+
+type softwareEncoder struct{}
+
+func (softwareEncoder) Name() string { return "software" }
+
+func (softwareEncoder) EncodeYUYV(frame []byte, width, height, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, yuyvToImage(frame, width, height), &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (softwareEncoder) Close() error { return nil }
@@ -0,0 +1,9 @@
+//go:build !turbojpeg || !cgo
+
+package main
+
+import "errors"
+
+func openTurboJPEGEncoder() (jpegEncoder, error) {
+	return nil, errors.New("built without turbojpeg support (go build -tags turbojpeg)")
+}
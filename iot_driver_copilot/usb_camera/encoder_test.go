@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/jpeg"
+	"testing"
+)
+
+type failingEncoder struct{ closed bool }
+
+func (*failingEncoder) Name() string { return "broken" }
+func (*failingEncoder) EncodeYUYV([]byte, int, int, int) ([]byte, error) {
+	return nil, errors.New("device gone")
+}
+func (e *failingEncoder) Close() error { e.closed = true; return nil }
+
+func TestEncoderFallsBackToSoftware(t *testing.T) {
+	t.Setenv("JPEG_ENCODER", "software")
+	t.Setenv("JPEG_QUALITY", "90")
+	if err := loadEncoderConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer activeEncoder.Store(nil)
+	if name := openJPEGEncoder(); name != "software" {
+		t.Fatalf("JPEG_ENCODER=software opened %s", name)
+	}
+
+	broken := &failingEncoder{}
+	var enc jpegEncoder = broken
+	activeEncoder.Store(&enc)
+	frame := make([]byte, 16*8*2)
+	jpg, err := encodeYUYVJPEG(frame, 16, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(jpg))
+	if err != nil || cfg.Width != 16 || cfg.Height != 8 {
+		t.Fatalf("fallback output: %+v, %v", cfg, err)
+	}
+	if !broken.closed || (*activeEncoder.Load()).Name() != "software" {
+		t.Error("failed encoder was not replaced by software")
+	}
+}
+
+func TestEncoderConfigRejects(t *testing.T) {
+	for _, env := range [][2]string{{"JPEG_ENCODER", "nvenc"}, {"JPEG_QUALITY", "0"}, {"JPEG_QUALITY", "101"}} {
+		t.Setenv("JPEG_ENCODER", "")
+		t.Setenv("JPEG_QUALITY", "")
+		t.Setenv(env[0], env[1])
+		if err := loadEncoderConfig(); err == nil {
+			t.Errorf("%s=%s accepted", env[0], env[1])
+		}
+	}
+}
@@ -0,0 +1,86 @@
+//go:build turbojpeg && cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -lturbojpeg
+#include <stdlib.h>
+#include <turbojpeg.h>
+
+// encode_yuyv splits packed YUYV into 4:2:2 planes and compresses them
+// without a colour conversion round trip.
+static int encode_yuyv(tjhandle h, const unsigned char *yuyv, int w, int ht, int q,
+		unsigned char **out, unsigned long *size) {
+	int cw = w / 2;
+	unsigned char *y = malloc((size_t)w * ht * 2);
+	if (!y) return -1;
+	unsigned char *u = y + (size_t)w * ht, *v = u + (size_t)cw * ht;
+	for (int r = 0; r < ht; r++) {
+		const unsigned char *s = yuyv + (size_t)r * w * 2;
+		for (int c = 0; c < cw; c++) {
+			y[(size_t)r * w + 2 * c] = s[4 * c];
+			y[(size_t)r * w + 2 * c + 1] = s[4 * c + 2];
+			u[(size_t)r * cw + c] = s[4 * c + 1];
+			v[(size_t)r * cw + c] = s[4 * c + 3];
+		}
+	}
+	const unsigned char *planes[3] = {y, u, v};
+	int strides[3] = {w, cw, cw};
+	*out = NULL;
+	*size = 0;
+	int rc = tjCompressFromYUVPlanes(h, planes, w, strides, ht, TJSAMP_422, out, size, q, TJFLAG_FASTDCT);
+	free(y);
+	return rc;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+type turboJPEGEncoder struct {
+	mu sync.Mutex // a tjhandle is not safe for concurrent use
+	h  C.tjhandle
+}
+
+func openTurboJPEGEncoder() (jpegEncoder, error) {
+	h := C.tjInitCompress()
+	if h == nil {
+		return nil, fmt.Errorf("tjInitCompress: %s", C.GoString(C.tjGetErrorStr2(nil)))
+	}
+	return &turboJPEGEncoder{h: h}, nil
+}
+
+func (e *turboJPEGEncoder) Name() string { return "turbojpeg" }
+
+func (e *turboJPEGEncoder) EncodeYUYV(frame []byte, width, height, quality int) ([]byte, error) {
+	if width%2 != 0 || len(frame) < width*height*2 {
+		return nil, fmt.Errorf("short or odd-width YUYV frame (%d bytes for %dx%d)", len(frame), width, height)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.h == nil {
+		return nil, errors.New("encoder closed")
+	}
+	var out *C.uchar
+	var size C.ulong
+	if C.encode_yuyv(e.h, (*C.uchar)(unsafe.Pointer(&frame[0])), C.int(width), C.int(height), C.int(quality), &out, &size) != 0 {
+		return nil, fmt.Errorf("tjCompressFromYUVPlanes: %s", C.GoString(C.tjGetErrorStr2(e.h)))
+	}
+	defer C.tjFree(out)
+	return C.GoBytes(unsafe.Pointer(out), C.int(size)), nil
+}
+
+func (e *turboJPEGEncoder) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.h != nil {
+		C.tjDestroy(e.h)
+		e.h = nil
+	}
+	return nil
+}
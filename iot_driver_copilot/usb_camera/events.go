@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event timeline, for dashboards that draw a scrubber bar:
+//
+//	GET /events[?from=RFC3339][&to=RFC3339][&type=snapshot,stream_started][&limit=100][&after=ID]
+//
+// The driver keeps its last EVENT_LOG_SIZE events in memory: capture
+// started/stopped/reconfigured, capture recovery steps (recovery.go), clip
+// playback started/stopped, snapshots, stills and clips, streams
+// started/ended, annotations added/cleared, barcodes read (barcode.go), and
+// the gauge reader failing and recovering (gauge.go).
+// Events come oldest first; when more match than limit, "next" holds the
+// query for the following page. The driver keeps no footage beyond the few
+// seconds clips are made from (clip.go), so events carry no media links,
+// and it has no motion detection to report.
+
+var eventTypes = map[string]bool{
+	"capture_started": true, "capture_stopped": true, "capture_reconfigured": true, "capture_recovery": true,
+	"playback_started": true, "playback_stopped": true,
+	"snapshot": true, "still": true, "clip": true, "stream_started": true, "stream_ended": true,
+	"annotation_added": true, "annotations_cleared": true, "barcode": true,
+	"gauge_failed": true, "gauge_recovered": true,
+}
+
+type cameraEvent struct {
+	ID     uint64                 `json:"id"`
+	Time   time.Time              `json:"time"`
+	Type   string                 `json:"type"`
+	Client string                 `json:"client,omitempty"`
+	Detail map[string]interface{} `json:"detail,omitempty"`
+}
+
+// eventLog is a ring of the newest events.
+type eventLog struct {
+	mu     sync.Mutex
+	events []cameraEvent // oldest first
+	size   int
+	nextID uint64
+}
+
+var events = &eventLog{size: 1000}
+
+// --- EVENT CONFIG ---
+func loadEventConfig() error {
+	size := 1000
+	if v := os.Getenv("EVENT_LOG_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("EVENT_LOG_SIZE must be a positive integer")
+		}
+		size = n
+	}
+	events = &eventLog{size: size}
+	return nil
+}
+
+func (l *eventLog) add(typ, client string, detail map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	l.events = append(l.events, cameraEvent{ID: l.nextID, Time: clockNow().UTC(), Type: typ, Client: client, Detail: detail})
+	if over := len(l.events) - l.size; over > 0 {
+		l.events = append(l.events[:0], l.events[over:]...)
+	}
+}
+
+// recordEvent adds an event to the timeline.
+func recordEvent(typ, client string, detail map[string]interface{}) {
+	events.add(typ, client, detail)
+}
+
+type eventQuery struct {
+	from, to time.Time // zero for open ends
+	types    map[string]bool
+	after    uint64
+	limit    int
+}
+
+// query returns up to q.limit matching events and whether more follow.
+func (l *eventLog) query(q eventQuery) ([]cameraEvent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := []cameraEvent{}
+	for _, e := range l.events {
+		if e.ID <= q.after || !q.from.IsZero() && e.Time.Before(q.from) || !q.to.IsZero() && !e.Time.Before(q.to) {
+			continue
+		}
+		if q.types != nil && !q.types[e.Type] {
+			continue
+		}
+		if len(out) == q.limit {
+			return out, true
+		}
+		out = append(out, e)
+	}
+	return out, false
+}
+
+func parseEventQuery(v map[string][]string) (eventQuery, error) {
+	get := func(k string) string {
+		if s := v[k]; len(s) > 0 {
+			return s[0]
+		}
+		return ""
+	}
+	q := eventQuery{limit: 100}
+	var err error
+	for _, b := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &q.from}, {"to", &q.to}} {
+		if s := get(b.name); s != "" {
+			if *b.dst, err = time.Parse(time.RFC3339, s); err != nil {
+				return q, fmt.Errorf("%s must be an RFC 3339 time", b.name)
+			}
+		}
+	}
+	if s := get("type"); s != "" {
+		q.types = map[string]bool{}
+		for _, t := range strings.Split(s, ",") {
+			if !eventTypes[t] {
+				return q, fmt.Errorf("unknown event type %q", t)
+			}
+			q.types[t] = true
+		}
+	}
+	if s := get("limit"); s != "" {
+		if q.limit, err = strconv.Atoi(s); err != nil || q.limit < 1 || q.limit > 1000 {
+			return q, fmt.Errorf("limit must be an integer from 1 to 1000")
+		}
+	}
+	if s := get("after"); s != "" {
+		if q.after, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return q, fmt.Errorf("after must be an event id")
+		}
+	}
+	return q, nil
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseEventQuery(r.URL.Query())
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	list, more := events.query(q)
+	resp := map[string]interface{}{"events": list}
+	if more {
+		next := r.URL.Query()
+		next.Set("after", strconv.FormatUint(list[len(list)-1].ID, 10))
+		resp["next"] = r.URL.Path + "?" + next.Encode()
+	}
+	jsonResponse(w, http.StatusOK, resp)
+}
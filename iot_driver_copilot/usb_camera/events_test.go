@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEventLogQuery(t *testing.T) {
+	l := &eventLog{size: 3}
+	for _, typ := range []string{"capture_started", "snapshot", "stream_started", "snapshot"} {
+		l.add(typ, "alice", nil)
+	}
+	all, more := l.query(eventQuery{limit: 10})
+	if more || len(all) != 3 || all[0].ID != 2 || all[2].ID != 4 {
+		t.Fatalf("ring kept %+v", all)
+	}
+	page, more := l.query(eventQuery{limit: 1, types: map[string]bool{"snapshot": true}})
+	if !more || len(page) != 1 || page[0].ID != 2 {
+		t.Errorf("first page %+v more=%v", page, more)
+	}
+	page, more = l.query(eventQuery{limit: 1, after: 2, types: map[string]bool{"snapshot": true}})
+	if more || len(page) != 1 || page[0].ID != 4 {
+		t.Errorf("second page %+v more=%v", page, more)
+	}
+	if got, _ := l.query(eventQuery{limit: 10, from: time.Now().Add(time.Minute)}); len(got) != 0 {
+		t.Errorf("future from: %+v", got)
+	}
+}
+
+func TestEventsEndpoint(t *testing.T) {
+	saved, savedEvents := cameraConfig, events
+	defer func() { closeCamera(); cameraConfig, events = saved, savedEvents }()
+	events = &eventLog{size: 100}
+	cameraConfig = CameraConfig{Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	handleSnapshot(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/snapshot", nil))
+	closeCamera()
+
+	get := func(target string) (int, map[string]json.RawMessage) {
+		rec := httptest.NewRecorder()
+		handleEvents(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var resp map[string]json.RawMessage
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	code, resp := get("/events?limit=2")
+	var list []cameraEvent
+	_ = json.Unmarshal(resp["events"], &list)
+	if code != http.StatusOK || len(list) != 2 || list[0].Type != "capture_started" || list[1].Type != "snapshot" {
+		t.Fatalf("first page: %d %s", code, resp["events"])
+	}
+	var next string
+	_ = json.Unmarshal(resp["next"], &next)
+	if next != "/events?after=2&limit=2" {
+		t.Errorf("next = %q", next)
+	}
+	_, resp = get(next)
+	list = nil
+	_ = json.Unmarshal(resp["events"], &list)
+	if len(list) != 1 || list[0].Type != "capture_stopped" || resp["next"] != nil {
+		t.Errorf("second page: %s", resp["events"])
+	}
+	for _, bad := range []string{"/events?type=motion", "/events?from=yesterday", "/events?limit=0"} {
+		if code, _ := get(bad); code != http.StatusBadRequest {
+			t.Errorf("%s: %d", bad, code)
+		}
+	}
+}
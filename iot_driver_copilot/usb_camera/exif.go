@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshots carry their provenance in an EXIF APP1 segment: capture time
+// (DateTimeOriginal with its UTC offset and milliseconds), pixel size, and
+// when configured the camera name (Model) and a fixed GPS position.
+type ExifConfig struct {
+	Enabled    bool
+	CameraName string  // EXIF_CAMERA_NAME
+	GPS        *gpsFix // EXIF_GPS; nil omits the GPS IFD
+}
+
+type gpsFix struct {
+	Lat, Lon float64
+	Alt      *float64 // metres above sea level
+}
+
+var exifConfig ExifConfig
+
+// --- EXIF CONFIG ---
+func loadExifConfig() error {
+	exifConfig.Enabled = !strings.EqualFold(os.Getenv("SNAPSHOT_EXIF"), "false")
+	exifConfig.CameraName = os.Getenv("EXIF_CAMERA_NAME")
+	exifConfig.GPS = nil
+	if v := os.Getenv("EXIF_GPS"); v != "" {
+		fix, err := parseGPS(v)
+		if err != nil {
+			return fmt.Errorf("EXIF_GPS: %w", err)
+		}
+		exifConfig.GPS = fix
+	}
+	return nil
+}
+
+// parseGPS parses "lat,lon" or "lat,lon,alt" in decimal degrees and metres.
+func parseGPS(s string) (*gpsFix, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("expected lat,lon[,alt], got %q", s)
+	}
+	var v [3]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("expected lat,lon[,alt], got %q", s)
+		}
+		v[i] = f
+	}
+	if v[0] < -90 || v[0] > 90 || v[1] < -180 || v[1] > 180 {
+		return nil, fmt.Errorf("coordinates out of range in %q", s)
+	}
+	fix := &gpsFix{Lat: v[0], Lon: v[1]}
+	if len(parts) == 3 {
+		fix.Alt = &v[2]
+	}
+	return fix, nil
+}
+
+type snapshotMeta struct {
+	Taken         time.Time
+	Width, Height uint32
+}
+
+// withExif returns frame with an EXIF segment describing it placed after
+// SOI and any APP0 (JFIF/AVI1) segments. An EXIF segment the camera
+// already wrote is replaced. Frames whose header cannot be walked are
+// returned unchanged.
+func withExif(frame []byte, meta snapshotMeta) []byte {
+	if len(frame) < 4 || frame[0] != 0xFF || frame[1] != 0xD8 {
+		return frame
+	}
+	out := make([]byte, 0, len(frame)+512)
+	out = append(out, frame[:2]...)
+	inserted := false
+	i := 2
+	for i+4 <= len(frame) {
+		if frame[i] != 0xFF {
+			return frame
+		}
+		marker := frame[i+1]
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == 0xDA || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			break
+		}
+		end := i + 2 + (int(frame[i+2])<<8 | int(frame[i+3]))
+		if end > len(frame) {
+			return frame
+		}
+		if !inserted && marker != 0xE0 {
+			out = append(out, exifSegment(meta)...)
+			inserted = true
+		}
+		if marker != 0xE1 || !strings.HasPrefix(string(frame[i+4:end]), "Exif\x00\x00") {
+			out = append(out, frame[i:end]...)
+		}
+		i = end
+	}
+	if !inserted {
+		out = append(out, exifSegment(meta)...)
+	}
+	return append(out, frame[i:]...)
+}
+
+// TIFF field types.
+const (
+	tiffByte     = 1
+	tiffASCII    = 2
+	tiffLong     = 4
+	tiffRational = 5
+)
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func asciiEntry(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag, tiffASCII, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func longEntry(tag uint16, v uint32) tiffEntry {
+	return tiffEntry{tag, tiffLong, 1, binary.BigEndian.AppendUint32(nil, v)}
+}
+
+func rationalEntry(tag uint16, vals ...[2]uint32) tiffEntry {
+	var b []byte
+	for _, v := range vals {
+		b = binary.BigEndian.AppendUint32(b, v[0])
+		b = binary.BigEndian.AppendUint32(b, v[1])
+	}
+	return tiffEntry{tag, tiffRational, uint32(len(vals)), b}
+}
+
+// dms splits decimal degrees into degree, minute and 1/1000 second rationals.
+func dms(deg float64) [][2]uint32 {
+	deg = math.Abs(deg)
+	d := math.Floor(deg)
+	m := math.Floor((deg - d) * 60)
+	s := math.Round(((deg-d)*60 - m) * 60 * 1000)
+	return [][2]uint32{{uint32(d), 1}, {uint32(m), 1}, {uint32(s), 1000}}
+}
+
+func ifdSize(entries []tiffEntry) int {
+	n := 2 + 12*len(entries) + 4
+	for _, e := range entries {
+		if len(e.data) > 4 {
+			n += len(e.data) + len(e.data)%2
+		}
+	}
+	return n
+}
+
+// appendIFD writes entries at offset off (relative to the TIFF header),
+// their out-of-line values right after, and no next IFD.
+func appendIFD(b []byte, off int, entries []tiffEntry) []byte {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+	b = binary.BigEndian.AppendUint16(b, uint16(len(entries)))
+	data := off + 2 + 12*len(entries) + 4
+	var extra []byte
+	for _, e := range entries {
+		b = binary.BigEndian.AppendUint16(b, e.tag)
+		b = binary.BigEndian.AppendUint16(b, e.typ)
+		b = binary.BigEndian.AppendUint32(b, e.count)
+		if len(e.data) <= 4 {
+			var v [4]byte
+			copy(v[:], e.data)
+			b = append(b, v[:]...)
+			continue
+		}
+		b = binary.BigEndian.AppendUint32(b, uint32(data+len(extra)))
+		extra = append(extra, e.data...)
+		if len(e.data)%2 == 1 {
+			extra = append(extra, 0)
+		}
+	}
+	b = binary.BigEndian.AppendUint32(b, 0)
+	return append(b, extra...)
+}
+
+func exifSegment(meta snapshotMeta) []byte {
+	taken := meta.Taken.Format("2006:01:02 15:04:05")
+	ifd0 := []tiffEntry{asciiEntry(0x0132, taken)} // DateTime
+	if exifConfig.CameraName != "" {
+		ifd0 = append(ifd0, asciiEntry(0x0110, exifConfig.CameraName)) // Model
+	}
+	exif := []tiffEntry{
+		asciiEntry(0x9003, taken),                                            // DateTimeOriginal
+		asciiEntry(0x9011, meta.Taken.Format("-07:00")),                      // OffsetTimeOriginal
+		asciiEntry(0x9291, fmt.Sprintf("%03d", meta.Taken.Nanosecond()/1e6)), // SubSecTimeOriginal
+		longEntry(0xA002, meta.Width),                                        // PixelXDimension
+		longEntry(0xA003, meta.Height),                                       // PixelYDimension
+	}
+	var gps []tiffEntry
+	if g := exifConfig.GPS; g != nil {
+		latRef, lonRef := "N", "E"
+		if g.Lat < 0 {
+			latRef = "S"
+		}
+		if g.Lon < 0 {
+			lonRef = "W"
+		}
+		gps = []tiffEntry{
+			{0x0000, tiffByte, 4, []byte{2, 3, 0, 0}}, // GPSVersionID
+			asciiEntry(0x0001, latRef),
+			rationalEntry(0x0002, dms(g.Lat)...),
+			asciiEntry(0x0003, lonRef),
+			rationalEntry(0x0004, dms(g.Lon)...),
+		}
+		if g.Alt != nil {
+			var below byte
+			if *g.Alt < 0 {
+				below = 1
+			}
+			gps = append(gps,
+				tiffEntry{0x0005, tiffByte, 1, []byte{below}}, // GPSAltitudeRef
+				rationalEntry(0x0006, [2]uint32{uint32(math.Round(math.Abs(*g.Alt) * 100)), 100}))
+		}
+	}
+
+	// Pointer entries have fixed size, so offsets can be laid out first.
+	ifd0 = append(ifd0, longEntry(0x8769, 0)) // ExifIFDPointer
+	if gps != nil {
+		ifd0 = append(ifd0, longEntry(0x8825, 0)) // GPSInfoIFDPointer
+	}
+	exifOff := 8 + ifdSize(ifd0)
+	gpsOff := exifOff + ifdSize(exif)
+	for i := range ifd0 {
+		switch ifd0[i].tag {
+		case 0x8769:
+			ifd0[i] = longEntry(0x8769, uint32(exifOff))
+		case 0x8825:
+			ifd0[i] = longEntry(0x8825, uint32(gpsOff))
+		}
+	}
+
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+	tiff = appendIFD(tiff, 8, ifd0)
+	tiff = appendIFD(tiff, exifOff, exif)
+	if gps != nil {
+		tiff = appendIFD(tiff, gpsOff, gps)
+	}
+	n := 2 + 6 + len(tiff)
+	seg := []byte{0xFF, 0xE1, byte(n >> 8), byte(n)}
+	seg = append(seg, "Exif\x00\x00"...)
+	return append(seg, tiff...)
+}
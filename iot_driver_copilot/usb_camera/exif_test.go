@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+// readExif returns the IFD0, Exif and GPS entries of frame's EXIF segment
+// as tag -> raw value bytes.
+func readExif(t *testing.T, frame []byte) (ifd0, exif, gps map[uint16][]byte) {
+	t.Helper()
+	i := 2
+	for frame[i+1] != 0xE1 {
+		i += 2 + int(binary.BigEndian.Uint16(frame[i+2:]))
+		if frame[i+1] == 0xDA {
+			t.Fatal("no APP1 segment")
+		}
+	}
+	seg := frame[i+4 : i+2+int(binary.BigEndian.Uint16(frame[i+2:]))]
+	if string(seg[:6]) != "Exif\x00\x00" {
+		t.Fatalf("APP1 is not EXIF: %q", seg[:6])
+	}
+	tiff := seg[6:]
+	be := binary.BigEndian
+	size := map[uint16]int{tiffByte: 1, tiffASCII: 1, tiffLong: 4, tiffRational: 8}
+	parse := func(off uint32) map[uint16][]byte {
+		m := map[uint16][]byte{}
+		n := int(be.Uint16(tiff[off:]))
+		for k := 0; k < n; k++ {
+			e := tiff[int(off)+2+12*k:]
+			tag, typ, count := be.Uint16(e), be.Uint16(e[2:]), be.Uint32(e[4:])
+			l := int(count) * size[typ]
+			if l <= 4 {
+				m[tag] = e[8 : 8+l]
+			} else {
+				p := be.Uint32(e[8:])
+				m[tag] = tiff[p : int(p)+l]
+			}
+		}
+		return m
+	}
+	ifd0 = parse(be.Uint32(tiff[4:]))
+	exif = parse(be.Uint32(ifd0[0x8769]))
+	if p, ok := ifd0[0x8825]; ok {
+		gps = parse(be.Uint32(p))
+	}
+	return ifd0, exif, gps
+}
+
+func TestWithExif(t *testing.T) {
+	defer func(c ExifConfig) { exifConfig = c }(exifConfig)
+	var src bytes.Buffer
+	if err := jpeg.Encode(&src, image.NewGray(image.Rect(0, 0, 16, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	taken := time.Date(2024, 5, 6, 7, 8, 9, 250e6, time.FixedZone("", 2*3600))
+	meta := snapshotMeta{Taken: taken, Width: 16, Height: 8}
+
+	exifConfig = ExifConfig{Enabled: true}
+	out := withExif(src.Bytes(), meta)
+	ifd0, exif, gps := readExif(t, out)
+	if got := string(ifd0[0x0132]); got != "2024:05:06 07:08:09\x00" {
+		t.Errorf("DateTime = %q", got)
+	}
+	if _, ok := ifd0[0x0110]; ok {
+		t.Error("Model set without EXIF_CAMERA_NAME")
+	}
+	if gps != nil {
+		t.Error("GPS IFD without EXIF_GPS")
+	}
+	for tag, want := range map[uint16]string{0x9003: "2024:05:06 07:08:09\x00", 0x9011: "+02:00\x00", 0x9291: "250\x00"} {
+		if got := string(exif[tag]); got != want {
+			t.Errorf("exif tag %#x = %q, want %q", tag, got, want)
+		}
+	}
+	if w, h := binary.BigEndian.Uint32(exif[0xA002]), binary.BigEndian.Uint32(exif[0xA003]); w != 16 || h != 8 {
+		t.Errorf("pixel dimensions %dx%d", w, h)
+	}
+	if img, err := jpeg.Decode(bytes.NewReader(out)); err != nil || img.Bounds().Dx() != 16 {
+		t.Fatalf("tagged frame does not decode: %v", err)
+	}
+
+	// Tagging again replaces the segment rather than adding a second one.
+	fix, err := parseGPS("-33.8568, 151.2153, 12.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exifConfig = ExifConfig{Enabled: true, CameraName: "dock-door-3", GPS: fix}
+	again := withExif(out, meta)
+	if n := bytes.Count(again, []byte("Exif\x00\x00")); n != 1 {
+		t.Fatalf("%d EXIF segments after retagging", n)
+	}
+	ifd0, _, gps = readExif(t, again)
+	if got := string(ifd0[0x0110]); got != "dock-door-3\x00" {
+		t.Errorf("Model = %q", got)
+	}
+	if string(gps[0x0001]) != "S\x00" || string(gps[0x0003]) != "E\x00" {
+		t.Errorf("GPS refs %q %q", gps[0x0001], gps[0x0003])
+	}
+	lat := gps[0x0002]
+	r := func(b []byte) float64 {
+		return float64(binary.BigEndian.Uint32(b)) / float64(binary.BigEndian.Uint32(b[4:]))
+	}
+	if d, m, s := r(lat), r(lat[8:]), r(lat[16:]); d != 33 || m != 51 || s < 24.47 || s > 24.49 {
+		t.Errorf("latitude %v %v %v, want 33 51 24.48", d, m, s)
+	}
+	if alt := r(gps[0x0006]); gps[0x0005][0] != 0 || alt != 12.5 {
+		t.Errorf("altitude %v ref %d", alt, gps[0x0005][0])
+	}
+
+	for _, bad := range []string{"1", "1,2,3,4", "91,0", "0,181", "north,east"} {
+		if _, err := parseGPS(bad); err == nil {
+			t.Errorf("parseGPS(%q): expected an error", bad)
+		}
+	}
+}
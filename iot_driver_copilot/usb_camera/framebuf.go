@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// --- FRAME BUFFERS ---
+// A frame travels from the capture backend through the taps to the handler
+// that called ReadFrame. Allocating it afresh every time kept the garbage
+// collector busy on ARM32 boards, so the V4L2 backends avoid that:
+//
+//	v4l2    lends out its mmap'd buffers: ReadFrame returns the kernel's
+//	        buffer itself, which is queued for capture again once released.
+//	        At most CAPTURE_LEASED_BUFFERS (default 2, 0 to 2) of its four
+//	        buffers are out at once, so the camera always has some to fill;
+//	        past that, frames are copied into pooled buffers.
+//	webcam  copies each frame out of the library's mmap'd buffer into a
+//	        pooled buffer before queueing it again. (The library's own
+//	        ReadFrame queued it first, so the camera could overwrite a frame
+//	        while it was still being sent.)
+//
+// Pooled buffers are as large as the largest frame seen, so MJPEG frames of
+// varying size reuse them; mmap'd buffers are page-aligned and sized by the
+// kernel, on 32- and 64-bit alike.
+//
+// Ownership: whoever calls ReadFrame owns the frame it returns, and hands it
+// to releaseFrame once nothing refers to it, even if the source has been
+// closed since. A released frame must not be touched again. Taps that keep a
+// frame past ReadFrame (clips, the barcode and gauge readers) keep copies of
+// their own; taps that replace a frame (lens correction, annotations)
+// release the one they replaced. releaseFrame takes the slice as ReadFrame
+// returned it and ignores frames no backend lent or pooled, so frames of
+// other backends are released the same way. A frame that is never released
+// stays out until its source is closed: a lent buffer drops out of the
+// rotation, so the v4l2 backend copies more, and a pooled one is left to
+// the collector.
+//
+// camera_frames_zero_copy, camera_frames_copied and
+// camera_frame_buffer_allocs in /metrics show how often each happens.
+
+type FrameBufferConfig struct {
+	LeasedBuffers int // CAPTURE_LEASED_BUFFERS
+}
+
+var frameBufferConfig = FrameBufferConfig{LeasedBuffers: 2}
+
+var framesZeroCopy, framesCopied, frameBufferAllocs atomic.Uint64
+
+func loadFrameBufferConfig() error {
+	frameBufferConfig = FrameBufferConfig{LeasedBuffers: 2}
+	if v := os.Getenv("CAPTURE_LEASED_BUFFERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > v4l2BufferCount-2 {
+			return fmt.Errorf("CAPTURE_LEASED_BUFFERS must be between 0 and %d", v4l2BufferCount-2)
+		}
+		frameBufferConfig.LeasedBuffers = n
+	}
+	return nil
+}
+
+// frameOwner takes back the frames it handed out; buf is the whole buffer
+// the frame starts.
+type frameOwner interface {
+	takeBack(buf []byte)
+}
+
+type frameLease struct {
+	owner frameOwner
+	buf   []byte
+}
+
+// frameLeases maps the first byte of every frame that is out to its owner.
+var frameLeases = struct {
+	sync.Mutex
+	m map[*byte]frameLease
+}{m: map[*byte]frameLease{}}
+
+// lendFrame records frame, the start of buf, as out on o's behalf.
+func lendFrame(frame, buf []byte, o frameOwner) {
+	frameLeases.Lock()
+	frameLeases.m[unsafe.SliceData(frame)] = frameLease{owner: o, buf: buf}
+	frameLeases.Unlock()
+}
+
+// releaseFrame gives a frame back to the backend it came from.
+func releaseFrame(frame []byte) {
+	if cap(frame) == 0 {
+		return
+	}
+	p := unsafe.SliceData(frame)
+	forgetFrameTime(p)
+	frameLeases.Lock()
+	l, ok := frameLeases.m[p]
+	delete(frameLeases.m, p)
+	frameLeases.Unlock()
+	if ok {
+		l.owner.takeBack(l.buf)
+	}
+}
+
+// forgetFrames drops the leases of o, whose frames are left to the
+// collector.
+func forgetFrames(o frameOwner) {
+	frameLeases.Lock()
+	defer frameLeases.Unlock()
+	for p, l := range frameLeases.m {
+		if l.owner == o {
+			delete(frameLeases.m, p)
+			forgetFrameTime(p)
+		}
+	}
+}
+
+// framePoolDepth is how many free buffers a pool keeps.
+const framePoolDepth = 8
+
+// framePool recycles a source's frame buffers.
+type framePool struct {
+	size atomic.Int64 // capacity of new buffers: the largest frame so far
+	free chan []byte
+}
+
+func newFramePool(size int) *framePool {
+	p := &framePool{free: make(chan []byte, framePoolDepth)}
+	p.size.Store(int64(size))
+	return p
+}
+
+// copyFrame returns a pooled copy of src, lent until releaseFrame.
+func (p *framePool) copyFrame(src []byte) []byte {
+	n := len(src)
+	var buf []byte
+	select {
+	case buf = <-p.free:
+	default:
+	}
+	if cap(buf) < n {
+		size := int(p.size.Load())
+		if size < n {
+			size = n
+			p.size.Store(int64(n))
+		}
+		frameBufferAllocs.Add(1)
+		buf = make([]byte, size)
+	}
+	buf = buf[:cap(buf)]
+	frame := buf[:n:n]
+	copy(frame, src)
+	framesCopied.Add(1)
+	lendFrame(frame, buf, p)
+	return frame
+}
+
+func (p *framePool) takeBack(buf []byte) {
+	if int64(cap(buf)) < p.size.Load() {
+		return // from before a larger frame came; let it go
+	}
+	select {
+	case p.free <- buf:
+	default:
+	}
+}
+
+// close forgets the pool's frames that are still out.
+func (p *framePool) close() { forgetFrames(p) }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+)
+
+func TestFramePoolReuse(t *testing.T) {
+	p := newFramePool(16)
+	defer p.close()
+	a := p.copyFrame([]byte("first"))
+	if string(a) != "first" || cap(a) != len(a) {
+		t.Fatalf("copy = %q (cap %d)", a, cap(a))
+	}
+	first := unsafe.SliceData(a)
+	releaseFrame(a)
+	b := p.copyFrame([]byte("second frame"))
+	if unsafe.SliceData(b) != first {
+		t.Error("a released buffer was not reused")
+	}
+	// b is still out, so the next frame needs a buffer of its own.
+	c := p.copyFrame([]byte("third"))
+	if unsafe.SliceData(c) == first {
+		t.Error("a buffer still out was handed out again")
+	}
+	releaseFrame(b)
+	releaseFrame(c)
+
+	// A frame larger than the buffers gets a new one, and sets their size.
+	big := p.copyFrame(bytes.Repeat([]byte{1}, 40))
+	if len(big) != 40 || p.size.Load() != 40 {
+		t.Errorf("40-byte frame: len %d, pool size %d", len(big), p.size.Load())
+	}
+	releaseFrame(big)
+}
+
+func TestReleaseFrameIgnoresUnknownFrames(t *testing.T) {
+	p := newFramePool(8)
+	defer p.close()
+	releaseFrame(nil)
+	releaseFrame([]byte("not pooled"))
+	a := p.copyFrame([]byte("abc"))
+	releaseFrame(a)
+	releaseFrame(a) // a second release must not hand the buffer out twice
+	b := p.copyFrame([]byte("def"))
+	c := p.copyFrame([]byte("ghi"))
+	if unsafe.SliceData(b) == unsafe.SliceData(c) {
+		t.Error("one buffer handed out twice")
+	}
+}
+
+func TestFramePoolSteadyStateAllocations(t *testing.T) {
+	p := newFramePool(64 << 10)
+	defer p.close()
+	src := bytes.Repeat([]byte{0xAB}, 50<<10)
+	releaseFrame(p.copyFrame(src)) // warm up
+	before := frameBufferAllocs.Load()
+	allocs := testing.AllocsPerRun(100, func() {
+		releaseFrame(p.copyFrame(src))
+	})
+	if allocs > 0.1 || frameBufferAllocs.Load() != before {
+		t.Errorf("%.2f allocations and %d new buffers per frame, want none", allocs, frameBufferAllocs.Load()-before)
+	}
+}
+
+func TestFrameBufferConfig(t *testing.T) {
+	defer loadFrameBufferConfig()
+	t.Setenv("CAPTURE_LEASED_BUFFERS", "0")
+	if err := loadFrameBufferConfig(); err != nil || frameBufferConfig.LeasedBuffers != 0 {
+		t.Errorf("0: %v, %d", err, frameBufferConfig.LeasedBuffers)
+	}
+	t.Setenv("CAPTURE_LEASED_BUFFERS", "3")
+	if err := loadFrameBufferConfig(); err == nil {
+		t.Error("3 of 4 buffers lent was accepted")
+	}
+}
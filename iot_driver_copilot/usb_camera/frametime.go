@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// --- FRAME TIMESTAMPS ---
+// Frames used to be timed by time.Now when a handler got round to them,
+// which is late by however long the frame sat in its buffer and the taps
+// took, and late by a different amount on every camera. The v4l2 backend
+// (CAPTURE_BACKEND=v4l2) keeps the kernel's timestamp instead: the
+// CLOCK_MONOTONIC time the driver stamped the buffer with, usually at the
+// end of exposure, and the buffer's sequence number, which skips when the
+// kernel dropped frames. Every frame carries both times:
+//
+//	timestamp       when the frame was captured, by the clock chosen with
+//	                CAPTURE_TIMESTAMPS: kernel (default) maps the kernel's
+//	                timestamp onto the wall clock (corrected by
+//	                NTP_SERVER); read uses the time ReadFrame returned it
+//	read_timestamp  when ReadFrame returned it
+//	monotonic_ns    the kernel's CLOCK_MONOTONIC timestamp, comparable
+//	                across cameras on one host without any mapping
+//	sequence        the kernel's frame sequence number
+//	clock           which clock timestamp came from: kernel or read
+//
+// The webcam backend, drivers that stamp buffers with no timestamp or a
+// copied one, and frames the driver makes itself (averaged snapshots) have
+// only the read time; monotonic_ns and sequence are left out of those.
+//
+// Multipart stream parts carry them as X-Frame-Timestamp,
+// X-Frame-Read-Timestamp, X-Frame-Monotonic-Ns and X-Frame-Sequence, and
+// snapshots as response headers of the same names; /frame/raw and
+// /stats/image put them in their JSON. camera_frame_latency_seconds in
+// /metrics is how long the last kernel-timed frame took from capture to
+// ReadFrame.
+
+const (
+	v4l2BufFlagTimestampMask      = 0x0000e000
+	v4l2BufFlagTimestampMonotonic = 0x00002000
+)
+
+type FrameTimeConfig struct {
+	Clock string // CAPTURE_TIMESTAMPS: kernel or read
+}
+
+var frameTimeConfig = FrameTimeConfig{Clock: "kernel"}
+
+// frameLatency is the capture-to-read time of the last kernel-timed frame,
+// in nanoseconds.
+var frameLatency atomic.Int64
+
+func loadFrameTimeConfig() error {
+	frameTimeConfig = FrameTimeConfig{Clock: "kernel"}
+	if v := strings.ToLower(os.Getenv("CAPTURE_TIMESTAMPS")); v != "" {
+		if v != "kernel" && v != "read" {
+			return fmt.Errorf("CAPTURE_TIMESTAMPS must be kernel or read, not %q", v)
+		}
+		frameTimeConfig.Clock = v
+	}
+	return nil
+}
+
+// frameTime is when a frame was captured and read.
+type frameTime struct {
+	Captured  time.Time     // by the CAPTURE_TIMESTAMPS clock
+	Read      time.Time     // when ReadFrame returned the frame
+	Monotonic time.Duration // the kernel's CLOCK_MONOTONIC timestamp
+	Sequence  uint32
+	Kernel    bool // Monotonic and Sequence are the kernel's
+}
+
+// readFrameTime is the time of a frame only known to have been read now.
+func readFrameTime() frameTime {
+	now := clockNow()
+	return frameTime{Captured: now, Read: now}
+}
+
+// kernelFrameTime times a frame dequeued in buf. A buffer without a
+// monotonic timestamp gets the read time only.
+func kernelFrameTime(buf *v4l2Buffer) frameTime {
+	ft := readFrameTime()
+	if buf.Flags&v4l2BufFlagTimestampMask != v4l2BufFlagTimestampMonotonic || buf.Timestamp.Nano() == 0 {
+		return ft
+	}
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		return ft
+	}
+	ft.Monotonic = time.Duration(buf.Timestamp.Nano())
+	ft.Sequence = buf.Sequence
+	ft.Kernel = true
+	age := time.Duration(now.Nano()) - ft.Monotonic
+	frameLatency.Store(int64(age))
+	if frameTimeConfig.Clock == "kernel" {
+		ft.Captured = ft.Read.Add(-age)
+	}
+	return ft
+}
+
+// clock names the clock Captured came from.
+func (ft frameTime) clock() string {
+	if ft.Kernel && frameTimeConfig.Clock == "kernel" {
+		return "kernel"
+	}
+	return "read"
+}
+
+// headers returns ft as multipart part header lines.
+func (ft frameTime) headers() []string {
+	h := []string{
+		"X-Frame-Timestamp: " + ft.Captured.UTC().Format(time.RFC3339Nano),
+		"X-Frame-Read-Timestamp: " + ft.Read.UTC().Format(time.RFC3339Nano),
+	}
+	if ft.Kernel {
+		h = append(h,
+			"X-Frame-Monotonic-Ns: "+strconv.FormatInt(int64(ft.Monotonic), 10),
+			"X-Frame-Sequence: "+strconv.FormatUint(uint64(ft.Sequence), 10))
+	}
+	return h
+}
+
+// stamp returns ft in its JSON form.
+func (ft frameTime) stamp() frameStamp {
+	s := frameStamp{Timestamp: ft.Captured.UTC(), ReadTimestamp: ft.Read.UTC(), Clock: ft.clock()}
+	if ft.Kernel {
+		seq := ft.Sequence
+		s.MonotonicNs, s.Sequence = int64(ft.Monotonic), &seq
+	}
+	return s
+}
+
+// frameStamp is how frame times appear in JSON responses.
+type frameStamp struct {
+	Timestamp     time.Time `json:"timestamp"`
+	ReadTimestamp time.Time `json:"read_timestamp"`
+	MonotonicNs   int64     `json:"monotonic_ns,omitempty"`
+	Sequence      *uint32   `json:"sequence,omitempty"`
+	Clock         string    `json:"clock"`
+}
+
+// frameTimes maps the first byte of every timed frame that is out to its
+// time. releaseFrame drops the entry.
+var frameTimes = struct {
+	sync.Mutex
+	m map[*byte]frameTime
+}{m: map[*byte]frameTime{}}
+
+// timeFrame records when frame was captured.
+func timeFrame(frame []byte, ft frameTime) {
+	if cap(frame) == 0 {
+		return
+	}
+	frameTimes.Lock()
+	frameTimes.m[unsafe.SliceData(frame)] = ft
+	frameTimes.Unlock()
+}
+
+// frameTimeOf returns when frame was captured, or the time now if that is
+// not known.
+func frameTimeOf(frame []byte) frameTime {
+	if cap(frame) > 0 {
+		frameTimes.Lock()
+		ft, ok := frameTimes.m[unsafe.SliceData(frame)]
+		frameTimes.Unlock()
+		if ok {
+			return ft
+		}
+	}
+	return readFrameTime()
+}
+
+// carryFrameTime gives out, made from frame, frame's time; taps that
+// replace a frame call it before releasing the one they replaced.
+func carryFrameTime(frame, out []byte) {
+	frameTimes.Lock()
+	ft, ok := frameTimes.m[unsafe.SliceData(frame)]
+	frameTimes.Unlock()
+	if ok {
+		timeFrame(out, ft)
+	}
+}
+
+func forgetFrameTime(p *byte) {
+	frameTimes.Lock()
+	delete(frameTimes.m, p)
+	frameTimes.Unlock()
+}
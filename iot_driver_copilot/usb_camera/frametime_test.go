@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// monotonicBuffer is a dequeued buffer stamped age ago.
+func monotonicBuffer(t *testing.T, age time.Duration) *v4l2Buffer {
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		t.Fatal(err)
+	}
+	return &v4l2Buffer{
+		Flags:     v4l2BufFlagTimestampMonotonic,
+		Timestamp: unix.NsecToTimeval(now.Nano() - int64(age)),
+		Sequence:  41,
+	}
+}
+
+func TestKernelFrameTime(t *testing.T) {
+	defer loadFrameTimeConfig()
+	loadFrameTimeConfig()
+	ft := kernelFrameTime(monotonicBuffer(t, 80*time.Millisecond))
+	if !ft.Kernel || ft.Sequence != 41 || ft.clock() != "kernel" {
+		t.Fatalf("frame time = %+v", ft)
+	}
+	if lag := ft.Read.Sub(ft.Captured); lag < 80*time.Millisecond || lag > 200*time.Millisecond {
+		t.Errorf("captured %v before it was read, want about 80ms", lag)
+	}
+	h := strings.Join(ft.headers(), "\n")
+	if !strings.Contains(h, "X-Frame-Sequence: 41") || !strings.Contains(h, "X-Frame-Monotonic-Ns: ") {
+		t.Errorf("headers:\n%s", h)
+	}
+
+	t.Setenv("CAPTURE_TIMESTAMPS", "read")
+	loadFrameTimeConfig()
+	ft = kernelFrameTime(monotonicBuffer(t, 80*time.Millisecond))
+	if !ft.Captured.Equal(ft.Read) || ft.clock() != "read" || ft.stamp().Sequence == nil {
+		t.Errorf("CAPTURE_TIMESTAMPS=read: %+v", ft)
+	}
+
+	// A copied timestamp says nothing about when the frame was captured.
+	buf := monotonicBuffer(t, time.Second)
+	buf.Flags = 0x4000
+	if ft := kernelFrameTime(buf); ft.Kernel || !ft.Captured.Equal(ft.Read) {
+		t.Errorf("copied timestamp used: %+v", ft)
+	}
+	if s := frameTimeOf(nil).stamp(); s.Sequence != nil || s.Clock != "read" {
+		t.Errorf("untimed frame: %+v", s)
+	}
+
+	t.Setenv("CAPTURE_TIMESTAMPS", "ptp")
+	if err := loadFrameTimeConfig(); err == nil {
+		t.Error("CAPTURE_TIMESTAMPS=ptp was accepted")
+	}
+}
+
+func TestFrameTimeFollowsFrame(t *testing.T) {
+	p := newFramePool(16)
+	defer p.close()
+	frame := p.copyFrame([]byte("frame"))
+	ft := frameTime{Captured: time.Unix(100, 0), Read: time.Unix(101, 0), Kernel: true, Sequence: 7}
+	timeFrame(frame, ft)
+	out := []byte("corrected")
+	carryFrameTime(frame, out)
+	releaseFrame(frame)
+	if got := frameTimeOf(out); got != ft {
+		t.Errorf("replacement frame time = %+v, want %+v", got, ft)
+	}
+	releaseFrame(out)
+	if got := frameTimeOf(out); got.Kernel {
+		t.Error("a released frame kept its time")
+	}
+	// The pooled buffer comes back for the next frame, which is not timed.
+	if got := frameTimeOf(p.copyFrame([]byte("next"))); got.Kernel {
+		t.Error("a reused buffer kept the time of its last frame")
+	}
+}
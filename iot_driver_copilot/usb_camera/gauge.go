@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- GAUGE READING ---
+// GAUGE_ANALYZER turns the camera into a retrofit sensor: every
+// GAUGE_INTERVAL_MS (default 5000) it cuts the region of interest named by
+// GAUGE_ROI (roi.go) out of a frame and reads a number from it.
+// Analyzers:
+//
+//	dial          an analog needle. The needle is the darkest ray from the
+//	              centre of the region (the lightest with GAUGE_POLARITY=light);
+//	              its angle, in degrees clockwise from 12 o'clock, maps
+//	              GAUGE_MIN_ANGLE..GAUGE_MAX_ANGLE (default -135..135) onto
+//	              GAUGE_MIN_VALUE..GAUGE_MAX_VALUE (default 0..100); a few
+//	              degrees past either end reads as that end.
+//	seven_segment a 7-segment readout of GAUGE_DIGITS digits (default 4) filling
+//	              the region. Lit segments are dark (LCD, GAUGE_POLARITY=dark,
+//	              the default) or light (LED). GAUGE_DECIMALS places the decimal
+//	              point, so 1234 with GAUGE_DECIMALS=1 reads 123.4.
+//	command       GAUGE_COMMAND, given the region as a JPEG on stdin, prints
+//	              the number; any other reader plugs in here.
+//
+// Each reading,
+//
+//	{"value": 42.5, "text": "42.5", "roi": "gauge", "analyzer": "dial", "time": "..."}
+//
+// is POSTed to GAUGE_WEBHOOK_URLS, published to GAUGE_MQTT_TOPIC (default
+// camera/gauge) on MQTT_BROKER, and with GAUGE_DISPLAY_URL shown on the
+// modbus_display driver there (displaylink.go). "text" has GAUGE_DECIMALS
+// decimals. GET /gauge shows the latest reading and error. A reader that
+// starts failing records "gauge_failed" on the event timeline, and
+// "gauge_recovered" once it reads again.
+
+type GaugeConfig struct {
+	Analyzer     string        // GAUGE_ANALYZER: dial, seven_segment or command; empty is off
+	ROI          string        // GAUGE_ROI
+	Interval     time.Duration // GAUGE_INTERVAL_MS
+	MinAngle     float64       // GAUGE_MIN_ANGLE
+	MaxAngle     float64       // GAUGE_MAX_ANGLE
+	MinValue     float64       // GAUGE_MIN_VALUE
+	MaxValue     float64       // GAUGE_MAX_VALUE
+	Digits       int           // GAUGE_DIGITS
+	Decimals     int           // GAUGE_DECIMALS
+	Light        bool          // GAUGE_POLARITY=light: the needle or lit segments are brighter than the background
+	Command      []string      // GAUGE_COMMAND, split on spaces
+	Webhooks     []string      // GAUGE_WEBHOOK_URLS
+	Topic        string        // GAUGE_MQTT_TOPIC
+	DisplayURL   string        // GAUGE_DISPLAY_URL: base URL of a modbus_display driver
+	DisplayToken string        // GAUGE_DISPLAY_TOKEN
+
+	DisplayDecimals  int           // GAUGE_DISPLAY_DECIMALS
+	DisplayUnit      string        // GAUGE_DISPLAY_UNIT
+	DisplayWidth     int           // GAUGE_DISPLAY_WIDTH; 0 is no limit
+	DisplayZone      int           // GAUGE_DISPLAY_ZONE: a slave id; 0 is the driver's own display
+	DisplayStale     time.Duration // GAUGE_DISPLAY_STALE_MS; 0 is off
+	DisplayStaleText string        // GAUGE_DISPLAY_STALE_TEXT
+}
+
+var gaugeConfig GaugeConfig
+
+// gauge is the running reader; nil unless GAUGE_ANALYZER is set.
+var gauge *gaugeReader
+
+var (
+	gaugeReadings   atomic.Uint64
+	gaugeReadErrors atomic.Uint64
+)
+
+// gaugeAnalyzer reads a number from a region of interest.
+type gaugeAnalyzer interface {
+	read(ctx context.Context, img *image.RGBA) (float64, error)
+}
+
+// gaugeAnalyzers builds the analyzer GAUGE_ANALYZER names from gaugeConfig.
+var gaugeAnalyzers = map[string]func() (gaugeAnalyzer, error){
+	"dial":          func() (gaugeAnalyzer, error) { return dialAnalyzer{}, nil },
+	"seven_segment": func() (gaugeAnalyzer, error) { return segmentAnalyzer{}, nil },
+	"command": func() (gaugeAnalyzer, error) {
+		if len(gaugeConfig.Command) == 0 {
+			return nil, errors.New("GAUGE_ANALYZER=command needs GAUGE_COMMAND")
+		}
+		path, err := exec.LookPath(gaugeConfig.Command[0])
+		if err != nil {
+			return nil, fmt.Errorf("GAUGE_COMMAND: %v", err)
+		}
+		return commandAnalyzer{path: path, args: gaugeConfig.Command[1:]}, nil
+	},
+}
+
+func loadGaugeConfig() error {
+	gaugeConfig = GaugeConfig{Interval: 5 * time.Second, MinAngle: -135, MaxAngle: 135, MaxValue: 100, Digits: 4}
+	gauge = nil
+	gaugeConfig.Analyzer = os.Getenv("GAUGE_ANALYZER")
+	if gaugeConfig.Analyzer == "" {
+		return nil
+	}
+	newAnalyzer, ok := gaugeAnalyzers[gaugeConfig.Analyzer]
+	if !ok {
+		return fmt.Errorf("GAUGE_ANALYZER must be dial, seven_segment or command, got %q", gaugeConfig.Analyzer)
+	}
+	gaugeConfig.ROI = os.Getenv("GAUGE_ROI")
+	if !roiNamePattern.MatchString(gaugeConfig.ROI) {
+		return errors.New("GAUGE_ANALYZER needs GAUGE_ROI, the name of a region of interest")
+	}
+	for _, s := range []struct {
+		name     string
+		dst      *int
+		min, max int
+	}{{"GAUGE_DIGITS", &gaugeConfig.Digits, 1, 12}, {"GAUGE_DECIMALS", &gaugeConfig.Decimals, 0, 6}} {
+		if v := os.Getenv(s.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < s.min || n > s.max {
+				return fmt.Errorf("%s must be between %d and %d", s.name, s.min, s.max)
+			}
+			*s.dst = n
+		}
+	}
+	if v := os.Getenv("GAUGE_INTERVAL_MS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 100 || n > 3600000 {
+			return errors.New("GAUGE_INTERVAL_MS must be between 100 and 3600000")
+		}
+		gaugeConfig.Interval = time.Duration(n) * time.Millisecond
+	}
+	for _, s := range []struct {
+		name string
+		dst  *float64
+	}{{"GAUGE_MIN_ANGLE", &gaugeConfig.MinAngle}, {"GAUGE_MAX_ANGLE", &gaugeConfig.MaxAngle},
+		{"GAUGE_MIN_VALUE", &gaugeConfig.MinValue}, {"GAUGE_MAX_VALUE", &gaugeConfig.MaxValue}} {
+		if v := os.Getenv(s.name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return fmt.Errorf("%s must be a number", s.name)
+			}
+			*s.dst = f
+		}
+	}
+	if sweep := gaugeConfig.MaxAngle - gaugeConfig.MinAngle; sweep <= 0 || sweep > 360 {
+		return errors.New("GAUGE_MAX_ANGLE must be above GAUGE_MIN_ANGLE, by at most 360 degrees")
+	}
+	switch v := os.Getenv("GAUGE_POLARITY"); v {
+	case "", "dark":
+	case "light":
+		gaugeConfig.Light = true
+	default:
+		return fmt.Errorf("GAUGE_POLARITY must be dark or light, got %q", v)
+	}
+	gaugeConfig.Command = strings.Fields(os.Getenv("GAUGE_COMMAND"))
+	webhooks, err := webhookURLs("GAUGE_WEBHOOK_URLS")
+	if err != nil {
+		return err
+	}
+	gaugeConfig.Webhooks = webhooks
+	gaugeConfig.Topic = getenvDefault("GAUGE_MQTT_TOPIC", "camera/gauge")
+	if v := strings.TrimSuffix(os.Getenv("GAUGE_DISPLAY_URL"), "/"); v != "" {
+		if p, err := url.Parse(v); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return fmt.Errorf("GAUGE_DISPLAY_URL must be the http(s) URL of a modbus_display driver, got %q", v)
+		}
+		gaugeConfig.DisplayURL = v
+	}
+	if err := loadGaugeDisplayConfig(); err != nil {
+		return err
+	}
+	a, err := newAnalyzer()
+	if err != nil {
+		return err
+	}
+	gauge = newGaugeReader(a)
+	return nil
+}
+
+type gaugeReading struct {
+	Value    float64   `json:"value"`
+	Text     string    `json:"text"` // the value with GAUGE_DECIMALS decimals
+	ROI      string    `json:"roi"`
+	Analyzer string    `json:"analyzer"`
+	Time     time.Time `json:"time"`
+}
+
+type gaugeReader struct {
+	analyzer gaugeAnalyzer
+	frames   chan clipFrame // one waiting frame at most
+	out      *publisher
+	display  *displayLink // nil without GAUGE_DISPLAY_URL
+
+	mu          sync.Mutex
+	lastSample  time.Time
+	last        *gaugeReading
+	lastErr     string
+	lastErrTime time.Time
+	failing     bool
+}
+
+func newGaugeReader(a gaugeAnalyzer) *gaugeReader {
+	g := &gaugeReader{analyzer: a, frames: make(chan clipFrame, 1),
+		out: newPublisher("gauge", gaugeConfig.Webhooks, gaugeConfig.Topic, "-gauge")}
+	if gaugeConfig.DisplayURL != "" {
+		g.display = newDisplayLink(time.Now())
+	}
+	return g
+}
+
+// offer queues a copy of frame if a GAUGE_INTERVAL_MS has passed since the
+// last one. It never blocks the reader.
+func (g *gaugeReader) offer(frame []byte, info sourceInfo, now time.Time) {
+	g.mu.Lock()
+	if now.Sub(g.lastSample) < gaugeConfig.Interval {
+		g.mu.Unlock()
+		return
+	}
+	g.lastSample = now
+	g.mu.Unlock()
+	select {
+	case g.frames <- clipFrame{at: now, frame: append([]byte(nil), frame...), format: info.Format, width: info.Width, height: info.Height}:
+	default: // still reading the last one
+	}
+}
+
+func (g *gaugeReader) sampledSince(t time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.lastSample.After(t)
+}
+
+// run reads the queued frames and, like the barcode scanner, reads the
+// camera itself while nobody else does.
+func (g *gaugeReader) run(ctx context.Context) {
+	defer g.out.connect()()
+	if g.display != nil {
+		go g.display.run(ctx)
+	}
+	go func() {
+		t := time.NewTicker(gaugeConfig.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+			cameraState.mu.Lock()
+			running, cam := cameraState.running, cameraState.source
+			cameraState.mu.Unlock()
+			if !running || cam == nil || g.sampledSince(time.Now().Add(-2*gaugeConfig.Interval)) {
+				continue
+			}
+			if cam.WaitForFrame(1) != nil {
+				continue
+			}
+			if frame, err := cam.ReadFrame(); len(frame) > 0 {
+				if err == nil {
+					markFrame()
+				}
+				releaseFrame(frame)
+			}
+		}
+	}()
+	for {
+		select {
+		case f := <-g.frames:
+			g.read(ctx, f)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *gaugeReader) read(ctx context.Context, f clipFrame) {
+	value, err := g.analyze(ctx, f)
+	if err != nil {
+		gaugeReadErrors.Add(1)
+		g.mu.Lock()
+		g.lastErr, g.lastErrTime = err.Error(), clockNow().UTC()
+		first := !g.failing
+		g.failing = true
+		g.mu.Unlock()
+		if first {
+			log.Printf("gauge: %v", err)
+			recordEvent("gauge_failed", "", map[string]interface{}{"roi": gaugeConfig.ROI, "error": err.Error()})
+		}
+		return
+	}
+	gaugeReadings.Add(1)
+	reading := gaugeReading{Value: value, Text: strconv.FormatFloat(value, 'f', gaugeConfig.Decimals, 64),
+		ROI: gaugeConfig.ROI, Analyzer: gaugeConfig.Analyzer, Time: clockNow().UTC()}
+	g.mu.Lock()
+	g.last = &reading
+	recovered := g.failing
+	g.failing = false
+	g.mu.Unlock()
+	if recovered {
+		recordEvent("gauge_recovered", "", map[string]interface{}{"roi": gaugeConfig.ROI, "value": value})
+	}
+	if body, err := json.Marshal(reading); err == nil {
+		g.out.publish(body)
+	}
+	if g.display != nil {
+		g.display.show(ctx, value, time.Now())
+	}
+}
+
+func (g *gaugeReader) analyze(ctx context.Context, f clipFrame) (float64, error) {
+	reg, ok := rois.get(gaugeConfig.ROI)
+	if !ok {
+		return 0, fmt.Errorf("no region of interest named %s", gaugeConfig.ROI)
+	}
+	img, err := roiImage(f.frame, f.format, f.width, f.height, reg)
+	if err != nil {
+		return 0, err
+	}
+	actx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return g.analyzer.read(actx, img)
+}
+
+func (g *gaugeReader) status() map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := map[string]interface{}{"analyzer": gaugeConfig.Analyzer, "roi": gaugeConfig.ROI,
+		"interval_ms": gaugeConfig.Interval.Milliseconds(), "reading": g.last}
+	if g.lastErr != "" {
+		st["error"], st["error_time"] = g.lastErr, g.lastErrTime
+	}
+	if g.display != nil {
+		st["display"] = g.display.status()
+	}
+	return st
+}
+
+// gaugeTap hands the frames read from a source to the gauge reader.
+type gaugeTap struct {
+	FrameSource
+	info sourceInfo
+}
+
+func (s *gaugeTap) ReadFrame() ([]byte, error) {
+	frame, err := s.FrameSource.ReadFrame()
+	if g := gauge; g != nil && len(frame) > 0 {
+		g.offer(frame, s.info, time.Now())
+	}
+	return frame, err
+}
+
+func handleGauge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	g := gauge
+	if g == nil {
+		http.Error(w, "Gauge reading is off (GAUGE_ANALYZER)", http.StatusNotFound)
+		return
+	}
+	jsonResponse(w, http.StatusOK, g.status())
+}
+
+// luma is the brightness of pixel (x, y), 0-255; dark marks are inverted
+// so the analyzers always look for the brightest marks.
+func luma(img *image.RGBA, x, y int) float64 {
+	i := img.PixOffset(x, y)
+	l := 0.299*float64(img.Pix[i]) + 0.587*float64(img.Pix[i+1]) + 0.114*float64(img.Pix[i+2])
+	if !gaugeConfig.Light {
+		return 255 - l
+	}
+	return l
+}
+
+// minGaugeContrast is how much brighter than the rest, in luma levels, a
+// needle or a lit segment must be.
+const minGaugeContrast = 24
+
+type dialAnalyzer struct{}
+
+func (dialAnalyzer) read(_ context.Context, img *image.RGBA) (float64, error) {
+	b := img.Bounds()
+	cx, cy := float64(b.Min.X)+float64(b.Dx())/2, float64(b.Min.Y)+float64(b.Dy())/2
+	radius := float64(min(b.Dx(), b.Dy())) / 2
+	if radius < 8 {
+		return 0, errors.New("the region is too small for a dial")
+	}
+	// Walk each ray from a fifth of the radius, clear of the hub, to the
+	// scale, in half-degree steps.
+	const steps = 720
+	var sums [steps]float64
+	for a := 0; a < steps; a++ {
+		theta := float64(a) * 2 * math.Pi / steps
+		dx, dy := math.Sin(theta), -math.Cos(theta)
+		n := 0
+		for t := 0.2 * radius; t <= 0.85*radius; t++ {
+			x, y := int(cx+dx*t), int(cy+dy*t)
+			if image.Pt(x, y).In(b) {
+				sums[a] += luma(img, x, y)
+				n++
+			}
+		}
+		if n > 0 {
+			sums[a] /= float64(n)
+		}
+	}
+	best, mean := 0, 0.0
+	for a, s := range sums {
+		mean += s / steps
+		if s > sums[best] {
+			best = a
+		}
+	}
+	if sums[best]-mean < minGaugeContrast {
+		return 0, errors.New("no needle found")
+	}
+	return dialValue(float64(best) * 360 / steps)
+}
+
+// dialEndSlack is how far, in degrees, a needle resting on its stop pin may
+// lie beyond the end of the scale.
+const dialEndSlack = 5
+
+// dialValue maps a needle angle, in degrees clockwise from 12 o'clock, onto
+// the scale.
+func dialValue(angle float64) (float64, error) {
+	c := gaugeConfig
+	sweep := c.MaxAngle - c.MinAngle
+	off := math.Mod(angle-c.MinAngle, 360)
+	if off < 0 {
+		off += 360
+	}
+	switch {
+	case off <= sweep:
+	case off-sweep <= dialEndSlack:
+		off = sweep
+	case 360-off <= dialEndSlack:
+		off = 0
+	default:
+		return 0, fmt.Errorf("needle at %.1f degrees is outside the scale", angle)
+	}
+	return c.MinValue + off/sweep*(c.MaxValue-c.MinValue), nil
+}
+
+type segmentAnalyzer struct{}
+
+// segmentSpots are where segments a-g sit in a digit cell, as fractions
+// of its width and height.
+var segmentSpots = [7][2]float64{
+	{0.5, 0.1}, {0.8, 0.3}, {0.8, 0.7}, {0.5, 0.9}, {0.2, 0.7}, {0.2, 0.3}, {0.5, 0.5},
+}
+
+// segmentDigits maps lit segments (bit 0 = a ... bit 6 = g) to characters.
+var segmentDigits = map[uint8]byte{
+	0x3f: '0', 0x06: '1', 0x5b: '2', 0x4f: '3', 0x66: '4', 0x6d: '5', 0x7d: '6', 0x7c: '6',
+	0x07: '7', 0x27: '7', 0x7f: '8', 0x6f: '9', 0x67: '9', 0x40: '-', 0x00: ' ',
+}
+
+func (segmentAnalyzer) read(_ context.Context, img *image.RGBA) (float64, error) {
+	b := img.Bounds()
+	digits := gaugeConfig.Digits
+	cellW := float64(b.Dx()) / float64(digits)
+	if cellW < 4 || b.Dy() < 8 {
+		return 0, errors.New("the region is too small for the digits")
+	}
+	// Each spot is the mean of a patch a tenth of the cell across.
+	pw, ph := max(1, int(cellW/10)), max(1, b.Dy()/20)
+	spots := make([]float64, digits*7)
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for d := 0; d < digits; d++ {
+		for s, p := range segmentSpots {
+			x0 := b.Min.X + int((float64(d)+p[0])*cellW) - pw/2
+			y0 := b.Min.Y + int(p[1]*float64(b.Dy())) - ph/2
+			sum, n := 0.0, 0
+			for y := y0; y < y0+ph; y++ {
+				for x := x0; x < x0+pw; x++ {
+					if image.Pt(x, y).In(b) {
+						sum += luma(img, x, y)
+						n++
+					}
+				}
+			}
+			v := sum / float64(max(n, 1))
+			spots[d*7+s] = v
+			lo, hi = min(lo, v), max(hi, v)
+		}
+	}
+	if hi-lo < minGaugeContrast {
+		return 0, errors.New("no lit segments found")
+	}
+	threshold := (lo + hi) / 2
+	var text []byte
+	for d := 0; d < digits; d++ {
+		var lit uint8
+		for s := 0; s < 7; s++ {
+			if spots[d*7+s] > threshold {
+				lit |= 1 << s
+			}
+		}
+		c, ok := segmentDigits[lit]
+		if !ok {
+			return 0, fmt.Errorf("digit %d is not readable (segments %#02x)", d+1, lit)
+		}
+		if c == ' ' {
+			if len(text) > 0 {
+				return 0, fmt.Errorf("digit %d is blank", d+1)
+			}
+			continue
+		}
+		text = append(text, c)
+	}
+	n, err := strconv.ParseInt(string(text), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("readout %q is not a number", text)
+	}
+	return float64(n) / math.Pow10(gaugeConfig.Decimals), nil
+}
+
+type commandAnalyzer struct {
+	path string
+	args []string
+}
+
+func (c commandAnalyzer) read(ctx context.Context, img *image.RGBA) (float64, error) {
+	var in bytes.Buffer
+	if err := jpeg.Encode(&in, img, &jpeg.Options{Quality: 90}); err != nil {
+		return 0, err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.path, c.args...)
+	cmd.Stdin, cmd.Stderr = &in, &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("GAUGE_COMMAND: %v %s", err, strings.TrimSpace(stderr.String()))
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return 0, errors.New("GAUGE_COMMAND printed nothing")
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("GAUGE_COMMAND printed %q, not a number", fields[0])
+	}
+	return v, nil
+}
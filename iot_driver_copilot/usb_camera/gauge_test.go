@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func whiteImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 255
+	}
+	return img
+}
+
+func TestDialAnalyzer(t *testing.T) {
+	saved := gaugeConfig
+	defer func() { gaugeConfig = saved }()
+	gaugeConfig = GaugeConfig{MinAngle: -135, MaxAngle: 135, MinValue: 0, MaxValue: 270}
+	needle := func(deg float64) *image.RGBA {
+		img := whiteImage(100, 100)
+		theta := deg * math.Pi / 180
+		for t := 0.0; t < 45; t += 0.5 {
+			x, y := 50+int(math.Sin(theta)*t), 50-int(math.Cos(theta)*t)
+			for dx := -1; dx <= 1; dx++ {
+				img.Set(x+dx, y, color.Black)
+			}
+		}
+		return img
+	}
+	for deg, want := range map[float64]float64{0: 135, 90: 225, -90: 45, -135: 0} {
+		got, err := dialAnalyzer{}.read(context.Background(), needle(deg))
+		if err != nil || math.Abs(got-want) > 2 {
+			t.Errorf("needle at %v degrees read %v %v, want %v", deg, got, err, want)
+		}
+	}
+	if _, err := (dialAnalyzer{}).read(context.Background(), needle(180)); err == nil {
+		t.Error("needle below the scale read")
+	}
+	if _, err := (dialAnalyzer{}).read(context.Background(), whiteImage(100, 100)); err == nil {
+		t.Error("blank dial read")
+	}
+}
+
+// drawSegments paints a readout: one character per cell, dark on white.
+func drawSegments(text string, cellW, h int) *image.RGBA {
+	masks := map[byte]uint8{' ': 0}
+	for m, c := range segmentDigits {
+		if _, ok := masks[c]; !ok || m > masks[c] {
+			masks[c] = m
+		}
+	}
+	img := whiteImage(cellW*len(text), h)
+	for d := 0; d < len(text); d++ {
+		for s, p := range segmentSpots {
+			if masks[text[d]]&(1<<s) == 0 {
+				continue
+			}
+			cx, cy := int((float64(d)+p[0])*float64(cellW)), int(p[1]*float64(h))
+			for y := cy - h/16; y <= cy+h/16; y++ {
+				for x := cx - cellW/8; x <= cx+cellW/8; x++ {
+					img.Set(x, y, color.Black)
+				}
+			}
+		}
+	}
+	return img
+}
+
+func TestSegmentAnalyzer(t *testing.T) {
+	saved := gaugeConfig
+	defer func() { gaugeConfig = saved }()
+	gaugeConfig = GaugeConfig{Digits: 4, Decimals: 1}
+	for text, want := range map[string]float64{"1234": 123.4, " -12": -1.2, "  80": 8, "9876": 987.6} {
+		got, err := segmentAnalyzer{}.read(context.Background(), drawSegments(text, 40, 80))
+		if err != nil || math.Abs(got-want) > 1e-9 {
+			t.Errorf("%q read %v %v, want %v", text, got, err, want)
+		}
+	}
+	for _, bad := range []string{"1 34", "    "} {
+		if v, err := (segmentAnalyzer{}).read(context.Background(), drawSegments(bad, 40, 80)); err == nil {
+			t.Errorf("%q read as %v", bad, v)
+		}
+	}
+}
+
+func TestLoadGaugeConfig(t *testing.T) {
+	defer func() { gaugeConfig, gauge = GaugeConfig{}, nil }()
+	for _, env := range []map[string]string{
+		{"GAUGE_ANALYZER": "ocr", "GAUGE_ROI": "gauge"},
+		{"GAUGE_ANALYZER": "dial"},
+		{"GAUGE_ANALYZER": "dial", "GAUGE_ROI": "gauge", "GAUGE_MIN_ANGLE": "90", "GAUGE_MAX_ANGLE": "-90"},
+		{"GAUGE_ANALYZER": "command", "GAUGE_ROI": "gauge"},
+		{"GAUGE_ANALYZER": "dial", "GAUGE_ROI": "gauge", "GAUGE_DISPLAY_URL": "display:8080"},
+	} {
+		t.Run("", func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			if loadGaugeConfig() == nil {
+				t.Errorf("%v accepted", env)
+			}
+		})
+	}
+	t.Setenv("GAUGE_ANALYZER", "seven_segment")
+	t.Setenv("GAUGE_ROI", "meter")
+	t.Setenv("GAUGE_DIGITS", "5")
+	if err := loadGaugeConfig(); err != nil || gauge == nil || gaugeConfig.Digits != 5 || gaugeConfig.Light {
+		t.Errorf("%+v %v", gaugeConfig, err)
+	}
+}
+
+type fixedGauge float64
+
+func (f fixedGauge) read(context.Context, *image.RGBA) (float64, error) { return float64(f), nil }
+
+func TestGaugeReading(t *testing.T) {
+	savedCam, savedROI, savedSet := cameraConfig, roiConfig, rois
+	defer func() {
+		closeCamera()
+		cameraConfig, roiConfig, rois, gaugeConfig, gauge = savedCam, savedROI, savedSet, GaugeConfig{}, nil
+	}()
+	hooked := make(chan gaugeReading, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var g gaugeReading
+		json.NewDecoder(r.Body).Decode(&g)
+		select {
+		case hooked <- g:
+		default:
+		}
+	}))
+	defer hook.Close()
+	shown := make(chan string, 4)
+	display := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			DisplayValue string `json:"display_value"`
+			Persist      bool   `json:"persist"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Method != http.MethodPut || r.URL.Path != "/display/value" || r.Header.Get("Authorization") != "Bearer display-key" || req.Persist {
+			t.Errorf("display write %s %s %q %+v", r.Method, r.URL.Path, r.Header.Get("Authorization"), req)
+		}
+		select {
+		case shown <- req.DisplayValue:
+		default:
+		}
+	}))
+	defer display.Close()
+
+	roiConfig.File = ""
+	rois = &roiSet{rois: map[string]roi{}}
+	gaugeConfig = GaugeConfig{Analyzer: "test", ROI: "meter", Interval: 50 * time.Millisecond, Decimals: 2, DisplayDecimals: 2,
+		Webhooks: []string{hook.URL}, DisplayURL: display.URL, DisplayToken: "display-key"}
+	gauge = newGaugeReader(fixedGauge(42.5))
+	rec := httptest.NewRecorder()
+	handleGauge(rec, httptest.NewRequest(http.MethodGet, "/gauge", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /gauge = %d", rec.Code)
+	}
+
+	cameraConfig = CameraConfig{DevicePath: "/dev/video-missing", Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		gauge.run(ctx)
+	}()
+	defer func() { stop(); <-done }()
+
+	// Without its region the reader fails, and says so once.
+	deadline := time.Now().Add(5 * time.Second)
+	for gaugeReadErrors.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if st := gauge.status(); st["error"] != "no region of interest named meter" {
+		t.Errorf("status without the region: %v", st)
+	}
+	rois.update(func(m map[string]roi) error {
+		m["meter"] = roi{Name: "meter", X: 0.25, Y: 0.25, Width: 0.5, Height: 0.5}
+		return nil
+	})
+	select {
+	case g := <-hooked:
+		if g.Value != 42.5 || g.Text != "42.50" || g.ROI != "meter" {
+			t.Errorf("webhook got %+v", g)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+	select {
+	case v := <-shown:
+		if v != "42.50" {
+			t.Errorf("display shows %q", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("display not written")
+	}
+	if evs, _ := events.query(eventQuery{types: map[string]bool{"gauge_failed": true, "gauge_recovered": true}, limit: 1000}); len(evs) < 2 ||
+		evs[len(evs)-2].Type != "gauge_failed" || evs[len(evs)-1].Type != "gauge_recovered" {
+		t.Errorf("timeline: %+v", evs)
+	}
+	rec = httptest.NewRecorder()
+	handleGauge(rec, httptest.NewRequest(http.MethodGet, "/gauge", nil))
+	var st struct{ Reading *gaugeReading }
+	if json.NewDecoder(rec.Body).Decode(&st); st.Reading == nil || st.Reading.Value != 42.5 {
+		t.Errorf("GET /gauge: %s", rec.Body)
+	}
+}
@@ -1,7 +1,18 @@
 module camera-driver
 
-go 1.21
+go 1.22
 
 require (
-	github.com/blackjack/webcam v0.4.0
-)
\ No newline at end of file
+	github.com/andybalholm/brotli v1.1.0
+	github.com/blackjack/webcam v0.6.1
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/gorilla/websocket v1.5.0
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/image v0.18.0
+	golang.org/x/sys v0.21.0
+)
+
+require (
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+)
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"camera-driver/client"
+)
+
+// TestGoClient drives a simulated camera through the client package.
+func TestGoClient(t *testing.T) {
+	saved := cameraConfig
+	defer func() { closeCamera(); cameraConfig = saved }()
+	cameraConfig = CameraConfig{DevicePath: "/dev/video-missing", Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status/all", handleStatusAll)
+	mux.HandleFunc("/capture/start", handleStartCapture)
+	mux.HandleFunc("/capture/stop", handleStopCapture)
+	mux.HandleFunc("/snapshot", handleSnapshot)
+	mux.HandleFunc("/stream", handleStream)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	c, err := client.New(srv.URL, client.WithRetry(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var re *client.Error
+	if _, err := c.Snapshot(ctx); !errors.As(err, &re) || re.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Snapshot before capture = %v", err)
+	}
+	if err := c.StartCapture(ctx, client.CaptureOptions{Width: 99999}); !errors.As(err, &re) || re.StatusCode != http.StatusBadRequest {
+		t.Fatalf("StartCapture(width 99999) = %v", err)
+	}
+	if err := c.StartCapture(ctx, client.CaptureOptions{Format: "MJPEG", Width: 32, Height: 24}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := c.GetStatus(ctx)
+	if err != nil || !st.Camera.Capturing || st.Camera.Width != 32 || st.Camera.Backend != "simulate" {
+		t.Fatalf("GetStatus = %+v, %v", st, err)
+	}
+	if jpg, err := c.Snapshot(ctx); err != nil || len(jpg) < 2 || jpg[0] != 0xFF || jpg[1] != 0xD8 {
+		t.Fatalf("Snapshot = %d bytes, %v", len(jpg), err)
+	}
+
+	stop := errors.New("enough")
+	n := 0
+	err = c.StreamFrames(ctx, func(f client.Frame) error {
+		if f.Width != 32 || f.Height != 24 {
+			t.Errorf("frame %d is %dx%d", n, f.Width, f.Height)
+		}
+		if n++; n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 3 {
+		t.Fatalf("StreamFrames = %v after %d frames", err, n)
+	}
+
+	streamCtx, stopStream := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- c.StreamFrames(streamCtx, func(client.Frame) error { return nil }) }()
+	time.Sleep(200 * time.Millisecond)
+	stopStream()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("StreamFrames after cancel = %v", err)
+	}
+	if err := c.StopCapture(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Exposure statistics for lighting controllers:
+//
+//	GET /stats/image[?bins=256]
+//
+// computes, on the next captured frame, the luminance histogram (bins
+// equal-width buckets over 0-255), the mean, median and standard deviation
+// of luminance, and the percentage of pixels clipped to black or white.
+// Luminance is the Y of the frame: YUYV frames carry it directly, MJPEG
+// frames are decoded. YUYV uses video range, so black is Y<=16 and white
+// Y>=235; JPEG uses full range, 0 and 255. Frames are not watermarked.
+
+type imageStats struct {
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	frameStamp
+	Mean            float64 `json:"mean"`
+	Median          int     `json:"median"`
+	StdDev          float64 `json:"stddev"`
+	ClippedBlackPct float64 `json:"clipped_black_pct"`
+	ClippedWhitePct float64 `json:"clipped_white_pct"`
+	Histogram       []int   `json:"histogram"`
+}
+
+// lumaStats summarizes luma samples. Values at or below black, or at or
+// above white, count as clipped.
+func lumaStats(luma []byte, bins int, black, white byte) imageStats {
+	var counts [256]int
+	for _, y := range luma {
+		counts[y]++
+	}
+	st := imageStats{Histogram: make([]int, bins)}
+	n := len(luma)
+	if n == 0 {
+		return st
+	}
+	var sum, sumSq float64
+	var clippedBlack, clippedWhite, seen int
+	st.Median = -1
+	for v, c := range counts {
+		st.Histogram[v*bins/256] += c
+		sum += float64(v * c)
+		sumSq += float64(v * v * c)
+		if v <= int(black) {
+			clippedBlack += c
+		}
+		if v >= int(white) {
+			clippedWhite += c
+		}
+		if seen += c; st.Median < 0 && seen*2 >= n {
+			st.Median = v
+		}
+	}
+	mean := sum / float64(n)
+	st.Mean = round2(mean)
+	st.StdDev = round2(math.Sqrt(math.Max(sumSq/float64(n)-mean*mean, 0)))
+	st.ClippedBlackPct = round2(100 * float64(clippedBlack) / float64(n))
+	st.ClippedWhitePct = round2(100 * float64(clippedWhite) / float64(n))
+	return st
+}
+
+func round2(f float64) float64 { return math.Round(f*100) / 100 }
+
+// yuyvLuma picks the Y samples out of a YUYV frame.
+func yuyvLuma(frame []byte) []byte {
+	luma := make([]byte, 0, len(frame)/2)
+	for i := 0; i < len(frame); i += 2 {
+		luma = append(luma, frame[i])
+	}
+	return luma
+}
+
+// imageLuma returns the luma plane of a decoded JPEG, converting when the
+// decoder did not produce YCbCr or grayscale.
+func imageLuma(img image.Image) []byte {
+	b := img.Bounds()
+	luma := make([]byte, 0, b.Dx()*b.Dy())
+	switch m := img.(type) {
+	case *image.YCbCr:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			off := (y-m.Rect.Min.Y)*m.YStride + b.Min.X - m.Rect.Min.X
+			luma = append(luma, m.Y[off:off+b.Dx()]...)
+		}
+	case *image.Gray:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			off := m.PixOffset(b.Min.X, y)
+			luma = append(luma, m.Pix[off:off+b.Dx()]...)
+		}
+	default:
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				luma = append(luma, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+		}
+	}
+	return luma
+}
+
+func handleImageStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bins := 256
+	if v := r.URL.Query().Get("bins"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 256 {
+			http.Error(w, "bins must be an integer from 1 to 256", http.StatusBadRequest)
+			return
+		}
+		bins = n
+	}
+	cameraState.mu.Lock()
+	running := cameraState.running
+	cam := cameraState.source
+	format := cameraState.formatStr
+	width, height := int(cameraState.width), int(cameraState.height)
+	cameraState.mu.Unlock()
+	if !running {
+		http.Error(w, "Camera is not capturing", http.StatusServiceUnavailable)
+		return
+	}
+	frame, ok := grabFrame(w, cam)
+	if !ok {
+		return
+	}
+	defer releaseFrame(frame)
+	var st imageStats
+	if format == "YUYV" {
+		st = lumaStats(yuyvLuma(frame), bins, 16, 235)
+	} else {
+		img, err := jpeg.Decode(bytes.NewReader(withDefaultHuffman(frame)))
+		if err != nil {
+			http.Error(w, "Decode frame: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b := img.Bounds()
+		width, height = b.Dx(), b.Dy()
+		st = lumaStats(imageLuma(img), bins, 0, 255)
+	}
+	st.Format, st.Width, st.Height, st.frameStamp = format, width, height, frameTimeOf(frame).stamp()
+	jsonResponse(w, http.StatusOK, st)
+}
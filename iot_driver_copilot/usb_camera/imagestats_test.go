@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLumaStats(t *testing.T) {
+	luma := []byte{0, 0, 100, 100, 100, 200, 255, 255}
+	st := lumaStats(luma, 4, 0, 255)
+	if st.Mean != 126.25 || st.Median != 100 {
+		t.Errorf("mean %v median %v", st.Mean, st.Median)
+	}
+	if st.ClippedBlackPct != 25 || st.ClippedWhitePct != 25 {
+		t.Errorf("clipped %v/%v", st.ClippedBlackPct, st.ClippedWhitePct)
+	}
+	if want := []int{2, 3, 0, 3}; len(st.Histogram) != 4 || st.Histogram[0] != want[0] || st.Histogram[1] != want[1] || st.Histogram[3] != want[3] {
+		t.Errorf("histogram %v", st.Histogram)
+	}
+	if st := lumaStats(nil, 256, 16, 235); st.Mean != 0 || len(st.Histogram) != 256 {
+		t.Errorf("empty frame: %+v", st)
+	}
+}
+
+func TestImageStatsEndpoint(t *testing.T) {
+	saved := cameraConfig
+	defer func() { closeCamera(); cameraConfig = saved }()
+
+	get := func(query string) (int, imageStats) {
+		rec := httptest.NewRecorder()
+		handleImageStats(rec, httptest.NewRequest(http.MethodGet, "/stats/image"+query, nil))
+		var st imageStats
+		_ = json.Unmarshal(rec.Body.Bytes(), &st)
+		return rec.Code, st
+	}
+	if code, _ := get(""); code != http.StatusServiceUnavailable {
+		t.Errorf("not capturing: %d", code)
+	}
+	for _, format := range []string{"YUYV", "MJPEG"} {
+		cameraConfig = CameraConfig{Simulate: true, Format: format, Width: 64, Height: 48, FPS: 30}
+		if err := openCamera(); err != nil {
+			t.Fatal(err)
+		}
+		code, st := get("?bins=16")
+		if code != http.StatusOK || st.Format != format || st.Width != 64 || len(st.Histogram) != 16 {
+			t.Fatalf("%s: %d %+v", format, code, st)
+		}
+		total := 0
+		for _, c := range st.Histogram {
+			total += c
+		}
+		// The simulator draws a black square and a black label box.
+		if total != 64*48 || st.Mean <= 0 || st.ClippedBlackPct <= 0 {
+			t.Errorf("%s: %d pixels, %+v", format, total, st)
+		}
+		closeCamera()
+	}
+	if code, _ := get("?bins=0"); code != http.StatusBadRequest {
+		t.Errorf("bins=0: %d", code)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// --- REQUEST BODIES ---
+// JSON request bodies (POST /tokens, POST /calibration) are capped at
+// MAX_REQUEST_BODY_BYTES (default 64 KiB; 413 beyond it) and decoded
+// strictly: one JSON value, no unknown fields, so a misspelt "ttl_secs"
+// is a 400 rather than a silently ignored default. Clip uploads to
+// POST /playback/start have PLAYBACK_MAX_BYTES instead.
+
+var maxRequestBody int64 = 64 << 10
+
+func loadBodyConfig() error {
+	maxRequestBody = 64 << 10
+	if v := os.Getenv("MAX_REQUEST_BODY_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("MAX_REQUEST_BODY_BYTES must be a positive number of bytes, got %q", v)
+		}
+		maxRequestBody = n
+	}
+	return nil
+}
+
+// decodeJSONBody decodes r's body into v, replying with a JSON error and
+// returning false when it can't.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the JSON value")
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &tooLarge):
+		jsonResponse(w, http.StatusRequestEntityTooLarge, map[string]string{"error": fmt.Sprintf("request body larger than %d bytes", tooLarge.Limit)})
+	case errors.Is(err, io.EOF):
+		jsonResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: empty"})
+	default:
+		jsonResponse(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+	}
+	return false
+}
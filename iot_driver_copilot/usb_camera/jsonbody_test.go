@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeJSONBody(t *testing.T) {
+	saved := maxRequestBody
+	defer func() { maxRequestBody = saved }()
+	maxRequestBody = 64
+	for _, tt := range []struct {
+		body, wantErr string
+		want          int
+	}{
+		{`{"path":"/stream"}`, "", http.StatusOK},
+		{`{"pth":"/stream"}`, `unknown field \"pth\"`, http.StatusBadRequest},
+		{`{"path":"/stream"}{}`, "after the JSON value", http.StatusBadRequest},
+		{``, "empty", http.StatusBadRequest},
+		{`{"path":"` + strings.Repeat("a", 100) + `"}`, "larger than 64 bytes", http.StatusRequestEntityTooLarge},
+	} {
+		var req struct {
+			Path string `json:"path"`
+		}
+		rec := httptest.NewRecorder()
+		if decodeJSONBody(rec, httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(tt.body)), &req) {
+			rec.WriteHeader(http.StatusOK)
+		}
+		if rec.Code != tt.want || !strings.Contains(rec.Body.String(), tt.wantErr) {
+			t.Errorf("%.30s: %d %s, want %d %q", tt.body, rec.Code, rec.Body, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// HTTP_LISTEN selects where the HTTP API listens:
+//
+//	unix:///run/copilot/camera.sock    a Unix domain socket
+//	tcp://127.0.0.1:8080                a TCP address
+//	tcp://[::]:8080                     every address, IPv4 and IPv6
+//	tcp6://[::]:8080                    IPv6 only (tcp4:// for IPv4 only)
+//	tcp://[fe80::1%eth0]:8080           a link-local address, with its zone
+//
+// HTTP_INTERFACE ties a TCP listener to one network interface
+// (SO_BINDTODEVICE), so [::] on a machine with an office and an OT port
+// answers on the OT port only. It also supplies the zone of a link-local
+// address given without one. A socket-activated listener is bound as its
+// .socket unit says (BindToDevice=).
+//
+// The socket file gets HTTP_SOCKET_MODE (octal, default 0660) and, with
+// HTTP_SOCKET_GROUP, that group, so a local agent in the group can connect
+// without the driver opening a TCP port. A socket left behind by a crash is
+// replaced; one that still accepts connections is not.
+//
+// HTTP_BASE_PATH serves the API under a prefix for a reverse proxy that
+// forwards /cameras/dock-3/... unchanged: every route moves under it, and
+// so do the URLs the driver hands out (stream tokens, the Thing
+// Description's base).
+
+type socketPerms struct {
+	Mode  os.FileMode
+	Group string // name or numeric gid; "" keeps the process's group
+}
+
+const defaultSocketMode = 0o660
+
+// httpBasePath is HTTP_BASE_PATH without its trailing slash; "" serves at
+// the root.
+var httpBasePath string
+
+func loadBasePath() error {
+	httpBasePath = strings.TrimRight(os.Getenv("HTTP_BASE_PATH"), "/")
+	if httpBasePath != "" && !strings.HasPrefix(httpBasePath, "/") {
+		return fmt.Errorf("HTTP_BASE_PATH must start with /, got %q", httpBasePath)
+	}
+	return nil
+}
+
+// mountAt serves h under base, with base stripped from the request path.
+func mountAt(base string, h http.Handler) http.Handler {
+	if base == "" {
+		return h
+	}
+	mux := http.NewServeMux()
+	mux.Handle(base+"/", http.StripPrefix(base, h))
+	return mux
+}
+
+// socketPermsFromEnv reads HTTP_SOCKET_MODE and HTTP_SOCKET_GROUP.
+func socketPermsFromEnv() (socketPerms, error) {
+	p := socketPerms{Mode: defaultSocketMode, Group: os.Getenv("HTTP_SOCKET_GROUP")}
+	if v := os.Getenv("HTTP_SOCKET_MODE"); v != "" {
+		m, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || m > 0o777 {
+			return p, fmt.Errorf("HTTP_SOCKET_MODE must be octal permission bits like 0660, got %q", v)
+		}
+		p.Mode = os.FileMode(m)
+	}
+	return p, nil
+}
+
+// parseListen splits an HTTP_LISTEN value into a network and address. A
+// value without a scheme is a TCP host:port.
+func parseListen(spec string) (network, addr string, err error) {
+	if path, ok := strings.CutPrefix(spec, "unix://"); ok {
+		if !filepath.IsAbs(path) {
+			return "", "", fmt.Errorf("HTTP_LISTEN %q: socket path must be absolute", spec)
+		}
+		return "unix", filepath.Clean(path), nil
+	}
+	network = "tcp"
+	if scheme, hostport, ok := strings.Cut(spec, "://"); ok {
+		if scheme != "tcp" && scheme != "tcp4" && scheme != "tcp6" {
+			return "", "", fmt.Errorf("HTTP_LISTEN %q: want unix:///path or tcp://host:port (or tcp4://, tcp6://)", spec)
+		}
+		network, spec = scheme, hostport
+	}
+	if _, _, err := net.SplitHostPort(spec); err != nil {
+		return "", "", fmt.Errorf("HTTP_LISTEN %q: %w", spec, err)
+	}
+	return network, spec, nil
+}
+
+// joinHostPort is net.JoinHostPort for a host that may already be in
+// brackets, as in HTTP_HOST=[::].
+func joinHostPort(host, port string) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), port)
+}
+
+// checkInterface validates HTTP_INTERFACE.
+func checkInterface(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, err := net.InterfaceByName(name); err != nil {
+		return fmt.Errorf("HTTP_INTERFACE %q: %w", name, err)
+	}
+	return nil
+}
+
+// listenTCP binds addr, on iface only when it is set.
+func listenTCP(network, addr, iface string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	// Linux can't bind a link-local address without knowing its link.
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil && ip.IsLinkLocalUnicast() {
+		if iface == "" {
+			return nil, fmt.Errorf("link-local address %s needs a zone, as in [%s%%eth0]:%s, or HTTP_INTERFACE", host, host, port)
+		}
+		addr = net.JoinHostPort(host+"%"+iface, port)
+	}
+	var lc net.ListenConfig
+	if iface != "" {
+		lc.Control = func(_, _ string, c syscall.RawConn) error {
+			var bindErr error
+			if err := c.Control(func(fd uintptr) { bindErr = syscall.BindToDevice(int(fd), iface) }); err != nil {
+				return err
+			}
+			if bindErr != nil {
+				return fmt.Errorf("bind to interface %s: %w", iface, bindErr)
+			}
+			return nil
+		}
+	}
+	return lc.Listen(context.Background(), network, addr)
+}
+
+func listenUnix(path string, perms socketPerms) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+	gid := -1
+	if perms.Group != "" {
+		g, err := lookupGroup(perms.Group)
+		if err != nil {
+			return nil, err
+		}
+		gid = g
+	}
+	// Bind owner-only and widen afterwards, so the socket is never more
+	// open than configured, whatever the process umask.
+	old := syscall.Umask(0o177)
+	l, err := net.Listen("unix", path)
+	syscall.Umask(old)
+	if err != nil {
+		return nil, err
+	}
+	if gid >= 0 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("chown socket: %w", err)
+		}
+	}
+	if err := os.Chmod(path, perms.Mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("chmod socket: %w", err)
+	}
+	return l, nil
+}
+
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("HTTP_SOCKET_GROUP: %w", err)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// cliClient returns the client and base URL the CLI should use for a -url
+// value; unix:///path reaches a driver listening on that socket.
+func cliClient(base string, timeout time.Duration) (*http.Client, string) {
+	c := &http.Client{Timeout: timeout}
+	if path, ok := strings.CutPrefix(base, "unix://"); ok {
+		c.Transport = &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}}
+		return c, "http://localhost"
+	}
+	return c, base
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// --- METRICS ---
+// GET /metrics serves the driver's counters in the Prometheus text format.
+// Each NAME_total counts since the process started; NAME_lifetime_total
+// adds what earlier runs counted, which METRICS_FILE (metrics.json in
+// STATE_DIR by default) keeps. The file is saved every
+// METRICS_SNAPSHOT_INTERVAL_MS and on shutdown, so a crash loses at most
+// one interval. Without a file both values are the same.
+
+type MetricsConfig struct {
+	File     string        // METRICS_FILE
+	Interval time.Duration // METRICS_SNAPSHOT_INTERVAL_MS
+}
+
+var (
+	metricsConfig MetricsConfig
+
+	framesCaptured atomic.Uint64 // frames read by streams, snapshots and raw frames
+	captureErrors  atomic.Uint64 // reads the source failed, other than timeouts
+	sourceReopens  atomic.Uint64 // network streams (CAPTURE_URL) reopened after they ended
+
+	// lifetimeBase is what earlier runs counted, loaded once at startup.
+	lifetimeBase = metricsSnapshot{Counters: map[string]uint64{}}
+)
+
+type metricsSnapshot struct {
+	Since    time.Time         `json:"since"` // when the counts began
+	Counters map[string]uint64 `json:"counters"`
+}
+
+var counterMetrics = []struct {
+	name, help string
+	value      *atomic.Uint64
+}{
+	{"camera_frames_captured", "Frames read from the capture source.", &framesCaptured},
+	{"camera_capture_errors", "Failed reads from the capture source, other than timeouts.", &captureErrors},
+	{"camera_reconnects", "Times a CAPTURE_URL network stream was reopened after it ended.", &sourceReopens},
+	{"camera_capture_recoveries", "Times the device was reopened after CAPTURE_RECOVERY_TIMEOUTS frame timeouts.", &captureRecoveries},
+	{"camera_capture_power_cycles", "Times CAPTURE_RECOVERY_POWER_CYCLE was run after a reopen failed.", &capturePowerCycles},
+	{"camera_barcode_frames_scanned", "Frames handed to the barcode decoder (BARCODE_SCAN).", &barcodeFramesScanned},
+	{"camera_barcodes_detected", "Barcodes reported, not counting repeats within BARCODE_REPEAT_MS.", &barcodesDetected},
+	{"camera_gauge_readings", "Numbers read from the gauge region (GAUGE_ANALYZER).", &gaugeReadings},
+	{"camera_gauge_read_errors", "Gauge frames no number could be read from.", &gaugeReadErrors},
+	{"camera_gauge_display_writes", "Gauge readings and fallback texts written to GAUGE_DISPLAY_URL.", &gaugeDisplayWrites},
+	{"camera_gauge_display_errors", "Writes to GAUGE_DISPLAY_URL that failed.", &gaugeDisplayErrors},
+	{"camera_sync_realigns", "Times the camera was reopened on the genlock grid after drifting (SYNC_GENLOCK_MAX_DRIFT_MS).", &syncRealigns},
+	{"camera_frames_zero_copy", "Frames handed out in the v4l2 backend's mmap'd buffers, without a copy.", &framesZeroCopy},
+	{"camera_frames_copied", "Frames copied out of a V4L2 buffer into a pooled one.", &framesCopied},
+	{"camera_frame_buffer_allocs", "Frame buffers allocated because none was free in the pool.", &frameBufferAllocs},
+}
+
+func loadMetricsConfig() error {
+	metricsConfig = MetricsConfig{File: stateFilePath("METRICS_FILE", "metrics.json"), Interval: time.Minute}
+	if v := os.Getenv("METRICS_SNAPSHOT_INTERVAL_MS"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 1000 {
+			return fmt.Errorf("METRICS_SNAPSHOT_INTERVAL_MS must be at least 1000, got %q", v)
+		}
+		metricsConfig.Interval = time.Duration(ms) * time.Millisecond
+	}
+	lifetimeBase = metricsSnapshot{Since: clockNow().UTC(), Counters: map[string]uint64{}}
+	if metricsConfig.File == "" {
+		return nil
+	}
+	var snap metricsSnapshot
+	if err := loadState(metricsConfig.File, &snap); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("METRICS_FILE %s: %v", metricsConfig.File, err)
+	}
+	if !snap.Since.IsZero() {
+		lifetimeBase.Since = snap.Since
+	}
+	for k, v := range snap.Counters {
+		lifetimeBase.Counters[k] = v
+	}
+	return nil
+}
+
+func saveMetrics() {
+	snap := metricsSnapshot{Since: lifetimeBase.Since, Counters: map[string]uint64{}}
+	for _, m := range counterMetrics {
+		snap.Counters[m.name] = lifetimeBase.Counters[m.name] + m.value.Load()
+	}
+	if err := saveState(metricsConfig.File, snap); err != nil {
+		log.Printf("saving metrics to %s: %v", metricsConfig.File, err)
+	}
+}
+
+// metricsSnapshotLoop saves METRICS_FILE until ctx ends, and once more then.
+func metricsSnapshotLoop(ctx context.Context) {
+	if metricsConfig.File == "" {
+		return
+	}
+	t := time.NewTicker(metricsConfig.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			saveMetrics()
+		case <-ctx.Done():
+			saveMetrics()
+			return
+		}
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, typ, help string, v interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, v)
+	}
+	for _, m := range counterMetrics {
+		v := m.value.Load()
+		metric(m.name+"_total", "counter", m.help, v)
+		metric(m.name+"_lifetime_total", "counter", m.help+" Includes earlier runs (METRICS_FILE).", lifetimeBase.Counters[m.name]+v)
+	}
+	metric("camera_active_streams", "gauge", "Clients streaming video.", activeStreams.Load())
+	metric("camera_lifetime_start_seconds", "gauge", "Unix time the lifetime counters began.", lifetimeBase.Since.Unix())
+	metric("camera_frame_latency_seconds", "gauge", "Capture to read time of the last frame with a kernel timestamp.", time.Duration(frameLatency.Load()).Seconds())
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLifetimeMetrics(t *testing.T) {
+	saved := metricsConfig
+	defer func() { metricsConfig = saved; lifetimeBase = metricsSnapshot{Counters: map[string]uint64{}} }()
+	t.Setenv("STATE_DIR", t.TempDir())
+	t.Setenv("METRICS_FILE", "")
+
+	// One run: counts, then shuts down.
+	if err := loadMetricsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if metricsConfig.File != filepath.Join(os.Getenv("STATE_DIR"), "metrics.json") {
+		t.Fatalf("METRICS_FILE defaults to %q", metricsConfig.File)
+	}
+	start := lifetimeBase.Since
+	framesCaptured.Store(40)
+	captureErrors.Store(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	metricsSnapshotLoop(ctx)
+
+	// The next starts from zero but keeps the totals.
+	framesCaptured.Store(0)
+	captureErrors.Store(0)
+	if err := loadMetricsConfig(); err != nil {
+		t.Fatal(err)
+	}
+	markFrame()
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"camera_frames_captured_total 1\n",
+		"camera_frames_captured_lifetime_total 41\n",
+		"camera_capture_errors_total 0\n",
+		"camera_capture_errors_lifetime_total 2\n",
+		"camera_reconnects_lifetime_total 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in\n%s", want, body)
+		}
+	}
+	if !lifetimeBase.Since.Equal(start) {
+		t.Errorf("lifetime start moved from %v to %v", start, lifetimeBase.Since)
+	}
+
+	t.Setenv("METRICS_SNAPSHOT_INTERVAL_MS", "10")
+	if err := loadMetricsConfig(); err == nil {
+		t.Error("METRICS_SNAPSHOT_INTERVAL_MS=10 accepted")
+	}
+}
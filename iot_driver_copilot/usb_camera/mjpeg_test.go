@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func encodeTestJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 32; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 8), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// stripDHT removes every DHT segment, as UVC MJPEG cameras do.
+func stripDHT(t *testing.T, b []byte) []byte {
+	t.Helper()
+	out := append([]byte(nil), b[:2]...)
+	i := 2
+	for b[i+1] != 0xDA {
+		n := 2 + (int(b[i+2])<<8 | int(b[i+3]))
+		if b[i+1] != 0xC4 {
+			out = append(out, b[i:i+n]...)
+		}
+		i += n
+	}
+	return append(out, b[i:]...)
+}
+
+func TestWithDefaultHuffman(t *testing.T) {
+	full := encodeTestJPEG(t)
+	bare := stripDHT(t, full)
+	if len(bare) >= len(full) {
+		t.Fatal("test frame had no DHT to strip")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(bare)); err == nil {
+		t.Fatal("frame without DHT decoded; test no longer exercises the fallback")
+	}
+	fixed := withDefaultHuffman(bare)
+	if _, err := jpeg.Decode(bytes.NewReader(fixed)); err != nil {
+		t.Fatalf("decode with default tables: %v", err)
+	}
+	if got := withDefaultHuffman(full); !bytes.Equal(got, full) {
+		t.Fatal("frame that already has a DHT was modified")
+	}
+	if got := withDefaultHuffman([]byte("not a jpeg")); string(got) != "not a jpeg" {
+		t.Fatal("non-JPEG input was modified")
+	}
+}
+
+func TestWatermarkJPEGWithoutDHT(t *testing.T) {
+	watermarkConfig = WatermarkConfig{Enabled: true, Position: "top-left", Opacity: 1, Quality: 80}
+	out, err := watermarkJPEG(stripDHT(t, encodeTestJPEG(t)), "cli")
+	if err != nil {
+		t.Fatalf("watermarkJPEG: %v", err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Fatalf("watermarked output does not decode: %v", err)
+	}
+}
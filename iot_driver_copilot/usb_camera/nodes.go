@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// --- VIDEO NODE SELECTION ---
+// A UVC camera usually has two nodes, e.g. /dev/video0 for video and
+// /dev/video1 for metadata, and the metadata node cannot capture. Before
+// the webcam and v4l2 backends open a node they ask it for its
+// capabilities (VIDIOC_QUERYCAP), so pointing DEVICE_PATH at a metadata
+// node fails with an error naming the camera's capture node instead of a
+// puzzling format error.
+//
+// Node numbers change with plug order, so the camera can be picked by what
+// it is instead: CAMERA_USB_ID=046d:085e (vendor:product) and/or
+// CAMERA_BUS_INFO=usb-0000:00:14.0-2 (the port, as v4l2-ctl --info shows
+// it) select the first capture node that matches, each time the camera is
+// opened, so a replugged or power-cycled camera is found on its new node.
+// DEVICE_PATH is then not used. GET /video-nodes lists the nodes with
+// their capabilities, to find the values.
+
+type videoNode struct {
+	Path     string `json:"path"`
+	Driver   string `json:"driver"`
+	Card     string `json:"card"`
+	BusInfo  string `json:"bus_info"`
+	USBID    string `json:"usb_id,omitempty"` // vendor:product, for USB devices
+	Capture  bool   `json:"capture"`          // video capture with streaming I/O
+	Metadata bool   `json:"metadata"`
+}
+
+const v4l2CapMetaCapture = 0x00800000
+
+var usbIDPattern = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{4}$`)
+
+// Where nodes are looked for, and how they are asked. Tests replace them.
+var (
+	videoDevDir    = "/dev"
+	videoSysDir    = "/sys/class/video4linux"
+	queryVideoNode = queryV4L2Node
+)
+
+// loadNodeMatch reads CAMERA_USB_ID and CAMERA_BUS_INFO into cfg.
+func loadNodeMatch(cfg *CameraConfig) error {
+	cfg.USBID = strings.ToLower(os.Getenv("CAMERA_USB_ID"))
+	cfg.BusInfo = os.Getenv("CAMERA_BUS_INFO")
+	if cfg.USBID != "" && !usbIDPattern.MatchString(cfg.USBID) {
+		return fmt.Errorf("CAMERA_USB_ID must be vendor:product in hex, e.g. 046d:085e, got %q", cfg.USBID)
+	}
+	if (cfg.USBID != "" || cfg.BusInfo != "") && os.Getenv("DEVICE_PATH") != "" {
+		return errors.New("DEVICE_PATH cannot be combined with CAMERA_USB_ID or CAMERA_BUS_INFO")
+	}
+	return nil
+}
+
+// deviceID names the camera in status and logs: DEVICE_PATH, or the
+// CAMERA_USB_ID/CAMERA_BUS_INFO match.
+func (c CameraConfig) deviceID() string {
+	var match []string
+	if c.USBID != "" {
+		match = append(match, "usb:"+c.USBID)
+	}
+	if c.BusInfo != "" {
+		match = append(match, "bus:"+c.BusInfo)
+	}
+	if len(match) == 0 {
+		return c.DevicePath
+	}
+	return strings.Join(match, ",")
+}
+
+func queryV4L2Node(path string) (videoNode, error) {
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return videoNode{}, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer unix.Close(fd)
+	var capab v4l2Capability
+	if err := v4l2Ioctl(fd, vidiocQueryCap, unsafe.Pointer(&capab)); err != nil {
+		return videoNode{}, fmt.Errorf("%s: VIDIOC_QUERYCAP: %w", path, err)
+	}
+	caps := capab.Capabilities
+	if caps&v4l2CapDeviceCaps != 0 {
+		caps = capab.DeviceCaps
+	}
+	n := videoNode{Path: path, Driver: cString(capab.Driver[:]), Card: cString(capab.Card[:]), BusInfo: cString(capab.BusInfo[:]),
+		Capture: caps&v4l2CapVideoCapture != 0 && caps&v4l2CapStreaming != 0, Metadata: caps&v4l2CapMetaCapture != 0}
+	n.USBID = sysfsUSBID(filepath.Base(path))
+	return n, nil
+}
+
+func cString(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// sysfsUSBID reads vendor:product of the USB device a node belongs to;
+// the node's device link points at the USB interface, whose parent holds
+// the ids.
+func sysfsUSBID(name string) string {
+	iface, err := filepath.EvalSymlinks(filepath.Join(videoSysDir, name, "device"))
+	if err != nil {
+		return ""
+	}
+	dev := filepath.Dir(iface)
+	vendor, err1 := os.ReadFile(filepath.Join(dev, "idVendor"))
+	product, err2 := os.ReadFile(filepath.Join(dev, "idProduct"))
+	if err1 != nil || err2 != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(vendor)) + ":" + strings.TrimSpace(string(product))
+}
+
+// videoNodePaths lists /dev/videoN in number order.
+func videoNodePaths() []string {
+	paths, _ := filepath.Glob(filepath.Join(videoDevDir, "video*"))
+	num := func(p string) int {
+		n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(p), "video"))
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	kept := paths[:0]
+	for _, p := range paths {
+		if num(p) >= 0 {
+			kept = append(kept, p)
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool { return num(kept[i]) < num(kept[j]) })
+	return kept
+}
+
+// listVideoNodes queries every node that answers.
+func listVideoNodes() []videoNode {
+	var nodes []videoNode
+	for _, p := range videoNodePaths() {
+		if n, err := queryVideoNode(p); err == nil {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// resolveDevicePath picks the node the webcam and v4l2 backends open.
+func resolveDevicePath(cfg CameraConfig) (string, error) {
+	if cfg.USBID == "" && cfg.BusInfo == "" {
+		n, err := queryVideoNode(cfg.DevicePath)
+		if err != nil || n.Capture {
+			return cfg.DevicePath, nil // the backend reports open errors itself
+		}
+		for _, other := range listVideoNodes() {
+			if other.Capture && other.Path != n.Path && n.BusInfo != "" && other.BusInfo == n.BusInfo {
+				return "", fmt.Errorf("%s is not a video capture node (it is %s's %s); use %s", cfg.DevicePath, n.Card, nodeKind(n), other.Path)
+			}
+		}
+		return "", fmt.Errorf("%s is not a video capture node (%s)", cfg.DevicePath, nodeKind(n))
+	}
+	var seen []string
+	for _, n := range listVideoNodes() {
+		if (cfg.USBID == "" || n.USBID == cfg.USBID) && (cfg.BusInfo == "" || n.BusInfo == cfg.BusInfo) {
+			if n.Capture {
+				return n.Path, nil
+			}
+			continue
+		}
+		seen = append(seen, fmt.Sprintf("%s (%s, %s)", n.Path, n.USBID, n.BusInfo))
+	}
+	if len(seen) == 0 {
+		return "", fmt.Errorf("no video capture node matches %s", cfg.deviceID())
+	}
+	return "", fmt.Errorf("no video capture node matches %s; found %s", cfg.deviceID(), strings.Join(seen, ", "))
+}
+
+func nodeKind(n videoNode) string {
+	if n.Metadata {
+		return "metadata node"
+	}
+	return "no streaming video capture"
+}
+
+func handleVideoNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nodes := listVideoNodes()
+	if nodes == nil {
+		nodes = []videoNode{}
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"nodes": nodes})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeVideoNodes stands in for /dev and VIDIOC_QUERYCAP.
+func fakeVideoNodes(t *testing.T, nodes ...videoNode) {
+	t.Helper()
+	savedDir, savedQuery := videoDevDir, queryVideoNode
+	t.Cleanup(func() { videoDevDir, queryVideoNode = savedDir, savedQuery })
+	videoDevDir = t.TempDir()
+	byPath := map[string]videoNode{}
+	for _, n := range nodes {
+		n.Path = filepath.Join(videoDevDir, n.Path)
+		byPath[n.Path] = n
+		if err := os.WriteFile(n.Path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queryVideoNode = func(path string) (videoNode, error) {
+		if n, ok := byPath[path]; ok {
+			return n, nil
+		}
+		return videoNode{}, errors.New("open " + path + ": no such device")
+	}
+}
+
+func TestResolveDevicePath(t *testing.T) {
+	brio := "usb-0000:00:14.0-2"
+	fakeVideoNodes(t,
+		videoNode{Path: "video0", Card: "Integrated Camera", BusInfo: "usb-0000:00:14.0-8", USBID: "04f2:b6ea", Capture: true},
+		videoNode{Path: "video1", Card: "Integrated Camera", BusInfo: "usb-0000:00:14.0-8", USBID: "04f2:b6ea", Metadata: true},
+		videoNode{Path: "video10", Card: "Logitech BRIO", BusInfo: brio, USBID: "046d:085e", Metadata: true},
+		videoNode{Path: "video2", Card: "Logitech BRIO", BusInfo: brio, USBID: "046d:085e", Capture: true},
+	)
+	node := func(name string) string { return filepath.Join(videoDevDir, name) }
+
+	if got := videoNodePaths(); len(got) != 4 || got[2] != node("video2") || got[3] != node("video10") {
+		t.Errorf("node order %v", got)
+	}
+	for _, c := range []struct {
+		cfg     CameraConfig
+		want    string
+		wantErr string
+	}{
+		{cfg: CameraConfig{DevicePath: node("video0")}, want: node("video0")},
+		{cfg: CameraConfig{DevicePath: node("video1")}, wantErr: "use " + node("video0")},
+		{cfg: CameraConfig{DevicePath: "/dev/video-missing"}, want: "/dev/video-missing"},
+		{cfg: CameraConfig{USBID: "046d:085e"}, want: node("video2")},
+		{cfg: CameraConfig{BusInfo: brio}, want: node("video2")},
+		{cfg: CameraConfig{USBID: "046d:085e", BusInfo: "usb-0000:00:14.0-8"}, wantErr: "no video capture node matches usb:046d:085e,bus:usb-0000:00:14.0-8"},
+	} {
+		got, err := resolveDevicePath(c.cfg)
+		if c.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("%+v: %q, %v; want error %q", c.cfg, got, err, c.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("%+v: %q, %v; want %q", c.cfg, got, err, c.want)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleVideoNodes(rec, httptest.NewRequest(http.MethodGet, "/video-nodes", nil))
+	var body struct{ Nodes []videoNode }
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || len(body.Nodes) != 4 || !body.Nodes[2].Capture || body.Nodes[2].USBID != "046d:085e" {
+		t.Errorf("GET /video-nodes: %+v %v", body, err)
+	}
+}
+
+func TestLoadNodeMatch(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"CAMERA_USB_ID": "logitech"},
+		{"CAMERA_USB_ID": "046d:085e", "DEVICE_PATH": "/dev/video2"},
+	} {
+		t.Run("", func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			var cfg CameraConfig
+			if loadNodeMatch(&cfg) == nil {
+				t.Errorf("%v accepted", env)
+			}
+		})
+	}
+	t.Setenv("CAMERA_USB_ID", "046D:085E")
+	var cfg CameraConfig
+	if err := loadNodeMatch(&cfg); err != nil || cfg.deviceID() != "usb:046d:085e" {
+		t.Errorf("%+v %v", cfg, err)
+	}
+}
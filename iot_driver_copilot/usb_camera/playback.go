@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Test clip playback, for checking stream consumers against a recorded
+// incident:
+//
+//	POST /playback/start?path=incident.avi[&fps=10]   a clip under PLAYBACK_DIR
+//	POST /playback/start[?fps=10]                     the request body is the clip
+//	POST /playback/stop
+//	GET  /playback
+//
+// Clips are MJPEG: a .mjpeg stream of concatenated JPEGs or an AVI with
+// MJPEG video (the JPEGs are taken straight out of the container). The clip
+// replaces the capture source the way a reconfigure does, so streams,
+// snapshots and raw frames carry on and see the clip as if it were live,
+// looped at fps (default CAMERA_FPS). Stopping reopens the camera if it was
+// capturing before, and otherwise leaves it stopped.
+
+type PlaybackConfig struct {
+	Dir      string // PLAYBACK_DIR: clips playable by path; empty allows uploads only
+	MaxBytes int64  // PLAYBACK_MAX_BYTES: largest upload
+}
+
+var playbackConfig = PlaybackConfig{MaxBytes: 256 << 20}
+
+// playbackState is guarded by cameraState.mu.
+var playbackState struct {
+	active  bool
+	clip    string // path, or "upload"
+	temp    string // uploaded clip, removed when playback ends
+	resume  bool   // the camera was capturing when playback started
+	started time.Time
+	fps     uint32
+}
+
+var (
+	errPlaybackActive = errors.New("clip playback is running; stop it first")
+	errNoPlayback     = errors.New("no clip is playing")
+)
+
+// --- PLAYBACK CONFIG ---
+func loadPlaybackConfig() error {
+	playbackConfig = PlaybackConfig{Dir: os.Getenv("PLAYBACK_DIR"), MaxBytes: 256 << 20}
+	if v := os.Getenv("PLAYBACK_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("PLAYBACK_MAX_BYTES must be a positive number of bytes")
+		}
+		playbackConfig.MaxBytes = n
+	}
+	if playbackConfig.Dir != "" {
+		if fi, err := os.Stat(playbackConfig.Dir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("PLAYBACK_DIR %s is not a directory", playbackConfig.Dir)
+		}
+	}
+	return nil
+}
+
+// clipFrameSize reads the dimensions of the first JPEG in the clip.
+func clipFrameSize(path string) (uint32, uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	return firstFrameSize(f)
+}
+
+// firstFrameSize reads the dimensions of the first JPEG in a clip stream.
+func firstFrameSize(r io.Reader) (uint32, uint32, error) {
+	var first []byte
+	_ = splitJPEGs(bufio.NewReaderSize(r, 256*1024), func(frame []byte) bool {
+		first = frame
+		return false
+	})
+	if first == nil {
+		return 0, 0, errors.New("no JPEG frames in clip (only MJPEG clips can be played)")
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(withDefaultHuffman(first)))
+	if err != nil {
+		return 0, 0, fmt.Errorf("first frame: %w", err)
+	}
+	return uint32(cfg.Width), uint32(cfg.Height), nil
+}
+
+// startPlayback swaps the capture source for the clip at path.
+func startPlayback(path, name, temp string, fps uint32) (sourceInfo, error) {
+	width, height, err := clipFrameSize(path)
+	if err != nil {
+		return sourceInfo{}, err
+	}
+	cameraState.mu.Lock()
+	defer cameraState.mu.Unlock()
+	if cameraState.running && cameraState.formatStr != "MJPEG" {
+		return sourceInfo{}, fmt.Errorf("camera is capturing %s; clips can only replace MJPEG capture", cameraState.formatStr)
+	}
+	src, err := newJPEGStreamSource(func() (io.ReadCloser, error) { return os.Open(path) }, true, time.Second/time.Duration(fps))
+	if err != nil {
+		return sourceInfo{}, err
+	}
+	if playbackState.active {
+		if playbackState.temp != "" {
+			os.Remove(playbackState.temp)
+		}
+	} else {
+		playbackState.resume = cameraState.running
+	}
+	if cameraState.source != nil {
+		cameraState.source.StopStreaming()
+		cameraState.source.Close()
+	}
+	info := sourceInfo{Format: "MJPEG", Width: width, Height: height, FPS: fps}
+	installSource(src, info)
+	cameraState.running = true
+	playbackState.active, playbackState.clip, playbackState.temp = true, name, temp
+	playbackState.started, playbackState.fps = time.Now(), fps
+	recordEvent("playback_started", "", map[string]interface{}{"clip": name, "width": width, "height": height, "fps": fps})
+	return info, nil
+}
+
+// stopPlayback returns to the camera, or to no capture.
+func stopPlayback() error {
+	cameraState.mu.Lock()
+	defer cameraState.mu.Unlock()
+	if !playbackState.active {
+		return errNoPlayback
+	}
+	cameraState.source.StopStreaming()
+	cameraState.source.Close()
+	resume := playbackState.resume
+	recordEvent("playback_stopped", "", map[string]interface{}{"clip": playbackState.clip})
+	endPlayback()
+	if !resume {
+		cameraState.source, cameraState.running = nil, false
+		cameraState.gen.Add(1)
+		_ = sdNotify("STATUS=idle, camera closed")
+		return nil
+	}
+	src, info, err := openFrameSource(cameraConfig)
+	if err != nil {
+		cameraState.source, cameraState.running = nil, false
+		cameraState.gen.Add(1)
+		_ = sdNotify("STATUS=camera reopen failed: " + err.Error())
+		return fmt.Errorf("playback stopped, but reopening the camera failed: %v", err)
+	}
+	installSource(src, info)
+	return nil
+}
+
+// endPlayback forgets the clip. The caller holds cameraState.mu.
+func endPlayback() {
+	if playbackState.temp != "" {
+		os.Remove(playbackState.temp)
+	}
+	playbackState.active, playbackState.clip, playbackState.temp = false, "", ""
+}
+
+// clipPath resolves a ?path= under PLAYBACK_DIR.
+func clipPath(name string) (string, error) {
+	if playbackConfig.Dir == "" {
+		return "", errors.New("PLAYBACK_DIR is not set; upload the clip as the request body instead")
+	}
+	if !filepath.IsLocal(name) {
+		return "", errors.New("path must be relative to PLAYBACK_DIR")
+	}
+	return filepath.Join(playbackConfig.Dir, name), nil
+}
+
+// saveUpload stores the request body in a temporary file.
+func saveUpload(r *http.Request) (string, error) {
+	f, err := os.CreateTemp("", "playback-*.mjpeg")
+	if err != nil {
+		return "", err
+	}
+	n, err := io.Copy(f, io.LimitReader(r.Body, playbackConfig.MaxBytes+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > playbackConfig.MaxBytes {
+		err = fmt.Errorf("clip exceeds PLAYBACK_MAX_BYTES (%d)", playbackConfig.MaxBytes)
+	}
+	if err == nil && n == 0 {
+		err = errors.New("empty request body; send a clip or ?path=")
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func handlePlaybackStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dry, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	fps := cameraConfig.FPS
+	if v := q.Get("fps"); v != "" {
+		var err error
+		if fps, err = parseFrameParam("fps", v, maxFrameRate); err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	name, path, temp := q.Get("path"), "", ""
+	if dry {
+		dryRunPlayback(w, r, name, fps)
+		return
+	}
+	var err error
+	if name != "" {
+		path, err = clipPath(name)
+	} else {
+		name = "upload"
+		path, err = saveUpload(r)
+		temp = path
+	}
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	info, err := startPlayback(path, name, temp, fps)
+	if err != nil {
+		if temp != "" {
+			os.Remove(temp)
+		}
+		code := http.StatusBadRequest
+		if errors.Is(err, os.ErrNotExist) {
+			code = http.StatusNotFound
+		}
+		jsonResponse(w, code, map[string]string{"error": err.Error()})
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"status": "playback started", "clip": name, "format": info.Format, "width": info.Width, "height": info.Height, "fps": info.FPS,
+	})
+}
+
+// dryRunPlayback checks the clip named by ?path=, or the first frame of
+// an upload, and answers with the source swap startPlayback would make.
+func dryRunPlayback(w http.ResponseWriter, r *http.Request, name string, fps uint32) {
+	var width, height uint32
+	var err error
+	if name != "" {
+		var path string
+		if path, err = clipPath(name); err == nil {
+			width, height, err = clipFrameSize(path)
+		}
+	} else {
+		name = "upload"
+		width, height, err = firstFrameSize(io.LimitReader(r.Body, playbackConfig.MaxBytes))
+	}
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, os.ErrNotExist) {
+			code = http.StatusNotFound
+		}
+		jsonResponse(w, code, map[string]string{"error": err.Error()})
+		return
+	}
+	var ops []plannedOp
+	cameraState.mu.Lock()
+	defer cameraState.mu.Unlock()
+	switch {
+	case cameraState.running && cameraState.formatStr != "MJPEG":
+		jsonResponse(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("camera is capturing %s; clips can only replace MJPEG capture", cameraState.formatStr)})
+		return
+	case playbackState.active:
+		ops = append(ops, plannedOp{Op: "stop_playback", Detail: map[string]string{"clip": playbackState.clip}})
+	case cameraState.source != nil:
+		ops = append(ops, closeSourceOp())
+	}
+	replyDryRun(w, append(ops, plannedOp{Op: "start_playback", Format: "MJPEG", Width: width, Height: height, FPS: fps, Detail: map[string]string{"clip": name}}))
+}
+
+func handlePlaybackStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if dry, ok := dryRunRequested(w, r); !ok {
+		return
+	} else if dry {
+		cameraState.mu.Lock()
+		active, clip, resume := playbackState.active, playbackState.clip, playbackState.resume
+		cameraState.mu.Unlock()
+		if !active {
+			jsonResponse(w, http.StatusConflict, map[string]string{"error": errNoPlayback.Error()})
+			return
+		}
+		ops := []plannedOp{{Op: "stop_playback", Detail: map[string]string{"clip": clip}}}
+		if resume {
+			ops = append(ops, openSourceOp(cameraConfig))
+		}
+		replyDryRun(w, ops)
+		return
+	}
+	if err := stopPlayback(); errors.Is(err, errNoPlayback) {
+		jsonResponse(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]string{"status": "playback stopped"})
+}
+
+func handlePlayback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cameraState.mu.Lock()
+	defer cameraState.mu.Unlock()
+	if !playbackState.active {
+		jsonResponse(w, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"active": true, "clip": playbackState.clip, "started": playbackState.started.UTC(),
+		"fps": playbackState.fps, "width": cameraState.width, "height": cameraState.height,
+	})
+}
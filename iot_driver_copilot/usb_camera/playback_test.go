@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testClip(t *testing.T, frames, w, h int) []byte {
+	t.Helper()
+	var clip bytes.Buffer
+	for i := 0; i < frames; i++ {
+		if err := jpeg.Encode(&clip, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return clip.Bytes()
+}
+
+func TestPlayback(t *testing.T) {
+	saved, savedPlayback := cameraConfig, playbackConfig
+	defer func() { closeCamera(); cameraConfig, playbackConfig = saved, savedPlayback }()
+	cameraConfig = CameraConfig{Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	dir := t.TempDir()
+	playbackConfig = PlaybackConfig{Dir: dir, MaxBytes: 1 << 20}
+	if err := os.WriteFile(filepath.Join(dir, "incident.mjpeg"), testClip(t, 3, 40, 30), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	post := func(h http.HandlerFunc, target string, body []byte) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body)))
+		var resp map[string]interface{}
+		_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	frameSize := func() (int, int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleSnapshot(rec, httptest.NewRequest(http.MethodGet, "/snapshot", nil))
+		cfg, err := jpeg.DecodeConfig(rec.Body)
+		if err != nil {
+			t.Fatalf("snapshot: %d %v", rec.Code, err)
+		}
+		return cfg.Width, cfg.Height
+	}
+
+	// An upload while the camera is stopped plays, and stopping leaves it stopped.
+	code, resp := post(handlePlaybackStart, "/playback/start?fps=50", testClip(t, 2, 32, 24))
+	if code != http.StatusOK || resp["width"] != 32.0 || resp["clip"] != "upload" {
+		t.Fatalf("upload: %d %v", code, resp)
+	}
+	if w, h := frameSize(); w != 32 || h != 24 {
+		t.Errorf("playing upload, frame is %dx%d", w, h)
+	}
+	cameraState.mu.Lock()
+	temp := playbackState.temp
+	cameraState.mu.Unlock()
+	if code, _ := post(handlePlaybackStop, "/playback/stop", nil); code != http.StatusOK {
+		t.Fatalf("stop: %d", code)
+	}
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Errorf("uploaded clip not removed: %v", err)
+	}
+	if cameraState.running {
+		t.Error("camera running after playback of a stopped camera")
+	}
+
+	// A clip by path replaces the running camera until stopped.
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	if code, resp := post(handlePlaybackStart, "/playback/start?path=incident.mjpeg", nil); code != http.StatusOK {
+		t.Fatalf("path: %d %v", code, resp)
+	}
+	if w, h := frameSize(); w != 40 || h != 30 {
+		t.Errorf("playing incident.mjpeg, frame is %dx%d", w, h)
+	}
+	if _, err := reconfigureCamera(32, 24, 30); err != errPlaybackActive {
+		t.Errorf("reconfigure during playback: %v", err)
+	}
+	if code, _ := post(handlePlaybackStop, "/playback/stop", nil); code != http.StatusOK {
+		t.Fatalf("stop: %d", code)
+	}
+	if w, h := frameSize(); w != 64 || h != 48 {
+		t.Errorf("after playback, frame is %dx%d", w, h)
+	}
+
+	for target, want := range map[string]int{
+		"/playback/start?path=../etc/passwd": http.StatusBadRequest,
+		"/playback/start?path=missing.mjpeg": http.StatusNotFound,
+		"/playback/start?fps=0":              http.StatusBadRequest,
+	} {
+		if code, resp := post(handlePlaybackStart, target, []byte("x")); code != want {
+			t.Errorf("%s: %d %v, want %d", target, code, resp, want)
+		}
+	}
+	if code, resp := post(handlePlaybackStart, "/playback/start", []byte("not a clip")); code != http.StatusBadRequest || !strings.Contains(resp["error"].(string), "no JPEG frames") {
+		t.Errorf("garbage upload: %d %v", code, resp)
+	}
+	if code, _ := post(handlePlaybackStop, "/playback/stop", nil); code != http.StatusConflict {
+		t.Errorf("stop without playback: %d", code)
+	}
+}
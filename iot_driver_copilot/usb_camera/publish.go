@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// --- PUBLISHING ---
+// Barcode detections (barcode.go) and gauge readings (gauge.go) go out as
+// JSON to webhooks, each POSTed in the background, and to an MQTT topic on
+// MQTT_BROKER. Each feature has its own MQTT connection: the barcode
+// scanner connects as MQTT_CLIENT_ID, the others add a suffix, since a
+// broker drops a client when another connects with the same id.
+
+type MQTTConfig struct {
+	Broker   string // MQTT_BROKER, e.g. tcp://broker:1883
+	ClientID string // MQTT_CLIENT_ID
+	Username string // MQTT_USERNAME
+	Password string // MQTT_PASSWORD or MQTT_PASSWORD_FILE
+}
+
+var mqttConfig MQTTConfig
+
+func loadMQTTConfig() {
+	mqttConfig = MQTTConfig{
+		Broker:   os.Getenv("MQTT_BROKER"),
+		ClientID: getenvDefault("MQTT_CLIENT_ID", "camera-driver"),
+		Username: os.Getenv("MQTT_USERNAME"),
+		Password: os.Getenv("MQTT_PASSWORD"),
+	}
+}
+
+func getenvDefault(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// webhookURLs reads a comma-separated list of http(s) URLs from env.
+func webhookURLs(env string) ([]string, error) {
+	var urls []string
+	for _, u := range strings.Split(os.Getenv(env), ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		if p, err := url.Parse(u); err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			return nil, fmt.Errorf("%s: %q is not an http(s) URL", env, u)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+type publisher struct {
+	name     string // for log lines, e.g. "barcode"
+	webhooks []string
+	topic    string
+	http     *http.Client
+	mqtt     mqtt.Client // nil without MQTT_BROKER
+}
+
+// newPublisher connects as MQTT_CLIENT_ID followed by idSuffix once
+// connect is called.
+func newPublisher(name string, webhooks []string, topic, idSuffix string) *publisher {
+	p := &publisher{name: name, webhooks: webhooks, topic: topic, http: &http.Client{Timeout: 10 * time.Second}}
+	if m := mqttConfig; m.Broker != "" && topic != "" {
+		opts := mqtt.NewClientOptions().AddBroker(m.Broker).SetClientID(m.ClientID + idSuffix).SetAutoReconnect(true).SetConnectRetry(true)
+		if m.Username != "" {
+			opts.SetUsername(m.Username)
+			opts.SetPassword(m.Password)
+		}
+		opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) { log.Printf("%s MQTT connection lost: %v", name, err) })
+		p.mqtt = mqtt.NewClient(opts)
+	}
+	return p
+}
+
+// connect starts the MQTT connection, which retries in the background,
+// and returns the function that closes it.
+func (p *publisher) connect() func() {
+	if p.mqtt == nil {
+		return func() {}
+	}
+	p.mqtt.Connect()
+	return func() { p.mqtt.Disconnect(250) }
+}
+
+// publish sends body without waiting for the receivers.
+func (p *publisher) publish(body []byte) {
+	for _, u := range p.webhooks {
+		go func(u string) {
+			resp, err := p.http.Post(u, "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Printf("%s webhook %s: %v", p.name, u, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("%s webhook %s returned %s", p.name, u, resp.Status)
+			}
+		}(u)
+	}
+	if p.mqtt != nil {
+		if !p.mqtt.IsConnected() {
+			log.Printf("%s MQTT: not connected to %s, message not published", p.name, mqttConfig.Broker)
+			return
+		}
+		tok := p.mqtt.Publish(p.topic, 1, false, body)
+		go func() {
+			if tok.WaitTimeout(10*time.Second) && tok.Error() != nil {
+				log.Printf("%s MQTT publish: %v", p.name, tok.Error())
+			}
+		}()
+	}
+}
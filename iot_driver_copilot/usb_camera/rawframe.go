@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Raw frames for machine vision, without JPEG artifacts:
+//
+//	GET /frame/raw[?pixfmt=yuyv|rgb][&compress=zstd]
+//
+// The body is one line of JSON describing the frame, then the pixel data:
+//
+//	{"pixfmt":"YUYV","width":640,"height":480,"stride":1280,"size":614400,
+//	 "compression":"zstd","timestamp":"2024-05-01T12:00:00.123Z"}\n<data>
+//
+// size is the uncompressed length. YUYV is only available while capturing
+// YUYV; rgb (packed 8-bit R,G,B) is converted from YUYV or decoded from
+// MJPEG, so for MJPEG cameras it carries the camera's own compression but
+// no more. Frames are not watermarked.
+
+type rawFrameHeader struct {
+	PixFmt      string `json:"pixfmt"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Stride      int    `json:"stride"`
+	Size        int    `json:"size"`
+	Compression string `json:"compression"`
+	frameStamp
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+)
+
+// zstdEncode compresses b. The encoder is shared; EncodeAll is safe for
+// concurrent use.
+func zstdEncode(b []byte) []byte {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	})
+	return zstdEncoder.EncodeAll(b, make([]byte, 0, len(b)/4))
+}
+
+func handleRawFrame(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	compression := strings.ToLower(q.Get("compress"))
+	if compression == "" {
+		compression = "none"
+	}
+	if compression != "none" && compression != "zstd" {
+		http.Error(w, "compress must be zstd or none", http.StatusBadRequest)
+		return
+	}
+	cameraState.mu.Lock()
+	running := cameraState.running
+	cam := cameraState.source
+	format := cameraState.formatStr
+	width, height := int(cameraState.width), int(cameraState.height)
+	cameraState.mu.Unlock()
+	if !running {
+		http.Error(w, "Camera is not capturing", http.StatusServiceUnavailable)
+		return
+	}
+	pixfmt := strings.ToUpper(q.Get("pixfmt"))
+	if pixfmt == "" {
+		pixfmt = "RGB"
+		if format == "YUYV" {
+			pixfmt = "YUYV"
+		}
+	}
+	if pixfmt != "RGB" && pixfmt != "YUYV" {
+		http.Error(w, "pixfmt must be yuyv or rgb", http.StatusBadRequest)
+		return
+	}
+	if pixfmt == "YUYV" && format != "YUYV" {
+		http.Error(w, "Camera is capturing "+format+", raw YUYV is not available", http.StatusBadRequest)
+		return
+	}
+	frame, ok := grabFrame(w, cam)
+	if !ok {
+		return
+	}
+	defer releaseFrame(frame)
+	hdr := rawFrameHeader{PixFmt: pixfmt, Width: width, Height: height, Compression: compression, frameStamp: frameTimeOf(frame).stamp()}
+	var data []byte
+	switch {
+	case pixfmt == "YUYV":
+		data, hdr.Stride = frame, width*2
+	case format == "YUYV":
+		data, hdr.Stride = imageToRGB24(yuyvToImage(frame, width, height)), width*3
+	default:
+		img, err := jpeg.Decode(bytes.NewReader(withDefaultHuffman(frame)))
+		if err != nil {
+			http.Error(w, "Decode frame: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b := img.Bounds()
+		hdr.Width, hdr.Height = b.Dx(), b.Dy()
+		data, hdr.Stride = imageToRGB24(img), b.Dx()*3
+	}
+	hdr.Size = len(data)
+	if compression == "zstd" {
+		data = zstdEncode(data)
+	}
+	head, _ := json.Marshal(hdr)
+	head = append(head, '\n')
+	w.Header().Set("Content-Type", "application/x-raw-frame")
+	w.Header().Set("Content-Length", strconv.Itoa(len(head)+len(data)))
+	w.Write(head)
+	w.Write(data)
+}
+
+// imageToRGB24 packs img as 8-bit R,G,B triples, row by row.
+func imageToRGB24(img image.Image) []byte {
+	b := img.Bounds()
+	rgba, ok := img.(*image.RGBA)
+	if !ok || rgba.Rect.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	}
+	out := make([]byte, 0, b.Dx()*b.Dy()*3)
+	for y := 0; y < rgba.Rect.Dy(); y++ {
+		row := rgba.Pix[y*rgba.Stride : y*rgba.Stride+rgba.Rect.Dx()*4]
+		for i := 0; i < len(row); i += 4 {
+			out = append(out, row[i], row[i+1], row[i+2])
+		}
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func getRawFrame(t *testing.T, query string) (rawFrameHeader, []byte) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handleRawFrame(rec, httptest.NewRequest(http.MethodGet, "/frame/raw"+query, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /frame/raw%s: %d %s", query, rec.Code, rec.Body)
+	}
+	br := bufio.NewReader(rec.Body)
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hdr rawFrameHeader
+	if err := json.Unmarshal(line, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(br)
+	if hdr.Compression == "zstd" {
+		dec, _ := zstd.NewReader(nil)
+		defer dec.Close()
+		if data, err = dec.DecodeAll(data, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(data) != hdr.Size || hdr.Size != hdr.Stride*hdr.Height {
+		t.Fatalf("%s: got %d bytes, header %+v", query, len(data), hdr)
+	}
+	return hdr, data
+}
+
+func TestRawFrame(t *testing.T) {
+	saved := cameraConfig
+	defer func() { closeCamera(); cameraConfig = saved }()
+
+	cameraConfig = CameraConfig{Simulate: true, Format: "YUYV", Width: 64, Height: 48, FPS: 30}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	hdr, _ := getRawFrame(t, "?compress=zstd")
+	if hdr.PixFmt != "YUYV" || hdr.Width != 64 || hdr.Stride != 128 {
+		t.Errorf("YUYV header %+v", hdr)
+	}
+	hdr, _ = getRawFrame(t, "?pixfmt=rgb")
+	if hdr.PixFmt != "RGB" || hdr.Stride != 192 || hdr.Compression != "none" {
+		t.Errorf("RGB header %+v", hdr)
+	}
+	closeCamera()
+
+	cameraConfig.Format = "MJPEG"
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	hdr, _ = getRawFrame(t, "?compress=zstd")
+	if hdr.PixFmt != "RGB" || hdr.Width != 64 || hdr.Height != 48 {
+		t.Errorf("MJPEG header %+v", hdr)
+	}
+	rec := httptest.NewRecorder()
+	handleRawFrame(rec, httptest.NewRequest(http.MethodGet, "/frame/raw?pixfmt=yuyv", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("YUYV from MJPEG: %d, want 400", rec.Code)
+	}
+}
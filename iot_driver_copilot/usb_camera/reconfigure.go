@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Resolution and frame-rate changes without dropping clients:
+//
+//	POST /capture/reconfigure?width=1280&height=720[&fps=30]
+//
+// The source is closed and reopened with the new settings while
+// cameraState.mu is held, which pauses every stream at its next frame.
+// Streams then continue from the new source, and the first part each sends
+// after the switch carries "X-Stream-Event: format-changed" and
+// "X-Frame-Size: WxH" headers. The pixel format can't change this way, as
+// streams are specific to it; that still takes a stop and start.
+
+var errNotCapturing = errors.New("camera is not capturing")
+
+// reconfigureCamera swaps the running source for one with the new frame
+// settings. If the device refuses them the previous settings are restored,
+// so streams carry on either way unless that fails too.
+func reconfigureCamera(width, height, fps uint32) (sourceInfo, error) {
+	cameraState.mu.Lock()
+	defer cameraState.mu.Unlock()
+	if !cameraState.running {
+		return sourceInfo{}, errNotCapturing
+	}
+	if playbackState.active {
+		return sourceInfo{}, errPlaybackActive
+	}
+	prev := cameraConfig
+	prev.Format = cameraState.formatStr
+	cfg := prev
+	cfg.Width, cfg.Height, cfg.FPS = width, height, fps
+	if err := validateFrameConfig(cfg); err != nil {
+		return sourceInfo{}, err
+	}
+	cameraState.source.StopStreaming()
+	cameraState.source.Close()
+	src, info, err := openFrameSource(cfg)
+	if err != nil {
+		var rerr error
+		if src, info, rerr = openFrameSource(prev); rerr != nil {
+			cameraState.source, cameraState.running = nil, false
+			cameraState.gen.Add(1)
+			_ = sdNotify("STATUS=camera reopen failed: " + rerr.Error())
+			return sourceInfo{}, fmt.Errorf("%v; reopening with the previous settings failed: %v", err, rerr)
+		}
+		installSource(src, info)
+		return sourceInfo{}, err
+	}
+	cameraConfig.Width, cameraConfig.Height, cameraConfig.FPS = width, height, fps
+	installSource(src, info)
+	recordEvent("capture_reconfigured", "", map[string]interface{}{"width": info.Width, "height": info.Height, "fps": info.FPS})
+	return info, nil
+}
+
+// installSource makes src the running source. The caller holds cameraState.mu.
+func installSource(src FrameSource, info sourceInfo) {
+	cameraState.source = src
+	cameraState.width, cameraState.height, cameraState.fps = info.Width, info.Height, info.FPS
+	cameraState.formatStr = info.Format
+	cameraState.gen.Add(1)
+	_ = sdNotify(fmt.Sprintf("STATUS=capturing %s %dx%d@%d", info.Format, info.Width, info.Height, info.FPS))
+}
+
+func handleReconfigure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dry, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+	cameraState.mu.Lock()
+	wv, hv, fv := cameraState.width, cameraState.height, cameraState.fps
+	cameraState.mu.Unlock()
+	q := r.URL.Query()
+	var err error
+	for _, p := range []struct {
+		name string
+		max  int
+		dst  *uint32
+	}{{"width", maxFrameWidth, &wv}, {"height", maxFrameHeight, &hv}, {"fps", maxFrameRate, &fv}} {
+		if v := q.Get(p.name); v != "" {
+			if *p.dst, err = parseFrameParam(p.name, v, p.max); err != nil {
+				jsonResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+	}
+	if dry {
+		cameraState.mu.Lock()
+		running, playing, format := cameraState.running, playbackState.active, cameraState.formatStr
+		cameraState.mu.Unlock()
+		if err := errNotCapturing; !running || playing {
+			if playing {
+				err = errPlaybackActive
+			}
+			jsonResponse(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		cfg := cameraConfig
+		cfg.Format, cfg.Width, cfg.Height, cfg.FPS = format, wv, hv, fv
+		replyDryRun(w, append([]plannedOp{closeSourceOp(), openSourceOp(cfg)}, saveCaptureStateOps()...))
+		return
+	}
+	info, err := reconfigureCamera(wv, hv, fv)
+	if errors.Is(err, errNotCapturing) || errors.Is(err, errPlaybackActive) {
+		jsonResponse(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	saveCaptureState(true)
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"status": "reconfigured", "format": info.Format, "width": info.Width, "height": info.Height, "fps": info.FPS,
+	})
+}
+
+// streamFeed is a stream's handle on the capture source, followed across
+// reconfigures.
+type streamFeed struct {
+	src           FrameSource
+	width, height int
+	gen           uint64
+	changed       bool // the next part is the first since a reconfigure
+}
+
+func newStreamFeed() *streamFeed {
+	cameraState.mu.Lock()
+	defer cameraState.mu.Unlock()
+	return &streamFeed{src: cameraState.source, width: int(cameraState.width), height: int(cameraState.height), gen: cameraState.gen.Load()}
+}
+
+// follow moves the feed to the current source if a reconfigure replaced
+// its own. failed means the feed's source just returned an error: follow
+// then waits out a reconfigure in progress and reports false, ending the
+// stream, unless the source was replaced.
+func (f *streamFeed) follow(failed bool) bool {
+	if !failed && cameraState.gen.Load() == f.gen {
+		return true
+	}
+	cameraState.mu.Lock()
+	defer cameraState.mu.Unlock()
+	if !cameraState.running || cameraState.source == nil {
+		return false
+	}
+	if g := cameraState.gen.Load(); g != f.gen {
+		f.src, f.width, f.height, f.gen = cameraState.source, int(cameraState.width), int(cameraState.height), g
+		f.changed = true
+		return true
+	}
+	return !failed
+}
+
+// writePartHeader starts a multipart part for a JPEG of n bytes, with any
+// extra header lines.
+func (f *streamFeed) writePartHeader(w io.Writer, boundary string, n int, extra ...string) {
+	fmt.Fprintf(w, "--%s\r\n", boundary)
+	fmt.Fprintf(w, "Content-Type: image/jpeg\r\n")
+	if f.changed {
+		fmt.Fprintf(w, "X-Stream-Event: format-changed\r\nX-Frame-Size: %dx%d\r\n", f.width, f.height)
+		f.changed = false
+	}
+	for _, h := range extra {
+		fmt.Fprintf(w, "%s\r\n", h)
+	}
+	fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", n)
+}
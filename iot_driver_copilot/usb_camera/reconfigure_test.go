@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReconfigureKeepsStreams(t *testing.T) {
+	saved := cameraConfig
+	defer func() { closeCamera(); cameraConfig = saved }()
+	cameraConfig = CameraConfig{Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(handleStream))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reconfigureCamera(32, 24, 30); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("stream ended across reconfigure: %v", err)
+		}
+		if p.Header.Get("X-Stream-Event") != "format-changed" {
+			continue
+		}
+		if got := p.Header.Get("X-Frame-Size"); got != "32x24" {
+			t.Errorf("X-Frame-Size = %q, want 32x24", got)
+		}
+		body, _ := io.ReadAll(p)
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width != 32 || cfg.Height != 24 {
+			t.Errorf("frame is %dx%d, want 32x24", cfg.Width, cfg.Height)
+		}
+		p, err = mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Header.Get("X-Stream-Event") != "" {
+			t.Error("format-changed repeated on a later part")
+		}
+		return
+	}
+	t.Fatal("no format-changed part")
+}
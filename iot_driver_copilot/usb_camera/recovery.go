@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- CAPTURE RECOVERY ---
+// Some cameras stop delivering frames without reporting an error: every
+// WaitForFrame just times out. With CAPTURE_RECOVERY_TIMEOUTS=N the driver
+// reopens the device once N such timeouts have piled up within
+// CAPTURE_RECOVERY_WINDOW_MS (default 30000) with no frame in between.
+// Streams carry on from the reopened device, as after a reconfigure. If
+// reopening fails and CAPTURE_RECOVERY_POWER_CYCLE is set, that command
+// (e.g. "uhubctl -l 1-1 -p 2 -a cycle") is run to cut and restore the
+// camera's USB power, and the device is opened again after
+// CAPTURE_RECOVERY_SETTLE_MS (default 3000). Capture stops while the
+// device is down, and if it does not come back it needs a /capture/start.
+// Each step is recorded on the event timeline as "capture_recovery" with
+// its action ("reopen" or "power_cycle") and outcome. Clip playback is
+// never interrupted.
+
+type RecoveryConfig struct {
+	Timeouts   int           // CAPTURE_RECOVERY_TIMEOUTS; 0 is off
+	Window     time.Duration // CAPTURE_RECOVERY_WINDOW_MS
+	PowerCycle []string      // CAPTURE_RECOVERY_POWER_CYCLE, split on spaces
+	Settle     time.Duration // CAPTURE_RECOVERY_SETTLE_MS
+}
+
+var recoveryConfig RecoveryConfig
+
+var (
+	captureRecoveries  atomic.Uint64
+	capturePowerCycles atomic.Uint64
+)
+
+// reopenSource opens the source a recovery installs. Tests replace it.
+var reopenSource = openFrameSource
+
+func loadRecoveryConfig() error {
+	recoveryConfig = RecoveryConfig{Window: 30 * time.Second, Settle: 3 * time.Second}
+	recovery.reset()
+	for _, s := range []struct {
+		name     string
+		min, max int
+		set      func(int)
+	}{
+		{"CAPTURE_RECOVERY_TIMEOUTS", 0, 1000, func(n int) { recoveryConfig.Timeouts = n }},
+		{"CAPTURE_RECOVERY_WINDOW_MS", 1000, 3600000, func(n int) { recoveryConfig.Window = time.Duration(n) * time.Millisecond }},
+		{"CAPTURE_RECOVERY_SETTLE_MS", 0, 120000, func(n int) { recoveryConfig.Settle = time.Duration(n) * time.Millisecond }},
+	} {
+		if v := os.Getenv(s.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < s.min || n > s.max {
+				return fmt.Errorf("%s must be between %d and %d", s.name, s.min, s.max)
+			}
+			s.set(n)
+		}
+	}
+	recoveryConfig.PowerCycle = strings.Fields(os.Getenv("CAPTURE_RECOVERY_POWER_CYCLE"))
+	if len(recoveryConfig.PowerCycle) > 0 {
+		if recoveryConfig.Timeouts == 0 {
+			return errors.New("CAPTURE_RECOVERY_POWER_CYCLE needs CAPTURE_RECOVERY_TIMEOUTS")
+		}
+		if _, err := exec.LookPath(recoveryConfig.PowerCycle[0]); err != nil {
+			return fmt.Errorf("CAPTURE_RECOVERY_POWER_CYCLE: %v", err)
+		}
+	}
+	return nil
+}
+
+// captureRecovery counts frame timeouts and runs recoveries one at a time.
+type captureRecovery struct {
+	mu       sync.Mutex
+	timeouts []time.Time // since the last frame, within the window
+	trigger  chan struct{}
+}
+
+var recovery = &captureRecovery{trigger: make(chan struct{}, 1)}
+
+func (c *captureRecovery) reset() {
+	c.mu.Lock()
+	c.timeouts = nil
+	c.mu.Unlock()
+}
+
+func (c *captureRecovery) noteFrame() {
+	c.mu.Lock()
+	c.timeouts = c.timeouts[:0]
+	c.mu.Unlock()
+}
+
+// noteTimeout counts a timeout at now and asks for a recovery when there
+// are CAPTURE_RECOVERY_TIMEOUTS within the window.
+func (c *captureRecovery) noteTimeout(now time.Time) {
+	if recoveryConfig.Timeouts == 0 {
+		return
+	}
+	c.mu.Lock()
+	kept := c.timeouts[:0]
+	for _, t := range c.timeouts {
+		if now.Sub(t) < recoveryConfig.Window {
+			kept = append(kept, t)
+		}
+	}
+	c.timeouts = append(kept, now)
+	due := len(c.timeouts) >= recoveryConfig.Timeouts
+	if due {
+		c.timeouts = nil
+	}
+	c.mu.Unlock()
+	if due {
+		select {
+		case c.trigger <- struct{}{}:
+		default: // a recovery is already pending
+		}
+	}
+}
+
+func (c *captureRecovery) run(ctx context.Context) {
+	for {
+		select {
+		case <-c.trigger:
+			c.recover(ctx)
+			c.reset() // timeouts seen during the recovery were the old device's
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recover reopens the device and, failing that, power-cycles it and opens
+// it once more.
+func (c *captureRecovery) recover(ctx context.Context) {
+	log.Printf("capture recovery: %d frame timeouts within %v, reopening %s", recoveryConfig.Timeouts, recoveryConfig.Window, cameraConfig.deviceID())
+	cfg, err := reopenCapture()
+	if errors.Is(err, errNotCapturing) || errors.Is(err, errPlaybackActive) {
+		return
+	}
+	captureRecoveries.Add(1)
+	recordRecovery("reopen", err)
+	if err == nil || len(recoveryConfig.PowerCycle) == 0 {
+		return
+	}
+	capturePowerCycles.Add(1)
+	if err := runPowerCycle(ctx); err != nil {
+		recordRecovery("power_cycle", err)
+		return
+	}
+	select {
+	case <-time.After(recoveryConfig.Settle):
+	case <-ctx.Done():
+		return
+	}
+	recordRecovery("power_cycle", resumeCapture(cfg))
+}
+
+func recordRecovery(action string, err error) {
+	detail := map[string]interface{}{"action": action, "ok": err == nil}
+	if err != nil {
+		detail["error"] = err.Error()
+		log.Printf("capture recovery: %s failed: %v", action, err)
+	} else {
+		log.Printf("capture recovery: %s succeeded", action)
+	}
+	recordEvent("capture_recovery", "", detail)
+}
+
+// reopenCapture closes the running source and opens it again with the
+// same settings, which it returns. The new source is installed like a
+// reconfigure's, so streams follow it. If the device does not open,
+// capture stops.
+func reopenCapture() (CameraConfig, error) {
+	cameraState.mu.Lock()
+	defer cameraState.mu.Unlock()
+	cfg := cameraConfig
+	if !cameraState.running {
+		return cfg, errNotCapturing
+	}
+	if playbackState.active {
+		return cfg, errPlaybackActive
+	}
+	cfg.Format = cameraState.formatStr
+	cameraState.source.StopStreaming()
+	cameraState.source.Close()
+	src, info, err := reopenSource(cfg)
+	if err != nil {
+		cameraState.source, cameraState.running = nil, false
+		cameraState.gen.Add(1)
+		_ = sdNotify("STATUS=camera recovery failed: " + err.Error())
+		recordEvent("capture_stopped", "", map[string]interface{}{"reason": "recovery failed"})
+		return cfg, err
+	}
+	installSource(src, info)
+	return cfg, nil
+}
+
+// resumeCapture opens the device with cfg after a power cycle, unless
+// capture was started again meanwhile.
+func resumeCapture(cfg CameraConfig) error {
+	cameraState.mu.Lock()
+	defer cameraState.mu.Unlock()
+	if cameraState.running {
+		return nil
+	}
+	src, info, err := reopenSource(cfg)
+	if err != nil {
+		return err
+	}
+	installSource(src, info)
+	cameraState.running = true
+	recordEvent("capture_started", "", map[string]interface{}{"format": info.Format, "width": info.Width, "height": info.Height, "fps": info.FPS})
+	return nil
+}
+
+func runPowerCycle(ctx context.Context) error {
+	cctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := exec.CommandContext(cctx, recoveryConfig.PowerCycle[0], recoveryConfig.PowerCycle[1:]...)
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// timeoutWatch reports a backend's frame timeouts and frames to recovery.
+type timeoutWatch struct {
+	FrameSource
+}
+
+func (s *timeoutWatch) WaitForFrame(timeout uint32) error {
+	err := s.FrameSource.WaitForFrame(timeout)
+	if err != nil && isTimeout(err) {
+		recovery.noteTimeout(time.Now())
+	}
+	return err
+}
+
+func (s *timeoutWatch) ReadFrame() ([]byte, error) {
+	frame, err := s.FrameSource.ReadFrame()
+	if len(frame) > 0 {
+		recovery.noteFrame()
+	}
+	return frame, err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRecoveryTimeoutCount(t *testing.T) {
+	saved := recoveryConfig
+	defer func() { recoveryConfig = saved }()
+	recoveryConfig = RecoveryConfig{Timeouts: 3, Window: 10 * time.Second}
+	c := &captureRecovery{trigger: make(chan struct{}, 1)}
+	triggered := func() bool {
+		select {
+		case <-c.trigger:
+			return true
+		default:
+			return false
+		}
+	}
+	t0 := time.Now()
+	c.noteTimeout(t0)
+	c.noteTimeout(t0.Add(time.Second))
+	c.noteFrame()
+	c.noteTimeout(t0.Add(2 * time.Second))
+	c.noteTimeout(t0.Add(3 * time.Second))
+	if triggered() {
+		t.Fatal("a frame between the timeouts did not reset the count")
+	}
+	c.noteTimeout(t0.Add(4 * time.Second))
+	if !triggered() {
+		t.Fatal("three timeouts in a row did not trigger a recovery")
+	}
+	c.noteTimeout(t0.Add(20 * time.Second))
+	c.noteTimeout(t0.Add(31 * time.Second))
+	c.noteTimeout(t0.Add(32 * time.Second))
+	if triggered() {
+		t.Error("timeouts outside the window were counted")
+	}
+}
+
+func TestCaptureRecovery(t *testing.T) {
+	savedCam, savedCfg, savedOpen := cameraConfig, recoveryConfig, reopenSource
+	defer func() { closeCamera(); cameraConfig, recoveryConfig, reopenSource = savedCam, savedCfg, savedOpen }()
+	cameraConfig = CameraConfig{DevicePath: "/dev/video-missing", Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	recoveryConfig = RecoveryConfig{Timeouts: 3, Window: time.Minute}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	lastRecovery := func() map[string]interface{} {
+		evs, _ := events.query(eventQuery{types: map[string]bool{"capture_recovery": true}, limit: 1000})
+		if len(evs) == 0 {
+			return nil
+		}
+		return evs[len(evs)-1].Detail
+	}
+
+	// A reopen that works swaps the source under the streams.
+	gen := cameraState.gen.Load()
+	recovery.recover(context.Background())
+	if d := lastRecovery(); d["action"] != "reopen" || d["ok"] != true {
+		t.Errorf("reopen event %v", d)
+	}
+	if cameraState.gen.Load() == gen || !cameraState.running {
+		t.Error("the source was not replaced")
+	}
+
+	// A device that won't reopen is power-cycled and opened again.
+	fails := 1
+	reopenSource = func(cfg CameraConfig) (FrameSource, sourceInfo, error) {
+		if fails > 0 {
+			fails--
+			return nil, sourceInfo{}, errors.New("no such device")
+		}
+		return openFrameSource(cfg)
+	}
+	recoveryConfig.PowerCycle = []string{"true"}
+	recoveries, cycles := captureRecoveries.Load(), capturePowerCycles.Load()
+	recovery.recover(context.Background())
+	if d := lastRecovery(); d["action"] != "power_cycle" || d["ok"] != true {
+		t.Errorf("power cycle event %v", d)
+	}
+	if !cameraState.running || cameraState.source == nil {
+		t.Error("capture did not resume after the power cycle")
+	}
+	if captureRecoveries.Load()-recoveries != 1 || capturePowerCycles.Load()-cycles != 1 {
+		t.Error("counters not updated")
+	}
+
+	// Without a power cycle command a failed reopen stops capture.
+	fails = 1
+	recoveryConfig.PowerCycle = nil
+	recovery.recover(context.Background())
+	if d := lastRecovery(); d["action"] != "reopen" || d["ok"] != false || d["error"] != "no such device" {
+		t.Errorf("failed reopen event %v", d)
+	}
+	if cameraState.running {
+		t.Error("still marked capturing without a device")
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// --- REGIONS OF INTEREST ---
+// A region of interest is a named rectangle of the frame served as a camera
+// of its own, so a gauge reader or a door monitor gets only its pixels:
+//
+//	PUT    /roi/gauge {"x": 0.62, "y": 0.10, "width": 0.15, "height": 0.20, "max_width": 320}
+//	GET    /roi/gauge/snapshot   one JPEG of the region
+//	GET    /roi/gauge/stream     the region as an MJPEG stream
+//	GET    /roi/gauge            the definition
+//	DELETE /roi/gauge
+//	GET    /rois                 all of them
+//
+// Like annotations, the rectangle is given in fractions of the frame, so it
+// covers the same part of the scene after a reconfigure. max_width, when
+// set, scales larger crops down to that width. The region is cut from the
+// frame as captured, after lens correction and annotations, and carries the
+// client's watermark. Snapshot and stream take a ?token= minted for their
+// path. Regions are kept in ROI_FILE (rois.json in STATE_DIR) and survive
+// restarts; a stream ends when its region is deleted.
+
+type roi struct {
+	Name     string  `json:"name"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Width    float64 `json:"width"`
+	Height   float64 `json:"height"`
+	MaxWidth int     `json:"max_width,omitempty"`
+}
+
+var roiNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+const maxROIs = 32
+
+func (r *roi) validate() error {
+	if !roiNamePattern.MatchString(r.Name) {
+		return errors.New("name must be 1-32 lowercase letters, digits, '-' or '_'")
+	}
+	for _, v := range []float64{r.X, r.Y, r.Width, r.Height} {
+		if math.IsNaN(v) || v < 0 || v > 1 {
+			return errors.New("x, y, width and height must be fractions of the frame, 0 to 1")
+		}
+	}
+	if r.Width == 0 || r.Height == 0 || r.X+r.Width > 1.000001 || r.Y+r.Height > 1.000001 {
+		return errors.New("the region must have a size and lie inside the frame")
+	}
+	if r.MaxWidth < 0 || r.MaxWidth > maxFrameWidth {
+		return fmt.Errorf("max_width must be 0 (no scaling) to %d", maxFrameWidth)
+	}
+	return nil
+}
+
+// rect is the region in a width x height frame, at least one pixel.
+func (r roi) rect(width, height int) image.Rectangle {
+	x0, y0 := min(int(math.Round(r.X*float64(width))), width-1), min(int(math.Round(r.Y*float64(height))), height-1)
+	x1, y1 := int(math.Round((r.X+r.Width)*float64(width))), int(math.Round((r.Y+r.Height)*float64(height)))
+	rect := image.Rect(x0, y0, max(x1, x0+1), max(y1, y0+1))
+	return rect.Intersect(image.Rect(0, 0, width, height))
+}
+
+type ROIConfig struct {
+	File string // ROI_FILE
+}
+
+var roiConfig ROIConfig
+
+type roiSet struct {
+	mu   sync.Mutex
+	rois map[string]roi
+}
+
+var rois = &roiSet{rois: map[string]roi{}}
+
+func loadROIConfig() error {
+	roiConfig.File = stateFilePath("ROI_FILE", "rois.json")
+	rois = &roiSet{rois: map[string]roi{}}
+	if roiConfig.File == "" {
+		return nil
+	}
+	var list []roi
+	err := loadState(roiConfig.File, &list)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range list {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("%s: region %q: %v", roiConfig.File, r.Name, err)
+		}
+		rois.rois[r.Name] = r
+	}
+	log.Printf("%d regions of interest loaded from %s", len(list), roiConfig.File)
+	return nil
+}
+
+func (s *roiSet) get(name string) (roi, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rois[name]
+	return r, ok
+}
+
+func (s *roiSet) list() []roi {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedLocked()
+}
+
+func (s *roiSet) sortedLocked() []roi {
+	out := make([]roi, 0, len(s.rois))
+	for _, r := range s.rois {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// update applies change to a copy of the set, saves it to ROI_FILE and
+// installs it; on a save error nothing changes.
+func (s *roiSet) update(change func(map[string]roi) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := make(map[string]roi, len(s.rois)+1)
+	for k, v := range s.rois {
+		next[k] = v
+	}
+	if err := change(next); err != nil {
+		return err
+	}
+	if roiConfig.File != "" {
+		list := (&roiSet{rois: next}).sortedLocked()
+		if err := saveState(roiConfig.File, list); err != nil {
+			return fmt.Errorf("saving regions: %v", err)
+		}
+	}
+	s.rois = next
+	return nil
+}
+
+// roiMediaPath splits /roi/NAME/snapshot or /roi/NAME/stream.
+func roiMediaPath(p string) (name, kind string, ok bool) {
+	rest, found := strings.CutPrefix(p, "/roi/")
+	if !found {
+		return "", "", false
+	}
+	name, kind, found = strings.Cut(rest, "/")
+	if !found || !roiNamePattern.MatchString(name) || (kind != "snapshot" && kind != "stream") {
+		return "", "", false
+	}
+	return name, kind, true
+}
+
+// roiJPEG cuts reg out of a captured frame and encodes it. Viewers of the
+// same region share the result through the frame cache.
+func roiJPEG(frame []byte, format string, width, height uint32, reg roi, mark string) ([]byte, int, int, error) {
+	spec := fmt.Sprintf("roi:%g,%g,%g,%g,%d|%s", reg.X, reg.Y, reg.Width, reg.Height, reg.MaxWidth, mark)
+	key := frameCache.key(frame, format, width, height, spec)
+	if encoderConfig.Dedup {
+		if jpg := frameCache.get(key); jpg != nil {
+			cfg, err := jpeg.DecodeConfig(bytes.NewReader(jpg))
+			return jpg, cfg.Width, cfg.Height, err
+		}
+	}
+	dst, err := roiImage(frame, format, width, height, reg)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	w, h := dst.Bounds().Dx(), dst.Bounds().Dy()
+	if mark != "" {
+		drawWatermark(dst, mark)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: encoderConfig.Quality}); err != nil {
+		return nil, 0, 0, err
+	}
+	if encoderConfig.Dedup {
+		frameCache.put(key, buf.Bytes())
+	}
+	return buf.Bytes(), w, h, nil
+}
+
+// roiImage cuts reg out of a captured frame, scaled down to its max_width.
+func roiImage(frame []byte, format string, width, height uint32, reg roi) (*image.RGBA, error) {
+	var img image.Image
+	if format == "YUYV" {
+		img = yuyvToImage(frame, int(width), int(height))
+	} else {
+		var err error
+		if img, err = jpeg.Decode(bytes.NewReader(withDefaultHuffman(frame))); err != nil {
+			return nil, err
+		}
+	}
+	b := img.Bounds()
+	src := reg.rect(b.Dx(), b.Dy()).Add(b.Min)
+	w, h := src.Dx(), src.Dy()
+	if reg.MaxWidth > 0 && w > reg.MaxWidth {
+		w, h = reg.MaxWidth, max(1, h*reg.MaxWidth/w)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if w == src.Dx() {
+		draw.Draw(dst, dst.Bounds(), img, src.Min, draw.Src)
+	} else {
+		draw.ApproxBiLinear.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	}
+	return dst, nil
+}
+
+func handleROIs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"rois": rois.list()})
+}
+
+// handleROI serves /roi/NAME and its snapshot and stream.
+func handleROI(w http.ResponseWriter, r *http.Request) {
+	if name, kind, ok := roiMediaPath(r.URL.Path); ok {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, ok := rois.get(name); !ok {
+			http.Error(w, "No region of interest named "+name, http.StatusNotFound)
+			return
+		}
+		if kind == "snapshot" {
+			handleROISnapshot(w, r, name)
+		} else {
+			handleROIStream(w, r, name)
+		}
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/roi/")
+	if !roiNamePattern.MatchString(name) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	dry, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		reg, ok := rois.get(name)
+		if !ok {
+			http.Error(w, "No region of interest named "+name, http.StatusNotFound)
+			return
+		}
+		jsonResponse(w, http.StatusOK, reg)
+	case http.MethodPut:
+		var reg roi
+		if !decodeJSONBody(w, r, &reg) {
+			return
+		}
+		if reg.Name != "" && reg.Name != name {
+			jsonResponse(w, http.StatusBadRequest, map[string]string{"error": "name in the body differs from the path"})
+			return
+		}
+		reg.Name = name
+		if err := reg.validate(); err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if dry {
+			replyDryRun(w, roiOps("save_state", plannedOp{Op: "set_roi", Detail: reg}))
+			return
+		}
+		err := rois.update(func(m map[string]roi) error {
+			if _, exists := m[name]; !exists && len(m) >= maxROIs {
+				return fmt.Errorf("at most %d regions of interest", maxROIs)
+			}
+			m[name] = reg
+			return nil
+		})
+		if err != nil {
+			jsonResponse(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		jsonResponse(w, http.StatusOK, reg)
+	case http.MethodDelete:
+		if _, ok := rois.get(name); !ok {
+			http.Error(w, "No region of interest named "+name, http.StatusNotFound)
+			return
+		}
+		if dry {
+			replyDryRun(w, roiOps("save_state", plannedOp{Op: "delete_roi", Detail: name}))
+			return
+		}
+		err := rois.update(func(m map[string]roi) error {
+			delete(m, name)
+			return nil
+		})
+		if err != nil {
+			jsonResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		jsonResponse(w, http.StatusOK, map[string]string{"deleted": name})
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func roiOps(fileOp string, op plannedOp) []plannedOp {
+	if roiConfig.File == "" {
+		return []plannedOp{op}
+	}
+	return []plannedOp{{Op: fileOp, File: roiConfig.File}, op}
+}
+
+func handleROISnapshot(w http.ResponseWriter, r *http.Request, name string) {
+	cameraState.mu.Lock()
+	running := cameraState.running
+	cam := cameraState.source
+	format := cameraState.formatStr
+	width, height := cameraState.width, cameraState.height
+	cameraState.mu.Unlock()
+	if !running {
+		http.Error(w, "Camera is not capturing", http.StatusServiceUnavailable)
+		return
+	}
+	frame, ok := grabFrame(w, cam)
+	if !ok {
+		return
+	}
+	defer releaseFrame(frame)
+	reg, ok := rois.get(name)
+	if !ok {
+		http.Error(w, "No region of interest named "+name, http.StatusNotFound)
+		return
+	}
+	client := clientIDFromRequest(r)
+	jpg, rw, rh, err := roiJPEG(frame, format, width, height, reg, watermarkFor(client))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(jpg)))
+	w.Write(jpg)
+	recordEvent("snapshot", client, map[string]interface{}{"width": rw, "height": rh, "roi": name})
+}
+
+func handleROIStream(w http.ResponseWriter, r *http.Request, name string) {
+	cameraState.mu.Lock()
+	running, format := cameraState.running, cameraState.formatStr
+	cameraState.mu.Unlock()
+	if !running {
+		http.Error(w, "Camera is not capturing", http.StatusServiceUnavailable)
+		return
+	}
+	boundary := "roistream"
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	client, started := clientIDFromRequest(r), time.Now()
+	recordEvent("stream_started", client, map[string]interface{}{"format": format, "roi": name})
+	defer func() {
+		recordEvent("stream_ended", client, map[string]interface{}{"format": format, "roi": name, "seconds": int(time.Since(started).Seconds())})
+	}()
+	feed := newStreamFeed()
+	mark := watermarkFor(client)
+	badFrames := 0
+	activeStreams.Add(1)
+	defer activeStreams.Add(-1)
+	sc := openStreamClient(r, "multipart")
+	defer sc.close()
+	for {
+		if r.Context().Err() != nil {
+			break
+		}
+		if !feed.follow(false) {
+			break
+		}
+		err := feed.src.WaitForFrame(5)
+		if err != nil && !isTimeout(err) {
+			captureErrors.Add(1)
+			if feed.follow(true) {
+				continue
+			}
+			break
+		}
+		frame, err := feed.src.ReadFrame()
+		if len(frame) == 0 {
+			continue
+		}
+		if err != nil && !isTimeout(err) {
+			releaseFrame(frame)
+			captureErrors.Add(1)
+			if feed.follow(true) {
+				continue
+			}
+			break
+		}
+		markFrame()
+		at := frameTimeOf(frame)
+		reg, ok := rois.get(name)
+		if !ok {
+			releaseFrame(frame)
+			break // the region was deleted
+		}
+		jpg, rw, rh, err := roiJPEG(frame, format, uint32(feed.width), uint32(feed.height), reg, mark)
+		releaseFrame(frame)
+		if err != nil {
+			if badFrames++; badFrames >= maxUndecodableFrames {
+				log.Printf("ending region %q stream for %q: frames cannot be decoded", name, client)
+				break
+			}
+			continue
+		}
+		badFrames = 0
+		// Part headers give the region's size, not the captured frame's.
+		part := *feed
+		part.width, part.height = rw, rh
+		writeStreamPart(w, flusher, &part, sc, boundary, jpg, at)
+		feed.changed = part.changed
+	}
+}
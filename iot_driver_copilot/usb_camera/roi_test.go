@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/jpeg"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestROIRect(t *testing.T) {
+	for _, c := range []struct {
+		r    roi
+		want string
+	}{
+		{roi{X: 0.25, Y: 0.5, Width: 0.5, Height: 0.25}, "(16,24)-(48,36)"},
+		{roi{X: 0, Y: 0, Width: 1, Height: 1}, "(0,0)-(64,48)"},
+		{roi{X: 0.999, Y: 0.999, Width: 0.001, Height: 0.001}, "(63,47)-(64,48)"},
+	} {
+		if got := c.r.rect(64, 48).String(); got != c.want {
+			t.Errorf("%+v: %s, want %s", c.r, got, c.want)
+		}
+	}
+	for _, bad := range []roi{
+		{Name: "Gauge", Width: 0.1, Height: 0.1},
+		{Name: "gauge", X: 0.95, Width: 0.1, Height: 0.1},
+		{Name: "gauge", Width: 0, Height: 0.1},
+		{Name: "gauge", Width: 0.1, Height: 0.1, MaxWidth: -1},
+	} {
+		if bad.validate() == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
+
+func TestROIEndpoints(t *testing.T) {
+	savedCam, savedROI, savedSet := cameraConfig, roiConfig, rois
+	defer func() { closeCamera(); cameraConfig, roiConfig, rois = savedCam, savedROI, savedSet }()
+	t.Setenv("ROI_FILE", t.TempDir()+"/rois.json")
+	if err := loadROIConfig(); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rois", handleROIs)
+	mux.HandleFunc("/roi/", handleROI)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	do := func(method, path, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := do(http.MethodPut, "/roi/gauge", `{"x": 0.5, "y": 0.5, "width": 0.6, "height": 0.1}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("region outside the frame: %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodPut, "/roi/gauge?dry_run=true", `{"x": 0.5, "y": 0.5, "width": 0.5, "height": 0.5}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("dry run: %d", resp.StatusCode)
+	}
+	if _, ok := rois.get("gauge"); ok {
+		t.Fatal("dry run created the region")
+	}
+	if resp := do(http.MethodPut, "/roi/gauge", `{"x": 0.5, "y": 0.5, "width": 0.5, "height": 0.5}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT: %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodPut, "/roi/door", `{"x": 0, "y": 0, "width": 1, "height": 1, "max_width": 16}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT door: %d", resp.StatusCode)
+	}
+	resp := do(http.MethodGet, "/rois", "")
+	var list struct{ ROIs []roi }
+	json.NewDecoder(resp.Body).Decode(&list)
+	if len(list.ROIs) != 2 || list.ROIs[0].Name != "door" || list.ROIs[1].Name != "gauge" {
+		t.Errorf("GET /rois = %+v", list.ROIs)
+	}
+
+	// The regions are back after a restart.
+	if err := loadROIConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := rois.get("door"); !ok || r.MaxWidth != 16 {
+		t.Fatalf("reloaded door = %+v %v", r, ok)
+	}
+
+	if resp := do(http.MethodGet, "/roi/gauge/snapshot", ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("snapshot while stopped: %d", resp.StatusCode)
+	}
+	cameraConfig = CameraConfig{DevicePath: "/dev/video-missing", Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string][2]int{"/roi/gauge/snapshot": {32, 24}, "/roi/door/snapshot": {16, 12}} {
+		resp := do(http.MethodGet, path, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: %d", path, resp.StatusCode)
+		}
+		if cfg, err := jpeg.DecodeConfig(resp.Body); err != nil || cfg.Width != want[0] || cfg.Height != want[1] {
+			t.Errorf("%s: %dx%d %v, want %v", path, cfg.Width, cfg.Height, err, want)
+		}
+	}
+	if resp := do(http.MethodGet, "/roi/nope/snapshot", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown region: %d", resp.StatusCode)
+	}
+
+	resp = do(http.MethodGet, "/roi/gauge/stream", "")
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(part)
+	if cfg, err := jpeg.DecodeConfig(&buf); err != nil || cfg.Width != 32 {
+		t.Errorf("stream part: %+v %v", cfg, err)
+	}
+	// Deleting the region ends its stream.
+	if resp := do(http.MethodDelete, "/roi/gauge", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("DELETE: %d", resp.StatusCode)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, err := mr.NextPart(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("stream still running after its region was deleted")
+	}
+	resp.Body.Close()
+}
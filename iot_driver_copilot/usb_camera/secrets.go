@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// --- SECRET FILES ---
+// API_KEYS, STREAM_TOKEN_SECRET, SNMP_COMMUNITY, GAUGE_DISPLAY_TOKEN and
+// MQTT_PASSWORD can be read from the files named by API_KEYS_FILE,
+// STREAM_TOKEN_SECRET_FILE, SNMP_COMMUNITY_FILE, GAUGE_DISPLAY_TOKEN_FILE and
+// MQTT_PASSWORD_FILE instead (Docker secrets, systemd credentials), so they
+// never sit in the container's environment.
+// One trailing newline is dropped; setting both forms is an error.
+
+var secretEnv = []string{"API_KEYS", "STREAM_TOKEN_SECRET", "SNMP_COMMUNITY", "GAUGE_DISPLAY_TOKEN", "MQTT_PASSWORD"}
+
+func loadSecretFiles() error {
+	for _, name := range secretEnv {
+		path := os.Getenv(name + "_FILE")
+		if path == "" {
+			continue
+		}
+		if os.Getenv(name) != "" {
+			return fmt.Errorf("%s and %s_FILE are both set", name, name)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s_FILE: %v", name, err)
+		}
+		v := strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
+		if v == "" {
+			return fmt.Errorf("%s_FILE: %s is empty", name, path)
+		}
+		os.Setenv(name, v)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSecretFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api_keys")
+	if err := os.WriteFile(path, []byte("alice:s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("API_KEYS", "")
+	t.Setenv("API_KEYS_FILE", path)
+	t.Setenv("STREAM_TOKEN_SECRET_FILE", "")
+	if err := loadSecretFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if got := os.Getenv("API_KEYS"); got != "alice:s3cret" {
+		t.Errorf("API_KEYS = %q", got)
+	}
+	if err := loadSecretFiles(); err == nil {
+		t.Error("API_KEYS and API_KEYS_FILE both set: no error")
+	}
+
+	t.Setenv("API_KEYS_FILE", "")
+	mqttPath := filepath.Join(t.TempDir(), "mqtt_password")
+	if err := os.WriteFile(mqttPath, []byte("broker-pw\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(loadMQTTConfig)
+	t.Setenv("MQTT_PASSWORD", "")
+	t.Setenv("MQTT_PASSWORD_FILE", mqttPath)
+	if err := loadSecretFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if loadMQTTConfig(); mqttConfig.Password != "broker-pw" {
+		t.Errorf("MQTT password = %q", mqttConfig.Password)
+	}
+}
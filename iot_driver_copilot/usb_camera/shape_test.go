@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShapeResponses(t *testing.T) {
+	t.Cleanup(func() { loadShapeConfig() })
+	t.Setenv("RESPONSE_ENVELOPE", "data")
+	t.Setenv("RESPONSE_CASE", "camel")
+	t.Setenv("RESPONSE_SHAPE_ROUTES", "/capture/=none+snake,/tokens=none")
+	if err := loadShapeConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	h := shapeResponses(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stream":
+			w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary=frame")
+			io.WriteString(w, "--frame\r\n")
+			w.(http.Flusher).Flush()
+		case "/snapshot":
+			http.Error(w, "Camera not started", http.StatusServiceUnavailable)
+		default:
+			jsonResponse(w, http.StatusOK, map[string]interface{}{"expires_at": "soon", "frame_size": map[string]int{"width_px": 640}})
+		}
+	}))
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	for path, want := range map[string]string{
+		"/video/start":   `{"data":{"expiresAt":"soon","frameSize":{"widthPx":640}},"ts":`,
+		"/tokens":        `{"expiresAt":"soon","frameSize":{"widthPx":640}}`,
+		"/capture/start": `{"expires_at":"soon","frame_size":{"width_px":640}}`,
+	} {
+		if got := get(path).Body.String(); !strings.HasPrefix(got, want) {
+			t.Errorf("%s: got %s, want %s...", path, got, want)
+		}
+	}
+	if rec := get("/stream"); !rec.Flushed || rec.Body.String() != "--frame\r\n" {
+		t.Errorf("/stream: flushed=%v %q", rec.Flushed, rec.Body)
+	}
+	if rec := get("/snapshot"); rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "Camera not started\n" {
+		t.Errorf("/snapshot: %d %q", rec.Code, rec.Body)
+	}
+
+	t.Setenv("RESPONSE_SHAPE_ROUTES", "/tokens=yaml")
+	if err := loadShapeConfig(); err == nil {
+		t.Error("unknown shape accepted")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"sync"
+	"time"
+
+	"github.com/blackjack/webcam"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// simulatedCamera produces a moving test pattern with a timestamp overlay,
+// paced at the configured frame rate, in either MJPEG or YUYV layout.
+type simulatedCamera struct {
+	format   string
+	width    int
+	height   int
+	interval time.Duration
+
+	mu      sync.Mutex
+	next    time.Time
+	frameNo uint64
+}
+
+var colorBars = []color.RGBA{
+	{255, 255, 255, 255}, {255, 255, 0, 255}, {0, 255, 255, 255}, {0, 255, 0, 255},
+	{255, 0, 255, 255}, {255, 0, 0, 255}, {0, 0, 255, 255}, {16, 16, 16, 255},
+}
+
+func newSimulatedCamera(format string, width, height, fps uint32) *simulatedCamera {
+	if fps == 0 {
+		fps = 15
+	}
+	return &simulatedCamera{
+		format:   format,
+		width:    int(width),
+		height:   int(height),
+		interval: time.Second / time.Duration(fps),
+		next:     time.Now(),
+	}
+}
+
+func (s *simulatedCamera) WaitForFrame(timeout uint32) error {
+	s.mu.Lock()
+	wait := time.Until(s.next)
+	s.mu.Unlock()
+	if wait > time.Duration(timeout)*time.Second {
+		time.Sleep(time.Duration(timeout) * time.Second)
+		return new(webcam.Timeout)
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+func (s *simulatedCamera) ReadFrame() ([]byte, error) {
+	s.mu.Lock()
+	n := s.frameNo
+	s.frameNo++
+	now := time.Now()
+	s.next = s.next.Add(s.interval)
+	if s.next.Before(now) {
+		s.next = now.Add(s.interval)
+	}
+	s.mu.Unlock()
+
+	img := s.render(n, now)
+	if s.format == "YUYV" {
+		return imageToYUYV(img), nil
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *simulatedCamera) StopStreaming() error { return nil }
+func (s *simulatedCamera) Close() error         { return nil }
+
+func (s *simulatedCamera) render(n uint64, now time.Time) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, s.width, s.height))
+	// Color bars scrolling one pixel per frame.
+	barW := s.width / len(colorBars)
+	if barW == 0 {
+		barW = 1
+	}
+	shift := int(n % uint64(s.width))
+	for x := 0; x < s.width; x++ {
+		c := colorBars[((x+shift)/barW)%len(colorBars)]
+		for y := 0; y < s.height; y++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+	// A black square bouncing horizontally gives motion detection something to find.
+	size := s.height / 6
+	span := s.width - size
+	if span > 0 && size > 0 {
+		pos := int(n*4) % (2 * span)
+		if pos > span {
+			pos = 2*span - pos
+		}
+		top := (s.height - size) / 2
+		draw.Draw(img, image.Rect(pos, top, pos+size, top+size), image.Black, image.Point{}, draw.Src)
+	}
+	// Timestamp and frame counter.
+	label := now.Format("2006-01-02 15:04:05.000")
+	d := &font.Drawer{
+		Dst:  img,
+		Src:  image.White,
+		Face: basicfont.Face7x13,
+	}
+	draw.Draw(img, image.Rect(0, 0, d.MeasureString(label).Ceil()+8, 20), image.Black, image.Point{}, draw.Src)
+	d.Dot = fixed.P(4, 14)
+	d.DrawString(label)
+	return img
+}
+
+// imageToYUYV packs an RGBA image into YUYV 4:2:2, the inverse of yuyvToImage.
+func imageToYUYV(img *image.RGBA) []byte {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := make([]byte, 0, w*h*2)
+	for y := 0; y < h; y++ {
+		for x := 0; x+1 < w; x += 2 {
+			y0, u0, v0 := rgbToYUV(img.RGBAAt(x, y))
+			y1, u1, v1 := rgbToYUV(img.RGBAAt(x+1, y))
+			out = append(out, y0, uint8((int(u0)+int(u1))/2), y1, uint8((int(v0)+int(v1))/2))
+		}
+	}
+	return out
+}
+
+func rgbToYUV(c color.RGBA) (uint8, uint8, uint8) {
+	r, g, b := int(c.R), int(c.G), int(c.B)
+	y := ((66*r + 129*g + 25*b + 128) >> 8) + 16
+	u := ((-38*r - 74*g + 112*b + 128) >> 8) + 128
+	v := ((112*r - 94*g - 18*b + 128) >> 8) + 128
+	return uint8(clamp(y, 0, 255)), uint8(clamp(u, 0, 255)), uint8(clamp(v, 0, 255))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+func TestSimulatedCameraFrames(t *testing.T) {
+	for _, c := range []struct {
+		format        string
+		width, height int
+	}{
+		{"MJPEG", 64, 48},
+		{"MJPEG", 320, 240},
+		{"YUYV", 64, 48},
+		{"YUYV", 160, 120},
+	} {
+		cam := newSimulatedCamera(c.format, uint32(c.width), uint32(c.height), 30)
+		first, err := cam.ReadFrame()
+		if err != nil {
+			t.Fatalf("%s %dx%d: %v", c.format, c.width, c.height, err)
+		}
+		second, _ := cam.ReadFrame()
+		if bytes.Equal(first, second) {
+			t.Errorf("%s %dx%d: two frames are the same; the pattern should move", c.format, c.width, c.height)
+		}
+		if c.format == "YUYV" {
+			if len(first) != c.width*c.height*2 {
+				t.Errorf("YUYV %dx%d: %d bytes, want %d", c.width, c.height, len(first), c.width*c.height*2)
+			}
+			// The first colour bar is white; the bottom row is clear of the
+			// timestamp and the moving square.
+			if y := first[(c.height-1)*c.width*2]; y < 230 {
+				t.Errorf("YUYV %dx%d: bottom-left luma %d, want white", c.width, c.height, y)
+			}
+			if b := yuyvToImage(first, c.width, c.height).Bounds(); b.Dx() != c.width || b.Dy() != c.height {
+				t.Errorf("YUYV %dx%d: decodes as %v", c.width, c.height, b)
+			}
+			continue
+		}
+		img, err := jpeg.Decode(bytes.NewReader(first))
+		if err != nil {
+			t.Fatalf("MJPEG %dx%d: not a JPEG: %v", c.width, c.height, err)
+		}
+		if b := img.Bounds(); b.Dx() != c.width || b.Dy() != c.height {
+			t.Errorf("MJPEG %dx%d: JPEG is %v", c.width, c.height, b)
+		}
+	}
+}
+
+func TestSimulatedCameraPacing(t *testing.T) {
+	const fps = 50
+	interval := time.Second / fps
+	cam := newSimulatedCamera("YUYV", 32, 24, fps)
+	read := func(n int) time.Duration {
+		t.Helper()
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if err := cam.WaitForFrame(1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cam.ReadFrame(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return time.Since(start)
+	}
+	// The first frame is ready at once, the other nine an interval apart.
+	if took := read(10); took < 9*interval-5*time.Millisecond || took > 9*interval+100*time.Millisecond {
+		t.Errorf("10 frames at %d fps took %v, want about %v", fps, took, 9*interval)
+	}
+	// A reader that falls behind gets the next frame now and the one after
+	// an interval later, not a burst to catch up.
+	time.Sleep(5 * interval)
+	if took := read(3); took < 2*interval-5*time.Millisecond || took > 2*interval+100*time.Millisecond {
+		t.Errorf("3 frames after a stall took %v, want about %v", took, 2*interval)
+	}
+
+	if cam := newSimulatedCamera("MJPEG", 32, 24, 0); cam.interval != time.Second/15 {
+		t.Errorf("FPS 0 paces frames %v apart, want the 15 fps default", cam.interval)
+	}
+}
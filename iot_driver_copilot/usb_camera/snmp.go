@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// --- SNMP ---
+// A minimal SNMPv2c agent for NOCs that monitor over SNMP. SNMP_LISTEN
+// (e.g. ":161") answers Get, GetNext and GetBulk for the read community
+// SNMP_COMMUNITY; Set gets noAccess, and v1/v3 requests or another
+// community are dropped. SNMP_TRAP_TARGETS receive SNMPv2-Trap
+// notifications when the camera goes offline (GET /status/all's "online":
+// device node present and capture healthy) and when it is back; the state
+// is checked every two seconds.
+//
+// Objects, under SNMP_BASE_OID (default 1.3.6.1.4.1.32473.2, under the
+// RFC 5612 documentation enterprise number; sites set their own):
+//
+//	sysDescr.0, sysObjectID.0, sysUpTime.0   the MIB-II system group
+//	BASE.1.1.0  online          INTEGER    1 or 2 (TruthValue)
+//	BASE.1.2.0  capturing       INTEGER    1 or 2
+//	BASE.1.3.0  captureHealthy  INTEGER    1 or 2
+//	BASE.1.4.0  devicePresent   INTEGER    1 or 2; always 1 for non-V4L2 backends
+//	BASE.1.5.0  lastFrameAge    TimeTicks  since a frame was last read (or since start)
+//	BASE.1.6.0  activeStreams   Gauge32
+//	BASE.1.7.0  backend         STRING
+//	BASE.1.8.0  detail          STRING     why the device is missing; empty otherwise
+//	BASE.2.1.0  framesCaptured  Counter64  since the driver started,
+//	BASE.2.2.0  captureErrors   Counter64  like the NAME_total metrics
+//	BASE.2.3.0  reconnects      Counter64
+//
+// Traps carry sysUpTime.0, snmpTrapOID.0 (BASE.0.1 cameraOffline or
+// BASE.0.2 cameraOnline), online, captureHealthy and detail.
+
+// snmpDefaultBaseOID is SNMP_BASE_OID's default.
+const snmpDefaultBaseOID = "1.3.6.1.4.1.32473.2"
+
+type SNMPConfig struct {
+	Listen      string   // SNMP_LISTEN
+	Community   string   // SNMP_COMMUNITY
+	TrapTargets []string // SNMP_TRAP_TARGETS
+	BaseOID     snmpOID  // SNMP_BASE_OID
+}
+
+var (
+	snmpConfig SNMPConfig
+	snmp       *snmpAgent // nil unless SNMP_LISTEN or SNMP_TRAP_TARGETS is set
+)
+
+// --- SNMP CONFIG ---
+func loadSNMPConfig() error {
+	snmpConfig = SNMPConfig{Listen: os.Getenv("SNMP_LISTEN"), Community: os.Getenv("SNMP_COMMUNITY")}
+	if snmpConfig.Community == "" {
+		snmpConfig.Community = "public"
+	}
+	var err error
+	if snmpConfig.TrapTargets, err = parseTrapTargets(os.Getenv("SNMP_TRAP_TARGETS")); err != nil {
+		return fmt.Errorf("SNMP_TRAP_TARGETS: %v", err)
+	}
+	base := os.Getenv("SNMP_BASE_OID")
+	if base == "" {
+		base = snmpDefaultBaseOID
+	}
+	if snmpConfig.BaseOID, err = parseOID(base); err != nil {
+		return fmt.Errorf("SNMP_BASE_OID: %v", err)
+	}
+	if snmpConfig.Listen != "" || len(snmpConfig.TrapTargets) > 0 {
+		snmp = newSNMPAgent("camera-driver "+buildVersion().Version, snmpConfig.Community, snmpConfig.TrapTargets, snmpConfig.BaseOID, log.Printf, cameraSNMPObjects(snmpConfig.BaseOID))
+	}
+	return nil
+}
+
+// --- camera objects ---
+
+func cameraSNMPObjects(base snmpOID) []snmpObject {
+	started := time.Now()
+	field := func(name string) interface{} { return cameraStatus()[name] }
+	truth := func(name string) func() snmpValue {
+		return func() snmpValue { return snmpTruth(field(name) == true) }
+	}
+	return []snmpObject{
+		{base.child(1, 1, 0), truth("online")},
+		{base.child(1, 2, 0), truth("capturing")},
+		{base.child(1, 3, 0), truth("capture_healthy")},
+		{base.child(1, 4, 0), truth("present")},
+		{base.child(1, 5, 0), func() snmpValue {
+			if last := lastFrameAt.Load(); last != 0 {
+				return snmpTicks(time.Since(time.Unix(0, last)))
+			}
+			return snmpTicks(time.Since(started))
+		}},
+		{base.child(1, 6, 0), func() snmpValue { return snmpGauge(uint64(activeStreams.Load())) }},
+		{base.child(1, 7, 0), func() snmpValue { return snmpString(captureBackend()) }},
+		{base.child(1, 8, 0), func() snmpValue { s, _ := field("error").(string); return snmpString(s) }},
+		{base.child(2, 1, 0), func() snmpValue { return snmpCounter(framesCaptured.Load()) }},
+		{base.child(2, 2, 0), func() snmpValue { return snmpCounter(captureErrors.Load()) }},
+		{base.child(2, 3, 0), func() snmpValue { return snmpCounter(sourceReopens.Load()) }},
+	}
+}
+
+// snmpWatch sends cameraOffline and cameraOnline traps on changes of the
+// camera's online state until ctx ends. An offline camera at startup traps
+// at once.
+func snmpWatch(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	prev := true
+	for {
+		cam := cameraStatus()
+		if online := cam["online"] == true; online != prev {
+			prev = online
+			trapOID := snmpConfig.BaseOID.child(0, 1)
+			if online {
+				trapOID = snmpConfig.BaseOID.child(0, 2)
+			}
+			detail, _ := cam["error"].(string)
+			snmp.trap(trapOID,
+				snmpVarBind{snmpConfig.BaseOID.child(1, 1, 0), snmpTruth(online)},
+				snmpVarBind{snmpConfig.BaseOID.child(1, 3, 0), snmpTruth(cam["capture_healthy"] == true)},
+				snmpVarBind{snmpConfig.BaseOID.child(1, 8, 0), snmpString(detail)})
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSNMPAgent(t *testing.T) {
+	savedCam, savedSNMP := cameraConfig, snmpConfig
+	defer func() { closeCamera(); cameraConfig, snmpConfig, snmp = savedCam, savedSNMP, nil }()
+	cameraConfig = CameraConfig{DevicePath: "/dev/video-missing", Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	trapConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trapConn.Close()
+	t.Setenv("SNMP_LISTEN", "127.0.0.1:0")
+	t.Setenv("SNMP_COMMUNITY", "noc")
+	t.Setenv("SNMP_TRAP_TARGETS", trapConn.LocalAddr().String())
+	t.Setenv("SNMP_BASE_OID", "")
+	if err := loadSNMPConfig(); err != nil {
+		t.Fatal(err)
+	}
+	base := snmpConfig.BaseOID
+	framesCaptured.Store(7)
+
+	// A walk of the camera subtree: every object, in order.
+	var walked []snmpOID
+	for oid := base.child(1); ; {
+		resp := snmp.handle(encodeSNMPMessage("noc", pduGetNextRequest, 1, 0, 0, []snmpVarBind{{oid, snmpValue{berNull, nil}}}))
+		req, err := decodeSNMPRequest(resp)
+		if err != nil || req.pduType != pduResponse || len(req.oids) != 1 {
+			t.Fatalf("GetNext %s: %x %v", oid, resp, err)
+		}
+		// endOfMibView repeats the OID asked for.
+		if next := req.oids[0]; next.compare(oid) <= 0 || next.compare(base.child(3)) >= 0 {
+			break
+		}
+		oid = req.oids[0]
+		walked = append(walked, oid)
+	}
+	if len(walked) != 11 || walked[0].String() != "1.3.6.1.4.1.32473.2.1.1.0" || walked[10].String() != "1.3.6.1.4.1.32473.2.2.3.0" {
+		t.Fatalf("walk = %v", walked)
+	}
+
+	get := func(oid snmpOID) []byte {
+		return snmp.handle(encodeSNMPMessage("noc", pduGetRequest, 2, 0, 0, []snmpVarBind{{oid, snmpValue{berNull, nil}}}))
+	}
+	if resp := get(base.child(1, 1, 0)); !bytes.Contains(resp, snmpTruth(true).encode()) {
+		t.Errorf("online = %x", resp)
+	}
+	if resp := get(base.child(1, 7, 0)); !bytes.Contains(resp, snmpString("simulate").encode()) {
+		t.Errorf("backend = %x", resp)
+	}
+	if resp := get(base.child(2, 1, 0)); !bytes.HasSuffix(resp, snmpCounter(7).encode()) {
+		t.Errorf("framesCaptured = %x", resp)
+	}
+	if resp := snmp.handle(encodeSNMPMessage("public", pduGetRequest, 3, 0, 0, []snmpVarBind{{base.child(1, 1, 0), snmpValue{berNull, nil}}})); resp != nil {
+		t.Errorf("wrong community answered: %x", resp)
+	}
+
+	// A camera that is offline (its V4L2 device node is missing) traps once.
+	cameraConfig.Simulate, cameraConfig.Backend = false, "v4l2"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go snmpWatch(ctx, 20*time.Millisecond)
+	trapConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := trapConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no trap: %v", err)
+	}
+	trap, err := decodeSNMPRequest(buf[:n])
+	if err != nil || trap.pduType != pduSNMPv2Trap || len(trap.oids) != 5 || trap.oids[1].compare(oidSnmpTrapOID) != 0 {
+		t.Fatalf("trap = %+v %v", trap, err)
+	}
+	if !bytes.Contains(buf[:n], snmpValue{berOID, base.child(0, 1)}.encode()) {
+		t.Errorf("trap is not cameraOffline: %x", buf[:n])
+	}
+	trapConn.SetReadDeadline(time.Now().Add(150 * time.Millisecond))
+	if _, _, err := trapConn.ReadFrom(buf); err == nil {
+		t.Error("offline trapped twice")
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSNMPAgentCopiesMatch keeps snmpagent.go the same in both drivers.
+// This test file is itself the same in both.
+func TestSNMPAgentCopiesMatch(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := map[string]string{"modbus_display": "usb_camera", "usb_camera": "modbus_display"}[filepath.Base(wd)]
+	if other == "" {
+		t.Skipf("%s is not one of the drivers", wd)
+	}
+	if _, err := os.Stat(filepath.Join("..", other)); err != nil {
+		t.Skipf("no %s driver next to this one: %v", other, err)
+	}
+	for _, name := range []string{"snmpagent.go", "snmpagent_test.go"} {
+		ours, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		theirs, err := os.ReadFile(filepath.Join("..", other, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ours, theirs) {
+			t.Errorf("%s differs from ../%s/%s; change both copies together", name, other, name)
+		}
+	}
+}
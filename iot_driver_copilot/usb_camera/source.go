@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blackjack/webcam"
+)
+
+// FrameSource is a capture backend. WaitForFrame blocks until a frame is
+// ready (returning *webcam.Timeout after timeout seconds), ReadFrame returns
+// it in the format reported by sourceInfo.
+type FrameSource interface {
+	WaitForFrame(timeout uint32) error
+	ReadFrame() ([]byte, error)
+	StopStreaming() error
+	Close() error
+}
+
+// sourceInfo describes what a backend actually negotiated.
+type sourceInfo struct {
+	Format string // "MJPEG" or "YUYV"
+	Width  uint32
+	Height uint32
+	FPS    uint32
+}
+
+// --- BACKEND SELECTION ---
+// CAPTURE_BACKEND selects the backend:
+//
+//	webcam    - V4L2 through github.com/blackjack/webcam (default)
+//	v4l2      - V4L2 through direct ioctls and mmap'd buffers
+//	simulate  - synthetic test pattern (same as SIMULATE=true)
+//	gstreamer - JPEG frames from a gst-launch-1.0 pipeline (GST_PIPELINE)
+//	file      - playback of CAPTURE_URL: an MJPEG file natively, anything else
+//	            (RTSP URL, MP4, AVI...) transcoded through ffmpeg
+//
+// Frame timeouts are counted for capture recovery (recovery.go). Frames
+// pass through lens correction (calibration.go), the barcode scanner
+// (barcode.go), the gauge reader (gauge.go) and annotations (annotations.go)
+// on the way out, and are kept for clips (clip.go). Their times are noted
+// for /sync/status (sync.go).
+func openFrameSource(cfg CameraConfig) (FrameSource, sourceInfo, error) {
+	src, info, err := openBackend(cfg)
+	if err != nil {
+		return nil, sourceInfo{}, err
+	}
+	src = &timeoutWatch{FrameSource: src}
+	src = &syncTap{FrameSource: src, info: info}
+	src = &undistortSource{FrameSource: src, info: info}
+	src = &barcodeTap{FrameSource: src, info: info}
+	src = &gaugeTap{FrameSource: src, info: info}
+	src = &annotateSource{FrameSource: src, info: info}
+	return &clipTap{FrameSource: src, info: info}, info, nil
+}
+
+func openBackend(cfg CameraConfig) (FrameSource, sourceInfo, error) {
+	if err := validateFrameConfig(cfg); err != nil {
+		return nil, sourceInfo{}, err
+	}
+	backend := cfg.Backend
+	if cfg.Simulate {
+		backend = "simulate"
+	}
+	if backend == "" || backend == "webcam" || backend == "v4l2" {
+		path, err := resolveDevicePath(cfg)
+		if err != nil {
+			return nil, sourceInfo{}, err
+		}
+		cfg.DevicePath = path
+	}
+	switch backend {
+	case "", "webcam":
+		return openWebcamSource(cfg)
+	case "v4l2":
+		return openV4L2Source(cfg)
+	case "simulate":
+		if cfg.Format != "MJPEG" && cfg.Format != "YUYV" {
+			return nil, sourceInfo{}, errors.New("unsupported camera format")
+		}
+		info := sourceInfo{Format: cfg.Format, Width: cfg.Width, Height: cfg.Height, FPS: cfg.FPS}
+		genlockStart()
+		return newSimulatedCamera(cfg.Format, cfg.Width, cfg.Height, cfg.FPS), info, nil
+	case "gstreamer":
+		return openGStreamerSource(cfg)
+	case "file", "rtsp":
+		return openPlaybackSource(cfg)
+	default:
+		return nil, sourceInfo{}, fmt.Errorf("unknown CAPTURE_BACKEND %q", backend)
+	}
+}
+
+// Upper bounds for requested frame parameters (8K at 240 fps); anything
+// larger is a typo, and the simulator would try to allocate it.
+const (
+	maxFrameWidth  = 7680
+	maxFrameHeight = 4320
+	maxFrameRate   = 240
+)
+
+func validateFrameConfig(cfg CameraConfig) error {
+	if cfg.Width == 0 || cfg.Width > maxFrameWidth || cfg.Height == 0 || cfg.Height > maxFrameHeight {
+		return fmt.Errorf("invalid resolution %dx%d (max %dx%d)", cfg.Width, cfg.Height, maxFrameWidth, maxFrameHeight)
+	}
+	if cfg.FPS == 0 || cfg.FPS > maxFrameRate {
+		return fmt.Errorf("invalid fps %d (1..%d)", cfg.FPS, maxFrameRate)
+	}
+	return nil
+}
+
+// --- WEBCAM BACKEND ---
+func openWebcamSource(cfg CameraConfig) (FrameSource, sourceInfo, error) {
+	cam, err := webcam.Open(cfg.DevicePath)
+	if err != nil {
+		return nil, sourceInfo{}, err
+	}
+	formatDesc := cam.GetSupportedFormats()
+	var pixFmt webcam.PixelFormat
+	for k, v := range formatDesc {
+		if (cfg.Format == "MJPEG" && strings.Contains(v, "MJPEG")) ||
+			(cfg.Format == "YUYV" && strings.Contains(v, "YUYV")) {
+			pixFmt = k
+			break
+		}
+	}
+	if pixFmt == 0 {
+		cam.Close()
+		return nil, sourceInfo{}, errors.New("unsupported camera format")
+	}
+	width, height, fps, err := selectFrameSizeAndFPS(cam, pixFmt, cfg)
+	if err != nil {
+		cam.Close()
+		return nil, sourceInfo{}, err
+	}
+	_, _, _, err = cam.SetImageFormat(pixFmt, width, height)
+	if err != nil {
+		cam.Close()
+		return nil, sourceInfo{}, err
+	}
+	err = cam.SetFramerate(float32(fps))
+	if err != nil {
+		cam.Close()
+		return nil, sourceInfo{}, err
+	}
+	genlockStart()
+	if err := cam.StartStreaming(); err != nil {
+		cam.Close()
+		return nil, sourceInfo{}, err
+	}
+	return &webcamSource{Webcam: cam, pool: newFramePool(0)}, sourceInfo{Format: cfg.Format, Width: width, Height: height, FPS: fps}, nil
+}
+
+// webcamSource copies frames out of the library's buffers (see framebuf.go).
+type webcamSource struct {
+	*webcam.Webcam
+	pool *framePool
+}
+
+func (s *webcamSource) ReadFrame() ([]byte, error) {
+	mem, index, err := s.GetFrame()
+	if err != nil {
+		return nil, err
+	}
+	if len(mem) == 0 {
+		return nil, s.ReleaseFrame(index)
+	}
+	frame := s.pool.copyFrame(mem)
+	return frame, s.ReleaseFrame(index)
+}
+
+func (s *webcamSource) Close() error {
+	s.pool.close()
+	return s.Webcam.Close()
+}
+
+// --- PIPE / PLAYBACK BACKENDS ---
+
+// jpegStreamSource splits a byte stream of concatenated JPEG images (as
+// produced by `jpegenc ! fdsink` or `ffmpeg -f mjpeg`) into frames. Only the
+// newest frame is kept so slow readers always see live video.
+type jpegStreamSource struct {
+	open     func() (io.ReadCloser, error) // (re)opens the stream
+	loop     bool                          // reopen at EOF instead of stopping
+	interval time.Duration                 // pacing between frames, 0 = as fast as produced
+
+	done chan struct{}
+	once sync.Once
+
+	mu     sync.Mutex
+	rc     io.ReadCloser
+	latest []byte
+	ready  chan struct{} // closed when latest is replaced
+	err    error
+}
+
+func newJPEGStreamSource(open func() (io.ReadCloser, error), loop bool, interval time.Duration) (*jpegStreamSource, error) {
+	rc, err := open()
+	if err != nil {
+		return nil, err
+	}
+	s := &jpegStreamSource{open: open, loop: loop, interval: interval, done: make(chan struct{}), ready: make(chan struct{}), rc: rc}
+	go s.run(rc)
+	return s, nil
+}
+
+// Reopen pacing for looping sources. A run that yields no frames at all
+// (RTSP server down, empty file) backs off, and after maxEmptyRuns in a row
+// the source gives up instead of spinning. Variables so tests can shorten them.
+var (
+	reopenBackoffMin = 500 * time.Millisecond
+	reopenBackoffMax = 30 * time.Second
+	maxEmptyRuns     = 8
+)
+
+func (s *jpegStreamSource) run(rc io.ReadCloser) {
+	backoff := reopenBackoffMin
+	empty := 0
+	var err error // why the last run ended
+	for {
+		frames := 0
+		if rc != nil {
+			err = splitJPEGs(bufio.NewReaderSize(rc, 256*1024), func(frame []byte) bool {
+				if s.interval > 0 {
+					select {
+					case <-time.After(s.interval):
+					case <-s.done:
+						return false
+					}
+				}
+				frames++
+				s.mu.Lock()
+				s.latest = frame
+				close(s.ready)
+				s.ready = make(chan struct{})
+				s.mu.Unlock()
+				return true
+			})
+			rc.Close()
+		}
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		if !s.loop {
+			s.fail(fmt.Errorf("capture stream ended: %v", err))
+			return
+		}
+		if frames > 0 {
+			backoff, empty = reopenBackoffMin, 0
+		} else {
+			empty++
+			if empty >= maxEmptyRuns {
+				s.fail(fmt.Errorf("capture stream produced no frames in %d attempts: %v", empty, err))
+				return
+			}
+			log.Printf("capture stream produced no frames (%v), reopening in %v", err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.done:
+				return
+			}
+			if backoff *= 2; backoff > reopenBackoffMax {
+				backoff = reopenBackoffMax
+			}
+		}
+		next, oerr := s.open()
+		if oerr != nil {
+			// Retried with backoff like an empty run.
+			err, next = oerr, nil
+		}
+		s.mu.Lock()
+		select {
+		case <-s.done: // Close ran while we were reopening
+			s.mu.Unlock()
+			if next != nil {
+				next.Close()
+			}
+			return
+		default:
+		}
+		s.rc = next
+		s.mu.Unlock()
+		if _, file := next.(*os.File); next != nil && !file {
+			sourceReopens.Add(1) // a network stream reconnecting, not a file looping
+		}
+		rc = next
+	}
+}
+
+func (s *jpegStreamSource) fail(err error) {
+	s.mu.Lock()
+	s.err = err
+	close(s.ready)
+	s.ready = make(chan struct{})
+	s.mu.Unlock()
+	log.Printf("capture source stopped: %v", err)
+}
+
+// maxJPEGFrame bounds a single frame so a corrupt stream without EOI can't
+// grow the buffer without limit.
+const maxJPEGFrame = 32 << 20
+
+var errBadJPEG = errors.New("malformed JPEG")
+
+// splitJPEGs scans r for SOI markers and hands each complete image to emit
+// until emit returns false or the stream ends. Malformed images are skipped.
+func splitJPEGs(r *bufio.Reader, emit func([]byte) bool) error {
+	var prev byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if prev != 0xFF || b != 0xD8 {
+			prev = b
+			continue
+		}
+		prev = 0
+		frame, err := readJPEG(r)
+		if err == errBadJPEG {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !emit(frame) {
+			return nil
+		}
+	}
+}
+
+// readJPEG reads the rest of an image whose SOI has just been consumed.
+// Marker segments are skipped by their length, so an EXIF thumbnail (with
+// its own SOI/EOI) inside APP1 does not end the frame early; only the EOI
+// after the entropy-coded data does.
+func readJPEG(r *bufio.Reader) ([]byte, error) {
+	buf := []byte{0xFF, 0xD8}
+	var code byte
+	haveCode := false
+	for len(buf) < maxJPEGFrame {
+		if !haveCode {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b != 0xFF {
+				return nil, errBadJPEG
+			}
+			for code = 0xFF; code == 0xFF; { // skip fill bytes
+				if code, err = r.ReadByte(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		haveCode = false
+		buf = append(buf, 0xFF, code)
+		switch {
+		case code == 0xD9:
+			return buf, nil
+		case code == 0x01 || code >= 0xD0 && code <= 0xD7: // standalone markers
+			continue
+		case code == 0x00 || code == 0xD8:
+			return nil, errBadJPEG
+		}
+		var hdr [2]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, err
+		}
+		n := int(hdr[0])<<8 | int(hdr[1])
+		if n < 2 {
+			return nil, errBadJPEG
+		}
+		buf = append(buf, hdr[0], hdr[1])
+		buf = append(buf, make([]byte, n-2)...)
+		if _, err := io.ReadFull(r, buf[len(buf)-(n-2):]); err != nil {
+			return nil, err
+		}
+		if code != 0xDA {
+			continue
+		}
+		// Entropy-coded scan data: 0xFF is followed by a stuffed 0x00 or a
+		// restart marker; anything else is the next marker (EOI, or the
+		// tables before another scan of a progressive image).
+		for !haveCode && len(buf) < maxJPEGFrame {
+			c, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if c != 0xFF {
+				buf = append(buf, c)
+				continue
+			}
+			next, err := r.ReadByte()
+			for err == nil && next == 0xFF {
+				next, err = r.ReadByte()
+			}
+			if err != nil {
+				return nil, err
+			}
+			if next == 0x00 || next >= 0xD0 && next <= 0xD7 {
+				buf = append(buf, 0xFF, next)
+				continue
+			}
+			code, haveCode = next, true
+		}
+	}
+	return nil, errBadJPEG
+}
+
+func (s *jpegStreamSource) WaitForFrame(timeout uint32) error {
+	s.mu.Lock()
+	if s.latest != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.err != nil {
+		err := s.err
+		s.mu.Unlock()
+		return err
+	}
+	ready := s.ready
+	s.mu.Unlock()
+	select {
+	case <-ready:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.latest == nil && s.err != nil {
+			return s.err
+		}
+		return nil
+	case <-time.After(time.Duration(timeout) * time.Second):
+		return new(webcam.Timeout)
+	case <-s.done:
+		return errors.New("capture source closed")
+	}
+}
+
+func (s *jpegStreamSource) ReadFrame() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.latest
+	s.latest = nil
+	return f, nil
+}
+
+func (s *jpegStreamSource) StopStreaming() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *jpegStreamSource) Close() error {
+	s.StopStreaming()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rc != nil {
+		return s.rc.Close()
+	}
+	return nil
+}
+
+// cmdReadCloser is a subprocess's stdout that kills the process on Close.
+type cmdReadCloser struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	once sync.Once
+	err  error
+}
+
+func (c *cmdReadCloser) Close() error {
+	c.once.Do(func() {
+		_ = c.ReadCloser.Close()
+		if c.cmd.Process != nil {
+			_ = c.cmd.Process.Kill()
+		}
+		c.err = c.cmd.Wait()
+	})
+	return c.err
+}
+
+func startCommand(name string, args ...string) (io.ReadCloser, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %s: %w", name, err)
+	}
+	return &cmdReadCloser{ReadCloser: out, cmd: cmd}, nil
+}
+
+// openGStreamerSource runs GST_PIPELINE through gst-launch-1.0. The pipeline
+// should produce raw video; JPEG encoding and the stdout sink are appended
+// unless the pipeline already ends in an fdsink.
+func openGStreamerSource(cfg CameraConfig) (FrameSource, sourceInfo, error) {
+	pipeline := strings.TrimSpace(cfg.GstPipeline)
+	if pipeline == "" {
+		return nil, sourceInfo{}, errors.New("GST_PIPELINE is required for the gstreamer backend")
+	}
+	if !strings.Contains(pipeline, "fdsink") {
+		pipeline += fmt.Sprintf(" ! videoconvert ! videoscale ! video/x-raw,width=%d,height=%d ! jpegenc ! fdsink fd=1", cfg.Width, cfg.Height)
+	}
+	src, err := newJPEGStreamSource(func() (io.ReadCloser, error) {
+		return startCommand("gst-launch-1.0", "-q", pipeline)
+	}, false, 0)
+	if err != nil {
+		return nil, sourceInfo{}, err
+	}
+	return src, sourceInfo{Format: "MJPEG", Width: cfg.Width, Height: cfg.Height, FPS: cfg.FPS}, nil
+}
+
+// openPlaybackSource plays CAPTURE_URL. Plain MJPEG files are read directly
+// and looped at CAMERA_FPS; other files and network streams go through ffmpeg.
+func openPlaybackSource(cfg CameraConfig) (FrameSource, sourceInfo, error) {
+	url := cfg.CaptureURL
+	if url == "" {
+		return nil, sourceInfo{}, errors.New("CAPTURE_URL is required for the file backend")
+	}
+	info := sourceInfo{Format: "MJPEG", Width: cfg.Width, Height: cfg.Height, FPS: cfg.FPS}
+	interval := time.Duration(0)
+	if cfg.FPS > 0 {
+		interval = time.Second / time.Duration(cfg.FPS)
+	}
+	ext := strings.ToLower(filepath.Ext(url))
+	if !strings.Contains(url, "://") && (ext == ".mjpeg" || ext == ".mjpg") {
+		src, err := newJPEGStreamSource(func() (io.ReadCloser, error) { return os.Open(url) }, true, interval)
+		return src, info, err
+	}
+	args := []string{"-loglevel", "error"}
+	live := strings.Contains(url, "://")
+	if live {
+		if strings.HasPrefix(url, "rtsp://") {
+			args = append(args, "-rtsp_transport", "tcp")
+		}
+	} else {
+		args = append(args, "-re", "-stream_loop", "-1")
+	}
+	args = append(args, "-i", url,
+		"-vf", fmt.Sprintf("fps=%d,scale=%d:%d", cfg.FPS, cfg.Width, cfg.Height),
+		"-f", "mjpeg", "-q:v", "5", "pipe:1")
+	src, err := newJPEGStreamSource(func() (io.ReadCloser, error) { return startCommand("ffmpeg", args...) }, live, 0)
+	return src, info, err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withThumbnail inserts an APP1 segment carrying thumb right after the SOI
+// of frame, the way cameras embed an EXIF preview.
+func withThumbnail(frame, thumb []byte) []byte {
+	payload := append([]byte("Exif\x00\x00"), thumb...)
+	n := len(payload) + 2
+	out := append([]byte{}, frame[:2]...)
+	out = append(out, 0xFF, 0xE1, byte(n>>8), byte(n))
+	out = append(out, payload...)
+	return append(out, frame[2:]...)
+}
+
+func TestSplitJPEGs(t *testing.T) {
+	a := encodeTestJPEG(t)
+	var small bytes.Buffer
+	if err := jpeg.Encode(&small, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := withThumbnail(a, small.Bytes())
+	c := stripDHT(t, a)
+
+	var stream bytes.Buffer
+	stream.WriteString("--boundary\r\n")
+	stream.Write(a)
+	stream.Write(b)
+	stream.WriteString("\r\njunk\xff")
+	stream.Write(c)
+	stream.Write(a[:len(a)/2]) // truncated final frame
+
+	var got [][]byte
+	err := splitJPEGs(bufio.NewReader(&stream), func(f []byte) bool {
+		got = append(got, f)
+		return true
+	})
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		t.Fatalf("err = %v, want EOF", err)
+	}
+	want := [][]byte{a, b, c}
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("frame %d: %d bytes, want %d", i, len(got[i]), len(want[i]))
+		}
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(got[1])); err != nil {
+		t.Errorf("frame with thumbnail does not decode: %v", err)
+	}
+
+	// emit returning false stops the scan.
+	n := 0
+	err = splitJPEGs(bufio.NewReader(bytes.NewReader(append(a, a...))), func([]byte) bool { n++; return false })
+	if err != nil || n != 1 {
+		t.Fatalf("stop after first frame: n=%d err=%v", n, err)
+	}
+}
+
+func TestJPEGStreamSourceGivesUpWithoutFrames(t *testing.T) {
+	defer func(min, max time.Duration, runs int) {
+		reopenBackoffMin, reopenBackoffMax, maxEmptyRuns = min, max, runs
+	}(reopenBackoffMin, reopenBackoffMax, maxEmptyRuns)
+	reopenBackoffMin, reopenBackoffMax, maxEmptyRuns = time.Millisecond, 4*time.Millisecond, 4
+
+	var opens int32
+	src, err := newJPEGStreamSource(func() (io.ReadCloser, error) {
+		atomic.AddInt32(&opens, 1)
+		return io.NopCloser(strings.NewReader("")), nil
+	}, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	err = src.WaitForFrame(2)
+	if err == nil || !strings.Contains(err.Error(), "no frames") {
+		t.Fatalf("WaitForFrame = %v, want a no-frames error", err)
+	}
+	if n := atomic.LoadInt32(&opens); n != 4 {
+		t.Fatalf("stream opened %d times, want 4", n)
+	}
+}
+
+func TestJPEGStreamSourceLoops(t *testing.T) {
+	frame := encodeTestJPEG(t)
+	var opens int32
+	src, err := newJPEGStreamSource(func() (io.ReadCloser, error) {
+		atomic.AddInt32(&opens, 1)
+		return io.NopCloser(bytes.NewReader(frame)), nil
+	}, true, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&opens) < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := src.WaitForFrame(1); err != nil {
+		t.Fatalf("WaitForFrame: %v", err)
+	}
+	if n := atomic.LoadInt32(&opens); n < 5 {
+		t.Fatalf("a one-frame file was reopened only %d times", n)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// --- STATE FILES ---
+// The calibration profile, capture state and regions of interest are saved
+// as state files: the new contents go to a temporary file that is synced
+// and renamed over the old one, which is kept as NAME.bak, and the
+// directory is synced after.
+// Each file records a SHA-256 of its payload. On load a file that does not
+// parse or match its checksum is renamed to NAME.corrupt and the backup is
+// used, so a power cut at any point costs at most the latest change.
+//
+// STATE_DIR supplies default locations: CALIBRATION_FILE,
+// CAPTURE_STATE_FILE and ROI_FILE fall back to calibration.json,
+// capture_state.json and rois.json in it.
+
+type stateEnvelope struct {
+	Checksum string          `json:"checksum"` // "sha256:" + hex of data
+	Saved    time.Time       `json:"saved"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// stateFilePath returns the file named by env, or name in STATE_DIR.
+func stateFilePath(env, name string) string {
+	if p := os.Getenv(env); p != "" {
+		return p
+	}
+	if dir := os.Getenv("STATE_DIR"); dir != "" {
+		return filepath.Join(dir, name)
+	}
+	return ""
+}
+
+func stateChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// saveState replaces path with v, keeping the previous contents as the backup.
+func saveState(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b, _ := json.Marshal(stateEnvelope{Checksum: stateChecksum(data), Saved: time.Now().UTC(), Data: data})
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(path, path+".bak"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return writeFileAtomic(path, append(b, '\n'))
+}
+
+// loadState reads path into v, falling back to the backup when the file is
+// missing or corrupt. It returns os.ErrNotExist when neither holds usable
+// state.
+func loadState(path string, v interface{}) error {
+	for _, p := range []string{path, path + ".bak"} {
+		b, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := decodeState(b, v); err != nil {
+			log.Printf("State file %s is corrupt (%v), moved to %s", p, err, p+".corrupt")
+			if err := os.Rename(p, p+".corrupt"); err != nil {
+				return err
+			}
+			continue
+		}
+		if p != path {
+			log.Printf("State file %s unusable, restoring from %s", path, p)
+			if err := writeFileAtomic(path, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return os.ErrNotExist
+}
+
+// removeState deletes path and its backup.
+func removeState(path string) error {
+	for _, p := range []string{path, path + ".bak"} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// decodeState checks and unwraps an envelope. Files from before state files
+// had one hold the bare JSON value and are read as they are.
+func decodeState(b []byte, v interface{}) error {
+	var env stateEnvelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return err
+	}
+	if env.Checksum == "" {
+		return json.Unmarshal(b, v)
+	}
+	if got := stateChecksum(env.Data); got != env.Checksum {
+		return fmt.Errorf("checksum mismatch: %s, recorded %s", got, env.Checksum)
+	}
+	return json.Unmarshal(env.Data, v)
+}
+
+// syncDir makes a rename or removal in dir survive a power cut.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
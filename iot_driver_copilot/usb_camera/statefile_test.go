@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStateFileRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture_state.json")
+	for _, fps := range []uint32{10, 15} {
+		if err := saveState(path, captureState{Running: true, Format: "MJPEG", FPS: fps}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var st captureState
+	if err := loadState(path, &st); err != nil || st.FPS != 15 {
+		t.Fatalf("loaded %+v, %v", st, err)
+	}
+
+	// A torn write of the latest save: the one before it is used.
+	b, _ := os.ReadFile(path)
+	os.WriteFile(path, b[:len(b)/2], 0o644)
+	st = captureState{}
+	if err := loadState(path, &st); err != nil || st.FPS != 10 {
+		t.Fatalf("after a torn write loaded %+v, %v", st, err)
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Errorf("corrupt file not kept: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file not restored from the backup: %v", err)
+	}
+
+	// A changed payload no longer matches its checksum.
+	b, _ = os.ReadFile(path)
+	os.WriteFile(path, []byte(strings.Replace(string(b), `"fps":10`, `"fps":99`, 1)), 0o644)
+	os.Remove(path + ".bak")
+	if err := loadState(path, &st); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("checksum mismatch: err = %v", err)
+	}
+
+	// Files written before the envelope still load.
+	os.WriteFile(path, []byte(`{"running": true, "format": "YUYV", "fps": 5}`), 0o644)
+	if err := loadState(path, &st); err != nil || st.Format != "YUYV" || st.FPS != 5 {
+		t.Errorf("legacy file: %+v, %v", st, err)
+	}
+
+	if err := removeState(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file after remove: %v", err)
+	}
+}
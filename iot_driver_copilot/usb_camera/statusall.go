@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"os"
+)
+
+// --- FLEET STATUS ---
+// GET /status/all answers with this driver's health (as GET /healthz) and
+// a "devices" list, so dashboards polling many drivers make one request
+// per driver. The driver runs one camera, so the list has one entry: its
+// source, whether a V4L2 device node is present, the capture settings and
+// whether capture is healthy. The shape leaves room for more cameras.
+
+// captureBackend names the backend openFrameSource uses.
+func captureBackend() string {
+	if cameraConfig.Simulate {
+		return "simulate"
+	}
+	if cameraConfig.Backend == "" {
+		return "webcam"
+	}
+	return cameraConfig.Backend
+}
+
+func cameraStatus() map[string]interface{} {
+	backend := captureBackend()
+	entry := map[string]interface{}{"id": cameraConfig.deviceID(), "backend": backend}
+	present := true
+	if backend == "webcam" || backend == "v4l2" {
+		path, err := resolveDevicePath(cameraConfig)
+		if err == nil {
+			_, err = os.Stat(path)
+			entry["node"] = path
+		}
+		present = err == nil
+		if err != nil {
+			entry["error"] = err.Error()
+		}
+	}
+	healthy := captureHealthy()
+	cameraState.mu.Lock()
+	entry["capturing"] = cameraState.running
+	if cameraState.running {
+		entry["format"], entry["width"], entry["height"], entry["fps"] = cameraState.formatStr, cameraState.width, cameraState.height, cameraState.fps
+	}
+	cameraState.mu.Unlock()
+	entry["present"], entry["capture_healthy"], entry["streams"] = present, healthy, activeStreams.Load()
+	entry["online"] = present && healthy
+	return entry
+}
+
+func handleStatusAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	status, clock, cam := fleetStatus()
+	if kind := statusMediaType(r.Header.Get("Accept")); kind != "json" {
+		writeStatusXML(w, newCameraStatusXML(status, clock, cam), kind == "soap")
+		return
+	}
+	online := 0
+	if cam["online"] == true {
+		online = 1
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"status": status, "clock": clock, "online": online, "total": 1, "devices": []interface{}{cam},
+	})
+}
+
+// fleetStatus is the overall status ("ok" or "degraded"), the clock health
+// and this camera's entry.
+func fleetStatus() (string, map[string]interface{}, map[string]interface{}) {
+	clock, ok := clockHealth()
+	cam := cameraStatus()
+	if !ok || cam["capture_healthy"] != true {
+		return "degraded", clock, cam
+	}
+	return "ok", clock, cam
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusAll(t *testing.T) {
+	savedCam := cameraConfig
+	defer func() { closeCamera(); cameraConfig = savedCam }()
+	cameraConfig = CameraConfig{DevicePath: "/dev/video-missing", Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	err := openCamera()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	handleStatusAll(rec, httptest.NewRequest(http.MethodGet, "/status/all", nil))
+	var body struct {
+		Status  string                   `json:"status"`
+		Online  int                      `json:"online"`
+		Devices []map[string]interface{} `json:"devices"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /status/all = %d %s", rec.Code, rec.Body)
+	}
+	if body.Status != "ok" || body.Online != 1 || len(body.Devices) != 1 {
+		t.Fatalf("body = %s", rec.Body)
+	}
+	cam := body.Devices[0]
+	if cam["backend"] != "simulate" || cam["capturing"] != true || cam["format"] != "MJPEG" || cam["width"] != 64.0 || cam["online"] != true {
+		t.Errorf("camera = %v", cam)
+	}
+
+	// The same status as XML, by Accept or /status.xml, and inside SOAP.
+	for _, tc := range []struct {
+		h            http.HandlerFunc
+		path, accept string
+	}{
+		{handleStatusAll, "/status/all", "application/json;q=0.9, application/xml"},
+		{handleStatusXML, "/status.xml", ""},
+		{handleStatusXML, "/status.xml", "application/soap+xml"},
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set("Accept", tc.accept)
+		tc.h(rec, req)
+		var doc cameraStatusXML
+		if tc.accept == "application/soap+xml" {
+			var env struct {
+				Body struct {
+					Status cameraStatusXML `xml:"camera_status"`
+				}
+			}
+			err = xml.Unmarshal(rec.Body.Bytes(), &env)
+			doc = env.Body.Status
+		} else {
+			err = xml.Unmarshal(rec.Body.Bytes(), &doc)
+		}
+		if err != nil || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/") || !strings.Contains(rec.Header().Get("Content-Type"), "xml") {
+			t.Fatalf("%s (Accept %q): %v %s\n%s", tc.path, tc.accept, err, rec.Header().Get("Content-Type"), rec.Body)
+		}
+		if doc.Status != "ok" || doc.Backend != "simulate" || doc.Capturing != "true" || doc.Width != "64" || doc.Error != "" || doc.Clock.Source != "system" {
+			t.Errorf("%s (Accept %q) = %+v", tc.path, tc.accept, doc)
+		}
+	}
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/status/all", nil)
+	req.Header.Set("Accept", "*/*")
+	handleStatusAll(rec, req)
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Accept */*: Content-Type %q", ct)
+	}
+
+	// A V4L2 camera whose device node is gone is offline.
+	closeCamera()
+	cameraConfig.Simulate = false
+	rec = httptest.NewRecorder()
+	handleStatusAll(rec, httptest.NewRequest(http.MethodGet, "/status/all", nil))
+	body.Devices = nil
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	if cam := body.Devices[0]; body.Online != 0 || cam["present"] != false || cam["error"] == nil || cam["capturing"] != false {
+		t.Errorf("without the device: %s", rec.Body)
+	}
+}
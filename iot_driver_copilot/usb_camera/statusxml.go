@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- XML STATUS ---
+// Building-management systems that only take XML can read the camera's
+// status from GET /status.xml, or from GET /status/all with
+// "Accept: application/xml" (or text/xml):
+//
+//	<camera_status xmlns="urn:camera-driver:status:1" status="ok">
+//	  <id>/dev/video0</id>
+//	  <backend>webcam</backend>
+//	  <present>true</present>
+//	  <online>true</online>
+//	  <capturing>true</capturing>
+//	  <capture_healthy>true</capture_healthy>
+//	  <streams>1</streams>
+//	  <format>MJPEG</format><width>640</width><height>480</height><fps>30</fps>
+//	  <clock source="ntp" ok="true"><server>pool.ntp.org</server><skew_ms>-2.5</skew_ms></clock>
+//	</camera_status>
+//
+// Elements carry the JSON names and always come in this order. format,
+// width, height and fps appear only while capturing; error only when the
+// device node is missing. RESPONSE_* shaping does not apply.
+// "Accept: application/soap+xml" returns the document as the Body of a
+// SOAP 1.2 Envelope.
+
+type cameraStatusXML struct {
+	XMLName        xml.Name       `xml:"urn:camera-driver:status:1 camera_status"`
+	Status         string         `xml:"status,attr"`
+	ID             string         `xml:"id"`
+	Backend        string         `xml:"backend"`
+	Present        string         `xml:"present"`
+	Online         string         `xml:"online"`
+	Capturing      string         `xml:"capturing"`
+	CaptureHealthy string         `xml:"capture_healthy"`
+	Streams        string         `xml:"streams"`
+	Format         string         `xml:"format,omitempty"`
+	Width          string         `xml:"width,omitempty"`
+	Height         string         `xml:"height,omitempty"`
+	FPS            string         `xml:"fps,omitempty"`
+	Error          string         `xml:"error,omitempty"`
+	Clock          clockStatusXML `xml:"clock"`
+}
+
+type clockStatusXML struct {
+	Source string `xml:"source,attr"`
+	OK     string `xml:"ok,attr"`
+	Server string `xml:"server,omitempty"`
+	SkewMs string `xml:"skew_ms,omitempty"`
+	Error  string `xml:"error,omitempty"`
+}
+
+type soapEnvelope struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2003/05/soap-envelope Envelope"`
+	Body    struct {
+		Content interface{}
+	} `xml:"Body"`
+}
+
+func newCameraStatusXML(status string, clock, cam map[string]interface{}) cameraStatusXML {
+	return cameraStatusXML{
+		Status: status, ID: xmlText(cam["id"]), Backend: xmlText(cam["backend"]),
+		Present: xmlText(cam["present"]), Online: xmlText(cam["online"]), Capturing: xmlText(cam["capturing"]),
+		CaptureHealthy: xmlText(cam["capture_healthy"]), Streams: xmlText(cam["streams"]),
+		Format: xmlText(cam["format"]), Width: xmlText(cam["width"]), Height: xmlText(cam["height"]), FPS: xmlText(cam["fps"]),
+		Error: xmlText(cam["error"]),
+		Clock: clockStatusXML{Source: xmlText(clock["source"]), OK: xmlText(clock["ok"]), Server: xmlText(clock["server"]),
+			SkewMs: xmlText(clock["skew_ms"]), Error: xmlText(clock["error"])},
+	}
+}
+
+// xmlText is v as element text; absent values are empty and left out.
+func xmlText(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// statusMediaType picks "json", "xml" or "soap" from an Accept header: the
+// highest q wins, JSON on a tie, so */* and no header keep JSON.
+func statusMediaType(accept string) string {
+	best, bestQ := "json", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		kind := ""
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "application/json", "*/*", "application/*":
+			kind = "json"
+		case "application/xml", "text/xml":
+			kind = "xml"
+		case "application/soap+xml":
+			kind = "soap"
+		}
+		if kind != "" && (q > bestQ || q == bestQ && kind == "json") {
+			best, bestQ = kind, q
+		}
+	}
+	return best
+}
+
+func writeStatusXML(w http.ResponseWriter, doc interface{}, soap bool) {
+	ctype := "application/xml; charset=utf-8"
+	if soap {
+		env := soapEnvelope{}
+		env.Body.Content = doc
+		doc, ctype = env, "application/soap+xml; charset=utf-8"
+	}
+	b, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Write([]byte(xml.Header))
+	w.Write(append(b, '\n'))
+}
+
+func handleStatusXML(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, clock, cam := fleetStatus()
+	writeStatusXML(w, newCameraStatusXML(status, clock, cam), statusMediaType(r.Header.Get("Accept")) == "soap")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Full-resolution stills:
+//
+//	GET /snapshot?full_res=true
+//
+// Many UVC cameras stream at 720p but have a larger sensor. uvcvideo does
+// not expose the UVC still-image pipes (methods 2 and 3), so the still is
+// taken the way UVC method 1 does it: capture switches to the largest frame
+// size the device lists for the current format, one frame is kept, and the
+// video mode is restored. Streams pause meanwhile and continue with a
+// format-changed part (see reconfigure.go).
+
+// stillSkipFrames are dropped after the switch; UVC cameras often send a
+// dark or half-exposed frame or two after a mode change.
+const stillSkipFrames = 2
+
+// simulatedSensor is the still size of the simulate backend.
+var simulatedSensor = [2]uint32{1920, 1080}
+
+var errNoStillSize = errors.New("full_res stills need a V4L2 camera (CAPTURE_BACKEND=webcam or v4l2)")
+
+type v4l2FrmSizeEnum struct {
+	Index       uint32
+	PixelFormat uint32
+	Type        uint32
+	Size        [6]uint32 // discrete: width, height; stepwise: min/max/step width, min/max/step height
+	Reserved    [2]uint32
+}
+
+const v4l2FrmSizeDiscrete = 1
+
+var vidiocEnumFrameSizes = ioc(iocRead|iocWrite, 74, unsafe.Sizeof(v4l2FrmSizeEnum{}))
+
+// largestFrameSize asks the device for the largest frame size it lists
+// for format. It opens its own handle, as the running source keeps
+// streaming on the other.
+func largestFrameSize(cfg CameraConfig, format string) (uint32, uint32, error) {
+	backend := cfg.Backend
+	if cfg.Simulate {
+		backend = "simulate"
+	}
+	switch backend {
+	case "simulate":
+		return simulatedSensor[0], simulatedSensor[1], nil
+	case "", "webcam", "v4l2":
+	default:
+		return 0, 0, errNoStillSize
+	}
+	path, err := resolveDevicePath(cfg)
+	if err != nil {
+		return 0, 0, err
+	}
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer unix.Close(fd)
+	pixFmt := v4l2PixFmtMJPEG
+	if format == "YUYV" {
+		pixFmt = v4l2PixFmtYUYV
+	}
+	var width, height uint32
+	for i := uint32(0); ; i++ {
+		fs := v4l2FrmSizeEnum{Index: i, PixelFormat: pixFmt}
+		if err := v4l2Ioctl(fd, vidiocEnumFrameSizes, unsafe.Pointer(&fs)); err != nil {
+			if i == 0 {
+				return 0, 0, fmt.Errorf("VIDIOC_ENUM_FRAMESIZES: %w", err)
+			}
+			break
+		}
+		w, h := fs.Size[0], fs.Size[1]
+		if fs.Type != v4l2FrmSizeDiscrete {
+			w, h = fs.Size[1], fs.Size[4] // continuous or stepwise: the maximum
+		}
+		if uint64(w)*uint64(h) > uint64(width)*uint64(height) {
+			width, height = w, h
+		}
+		if fs.Type != v4l2FrmSizeDiscrete {
+			break // only index 0 is defined
+		}
+	}
+	if width > maxFrameWidth || height > maxFrameHeight {
+		width, height = maxFrameWidth, maxFrameHeight
+	}
+	return width, height, nil
+}
+
+// readStill waits for the first usable frame of a freshly opened source.
+func readStill(src FrameSource) ([]byte, error) {
+	deadline := time.Now().Add(10 * time.Second)
+	for skipped := 0; time.Now().Before(deadline); {
+		if err := src.WaitForFrame(2); err != nil {
+			if isTimeout(err) {
+				continue
+			}
+			return nil, err
+		}
+		frame, err := src.ReadFrame()
+		if err != nil && !isTimeout(err) {
+			return nil, err
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		if skipped < stillSkipFrames {
+			skipped++
+			releaseFrame(frame)
+			continue
+		}
+		return frame, nil
+	}
+	return nil, errors.New("no frame received from camera at full resolution")
+}
+
+// captureStill takes one frame at the device's largest frame size and puts
+// the video mode back. The frame is in info.Format.
+func captureStill() ([]byte, sourceInfo, error) {
+	cameraState.mu.Lock()
+	defer cameraState.mu.Unlock()
+	if !cameraState.running {
+		return nil, sourceInfo{}, errNotCapturing
+	}
+	if playbackState.active {
+		return nil, sourceInfo{}, errPlaybackActive
+	}
+	video := cameraConfig
+	video.Format = cameraState.formatStr
+	width, height, err := largestFrameSize(video, video.Format)
+	if err != nil {
+		return nil, sourceInfo{}, err
+	}
+	still := video
+	still.Width, still.Height = width, height
+
+	cameraState.source.StopStreaming()
+	cameraState.source.Close()
+	src, info, err := openFrameSource(still)
+	var frame []byte
+	if err == nil {
+		frame, err = readStill(src)
+		src.StopStreaming()
+		src.Close()
+	}
+	back, backInfo, rerr := openFrameSource(video)
+	if rerr != nil {
+		cameraState.source, cameraState.running = nil, false
+		cameraState.gen.Add(1)
+		_ = sdNotify("STATUS=camera reopen failed: " + rerr.Error())
+		if err != nil {
+			return nil, sourceInfo{}, err
+		}
+		log.Printf("still taken, but restoring the video mode failed: %v", rerr)
+		return frame, info, nil
+	}
+	installSource(back, backInfo)
+	if err != nil {
+		return nil, sourceInfo{}, err
+	}
+	return frame, info, nil
+}
+
+func handleStill(w http.ResponseWriter, r *http.Request) {
+	frame, info, err := captureStill()
+	switch {
+	case errors.Is(err, errNotCapturing):
+		http.Error(w, "Camera is not capturing", http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, errPlaybackActive):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errNoStillSize):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	markFrame()
+	writeSnapshot(w, r, "still", frame, info.Format, info.Width, info.Height)
+	releaseFrame(frame)
+}
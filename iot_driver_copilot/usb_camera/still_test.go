@@ -0,0 +1,50 @@
+package main
+
+import (
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"unsafe"
+)
+
+func TestFrmSizeEnumLayout(t *testing.T) {
+	if n := unsafe.Sizeof(v4l2FrmSizeEnum{}); n != 44 {
+		t.Errorf("sizeof(v4l2_frmsizeenum) = %d, want 44", n)
+	}
+}
+
+func TestFullResSnapshot(t *testing.T) {
+	saved := cameraConfig
+	defer func() { closeCamera(); cameraConfig = saved }()
+	cameraConfig = CameraConfig{Simulate: true, Format: "MJPEG", Width: 64, Height: 48, FPS: 30}
+	snapshot := func(target string) (int, int, int) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleSnapshot(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			return rec.Code, 0, 0
+		}
+		cfg, err := jpeg.DecodeConfig(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, cfg.Width, cfg.Height
+	}
+	if code, _, _ := snapshot("/snapshot?full_res=true"); code != http.StatusServiceUnavailable {
+		t.Errorf("full_res while stopped: %d", code)
+	}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	gen := cameraState.gen.Load()
+	if code, w, h := snapshot("/snapshot?full_res=true"); code != http.StatusOK || w != int(simulatedSensor[0]) || h != int(simulatedSensor[1]) {
+		t.Errorf("full_res: %d %dx%d", code, w, h)
+	}
+	if cameraState.gen.Load() == gen {
+		t.Error("streams were not told about the source switch")
+	}
+	if code, w, h := snapshot("/snapshot"); code != http.StatusOK || w != 64 || h != 48 {
+		t.Errorf("after the still: %d %dx%d, want the 64x48 video mode", code, w, h)
+	}
+}
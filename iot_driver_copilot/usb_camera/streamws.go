@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// --- WEBSOCKET STREAM ---
+// GET /stream/ws carries the same frames as /stream over a WebSocket, one
+// binary message per JPEG. Viewers that read frames themselves (Electron,
+// browsers drawing to a canvas) get flow control for free: a message is
+// only sent once the previous one is written, so a slow viewer sees a lower
+// frame rate instead of a growing backlog. The first message is a text
+// header,
+//
+//	{"type": "stream", "content_type": "image/jpeg", "format": "MJPEG", "width": 1280, "height": 720, "fps": 30}
+//
+// and {"type": "format_changed", "width": ..., "height": ...} precedes the
+// first frame after a reconfigure, as {"type": "quality_changed", ...,
+// "quality_tier": N} does after an adaptive quality change (adaptive.go).
+// Browsers cannot set headers on a WebSocket, so the route takes a ?token=
+// stream token. Pages served from
+// another origin must be listed in STREAM_WS_ORIGINS; clients that send no
+// Origin header (native apps) are always let in.
+
+type StreamWSConfig struct {
+	Origins []string // STREAM_WS_ORIGINS: comma-separated origins allowed besides the driver's own, or "*"
+}
+
+var streamWSConfig StreamWSConfig
+
+// wsWriteTimeout bounds one message; a viewer that stops reading for this
+// long is dropped.
+const wsWriteTimeout = 10 * time.Second
+
+func loadStreamWSConfig() error {
+	streamWSConfig = StreamWSConfig{}
+	for _, o := range strings.Split(os.Getenv("STREAM_WS_ORIGINS"), ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		if o != "*" {
+			u, err := url.Parse(o)
+			switch {
+			case err == nil && u.Scheme == "file":
+				o = "file://" // what Electron sends for local pages
+			case err == nil && u.Scheme != "" && u.Host != "" && strings.Trim(u.Path, "/") == "":
+				o = u.Scheme + "://" + u.Host
+			default:
+				return fmt.Errorf("STREAM_WS_ORIGINS: %q is not an origin like https://viewer.example.com", o)
+			}
+		}
+		streamWSConfig.Origins = append(streamWSConfig.Origins, o)
+	}
+	return nil
+}
+
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range streamWSConfig.Origins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+var wsUpgrader = websocket.Upgrader{WriteBufferSize: 64 << 10, CheckOrigin: checkWSOrigin}
+
+type wsStreamHeader struct {
+	Type        string `json:"type"` // "stream", "format_changed" or "quality_changed"
+	ContentType string `json:"content_type,omitempty"`
+	Format      string `json:"format,omitempty"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	FPS         uint32 `json:"fps,omitempty"`
+	Tier        *int   `json:"quality_tier,omitempty"` // on quality_changed
+}
+
+func handleStreamWS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cameraState.mu.Lock()
+	running, format, fps := cameraState.running, cameraState.formatStr, cameraState.fps
+	cameraState.mu.Unlock()
+	if !running {
+		http.Error(w, "Camera is not capturing", http.StatusServiceUnavailable)
+		return
+	}
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade has answered
+	}
+	defer conn.Close()
+	// Control frames are only processed while reading; the viewer sends
+	// nothing else, and a read error means it has gone.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	client, started := clientIDFromRequest(r), time.Now()
+	recordEvent("stream_started", client, map[string]interface{}{"format": format, "transport": "websocket"})
+	defer func() {
+		recordEvent("stream_ended", client, map[string]interface{}{"format": format, "transport": "websocket", "seconds": int(time.Since(started).Seconds())})
+	}()
+	activeStreams.Add(1)
+	defer activeStreams.Add(-1)
+	sc := openStreamClient(r, "websocket")
+	defer sc.close()
+
+	feed := newStreamFeed()
+	send := func(typ int, data interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if b, ok := data.([]byte); ok {
+			return conn.WriteMessage(typ, b)
+		}
+		return conn.WriteJSON(data)
+	}
+	if err := send(websocket.TextMessage, wsStreamHeader{Type: "stream", ContentType: "image/jpeg", Format: format, Width: feed.width, Height: feed.height, FPS: fps}); err != nil {
+		return
+	}
+	mark := watermarkFor(client)
+	badFrames := 0
+	var held []byte // the frame being sent, when it is the one read
+	defer func() { releaseFrame(held) }()
+	for {
+		releaseFrame(held)
+		held = nil
+		select {
+		case <-gone:
+			return
+		case <-r.Context().Done():
+			return
+		default:
+		}
+		if !feed.follow(false) {
+			break
+		}
+		err := feed.src.WaitForFrame(5)
+		if err != nil && !isTimeout(err) {
+			captureErrors.Add(1)
+			if feed.follow(true) {
+				continue
+			}
+			break
+		}
+		frame, err := feed.src.ReadFrame()
+		if len(frame) == 0 {
+			continue
+		}
+		if err != nil && !isTimeout(err) {
+			releaseFrame(frame)
+			captureErrors.Add(1)
+			if feed.follow(true) {
+				continue
+			}
+			break
+		}
+		markFrame()
+		jpg := frame
+		if format != "MJPEG" || mark != "" {
+			jpg, err = snapshotJPEG(frame, format, uint32(feed.width), uint32(feed.height), mark)
+			releaseFrame(frame)
+			if err != nil {
+				// As on /stream, a watermarked viewer never gets an
+				// unmarked frame.
+				if badFrames++; badFrames >= maxUndecodableFrames {
+					log.Printf("ending websocket stream for %q: frames cannot be decoded", client)
+					break
+				}
+				continue
+			}
+			badFrames = 0
+		} else {
+			held = frame
+		}
+		if feed.changed {
+			feed.changed = false
+			if err := send(websocket.TextMessage, wsStreamHeader{Type: "format_changed", Width: feed.width, Height: feed.height}); err != nil {
+				return
+			}
+		}
+		jpg, width, height, announce, err := sc.prepare(jpg, feed.width, feed.height)
+		if err != nil {
+			continue
+		}
+		if announce {
+			tier := sc.currentTier()
+			if err := send(websocket.TextMessage, wsStreamHeader{Type: "quality_changed", Width: width, Height: height, Tier: &tier}); err != nil {
+				return
+			}
+		}
+		start := time.Now()
+		if err := send(websocket.BinaryMessage, jpg); err != nil {
+			return
+		}
+		sc.wrote(time.Since(start), time.Now())
+	}
+	// The capture ended: say so before closing.
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "capture stopped"))
+}
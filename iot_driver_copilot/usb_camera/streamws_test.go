@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestStreamWS(t *testing.T) {
+	saved, savedWS := cameraConfig, streamWSConfig
+	defer func() { closeCamera(); cameraConfig, streamWSConfig = saved, savedWS }()
+	cameraConfig = CameraConfig{DevicePath: "/dev/video-missing", Simulate: true, Format: "YUYV", Width: 64, Height: 48, FPS: 30}
+	srv := httptest.NewServer(http.HandlerFunc(handleStreamWS))
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("dial while not capturing: %v", err)
+	}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://elsewhere.example"}}); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("dial from another origin: %v", err)
+	}
+	streamWSConfig.Origins = []string{"https://elsewhere.example"}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://elsewhere.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var hdr wsStreamHeader
+	if typ, msg, err := conn.ReadMessage(); err != nil || typ != websocket.TextMessage || json.Unmarshal(msg, &hdr) != nil {
+		t.Fatalf("header: %d %s %v", typ, msg, err)
+	}
+	if hdr.Type != "stream" || hdr.Format != "YUYV" || hdr.ContentType != "image/jpeg" || hdr.Width != 64 || hdr.Height != 48 {
+		t.Errorf("header = %+v", hdr)
+	}
+	for i := 0; i < 2; i++ {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil || typ != websocket.BinaryMessage {
+			t.Fatalf("frame %d: %d %v", i, typ, err)
+		}
+		if cfg, err := jpeg.DecodeConfig(bytes.NewReader(msg)); err != nil || cfg.Width != 64 {
+			t.Fatalf("frame %d: %+v %v", i, cfg, err)
+		}
+	}
+
+	if _, err := reconfigureCamera(32, 24, 30); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("stream ended across reconfigure: %v", err)
+		}
+		if typ != websocket.TextMessage {
+			continue
+		}
+		if json.Unmarshal(msg, &hdr) != nil || hdr.Type != "format_changed" || hdr.Width != 32 || hdr.Height != 24 {
+			t.Fatalf("after reconfigure: %s", msg)
+		}
+		break
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	} else if cfg, err := jpeg.DecodeConfig(bytes.NewReader(msg)); err != nil || cfg.Width != 32 {
+		t.Errorf("frame after reconfigure: %+v %v", cfg, err)
+	}
+}
+
+func TestLoadStreamWSConfig(t *testing.T) {
+	defer func() { streamWSConfig = StreamWSConfig{} }()
+	t.Setenv("STREAM_WS_ORIGINS", " https://viewer.example.com/, file://, *")
+	if err := loadStreamWSConfig(); err != nil || len(streamWSConfig.Origins) != 3 || streamWSConfig.Origins[0] != "https://viewer.example.com" || streamWSConfig.Origins[1] != "file://" {
+		t.Errorf("origins = %q, %v", streamWSConfig.Origins, err)
+	}
+	for _, bad := range []string{"viewer.example.com", "https://viewer.example.com/app"} {
+		t.Setenv("STREAM_WS_ORIGINS", bad)
+		if err := loadStreamWSConfig(); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
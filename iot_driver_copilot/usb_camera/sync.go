@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- CAMERA SYNC ---
+// A stereo or multi-camera rig runs one driver per camera. GET /sync/status
+// reports when this camera's last frame was captured (see frametime.go) and
+// how far apart its frames are, and with SYNC_PEERS (the other drivers'
+// base URLs, e.g. "http://cam-right:8080") the same for every peer, with
+// each peer's offset_ms: how far the peer's nearest frame is from this
+// camera's, from -half a frame to +half. Peers on the same host (same
+// kernel boot_id) are compared by their kernel monotonic timestamps, others
+// by wall clock, which needs NTP_SERVER on every driver. SYNC_PEER_API_KEY
+// is sent to peers that need a key; SYNC_PEER_TIMEOUT_MS (default 500)
+// bounds each query. ?peers=false leaves the peers out, as peers ask.
+// SYNC_NAME (default the hostname) names the camera.
+//
+// USB cameras have no genlock input, so SYNC_GENLOCK=true does it in
+// software: streaming starts on the next whole multiple of
+// SYNC_GENLOCK_PERIOD_MS (default 1000) of the wall clock, so cameras
+// started together on hosts with the same setting start on the same
+// instant. Each then runs on its own oscillator. The genlock section of
+// /sync/status gives phase_ms, how far the last frame was from the grid of
+// frame periods laid from that instant; drift_ms, how far the phase has
+// moved since the first frame; and drift_ppm. With
+// SYNC_GENLOCK_MAX_DRIFT_MS set, a camera that drifts further is reopened
+// and aligned again, recorded as a "sync_realigned" event and counted in
+// camera_sync_realigns. Only the webcam, v4l2 and simulate backends start
+// on the grid. Opening waits up to a period for it, pausing streams as a
+// reconfigure does. Phases are as exact as the frame timestamps, so use
+// CAPTURE_BACKEND=v4l2 with its kernel timestamps.
+
+type SyncConfig struct {
+	Name          string        // SYNC_NAME
+	Peers         []string      // SYNC_PEERS
+	PeerAPIKey    string        // SYNC_PEER_API_KEY
+	PeerTimeout   time.Duration // SYNC_PEER_TIMEOUT_MS
+	Genlock       bool          // SYNC_GENLOCK
+	GenlockPeriod time.Duration // SYNC_GENLOCK_PERIOD_MS
+	MaxDrift      time.Duration // SYNC_GENLOCK_MAX_DRIFT_MS; 0 only reports
+}
+
+var syncConfig SyncConfig
+
+var syncRealigns atomic.Uint64
+
+// bootID tells peers on the same kernel, whose monotonic clocks agree.
+var bootID string
+
+func loadSyncConfig() error {
+	syncConfig = SyncConfig{Name: os.Getenv("SYNC_NAME"), PeerTimeout: 500 * time.Millisecond, GenlockPeriod: time.Second}
+	if syncConfig.Name == "" {
+		syncConfig.Name, _ = os.Hostname()
+	}
+	for _, p := range strings.Split(os.Getenv("SYNC_PEERS"), ",") {
+		if p = strings.TrimRight(strings.TrimSpace(p), "/"); p == "" {
+			continue
+		}
+		if !strings.HasPrefix(p, "http://") && !strings.HasPrefix(p, "https://") {
+			return fmt.Errorf("SYNC_PEERS: %q is not an http(s) URL", p)
+		}
+		syncConfig.Peers = append(syncConfig.Peers, p)
+	}
+	syncConfig.PeerAPIKey = os.Getenv("SYNC_PEER_API_KEY")
+	if v := os.Getenv("SYNC_GENLOCK"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("SYNC_GENLOCK must be true or false")
+		}
+		syncConfig.Genlock = b
+	}
+	for _, s := range []struct {
+		name     string
+		min, max int
+		set      func(int)
+	}{
+		{"SYNC_PEER_TIMEOUT_MS", 50, 10000, func(n int) { syncConfig.PeerTimeout = time.Duration(n) * time.Millisecond }},
+		{"SYNC_GENLOCK_PERIOD_MS", 10, 60000, func(n int) { syncConfig.GenlockPeriod = time.Duration(n) * time.Millisecond }},
+		{"SYNC_GENLOCK_MAX_DRIFT_MS", 0, 1000, func(n int) { syncConfig.MaxDrift = time.Duration(n) * time.Millisecond }},
+	} {
+		if v := os.Getenv(s.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < s.min || n > s.max {
+				return fmt.Errorf("%s must be between %d and %d", s.name, s.min, s.max)
+			}
+			s.set(n)
+		}
+	}
+	if syncConfig.MaxDrift > 0 && !syncConfig.Genlock {
+		return fmt.Errorf("SYNC_GENLOCK_MAX_DRIFT_MS needs SYNC_GENLOCK=true")
+	}
+	if b, err := os.ReadFile("/proc/sys/kernel/random/boot_id"); err == nil {
+		bootID = strings.TrimSpace(string(b))
+	}
+	cameraSync.reset()
+	return nil
+}
+
+// genlockStart waits for the next genlock instant, if SYNC_GENLOCK is on.
+// Backends call it just before they start streaming.
+func genlockStart() {
+	if !syncConfig.Genlock {
+		return
+	}
+	now := clockNow()
+	period := syncConfig.GenlockPeriod
+	wait := period - time.Duration(now.UnixNano()%int64(period))
+	time.Sleep(wait)
+	cameraSync.aligned(now.Add(wait))
+}
+
+// syncState follows the frames of the running source.
+type syncState struct {
+	mu         sync.Mutex
+	last       frameTime
+	have       bool
+	interval   time.Duration // smoothed time between captures
+	alignedAt  time.Time     // when streaming started on the genlock grid
+	phase      time.Duration
+	startPhase time.Duration
+	phased     bool // phase and startPhase are set
+	realigning atomic.Bool
+}
+
+var cameraSync = &syncState{}
+
+func (s *syncState) reset() {
+	s.mu.Lock()
+	s.last, s.have, s.interval = frameTime{}, false, 0
+	s.alignedAt, s.phased = time.Time{}, false
+	s.mu.Unlock()
+}
+
+func (s *syncState) aligned(at time.Time) {
+	s.mu.Lock()
+	s.alignedAt, s.phased = at, false
+	s.mu.Unlock()
+}
+
+// note records a frame captured at ft from a source whose frames are
+// period apart, and returns how far it has drifted from the genlock grid
+// and whether that is past SYNC_GENLOCK_MAX_DRIFT_MS.
+func (s *syncState) note(ft frameTime, period time.Duration) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.have {
+		if d := ft.Captured.Sub(s.last.Captured); d > 0 && d < 4*period {
+			if s.interval == 0 {
+				s.interval = d
+			} else {
+				s.interval += (d - s.interval) / 8
+			}
+		}
+	}
+	s.last, s.have = ft, true
+	if s.alignedAt.IsZero() || period <= 0 {
+		return 0, false
+	}
+	s.phase = foldPhase(ft.Captured.Sub(s.alignedAt), period)
+	if !s.phased {
+		s.startPhase, s.phased = s.phase, true
+	}
+	drift := foldPhase(s.phase-s.startPhase, period)
+	return drift, syncConfig.MaxDrift > 0 && (drift > syncConfig.MaxDrift || drift < -syncConfig.MaxDrift)
+}
+
+// foldPhase returns d modulo period, from -period/2 up to period/2.
+func foldPhase(d, period time.Duration) time.Duration {
+	d %= period
+	if d >= period/2 {
+		d -= period
+	} else if d < -period/2 {
+		d += period
+	}
+	return d
+}
+
+// realign reopens the camera on the genlock grid, once at a time.
+func (s *syncState) realign(drift time.Duration) {
+	if !s.realigning.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer s.realigning.Store(false)
+		log.Printf("camera sync: drifted %v from the genlock grid, realigning", drift)
+		_, err := reopenCapture()
+		detail := map[string]interface{}{"drift_ms": millis(drift), "ok": err == nil}
+		if err != nil {
+			detail["error"] = err.Error()
+			log.Printf("camera sync: realigning failed: %v", err)
+		}
+		syncRealigns.Add(1)
+		recordEvent("sync_realigned", "", detail)
+	}()
+}
+
+// syncTap notes every frame for /sync/status.
+type syncTap struct {
+	FrameSource
+	info sourceInfo
+}
+
+func (s *syncTap) ReadFrame() ([]byte, error) {
+	frame, err := s.FrameSource.ReadFrame()
+	if len(frame) > 0 {
+		var period time.Duration
+		if s.info.FPS > 0 {
+			period = time.Second / time.Duration(s.info.FPS)
+		}
+		if drift, over := cameraSync.note(frameTimeOf(frame), period); over {
+			cameraSync.realign(drift)
+		}
+	}
+	return frame, err
+}
+
+// millis is d in milliseconds.
+func millis(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+type syncFrame struct {
+	frameStamp
+	AgeMs float64 `json:"age_ms"`
+}
+
+type genlockStatus struct {
+	PeriodMs     float64   `json:"period_ms"`
+	AlignedAt    time.Time `json:"aligned_at"`
+	PhaseMs      float64   `json:"phase_ms"`
+	StartPhaseMs float64   `json:"start_phase_ms"`
+	DriftMs      float64   `json:"drift_ms"`
+	DriftPPM     float64   `json:"drift_ppm"`
+	MaxDriftMs   float64   `json:"max_drift_ms,omitempty"`
+	Realigns     uint64    `json:"realigns"`
+}
+
+// genlock reports the phase and drift of the last frame.
+func (s *syncState) genlock(period time.Duration) *genlockStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := &genlockStatus{PeriodMs: millis(period), AlignedAt: s.alignedAt.UTC(), MaxDriftMs: millis(syncConfig.MaxDrift), Realigns: syncRealigns.Load()}
+	if !s.phased {
+		return g
+	}
+	drift := foldPhase(s.phase-s.startPhase, period)
+	g.PhaseMs, g.StartPhaseMs, g.DriftMs = millis(s.phase), millis(s.startPhase), millis(drift)
+	if elapsed := s.last.Captured.Sub(s.alignedAt); elapsed > 0 {
+		g.DriftPPM = float64(drift) / float64(elapsed) * 1e6
+	}
+	return g
+}
+
+type syncStatus struct {
+	Camera          string         `json:"camera"`
+	BootID          string         `json:"boot_id,omitempty"`
+	Capturing       bool           `json:"capturing"`
+	FPS             uint32         `json:"fps"`
+	FrameIntervalMs float64        `json:"frame_interval_ms,omitempty"`
+	LastFrame       *syncFrame     `json:"last_frame,omitempty"`
+	Genlock         *genlockStatus `json:"genlock,omitempty"`
+	Peers           []syncPeer     `json:"peers,omitempty"`
+	MaxOffsetMs     *float64       `json:"max_offset_ms,omitempty"`
+}
+
+type syncPeer struct {
+	URL      string      `json:"url"`
+	Status   *syncStatus `json:"status,omitempty"`
+	OffsetMs *float64    `json:"offset_ms,omitempty"`
+	Basis    string      `json:"basis,omitempty"` // monotonic or wall
+	Error    string      `json:"error,omitempty"`
+}
+
+// localSyncStatus reports this camera.
+func localSyncStatus() syncStatus {
+	cameraState.mu.Lock()
+	running, fps := cameraState.running, cameraState.fps
+	cameraState.mu.Unlock()
+	st := syncStatus{Camera: syncConfig.Name, BootID: bootID, Capturing: running, FPS: fps}
+	var period time.Duration
+	if fps > 0 {
+		period = time.Second / time.Duration(fps)
+	}
+	cameraSync.mu.Lock()
+	last, have, interval := cameraSync.last, cameraSync.have, cameraSync.interval
+	cameraSync.mu.Unlock()
+	st.FrameIntervalMs = millis(interval)
+	if have {
+		st.LastFrame = &syncFrame{frameStamp: last.stamp(), AgeMs: millis(clockNow().Sub(last.Captured))}
+	}
+	if syncConfig.Genlock && period > 0 {
+		st.Genlock = cameraSync.genlock(period)
+	}
+	return st
+}
+
+// peerOffset is how far peer's last frame is from ours, folded into one of
+// our frame periods, and what it was measured by.
+func peerOffset(local, peer syncStatus) (time.Duration, string, bool) {
+	if local.LastFrame == nil || peer.LastFrame == nil || local.FPS == 0 {
+		return 0, "", false
+	}
+	period := time.Second / time.Duration(local.FPS)
+	l, p := local.LastFrame, peer.LastFrame
+	if local.BootID != "" && local.BootID == peer.BootID && l.Sequence != nil && p.Sequence != nil {
+		return foldPhase(time.Duration(p.MonotonicNs-l.MonotonicNs), period), "monotonic", true
+	}
+	return foldPhase(p.Timestamp.Sub(l.Timestamp), period), "wall", true
+}
+
+var syncHTTP = &http.Client{}
+
+func fetchPeerStatus(url string) (syncStatus, error) {
+	var st syncStatus
+	req, err := http.NewRequest(http.MethodGet, url+"/sync/status?peers=false", nil)
+	if err != nil {
+		return st, err
+	}
+	if syncConfig.PeerAPIKey != "" {
+		req.Header.Set("X-API-Key", syncConfig.PeerAPIKey)
+	}
+	c := *syncHTTP
+	c.Timeout = syncConfig.PeerTimeout
+	resp, err := c.Do(req)
+	if err != nil {
+		return st, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return st, fmt.Errorf("%s", resp.Status)
+	}
+	return st, json.NewDecoder(resp.Body).Decode(&st)
+}
+
+func handleSyncStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st := localSyncStatus()
+	if r.URL.Query().Get("peers") == "false" || len(syncConfig.Peers) == 0 {
+		jsonResponse(w, http.StatusOK, st)
+		return
+	}
+	st.Peers = make([]syncPeer, len(syncConfig.Peers))
+	var wg sync.WaitGroup
+	for i, url := range syncConfig.Peers {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			st.Peers[i].URL = url
+			ps, err := fetchPeerStatus(url)
+			if err != nil {
+				st.Peers[i].Error = err.Error()
+				return
+			}
+			st.Peers[i].Status = &ps
+		}(i, url)
+	}
+	wg.Wait()
+	for i := range st.Peers {
+		p := &st.Peers[i]
+		if p.Status == nil {
+			continue
+		}
+		off, basis, ok := peerOffset(st, *p.Status)
+		if !ok {
+			continue
+		}
+		v := millis(off)
+		p.OffsetMs, p.Basis = &v, basis
+		if off < 0 {
+			off = -off
+		}
+		if st.MaxOffsetMs == nil || millis(off) > *st.MaxOffsetMs {
+			spread := millis(off)
+			st.MaxOffsetMs = &spread
+		}
+	}
+	jsonResponse(w, http.StatusOK, st)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFoldPhase(t *testing.T) {
+	const p = 40 * time.Millisecond
+	for _, c := range []struct{ d, want time.Duration }{
+		{5 * time.Millisecond, 5 * time.Millisecond},
+		{35 * time.Millisecond, -5 * time.Millisecond},
+		{85 * time.Millisecond, 5 * time.Millisecond},
+		{-35 * time.Millisecond, 5 * time.Millisecond},
+		{20 * time.Millisecond, -20 * time.Millisecond},
+	} {
+		if got := foldPhase(c.d, p); got != c.want {
+			t.Errorf("foldPhase(%v) = %v, want %v", c.d, got, c.want)
+		}
+	}
+}
+
+func TestGenlockDrift(t *testing.T) {
+	defer loadSyncConfig()
+	t.Setenv("SYNC_GENLOCK", "true")
+	t.Setenv("SYNC_GENLOCK_MAX_DRIFT_MS", "2")
+	if err := loadSyncConfig(); err != nil {
+		t.Fatal(err)
+	}
+	const period = 40 * time.Millisecond
+	start := time.Unix(1000, 0)
+	cameraSync.aligned(start)
+	// Frames 7ms after the grid, running 0.1ms per frame slow.
+	for i := 0; i < 30; i++ {
+		at := start.Add(7*time.Millisecond + time.Duration(i)*(period+100*time.Microsecond))
+		drift, over := cameraSync.note(frameTime{Captured: at, Read: at}, period)
+		if want := time.Duration(i) * 100 * time.Microsecond; drift != want {
+			t.Fatalf("frame %d: drift %v, want %v", i, drift, want)
+		}
+		if over != (i > 20) {
+			t.Fatalf("frame %d: over the limit = %v", i, over)
+		}
+	}
+	g := cameraSync.genlock(period)
+	if g.StartPhaseMs != 7 || g.PhaseMs != 9.9 || g.DriftPPM < 2400 || g.DriftPPM > 2600 {
+		t.Errorf("genlock status %+v", g)
+	}
+	if cameraSync.interval < period || cameraSync.interval > period+100*time.Microsecond {
+		t.Errorf("frame interval %v", cameraSync.interval)
+	}
+}
+
+func TestSyncStatusWithPeer(t *testing.T) {
+	saved := cameraConfig
+	defer func() { closeCamera(); cameraConfig = saved; loadSyncConfig() }()
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("peers") != "false" || r.Header.Get("X-API-Key") != "peer-key" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		cameraSync.mu.Lock()
+		last := cameraSync.last
+		cameraSync.mu.Unlock()
+		last.Captured = last.Captured.Add(13 * time.Millisecond)
+		jsonResponse(w, http.StatusOK, syncStatus{Camera: "right", FPS: 20, LastFrame: &syncFrame{frameStamp: last.stamp()}})
+	}))
+	defer peer.Close()
+	t.Setenv("SYNC_NAME", "left")
+	t.Setenv("SYNC_PEERS", peer.URL+", http://127.0.0.1:1")
+	t.Setenv("SYNC_PEER_API_KEY", "peer-key")
+	t.Setenv("SYNC_GENLOCK", "true")
+	t.Setenv("SYNC_GENLOCK_PERIOD_MS", "100")
+	if err := loadSyncConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cameraConfig = CameraConfig{Simulate: true, Format: "MJPEG", Width: 32, Height: 24, FPS: 20}
+	if err := openCamera(); err != nil {
+		t.Fatal(err)
+	}
+	cam := cameraState.source
+	for i := 0; i < 3; i++ {
+		if err := cam.WaitForFrame(1); err != nil {
+			t.Fatal(err)
+		}
+		frame, _ := cam.ReadFrame()
+		releaseFrame(frame)
+	}
+
+	rec := httptest.NewRecorder()
+	handleSyncStatus(rec, httptest.NewRequest(http.MethodGet, "/sync/status", nil))
+	var st syncStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	if st.Camera != "left" || st.FPS != 20 || st.LastFrame == nil || st.Genlock == nil {
+		t.Fatalf("status %s", rec.Body)
+	}
+	if st.Genlock.AlignedAt.UnixNano()%int64(100*time.Millisecond) != 0 {
+		t.Errorf("capture started at %v, not on the 100ms grid", st.Genlock.AlignedAt)
+	}
+	if len(st.Peers) != 2 || st.Peers[0].Status == nil || st.Peers[0].Status.Camera != "right" || st.Peers[1].Error == "" {
+		t.Fatalf("peers %s", rec.Body)
+	}
+	if off := st.Peers[0].OffsetMs; off == nil || *off != 13 || st.MaxOffsetMs == nil || *st.MaxOffsetMs != 13 {
+		t.Errorf("peer offset %s", rec.Body)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// sdNotify sends a state string to systemd's NOTIFY_SOCKET; it is a no-op
+// when the driver isn't running under a Type=notify unit.
+func sdNotify(state string) error {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return nil
+	}
+	if sock[0] == '@' {
+		sock = "\x00" + sock[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// systemdListener returns the first socket passed by systemd socket
+// activation (LISTEN_FDS), or nil when the driver was started normally.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	const firstFD = 3
+	f := os.NewFile(firstFD, "LISTEN_FD_3")
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %w", err)
+	}
+	return l, nil
+}
+
+// listenHTTP prefers a socket-activated listener and otherwise binds spec,
+// a TCP host:port or an HTTP_LISTEN value (see listen.go), to iface when
+// it is set.
+func listenHTTP(spec, iface string, perms socketPerms) (net.Listener, error) {
+	l, err := systemdListener()
+	if err != nil || l != nil {
+		return l, err
+	}
+	network, addr, err := parseListen(spec)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if iface != "" {
+			return nil, fmt.Errorf("HTTP_INTERFACE applies to TCP listeners, not %s", spec)
+		}
+		return listenUnix(addr, perms)
+	}
+	return listenTCP(network, addr, iface)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- TIME SOURCE ---
+// Event, snapshot (EXIF), raw frame, image statistics and saved state
+// timestamps come from clockNow. With NTP_SERVER set the driver asks that
+// server for the time every NTP_INTERVAL_MS (SNTP) and adds the measured
+// offset to the host clock, without setting the system time; cameras on
+// boxes that boot with a wrong clock still produce a usable timeline.
+// Until the first answer, or without NTP_SERVER, it is the host clock.
+// GET /healthz reports the skew; beyond CLOCK_SKEW_WARN_MS, or with the
+// server silent for three intervals, the driver is "degraded".
+
+type TimeConfig struct {
+	Server   string        // NTP_SERVER
+	Interval time.Duration // NTP_INTERVAL_MS
+	Warn     time.Duration // CLOCK_SKEW_WARN_MS
+}
+
+var timeConfig TimeConfig
+
+var clockState struct {
+	mu      sync.Mutex
+	offset  time.Duration // NTP time minus host time
+	rtt     time.Duration
+	synced  time.Time // host time of the last answer
+	lastErr error
+	warned  bool
+}
+
+const (
+	ntpEpochOffset = 2208988800 // seconds from 1900 to 1970
+	ntpTimeout     = 5 * time.Second
+)
+
+func loadTimeConfig() error {
+	timeConfig = TimeConfig{Server: os.Getenv("NTP_SERVER"), Interval: 15 * time.Minute, Warn: time.Second}
+	ms := func(name string, min time.Duration, dst *time.Duration) error {
+		v := os.Getenv(name)
+		if v == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || time.Duration(n)*time.Millisecond < min {
+			return fmt.Errorf("%s must be at least %d, got %q", name, min.Milliseconds(), v)
+		}
+		*dst = time.Duration(n) * time.Millisecond
+		return nil
+	}
+	if err := ms("NTP_INTERVAL_MS", time.Minute, &timeConfig.Interval); err != nil {
+		return err
+	}
+	return ms("CLOCK_SKEW_WARN_MS", time.Millisecond, &timeConfig.Warn)
+}
+
+// clockNow is the current time, corrected by the last NTP measurement.
+func clockNow() time.Time {
+	clockState.mu.Lock()
+	defer clockState.mu.Unlock()
+	return time.Now().Add(clockState.offset)
+}
+
+func timeSyncLoop(ctx context.Context) {
+	for {
+		syncClock(ctx)
+		select {
+		case <-time.After(timeConfig.Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncClock takes one measurement; a failure keeps the previous offset.
+func syncClock(ctx context.Context) {
+	offset, rtt, err := queryNTP(ctx, timeConfig.Server)
+	s := &clockState
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if s.lastErr == nil {
+			log.Printf("NTP query to %s failed: %v", timeConfig.Server, err)
+		}
+		s.lastErr = err
+		return
+	}
+	if s.lastErr != nil {
+		log.Printf("NTP server %s answering again", timeConfig.Server)
+	}
+	s.offset, s.rtt, s.synced, s.lastErr = offset, rtt, time.Now(), nil
+	skewed := offset.Abs() > timeConfig.Warn
+	if skewed && !s.warned {
+		log.Printf("Host clock differs from %s by %v; correcting timestamps", timeConfig.Server, -offset)
+	}
+	s.warned = skewed
+}
+
+// clockHealth is the "clock" object of GET /healthz, and whether it is ok.
+func clockHealth() (map[string]interface{}, bool) {
+	if timeConfig.Server == "" {
+		return map[string]interface{}{"source": "system", "ok": true}, true
+	}
+	s := &clockState
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := map[string]interface{}{"source": "ntp", "server": timeConfig.Server}
+	if s.lastErr != nil {
+		h["error"] = s.lastErr.Error()
+	}
+	ok := false
+	if !s.synced.IsZero() {
+		ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+		h["skew_ms"], h["rtt_ms"], h["last_sync"] = ms(-s.offset), ms(s.rtt), s.synced.Add(s.offset).UTC()
+		ok = s.offset.Abs() <= timeConfig.Warn && time.Since(s.synced) < 3*timeConfig.Interval
+	}
+	h["ok"] = ok
+	return h, ok
+}
+
+// queryNTP asks server ("host" or "host:port") for the time, returning the
+// host clock's offset from it and the round trip.
+func queryNTP(ctx context.Context, server string) (offset, rtt time.Duration, err error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	ctx, cancel := context.WithTimeout(ctx, ntpTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	// A random transmit timestamp, echoed back as the originate timestamp,
+	// matches the answer to the request without revealing a wrong clock.
+	req := make([]byte, 48)
+	req[0] = 0x23 // LI 0, version 4, mode 3 (client)
+	if _, err := rand.Read(req[40:]); err != nil {
+		return 0, 0, err
+	}
+	t1 := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, 0, err
+	}
+	resp := make([]byte, 48)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n >= 48 && string(resp[24:32]) == string(req[40:48]) {
+			break
+		}
+	}
+	t4 := t1.Add(time.Since(t1))
+	switch {
+	case resp[0]&0x07 != 4:
+		return 0, 0, errors.New("ntp: not a server reply")
+	case resp[0]>>6 == 3:
+		return 0, 0, errors.New("ntp: server clock not synchronized")
+	case resp[1] == 0:
+		return 0, 0, fmt.Errorf("ntp: server refused: %q", resp[12:16])
+	}
+	t2, t3 := ntpTime(resp[32:40]), ntpTime(resp[40:48])
+	rtt = t4.Sub(t1) - t3.Sub(t2)
+	offset = (t2.Sub(t1.Round(0)) + t3.Sub(t4.Round(0))) / 2
+	return offset, rtt, nil
+}
+
+func ntpTime(b []byte) time.Time {
+	secs := int64(binary.BigEndian.Uint32(b))
+	if secs < 1<<31 {
+		secs += 1 << 32 // era 1, from February 2036
+	}
+	frac := int64(binary.BigEndian.Uint32(b[4:]))
+	return time.Unix(secs-ntpEpochOffset, frac*1e9>>32)
+}
+
+// handleHealthz needs no API key, so probes can reach it. The driver is
+// degraded when its clock is, or when capture has stalled under a client.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	clock, ok := clockHealth()
+	capturing := captureHealthy()
+	status := "ok"
+	if !ok || !capturing {
+		status = "degraded"
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"status": status, "capture_healthy": capturing, "clock": clock})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeNTP answers SNTP requests with the host time shifted by ahead.
+func fakeNTP(t *testing.T, ahead time.Duration) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 48)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 48 {
+				continue
+			}
+			resp := make([]byte, 48)
+			resp[0], resp[1] = 0x24, 2 // version 4, mode 4 (server), stratum 2
+			copy(resp[24:32], buf[40:48])
+			now := time.Now().Add(ahead)
+			for _, off := range []int{32, 40} {
+				binary.BigEndian.PutUint32(resp[off:], uint32(now.Unix()+ntpEpochOffset))
+				binary.BigEndian.PutUint32(resp[off+4:], uint32((uint64(now.Nanosecond())<<32)/1e9))
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestClockSkew(t *testing.T) {
+	t.Cleanup(func() {
+		timeConfig = TimeConfig{}
+		clockState.offset, clockState.rtt, clockState.synced, clockState.lastErr = 0, 0, time.Time{}, nil
+	})
+	healthz := func() (status string, clock map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var body struct {
+			Status string                 `json:"status"`
+			Clock  map[string]interface{} `json:"clock"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("GET /healthz = %d %s", rec.Code, rec.Body)
+		}
+		return body.Status, body.Clock
+	}
+
+	t.Setenv("NTP_SERVER", "")
+	if err := loadTimeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if status, clock := healthz(); status != "ok" || clock["source"] != "system" {
+		t.Errorf("without NTP: %s %v", status, clock)
+	}
+
+	t.Setenv("NTP_SERVER", fakeNTP(t, -10*time.Minute))
+	if err := loadTimeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := healthz(); status != "degraded" {
+		t.Errorf("before the first answer: %s", status)
+	}
+	syncClock(context.Background())
+	if off := time.Until(clockNow()); off > -10*time.Minute+time.Second || off < -10*time.Minute-time.Second {
+		t.Errorf("clockNow() is %v off, want -10m", off)
+	}
+	status, clock := healthz()
+	if skew, _ := clock["skew_ms"].(float64); status != "degraded" || skew < 599000 || skew > 601000 {
+		t.Errorf("10 minutes fast: %s %v", status, clock)
+	}
+
+	t.Setenv("NTP_INTERVAL_MS", "1000")
+	if err := loadTimeConfig(); err == nil {
+		t.Error("NTP_INTERVAL_MS=1000 accepted")
+	}
+}
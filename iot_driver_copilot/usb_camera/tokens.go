@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Short-lived stream URLs for embedding in dashboards:
+//
+//	POST /tokens {"path":"/stream","ttl_seconds":300}
+//	-> {"token":"...","url":"/stream?token=...","expires_at":"..."}
+//
+// The url is under HTTP_BASE_PATH; the token's path is not.
+//
+// A token is a signed claim (client, path, expiry), so the driver keeps no
+// state: it opens only the path it was minted for, acts as the client that
+// minted it (watermarks included) and stops being accepted at expiry. A
+// stream opened before then keeps running. Tokens are signed with
+// STREAM_TOKEN_SECRET; without one a random key is made at startup, and a
+// restart invalidates every token.
+
+// tokenPaths are the endpoints a token can be minted for.
+var tokenPaths = map[string]bool{"/stream": true, "/stream/ws": true, "/video/stream": true, "/snapshot": true, "/clip.gif": true, "/clip.mp4": true, "/barcodes/events": true}
+
+type TokenConfig struct {
+	Secret     []byte
+	DefaultTTL time.Duration // STREAM_TOKEN_TTL
+	MaxTTL     time.Duration // STREAM_TOKEN_MAX_TTL
+}
+
+var tokenConfig TokenConfig
+
+// --- TOKEN CONFIG ---
+func loadTokenConfig() error {
+	tokenConfig.Secret = []byte(os.Getenv("STREAM_TOKEN_SECRET"))
+	if len(tokenConfig.Secret) == 0 {
+		tokenConfig.Secret = make([]byte, 32)
+		if _, err := rand.Read(tokenConfig.Secret); err != nil {
+			return err
+		}
+	} else if len(tokenConfig.Secret) < 16 {
+		return errors.New("STREAM_TOKEN_SECRET must be at least 16 bytes")
+	}
+	tokenConfig.DefaultTTL, tokenConfig.MaxTTL = 5*time.Minute, time.Hour
+	for _, d := range []struct {
+		env string
+		dst *time.Duration
+	}{{"STREAM_TOKEN_TTL", &tokenConfig.DefaultTTL}, {"STREAM_TOKEN_MAX_TTL", &tokenConfig.MaxTTL}} {
+		if v := os.Getenv(d.env); v != "" {
+			ttl, err := time.ParseDuration(v)
+			if err != nil || ttl <= 0 {
+				return fmt.Errorf("%s must be a positive duration like 5m, got %q", d.env, v)
+			}
+			*d.dst = ttl
+		}
+	}
+	if tokenConfig.DefaultTTL > tokenConfig.MaxTTL {
+		return errors.New("STREAM_TOKEN_TTL exceeds STREAM_TOKEN_MAX_TTL")
+	}
+	return nil
+}
+
+type tokenClaims struct {
+	Client  string `json:"c"`
+	Path    string `json:"p"`
+	Expires int64  `json:"e"` // unix seconds
+}
+
+func tokenMAC(payload string) []byte {
+	m := hmac.New(sha256.New, tokenConfig.Secret)
+	m.Write([]byte(payload))
+	return m.Sum(nil)
+}
+
+func mintToken(c tokenClaims) string {
+	b, _ := json.Marshal(c)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(payload))
+}
+
+// verifyToken returns the client a token was minted by if it is genuine,
+// unexpired and for path.
+func verifyToken(tok, path string, now time.Time) (string, bool) {
+	payload, sig, ok := strings.Cut(tok, ".")
+	if !ok {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, tokenMAC(payload)) {
+		return "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", false
+	}
+	var c tokenClaims
+	if json.Unmarshal(b, &c) != nil || c.Path != path || now.Unix() >= c.Expires {
+		return "", false
+	}
+	return c.Client, true
+}
+
+// tokenAuth admits a request carrying a valid token query parameter, as
+// the client that minted it.
+func tokenAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tok := r.URL.Query().Get("token"); tok != "" && authEnabled() {
+			id, ok := verifyToken(tok, r.URL.Path, time.Now())
+			if !ok {
+				http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+			if !tenantAllowed(id) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next(w, r.WithContext(context.WithValue(r.Context(), clientIDKey, id)))
+			return
+		}
+		requireAuth(next)(w, r)
+	}
+}
+
+func handleMintToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Path       string `json:"path"`
+		TTLSeconds int    `json:"ttl_seconds"`
+	}
+	if r.ContentLength != 0 {
+		if !decodeJSONBody(w, r, &req) {
+			return
+		}
+	}
+	if req.Path == "" {
+		req.Path = "/stream"
+	}
+	if _, _, roiPath := roiMediaPath(req.Path); !tokenPaths[req.Path] && !roiPath {
+		jsonResponse(w, http.StatusBadRequest, map[string]string{"error": "path must be /stream, /stream/ws, /video/stream, /snapshot, /clip.gif, /clip.mp4, /barcodes/events, /roi/NAME/snapshot or /roi/NAME/stream"})
+		return
+	}
+	ttl := tokenConfig.DefaultTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+		if req.TTLSeconds < 0 || ttl > tokenConfig.MaxTTL {
+			jsonResponse(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("ttl_seconds must be 1-%d", int(tokenConfig.MaxTTL.Seconds()))})
+			return
+		}
+	}
+	exp := time.Now().Add(ttl).Truncate(time.Second)
+	tok := mintToken(tokenClaims{Client: clientIDFromRequest(r), Path: req.Path, Expires: exp.Unix()})
+	jsonResponse(w, http.StatusCreated, map[string]string{
+		"token":      tok,
+		"url":        httpBasePath + req.Path + "?token=" + url.QueryEscape(tok),
+		"expires_at": exp.UTC().Format(time.RFC3339),
+	})
+}
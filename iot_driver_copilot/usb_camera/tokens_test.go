@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamTokens(t *testing.T) {
+	savedKeys := apiKeys
+	defer func() { apiKeys = savedKeys }()
+	apiKeys = map[string]string{"s3cret": "alice"}
+	t.Setenv("STREAM_TOKEN_SECRET", "0123456789abcdef0123")
+	if err := loadTokenConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	mint := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer s3cret")
+		rec := httptest.NewRecorder()
+		requireAuth(handleMintToken)(rec, req)
+		return rec
+	}
+	rec := mint(`{"ttl_seconds":60}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("mint: %d %s", rec.Code, rec.Body)
+	}
+	var resp struct{ Token, URL string }
+	json.NewDecoder(rec.Body).Decode(&resp)
+
+	echo := tokenAuth(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(clientIDFromRequest(r))) })
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		echo(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		return rec
+	}
+	if rec := get(resp.URL); rec.Code != http.StatusOK || rec.Body.String() != "alice" {
+		t.Errorf("token URL: %d %q", rec.Code, rec.Body)
+	}
+	if rec := get("/snapshot?token=" + resp.Token); rec.Code != http.StatusUnauthorized {
+		t.Errorf("token for /stream opened /snapshot: %d", rec.Code)
+	}
+	if rec := get(resp.URL + "x"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("tampered token: %d", rec.Code)
+	}
+	if rec := get("/stream"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no credentials: %d", rec.Code)
+	}
+	if _, ok := verifyToken(resp.Token, "/stream", time.Now().Add(61*time.Second)); ok {
+		t.Error("expired token accepted")
+	}
+
+	for _, body := range []string{`{"path":"/capture/stop"}`, `{"ttl_seconds":7200}`, `{"ttl_seconds":-1}`} {
+		if rec := mint(body); rec.Code != http.StatusBadRequest {
+			t.Errorf("mint %s: %d", body, rec.Code)
+		}
+	}
+}
+
+func TestStreamTokensUnderBasePath(t *testing.T) {
+	t.Cleanup(func() { loadBasePath() })
+	t.Setenv("HTTP_BASE_PATH", "/cameras/dock-3/")
+	if err := loadBasePath(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTokenConfig(); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tokens", handleMintToken)
+	mux.HandleFunc("/stream", tokenAuth(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }))
+	h := mountAt(httpBasePath, mux)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/cameras/dock-3/tokens", nil))
+	var resp struct{ URL string }
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if !strings.HasPrefix(resp.URL, "/cameras/dock-3/stream?token=") {
+		t.Fatalf("token url %q is not under the base path", resp.URL)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, resp.URL, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("token url: %d %s", rec.Code, rec.Body)
+	}
+
+	t.Setenv("HTTP_BASE_PATH", "cameras")
+	if err := loadBasePath(); err == nil {
+		t.Error("HTTP_BASE_PATH without a leading / was accepted")
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"unsafe"
+
+	"github.com/blackjack/webcam"
+	"golang.org/x/sys/unix"
+)
+
+// Minimal V4L2 bindings for the "v4l2" backend: single-planar capture with
+// mmap'd streaming buffers. Struct layouts mirror <linux/videodev2.h>.
+
+const (
+	v4l2BufTypeVideoCapture = 1
+	v4l2MemoryMmap          = 1
+	v4l2FieldAny            = 0
+
+	v4l2CapVideoCapture = 0x00000001
+	v4l2CapStreaming    = 0x04000000
+	v4l2CapDeviceCaps   = 0x80000000
+
+	v4l2BufferCount = 4
+)
+
+var (
+	v4l2PixFmtMJPEG = fourcc('M', 'J', 'P', 'G')
+	v4l2PixFmtYUYV  = fourcc('Y', 'U', 'Y', 'V')
+)
+
+func fourcc(a, b, c, d byte) uint32 {
+	return uint32(a) | uint32(b)<<8 | uint32(c)<<16 | uint32(d)<<24
+}
+
+type v4l2Capability struct {
+	Driver       [16]byte
+	Card         [32]byte
+	BusInfo      [32]byte
+	Version      uint32
+	Capabilities uint32
+	DeviceCaps   uint32
+	Reserved     [3]uint32
+}
+
+type v4l2PixFormat struct {
+	Width        uint32
+	Height       uint32
+	PixelFormat  uint32
+	Field        uint32
+	BytesPerLine uint32
+	SizeImage    uint32
+	Colorspace   uint32
+	Priv         uint32
+	Flags        uint32
+	YcbcrEnc     uint32
+	Quantization uint32
+	XferFunc     uint32
+}
+
+// v4l2Format's union contains pointers, so it is pointer-aligned; a
+// []uintptr-backed raw area reproduces that on both 32- and 64-bit.
+type v4l2Format struct {
+	Type uint32
+	Fmt  [200 / unsafe.Sizeof(uintptr(0))]uintptr
+}
+
+func (f *v4l2Format) pix() *v4l2PixFormat { return (*v4l2PixFormat)(unsafe.Pointer(&f.Fmt[0])) }
+
+type v4l2Fract struct {
+	Numerator   uint32
+	Denominator uint32
+}
+
+type v4l2StreamParm struct {
+	Type         uint32
+	Capability   uint32
+	CaptureMode  uint32
+	TimePerFrame v4l2Fract
+	ExtendedMode uint32
+	ReadBuffers  uint32
+	Reserved     [4]uint32
+	_            [200 - 40]byte
+}
+
+type v4l2RequestBuffers struct {
+	Count        uint32
+	Type         uint32
+	Memory       uint32
+	Capabilities uint32
+	Flags        uint8
+	Reserved     [3]uint8
+}
+
+type v4l2Buffer struct {
+	Index     uint32
+	Type      uint32
+	BytesUsed uint32
+	Flags     uint32
+	Field     uint32
+	Timestamp unix.Timeval
+	Timecode  [16]byte
+	Sequence  uint32
+	Memory    uint32
+	M         uintptr // union: offset for MEMORY_MMAP (low 32 bits)
+	Length    uint32
+	Reserved2 uint32
+	RequestFD uint32
+}
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | uintptr('V')<<8 | nr
+}
+
+const (
+	iocWrite = 1
+	iocRead  = 2
+)
+
+var (
+	vidiocQueryCap  = ioc(iocRead, 0, unsafe.Sizeof(v4l2Capability{}))
+	vidiocSFmt      = ioc(iocRead|iocWrite, 5, unsafe.Sizeof(v4l2Format{}))
+	vidiocReqBufs   = ioc(iocRead|iocWrite, 8, unsafe.Sizeof(v4l2RequestBuffers{}))
+	vidiocQueryBuf  = ioc(iocRead|iocWrite, 9, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocQBuf      = ioc(iocRead|iocWrite, 15, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocDQBuf     = ioc(iocRead|iocWrite, 17, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocStreamOn  = ioc(iocWrite, 18, unsafe.Sizeof(int32(0)))
+	vidiocStreamOff = ioc(iocWrite, 19, unsafe.Sizeof(int32(0)))
+	vidiocSParm     = ioc(iocRead|iocWrite, 22, unsafe.Sizeof(v4l2StreamParm{}))
+)
+
+func v4l2Ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// v4l2Source captures through direct ioctls, without cgo, lending its
+// buffers out as frames (see framebuf.go).
+type v4l2Source struct {
+	fd      int
+	buffers [][]byte
+	pool    *framePool
+
+	mu     sync.Mutex
+	lent   map[*byte]v4l2Buffer // by the frame's first byte
+	closed bool
+}
+
+func openV4L2Source(cfg CameraConfig) (FrameSource, sourceInfo, error) {
+	fd, err := unix.Open(cfg.DevicePath, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, sourceInfo{}, fmt.Errorf("open %s: %w", cfg.DevicePath, err)
+	}
+	s := &v4l2Source{fd: fd, lent: map[*byte]v4l2Buffer{}}
+	info, err := s.configure(cfg)
+	if err != nil {
+		s.Close()
+		return nil, sourceInfo{}, err
+	}
+	return s, info, nil
+}
+
+func (s *v4l2Source) configure(cfg CameraConfig) (sourceInfo, error) {
+	var capab v4l2Capability
+	if err := v4l2Ioctl(s.fd, vidiocQueryCap, unsafe.Pointer(&capab)); err != nil {
+		return sourceInfo{}, fmt.Errorf("VIDIOC_QUERYCAP: %w", err)
+	}
+	caps := capab.Capabilities
+	if caps&v4l2CapDeviceCaps != 0 {
+		caps = capab.DeviceCaps
+	}
+	if caps&v4l2CapVideoCapture == 0 || caps&v4l2CapStreaming == 0 {
+		return sourceInfo{}, fmt.Errorf("%s is not a streaming video capture node", cfg.DevicePath)
+	}
+
+	pixFmt := v4l2PixFmtMJPEG
+	if cfg.Format == "YUYV" {
+		pixFmt = v4l2PixFmtYUYV
+	} else if cfg.Format != "MJPEG" {
+		return sourceInfo{}, errors.New("unsupported camera format")
+	}
+	f := v4l2Format{Type: v4l2BufTypeVideoCapture}
+	p := f.pix()
+	p.Width, p.Height, p.PixelFormat, p.Field = cfg.Width, cfg.Height, pixFmt, v4l2FieldAny
+	if err := v4l2Ioctl(s.fd, vidiocSFmt, unsafe.Pointer(&f)); err != nil {
+		return sourceInfo{}, fmt.Errorf("VIDIOC_S_FMT: %w", err)
+	}
+	if p.PixelFormat != pixFmt {
+		return sourceInfo{}, errors.New("unsupported camera format")
+	}
+	info := sourceInfo{Format: cfg.Format, Width: p.Width, Height: p.Height, FPS: cfg.FPS}
+
+	if cfg.FPS > 0 {
+		parm := v4l2StreamParm{Type: v4l2BufTypeVideoCapture, TimePerFrame: v4l2Fract{1, cfg.FPS}}
+		if err := v4l2Ioctl(s.fd, vidiocSParm, unsafe.Pointer(&parm)); err == nil && parm.TimePerFrame.Numerator > 0 {
+			info.FPS = parm.TimePerFrame.Denominator / parm.TimePerFrame.Numerator
+		}
+	}
+
+	req := v4l2RequestBuffers{Count: v4l2BufferCount, Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+	if err := v4l2Ioctl(s.fd, vidiocReqBufs, unsafe.Pointer(&req)); err != nil {
+		return sourceInfo{}, fmt.Errorf("VIDIOC_REQBUFS: %w", err)
+	}
+	for i := uint32(0); i < req.Count; i++ {
+		buf := v4l2Buffer{Index: i, Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+		if err := v4l2Ioctl(s.fd, vidiocQueryBuf, unsafe.Pointer(&buf)); err != nil {
+			return sourceInfo{}, fmt.Errorf("VIDIOC_QUERYBUF: %w", err)
+		}
+		mem, err := unix.Mmap(s.fd, int64(uint32(buf.M)), int(buf.Length), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			return sourceInfo{}, fmt.Errorf("mmap buffer %d: %w", i, err)
+		}
+		s.buffers = append(s.buffers, mem)
+		if s.pool == nil {
+			s.pool = newFramePool(int(buf.Length))
+		}
+		if err := v4l2Ioctl(s.fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+			return sourceInfo{}, fmt.Errorf("VIDIOC_QBUF: %w", err)
+		}
+	}
+	typ := int32(v4l2BufTypeVideoCapture)
+	genlockStart()
+	if err := v4l2Ioctl(s.fd, vidiocStreamOn, unsafe.Pointer(&typ)); err != nil {
+		return sourceInfo{}, fmt.Errorf("VIDIOC_STREAMON: %w", err)
+	}
+	return info, nil
+}
+
+func (s *v4l2Source) WaitForFrame(timeout uint32) error {
+	fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLIN}}
+	for {
+		n, err := unix.Poll(fds, int(timeout)*1000)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return new(webcam.Timeout)
+		}
+		return nil
+	}
+}
+
+func (s *v4l2Source) ReadFrame() ([]byte, error) {
+	buf := v4l2Buffer{Type: v4l2BufTypeVideoCapture, Memory: v4l2MemoryMmap}
+	if err := v4l2Ioctl(s.fd, vidiocDQBuf, unsafe.Pointer(&buf)); err != nil {
+		if err == unix.EAGAIN {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("VIDIOC_DQBUF: %w", err)
+	}
+	mem := s.buffers[buf.Index]
+	frame := mem[:buf.BytesUsed:buf.BytesUsed]
+	if buf.BytesUsed > 0 && s.lend(frame, buf) {
+		timeFrame(frame, kernelFrameTime(&buf))
+		lendFrame(frame, mem, s)
+		framesZeroCopy.Add(1)
+		return frame, nil
+	}
+	if buf.BytesUsed > 0 {
+		frame = s.pool.copyFrame(frame)
+		timeFrame(frame, kernelFrameTime(&buf))
+	} else {
+		frame = nil
+	}
+	if err := v4l2Ioctl(s.fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+		return frame, fmt.Errorf("VIDIOC_QBUF: %w", err)
+	}
+	return frame, nil
+}
+
+// lend marks buf as out, unless CAPTURE_LEASED_BUFFERS already are.
+func (s *v4l2Source) lend(frame []byte, buf v4l2Buffer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || len(s.lent) >= frameBufferConfig.LeasedBuffers {
+		return false
+	}
+	s.lent[unsafe.SliceData(frame)] = buf
+	return true
+}
+
+// takeBack queues a lent buffer for capture again, or unmaps it once the
+// source is closed. s.mu is held across the ioctl so that Close, which sets
+// closed under it, can't close the fd (and the number be reused) first.
+func (s *v4l2Source) takeBack(mem []byte) {
+	p := unsafe.SliceData(mem)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf, ok := s.lent[p]
+	delete(s.lent, p)
+	switch {
+	case !ok:
+	case s.closed:
+		_ = unix.Munmap(mem)
+	default:
+		if err := v4l2Ioctl(s.fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+			log.Printf("v4l2: requeueing buffer %d: %v", buf.Index, err)
+		}
+	}
+}
+
+func (s *v4l2Source) StopStreaming() error {
+	typ := int32(v4l2BufTypeVideoCapture)
+	return v4l2Ioctl(s.fd, vidiocStreamOff, unsafe.Pointer(&typ))
+}
+
+// Close unmaps the buffers that are not lent out; those are unmapped as
+// they are released.
+func (s *v4l2Source) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for _, b := range s.buffers {
+		if _, out := s.lent[unsafe.SliceData(b)]; !out {
+			_ = unix.Munmap(b)
+		}
+	}
+	s.buffers = nil
+	s.mu.Unlock()
+	if s.pool != nil {
+		s.pool.close()
+	}
+	return unix.Close(s.fd)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// V4L2 memory-to-memory JPEG encoders, as found on SoCs with a hardware
+// JPEG block: YUYV frames are queued on the OUTPUT side and the JPEG is
+// dequeued from the CAPTURE side. Both single- and multi-planar APIs are
+// handled; one buffer per side, since frames are encoded one at a time.
+
+const (
+	v4l2BufTypeVideoOutput        = 2
+	v4l2BufTypeVideoCaptureMplane = 9
+	v4l2BufTypeVideoOutputMplane  = 10
+	v4l2FieldNone                 = 1
+
+	v4l2CapVideoM2MMplane = 0x00004000
+	v4l2CapVideoM2M       = 0x00008000
+
+	v4l2CIDJPEGCompressionQuality = 0x009d0903
+)
+
+var v4l2PixFmtJPEG = fourcc('J', 'P', 'E', 'G')
+
+type v4l2PlanePixFormat struct {
+	SizeImage    uint32
+	BytesPerLine uint32
+	Reserved     [6]uint16
+}
+
+type v4l2PixFormatMplane struct {
+	Width        uint32
+	Height       uint32
+	PixelFormat  uint32
+	Field        uint32
+	Colorspace   uint32
+	PlaneFmt     [8]v4l2PlanePixFormat
+	NumPlanes    uint8
+	Flags        uint8
+	YcbcrEnc     uint8
+	Quantization uint8
+	XferFunc     uint8
+	Reserved     [7]uint8
+}
+
+func (f *v4l2Format) pixMp() *v4l2PixFormatMplane {
+	return (*v4l2PixFormatMplane)(unsafe.Pointer(&f.Fmt[0]))
+}
+
+type v4l2Plane struct {
+	BytesUsed  uint32
+	Length     uint32
+	M          uintptr // union: mem_offset for MEMORY_MMAP (low 32 bits)
+	DataOffset uint32
+	Reserved   [11]uint32
+}
+
+type v4l2Control struct {
+	ID    uint32
+	Value int32
+}
+
+var vidiocSCtrl = ioc(iocRead|iocWrite, 28, unsafe.Sizeof(v4l2Control{}))
+
+type v4l2Encoder struct {
+	mu      sync.Mutex // the device encodes one frame at a time
+	path    string
+	fd      int
+	mplane  bool
+	outType uint32
+	capType uint32
+
+	width, height, quality int
+	outStride              int
+	out, cap               []byte // mmap'd buffers, nil when not set up
+}
+
+// openV4L2Encoder opens path, or with path "" the first M2M JPEG encoder
+// under /dev/video*.
+func openV4L2Encoder(path string) (jpegEncoder, error) {
+	if path != "" {
+		return probeV4L2Encoder(path)
+	}
+	nodes, _ := filepath.Glob("/dev/video*")
+	for _, p := range nodes {
+		if e, err := probeV4L2Encoder(p); err == nil {
+			return e, nil
+		}
+	}
+	return nil, errors.New("no V4L2 JPEG encoder found")
+}
+
+func probeV4L2Encoder(path string) (*v4l2Encoder, error) {
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	e := &v4l2Encoder{path: path, fd: fd}
+	var capab v4l2Capability
+	if err := v4l2Ioctl(fd, vidiocQueryCap, unsafe.Pointer(&capab)); err != nil {
+		e.Close()
+		return nil, fmt.Errorf("%s: VIDIOC_QUERYCAP: %w", path, err)
+	}
+	caps := capab.Capabilities
+	if caps&v4l2CapDeviceCaps != 0 {
+		caps = capab.DeviceCaps
+	}
+	switch {
+	case caps&v4l2CapVideoM2MMplane != 0:
+		e.mplane, e.outType, e.capType = true, v4l2BufTypeVideoOutputMplane, v4l2BufTypeVideoCaptureMplane
+	case caps&v4l2CapVideoM2M != 0:
+		e.outType, e.capType = v4l2BufTypeVideoOutput, v4l2BufTypeVideoCapture
+	default:
+		e.Close()
+		return nil, fmt.Errorf("%s is not a memory-to-memory device", path)
+	}
+	// Probe with a common size; the real one is set on the first frame.
+	if err := e.setup(640, 480, encoderConfig.Quality); err != nil {
+		e.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return e, nil
+}
+
+func (e *v4l2Encoder) Name() string { return "v4l2 " + e.path }
+
+// setFormat sets one side's format and returns the resulting bytes per line.
+func (e *v4l2Encoder) setFormat(typ uint32, pixFmt uint32, width, height int) (uint32, int, error) {
+	f := v4l2Format{Type: typ}
+	if e.mplane {
+		p := f.pixMp()
+		p.Width, p.Height, p.PixelFormat, p.Field, p.NumPlanes = uint32(width), uint32(height), pixFmt, v4l2FieldNone, 1
+		if err := v4l2Ioctl(e.fd, vidiocSFmt, unsafe.Pointer(&f)); err != nil {
+			return 0, 0, err
+		}
+		return p.PixelFormat, int(p.PlaneFmt[0].BytesPerLine), nil
+	}
+	p := f.pix()
+	p.Width, p.Height, p.PixelFormat, p.Field = uint32(width), uint32(height), pixFmt, v4l2FieldNone
+	if err := v4l2Ioctl(e.fd, vidiocSFmt, unsafe.Pointer(&f)); err != nil {
+		return 0, 0, err
+	}
+	return p.PixelFormat, int(p.BytesPerLine), nil
+}
+
+// bufIoctl issues a buffer ioctl for buffer 0 of type typ, hiding the
+// single/multi-planar difference. It returns the buffer's bytes used,
+// length and mmap offset.
+func (e *v4l2Encoder) bufIoctl(req uintptr, typ uint32, bytesUsed int) (used, length int, offset int64, err error) {
+	buf := v4l2Buffer{Type: typ, Memory: v4l2MemoryMmap, BytesUsed: uint32(bytesUsed), Field: v4l2FieldNone}
+	if !e.mplane {
+		err = v4l2Ioctl(e.fd, req, unsafe.Pointer(&buf))
+		return int(buf.BytesUsed), int(buf.Length), int64(uint32(buf.M)), err
+	}
+	plane := new(v4l2Plane)
+	plane.BytesUsed = uint32(bytesUsed)
+	buf.M, buf.Length = uintptr(unsafe.Pointer(plane)), 1
+	err = v4l2Ioctl(e.fd, req, unsafe.Pointer(&buf))
+	runtime.KeepAlive(plane)
+	return int(plane.BytesUsed), int(plane.Length), int64(uint32(plane.M)), err
+}
+
+func (e *v4l2Encoder) setup(width, height, quality int) error {
+	e.teardown()
+	pf, stride, err := e.setFormat(e.outType, v4l2PixFmtYUYV, width, height)
+	if err != nil || pf != v4l2PixFmtYUYV {
+		return fmt.Errorf("YUYV input at %dx%d not supported (%v)", width, height, err)
+	}
+	if stride < width*2 {
+		stride = width * 2
+	}
+	if pf, _, err = e.setFormat(e.capType, v4l2PixFmtJPEG, width, height); err != nil || pf != v4l2PixFmtJPEG {
+		if pf, _, err = e.setFormat(e.capType, v4l2PixFmtMJPEG, width, height); err != nil || pf != v4l2PixFmtMJPEG {
+			return fmt.Errorf("JPEG output not supported (%v)", err)
+		}
+	}
+	// Not every encoder exposes the quality control; it keeps its default then.
+	ctrl := v4l2Control{ID: v4l2CIDJPEGCompressionQuality, Value: int32(quality)}
+	_ = v4l2Ioctl(e.fd, vidiocSCtrl, unsafe.Pointer(&ctrl))
+
+	for _, side := range []struct {
+		typ uint32
+		mem *[]byte
+	}{{e.outType, &e.out}, {e.capType, &e.cap}} {
+		req := v4l2RequestBuffers{Count: 1, Type: side.typ, Memory: v4l2MemoryMmap}
+		if err := v4l2Ioctl(e.fd, vidiocReqBufs, unsafe.Pointer(&req)); err != nil {
+			return fmt.Errorf("VIDIOC_REQBUFS: %w", err)
+		}
+		_, length, offset, err := e.bufIoctl(vidiocQueryBuf, side.typ, 0)
+		if err != nil {
+			return fmt.Errorf("VIDIOC_QUERYBUF: %w", err)
+		}
+		mem, err := unix.Mmap(e.fd, offset, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+		*side.mem = mem
+		typ := int32(side.typ)
+		if err := v4l2Ioctl(e.fd, vidiocStreamOn, unsafe.Pointer(&typ)); err != nil {
+			return fmt.Errorf("VIDIOC_STREAMON: %w", err)
+		}
+	}
+	e.width, e.height, e.quality, e.outStride = width, height, quality, stride
+	return nil
+}
+
+func (e *v4l2Encoder) teardown() {
+	for _, side := range []struct {
+		typ uint32
+		mem *[]byte
+	}{{e.outType, &e.out}, {e.capType, &e.cap}} {
+		typ := int32(side.typ)
+		_ = v4l2Ioctl(e.fd, vidiocStreamOff, unsafe.Pointer(&typ))
+		if *side.mem != nil {
+			_ = unix.Munmap(*side.mem)
+			*side.mem = nil
+		}
+		req := v4l2RequestBuffers{Count: 0, Type: side.typ, Memory: v4l2MemoryMmap}
+		_ = v4l2Ioctl(e.fd, vidiocReqBufs, unsafe.Pointer(&req))
+	}
+	e.width, e.height = 0, 0
+}
+
+// dequeue waits up to two seconds for buffer 0 of type typ to come back.
+func (e *v4l2Encoder) dequeue(typ uint32, events int16) (int, error) {
+	fds := []unix.PollFd{{Fd: int32(e.fd), Events: events}}
+	for attempt := 0; ; attempt++ {
+		used, _, _, err := e.bufIoctl(vidiocDQBuf, typ, 0)
+		if err != unix.EAGAIN {
+			return used, err
+		}
+		if attempt == 1 {
+			return 0, errors.New("encoder timed out")
+		}
+		if _, err := unix.Poll(fds, 2000); err != nil && err != unix.EINTR {
+			return 0, err
+		}
+	}
+}
+
+func (e *v4l2Encoder) EncodeYUYV(frame []byte, width, height, quality int) ([]byte, error) {
+	if len(frame) < width*height*2 {
+		return nil, fmt.Errorf("short YUYV frame (%d bytes for %dx%d)", len(frame), width, height)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fd < 0 {
+		return nil, errors.New("encoder closed")
+	}
+	if width != e.width || height != e.height || quality != e.quality {
+		if err := e.setup(width, height, quality); err != nil {
+			return nil, err
+		}
+	}
+	row := width * 2
+	if e.outStride*(height-1)+row > len(e.out) {
+		return nil, errors.New("encoder input buffer too small")
+	}
+	for y := 0; y < height; y++ {
+		copy(e.out[y*e.outStride:], frame[y*row:(y+1)*row])
+	}
+	if _, _, _, err := e.bufIoctl(vidiocQBuf, e.capType, 0); err != nil {
+		return nil, fmt.Errorf("VIDIOC_QBUF: %w", err)
+	}
+	if _, _, _, err := e.bufIoctl(vidiocQBuf, e.outType, e.outStride*height); err != nil {
+		return nil, fmt.Errorf("VIDIOC_QBUF: %w", err)
+	}
+	n, err := e.dequeue(e.capType, unix.POLLIN)
+	if err != nil {
+		return nil, fmt.Errorf("VIDIOC_DQBUF: %w", err)
+	}
+	if _, err := e.dequeue(e.outType, unix.POLLOUT); err != nil {
+		return nil, fmt.Errorf("VIDIOC_DQBUF: %w", err)
+	}
+	jpg := make([]byte, n)
+	copy(jpg, e.cap[:n])
+	return jpg, nil
+}
+
+func (e *v4l2Encoder) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fd < 0 {
+		return nil
+	}
+	e.teardown()
+	err := unix.Close(e.fd)
+	e.fd = -1
+	return err
+}
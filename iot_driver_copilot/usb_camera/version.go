@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Build identity, stamped with
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.gitCommit=... -X main.buildDate=..."
+//
+// (the Dockerfile takes them as VERSION, GIT_COMMIT and BUILD_DATE build
+// args). Unstamped fields come from the go command's VCS stamp, if any.
+var (
+	version   = "dev"
+	gitCommit = ""
+	buildDate = ""
+)
+
+type versionInfo struct {
+	Version   string        `json:"version"`
+	GitCommit string        `json:"git_commit,omitempty"`
+	Modified  bool          `json:"modified,omitempty"`
+	BuildDate string        `json:"build_date,omitempty"`
+	GoVersion string        `json:"go_version"`
+	Platform  string        `json:"platform"`
+	Update    *updateStatus `json:"update,omitempty"`
+}
+
+func buildVersion() versionInfo {
+	v := versionInfo{Version: version, GitCommit: gitCommit, BuildDate: buildDate,
+		GoVersion: runtime.Version(), Platform: runtime.GOOS + "/" + runtime.GOARCH}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	if v.Version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		v.Version = strings.TrimPrefix(bi.Main.Version, "v")
+	}
+	for _, s := range bi.Settings {
+		switch {
+		case s.Key == "vcs.revision" && v.GitCommit == "":
+			v.GitCommit = s.Value
+		case s.Key == "vcs.time" && v.BuildDate == "":
+			v.BuildDate = s.Value
+		case s.Key == "vcs.modified" && gitCommit == "":
+			v.Modified = s.Value == "true"
+		}
+	}
+	return v
+}
+
+// --- UPDATE CHECK ---
+// UPDATE_MANIFEST_URL points at {"version": "1.5.0", "url": "...", "notes": "..."}.
+// GET /version compares it with the running version; it only reports, the
+// driver never downloads anything.
+
+type UpdateConfig struct {
+	ManifestURL string
+	Interval    time.Duration // UPDATE_CHECK_INTERVAL: how long a result is reused
+}
+
+var (
+	updateConfig UpdateConfig
+	updates      = &updateChecker{client: &http.Client{Timeout: 10 * time.Second}}
+)
+
+func loadUpdateConfig() error {
+	updateConfig.ManifestURL = os.Getenv("UPDATE_MANIFEST_URL")
+	updateConfig.Interval = 6 * time.Hour
+	if v := os.Getenv("UPDATE_CHECK_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("UPDATE_CHECK_INTERVAL must be a positive duration like 6h, got %q", v)
+		}
+		updateConfig.Interval = d
+	}
+	if m := updateConfig.ManifestURL; m != "" {
+		if u, err := url.Parse(m); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("UPDATE_MANIFEST_URL must be an http(s) URL, got %q", m)
+		}
+	}
+	return nil
+}
+
+type updateManifest struct {
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	Notes   string `json:"notes"`
+}
+
+type updateStatus struct {
+	Checked   time.Time `json:"checked"`
+	Current   string    `json:"current"`
+	Latest    string    `json:"latest,omitempty"`
+	Available bool      `json:"available"`
+	URL       string    `json:"url,omitempty"`
+	Notes     string    `json:"notes,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type updateChecker struct {
+	client *http.Client
+
+	mu   sync.Mutex
+	last *updateStatus
+	next time.Time
+}
+
+// status returns the last result until it goes stale (a failed check is
+// retried after a minute), or fetches the manifest again when force is set.
+func (u *updateChecker) status(ctx context.Context, manifestURL string, interval time.Duration, current string, force bool) updateStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.last != nil && !force && time.Now().Before(u.next) {
+		return *u.last
+	}
+	s := updateStatus{Checked: time.Now().UTC(), Current: current}
+	m, err := u.fetch(ctx, manifestURL)
+	if err != nil {
+		s.Error = err.Error()
+		u.next = s.Checked.Add(min(interval, time.Minute))
+	} else {
+		s.Latest, s.URL, s.Notes = m.Version, m.URL, m.Notes
+		s.Available = newerVersion(m.Version, current)
+		u.next = s.Checked.Add(interval)
+	}
+	u.last = &s
+	return s
+}
+
+func (u *updateChecker) fetch(ctx context.Context, manifestURL string) (updateManifest, error) {
+	var m updateManifest
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return m, err
+	}
+	req.Header.Set("User-Agent", "camera-driver/"+version)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return m, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return m, fmt.Errorf("manifest: %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&m); err != nil {
+		return m, fmt.Errorf("manifest: %w", err)
+	}
+	if _, ok := parseSemver(m.Version); !ok {
+		return m, fmt.Errorf("manifest: invalid version %q", m.Version)
+	}
+	return m, nil
+}
+
+// semver is a parsed MAJOR.MINOR.PATCH[-PRERELEASE][+BUILD]; a leading "v"
+// is accepted and build metadata is ignored.
+type semver struct {
+	core [3]int
+	pre  []string
+}
+
+func parseSemver(s string) (semver, bool) {
+	var v semver
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.pre = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v.core[i] = n
+	}
+	for _, id := range v.pre {
+		if id == "" {
+			return v, false
+		}
+	}
+	return v, true
+}
+
+// compareSemver orders a and b by semver precedence.
+func compareSemver(a, b semver) int {
+	for i := range a.core {
+		if a.core[i] != b.core[i] {
+			if a.core[i] < b.core[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	// A release outranks its pre-releases.
+	switch {
+	case len(a.pre) == 0 && len(b.pre) == 0:
+		return 0
+	case len(a.pre) == 0:
+		return 1
+	case len(b.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.pre) && i < len(b.pre); i++ {
+		x, y := a.pre[i], b.pre[i]
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		switch {
+		case xerr == nil && yerr == nil:
+			if xn != yn {
+				if xn < yn {
+					return -1
+				}
+				return 1
+			}
+		case xerr == nil: // numeric identifiers sort first
+			return -1
+		case yerr == nil:
+			return 1
+		case x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a.pre) < len(b.pre):
+		return -1
+	case len(a.pre) > len(b.pre):
+		return 1
+	}
+	return 0
+}
+
+// newerVersion reports whether latest is a higher version than current. A
+// development build ("dev") never reports an update.
+func newerVersion(latest, current string) bool {
+	l, ok := parseSemver(latest)
+	if !ok {
+		return false
+	}
+	c, ok := parseSemver(current)
+	return ok && compareSemver(l, c) > 0
+}
+
+// GET /version[?check=true]
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	v := buildVersion()
+	if updateConfig.ManifestURL != "" {
+		s := updates.status(r.Context(), updateConfig.ManifestURL, updateConfig.Interval, v.Version, r.URL.Query().Get("check") == "true")
+		v.Update = &s
+	}
+	jsonResponse(w, http.StatusOK, v)
+}
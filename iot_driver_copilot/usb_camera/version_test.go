@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestVersionUpdateCheck(t *testing.T) {
+	var hits atomic.Int32
+	manifest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte(`{"version": "v2.1.0", "url": "https://example.com/camera/2.1.0"}`))
+	}))
+	defer manifest.Close()
+
+	savedVersion, savedUpdates := version, updates
+	// Cleanups run last-in first-out, so this one sees the environment the
+	// t.Setenv calls below restore.
+	t.Cleanup(func() { version, updates = savedVersion, savedUpdates; loadUpdateConfig() })
+	version = "2.0.3"
+	updates = &updateChecker{client: manifest.Client()}
+	t.Setenv("UPDATE_MANIFEST_URL", manifest.URL+"/manifest.json")
+	t.Setenv("UPDATE_CHECK_INTERVAL", "1h")
+	if err := loadUpdateConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(url string) versionInfo {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleVersion(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", url, rec.Code, rec.Body)
+		}
+		var v versionInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	v := get("/version")
+	if v.Version != "2.0.3" || v.GoVersion == "" || v.Update == nil {
+		t.Fatalf("version info: %+v", v)
+	}
+	if u := v.Update; !u.Available || u.Current != "2.0.3" || u.Latest != "v2.1.0" || u.URL != "https://example.com/camera/2.1.0" {
+		t.Fatalf("update: %+v", u)
+	}
+	get("/version")
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("manifest fetched %d times, want 1", n)
+	}
+	get("/version?check=true")
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("manifest fetched %d times after ?check=true, want 2", n)
+	}
+
+	version = "2.1.0-rc.1"
+	if s := updates.status(context.Background(), updateConfig.ManifestURL, updateConfig.Interval, version, true); !s.Available {
+		t.Fatalf("2.1.0 not newer than %s: %+v", version, s)
+	}
+	version = "2.1.0"
+	if s := updates.status(context.Background(), updateConfig.ManifestURL, updateConfig.Interval, version, true); s.Available {
+		t.Fatalf("update reported for the current release: %+v", s)
+	}
+
+	for _, bad := range []string{"ftp://example.com/m.json", "manifest.json"} {
+		t.Setenv("UPDATE_MANIFEST_URL", bad)
+		if err := loadUpdateConfig(); err == nil {
+			t.Errorf("UPDATE_MANIFEST_URL=%s accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type WatchdogConfig struct {
+	Device   string        // e.g. /dev/watchdog; empty disables the hardware watchdog
+	Interval time.Duration // pat interval
+	Stall    time.Duration // max gap between frames while someone is streaming
+}
+
+var (
+	watchdogConfig WatchdogConfig
+
+	// Capture progress, updated by the streaming loops.
+	lastFrameAt   atomic.Int64 // unix nanos
+	activeStreams atomic.Int32
+)
+
+// --- WATCHDOG CONFIG ---
+func loadWatchdogConfig() error {
+	watchdogConfig.Device = os.Getenv("WATCHDOG_DEVICE")
+	watchdogConfig.Interval = 5 * time.Second
+	watchdogConfig.Stall = 30 * time.Second
+	if v := os.Getenv("WATCHDOG_INTERVAL_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil && ms > 0 {
+			watchdogConfig.Interval = time.Duration(ms) * time.Millisecond
+		}
+	}
+	if v := os.Getenv("WATCHDOG_STALL_MS"); v != "" {
+		if ms, err := strconv.Atoi(v); err == nil && ms > 0 {
+			watchdogConfig.Stall = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return nil
+}
+
+func markFrame() {
+	lastFrameAt.Store(time.Now().UnixNano())
+	framesCaptured.Add(1)
+}
+
+// captureHealthy reports whether capture is making progress. An idle driver
+// (not capturing, or capturing with nobody reading) is healthy; a capture
+// loop that stops receiving frames while clients are streaming is not.
+func captureHealthy() bool {
+	cameraState.mu.Lock()
+	running := cameraState.running
+	cameraState.mu.Unlock()
+	if !running || activeStreams.Load() == 0 {
+		return true
+	}
+	return time.Since(time.Unix(0, lastFrameAt.Load())) < watchdogConfig.Stall
+}
+
+// systemdWatchdogInterval returns WATCHDOG_USEC when it is addressed to this process.
+func systemdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdogLoop pats /dev/watchdog and/or the systemd watchdog only while
+// captureHealthy holds, so a wedged capture gets the box or service restarted.
+// When ctx ends the hardware watchdog is disarmed with the magic close.
+func watchdogLoop(ctx context.Context) {
+	sdInterval := systemdWatchdogInterval()
+	var dev *os.File
+	if watchdogConfig.Device != "" {
+		f, err := os.OpenFile(watchdogConfig.Device, os.O_WRONLY, 0)
+		if err != nil {
+			log.Printf("watchdog: open %s: %v", watchdogConfig.Device, err)
+		} else {
+			dev = f
+		}
+	}
+	if dev == nil && sdInterval == 0 {
+		return
+	}
+	interval := watchdogConfig.Interval
+	if sdInterval > 0 && sdInterval/2 < interval {
+		interval = sdInterval / 2
+	}
+	log.Printf("watchdog: patting every %v while capture progresses (stall limit %v)", interval, watchdogConfig.Stall)
+	warned := false
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if dev != nil {
+				// Magic close: disarm the hardware watchdog on a clean shutdown.
+				_, _ = dev.Write([]byte("V"))
+				dev.Close()
+			}
+			return
+		case <-t.C:
+		}
+		if !captureHealthy() {
+			if !warned {
+				log.Printf("watchdog: capture stalled, no longer patting")
+				warned = true
+			}
+			continue
+		}
+		warned = false
+		if dev != nil {
+			if _, err := dev.Write([]byte{0}); err != nil {
+				log.Printf("watchdog: pat %s: %v", watchdogConfig.Device, err)
+			}
+		}
+		if sdInterval > 0 {
+			_ = sdNotify("WATCHDOG=1")
+		}
+	}
+}
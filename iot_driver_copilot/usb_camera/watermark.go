@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+type WatermarkConfig struct {
+	Enabled  bool
+	Position string  // "top-left", "top-right", "bottom-left", "bottom-right", "center"
+	Opacity  float64 // 0..1
+	Quality  int     // JPEG quality used when re-encoding watermarked frames
+}
+
+var watermarkConfig WatermarkConfig
+
+const watermarkMargin = 4
+
+// --- WATERMARK CONFIG ---
+func loadWatermarkConfig() error {
+	watermarkConfig.Enabled = strings.EqualFold(os.Getenv("WATERMARK_ENABLED"), "true")
+	watermarkConfig.Position = strings.ToLower(os.Getenv("WATERMARK_POSITION"))
+	switch watermarkConfig.Position {
+	case "top-left", "top-right", "bottom-left", "bottom-right", "center":
+	default:
+		watermarkConfig.Position = "bottom-right"
+	}
+	watermarkConfig.Opacity = 0.5
+	if v := os.Getenv("WATERMARK_OPACITY"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+			watermarkConfig.Opacity = f
+		}
+	}
+	watermarkConfig.Quality = jpeg.DefaultQuality
+	if v := os.Getenv("WATERMARK_JPEG_QUALITY"); v != "" {
+		if q, err := strconv.Atoi(v); err == nil && q >= 1 && q <= 100 {
+			watermarkConfig.Quality = q
+		}
+	}
+	return nil
+}
+
+// watermarkFor returns the text to embed for the given client, or "" when
+// frames for this client should be served unmodified.
+func watermarkFor(clientID string) string {
+	if !watermarkConfig.Enabled || clientID == "" {
+		return ""
+	}
+	return clientID
+}
+
+// drawWatermark blends a small label containing text onto img in place.
+func drawWatermark(img draw.Image, text string) {
+	face := basicfont.Face7x13
+	b := img.Bounds()
+	textW := font.MeasureString(face, text).Ceil()
+	metrics := face.Metrics()
+	textH := (metrics.Ascent + metrics.Descent).Ceil()
+	boxW := textW + 2*watermarkMargin
+	boxH := textH + 2*watermarkMargin
+	if boxW > b.Dx() || boxH > b.Dy() {
+		return
+	}
+
+	var x, y int
+	switch watermarkConfig.Position {
+	case "top-left":
+		x, y = b.Min.X, b.Min.Y
+	case "top-right":
+		x, y = b.Max.X-boxW, b.Min.Y
+	case "bottom-left":
+		x, y = b.Min.X, b.Max.Y-boxH
+	case "center":
+		x, y = b.Min.X+(b.Dx()-boxW)/2, b.Min.Y+(b.Dy()-boxH)/2
+	default:
+		x, y = b.Max.X-boxW, b.Max.Y-boxH
+	}
+	box := image.Rect(x, y, x+boxW, y+boxH)
+
+	// Render the label on its own layer, then composite with the configured opacity.
+	label := image.NewRGBA(image.Rect(0, 0, boxW, boxH))
+	draw.Draw(label, label.Bounds(), image.NewUniform(color.RGBA{A: 255}), image.Point{}, draw.Src)
+	d := &font.Drawer{
+		Dst:  label,
+		Src:  image.NewUniform(color.White),
+		Face: face,
+		Dot:  fixed.P(watermarkMargin, watermarkMargin+metrics.Ascent.Ceil()),
+	}
+	d.DrawString(text)
+
+	mask := image.NewUniform(color.Alpha{A: uint8(watermarkConfig.Opacity * 255)})
+	draw.DrawMask(img, box, label, image.Point{}, mask, image.Point{}, draw.Over)
+}
+
+// watermarkImage stamps src and returns it. A src that is already a
+// draw.Image is modified in place; anything else is copied to RGBA first.
+func watermarkImage(src image.Image, text string) image.Image {
+	dst, ok := src.(draw.Image)
+	if !ok {
+		rgba := image.NewRGBA(src.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+		dst = rgba
+	}
+	drawWatermark(dst, text)
+	return dst
+}
+
+// watermarkJPEG decodes a JPEG frame, stamps it and re-encodes it.
+func watermarkJPEG(frame []byte, text string) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(withDefaultHuffman(frame)))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, watermarkImage(img, text), &jpeg.Options{Quality: watermarkConfig.Quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+// --- WEB OF THINGS ---
+// GET /.well-known/wot describes the camera as a W3C Web of Things Thing
+// Description (TD 1.1, application/td+json), so WoT platforms can drive it
+// without a custom adapter. Status, snapshots, the MJPEG stream and the
+// other readable endpoints are properties; starting, stopping and
+// reconfiguring capture, playback and stream tokens are actions. The one
+// event is "barcode" (GET /barcodes/events, Server-Sent Events), present
+// while BARCODE_SCAN is on; the timeline is the read-only "events"
+// property (GET /events).
+//
+// With API_KEYS set the TD declares bearer authentication, and the
+// snapshot and stream forms accept a ?token= stream token instead.
+
+type tdMap = map[string]interface{}
+
+func tdForm(href string, op interface{}, method, contentType string) tdMap {
+	f := tdMap{"href": href, "op": op, "contentType": contentType}
+	if method != "" {
+		f["htv:methodName"] = method
+	}
+	return f
+}
+
+// tdReadOnly is a JSON property read with GET.
+func tdReadOnly(title, href string) tdMap {
+	return tdMap{"title": title, "type": "object", "readOnly": true,
+		"forms": []tdMap{tdForm(href, "readproperty", "", "application/json")}}
+}
+
+func tdFrameVars() tdMap {
+	return tdMap{
+		"width":  tdMap{"type": "integer", "minimum": 1, "maximum": maxFrameWidth},
+		"height": tdMap{"type": "integer", "minimum": 1, "maximum": maxFrameHeight},
+		"fps":    tdMap{"type": "integer", "minimum": 1, "maximum": maxFrameRate},
+	}
+}
+
+func thingDescription(r *http.Request) tdMap {
+	host, _ := os.Hostname()
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	td := tdMap{
+		"@context":    []interface{}{"https://www.w3.org/2022/wot/td/v1.1", tdMap{"htv": "http://www.w3.org/2011/http#"}},
+		"@type":       "Thing",
+		"id":          "urn:camera-driver:" + host + ":" + cameraConfig.deviceID(),
+		"title":       "camera " + cameraConfig.deviceID(),
+		"description": "USB camera (" + captureBackend() + " backend)",
+		"version":     tdMap{"instance": version},
+		"base":        scheme + "://" + r.Host + httpBasePath + "/",
+	}
+	// Properties and actions inherit the Thing's security; the media forms
+	// override it to allow stream tokens as well.
+	var media []string
+	if authEnabled() {
+		td["securityDefinitions"] = tdMap{
+			"bearer_sc": tdMap{"scheme": "bearer", "in": "header", "name": "Authorization"},
+			"token_sc":  tdMap{"scheme": "apikey", "in": "query", "name": "token", "description": "stream token from POST /tokens"},
+			"media_sc":  tdMap{"scheme": "combo", "oneOf": []string{"bearer_sc", "token_sc"}},
+		}
+		td["security"], media = "bearer_sc", []string{"media_sc"}
+	} else {
+		td["securityDefinitions"] = tdMap{"nosec_sc": tdMap{"scheme": "nosec"}}
+		td["security"], media = "nosec_sc", []string{"nosec_sc"}
+	}
+
+	mediaForm := func(href, contentType string) tdMap {
+		f := tdForm(href, "readproperty", "", contentType)
+		f["security"] = media
+		return f
+	}
+	calibration := tdMap{"title": "Lens calibration profile", "type": "object",
+		"forms": []tdMap{tdForm("calibration", "readproperty", "", "application/json"), tdForm("calibration", "writeproperty", "POST", "application/json")}}
+	td["properties"] = tdMap{
+		"status":      tdReadOnly("Camera status", "status/all"),
+		"snapshot":    tdMap{"title": "Current frame", "readOnly": true, "forms": []tdMap{mediaForm("snapshot", "image/jpeg"), mediaForm("snapshot?full_res=true", "image/jpeg")}},
+		"stream":      tdMap{"title": "Live stream", "readOnly": true, "forms": []tdMap{mediaForm("stream", "multipart/x-mixed-replace")}},
+		"events":      tdReadOnly("Event timeline", "events"),
+		"image_stats": tdReadOnly("Brightness statistics of the next frame", "stats/image"),
+		"playback":    tdReadOnly("Clip playback", "playback"),
+		"calibration": calibration,
+		"annotations": tdReadOnly("Markers drawn on the stream", "annotations"),
+		"streams":     tdReadOnly("Open streams and their quality tiers", "streams"),
+		"rois":        tdReadOnly("Regions of interest", "rois"),
+		"video_nodes": tdReadOnly("V4L2 device nodes and their capabilities", "video-nodes"),
+		"version":     tdReadOnly("Build and update information", "version"),
+		"sync":        tdReadOnly("Frame timing of this camera and its SYNC_PEERS", "sync/status"),
+	}
+	if gauge != nil {
+		td["properties"].(tdMap)["gauge"] = tdReadOnly("Latest gauge reading", "gauge")
+	}
+	if clipConfig.Seconds > 0 {
+		td["properties"].(tdMap)["clip"] = tdMap{"title": "The last seconds of video", "readOnly": true,
+			"uriVariables": tdMap{"seconds": tdMap{"type": "integer", "minimum": 1, "maximum": clipConfig.Seconds},
+				"width": tdMap{"type": "integer", "minimum": 16, "maximum": maxFrameWidth}},
+			"forms": []tdMap{mediaForm("clip.gif{?seconds,width}", "image/gif"), mediaForm("clip.mp4{?seconds,width}", "video/mp4")}}
+	}
+
+	start := tdForm("capture/start{?format,width,height,fps}", "invokeaction", "", "application/json")
+	startVars := tdFrameVars()
+	startVars["format"] = tdMap{"type": "string", "enum": []string{"MJPEG", "YUYV"}}
+	td["actions"] = tdMap{
+		"start_capture": tdMap{"title": "Open the camera and start capturing", "uriVariables": startVars, "forms": []tdMap{start}},
+		"stop_capture":  tdMap{"title": "Stop capturing and close the camera", "forms": []tdMap{tdForm("capture/stop", "invokeaction", "", "application/json")}},
+		"reconfigure": tdMap{"title": "Change the frame size or rate while capturing", "uriVariables": tdFrameVars(),
+			"forms": []tdMap{tdForm("capture/reconfigure{?width,height,fps}", "invokeaction", "", "application/json")}},
+		"start_playback": tdMap{"title": "Play an MJPEG clip in place of the camera",
+			"uriVariables": tdMap{"path": tdMap{"type": "string", "description": "clip under PLAYBACK_DIR; otherwise the clip is the request body"}},
+			"forms":        []tdMap{tdForm("playback/start{?path}", "invokeaction", "", "application/json")}},
+		"stop_playback": tdMap{"title": "Return to the camera", "forms": []tdMap{tdForm("playback/stop", "invokeaction", "", "application/json")}},
+		"annotate": tdMap{"title": "Draw a marker on the stream for a while",
+			"input": tdMap{"type": "object", "required": []string{"shape", "x", "y"}, "properties": tdMap{
+				"shape": tdMap{"type": "string", "enum": []string{"box", "arrow", "text"}},
+				"x":     tdMap{"type": "number", "minimum": 0, "maximum": 1}, "y": tdMap{"type": "number", "minimum": 0, "maximum": 1},
+				"width": tdMap{"type": "number"}, "height": tdMap{"type": "number"}, "x2": tdMap{"type": "number"}, "y2": tdMap{"type": "number"},
+				"text": tdMap{"type": "string"}, "color": tdMap{"type": "string"},
+				"seconds": tdMap{"type": "integer", "minimum": 1, "maximum": maxAnnotationSeconds}}},
+			"forms": []tdMap{tdForm("annotations", "invokeaction", "", "application/json")}},
+		"clear_annotations": tdMap{"title": "Remove all markers", "forms": []tdMap{tdForm("annotations", "invokeaction", "DELETE", "application/json")}},
+		"mint_token": tdMap{"title": "Issue a stream token",
+			"input": tdMap{"type": "object", "properties": tdMap{"path": tdMap{"type": "string"}, "ttl_seconds": tdMap{"type": "integer", "minimum": 1}}},
+			"forms": []tdMap{tdForm("tokens", "invokeaction", "", "application/json")}},
+	}
+	if !authEnabled() {
+		delete(td["actions"].(tdMap), "mint_token") // tokens only matter with API_KEYS
+	}
+	td["events"] = tdMap{}
+	if barcodes != nil {
+		td["events"] = tdMap{"barcode": tdMap{"title": "Barcode or QR code read", "data": tdMap{"type": "object"},
+			"forms": []tdMap{{"href": "barcodes/events", "op": "subscribeevent", "subprotocol": "sse", "contentType": "text/event-stream"}}}}
+	}
+	return td
+}
+
+func handleThingDescription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/td+json")
+	_ = json.NewEncoder(w).Encode(thingDescription(r))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestThingDescription(t *testing.T) {
+	savedKeys := apiKeys
+	defer func() { apiKeys = savedKeys }()
+
+	type form struct {
+		Href     string   `json:"href"`
+		Type     string   `json:"contentType"`
+		Security []string `json:"security"`
+	}
+	type affordance struct {
+		Forms []form `json:"forms"`
+	}
+	var td struct {
+		Base       string                `json:"base"`
+		Security   string                `json:"security"`
+		Properties map[string]affordance `json:"properties"`
+		Actions    map[string]affordance `json:"actions"`
+	}
+	get := func() {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handleThingDescription(rec, httptest.NewRequest(http.MethodGet, "http://cam.local:8080/.well-known/wot", nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/td+json" {
+			t.Fatalf("GET /.well-known/wot = %d %s", rec.Code, rec.Header().Get("Content-Type"))
+		}
+		td.Properties, td.Actions = nil, nil
+		if err := json.Unmarshal(rec.Body.Bytes(), &td); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	apiKeys = map[string]string{}
+	get()
+	if td.Base != "http://cam.local:8080/" || td.Security != "nosec_sc" {
+		t.Errorf("base %q, security %q", td.Base, td.Security)
+	}
+	if f := td.Properties["snapshot"].Forms; len(f) != 2 || f[0].Type != "image/jpeg" {
+		t.Errorf("snapshot forms = %+v", f)
+	}
+	if f := td.Actions["start_capture"].Forms; len(f) != 1 || f[0].Href != "capture/start{?format,width,height,fps}" {
+		t.Errorf("start_capture forms = %+v", f)
+	}
+	if _, ok := td.Actions["mint_token"]; ok {
+		t.Error("mint_token without API_KEYS")
+	}
+
+	// With API keys, media forms also take a stream token.
+	apiKeys = map[string]string{"k-ops": "ops"}
+	get()
+	if td.Security != "bearer_sc" {
+		t.Errorf("security = %q", td.Security)
+	}
+	if f := td.Properties["stream"].Forms; len(f) != 1 || len(f[0].Security) != 1 || f[0].Security[0] != "media_sc" {
+		t.Errorf("stream forms = %+v", f)
+	}
+	if _, ok := td.Actions["mint_token"]; !ok {
+		t.Error("mint_token missing with API_KEYS")
+	}
+}